@@ -0,0 +1,267 @@
+package app
+
+import (
+	"fmt"
+	"llm-router/client"
+	"llm-router/server"
+	"strings"
+	"time"
+)
+
+// adminHandlers returns the callbacks serving the admin API
+func (a *App) adminHandlers() *server.AdminHandlers {
+	handlers := &server.AdminHandlers{
+		Groups:        a.adminGroups,
+		Providers:     a.adminProviders,
+		KeyStatus:     a.keyStatus,
+		SetKeyDrained: a.setKeyDrained,
+		SnapshotUsage: a.snapshotUsage,
+		RestoreUsage:  a.restoreUsage,
+		// Changes to the configuration, persisted to overlay_file
+		AddKey:          a.addKey,
+		RemoveKey:       a.removeKey,
+		SetModelWeight:  a.setModelWeight,
+		SetGroupEnabled: a.setGroupEnabled,
+		ConfigStatus:    a.configStatus,
+	}
+	if a.ledger != nil {
+		handlers.Requests = a.ledger.Entries
+		handlers.RequestUsage = a.ledger.Usage
+	}
+	if a.auditLog != nil {
+		handlers.Audit = a.audit
+	}
+	if a.metrics != nil {
+		handlers.Metrics = a.metrics.registry.Catalog
+	}
+	return handlers
+}
+
+// adminGroups describes the configured groups
+func (a *App) adminGroups() []server.AdminGroup {
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	groups := make([]server.AdminGroup, 0, len(a.Groups))
+	for _, g := range a.Groups {
+		group := server.AdminGroup{Name: g.Name, Models: make([]server.AdminModel, 0, len(g.Models))}
+		for _, m := range g.Models {
+			group.Models = append(group.Models, server.AdminModel{
+				Provider:      m.Provider,
+				Name:          m.Name,
+				Weight:        m.Weight,
+				ContextWindow: m.ContextWindow,
+				Capabilities:  m.Capabilities,
+			})
+		}
+		groups = append(groups, group)
+	}
+	for _, g := range a.Config.Groups {
+		if g.Disabled {
+			group := server.AdminGroup{Name: g.Name, Models: make([]server.AdminModel, 0, len(g.Models)), Disabled: true}
+			for _, m := range g.Models {
+				group.Models = append(group.Models, server.AdminModel{Provider: m.Provider, Name: m.Name, Weight: m.Weight})
+			}
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// adminProviders describes the providers with the health, state, and usage of their keys
+func (a *App) adminProviders() []server.AdminProvider {
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	providers := make([]server.AdminProvider, 0, len(a.Providers))
+	for _, p := range a.Providers {
+		provider := server.AdminProvider{Name: p.Name, BaseURL: p.BaseURL, Keys: make([]server.AdminKey, 0), Streaming: a.streamStats.provider(p.Name)}
+		if pClient, exists := a.clients[p.Name]; exists {
+			for i, kClient := range pClient.KeyClients {
+				health := kClient.Health()
+				key := server.AdminKey{
+					Index:     i,
+					Key:       redactKey(kClient.APIKey),
+					Status:    server.KeyStatusActive,
+					Requests:  health.Requests,
+					Errors:    health.Errors,
+					LastError: health.LastError,
+					Free:      kClient.Free,
+					Usage:     kClient.ModelUsage(),
+					Cost:      kClient.ModelCost(),
+					Tokens:    make(map[string]server.AdminTokens),
+				}
+				for model, tokens := range kClient.ModelTokenUsage() {
+					key.Tokens[model] = server.AdminTokens(tokens)
+				}
+				if health.Drained {
+					key.Status = server.KeyStatusDrained
+				}
+				if !health.LastErrorAt.IsZero() {
+					key.LastErrorAt = &health.LastErrorAt
+				}
+				if time.Now().Before(health.RateLimitedUntil) {
+					key.RateLimitedUntil = &health.RateLimitedUntil
+				}
+				provider.Keys = append(provider.Keys, key)
+			}
+		}
+		providers = append(providers, provider)
+	}
+	return providers
+}
+
+// keyStatus reports the health, circuit, and budgets of every provider key, and why those not routed to are not
+func (a *App) keyStatus() []server.AdminKeyStatus {
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	keys := make([]server.AdminKeyStatus, 0)
+	for _, p := range a.Providers {
+		pClient, exists := a.clients[p.Name]
+		if !exists {
+			continue
+		}
+		for i, kClient := range pClient.KeyClients {
+			health := kClient.Health()
+			key := server.AdminKeyStatus{
+				Alias:     providerKeyID(p.Name, kClient),
+				Provider:  p.Name,
+				Index:     i,
+				Key:       redactKey(kClient.APIKey),
+				Free:      kClient.Free,
+				Tenant:    kClient.Tenant,
+				Status:    server.KeyStatusActive,
+				Health:    server.KeyHealthUnknown,
+				Circuit:   server.CircuitClosed,
+				Requests:  health.Requests,
+				Errors:    health.Errors,
+				LastError: health.LastError,
+			}
+			if health.Drained {
+				key.Status = server.KeyStatusDrained
+			}
+			if probe := health.Probe; probe != nil {
+				key.Health = server.KeyHealthHealthy
+				if !probe.Reachable || !probe.Valid {
+					key.Health = server.KeyHealthUnhealthy
+					key.HealthError = probe.Error
+				}
+			}
+			if time.Now().Before(health.RateLimitedUntil) {
+				key.Circuit = server.CircuitOpen
+				key.CircuitOpenUntil = &health.RateLimitedUntil
+			}
+			if !health.LastErrorAt.IsZero() {
+				key.LastErrorAt = &health.LastErrorAt
+			}
+			// Paid keys are still routed to while their circuit is open, except by groups with the cheapest strategy
+			switch {
+			case health.Drained:
+				key.Unavailable = skipDrained
+			case kClient.Free && key.Circuit == server.CircuitOpen:
+				key.Unavailable = skipRateLimited
+			case !a.keyWithinBudget(p.Name, kClient):
+				key.Unavailable = skipKeyBudget
+			}
+			for _, b := range a.budgets.Usage(providerKey(p.Name, kClient)) {
+				key.Budgets = append(key.Budgets, server.AdminBudgetUsage{
+					Scope:       b.Budget.Scope.String(),
+					Period:      b.Budget.Period,
+					Tokens:      b.Spent.TotalTokens,
+					TokensLimit: b.Budget.Tokens,
+					Cost:        b.Spent.Cost,
+					CostLimit:   b.Budget.Cost,
+					ResetsAt:    b.Reset,
+				})
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// setKeyDrained drains or undrains a provider key, returning false if it does not exist
+func (a *App) setKeyDrained(provider string, index int, drained bool) bool {
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	pClient, exists := a.clients[provider]
+	if !exists || index < 0 || index >= len(pClient.KeyClients) {
+		return false
+	}
+	pClient.KeyClients[index].SetDrained(drained)
+	return true
+}
+
+// snapshotUsage returns the usage counted for every provider key
+func (a *App) snapshotUsage() server.AdminUsageSnapshot {
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	snapshot := server.AdminUsageSnapshot{
+		Object:    "usage_snapshot",
+		CreatedAt: time.Now().Unix(),
+		Providers: make([]server.AdminProviderUsage, 0, len(a.Providers)),
+	}
+	for _, p := range a.Providers {
+		provider := server.AdminProviderUsage{Name: p.Name, Keys: make([]server.AdminKeyUsage, 0)}
+		if pClient, exists := a.clients[p.Name]; exists {
+			for i, kClient := range pClient.KeyClients {
+				usage := kClient.SnapshotUsage()
+				key := server.AdminKeyUsage{
+					Index:  i,
+					Key:    redactKey(kClient.APIKey),
+					Usage:  usage.Usage,
+					Tokens: make(map[string]server.AdminTokens, len(usage.Tokens)),
+					Cost:   usage.Cost,
+				}
+				for model, tokens := range usage.Tokens {
+					key.Tokens[model] = server.AdminTokens(tokens)
+				}
+				provider.Keys = append(provider.Keys, key)
+			}
+		}
+		snapshot.Providers = append(snapshot.Providers, provider)
+	}
+	return snapshot
+}
+
+// restoreUsage sets the usage of the keys and models in a snapshot. It checks every key first and restores
+// none if one does not exist or, when the snapshot has its redacted key, is not the same key.
+func (a *App) restoreUsage(snapshot server.AdminUsageSnapshot) error {
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	type restore struct {
+		kClient *client.KeyClient
+		usage   client.UsageSnapshot
+	}
+	var restores []restore
+	for _, provider := range snapshot.Providers {
+		pClient, exists := a.clients[provider.Name]
+		if !exists {
+			return fmt.Errorf("unknown provider %q", provider.Name)
+		}
+		for _, key := range provider.Keys {
+			if key.Index < 0 || key.Index >= len(pClient.KeyClients) {
+				return fmt.Errorf("no key %d for provider %q", key.Index, provider.Name)
+			}
+			kClient := pClient.KeyClients[key.Index]
+			if key.Key != "" && key.Key != redactKey(kClient.APIKey) {
+				return fmt.Errorf("key %d of provider %q is %s, not %s", key.Index, provider.Name, redactKey(kClient.APIKey), key.Key)
+			}
+			usage := client.UsageSnapshot{Usage: key.Usage, Tokens: make(map[string]client.TokenUsage, len(key.Tokens)), Cost: key.Cost}
+			for model, tokens := range key.Tokens {
+				usage.Tokens[model] = client.TokenUsage(tokens)
+			}
+			restores = append(restores, restore{kClient: kClient, usage: usage})
+		}
+	}
+	for _, r := range restores {
+		r.kClient.RestoreUsage(r.usage)
+	}
+	return nil
+}
+
+// redactKey shows only the first 3 and last 4 characters of a provider API key
+func redactKey(key string) string {
+	if len(key) > 12 {
+		return key[:3] + "..." + key[len(key)-4:]
+	}
+	return strings.Repeat("*", len(key))
+}
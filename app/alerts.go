@@ -0,0 +1,173 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"llm-router/config"
+	"llm-router/usage"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// defaultAlertThresholds are the budget percentages notified when none are configured
+var defaultAlertThresholds = []float64{50, 80, 100}
+
+// webhookTimeout bounds the delivery of a notification to a webhook
+const webhookTimeout = 10 * time.Second
+
+// budgetAlert is the JSON payload of budget notifications
+type budgetAlert struct {
+	Type      string  `json:"type"`
+	Scope     string  `json:"scope"`
+	Group     string  `json:"group,omitempty"`
+	Provider  string  `json:"provider,omitempty"`
+	APIKeyID  string  `json:"api_key_id,omitempty"`
+	Model     string  `json:"model,omitempty"`
+	Tenant    string  `json:"tenant,omitempty"`
+	Period    string  `json:"period"`
+	Threshold float64 `json:"threshold"`
+	// Limits and usage of the current period; zero limits are unlimited
+	TokenLimit int64   `json:"token_limit,omitempty"`
+	CostLimit  float64 `json:"cost_limit,omitempty"`
+	Tokens     int64   `json:"tokens"`
+	Cost       float64 `json:"cost"`
+	// The request usage that crossed the threshold
+	Trigger budgetAlertTrigger `json:"trigger"`
+	Time    time.Time          `json:"time"`
+}
+
+type budgetAlertTrigger struct {
+	Group    string `json:"group,omitempty"`
+	APIKeyID string `json:"api_key_id"`
+	Model    string `json:"model"`
+}
+
+// notifyBudgetAlert logs a budget threshold crossing and posts it to the configured webhooks in the background
+func (a *App) notifyBudgetAlert(alert usage.Alert) {
+	payload := budgetAlert{
+		Type:       "budget.threshold",
+		Scope:      alert.Budget.Scope.String(),
+		Group:      alert.Budget.Scope.Group,
+		Provider:   alert.Budget.Scope.Provider,
+		APIKeyID:   alert.Budget.Scope.KeyID,
+		Model:      alert.Budget.Scope.Model,
+		Tenant:     alert.Budget.Scope.Tenant,
+		Period:     alert.Budget.Period,
+		Threshold:  alert.Threshold,
+		TokenLimit: alert.Budget.Tokens,
+		CostLimit:  alert.Budget.Cost,
+		Tokens:     alert.Spent.TotalTokens,
+		Cost:       alert.Spent.Cost,
+		Trigger: budgetAlertTrigger{
+			Group:    alert.Key.Group,
+			APIKeyID: usage.KeyID(alert.Key.Provider, alert.Key.KeyHash),
+			Model:    alert.Key.Model,
+		},
+		Time: time.Now().UTC(),
+	}
+	a.Logger.Warn("Budget threshold crossed",
+		slog.String("scope", payload.Scope),
+		slog.String("period", payload.Period),
+		slog.Float64("threshold", payload.Threshold),
+		slog.String("key", payload.Trigger.APIKeyID),
+		slog.String("model", payload.Trigger.Model))
+
+	for _, webhook := range a.Config.BudgetAlerts.Webhooks {
+		go func() {
+			if err := postWebhook(webhook, payload); err != nil {
+				a.Logger.Error("Failed to deliver budget alert", slog.String("url", webhook.URL), slog.Any("error", err))
+			}
+		}()
+	}
+}
+
+// notification is the payload of an alert posted to webhooks, as JSON or as its text for chat notifications
+type notification interface {
+	text() string
+}
+
+// postWebhook delivers an alert in the webhook's format
+func postWebhook(webhook config.Webhook, alert notification) error {
+	var body []byte
+	var err error
+	if webhook.Format == "slack" {
+		body, err = json.Marshal(map[string]string{"text": alert.text()})
+	} else {
+		body, err = json.Marshal(alert)
+	}
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	return postJSON(ctx, webhook, body)
+}
+
+// postJSON posts a JSON body to a webhook with its headers
+func postJSON(ctx context.Context, webhook config.Webhook, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range webhook.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// text describes the alert for chat notifications
+func (b budgetAlert) text() string {
+	limit := fmt.Sprintf("%d tokens", b.TokenLimit)
+	used := fmt.Sprintf("%d tokens", b.Tokens)
+	if b.CostLimit > 0 {
+		limit = fmt.Sprintf("$%.2f", b.CostLimit)
+		used = fmt.Sprintf("$%.2f", b.Cost)
+	}
+	trigger := "key " + b.Trigger.APIKeyID + ", model " + b.Trigger.Model
+	if b.Trigger.Group != "" {
+		trigger = "group " + b.Trigger.Group + ", " + trigger
+	}
+	period := "daily"
+	if b.Period == usage.PeriodMonth {
+		period = "monthly"
+	}
+	return fmt.Sprintf(":warning: LLM Router: %s reached %g%% of its %s budget (%s of %s), triggered by %s",
+		b.Scope, b.Threshold, period, used, limit, trigger)
+}
+
+// errorRateAlert is the JSON payload of error rate notifications, raised with type error_rate.threshold and
+// resolved with type error_rate.resolved
+type errorRateAlert struct {
+	Type      string  `json:"type"`
+	Provider  string  `json:"provider"`
+	ErrorRate float64 `json:"error_rate"`
+	Threshold float64 `json:"threshold"`
+	// Requests and errors within the window
+	Requests      int       `json:"requests"`
+	Errors        int       `json:"errors"`
+	WindowSeconds int64     `json:"window_seconds"`
+	Time          time.Time `json:"time"`
+}
+
+// text describes the alert for chat notifications
+func (e errorRateAlert) text() string {
+	window := time.Duration(e.WindowSeconds) * time.Second
+	if e.Type == "error_rate.resolved" {
+		return fmt.Sprintf(":white_check_mark: LLM Router: provider %s is back under its error rate threshold of %g%%, with %d of %d requests failed in the last %s",
+			e.Provider, e.Threshold*100, e.Errors, e.Requests, window)
+	}
+	return fmt.Sprintf(":rotating_light: LLM Router: %.0f%% of the requests to provider %s failed in the last %s (%d of %d), over its threshold of %g%%",
+		e.ErrorRate*100, e.Provider, window, e.Errors, e.Requests, e.Threshold*100)
+}
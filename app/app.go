@@ -2,14 +2,29 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"llm-router/client"
 	"llm-router/config"
+	"llm-router/ledger"
+	"llm-router/secrets"
 	"llm-router/server"
+	"llm-router/tracing"
+	"llm-router/usage"
+	"llm-router/utils"
 	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/redis/go-redis/v9"
 	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type App struct {
@@ -19,70 +34,634 @@ type App struct {
 	Groups    []*Group
 	Providers []*Provider
 	clients   map[string]*client.ProviderClient
+	startedAt time.Time
+	// tokenizers by encoding name
+	tokenizers map[string]*utils.Tokenizer
+	// usage history
+	usage *usage.Store
+	// usage of the current budget periods
+	budgets *usage.Budgets
+	// record of every request, nil when disabled
+	ledger *ledger.Ledger
+	// record of the changes made through the admin API and by reloads, nil when disabled
+	auditLog *auditLog
+	// usage counters exposed to Prometheus
+	metrics *usageMetrics
+	// events of completed requests shipped to external sinks, nil when disabled
+	events *usageEvents
+	// subscribers to the lifecycle events of requests
+	lifecycle lifecycle
+	// exporter of the spans of requests, nil when tracing is disabled
+	tracer *tracing.Tracer
+	// recorder of the transcripts of the requests with capture set, nil when no capture sink is configured
+	captures *captures
+	// time to first token and throughput of the streams of every provider and model
+	streamStats streamStats
+	// error rates of the providers alerted on
+	errorRates errorRates
+	// logger of the line of every HTTP request, nil when the access log is disabled
+	accessLog *slog.Logger
+	// files the logs and transcripts are appended to, rotated by the new process once handed over
+	rotatingFiles []*utils.RotatingFile
+	// redactor of the keys in the logs
+	redactor *redactor
+	// tenants by name
+	tenants map[string]*Tenant
+	// hash of the configuration reported by /version
+	configHash string
+	// Redis server shared with the other instances, nil when not configured
+	redis *redis.Client
+	// usage reset schedules by provider name
+	resetSchedules map[string]*resetSchedule
+	// resolver of the secrets referenced by provider keys
+	secrets *secrets.Resolver
+	// configuration last applied as loaded, without the overlay and with its provider keys still referencing
+	// secrets, guarded by reloading
+	loaded *config.Config
+	// changes made through the admin API applied over the loaded configuration, guarded by reloading
+	overlay *configOverlay
+
+	// listeners of the router's API, the admin API, and gRPC, handed over to a new process on SIGUSR2
+	listeners []net.Listener
+	// shutdown in progress, which Run waits for once Serve returns
+	stopping sync.WaitGroup
+	// usageSaves stops saving the usage history in the background once closed by shutdown
+	usageSaves chan struct{}
+	// usageHandover is the pipe the usage recorded after a handover is sent to the new process on
+	usageHandover *os.File
+
+	// outcome of the latest reload reported by the admin API
+	reloadStatus server.AdminConfigStatus
+
+	// reloadMutex protects Groups, Providers, clients, resetSchedules, configHash, reloadStatus, and the
+	// settings of Config applied by Reload, which reloading serializes
+	reloadMutex sync.RWMutex
+	reloading   sync.Mutex
 }
 
 // NewApp initializes the application with configuration, groups, providers, and clients
 func NewApp(cfg *config.Config) *App {
+	resolver := newSecretsResolver(cfg.Secrets)
+	overlay, overlayErr := loadOverlay(cfg.OverlayFile)
+	// Keys whose secrets cannot be resolved yet stay references until a refresh resolves them
+	resolved, secretsErr := resolveSecrets(resolver, overlay.apply(cfg))
+	clients, clientsErr := getClients(resolved)
 	app := &App{
-		Config:    cfg,
-		Groups:    getGroups(cfg),
-		Providers: getProviders(cfg),
-		clients:   getClients(cfg),
+		Config:       resolved,
+		Groups:       getGroups(resolved),
+		Providers:    getProviders(resolved),
+		tenants:      getTenants(resolved),
+		clients:      clients,
+		startedAt:    time.Now(),
+		configHash:   hashConfig(resolved),
+		reloadStatus: server.AdminConfigStatus{AppliedAt: time.Now().UTC()},
+		secrets:      resolver,
+		loaded:       cfg,
+		overlay:      overlay,
+	}
+	app.redactor = newRedactor(resolved)
+	logger, logFile, loggerErr := newLogger(cfg, app.redactor)
+	app.Logger = logger
+	app.addRotatingFile(logFile)
+	if loggerErr != nil {
+		app.Logger.Error("Failed to open log file, logging to standard output", slog.String("path", cfg.Logging.File), slog.Any("error", loggerErr))
+	}
+	accessLog, accessLogFile, accessLogErr := newAccessLogger(cfg, app.redactor)
+	app.accessLog = accessLog
+	app.addRotatingFile(accessLogFile)
+	if accessLogErr != nil {
+		app.Logger.Error("Failed to open access log file, logging requests to standard output", slog.String("path", cfg.Logging.AccessLog.File), slog.Any("error", accessLogErr))
+	}
+	if cfg.Features.EnableMetrics || cfg.StatsD.Address != "" {
+		app.metrics = newUsageMetrics()
+		app.startStatsD()
 	}
-	app.Logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	if overlayErr != nil {
+		app.Logger.Error("Failed to load overlay, ignoring it", slog.Any("error", overlayErr))
+	}
+	if secretsErr != nil {
+		app.Logger.Error("Failed to resolve secrets", slog.Any("error", secretsErr))
+	}
+	if clientsErr != nil {
+		app.Logger.Error("Failed to create provider clients", slog.Any("error", clientsErr))
+	}
+	problems := ValidateConfig(resolved)
+	app.logProblems(problems)
+	app.reloadStatus.Warnings = problemWarnings(problems)
+	app.tokenizers = app.loadTokenizers()
+	app.usage = app.loadUsageStore()
+	app.budgets = app.loadBudgets()
+	app.ledger = app.openLedger()
+	app.auditLog = app.openAuditLog()
+	app.events = app.startUsageEvents()
+	app.startLifecycleWebhooks()
+	app.captures = app.startCapture()
+	app.tracer = app.startTracing()
+	app.attachKeyClients(app.clients)
 	app.Server = app.getServer()
+	app.redis = app.connectRedis()
 	return app
 }
 
+// logLevels are the levels of the log_level settings
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// logLevel returns the level of a log_level setting, info when empty
+func logLevel(setting string) slog.Level {
+	if level, exists := logLevels[setting]; exists {
+		return level
+	}
+	return slog.LevelInfo
+}
+
+// attachKeyClients makes the key clients count tokens with the configured tokenizers and record their usage
+func (a *App) attachKeyClients(clients map[string]*client.ProviderClient) {
+	for _, pClient := range clients {
+		for _, kClient := range pClient.KeyClients {
+			kClient.CountTokens = a.countTokens
+			kClient.RecordUsage = a.usageRecorder(pClient.ProviderName, usage.KeyHash(kClient.APIKey))
+		}
+	}
+}
+
 // Run starts the server and begins handling requests
 func (a *App) Run() {
-	a.Logger.Info("Starting LLM Router", slog.Int64("port", a.Config.Port))
-	addr := fmt.Sprintf(":%d", a.Config.Port)
-	a.Server.ListenAndServe(addr)
+	a.Logger.Info("Starting LLM Router")
+	if a.Config.UsageFile != "" {
+		a.startUsagePersistence(usageSaveInterval)
+	}
+	a.startUsageResets()
+	if a.redis != nil {
+		interval := defaultRedisSyncInterval
+		if a.Config.Redis.SyncInterval > 0 {
+			interval = time.Duration(a.Config.Redis.SyncInterval) * time.Millisecond
+		}
+		a.startUsageSync(a.redis, interval)
+	}
+	if a.Config.Secrets.RefreshInterval > 0 {
+		a.startSecretsRefresh(time.Duration(a.Config.Secrets.RefreshInterval) * time.Second)
+	}
+	if a.Config.HealthCheckInterval > 0 {
+		a.startHealthProber(time.Duration(a.Config.HealthCheckInterval) * time.Second)
+	}
+	if err := a.Server.LoadCertificate(); err != nil {
+		a.Logger.Error("Failed to load the TLS certificate", slog.String("cert", a.Config.TLSCert), slog.Any("error", err))
+		os.Exit(1)
+	}
+	if err := inheritListeners(); err != nil {
+		a.Logger.Error("Failed to take over the listeners of the previous process", slog.Any("error", err))
+		os.Exit(1)
+	}
+	a.receiveUsage()
+	listeners, err := listenAll(a.Config)
+	if err != nil {
+		a.Logger.Error("Failed to listen", slog.Any("error", err))
+		os.Exit(1)
+	}
+	// The admin API is not served at all rather than with the router's API when its listener fails
+	adminListener, err := listenAdmin(a.Config)
+	if err != nil {
+		a.Logger.Error("Failed to listen for the admin API", slog.Any("error", err))
+		os.Exit(1)
+	}
+	a.Server.AdminListener = adminListener
+	acmeListener, err := listenACME(a.Config)
+	if err != nil {
+		a.Logger.Error("Failed to listen for the ACME challenge", slog.Any("error", err))
+		os.Exit(1)
+	}
+	a.Server.ACMEListener = acmeListener
+	for _, listener := range listeners {
+		a.listeners = append(a.listeners, listener.Listener)
+	}
+	if adminListener != nil {
+		a.listeners = append(a.listeners, adminListener)
+	}
+	if acmeListener != nil {
+		a.listeners = append(a.listeners, acmeListener)
+	}
+	if a.Config.GRPCPort != 0 {
+		if grpcListener, err := listenTCP(fmt.Sprintf(":%d", a.Config.GRPCPort)); err != nil {
+			a.Logger.Error("Failed to listen for gRPC", slog.Any("error", err))
+		} else {
+			a.listeners = append(a.listeners, grpcListener)
+			go func() {
+				if err := a.Server.ServeGRPC(grpcListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					a.Logger.Error("gRPC server stopped", slog.Any("error", err))
+				}
+			}()
+		}
+	}
+	a.watchSignals()
+	a.reportListening()
+	a.Server.Serve(listeners...)
+	// Serve returns as soon as a shutdown starts, which then waits for the requests in flight
+	a.stopping.Wait()
 }
 
 // HandleRequest processes chat completion requests
-func (a *App) HandleRequest(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionResponse, error) {
-	provider, model, keyClient, err := a.getClientForGroup(req.Model)
-	if err != nil {
-		a.Logger.Error("Failed to get client for group", slog.String("group", req.Model), slog.Any("error", err))
+func (a *App) HandleRequest(ctx context.Context, req openai.ChatCompletionRequest) (resp *client.ChatCompletionResponse, err error) {
+	start := time.Now()
+	groupName := a.resolveAlias(req.Model)
+	ctx, span := a.tracer.Start(ctx, "chat.completion", trace.SpanKindInternal, attribute.String("llm_router.group", groupName))
+	ctx = client.WithGroup(ctx, groupName)
+	ctx = withRequestUser(ctx, req.User)
+	ctx = a.sampleLogs(ctx)
+	var capture *transcript
+	if a.capturesRequest(ctx, groupName) {
+		capture = newTranscript(ctx, groupName, req)
+	}
+	a.publish(ctx, LifecycleEvent{Type: EventRequestStarted, Group: groupName})
+	// lastAttempt is when the last attempt at the request started
+	var lastAttempt time.Time
+	defer func() {
+		a.endLogSample(ctx, start, err)
+		a.recordRequest(ctx, start, groupName, resp, err)
+		var route client.Route
+		if resp != nil {
+			route = resp.Route
+		}
+		a.logSlowRequest(ctx, start, groupName, false, route, lastAttempt, time.Time{}, err)
+		if capture != nil {
+			var route client.Route
+			var completion *openai.ChatCompletionResponse
+			if resp != nil {
+				route, completion = resp.Route, &resp.ChatCompletionResponse
+			}
+			capture.end(start, route, completion, err)
+			a.captures.record(capture)
+		}
+		if resp != nil {
+			span.SetAttributes(append(routeAttributes(resp.Route), attribute.Int("llm_router.attempts", resp.Route.Attempts))...)
+		}
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+	tenant := client.TenantFromContext(ctx)
+	if err := a.tenantAllowsGroup(ctx, groupName); err != nil {
+		a.Logger.WarnContext(ctx, "Group not available to tenant", slog.String("tenant", tenant), slog.String("group", groupName))
 		return nil, err
 	}
-	a.Logger.Info("Routing request", slog.String("provider", provider), slog.String("model", model))
-
-	// Update the request model to the selected model
-	req.Model = model
-	resp, err := keyClient.ChatCompletion(ctx, req)
-	if err != nil {
-		a.Logger.Error("ChatCompletion error", slog.Any("error", err))
+	if err := a.clientWithinBudget(ctx); err != nil {
+		a.Logger.WarnContext(ctx, "Client key over budget", slog.String("client_key", client.ClientKeyFromContext(ctx)), slog.Any("error", err))
 		return nil, err
 	}
-	return resp, nil
+	excluded := make(map[candidate]bool)
+	// lastErr is the latest invalid response, retryErr the latest upstream error moved on from
+	var lastErr, retryErr error
+	failures := 0
+	// Requests keep the settings of their group as they started if the configuration is reloaded
+	a.reloadMutex.RLock()
+	a.applyGroupDefaults(groupName, &req)
+	validate := a.validatesResponseFormat(groupName) && req.ResponseFormat != nil
+	cheapest := a.routesCheapest(groupName)
+	var errorPenalty int64
+	if validate {
+		errorPenalty = a.Config.ErrorPenalty
+	}
+	a.reloadMutex.RUnlock()
+
+	for attempts := 1; ; attempts++ {
+		req.Model = groupName
+		explanation := a.newRouteExplanation(ctx)
+		provider, model, keyClient, keyID, err := a.tracedRouteAttempt(ctx, req, excluded, tenant, explanation)
+		if errors.Is(err, server.ErrRequestTooExpensive) {
+			a.Logger.WarnContext(ctx, "Request over the maximum cost", slog.String("group", groupName), slog.Any("error", err))
+			return nil, err
+		}
+		if err != nil {
+			if retryErr != nil {
+				return nil, retryErr
+			}
+			if lastErr != nil {
+				return nil, fmt.Errorf("no model produced a valid response: %w", lastErr)
+			}
+			a.Logger.ErrorContext(ctx, "Failed to get client for group", slog.String("group", groupName), slog.Any("error", err))
+			return nil, err
+		}
+		a.Logger.InfoContext(ctx, "Routing request", slog.String("provider", provider), slog.String("model", model), slog.String("client_key", client.ClientKeyFromContext(ctx)), slog.String("tenant", tenant))
+
+		// Update the request model to the selected model, bounding the attempt with the provider's timeout
+		req.Model = model
+		limits := a.providerLimits(provider)
+		attemptCtx, cancel := attemptContext(ctx, limits.RequestTimeout)
+		attemptStart := time.Now()
+		lastAttempt = attemptStart
+		attemptRoute := client.Route{Provider: provider, Model: model, KeyID: keyID, Attempts: attempts}
+		a.publishAttempt(ctx, EventRouteSelected, groupName, false, attemptRoute, nil)
+		attemptCtx, attemptSpan := a.startAttemptSpan(attemptCtx, attemptRoute)
+		resp, err := keyClient.ChatCompletion(attemptCtx, req)
+		tracing.RecordError(attemptSpan, err)
+		attemptSpan.End()
+		a.observeAttempt(attemptStart, groupName, attemptRoute, err)
+		timedOut := ctx.Err() == nil && (errors.Is(attemptCtx.Err(), context.DeadlineExceeded) || isTimeout(err))
+		cancel()
+		if err != nil && timedOut {
+			err = fmt.Errorf("provider %s did not respond within %s: %w", provider, limits.RequestTimeout, err)
+		}
+		if err != nil {
+			a.publishAttempt(ctx, EventAttemptFailed, groupName, false, attemptRoute, err)
+		}
+		if err != nil && a.retryAttempt(ctx, false, keyClient, attemptRoute, err, timedOut, &failures, cheapest) {
+			excluded[candidate{keyClient: keyClient, model: model}] = true
+			retryErr = err
+			continue
+		}
+		if err != nil {
+			a.Logger.ErrorContext(ctx, "ChatCompletion error", slog.Any("error", err), upstreamIDsAttr(client.UpstreamIDs(err)))
+			return nil, err
+		}
+		resp.Route = client.Route{Provider: provider, Model: model, KeyID: keyID, Attempts: attempts, UpstreamIDs: resp.UpstreamIDs}
+		if client.RouteExplanationRequested(ctx) {
+			resp.Route.Candidates = explanation.list()
+		}
+		if !validate {
+			return resp, nil
+		}
+
+		// Retry with another model/key when the response does not follow the requested format
+		lastErr = validateResponseFormat(req.ResponseFormat, resp)
+		if lastErr == nil {
+			return resp, nil
+		}
+		a.Logger.WarnContext(ctx, "Response does not match response_format", slog.String("provider", provider), slog.String("model", model), slog.Any("error", lastErr))
+		a.publishAttempt(ctx, EventAttemptFailed, groupName, false, attemptRoute, lastErr)
+		keyClient.PenalizeError(model, errorPenalty)
+		excluded[candidate{keyClient: keyClient, model: model}] = true
+	}
 }
 
 // HandleStreamRequest processes streaming chat completion requests
 func (a *App) HandleStreamRequest(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionStream, error) {
-	provider, model, keyClient, err := a.getClientForGroup(req.Model)
-	if err != nil {
-		a.Logger.Error("Failed to get client for group", slog.String("group", req.Model), slog.Any("error", err))
+	start := time.Now()
+	groupName := a.resolveAlias(req.Model)
+	// The span lasts as long as the stream, ending when it is closed
+	ctx, span := a.tracer.Start(ctx, "chat.completion", trace.SpanKindInternal, attribute.String("llm_router.group", groupName), attribute.Bool("llm_router.stream", true))
+	ctx = withRequestUser(ctx, req.User)
+	ctx = a.sampleLogs(ctx)
+	tenant := client.TenantFromContext(ctx)
+	var capture *transcript
+	if a.capturesRequest(ctx, groupName) {
+		capture = newTranscript(ctx, groupName, req)
+		capture.Stream = true
+	}
+	a.publish(ctx, LifecycleEvent{Type: EventRequestStarted, Group: groupName, Stream: true})
+	fail := func(err error) (*client.ChatCompletionStream, error) {
+		a.endLogSample(ctx, start, err)
+		a.recordStream(ctx, start, groupName, nil, err)
+		a.logSlowRequest(ctx, start, groupName, true, client.Route{}, time.Time{}, time.Time{}, err)
+		if capture != nil {
+			capture.end(start, client.Route{}, nil, err)
+			a.captures.record(capture)
+		}
+		tracing.RecordError(span, err)
+		span.End()
 		return nil, err
 	}
-	a.Logger.Info("Routing streaming request", slog.String("provider", provider), slog.String("model", model))
-
-	// Update the request model to the selected model
-	req.Model = model
+	if err := a.tenantAllowsGroup(ctx, groupName); err != nil {
+		a.Logger.WarnContext(ctx, "Group not available to tenant", slog.String("tenant", tenant), slog.String("group", groupName))
+		return fail(err)
+	}
+	if err := a.clientWithinBudget(ctx); err != nil {
+		a.Logger.WarnContext(ctx, "Client key over budget", slog.String("client_key", client.ClientKeyFromContext(ctx)), slog.Any("error", err))
+		return fail(err)
+	}
+	ctx = client.WithGroup(ctx, groupName)
 	// Ensure usage info is included in the stream
 	req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
-	stream, err := keyClient.ChatCompletionStream(ctx, req)
+	excluded := make(map[candidate]bool)
+	// retryErr is the latest upstream error moved on from
+	var retryErr error
+	failures := 0
+	a.reloadMutex.RLock()
+	a.applyGroupDefaults(groupName, &req)
+	cheapest := a.routesCheapest(groupName)
+	a.reloadMutex.RUnlock()
+
+	for attempts := 1; ; attempts++ {
+		req.Model = groupName
+		explanation := a.newRouteExplanation(ctx)
+		provider, model, keyClient, keyID, err := a.tracedRouteAttempt(ctx, req, excluded, tenant, explanation)
+		if errors.Is(err, server.ErrRequestTooExpensive) {
+			a.Logger.WarnContext(ctx, "Request over the maximum cost", slog.String("group", groupName), slog.Any("error", err))
+			return fail(err)
+		}
+		if err != nil {
+			if retryErr != nil {
+				err = retryErr
+			}
+			a.Logger.ErrorContext(ctx, "Failed to get client for group", slog.String("group", groupName), slog.Any("error", err))
+			return fail(err)
+		}
+		a.Logger.InfoContext(ctx, "Routing streaming request", slog.String("provider", provider), slog.String("model", model), slog.String("client_key", client.ClientKeyFromContext(ctx)), slog.String("tenant", tenant))
+
+		// Update the request model to the selected model, bounding the attempt with the provider's timeout
+		// until the stream has started
+		req.Model = model
+		limits := a.providerLimits(provider)
+		attemptCtx, started, cancel := streamAttemptContext(ctx, limits.RequestTimeout)
+		attemptStart := time.Now()
+		attemptRoute := client.Route{Provider: provider, Model: model, KeyID: keyID, Attempts: attempts}
+		a.publishAttempt(ctx, EventRouteSelected, groupName, true, attemptRoute, nil)
+		attemptCtx, attemptSpan := a.startAttemptSpan(attemptCtx, attemptRoute)
+		timing := &streamTiming{start: attemptStart}
+		var reassembled *streamTranscript
+		if capture != nil {
+			reassembled = &streamTranscript{}
+		}
+		stream, err := keyClient.ChatCompletionStream(attemptCtx, req)
+		if err == nil {
+			stream.OnChunk = func(chunk openai.ChatCompletionStreamResponse) {
+				timing.chunk(chunk)
+				if reassembled != nil {
+					reassembled.add(chunk)
+				}
+			}
+			// Nothing has been relayed until the first chunk, so that a stream failing before it is retried
+			err = stream.Peek()
+		}
+		timedOut := started() && ctx.Err() == nil
+		if err == nil && timedOut {
+			err = context.DeadlineExceeded
+		}
+		timedOut = timedOut || (ctx.Err() == nil && isTimeout(err))
+		if err != nil && timedOut {
+			err = fmt.Errorf("provider %s did not start streaming within %s: %w", provider, limits.RequestTimeout, err)
+		}
+		tracing.RecordError(attemptSpan, err)
+		attemptSpan.End()
+		a.observeAttempt(attemptStart, groupName, attemptRoute, err)
+		if err != nil {
+			if stream != nil {
+				stream.Close()
+			}
+			cancel()
+			a.publishAttempt(ctx, EventAttemptFailed, groupName, true, attemptRoute, err)
+		}
+		if err != nil && a.retryAttempt(ctx, true, keyClient, attemptRoute, err, timedOut, &failures, cheapest) {
+			excluded[candidate{keyClient: keyClient, model: model}] = true
+			retryErr = err
+			continue
+		}
+		if err != nil {
+			a.Logger.ErrorContext(ctx, "ChatCompletionStream error", slog.Any("error", err), upstreamIDsAttr(client.UpstreamIDs(err)))
+			return fail(err)
+		}
+		stream.Route = client.Route{Provider: provider, Model: model, KeyID: keyID, Attempts: attempts, UpstreamIDs: stream.UpstreamIDs}
+		if client.RouteExplanationRequested(ctx) {
+			stream.Route.Candidates = explanation.list()
+		}
+		span.SetAttributes(append(routeAttributes(stream.Route), attribute.Int("llm_router.attempts", attempts))...)
+		stream.OnClose = func() {
+			cancel()
+			a.endLogSample(ctx, start, stream.Err())
+			a.recordStream(ctx, start, groupName, stream, stream.Err())
+			a.observeStream(ctx, groupName, stream, timing)
+			a.logSlowRequest(ctx, start, groupName, true, stream.Route, attemptStart, timing.firstTokenAt(), stream.Err())
+			if capture != nil {
+				capture.end(start, stream.Route, reassembled.result(), stream.Err())
+				a.captures.record(capture)
+			}
+			tracing.RecordError(span, stream.Err())
+			span.End()
+		}
+		return stream, nil
+	}
+}
+
+// routeAttempt selects the candidate of an attempt at a request of a tenant, skipping the excluded candidates,
+// and checks the worst-case cost of the request on it. It holds the configuration steady while it does, and
+// returns the ID of the selected key for the route.
+func (a *App) routeAttempt(req openai.ChatCompletionRequest, excluded map[candidate]bool, tenant string, explanation *routeExplanation) (provider string, model string, keyClient *client.KeyClient, keyID string, err error) {
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	provider, model, keyClient, err = a.selectClientForGroup(req, excluded, tenant, explanation)
+	a.logRouteExplanation(req.Model, explanation)
 	if err != nil {
-		a.Logger.Error("ChatCompletionStream error", slog.Any("error", err))
-		return nil, err
+		return "", "", nil, "", err
+	}
+	if err := a.requestWithinMaxCost(req.Model, provider, model, req); err != nil {
+		return "", "", nil, "", err
+	}
+	return provider, model, keyClient, providerKeyID(provider, keyClient), nil
+}
+
+// tracedRouteAttempt is routeAttempt recorded as a span of the request of ctx
+func (a *App) tracedRouteAttempt(ctx context.Context, req openai.ChatCompletionRequest, excluded map[candidate]bool, tenant string, explanation *routeExplanation) (provider string, model string, keyClient *client.KeyClient, keyID string, err error) {
+	_, span := a.tracer.Start(ctx, "route", trace.SpanKindInternal, attribute.String("llm_router.group", req.Model), attribute.Int("llm_router.excluded", len(excluded)))
+	defer span.End()
+	provider, model, keyClient, keyID, err = a.routeAttempt(req, excluded, tenant, explanation)
+	span.SetAttributes(routeAttributes(client.Route{Provider: provider, Model: model, KeyID: keyID})...)
+	tracing.RecordError(span, err)
+	return provider, model, keyClient, keyID, err
+}
+
+// startAttemptSpan starts the span of an attempt at a provider on a route
+func (a *App) startAttemptSpan(ctx context.Context, route client.Route) (context.Context, trace.Span) {
+	return a.tracer.Start(ctx, "upstream "+route.Provider, trace.SpanKindClient,
+		append(routeAttributes(route), attribute.Int("llm_router.attempt", route.Attempts))...)
+}
+
+// candidate is a KeyClient and model pair a request can be routed to
+type candidate struct {
+	keyClient *client.KeyClient
+	model     string
+}
+
+// providerKeyID identifies a provider key as "provider/hash", which callers can be told without revealing the key
+func providerKeyID(provider string, keyClient *client.KeyClient) string {
+	return usage.KeyID(provider, usage.KeyHash(keyClient.APIKey))
+}
+
+// resolveAlias returns the group an alias maps a requested model name to, or the name itself when it is no alias
+func (a *App) resolveAlias(name string) string {
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	if a.Config == nil {
+		return name
+	}
+	// Configuration files hold the aliases lowercased
+	for alias, group := range a.Config.Aliases {
+		if strings.EqualFold(alias, name) {
+			return group
+		}
+	}
+	return name
+}
+
+// findGroup returns the group with the given name, or nil if there is none
+func (a *App) findGroup(name string) *Group {
+	for _, group := range a.Groups {
+		if group.Name == name {
+			return group
+		}
+	}
+	return nil
+}
+
+// applyGroupDefaults sets the default parameters of the group that the request omits
+func (a *App) applyGroupDefaults(groupName string, req *openai.ChatCompletionRequest) {
+	if group := a.findGroup(groupName); group != nil {
+		group.applyDefaults(req)
+	}
+}
+
+// validatesResponseFormat reports whether responses of the group are validated against the response_format
+func (a *App) validatesResponseFormat(groupName string) bool {
+	group := a.findGroup(groupName)
+	return group != nil && group.ValidateResponseFormat
+}
+
+// passthroughModels returns the models of the groups named like a model that is no group, one per provider,
+// which requests for the model are routed to with passthrough_unknown_models
+func (a *App) passthroughModels(name string) []*Model {
+	var models []*Model
+	for _, group := range a.Groups {
+		for _, m := range group.Models {
+			if m.Name == name && !slices.ContainsFunc(models, func(other *Model) bool { return other.Provider == m.Provider }) {
+				models = append(models, m)
+			}
+		}
+	}
+	return models
+}
+
+// wildcardModels returns the model of each provider whose model patterns match a model name that is no group,
+// which requests for the model are passed through to under that name
+func (a *App) wildcardModels(name string) []*Model {
+	var models []*Model
+	for _, p := range a.Providers {
+		if !p.servesModel(name) {
+			continue
+		}
+		meta, _ := lookupModelMeta(name)
+		models = append(models, &Model{
+			Weight:        1,
+			Provider:      p.Name,
+			Name:          name,
+			ContextWindow: meta.ContextWindow,
+			Capabilities:  meta.Capabilities,
+		})
 	}
-	return stream, nil
+	return models
+}
+
+// getClientForGroup selects the appropriate provider, model, and KeyClient for the group named by the request
+func (a *App) getClientForGroup(req openai.ChatCompletionRequest) (provider string, model string, keyClient *client.KeyClient, err error) {
+	return a.selectClientForGroup(req, nil, "", nil)
 }
 
-// getClientForGroup selects the appropriate provider, model, and KeyClient for the given group name
-func (a *App) getClientForGroup(groupName string) (provider string, model string, keyClient *client.KeyClient, err error) {
+// selectClientForGroup selects the provider, model, and KeyClient for the group named by the request of a tenant,
+// skipping the excluded candidates, keys over budget, and keys not serving the tenant. Groups with the cheapest
+// strategy also skip rate limited keys. The candidates evaluated are recorded in the explanation, if not nil.
+func (a *App) selectClientForGroup(req openai.ChatCompletionRequest, excluded map[candidate]bool, tenant string, explanation *routeExplanation) (provider string, model string, keyClient *client.KeyClient, err error) {
+	groupName := req.Model
+
 	// Find the models of the group in the config
 	var models []*Model
 	for _, group := range a.Groups {
@@ -91,36 +670,145 @@ func (a *App) getClientForGroup(groupName string) (provider string, model string
 			break
 		}
 	}
+	if models == nil && a.Config != nil && a.Config.Features.PassthroughUnknownModels {
+		models = a.passthroughModels(groupName)
+	}
+	if models == nil {
+		models = a.wildcardModels(groupName)
+	}
 
 	if len(models) == 0 {
 		return "", "", nil, fmt.Errorf("no models found for group: %s", groupName)
 	}
+	if err := a.budgets.Exceeded(usage.Key{Group: groupName}); err != nil {
+		return "", "", nil, err
+	}
 
-	provider, model, client := a.getClient(models)
+	// Only consider models able to handle the request's content, e.g. images
+	capable, err := eligibleModels(groupName, models, requiredCapabilities(req))
+	if err != nil {
+		return "", "", nil, err
+	}
+	a.skipModels(explanation, models, capable, skipCapability, tenant)
+	// and whose context window fits the request
+	models, err = a.fittingModels(groupName, capable, req)
+	if err != nil {
+		return "", "", nil, err
+	}
+	a.skipModels(explanation, capable, models, skipContextWindow, tenant)
+	// and, with the cheapest strategy, that cost the least among those available
+	if a.routesCheapest(groupName) {
+		cheapest, withoutRateLimited := a.cheapestModels(models, req, excluded, tenant)
+		a.skipModels(explanation, models, cheapest, skipPricier, tenant)
+		models, excluded = cheapest, withoutRateLimited
+	}
+
+	provider, model, client := a.selectClient(models, excluded, tenant, explanation)
+	if client == nil {
+		return "", "", nil, a.noCandidateError(groupName, models)
+	}
 
 	return provider, model, client, nil
 }
 
 // getClient selects the KeyClient with the lowest usage for the specific provider/model combination
 func (a *App) getClient(models []*Model) (provider string, model string, keyClient *client.KeyClient) {
+	return a.selectClient(models, nil, "", nil)
+}
+
+// selectClient selects the KeyClient with the lowest usage for the specific provider/model combination,
+// skipping the excluded candidates and keys not serving the tenant. Models with the free_first key policy
+// are only routed to paid keys while none of their free keys is available. The candidates evaluated are
+// recorded in the explanation, if not nil.
+func (a *App) selectClient(models []*Model, excluded map[candidate]bool, tenant string, explanation *routeExplanation) (provider string, model string, keyClient *client.KeyClient) {
 	minUsage := int64(-1)
 	var selectedProvider string
 	var selectedModel string
 	var selectedClient *client.KeyClient
+	selectedIndex := -1
+	freeOnly := a.freeKeyAvailable(models, excluded, tenant)
 
 	// Iterate over all models in the group
 	for _, m := range models {
+		withinBudget := a.modelWithinBudget(m)
+		if !withinBudget && explanation == nil {
+			continue
+		}
 		if pClient, exists := a.clients[m.Provider]; exists {
 			for _, kClient := range pClient.KeyClients {
-				usage := kClient.Usage(m.Name) * m.Weight
+				usage := kClient.BalanceUsage(m.Name, m.BalanceOn) * m.Weight
+				skipped := a.keyUnavailable(m, kClient, excluded, tenant)
+				switch {
+				case skipped != "":
+				case !withinBudget:
+					skipped = skipModelBudget
+				case freeOnly && !kClient.Free:
+					skipped = skipFreeFirst
+				}
+				index := explanation.add(m, kClient, usage, skipped)
+				if skipped != "" {
+					continue
+				}
 				if minUsage == -1 || usage < minUsage {
 					minUsage = usage
 					selectedClient = kClient
 					selectedProvider = m.Provider
 					selectedModel = m.Name
+					selectedIndex = index
 				}
 			}
 		}
 	}
+	explanation.selected(selectedIndex)
 	return selectedProvider, selectedModel, selectedClient
 }
+
+// keyAvailable reports whether a key of the model's provider can serve the model to the tenant.
+// Free keys are unavailable while rate limited, so that requests move on to other keys.
+func (a *App) keyAvailable(m *Model, kClient *client.KeyClient, excluded map[candidate]bool, tenant string) bool {
+	return a.keyUnavailable(m, kClient, excluded, tenant) == ""
+}
+
+// keyUnavailable returns the reason a key of the model's provider cannot serve the model to the tenant,
+// or "" if it can
+func (a *App) keyUnavailable(m *Model, kClient *client.KeyClient, excluded map[candidate]bool, tenant string) string {
+	c := candidate{keyClient: kClient, model: m.Name}
+	switch {
+	case !a.keyServesTenant(m.Provider, kClient, tenant):
+		return skipTenant
+	case kClient.Drained():
+		return skipDrained
+	case kClient.RateLimited() && (kClient.Free || excluded[c]):
+		return skipRateLimited
+	case excluded[c]:
+		return skipFailed
+	case !a.keyWithinBudget(m.Provider, kClient):
+		return skipKeyBudget
+	}
+	return ""
+}
+
+// freeKeyAvailable reports whether a model with the free_first key policy has an available free key
+func (a *App) freeKeyAvailable(models []*Model, excluded map[candidate]bool, tenant string) bool {
+	for _, m := range models {
+		if m.KeyPolicy != KeyPolicyFreeFirst || !a.modelWithinBudget(m) {
+			continue
+		}
+		if pClient, exists := a.clients[m.Provider]; exists {
+			for _, kClient := range pClient.KeyClients {
+				if kClient.Free && a.keyAvailable(m, kClient, excluded, tenant) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// withRequestUser attributes usage to the user field of a request, unless an end user is already attached
+func withRequestUser(ctx context.Context, user string) context.Context {
+	if user == "" || client.EndUserFromContext(ctx) != "" {
+		return ctx
+	}
+	return client.WithEndUser(ctx, user)
+}
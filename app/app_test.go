@@ -1,10 +1,37 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"llm-router/client"
+	"llm-router/config"
+	"llm-router/ledger"
+	"llm-router/metrics"
+	"llm-router/server"
+	"llm-router/usage"
+	"llm-router/utils"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/sashabaranov/go-openai"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestGetClientWithMultipleModelsFromSameProvider(t *testing.T) {
@@ -303,3 +330,3156 @@ func TestWeightedBalancingAcrossMultipleKeys(t *testing.T) {
 		t.Errorf("Expected kc2 to be selected (weighted usage 50)")
 	}
 }
+
+func TestModelMetadataFromRegistry(t *testing.T) {
+	cfg := &config.Config{
+		Groups: []config.Group{{
+			Name: "mixed",
+			Models: []config.Model{
+				{Weight: 1, Provider: "openai", Name: "gpt-4"},
+				{Weight: 1, Provider: "openrouter", Name: "openai/gpt-4o"},
+				{Weight: 1, Provider: "local", Name: "my-finetune", ContextWindow: 4096, Capabilities: []string{"chat"}},
+			},
+		}},
+	}
+
+	groups := getGroups(cfg)
+	models := groups[0].Models
+
+	if models[0].ContextWindow != 8192 || models[0].HasCapability(CapabilityVision) {
+		t.Errorf("Expected gpt-4 registry metadata, got %+v", models[0])
+	}
+	if models[1].ContextWindow != 128000 || !models[1].HasCapability(CapabilityVision) {
+		t.Errorf("Expected vendor-prefixed gpt-4o to resolve from registry, got %+v", models[1])
+	}
+	if models[2].ContextWindow != 4096 || !models[2].HasCapability(CapabilityChat) {
+		t.Errorf("Expected config overrides for unknown model, got %+v", models[2])
+	}
+
+	if window := groups[0].ContextWindow(); window != 128000 {
+		t.Errorf("Expected group context window 128000, got %d", window)
+	}
+	capabilities := groups[0].Capabilities()
+	if len(capabilities) != 4 {
+		t.Errorf("Expected union of 4 capabilities, got %v", capabilities)
+	}
+}
+
+func TestVisionRequestsOnlyRouteToVisionModels(t *testing.T) {
+	kc1 := client.NewKeyClient("key1", openai.NewClientWithConfig(openai.DefaultConfig("key1")), 0, 0)
+
+	app := &App{
+		Groups: []*Group{{
+			Name: "mixed",
+			Models: []*Model{
+				{Weight: 1, Provider: "openai", Name: "gpt-3.5-turbo", Capabilities: []string{CapabilityChat}},
+				{Weight: 1, Provider: "openai", Name: "gpt-4o", Capabilities: []string{CapabilityChat, CapabilityVision}},
+			},
+		}},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{kc1}},
+		},
+	}
+	// Make the text-only model the least used
+	kc1.IncrementUsage("gpt-4o", 1000)
+
+	textReq := openai.ChatCompletionRequest{
+		Model:    "mixed",
+		Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}},
+	}
+	if _, model, _, err := app.getClientForGroup(textReq); err != nil || model != "gpt-3.5-turbo" {
+		t.Errorf("Expected text request to use 'gpt-3.5-turbo', got '%s' (%v)", model, err)
+	}
+
+	visionReq := openai.ChatCompletionRequest{
+		Model: "mixed",
+		Messages: []openai.ChatCompletionMessage{{Role: "user", MultiContent: []openai.ChatMessagePart{
+			{Type: openai.ChatMessagePartTypeText, Text: "What is this?"},
+			{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "https://example.com/a.png"}},
+		}}},
+	}
+	if _, model, _, err := app.getClientForGroup(visionReq); err != nil || model != "gpt-4o" {
+		t.Errorf("Expected vision request to use 'gpt-4o', got '%s' (%v)", model, err)
+	}
+
+	audioReq := openai.ChatCompletionRequest{
+		Model: "mixed",
+		Messages: []openai.ChatCompletionMessage{{Role: "user", MultiContent: []openai.ChatMessagePart{
+			{Type: "input_audio"},
+		}}},
+	}
+	if _, _, _, err := app.getClientForGroup(audioReq); err == nil {
+		t.Errorf("Expected audio request to fail without an audio-capable model")
+	}
+}
+
+func TestInvalidStructuredOutputRetriesOnAnotherModel(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openai.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		content := `{"answer": 42}`
+		if req.Model == "bad-model" {
+			content = `{"answer": "forty-two"}`
+		}
+		resp := openai.ChatCompletionResponse{
+			Model: req.Model,
+			Choices: []openai.ChatCompletionChoice{{
+				Message: openai.ChatCompletionMessage{Role: "assistant", Content: content},
+			}},
+			Usage: openai.Usage{TotalTokens: 10},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer upstream.Close()
+
+	clientConfig := openai.DefaultConfig("key1")
+	clientConfig.BaseURL = upstream.URL + "/v1"
+	kc1 := client.NewKeyClient("key1", openai.NewClientWithConfig(clientConfig), 0, 0)
+
+	app := &App{
+		Config: &config.Config{ErrorPenalty: 100},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{{
+			Name: "structured",
+			Models: []*Model{
+				{Weight: 1, Provider: "openai", Name: "bad-model"},
+				{Weight: 1, Provider: "openai", Name: "good-model"},
+			},
+			ValidateResponseFormat: true,
+		}},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{kc1}},
+		},
+	}
+	// Make the invalid model the first choice
+	kc1.IncrementUsage("good-model", 1)
+
+	req := openai.ChatCompletionRequest{
+		Model:    "structured",
+		Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "What is the answer?"}},
+		ResponseFormat: &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+				Name:   "answer",
+				Schema: json.RawMessage(`{"type":"object","properties":{"answer":{"type":"integer"}},"required":["answer"]}`),
+			},
+		},
+	}
+	resp, err := app.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.Model != "good-model" {
+		t.Errorf("Expected response from 'good-model' after retry, got '%s'", resp.Model)
+	}
+	if usage := kc1.Usage("bad-model"); usage != 110 {
+		t.Errorf("Expected 'bad-model' usage of 110 including the error penalty, got %d", usage)
+	}
+
+	// Without any valid model the request fails
+	app.Groups[0].Models = app.Groups[0].Models[:1]
+	if _, err := app.HandleRequest(context.Background(), req); err == nil {
+		t.Errorf("Expected an error when no model produces a valid response")
+	}
+}
+
+func TestLongRequestsOnlyRouteToModelsWithLargeContext(t *testing.T) {
+	kc1 := client.NewKeyClient("key1", openai.NewClientWithConfig(openai.DefaultConfig("key1")), 0, 0)
+
+	app := &App{
+		Groups: []*Group{{
+			Name: "mixed",
+			Models: []*Model{
+				{Weight: 1, Provider: "openai", Name: "gpt-4", ContextWindow: 8192},
+				{Weight: 1, Provider: "openai", Name: "gpt-4-turbo", ContextWindow: 128000},
+			},
+		}},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{kc1}},
+		},
+	}
+	// Make the small model the least used
+	kc1.IncrementUsage("gpt-4-turbo", 1000)
+
+	shortReq := openai.ChatCompletionRequest{
+		Model:    "mixed",
+		Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}},
+	}
+	if _, model, _, err := app.getClientForGroup(shortReq); err != nil || model != "gpt-4" {
+		t.Errorf("Expected short request to use 'gpt-4', got '%s' (%v)", model, err)
+	}
+
+	longReq := openai.ChatCompletionRequest{
+		Model:    "mixed",
+		Messages: []openai.ChatCompletionMessage{{Role: "user", Content: strings.Repeat("lorem ipsum ", 5000)}},
+	}
+	if _, model, _, err := app.getClientForGroup(longReq); err != nil || model != "gpt-4-turbo" {
+		t.Errorf("Expected long request to use 'gpt-4-turbo', got '%s' (%v)", model, err)
+	}
+
+	// The requested completion length counts towards the context window as well
+	shortReq.MaxTokens = 10000
+	if _, model, _, err := app.getClientForGroup(shortReq); err != nil || model != "gpt-4-turbo" {
+		t.Errorf("Expected request with a large max_tokens to use 'gpt-4-turbo', got '%s' (%v)", model, err)
+	}
+
+	longReq.Messages[0].Content = strings.Repeat("lorem ipsum ", 200000)
+	if _, _, _, err := app.getClientForGroup(longReq); err == nil {
+		t.Errorf("Expected request exceeding every context window to fail")
+	}
+}
+
+func TestRerankRoutesThroughGroup(t *testing.T) {
+	var path string
+	var received map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results":[{"index":1,"relevance_score":0.9},{"index":0,"relevance_score":0.1}],"usage":{"total_tokens":42}}`))
+	}))
+	defer upstream.Close()
+
+	kc1 := client.NewKeyClient("key1", openai.NewClientWithConfig(openai.DefaultConfig("key1")), 0, 0)
+	app := &App{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{{
+			Name: "rerank",
+			Models: []*Model{
+				{Weight: 1, Provider: "jina", Name: "jina-reranker-v2-base-multilingual", Capabilities: []string{CapabilityRerank}},
+			},
+		}},
+		clients: map[string]*client.ProviderClient{
+			"jina": {ProviderName: "jina", BaseURL: upstream.URL + "/v1", KeyClients: []*client.KeyClient{kc1}},
+		},
+	}
+
+	body := []byte(`{"model":"rerank","query":"capital of France","documents":["Berlin",{"text":"Paris"}],"top_n":2}`)
+	var req server.RerankRequest
+	json.Unmarshal(body, &req)
+	resp, err := app.HandleRerank(context.Background(), req, body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if path != "/v1/rerank" {
+		t.Errorf("Expected request to /v1/rerank, got %s", path)
+	}
+	if received["model"] != "jina-reranker-v2-base-multilingual" || received["top_n"] != float64(2) {
+		t.Errorf("Expected rewritten model and forwarded options, got %v", received)
+	}
+	if !strings.Contains(string(resp), `"relevance_score":0.9`) {
+		t.Errorf("Expected provider response to be returned, got %s", resp)
+	}
+	if usage := kc1.Usage("jina-reranker-v2-base-multilingual"); usage != 42 {
+		t.Errorf("Expected reported usage of 42, got %d", usage)
+	}
+}
+
+func TestDrainedKeysAreSkipped(t *testing.T) {
+	kc1 := client.NewKeyClient("key1", openai.NewClientWithConfig(openai.DefaultConfig("key1")), 0, 0)
+	kc2 := client.NewKeyClient("key2", openai.NewClientWithConfig(openai.DefaultConfig("key2")), 0, 0)
+	app := &App{
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{kc1, kc2}},
+		},
+	}
+	models := []*Model{{Weight: 1, Provider: "openai", Name: "gpt-4"}}
+	kc2.IncrementUsage("gpt-4", 1000)
+
+	if !app.setKeyDrained("openai", 0, true) {
+		t.Fatalf("Expected key 0 to exist")
+	}
+	if _, _, selected := app.getClient(models); selected != kc2 {
+		t.Errorf("Expected the drained key to be skipped")
+	}
+	app.setKeyDrained("openai", 0, false)
+	if _, _, selected := app.getClient(models); selected != kc1 {
+		t.Errorf("Expected the undrained key to be selected again")
+	}
+	if app.setKeyDrained("openai", 2, true) || app.setKeyDrained("missing", 0, true) {
+		t.Errorf("Expected unknown keys to be reported")
+	}
+}
+
+func TestUsageSnapshotRestore(t *testing.T) {
+	newApp := func() (*App, *client.KeyClient) {
+		kc := client.NewKeyClient("sk-first-provider-key", openai.NewClientWithConfig(openai.DefaultConfig("key")), 0, 0)
+		return &App{
+			Providers: []*Provider{{Name: "openai"}},
+			clients: map[string]*client.ProviderClient{
+				"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{kc}},
+			},
+		}, kc
+	}
+	source, kc := newApp()
+	kc.RestoreUsage(client.UsageSnapshot{
+		Usage:  map[string]int64{"gpt-4o": 150},
+		Tokens: map[string]client.TokenUsage{"gpt-4o": {PromptTokens: 100, CompletionTokens: 50, TotalTokens: 150}},
+		Cost:   map[string]float64{"gpt-4o": 0.0002},
+	})
+	snapshot := source.snapshotUsage()
+
+	target, restored := newApp()
+	restored.IncrementUsage("gpt-4o-mini", 7)
+	if err := target.restoreUsage(snapshot); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if usage := restored.Usage("gpt-4o"); usage != 150 {
+		t.Errorf("Expected restored usage of 150, got %d", usage)
+	}
+	if tokens := restored.TokenUsage("gpt-4o"); tokens.PromptTokens != 100 || tokens.CompletionTokens != 50 {
+		t.Errorf("Expected restored tokens, got %+v", tokens)
+	}
+	if cost := restored.Cost("gpt-4o"); cost != 0.0002 {
+		t.Errorf("Expected restored cost of 0.0002, got %f", cost)
+	}
+	if usage := restored.Usage("gpt-4o-mini"); usage != 7 {
+		t.Errorf("Expected models missing from the snapshot to be unchanged, got %d", usage)
+	}
+
+	// Restores are all or nothing
+	snapshot.Providers[0].Keys[0].Usage["gpt-4o"] = 1
+	snapshot.Providers[0].Keys = append(snapshot.Providers[0].Keys, server.AdminKeyUsage{Index: 1})
+	if err := target.restoreUsage(snapshot); err == nil {
+		t.Errorf("Expected an unknown key to be rejected")
+	}
+	snapshot.Providers[0].Keys = snapshot.Providers[0].Keys[:1]
+	snapshot.Providers[0].Keys[0].Key = "sk-...else"
+	if err := target.restoreUsage(snapshot); err == nil {
+		t.Errorf("Expected a different key to be rejected")
+	}
+	if usage := restored.Usage("gpt-4o"); usage != 150 {
+		t.Errorf("Expected rejected restores to change nothing, got %d", usage)
+	}
+}
+
+func TestDeepHealth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/models" || r.Header.Get("Authorization") != "Bearer valid-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"object":"list","data":[]}`))
+	}))
+	defer upstream.Close()
+
+	valid := client.NewKeyClient("valid-key", nil, 0, 0)
+	invalid := client.NewKeyClient("invalid-key", nil, 0, 0)
+	app := &App{
+		Config:    &config.Config{},
+		Providers: []*Provider{{Name: "good"}, {Name: "bad"}},
+		Groups: []*Group{
+			{Name: "healthy", Models: []*Model{{Provider: "good", Name: "gpt-4"}, {Provider: "bad", Name: "gpt-4"}}},
+			{Name: "broken", Models: []*Model{{Provider: "bad", Name: "gpt-4"}}},
+		},
+		clients: map[string]*client.ProviderClient{
+			"good": {ProviderName: "good", BaseURL: upstream.URL + "/v1", KeyClients: []*client.KeyClient{valid}},
+			"bad":  {ProviderName: "bad", BaseURL: upstream.URL + "/v1", KeyClients: []*client.KeyClient{invalid}},
+		},
+	}
+
+	health := app.DeepHealth(context.Background())
+	if health.Status != server.HealthStatusUnhealthy {
+		t.Errorf("Expected unhealthy status with a broken group, got %s", health.Status)
+	}
+	if !health.Groups[0].Healthy || health.Groups[1].Healthy {
+		t.Errorf("Expected only the first group to be healthy, got %+v", health.Groups)
+	}
+	bad := health.Providers[1].Keys[0]
+	if !bad.Reachable || bad.Valid || bad.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected reachable provider with an invalid key, got %+v", bad)
+	}
+
+	app.Groups = app.Groups[:1]
+	if health := app.DeepHealth(context.Background()); health.Status != server.HealthStatusOK {
+		t.Errorf("Expected ok status, got %s", health.Status)
+	}
+
+	// Drained keys do not count as healthy upstreams
+	valid.SetDrained(true)
+	if health := app.DeepHealth(context.Background()); health.Status != server.HealthStatusUnhealthy {
+		t.Errorf("Expected unhealthy status with the only valid key drained, got %s", health.Status)
+	}
+}
+
+func TestBalanceOnTokenDimension(t *testing.T) {
+	newKey := func(usage string) *client.KeyClient {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":`+usage+`}`)
+		}))
+		t.Cleanup(upstream.Close)
+		config := openai.DefaultConfig("key")
+		config.BaseURL = upstream.URL
+		return client.NewKeyClient("key", openai.NewClientWithConfig(config), 0, 0)
+	}
+	// key1 has used mostly prompt tokens, key2 mostly completion tokens
+	kc1 := newKey(`{"prompt_tokens":900,"completion_tokens":100,"total_tokens":1000}`)
+	kc2 := newKey(`{"prompt_tokens":100,"completion_tokens":800,"total_tokens":900,"completion_tokens_details":{"reasoning_tokens":500}}`)
+	for _, kc := range []*client.KeyClient{kc1, kc2} {
+		if _, err := kc.ChatCompletion(context.Background(), openai.ChatCompletionRequest{Model: "gpt-4o"}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if tokens := kc2.TokenUsage("gpt-4o"); tokens.PromptTokens != 100 || tokens.CompletionTokens != 800 || tokens.ReasoningTokens != 500 {
+		t.Errorf("Expected tokens to be tracked by kind, got %+v", tokens)
+	}
+
+	app := &App{
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{kc1, kc2}},
+		},
+	}
+	for dimension, expected := range map[string]*client.KeyClient{
+		"":                       kc2,
+		client.BalanceTotal:      kc2,
+		client.BalancePrompt:     kc2,
+		client.BalanceCompletion: kc1,
+	} {
+		_, _, kc := app.getClient([]*Model{{Weight: 1, Provider: "openai", Name: "gpt-4o", BalanceOn: dimension}})
+		if kc != expected {
+			t.Errorf("Balancing on %q selected the wrong key", dimension)
+		}
+	}
+}
+
+func TestKeysOverBudgetAreSkipped(t *testing.T) {
+	kc1 := client.NewKeyClient("key1", openai.NewClientWithConfig(openai.DefaultConfig("key1")), 0, 0)
+	kc2 := client.NewKeyClient("key2", openai.NewClientWithConfig(openai.DefaultConfig("key2")), 0, 0)
+	kc2.IncrementUsage("gpt-4o", 1000)
+
+	app := &App{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{{Name: "smart", Models: []*Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}}},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{kc1, kc2}},
+		},
+		budgets: usage.NewBudgets([]usage.Budget{
+			{Scope: usage.Scope{KeyID: testKeyID("openai", "key1")}, Period: usage.PeriodDay, Tokens: 100},
+			{Scope: usage.Scope{Group: "smart"}, Period: usage.PeriodDay, Tokens: 1000},
+		}),
+	}
+	hour := time.Now().Truncate(time.Hour).Unix()
+	app.budgets.Record(usage.Entry{Key: usage.Key{Hour: hour, Group: "smart", Provider: "openai", KeyHash: usage.KeyHash("key1")}, Counts: usage.Counts{TotalTokens: 100}})
+
+	// key1 has the lower usage but is over its budget
+	_, _, kc, err := app.getClientForGroup(openai.ChatCompletionRequest{Model: "smart"})
+	if err != nil || kc != kc2 {
+		t.Errorf("Expected the key within budget to be selected, got %v", err)
+	}
+
+	kc2.SetDrained(true)
+	if _, _, _, err := app.getClientForGroup(openai.ChatCompletionRequest{Model: "smart"}); !errors.Is(err, usage.ErrBudgetExceeded) {
+		t.Errorf("Expected a budget error when only keys over budget remain, got %v", err)
+	}
+
+	kc2.SetDrained(false)
+	app.budgets.Record(usage.Entry{Key: usage.Key{Hour: hour, Group: "smart", Provider: "openai", KeyHash: usage.KeyHash("key2")}, Counts: usage.Counts{TotalTokens: 900}})
+	if _, err := app.HandleRequest(context.Background(), openai.ChatCompletionRequest{Model: "smart"}); !errors.Is(err, usage.ErrBudgetExceeded) {
+		t.Errorf("Expected a budget error for a group over budget, got %v", err)
+	}
+}
+
+func TestKeyStatus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer key1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"object":"list","data":[]}`))
+	}))
+	defer upstream.Close()
+
+	kc1 := client.NewKeyClient("key1", nil, 0, 0)
+	kc2 := client.NewKeyClient("key2", nil, 0, 0)
+	kc3 := client.NewKeyClient("key3", nil, 0, 0)
+	app := &App{
+		Config:    &config.Config{},
+		Providers: []*Provider{{Name: "openai"}},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", BaseURL: upstream.URL + "/v1", KeyClients: []*client.KeyClient{kc1, kc2, kc3}},
+		},
+		budgets: usage.NewBudgets([]usage.Budget{
+			{Scope: usage.Scope{KeyID: testKeyID("openai", "key1")}, Period: usage.PeriodDay, Tokens: 100},
+			{Scope: usage.Scope{Provider: "openai"}, Period: usage.PeriodMonth, Cost: 50},
+		}),
+	}
+	hour := time.Now().Truncate(time.Hour).Unix()
+	app.budgets.Record(usage.Entry{Key: usage.Key{Hour: hour, Provider: "openai", KeyHash: usage.KeyHash("key1")}, Counts: usage.Counts{TotalTokens: 100, Cost: 2}})
+	kc2.SetDrained(true)
+	app.probeKeys(context.Background())
+
+	keys := app.keyStatus()
+	if len(keys) != 3 {
+		t.Fatalf("Expected a status per key, got %+v", keys)
+	}
+	if k := keys[0]; k.Alias != testKeyID("openai", "key1") || k.Health != server.KeyHealthHealthy || k.Unavailable != skipKeyBudget || len(k.Budgets) != 2 {
+		t.Errorf("Expected a healthy key over its budget, got %+v", k)
+	}
+	if b := keys[0].Budgets[0]; b.Scope != "key "+testKeyID("openai", "key1") || b.Tokens != 100 || b.TokensLimit != 100 {
+		t.Errorf("Expected the usage of the key budget, got %+v", b)
+	}
+	if k := keys[1]; k.Status != server.KeyStatusDrained || k.Health != server.KeyHealthUnhealthy || k.HealthError == "" || k.Unavailable != skipDrained {
+		t.Errorf("Expected a drained unhealthy key, got %+v", k)
+	}
+	if k := keys[2]; k.Circuit != server.CircuitClosed || k.Unavailable != "" {
+		t.Errorf("Expected an available key, got %+v", k)
+	}
+}
+
+func TestDebugRouting(t *testing.T) {
+	kc1 := client.NewKeyClient("key1", openai.NewClientWithConfig(openai.DefaultConfig("key1")), 0, 0)
+	kc2 := client.NewKeyClient("key2", openai.NewClientWithConfig(openai.DefaultConfig("key2")), 0, 0)
+	app := &App{
+		Providers: []*Provider{{Name: "openai"}},
+		Groups: []*Group{
+			{Name: "smart", Models: []*Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}},
+			{Name: "local", Models: []*Model{{Weight: 1, Provider: "ollama", Name: "llama3"}}},
+		},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{kc1, kc2}},
+		},
+	}
+	kc1.PenalizeError("gpt-4o", 500)
+
+	routing := app.debugRouting()
+	if len(routing.Groups) != 2 || len(routing.Keys) != 2 {
+		t.Fatalf("Expected the state of every group and key, got %+v", routing)
+	}
+	smart := routing.Groups[0]
+	if smart.Strategy != StrategyBalanced || smart.Error != "" || len(smart.Candidates) != 2 {
+		t.Fatalf("Expected both keys as candidates of the group, got %+v", smart)
+	}
+	if c := smart.Candidates[1]; !c.Selected || c.KeyID != testKeyID("openai", "key2") {
+		t.Errorf("Expected the key without penalties to be selected, got %+v", c)
+	}
+	if local := routing.Groups[1]; local.Error == "" || len(local.Candidates) != 0 {
+		t.Errorf("Expected the group without keys not to be routable, got %+v", local)
+	}
+	if k := routing.Keys[0]; k.Usage["gpt-4o"] != 500 || k.Penalties["gpt-4o"] != 500 || k.Circuit != server.CircuitClosed {
+		t.Errorf("Expected the penalties of the first key, got %+v", k)
+	}
+	if k := routing.Keys[1]; len(k.Penalties) != 0 {
+		t.Errorf("Expected no penalties on the second key, got %+v", k)
+	}
+}
+
+func TestBudgetAlertWebhook(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload
+	}))
+	defer webhook.Close()
+
+	app := &App{
+		Config: &config.Config{
+			Groups:       []config.Group{{Name: "smart", Budgets: []config.Budget{{Period: usage.PeriodMonth, Cost: 10}}}},
+			BudgetAlerts: config.BudgetAlerts{Webhooks: []config.Webhook{{URL: webhook.URL, Format: "slack"}}},
+		},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		usage:  mustStore(t),
+	}
+	app.budgets = app.loadBudgets()
+
+	app.usageRecorder("openai", usage.KeyHash("key3"))(client.UsageRecord{Model: "gpt-4o", Group: "smart", Requests: 1, TotalTokens: 1000, Cost: 8.5})
+
+	select {
+	case payload := <-received:
+		text, _ := payload["text"].(string)
+		for _, part := range []string{"group smart", "80%", "monthly", "$8.50 of $10.00", "key " + testKeyID("openai", "key3"), "model gpt-4o"} {
+			if !strings.Contains(text, part) {
+				t.Errorf("Expected alert text to contain %q, got %q", part, text)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the webhook to be notified")
+	}
+}
+
+func TestErrorRateAlerts(t *testing.T) {
+	received := make(chan map[string]any, 2)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload
+	}))
+	defer webhook.Close()
+
+	app := &App{
+		Config: &config.Config{
+			Providers: []config.Provider{{Name: "openai", ErrorRateThreshold: 0.5}, {Name: "anthropic"}},
+			ErrorRateAlerts: config.ErrorRateAlerts{
+				Threshold:   0.9,
+				Window:      time.Minute,
+				MinRequests: 4,
+				Webhooks:    []config.Webhook{{URL: webhook.URL}},
+			},
+		},
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics: newUsageMetrics(),
+	}
+	upstreamErr := &openai.APIError{HTTPStatusCode: http.StatusInternalServerError, Message: "overloaded"}
+	attempt := func(provider string, err error) {
+		app.observeAttempt(time.Now(), "smart", client.Route{Provider: provider, Model: "gpt-4o"}, err)
+	}
+	expectAlert := func(kind string) {
+		t.Helper()
+		select {
+		case payload := <-received:
+			if payload["type"] != kind || payload["provider"] != "openai" {
+				t.Errorf("Expected a %s alert of openai, got %v", kind, payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the webhook to be notified of %s", kind)
+		}
+	}
+
+	// Too few requests to alert, then 3 failures out of 4, over the provider's own threshold
+	attempt("openai", upstreamErr)
+	attempt("openai", upstreamErr)
+	attempt("openai", nil)
+	if app.metrics.errorRateAlert.Value("openai") != 0 {
+		t.Errorf("Expected no alert below min_requests")
+	}
+	attempt("openai", upstreamErr)
+	expectAlert("error_rate.threshold")
+	if app.metrics.errorRateAlert.Value("openai") != 1 {
+		t.Errorf("Expected the alert gauge to be set")
+	}
+
+	// Canceled requests are no failures of the provider
+	attempt("openai", context.Canceled)
+	attempt("openai", nil)
+	expectAlert("error_rate.resolved")
+	if app.metrics.errorRateAlert.Value("openai") != 0 {
+		t.Errorf("Expected the alert gauge to be cleared")
+	}
+
+	// Other providers alert at the global threshold
+	for range 4 {
+		attempt("anthropic", upstreamErr)
+	}
+	if app.metrics.errorRateAlert.Value("anthropic") != 1 {
+		t.Errorf("Expected the global threshold to apply")
+	}
+	<-received
+
+	var rates errorRates
+	start := time.Now()
+	rates.observe("openai", true, start, time.Minute, 0.5, 1)
+	if rate, _ := rates.observe("openai", false, start.Add(time.Minute), time.Minute, 0.5, 1); rate.Requests != 1 || rate.Errors != 0 {
+		t.Errorf("Expected attempts older than the window to expire, got %+v", rate)
+	}
+}
+
+func mustClients(t *testing.T, cfg *config.Config) map[string]*client.ProviderClient {
+	clients, err := getClients(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create clients: %v", err)
+	}
+	return clients
+}
+
+func mustStore(t *testing.T) *usage.Store {
+	store, err := usage.NewStore("")
+	if err != nil {
+		t.Fatalf("Failed to create usage store: %v", err)
+	}
+	return store
+}
+
+// testKeyID returns the identifier of a provider key reported in usage, routes, and metrics
+func testKeyID(provider string, apiKey string) string {
+	return usage.KeyID(provider, usage.KeyHash(apiKey))
+}
+
+func TestUsageSharedThroughRedis(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+
+	// Two instances with the same keys, each serving part of the traffic
+	newInstance := func() (*App, []*client.KeyClient) {
+		keys := []*client.KeyClient{
+			client.NewKeyClient("key1", openai.NewClientWithConfig(openai.DefaultConfig("key1")), 0, 0),
+			client.NewKeyClient("key2", openai.NewClientWithConfig(openai.DefaultConfig("key2")), 0, 0),
+		}
+		app := &App{
+			Config: &config.Config{Redis: config.Redis{Address: redisServer.Addr()}},
+			Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			clients: map[string]*client.ProviderClient{
+				"openai": {ProviderName: "openai", KeyClients: keys},
+			},
+			Server: server.NewServer("router-key", nil, server.Handlers{}),
+		}
+		app.redis = app.connectRedis()
+		return app, keys
+	}
+	app1, keys1 := newInstance()
+	app2, keys2 := newInstance()
+	models := []*Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}
+
+	keys1[0].IncrementUsage("gpt-4o", 100)
+	keys2[1].IncrementUsage("gpt-4o", 30)
+	app1.syncUsage(app1.redis)
+	app2.syncUsage(app2.redis)
+	app1.syncUsage(app1.redis)
+
+	for i, app := range []*App{app1, app2} {
+		keys := app.clients["openai"].KeyClients
+		if keys[0].Usage("gpt-4o") != 100 || keys[1].Usage("gpt-4o") != 30 {
+			t.Errorf("Expected instance %d to see the usage of both instances, got %d and %d", i+1, keys[0].Usage("gpt-4o"), keys[1].Usage("gpt-4o"))
+		}
+		// Without sharing, instance 2 would pick key1, which it has not used itself
+		if _, _, kc := app.getClient(models); kc != keys[1] {
+			t.Errorf("Expected instance %d to select the key with the lower shared usage", i+1)
+		}
+	}
+
+	// Usage counted between syncs is kept on top of the shared totals
+	keys2[0].IncrementUsage("gpt-4o", 5)
+	app1.syncUsage(app1.redis)
+	if usage := keys2[0].Usage("gpt-4o"); usage != 105 {
+		t.Errorf("Expected unsynced usage to be kept, got %d", usage)
+	}
+	app2.syncUsage(app2.redis)
+	app1.syncUsage(app1.redis)
+	if usage := keys1[0].Usage("gpt-4o"); usage != 105 {
+		t.Errorf("Expected synced usage to be shared, got %d", usage)
+	}
+
+	// A batch retried after its reply was lost is added once
+	hash := app1.usageHash("openai", keys1[1])
+	apply := redisUsageApplier(app1.redis, hash)
+	batch := client.UsageBatch{Source: "lost", Seq: 1, Deltas: map[string]int64{"usage/gpt-4o": 10}}
+	for range 2 {
+		if totals, err := apply(batch); err != nil || totals["usage/gpt-4o"] != 40 {
+			t.Errorf("Expected the batch to be added once, got %v, %v", totals, err)
+		}
+	}
+}
+
+func TestUsageResetThroughRedis(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	newInstance := func() (*App, *client.KeyClient) {
+		key := client.NewKeyClient("key1", openai.NewClientWithConfig(openai.DefaultConfig("key1")), 0, 0)
+		schedule, err := parseResetSchedule(config.UsageReset{Schedule: ResetDaily})
+		if err != nil {
+			t.Fatal(err)
+		}
+		app := &App{
+			Config: &config.Config{Redis: config.Redis{Address: redisServer.Addr()}},
+			Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			clients: map[string]*client.ProviderClient{
+				"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{key}},
+			},
+			resetSchedules: map[string]*resetSchedule{"openai": schedule},
+			Server:         server.NewServer("router-key", nil, server.Handlers{}),
+		}
+		app.redis = app.connectRedis()
+		t.Cleanup(func() { app.redis.Close() })
+		return app, key
+	}
+	app1, key1 := newInstance()
+	app2, key2 := newInstance()
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	redisServer.SetTime(now)
+	app1.rotateUsage("openai", app1.resetSchedules["openai"], now)
+	app2.rotateUsage("openai", app2.resetSchedules["openai"], now)
+
+	key1.IncrementUsage("gpt-4o", 100)
+	key2.IncrementUsage("gpt-4o", 30)
+	key2.RestoreUsage(client.UsageSnapshot{Cost: map[string]float64{"gpt-4o": 0.25}})
+	app1.syncUsage(app1.redis)
+	app2.syncUsage(app2.redis)
+	app1.syncUsage(app1.redis)
+	if usage, cost := key1.Usage("gpt-4o"), key1.Cost("gpt-4o"); usage != 130 || cost != 0.25 {
+		t.Fatalf("Expected the usage and cost of both instances, got %d and %g", usage, cost)
+	}
+
+	// Instance 2 stops, and its usage is reset all the same along with that of instance 1
+	key1.IncrementUsage("gpt-4o", 5)
+	redisServer.SetTime(now.Add(12 * time.Hour))
+	app1.rotateUsage("openai", app1.resetSchedules["openai"], now.Add(12*time.Hour))
+	app1.syncUsage(app1.redis)
+	if usage := key1.Usage("gpt-4o"); usage != 0 {
+		t.Errorf("Expected the shared usage to be reset, got %d", usage)
+	}
+	if cost := key1.Cost("gpt-4o"); cost != 0.25 {
+		t.Errorf("Expected the shared cost to keep accumulating, got %g", cost)
+	}
+	previous := app1.usageHash("openai", key1) + ":" + strconv.FormatInt(time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC).Unix(), 10)
+	if usage := redisServer.HGet(previous, "usage/gpt-4o"); usage != "135" {
+		t.Errorf("Expected the usage counted before the reset in its window, got %q", usage)
+	}
+	if ttl := redisServer.TTL(previous); ttl <= 0 {
+		t.Errorf("Expected the counters of the window to expire, got %s", ttl)
+	}
+}
+
+func TestQuotasSharedThroughRedis(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	app := &App{
+		Config: &config.Config{Redis: config.Redis{Address: redisServer.Addr()}},
+		Server: server.NewServer("router-key", nil, server.Handlers{}),
+	}
+	rc := app.connectRedis()
+	defer rc.Close()
+	counters := &redisQuotaCounters{client: rc, prefix: defaultRedisPrefix}
+	ctx := context.Background()
+	windows := []server.QuotaWindow{
+		{Key: "quota:ci:requests:0", Limit: 2, Delta: 1, TTL: time.Minute},
+		{Key: "quota:ci:tokens:0", Limit: 100, TTL: time.Minute},
+	}
+
+	for i := range 2 {
+		usage, admitted, err := counters.Admit(ctx, windows)
+		if err != nil || !admitted || usage[0] != int64(i) || usage[1] != 0 {
+			t.Fatalf("Expected request %d to be admitted, got %v, %v, %v", i, usage, admitted, err)
+		}
+	}
+	usage, admitted, err := counters.Admit(ctx, windows)
+	if err != nil || admitted || usage[0] != 2 {
+		t.Errorf("Expected the request quota to be used up, got %v, %v, %v", usage, admitted, err)
+	}
+	if requests, _ := redisServer.Get(defaultRedisPrefix + "quota:ci:requests:0"); requests != "2" {
+		t.Errorf("Expected rejected requests not to be counted, got %s", requests)
+	}
+	if ttl := redisServer.TTL(defaultRedisPrefix + "quota:ci:requests:0"); ttl != time.Minute {
+		t.Errorf("Expected the counter to expire after its window, got %s", ttl)
+	}
+
+	// A used up token quota rejects requests without counting them either
+	windows[0].Key = "quota:ci:requests:60"
+	if err := counters.Add(ctx, []server.QuotaWindow{{Key: "quota:ci:tokens:0", Delta: 100, TTL: time.Minute}}); err != nil {
+		t.Fatalf("Failed to count tokens: %v", err)
+	}
+	if usage, admitted, err := counters.Admit(ctx, windows); err != nil || admitted || usage[1] != 100 {
+		t.Errorf("Expected the token quota to be used up, got %v, %v, %v", usage, admitted, err)
+	}
+	if redisServer.Exists(defaultRedisPrefix + "quota:ci:requests:60") {
+		t.Error("Expected requests rejected over the token quota not to be counted")
+	}
+}
+
+func TestUsageResetSchedules(t *testing.T) {
+	at := func(s string) time.Time {
+		t, _ := time.Parse(time.RFC3339, s)
+		return t
+	}
+	for _, tc := range []struct {
+		reset    config.UsageReset
+		now      string
+		expected string
+	}{
+		{config.UsageReset{Schedule: ResetDaily}, "2025-03-01T12:00:00Z", "2025-03-02T00:00:00Z"},
+		{config.UsageReset{Schedule: ResetDaily, Time: "17:30"}, "2025-03-01T12:00:00Z", "2025-03-01T17:30:00Z"},
+		{config.UsageReset{Schedule: ResetDaily, Time: "17:30"}, "2025-03-01T17:30:00Z", "2025-03-02T17:30:00Z"},
+		{config.UsageReset{Schedule: ResetMonthly, Day: 15}, "2025-03-20T00:00:00Z", "2025-04-15T00:00:00Z"},
+		{config.UsageReset{Schedule: ResetMonthly, Day: 31}, "2025-02-10T00:00:00Z", "2025-02-28T00:00:00Z"},
+		{config.UsageReset{Schedule: ResetMonthly}, "2025-12-05T00:00:00Z", "2026-01-01T00:00:00Z"},
+		{config.UsageReset{Schedule: ResetRolling, Window: 3600}, "2025-03-01T12:07:00Z", "2025-03-01T12:10:00Z"},
+	} {
+		schedule, err := parseResetSchedule(tc.reset)
+		if err != nil {
+			t.Fatalf("Unexpected error for %+v: %v", tc.reset, err)
+		}
+		if next := schedule.next(at(tc.now)); !next.Equal(at(tc.expected)) {
+			t.Errorf("Expected the reset after %s of %+v at %s, got %s", tc.now, tc.reset, tc.expected, next)
+		}
+	}
+
+	for _, reset := range []config.UsageReset{
+		{Schedule: "weekly"},
+		{Schedule: ResetRolling},
+		{Schedule: ResetDaily, Time: "25:00"},
+	} {
+		if _, err := parseResetSchedule(reset); err == nil {
+			t.Errorf("Expected an error for %+v", reset)
+		}
+	}
+}
+
+func TestUsageAttributedToEndUser(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	cfg := openai.DefaultConfig("key1")
+	cfg.BaseURL = upstream.URL + "/v1"
+	kc := client.NewKeyClient("key1", openai.NewClientWithConfig(cfg), 0, 0)
+	app := &App{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{{Name: "smart", Models: []*Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}}},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{kc}},
+		},
+		usage: mustStore(t),
+	}
+	kc.RecordUsage = app.usageRecorder("openai", usage.KeyHash("key1"))
+
+	ctx := client.WithClientKey(context.Background(), "backend")
+	for _, user := range []string{"alice", "alice", "bob"} {
+		if _, err := app.HandleRequest(ctx, openai.ChatCompletionRequest{Model: "smart", User: user}); err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+	}
+	// An end user attached from the header takes precedence over the user field
+	if _, err := app.HandleRequest(client.WithEndUser(ctx, "carol"), openai.ChatCompletionRequest{Model: "smart", User: "bob"}); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	end := time.Now().Add(time.Hour)
+	buckets, err := usage.Aggregate(app.usage.Entries(start, end), start, end, 2*time.Hour, []string{usage.GroupByClient, usage.GroupByUser})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	totals := make(map[string]int64)
+	for _, b := range buckets {
+		for _, r := range b.Results {
+			if r.ClientKey != "backend" {
+				t.Errorf("Expected usage attributed to the client key, got %+v", r)
+			}
+			totals[r.User] += r.TotalTokens
+		}
+	}
+	if totals["alice"] != 30 || totals["bob"] != 15 || totals["carol"] != 15 {
+		t.Errorf("Expected usage per end user, got %v", totals)
+	}
+}
+
+func TestModelsOverDailyCapAreSkipped(t *testing.T) {
+	kc := client.NewKeyClient("key1", openai.NewClientWithConfig(openai.DefaultConfig("key1")), 0, 0)
+	kc.IncrementUsage("gpt-4o", 1000)
+	cfg := &config.Config{Groups: []config.Group{
+		{Name: "smart", Models: []config.Model{
+			{Weight: 1, Provider: "openai", Name: "o1-preview", DailyTokens: 500},
+			{Weight: 1, Provider: "openai", Name: "gpt-4o"},
+		}},
+		{Name: "experimental", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "o1-preview", DailyTokens: 500}}},
+	}}
+	app := &App{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{
+			{Name: "smart", Models: []*Model{{Weight: 1, Provider: "openai", Name: "o1-preview"}, {Weight: 1, Provider: "openai", Name: "gpt-4o"}}},
+			{Name: "experimental", Models: []*Model{{Weight: 1, Provider: "openai", Name: "o1-preview"}}},
+		},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{kc}},
+		},
+		budgets: usage.NewBudgets(getBudgets(cfg)),
+	}
+	if budgets := getBudgets(cfg); len(budgets) != 1 {
+		t.Fatalf("Expected the cap of a model listed by two groups to be added once, got %+v", budgets)
+	}
+
+	if _, model, _, err := app.getClientForGroup(openai.ChatCompletionRequest{Model: "smart"}); err != nil || model != "o1-preview" {
+		t.Fatalf("Expected the unused model to be selected, got %q (%v)", model, err)
+	}
+
+	// Usage through any group counts towards the cap
+	hour := time.Now().Truncate(time.Hour).Unix()
+	app.budgets.Record(usage.Entry{Key: usage.Key{Hour: hour, Group: "experimental", Provider: "openai", Model: "o1-preview"}, Counts: usage.Counts{TotalTokens: 500}})
+	if _, model, _, err := app.getClientForGroup(openai.ChatCompletionRequest{Model: "smart"}); err != nil || model != "gpt-4o" {
+		t.Errorf("Expected the group to fall back to the model within its cap, got %q (%v)", model, err)
+	}
+	if _, _, _, err := app.getClientForGroup(openai.ChatCompletionRequest{Model: "experimental"}); !errors.Is(err, usage.ErrBudgetExceeded) {
+		t.Errorf("Expected a budget error when every model is over its cap, got %v", err)
+	}
+}
+
+func TestRequestsRecordedInLedger(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); strings.Contains(string(body), `"stream":true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, `data: {"id":"1","object":"chat.completion.chunk","model":"gpt-4o","choices":[],"usage":{"prompt_tokens":4,"completion_tokens":2,"total_tokens":6}}`+"\n\n")
+			io.WriteString(w, "data: [DONE]\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	cfg := openai.DefaultConfig("key1")
+	cfg.BaseURL = upstream.URL + "/v1"
+	kc := client.NewKeyClient("key1", openai.NewClientWithConfig(cfg), 0, 0)
+	kc.Prices = map[string]client.Price{"gpt-4o": {Input: 2.5, Output: 10}}
+	app := &App{
+		Config: &config.Config{LedgerFile: t.TempDir() + "/requests.db"},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{{Name: "smart", Models: []*Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}}},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{kc}},
+		},
+		budgets: usage.NewBudgets([]usage.Budget{{Scope: usage.Scope{ClientKey: "capped"}, Period: usage.PeriodDay, Tokens: 1}}),
+	}
+	app.ledger = app.openLedger()
+	defer app.ledger.Close()
+	app.budgets.Record(usage.Entry{Key: usage.Key{Hour: time.Now().Truncate(time.Hour).Unix(), ClientKey: "capped"}, Counts: usage.Counts{TotalTokens: 1}})
+
+	ctx := client.WithClientKey(context.Background(), "ci")
+	if _, err := app.HandleRequest(ctx, openai.ChatCompletionRequest{Model: "smart", User: "alice"}); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	stream, err := app.HandleStreamRequest(ctx, openai.ChatCompletionRequest{Model: "smart", Stream: true})
+	if err != nil {
+		t.Fatalf("Stream failed: %v", err)
+	}
+	for {
+		if _, err := stream.Recv(); err != nil {
+			break
+		}
+	}
+	stream.Close()
+	app.HandleRequest(client.WithClientKey(context.Background(), "capped"), openai.ChatCompletionRequest{Model: "smart"})
+
+	entries, err := app.ledger.Entries(ledger.Filter{Start: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour)})
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("Expected a ledger entry per request, got %+v (%v)", entries, err)
+	}
+	failed, streamed, completed := entries[0], entries[1], entries[2]
+	if completed.ClientKey != "ci" || completed.User != "alice" || completed.Group != "smart" || completed.KeyID != testKeyID("openai", "key1") ||
+		completed.TotalTokens != 15 || completed.Cost != 0.000075 || completed.Status != ledger.StatusSuccess {
+		t.Errorf("Unexpected entry of the completed request: %+v", completed)
+	}
+	if !streamed.Stream || streamed.Model != "gpt-4o" || streamed.PromptTokens != 4 || streamed.TotalTokens != 6 || streamed.Status != ledger.StatusSuccess {
+		t.Errorf("Unexpected entry of the streamed request: %+v", streamed)
+	}
+	if failed.ClientKey != "capped" || failed.Status != ledger.StatusError || failed.ErrorClass != errorClassSpendCap || failed.Provider != "" {
+		t.Errorf("Unexpected entry of the request over its spend cap: %+v", failed)
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		Providers: []config.Provider{{Name: "openai", BaseURL: upstream.URL + "/v1", APIKeys: []string{"shared"}}},
+		Groups: []config.Group{
+			{Name: "smart", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}},
+			{Name: "fast", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}},
+		},
+		Tenants: []config.Tenant{
+			{
+				Name:         "acme",
+				ClientKeys:   []config.ClientKey{{Name: "acme-backend", Key: "sk-acme"}},
+				Groups:       []string{"smart"},
+				Budgets:      []config.Budget{{Period: usage.PeriodDay, Tokens: 30}},
+				ProviderKeys: []config.TenantProviderKeys{{Provider: "openai", APIKeys: []string{"acme-openai"}}},
+			},
+			{Name: "globex", ClientKeys: []config.ClientKey{{Name: "globex-web", Key: "sk-globex"}}},
+		},
+	}
+	app := &App{
+		Config:  cfg,
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups:  getGroups(cfg),
+		clients: mustClients(t, cfg),
+		tenants: getTenants(cfg),
+		usage:   mustStore(t),
+	}
+	app.budgets = usage.NewBudgets(getBudgets(cfg))
+	for _, kc := range app.clients["openai"].KeyClients {
+		kc.RecordUsage = app.usageRecorder("openai", usage.KeyHash(kc.APIKey))
+	}
+	acme := client.WithTenant(client.WithClientKey(context.Background(), "acme-backend"), "acme")
+	globex := client.WithTenant(client.WithClientKey(context.Background(), "globex-web"), "globex")
+
+	if _, err := app.HandleRequest(acme, openai.ChatCompletionRequest{Model: "fast"}); !errors.Is(err, server.ErrGroupNotAllowed) {
+		t.Errorf("Expected a tenant to be denied groups it is not allowed, got %v", err)
+	}
+	if models := app.listModels(acme); len(models) != 1 || models[0].ID != "smart" {
+		t.Errorf("Expected a tenant to be listed the groups it is allowed only, got %+v", models)
+	}
+	if models := app.listModels(globex); len(models) != 2 {
+		t.Errorf("Expected a tenant without group restrictions to be listed all groups, got %+v", models)
+	}
+
+	// Dedicated keys only serve their tenant, which does not use the shared keys
+	resp, err := app.HandleRequest(acme, openai.ChatCompletionRequest{Model: "smart"})
+	if err != nil || resp.Route.KeyID != testKeyID("openai", "acme-openai") {
+		t.Fatalf("Expected the tenant's dedicated key, got %+v (%v)", resp, err)
+	}
+	for _, ctx := range []context.Context{globex, context.Background()} {
+		for range 2 {
+			resp, err := app.HandleRequest(ctx, openai.ChatCompletionRequest{Model: "fast"})
+			if err != nil || resp.Route.KeyID != testKeyID("openai", "shared") {
+				t.Errorf("Expected other clients to use the shared key only, got %+v (%v)", resp, err)
+			}
+		}
+	}
+
+	start := time.Now().Add(-time.Hour)
+	end := time.Now().Add(time.Hour)
+	buckets, _ := usage.Aggregate(app.usage.Entries(start, end), start, end, 2*time.Hour, []string{usage.GroupByTenant})
+	totals := make(map[string]int64)
+	for _, b := range buckets {
+		for _, r := range b.Results {
+			totals[r.Tenant] += r.Requests
+		}
+	}
+	if totals["acme"] != 1 || totals["globex"] != 2 || totals[""] != 2 {
+		t.Errorf("Expected usage attributed to tenants, got %v", totals)
+	}
+
+	// The tenant's budget caps all of its keys
+	app.HandleRequest(acme, openai.ChatCompletionRequest{Model: "smart"})
+	if _, err := app.HandleRequest(acme, openai.ChatCompletionRequest{Model: "smart"}); !errors.Is(err, usage.ErrSpendCapExceeded) {
+		t.Errorf("Expected the tenant's budget to be enforced, got %v", err)
+	}
+	if remaining, ok := app.clientBudget("acme-backend"); !ok || remaining.Tokens != 0 {
+		t.Errorf("Expected the tenant's budget to be reported for its keys, got %+v", remaining)
+	}
+	if _, err := app.HandleRequest(globex, openai.ChatCompletionRequest{Model: "smart"}); err != nil {
+		t.Errorf("Expected other tenants to be unaffected, got %v", err)
+	}
+}
+
+func TestFreeKeysUsedFirst(t *testing.T) {
+	var freeLimited bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if freeLimited && r.Header.Get("Authorization") == "Bearer free" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, `{"error":{"message":"Rate limit reached","type":"requests"}}`)
+			return
+		}
+		io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+	newKey := func(key string, free bool) *client.KeyClient {
+		cfg := openai.DefaultConfig(key)
+		cfg.BaseURL = upstream.URL + "/v1"
+		kc := client.NewKeyClient(key, openai.NewClientWithConfig(cfg), 0, 0)
+		kc.Free = free
+		return kc
+	}
+
+	paid, free := newKey("paid", false), newKey("free", true)
+	free.IncrementUsage("gpt-4o", 1000)
+	app := &App{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{
+			{Name: "smart", Models: []*Model{{Weight: 1, Provider: "openai", Name: "gpt-4o", KeyPolicy: KeyPolicyFreeFirst}}},
+			{Name: "balanced", Models: []*Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}},
+		},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{paid, free}},
+		},
+		budgets: usage.NewBudgets([]usage.Budget{{Scope: usage.Scope{Provider: "openai", KeyID: testKeyID("openai", "free")}, Period: usage.PeriodDay, Tokens: 100}}),
+	}
+
+	if _, _, kc, _ := app.getClientForGroup(openai.ChatCompletionRequest{Model: "balanced"}); kc != paid {
+		t.Errorf("Expected balanced groups to select the key with the lowest usage")
+	}
+	resp, err := app.HandleRequest(context.Background(), openai.ChatCompletionRequest{Model: "smart"})
+	if err != nil || resp.Route.KeyID != testKeyID("openai", "free") {
+		t.Fatalf("Expected the free key to be used first, got %+v (%v)", resp, err)
+	}
+
+	// A rate limited free key moves the request and the following ones to the paid key
+	freeLimited = true
+	resp, err = app.HandleRequest(context.Background(), openai.ChatCompletionRequest{Model: "smart"})
+	if err != nil || resp.Route.KeyID != testKeyID("openai", "paid") || resp.Route.Attempts != 2 {
+		t.Fatalf("Expected the request to be retried on the paid key, got %+v (%v)", resp, err)
+	}
+	if !free.RateLimited() {
+		t.Errorf("Expected the free key to be rate limited")
+	}
+	if _, _, kc, _ := app.getClientForGroup(openai.ChatCompletionRequest{Model: "smart"}); kc != paid {
+		t.Errorf("Expected the paid key while the free key is rate limited")
+	}
+
+	// So does a free key over budget
+	free = newKey("free", true)
+	app.clients["openai"].KeyClients[1] = free
+	if _, _, kc, _ := app.getClientForGroup(openai.ChatCompletionRequest{Model: "smart"}); kc != free {
+		t.Fatalf("Expected the free key once no longer rate limited")
+	}
+	app.budgets.Record(usage.Entry{Key: usage.Key{Hour: time.Now().Truncate(time.Hour).Unix(), Provider: "openai", KeyHash: usage.KeyHash("free")}, Counts: usage.Counts{TotalTokens: 100}})
+	if _, _, kc, _ := app.getClientForGroup(openai.ChatCompletionRequest{Model: "smart"}); kc != paid {
+		t.Errorf("Expected the paid key while the free key is over budget")
+	}
+}
+
+func TestStreamRetries(t *testing.T) {
+	var delay time.Duration
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer free":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, `{"error":{"message":"Rate limit reached","type":"requests"}}`)
+			return
+		case "Bearer slow":
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, `data: {"id":"1","object":"chat.completion.chunk","model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":"hi"}}]}`+"\n\n")
+		io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	newKey := func(key string, free bool) *client.KeyClient {
+		cfg := openai.DefaultConfig(key)
+		cfg.BaseURL = upstream.URL + "/v1"
+		kc := client.NewKeyClient(key, openai.NewClientWithConfig(cfg), 0, 0)
+		kc.Free = free
+		return kc
+	}
+	stream := func(app *App) (*client.ChatCompletionStream, error) {
+		stream, err := app.HandleStreamRequest(context.Background(), openai.ChatCompletionRequest{Model: "smart", Stream: true})
+		if err != nil {
+			return nil, err
+		}
+		defer stream.Close()
+		if chunk, err := stream.Recv(); err != nil || chunk.Choices[0].Delta.Content != "hi" {
+			t.Errorf("Expected the first chunk to be relayed, got %+v (%v)", chunk, err)
+		}
+		return stream, nil
+	}
+
+	// A free key answering 429 before the first chunk moves the stream to the paid key
+	free, paid := newKey("free", true), newKey("paid", false)
+	free.IncrementUsage("gpt-4o", 1000)
+	app := &App{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{{Name: "smart", Models: []*Model{{Weight: 1, Provider: "openai", Name: "gpt-4o", KeyPolicy: KeyPolicyFreeFirst}}}},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{paid, free}},
+		},
+	}
+	s, err := stream(app)
+	if err != nil || s.Route.KeyID != testKeyID("openai", "paid") || s.Route.Attempts != 2 {
+		t.Fatalf("Expected the stream to be retried on the paid key, got %+v (%v)", s, err)
+	}
+
+	// A provider not starting the stream within its timeout is retried like requests
+	timeout, retries := 50*time.Millisecond, 1
+	delay = time.Second
+	app = NewApp(&config.Config{
+		Groups: []config.Group{{Name: "smart", Models: []config.Model{
+			{Weight: 0, Provider: "local", Name: "llama"},
+			{Weight: 1, Provider: "openai", Name: "gpt-4o"},
+		}}},
+		Providers: []config.Provider{
+			{Name: "local", BaseURL: upstream.URL + "/v1", APIKeys: []string{"slow"}, Limits: config.ProviderLimits{RequestTimeout: &timeout, Retries: &retries}},
+			{Name: "openai", BaseURL: upstream.URL + "/v1", APIKeys: []string{"paid"}},
+		},
+		Limits: config.Limits{RequestTimeout: time.Minute},
+	})
+	app.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	s, err = stream(app)
+	if err != nil || s.Route.Provider != "openai" || s.Route.Attempts != 2 {
+		t.Errorf("Expected the timed out stream to be retried on openai, got %+v (%v)", s, err)
+	}
+}
+
+func TestUsageMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	cfg := openai.DefaultConfig("key1")
+	cfg.BaseURL = upstream.URL + "/v1"
+	kc := client.NewKeyClient("key1", openai.NewClientWithConfig(cfg), 0, 0)
+	kc.Prices = map[string]client.Price{"gpt-4o": {Input: 2.5, Output: 10}}
+	app := &App{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{{Name: "smart", Models: []*Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}}},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{kc}},
+		},
+		usage:   mustStore(t),
+		metrics: newUsageMetrics(),
+	}
+	kc.RecordUsage = app.usageRecorder("openai", usage.KeyHash("key1"))
+
+	for range 2 {
+		if _, err := app.HandleRequest(client.WithClientKey(context.Background(), "backend"), openai.ChatCompletionRequest{Model: "smart"}); err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+	}
+	if _, err := app.HandleRequest(context.Background(), openai.ChatCompletionRequest{Model: "other"}); err == nil {
+		t.Fatalf("Expected a request for an unknown group to fail")
+	}
+
+	w := httptest.NewRecorder()
+	app.metrics.registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	labels := `{client_key="backend",key_alias="` + testKeyID("openai", "key1") + `",model="gpt-4o",provider="openai"}`
+	for _, sample := range []string{
+		"llmrouter_requests_total" + labels + " 2",
+		"llmrouter_prompt_tokens_total" + labels + " 20",
+		"llmrouter_completion_tokens_total" + labels + " 10",
+		"llmrouter_cost_usd_total" + labels + " 0.00015",
+		`llmrouter_chat_requests_total{group="smart",key_alias="` + testKeyID("openai", "key1") + `",model="gpt-4o",provider="openai",status="success"} 2`,
+		`llmrouter_chat_requests_total{group="other",key_alias="",model="",provider="",status="error"} 1`,
+		`llmrouter_errors_total{class="routing_error",group="other",key_alias="",model="",provider=""} 1`,
+		`llmrouter_request_outcomes_total{group="smart",outcome="completed",stream="false"} 2`,
+		`llmrouter_request_duration_seconds_count{group="smart",key_alias="` + testKeyID("openai", "key1") + `",model="gpt-4o",provider="openai"} 2`,
+		`llmrouter_upstream_duration_seconds_count{group="smart",key_alias="` + testKeyID("openai", "key1") + `",model="gpt-4o",provider="openai"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), sample+"\n") {
+			t.Errorf("Expected sample %s, got:\n%s", sample, w.Body.String())
+		}
+	}
+}
+
+func TestStatsDExport(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	app := &App{
+		Config:  &config.Config{StatsD: config.StatsD{Address: agent.LocalAddr().String(), Tags: []string{"env:test"}, FlushInterval: 10 * time.Millisecond}},
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics: newUsageMetrics(),
+	}
+	app.startStatsD()
+	app.observeRequest(context.Background(), time.Now(), "smart", false, client.Route{Provider: "openai", Model: "gpt-4o", KeyID: "openai/0"}, nil)
+
+	// Counts are aggregated apart from the distributions, so they may come in a datagram of their own
+	agent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	want := "llmrouter_chat_requests_total:1|c|#env:test,group:smart,provider:openai,model:gpt-4o,key_alias:openai/0,status:success"
+	var received string
+	packet := make([]byte, 8192)
+	for !slices.Contains(strings.Split(received, "\n"), want) {
+		n, _, err := agent.ReadFrom(packet)
+		if err != nil {
+			t.Fatalf("Expected the metrics tagged with their labels, got:\n%s", received)
+		}
+		received += string(packet[:n]) + "\n"
+	}
+}
+
+func TestMetricsCatalog(t *testing.T) {
+	cfg := &config.Config{
+		AdminAPIKey: "admin-key",
+		Features:    config.Features{EnableMetrics: true},
+		Groups:      []config.Group{{Name: "smart", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}}},
+		Providers:   []config.Provider{{Name: "openai", BaseURL: "http://localhost/v1", APIKeys: []string{"key"}}},
+	}
+	app := NewApp(cfg)
+	app.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	admin := app.Server.AdminMux(*app.adminHandlers())
+
+	req := httptest.NewRequest("GET", "/admin/metrics", nil)
+	req.Header.Set("Authorization", "Bearer admin-key")
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	var catalog struct {
+		Data []metrics.Descriptor `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &catalog); err != nil || len(catalog.Data) == 0 {
+		t.Fatalf("Expected the catalog of the metrics, got %d: %s", w.Code, w.Body.String())
+	}
+	names := make(map[string]bool)
+	for _, metric := range catalog.Data {
+		names[metric.Name] = true
+		for _, label := range metric.Labels {
+			if label.Help == "" {
+				t.Errorf("Expected label %s of %s to be described", label.Name, metric.Name)
+			}
+		}
+	}
+	if !names["llmrouter_request_outcomes_total"] || !names["llmrouter_stream_duration_seconds"] {
+		t.Errorf("Expected every metric in the catalog, got %v", names)
+	}
+}
+
+func TestStreamMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, `data: {"id":"1","model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant"}}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(w, `data: {"id":"1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Hello"}}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(w, `data: {"id":"1","model":"gpt-4o","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`+"\n\n")
+		io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		Groups:    []config.Group{{Name: "smart", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}}},
+		Providers: []config.Provider{{Name: "openai", BaseURL: upstream.URL + "/v1", APIKeys: []string{"key"}}},
+	}
+	app := &App{
+		Config:    cfg,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups:    getGroups(cfg),
+		Providers: getProviders(cfg),
+		clients:   mustClients(t, cfg),
+		metrics:   newUsageMetrics(),
+	}
+	stream, err := app.HandleStreamRequest(context.Background(), openai.ChatCompletionRequest{Model: "smart", Stream: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := stream.Recv(); err != nil {
+			break
+		}
+	}
+	stream.Close()
+
+	stats := app.adminProviders()[0].Streaming["gpt-4o"]
+	// The first chunk only carries the role, so the first token arrives after the first delay
+	if stats.Streams != 1 || stats.TimeToFirstTokenMs < 50 || stats.TokensPerSecond <= 0 || stats.TokensPerSecond > 100 {
+		t.Errorf("Unexpected streaming stats %+v", stats)
+	}
+	w := httptest.NewRecorder()
+	app.metrics.registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	labels := `{group="smart",key_alias="` + testKeyID("openai", "key") + `",model="gpt-4o",provider="openai"}`
+	for _, sample := range []string{
+		"llmrouter_time_to_first_token_seconds_count" + labels + " 1",
+		"llmrouter_stream_tokens_per_second_count" + labels + " 1",
+		"llmrouter_stream_duration_seconds_count" + labels + " 1",
+		"llmrouter_stream_chunks_sum" + labels + " 3",
+		`llmrouter_stream_chunks_bucket{group="smart",key_alias="` + testKeyID("openai", "key") + `",model="gpt-4o",provider="openai",le="5"} 1`,
+		`llmrouter_stream_bytes_bucket{group="smart",key_alias="` + testKeyID("openai", "key") + `",model="gpt-4o",provider="openai",le="1024"} 1`,
+		`llmrouter_stream_ends_total{group="smart",key_alias="` + testKeyID("openai", "key") + `",model="gpt-4o",provider="openai",reason="completed"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), sample+"\n") {
+			t.Errorf("Expected sample %s, got:\n%s", sample, w.Body.String())
+		}
+	}
+
+	var averages streamStats
+	averages.observe("openai", "gpt-4o", 100*time.Millisecond, 0)
+	averages.observe("openai", "gpt-4o", 300*time.Millisecond, 40)
+	if stats := averages.provider("openai")["gpt-4o"]; stats.TimeToFirstTokenMs != 200 || stats.TokensPerSecond != 40 {
+		t.Errorf("Expected the first streams to be averaged evenly, got %+v", stats)
+	}
+}
+
+func TestRequestOutcomes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); strings.Contains(string(body), `"user":"failing"`) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `{"error":{"message":"Internal error","type":"server_error"}}`)
+			return
+		}
+		// The stream stalls after its first chunk until the client goes away
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, `data: {"id":"1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Hello"}}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		Groups:    []config.Group{{Name: "smart", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}}},
+		Providers: []config.Provider{{Name: "openai", BaseURL: upstream.URL + "/v1", APIKeys: []string{"key"}}},
+	}
+	app := &App{
+		Config:    cfg,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups:    getGroups(cfg),
+		Providers: getProviders(cfg),
+		clients:   mustClients(t, cfg),
+		metrics:   newUsageMetrics(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := app.HandleStreamRequest(ctx, openai.ChatCompletionRequest{Model: "smart", Stream: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	stream.Recv()
+	stream.Close()
+	if _, err := app.HandleRequest(context.Background(), openai.ChatCompletionRequest{Model: "smart", User: "failing"}); err == nil {
+		t.Fatalf("Expected the failing request to fail")
+	}
+	if _, err := app.HandleRequest(context.Background(), openai.ChatCompletionRequest{Model: "other"}); err == nil {
+		t.Fatalf("Expected a request for an unknown group to fail")
+	}
+
+	w := httptest.NewRecorder()
+	app.metrics.registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, sample := range []string{
+		`llmrouter_request_outcomes_total{group="smart",outcome="client_canceled",stream="true"} 1`,
+		`llmrouter_request_outcomes_total{group="smart",outcome="upstream_error",stream="false"} 1`,
+		`llmrouter_request_outcomes_total{group="other",outcome="rejected",stream="false"} 1`,
+		`llmrouter_stream_ends_total{group="smart",key_alias="` + testKeyID("openai", "key") + `",model="gpt-4o",provider="openai",reason="client_canceled"} 1`,
+		`llmrouter_stream_chunks_sum{group="smart",key_alias="` + testKeyID("openai", "key") + `",model="gpt-4o",provider="openai"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), sample+"\n") {
+			t.Errorf("Expected sample %s, got:\n%s", sample, w.Body.String())
+		}
+	}
+}
+
+func TestUpstreamIDsRecordedInLedger(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if body, _ := io.ReadAll(r.Body); strings.Contains(string(body), `"user":"failing"`) {
+			w.Header().Set("Request-Id", "req_failed")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":{"message":"Invalid request","type":"invalid_request_error"}}`)
+			return
+		}
+		w.Header().Set("X-Request-Id", "req_ok")
+		io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		Groups:     []config.Group{{Name: "smart", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}}},
+		Providers:  []config.Provider{{Name: "openai", BaseURL: upstream.URL + "/v1", APIKeys: []string{"key"}}},
+		LedgerFile: t.TempDir() + "/requests.db",
+	}
+	app := &App{
+		Config:    cfg,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups:    getGroups(cfg),
+		Providers: getProviders(cfg),
+		clients:   mustClients(t, cfg),
+	}
+	app.ledger = app.openLedger()
+	defer app.ledger.Close()
+
+	if _, err := app.HandleRequest(context.Background(), openai.ChatCompletionRequest{Model: "smart"}); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if _, err := app.HandleRequest(context.Background(), openai.ChatCompletionRequest{Model: "smart", User: "failing"}); err == nil {
+		t.Fatal("Expected the provider's error")
+	}
+
+	entries, err := app.ledger.Entries(ledger.Filter{Start: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour)})
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected a ledger entry per request, got %+v (%v)", entries, err)
+	}
+	if failed := entries[0]; failed.Status != ledger.StatusError || failed.UpstreamIDs["request-id"] != "req_failed" {
+		t.Errorf("Expected the identifier of the failed request, got %+v", failed)
+	}
+	if completed := entries[1]; completed.UpstreamIDs["x-request-id"] != "req_ok" {
+		t.Errorf("Expected the identifier of the completed request, got %+v", completed)
+	}
+}
+
+func TestUsageEventsShipped(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+	// The webhook hangs until released, which must not hold up the other sinks
+	posted, release := make(chan []usageEvent, 2), make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var events []usageEvent
+		json.NewDecoder(r.Body).Decode(&events)
+		<-release
+		posted <- events
+	}))
+	defer webhook.Close()
+
+	cfg := openai.DefaultConfig("key1")
+	cfg.BaseURL = upstream.URL + "/v1"
+	kc := client.NewKeyClient("key1", openai.NewClientWithConfig(cfg), 0, 0)
+	file := t.TempDir() + "/events/usage.jsonl"
+	app := &App{
+		Config: &config.Config{UsageEvents: config.UsageEvents{
+			Webhooks: []config.Webhook{{URL: webhook.URL}},
+			File:     file,
+		}},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{{Name: "smart", Models: []*Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}}},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{kc}},
+		},
+	}
+	app.events = app.startUsageEvents()
+
+	if _, err := app.HandleRequest(client.WithClientKey(context.Background(), "ci"), openai.ChatCompletionRequest{Model: "smart"}); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		data, _ := os.ReadFile(file)
+		if strings.Count(string(data), "\n") == 1 {
+			var written usageEvent
+			if err := json.Unmarshal(data, &written); err != nil || written.ID == "" || written.Type != usageEventType ||
+				written.ClientKey != "ci" || written.KeyID != testKeyID("openai", "key1") || written.TotalTokens != 15 || written.Status != ledger.StatusSuccess {
+				t.Fatalf("Unexpected event in the file: %s (%v)", data, err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the event in the file while the webhook hangs, got %q", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Stopping ships the events still queued to every sink
+	if _, err := app.HandleRequest(client.WithClientKey(context.Background(), "ci"), openai.ChatCompletionRequest{Model: "smart"}); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	stopped := make(chan error, 1)
+	go func() { stopped <- app.events.stop(context.Background()) }()
+	select {
+	case err := <-stopped:
+		t.Fatalf("Expected stopping to wait for the webhook, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-stopped; err != nil {
+		t.Fatalf("Expected the events to be shipped, got %v", err)
+	}
+	if first, second := <-posted, <-posted; len(first) != 1 || len(second) != 1 || first[0].ID == second[0].ID {
+		t.Errorf("Expected both events posted to the webhook, got %+v and %+v", first, second)
+	}
+	if data, _ := os.ReadFile(file); strings.Count(string(data), "\n") != 2 {
+		t.Errorf("Expected both events in the file, got %q", data)
+	}
+	app.events.emit(ledger.Entry{})
+	if data, _ := os.ReadFile(file); strings.Count(string(data), "\n") != 2 {
+		t.Errorf("Expected events emitted after stopping to be dropped, got %q", data)
+	}
+}
+
+func TestGroupDefaults(t *testing.T) {
+	var received openai.ChatCompletionRequest
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = openai.ChatCompletionRequest{}
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	cfg := openai.DefaultConfig("key")
+	cfg.BaseURL = upstream.URL + "/v1"
+	app := &App{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{{
+			Name:     "support",
+			Models:   []*Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}},
+			Defaults: config.RequestDefaults{MaxTokens: 512, Temperature: 0.2, System: "You are a support agent."},
+		}},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{client.NewKeyClient("key", openai.NewClientWithConfig(cfg), 0, 0)}},
+		},
+	}
+
+	req := openai.ChatCompletionRequest{Model: "support", Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}}
+	if _, err := app.HandleRequest(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if received.MaxTokens != 512 || received.Temperature != 0.2 || len(received.Messages) != 2 || received.Messages[0].Content != "You are a support agent." {
+		t.Errorf("Expected the group defaults to be applied, got %+v", received)
+	}
+
+	req.MaxCompletionTokens = 100
+	req.Temperature = 0.9
+	req.Messages = []openai.ChatCompletionMessage{{Role: "developer", Content: "Be brief."}, {Role: "user", Content: "hi"}}
+	if _, err := app.HandleRequest(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if received.MaxTokens != 0 || received.Temperature != 0.9 || len(received.Messages) != 2 || received.Messages[0].Content != "Be brief." {
+		t.Errorf("Expected the request's own parameters to be kept, got %+v", received)
+	}
+}
+
+func TestModelAliases(t *testing.T) {
+	var received openai.ChatCompletionRequest
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = openai.ChatCompletionRequest{}
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	cfg := openai.DefaultConfig("key")
+	cfg.BaseURL = upstream.URL + "/v1"
+	app := &App{
+		Config: &config.Config{Aliases: map[string]string{"gpt-4o": "azure-gpt-4o"}},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{{Name: "azure-gpt-4o", Models: []*Model{{Weight: 1, Provider: "azure", Name: "my-gpt4o-deployment"}}}},
+		clients: map[string]*client.ProviderClient{
+			"azure": {ProviderName: "azure", KeyClients: []*client.KeyClient{client.NewKeyClient("key", openai.NewClientWithConfig(cfg), 0, 0)}},
+		},
+	}
+
+	req := openai.ChatCompletionRequest{Model: "GPT-4o", Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}}
+	if _, err := app.HandleRequest(context.Background(), req); err != nil {
+		t.Fatalf("Expected the alias to be routed to its group, got %v", err)
+	}
+	if received.Model != "my-gpt4o-deployment" {
+		t.Errorf("Expected the deployment of the aliased group, got %q", received.Model)
+	}
+	if model, _ := app.modelForTokenizing("gpt-4o"); model != "my-gpt4o-deployment" {
+		t.Errorf("Expected aliases to be tokenized with their group's model, got %q", model)
+	}
+	req.Model = "gpt-4o-mini"
+	if _, err := app.HandleRequest(context.Background(), req); err == nil {
+		t.Errorf("Expected names without an alias or group to be rejected")
+	}
+}
+
+func TestPassthroughUnknownModels(t *testing.T) {
+	var received openai.ChatCompletionRequest
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = openai.ChatCompletionRequest{}
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"gpt-4o-mini","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	cfg := openai.DefaultConfig("key")
+	cfg.BaseURL = upstream.URL + "/v1"
+	app := &App{
+		Config: &config.Config{},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{{Name: "smart", Models: []*Model{
+			{Weight: 1, Provider: "openai", Name: "gpt-4o"},
+			{Weight: 1, Provider: "openai", Name: "gpt-4o-mini"},
+		}}},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{client.NewKeyClient("key", openai.NewClientWithConfig(cfg), 0, 0)}},
+		},
+	}
+
+	req := openai.ChatCompletionRequest{Model: "gpt-4o-mini", Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}}
+	if _, err := app.HandleRequest(context.Background(), req); err == nil {
+		t.Errorf("Expected models that are no group to be rejected by default")
+	}
+	app.Config.Features.PassthroughUnknownModels = true
+	if _, err := app.HandleRequest(context.Background(), req); err != nil || received.Model != "gpt-4o-mini" {
+		t.Errorf("Expected the model to be passed through to its provider, got %q, %v", received.Model, err)
+	}
+	req.Model = "gpt-5"
+	if _, err := app.HandleRequest(context.Background(), req); err == nil {
+		t.Errorf("Expected models no group serves to be rejected")
+	}
+}
+
+func TestWildcardModels(t *testing.T) {
+	var received openai.ChatCompletionRequest
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = openai.ChatCompletionRequest{}
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"x","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	cfg := openai.DefaultConfig("key")
+	cfg.BaseURL = upstream.URL + "/v1"
+	keyClient := client.NewKeyClient("key", openai.NewClientWithConfig(cfg), 0, 0)
+	app := &App{
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Providers: []*Provider{{Name: "openrouter", Models: []string{"meta-llama/*-instruct"}}},
+		clients: map[string]*client.ProviderClient{
+			"openrouter": {ProviderName: "openrouter", KeyClients: []*client.KeyClient{keyClient}},
+		},
+	}
+
+	req := openai.ChatCompletionRequest{Model: "meta-llama/llama-3.1-8b-instruct", Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}}
+	if _, err := app.HandleRequest(context.Background(), req); err != nil || received.Model != req.Model {
+		t.Errorf("Expected the model to be passed through to the provider, got %q, %v", received.Model, err)
+	}
+	if tokens := keyClient.Usage(req.Model); tokens != 15 {
+		t.Errorf("Expected usage to be tracked under the requested model, got %d tokens", tokens)
+	}
+	req.Model = "meta-llama/llama-3.1-8b"
+	if _, err := app.HandleRequest(context.Background(), req); err == nil {
+		t.Errorf("Expected models matching no pattern to be rejected")
+	}
+
+	for _, tc := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*", "any/model", true},
+		{"gpt-4o", "gpt-4o", true},
+		{"gpt-4o", "gpt-4o-mini", false},
+		{"gpt-*", "gpt-4o-mini", true},
+		{"*-mini", "gpt-4o-mini", true},
+		{"a*b*c", "abxbc", true},
+		{"a*b*c", "acb", false},
+	} {
+		if got := matchModel(tc.pattern, tc.name); got != tc.want {
+			t.Errorf("matchModel(%q, %q) = %v, want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMaxRequestCost(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"gpt-4","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	cfg := openai.DefaultConfig("key")
+	cfg.BaseURL = upstream.URL + "/v1"
+	app := &App{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{{Name: "premium", MaxRequestCost: 0.1, Models: []*Model{
+			{Weight: 1, Provider: "openai", Name: "gpt-4", ContextWindow: 8192, Price: client.Price{Input: 30, Output: 60}},
+		}}},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{client.NewKeyClient("key", openai.NewClientWithConfig(cfg), 0, 0)}},
+		},
+	}
+	request := func(maxTokens int) error {
+		req := openai.ChatCompletionRequest{Model: "premium", MaxTokens: maxTokens, Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}}
+		_, err := app.HandleRequest(context.Background(), req)
+		return err
+	}
+
+	if err := request(100); err != nil {
+		t.Fatalf("Expected a cheap request to be served, got %v", err)
+	}
+	// 4000 completion tokens at $60 per million could cost $0.24
+	if err := request(4000); !errors.Is(err, server.ErrRequestTooExpensive) {
+		t.Errorf("Expected a request over the maximum cost to be rejected, got %v", err)
+	}
+	// Without max_tokens, the completion may fill the rest of the context window
+	if err := request(0); !errors.Is(err, server.ErrRequestTooExpensive) {
+		t.Errorf("Expected a request without max_tokens to be checked against the context window, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected rejected requests not to reach the provider, got %d calls", calls.Load())
+	}
+}
+
+func TestCheapestStrategy(t *testing.T) {
+	// failure is the status the cheapest model fails with, 0 while it succeeds
+	var failure atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openai.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if status := int(failure.Load()); req.Model == "mini" && status != 0 {
+			w.WriteHeader(status)
+			io.WriteString(w, `{"error":{"message":"failed","type":"error"}}`)
+			return
+		}
+		if req.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: [DONE]\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"`+req.Model+`","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	newKey := func() *client.KeyClient {
+		cfg := openai.DefaultConfig("key")
+		cfg.BaseURL = upstream.URL + "/v1"
+		return client.NewKeyClient("key", openai.NewClientWithConfig(cfg), 0, 0)
+	}
+	app := &App{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{{Name: "smart", Strategy: StrategyCheapest, Models: []*Model{
+			{Weight: 1, Provider: "local", Name: "unpriced"},
+			{Weight: 1, Provider: "openai", Name: "gpt-4o", Price: client.Price{Input: 2.5, Output: 10}},
+			{Weight: 1, Provider: "mini", Name: "mini", Price: client.Price{Input: 0.15, Output: 0.6}},
+		}}},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{newKey()}},
+			"mini":   {ProviderName: "mini", KeyClients: []*client.KeyClient{newKey()}},
+			"local":  {ProviderName: "local", KeyClients: []*client.KeyClient{newKey()}},
+		},
+	}
+	req := openai.ChatCompletionRequest{Model: "smart", Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}}
+	route := func() client.Route {
+		t.Helper()
+		resp, err := app.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp.Route
+	}
+
+	// The cheapest model takes every request, however much it is used
+	for range 3 {
+		if r := route(); r.Model != "mini" || r.Attempts != 1 {
+			t.Fatalf("Expected the cheapest model, got %+v", r)
+		}
+	}
+	// Invalid requests are not escalated
+	failure.Store(http.StatusBadRequest)
+	if _, err := app.HandleRequest(context.Background(), req); err == nil {
+		t.Error("Expected the invalid request to fail")
+	}
+	// Once rate limited, the request escalates to the next cheapest model, then to unpriced models
+	failure.Store(http.StatusTooManyRequests)
+	if r := route(); r.Model != "gpt-4o" || r.Attempts != 2 {
+		t.Errorf("Expected escalation to the next cheapest model, got %+v", r)
+	}
+	if r := route(); r.Model != "gpt-4o" || r.Attempts != 1 {
+		t.Errorf("Expected the rate limited model to be skipped, got %+v", r)
+	}
+	app.clients["openai"].KeyClients[0].SetDrained(true)
+	if r := route(); r.Model != "unpriced" {
+		t.Errorf("Expected unpriced models last, got %+v", r)
+	}
+
+	// Streams escalate as well
+	app.clients["openai"].KeyClients[0].SetDrained(false)
+	app.clients["mini"].KeyClients[0] = newKey()
+	failure.Store(http.StatusServiceUnavailable)
+	req.Stream = true
+	stream, err := app.HandleStreamRequest(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Stream failed: %v", err)
+	}
+	stream.Close()
+	if stream.Route.Model != "gpt-4o" || stream.Route.Attempts != 2 {
+		t.Errorf("Expected the stream to escalate to the next cheapest model, got %+v", stream.Route)
+	}
+}
+
+func TestProviderLimits(t *testing.T) {
+	upstream := func(delay time.Duration) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+		}))
+	}
+	slow, fast := upstream(time.Second), upstream(0)
+	defer slow.Close()
+	defer fast.Close()
+
+	timeout, retries := 50*time.Millisecond, 1
+	cfg := &config.Config{
+		Groups: []config.Group{{Name: "smart", Models: []config.Model{
+			// The self-hosted model takes every request while it is available
+			{Weight: 0, Provider: "local", Name: "llama"},
+			{Weight: 1, Provider: "openai", Name: "gpt-4o"},
+		}}},
+		Providers: []config.Provider{
+			{Name: "local", BaseURL: slow.URL + "/v1", APIKeys: []string{"key"}, Limits: config.ProviderLimits{RequestTimeout: &timeout, Retries: &retries}},
+			{Name: "openai", BaseURL: fast.URL + "/v1", APIKeys: []string{"key"}},
+		},
+		Limits: config.Limits{RequestTimeout: time.Minute},
+	}
+	req := openai.ChatCompletionRequest{Model: "smart", Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}}
+
+	app := NewApp(cfg)
+	app.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	resp, err := app.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expected the request to be retried on the other provider, got %v", err)
+	}
+	if resp.Route.Provider != "openai" || resp.Route.Attempts != 2 {
+		t.Errorf("Expected the timed out request to be retried on openai, got %+v", resp.Route)
+	}
+
+	retries = 0
+	app = NewApp(cfg)
+	app.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	started := time.Now()
+	if _, err := app.HandleRequest(context.Background(), req); err == nil || !strings.Contains(err.Error(), "provider local did not respond within 50ms") {
+		t.Errorf("Expected the request to time out on the provider without retries, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the provider's timeout to apply, took %s", elapsed)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	upstream := func(status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+		}))
+	}
+	failing, working := upstream(http.StatusInternalServerError), upstream(http.StatusOK)
+	defer failing.Close()
+	defer working.Close()
+	exported := make(chan []*tracepb.Span, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		proto.Unmarshal(body, req)
+		exported <- req.ResourceSpans[0].ScopeSpans[0].Spans
+	}))
+	defer collector.Close()
+
+	retries := 1
+	app := NewApp(&config.Config{
+		Groups: []config.Group{{Name: "smart", Models: []config.Model{
+			{Weight: 0, Provider: "local", Name: "llama"},
+			{Weight: 1, Provider: "openai", Name: "gpt-4o"},
+		}}},
+		Providers: []config.Provider{
+			{Name: "local", BaseURL: failing.URL + "/v1", APIKeys: []string{"key"}},
+			{Name: "openai", BaseURL: working.URL + "/v1", APIKeys: []string{"key"}},
+		},
+		Limits:  config.Limits{RequestTimeout: time.Minute, Retries: &retries},
+		Tracing: config.Tracing{Endpoint: collector.URL, SampleRatio: 1},
+	})
+	app.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	if _, err := app.HandleRequest(context.Background(), openai.ChatCompletionRequest{Model: "smart", Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}}); err != nil {
+		t.Fatalf("Expected the request to be retried on openai, got %v", err)
+	}
+	if err := app.tracer.Flush(context.Background()); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	spans := <-exported
+	var names []string
+	for _, s := range spans {
+		names = append(names, s.Name)
+	}
+	if strings.Join(names, ",") != "route,upstream local,route,upstream openai,chat.completion" {
+		t.Fatalf("Unexpected spans %v", names)
+	}
+	request := spans[4]
+	for _, s := range spans[:4] {
+		if string(s.TraceId) != string(request.TraceId) || string(s.ParentSpanId) != string(request.SpanId) {
+			t.Errorf("Expected span %s to be a child of the request's span", s.Name)
+		}
+	}
+	if spans[1].Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR || spans[3].Status.GetCode() != tracepb.Status_STATUS_CODE_UNSET {
+		t.Errorf("Expected only the failed attempt to be marked as failed")
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer working.Close()
+	posted := make(chan []LifecycleEvent, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var events []LifecycleEvent
+		json.NewDecoder(r.Body).Decode(&events)
+		posted <- events
+	}))
+	defer webhook.Close()
+
+	retries := 1
+	app := NewApp(&config.Config{
+		Groups: []config.Group{{Name: "smart", Models: []config.Model{
+			{Weight: 0, Provider: "local", Name: "llama"},
+			{Weight: 1, Provider: "openai", Name: "gpt-4o"},
+		}}},
+		Providers: []config.Provider{
+			{Name: "local", BaseURL: failing.URL + "/v1", APIKeys: []string{"key"}},
+			{Name: "openai", BaseURL: working.URL + "/v1", APIKeys: []string{"key"}},
+		},
+		Limits:          config.Limits{RequestTimeout: time.Minute, Retries: &retries},
+		LifecycleEvents: config.LifecycleEvents{Webhooks: []config.Webhook{{URL: webhook.URL}}, Types: []string{EventRequestCompleted}},
+	})
+	app.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	var events []LifecycleEvent
+	app.Subscribe(SubscriberFunc(func(event LifecycleEvent) {
+		events = append(events, event)
+	}))
+
+	ctx := client.WithRequestID(client.WithClientKey(context.Background(), "ci"), "req-1")
+	if _, err := app.HandleRequest(ctx, openai.ChatCompletionRequest{Model: "smart", Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}}); err != nil {
+		t.Fatalf("Expected the request to be retried on openai, got %v", err)
+	}
+
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+		if event.RequestID != "req-1" || event.ClientKey != "ci" || event.Group != "smart" {
+			t.Errorf("Expected the event to be attributed to the request, got %+v", event)
+		}
+	}
+	if strings.Join(types, ",") != "request_started,route_selected,attempt_failed,route_selected,request_completed" {
+		t.Fatalf("Unexpected events %v", types)
+	}
+	if failed := events[2]; failed.Provider != "local" || failed.Attempt != 1 || failed.ErrorClass != errorClassUpstream {
+		t.Errorf("Expected the failed attempt on local, got %+v", failed)
+	}
+	if selected := events[3]; selected.Provider != "openai" || selected.KeyID != testKeyID("openai", "key") || selected.Attempt != 2 {
+		t.Errorf("Expected the retry to be routed to openai, got %+v", selected)
+	}
+	if completed := events[4].Request; completed == nil || completed.TotalTokens != 15 || completed.Status != ledger.StatusSuccess {
+		t.Errorf("Expected the usage of the completed request, got %+v", completed)
+	}
+
+	select {
+	case batch := <-posted:
+		if len(batch) != 1 || batch[0].Type != EventRequestCompleted || batch[0].RequestID != "req-1" {
+			t.Errorf("Expected only the completion to be posted, got %+v", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected lifecycle events to be posted to the webhook")
+	}
+}
+
+func TestRouteExplanation(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"gpt-4o-mini","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	cfg := openai.DefaultConfig("key")
+	cfg.BaseURL = upstream.URL + "/v1"
+	kc0 := client.NewKeyClient("key0", openai.NewClientWithConfig(cfg), 0, 0)
+	kc1 := client.NewKeyClient("key1", openai.NewClientWithConfig(cfg), 0, 0)
+	kc1.SetDrained(true)
+	kc0.IncrementUsage("gpt-4o", 100)
+	kc0.IncrementUsage("gpt-4o-mini", 30)
+	app := &App{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups: []*Group{{Name: "smart", Models: []*Model{
+			{Weight: 1, Provider: "openai", Name: "gpt-4o"},
+			{Weight: 2, Provider: "openai", Name: "gpt-4o-mini"},
+			{Weight: 1, Provider: "openai", Name: "tiny", ContextWindow: 1},
+		}}},
+		clients: map[string]*client.ProviderClient{
+			"openai": {ProviderName: "openai", KeyClients: []*client.KeyClient{kc0, kc1}},
+		},
+	}
+	req := openai.ChatCompletionRequest{Model: "smart", Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}}
+
+	resp, err := app.HandleRequest(context.Background(), req)
+	if err != nil || resp.Route.Candidates != nil {
+		t.Fatalf("Expected no explanation unless requested, got %+v (%v)", resp, err)
+	}
+	resp, err = app.HandleRequest(client.WithRouteExplanation(context.Background()), req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	key0, key1 := testKeyID("openai", "key0"), testKeyID("openai", "key1")
+	expected := []client.Candidate{
+		{Provider: "openai", Model: "tiny", KeyID: key0, Weight: 1, Skipped: skipContextWindow},
+		{Provider: "openai", Model: "tiny", KeyID: key1, Weight: 1, Skipped: skipContextWindow},
+		{Provider: "openai", Model: "gpt-4o", KeyID: key0, Weight: 1, Usage: 100, Penalties: 100, Score: 100},
+		{Provider: "openai", Model: "gpt-4o", KeyID: key1, Weight: 1, Skipped: skipDrained},
+		{Provider: "openai", Model: "gpt-4o-mini", KeyID: key0, Weight: 2, Usage: 45, Penalties: 30, Score: 90, Selected: true},
+		{Provider: "openai", Model: "gpt-4o-mini", KeyID: key1, Weight: 2, Skipped: skipDrained},
+	}
+	if len(resp.Route.Candidates) != len(expected) {
+		t.Fatalf("Expected %d candidates, got %+v", len(expected), resp.Route.Candidates)
+	}
+	for i, c := range resp.Route.Candidates {
+		if c != expected[i] {
+			t.Errorf("Expected candidate %d to be %+v, got %+v", i, expected[i], c)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	path := t.TempDir() + "/audit/admin.jsonl"
+	cfg := &config.Config{
+		AdminAPIKey:  "admin-key",
+		AuditLogFile: path,
+		Groups:       []config.Group{{Name: "smart", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}}},
+		Providers:    []config.Provider{{Name: "openai", BaseURL: "http://localhost/v1", APIKeys: []string{"key-a"}}},
+	}
+	app := NewApp(cfg)
+	app.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	admin := app.Server.AdminMux(*app.adminHandlers())
+
+	req := httptest.NewRequest("POST", "/admin/providers/openai/keys/0/drain", nil)
+	req.Header.Set("Authorization", "Bearer admin-key")
+	req.Header.Set(server.HeaderActor, "alice")
+	admin.ServeHTTP(httptest.NewRecorder(), req)
+	next := *cfg
+	next.Groups = []config.Group{{Name: "smart", Models: []config.Model{{Weight: 2, Provider: "openai", Name: "gpt-4o"}}}}
+	app.Reload(&next)
+	// A reload that changes nothing is not recorded
+	app.Reload(&next)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected the drain and the reload to be recorded, got:\n%s", data)
+	}
+	var drain, reload server.AdminAuditEntry
+	json.Unmarshal([]byte(lines[0]), &drain)
+	json.Unmarshal([]byte(lines[1]), &reload)
+	if drain.Actor != "alice" || drain.Action != server.AuditKeyDrain || !strings.Contains(lines[0], `"before":{"index":0,"key":"***`) || !strings.Contains(lines[0], `"status":"drained"`) {
+		t.Errorf("Unexpected entry of the drain: %s", lines[0])
+	}
+	if reload.Actor != auditActorReload || reload.Action != auditConfigReload || reload.Before == nil || reload.After == nil {
+		t.Errorf("Unexpected entry of the reload: %s", lines[1])
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "slow") {
+			started <- struct{}{}
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	initial := &config.Config{
+		Port:      8080,
+		Groups:    []config.Group{{Name: "smart", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}}},
+		Providers: []config.Provider{{Name: "openai", BaseURL: upstream.URL + "/v1", APIKeys: []string{"key-a", "key-b"}}},
+	}
+	app := &App{
+		Config:    initial,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups:    getGroups(initial),
+		Providers: getProviders(initial),
+		clients:   mustClients(t, initial),
+		usage:     mustStore(t),
+	}
+	app.budgets = usage.NewBudgets(getBudgets(initial))
+	app.attachKeyClients(app.clients)
+	app.clients["openai"].KeyClients[0].SetDrained(true)
+	app.clients["openai"].KeyClients[1].IncrementUsage("gpt-4o", 1000)
+
+	// A request is in flight on key-b while key-a is removed, key-c added, and a model added
+	done := make(chan error)
+	go func() {
+		_, err := app.HandleRequest(context.Background(), openai.ChatCompletionRequest{Model: "smart", Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "slow"}}})
+		done <- err
+	}()
+	<-started
+	next := &config.Config{
+		Port: 9090,
+		Groups: []config.Group{{Name: "smart", Models: []config.Model{
+			{Weight: 1, Provider: "openai", Name: "gpt-4o"},
+			{Weight: 1, Provider: "openai", Name: "gpt-4o-mini"},
+		}}},
+		Providers: []config.Provider{{Name: "openai", BaseURL: upstream.URL + "/v1", APIKeys: []string{"key-b", "key-c"}}},
+	}
+	app.Reload(next)
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Expected the request in flight to complete, got %v", err)
+	}
+
+	if len(app.Groups[0].Models) != 2 || len(app.Config.Groups[0].Models) != 2 {
+		t.Errorf("Expected the added model to be routed to")
+	}
+	if app.Config.Port != 8080 {
+		t.Errorf("Expected the port to only change on restart, got %d", app.Config.Port)
+	}
+	keys := app.clients["openai"].KeyClients
+	if len(keys) != 2 || keys[0].APIKey != "key-b" || keys[1].APIKey != "key-c" {
+		t.Fatalf("Expected keys key-b and key-c, got %d keys", len(keys))
+	}
+	if usage := keys[0].Usage("gpt-4o"); usage != 1015 {
+		t.Errorf("Expected the kept key to keep its usage and count the request in flight, got %d", usage)
+	}
+	if health := keys[0].Health(); health.Requests != 1 {
+		t.Errorf("Expected the kept key to keep its health, got %d requests", health.Requests)
+	}
+	if usage := keys[1].Usage("gpt-4o"); usage != 0 || keys[1].Drained() {
+		t.Errorf("Expected the added key to start unused and active, got %d", usage)
+	}
+
+	// Invalid configurations are not applied
+	app.Reload(&config.Config{Groups: []config.Group{{Name: "smart", Models: []config.Model{{Weight: 1, Provider: "missing", Name: "gpt-4o"}}}}})
+	if len(app.Groups[0].Models) != 2 || len(app.clients["openai"].KeyClients) != 2 {
+		t.Errorf("Expected an invalid configuration to be rejected")
+	}
+	status := app.configStatus()
+	if status.Failures != 1 || !strings.Contains(status.LastError, "undefined provider") || status.LastFailedAt == nil {
+		t.Errorf("Expected the failed reload to be reported, got %+v", status)
+	}
+	// Clients that cannot be built fail the reload before any of the state is replaced
+	if _, err := getClients(&config.Config{Providers: []config.Provider{{Name: "openai", BaseURL: "/v1", APIKeys: []string{"key"}}}}); err == nil {
+		t.Errorf("Expected a provider without a host to fail")
+	}
+	app.Reload(next)
+	if status := app.configStatus(); status.Failures != 0 || status.LastError != "" || status.ConfigHash != hashConfig(app.Config) {
+		t.Errorf("Expected a successful reload to clear the failure, got %+v", status)
+	}
+	next.Providers = append(next.Providers, config.Provider{Name: "backup", BaseURL: upstream.URL + "/v1", APIKeys: []string{"key-d"}})
+	app.Reload(next)
+	if status := app.configStatus(); len(status.Warnings) != 1 || !strings.Contains(status.Warnings[0], `provider "backup" is referenced by no group`) {
+		t.Errorf("Expected the warnings of the applied configuration to be reported, got %+v", status.Warnings)
+	}
+}
+
+func TestWatchConfigReloadsOnSIGHUP(t *testing.T) {
+	path := t.TempDir() + "/config.yaml"
+	write := func(group string) {
+		yaml := "groups:\n  - name: " + group + "\n    models:\n      - provider: openai\n        name: gpt-4o\n        weight: 1\n" +
+			"providers:\n  - name: openai\n    base_url: http://localhost\n    api_keys: [key]\n"
+		if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("fast")
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{
+		Config:    cfg,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups:    getGroups(cfg),
+		Providers: getProviders(cfg),
+		clients:   mustClients(t, cfg),
+	}
+	app.WatchConfig(path, config.LoadConfig)
+
+	write("smart")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		app.reloadMutex.RLock()
+		reloaded := app.findGroup("smart") != nil
+		app.reloadMutex.RUnlock()
+		if reloaded {
+			return
+		}
+	}
+	t.Errorf("Expected the configuration to be reloaded on SIGHUP")
+}
+
+func TestRefreshSecrets(t *testing.T) {
+	var secret atomic.Value
+	secret.Store("sk-1")
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"data":{"data":{"openai":%q},"metadata":{"version":1}}}`, secret.Load())
+	}))
+	defer vault.Close()
+
+	cfg := &config.Config{
+		Groups:    []config.Group{{Name: "smart", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}}},
+		Providers: []config.Provider{{Name: "openai", BaseURL: "http://localhost/v1", APIKeys: []string{"vault:secret/data/llm-router#openai", "sk-static"}}},
+		Secrets:   config.Secrets{Vault: config.Vault{Address: vault.URL, Token: "token"}},
+	}
+	resolver := newSecretsResolver(cfg.Secrets)
+	resolved, err := resolveSecrets(resolver, cfg)
+	if err != nil {
+		t.Fatalf("Failed to resolve secrets: %v", err)
+	}
+	if resolved.Providers[0].APIKeys[0] != "sk-1" || cfg.Providers[0].APIKeys[0] != "vault:secret/data/llm-router#openai" {
+		t.Fatalf("Expected the resolved copy to hold the secret, got %q", resolved.Providers[0].APIKeys)
+	}
+	app := &App{
+		Config:    resolved,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups:    getGroups(resolved),
+		Providers: getProviders(resolved),
+		clients:   mustClients(t, resolved),
+		secrets:   resolver,
+		loaded:    cfg,
+	}
+	app.attachKeyClients(app.clients)
+	app.clients["openai"].KeyClients[1].IncrementUsage("gpt-4o", 100)
+
+	app.refreshSecrets()
+	if app.clients["openai"].KeyClients[0].APIKey != "sk-1" {
+		t.Fatalf("Expected unchanged secrets not to reload")
+	}
+
+	// The key is rotated in Vault
+	secret.Store("sk-2")
+	app.refreshSecrets()
+	keys := app.clients["openai"].KeyClients
+	if keys[0].APIKey != "sk-2" || app.Config.Providers[0].APIKeys[0] != "sk-2" {
+		t.Errorf("Expected the rotated key to be reloaded, got %q", keys[0].APIKey)
+	}
+	if keys[1].Usage("gpt-4o") != 100 {
+		t.Errorf("Expected the static key to keep its usage")
+	}
+
+	// A store failing keeps the current keys
+	vault.Close()
+	app.refreshSecrets()
+	if app.clients["openai"].KeyClients[0].APIKey != "sk-2" {
+		t.Errorf("Expected the current keys to be kept when the store fails")
+	}
+}
+
+func TestConfigOverlay(t *testing.T) {
+	cfg := &config.Config{
+		Groups: []config.Group{
+			{Name: "smart", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}, {Weight: 1, Provider: "openai", Name: "gpt-4o-mini"}}},
+			{Name: "fast", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o-mini"}}},
+		},
+		Providers:   []config.Provider{{Name: "openai", BaseURL: "http://localhost/v1", APIKeys: []string{"sk-1", "sk-2"}}},
+		OverlayFile: filepath.Join(t.TempDir(), "overlay.json"),
+	}
+	app := NewApp(cfg)
+	app.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	app.clients["openai"].KeyClients[1].IncrementUsage("gpt-4o", 100)
+	record := client.UsageRecord{Model: "gpt-4o", Requests: 1, TotalTokens: 100}
+	app.clients["openai"].KeyClients[1].RecordUsage(record)
+
+	index, err := app.addKey("openai", "sk-3", true)
+	if err != nil || index != 2 {
+		t.Fatalf("Expected the key to be added at index 2, got %d, %v", index, err)
+	}
+	if err := app.removeKey("openai", 0); err != nil {
+		t.Fatalf("Failed to remove key: %v", err)
+	}
+	keys := app.clients["openai"].KeyClients
+	if len(keys) != 2 || keys[0].APIKey != "sk-2" || keys[1].APIKey != "sk-3" || !keys[1].Free {
+		t.Fatalf("Unexpected keys after the changes: %+v", keys)
+	}
+	if keys[0].Usage("gpt-4o") != 100 {
+		t.Errorf("Expected the remaining key to keep its usage")
+	}
+	// The usage history of the remaining key stays its own although its index changed
+	keys[0].RecordUsage(record)
+	start, end := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	buckets, _ := usage.Aggregate(app.usage.Entries(start, end), start, end, 2*time.Hour, []string{usage.GroupByKey})
+	var results []usage.Result
+	for _, b := range buckets {
+		results = append(results, b.Results...)
+	}
+	if len(results) != 1 || results[0].KeyID != testKeyID("openai", "sk-2") || results[0].Requests != 2 {
+		t.Errorf("Expected the usage of the remaining key under the same identifier, got %+v", results)
+	}
+	if err := app.setModelWeight("smart", 1, 5); err != nil {
+		t.Fatalf("Failed to set weight: %v", err)
+	}
+	if err := app.setGroupEnabled("fast", false); err != nil {
+		t.Fatalf("Failed to disable group: %v", err)
+	}
+	if app.findGroup("fast") != nil {
+		t.Errorf("Expected the disabled group not to be routed to")
+	}
+	if groups := app.adminGroups(); len(groups) != 2 || groups[0].Models[1].Weight != 5 || !groups[1].Disabled {
+		t.Errorf("Unexpected groups after the changes: %+v", groups)
+	}
+
+	for _, err := range []error{
+		app.removeKey("openai", 7),
+		app.setModelWeight("smart", 2, 1),
+		app.setGroupEnabled("missing", true),
+		func() error { _, err := app.addKey("anthropic", "sk-4", false); return err }(),
+	} {
+		if !errors.Is(err, server.ErrAdminNotFound) {
+			t.Errorf("Expected a not found error, got %v", err)
+		}
+	}
+	if _, err := app.addKey("openai", "sk-2", false); err == nil || errors.Is(err, server.ErrAdminNotFound) {
+		t.Errorf("Expected a duplicate key to be rejected, got %v", err)
+	}
+	if err := app.setModelWeight("smart", 0, -1); err == nil {
+		t.Errorf("Expected a negative weight to make the configuration invalid")
+	}
+
+	// The changes survive a reload of the configuration and a restart
+	app.Reload(cfg)
+	if keys := app.clients["openai"].KeyClients; len(keys) != 2 || keys[0].APIKey != "sk-2" {
+		t.Errorf("Expected the changes to survive a reload, got %d keys", len(keys))
+	}
+	restarted := NewApp(cfg)
+	if keys := restarted.clients["openai"].KeyClients; len(keys) != 2 || keys[1].APIKey != "sk-3" || restarted.findGroup("fast") != nil {
+		t.Errorf("Expected the changes to survive a restart, got %d keys", len(keys))
+	}
+	if restarted.Groups[0].Models[1].Weight != 5 {
+		t.Errorf("Expected the weight to survive a restart")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	cfg := &config.Config{
+		Groups: []config.Group{
+			{Name: "fast", Models: []config.Model{
+				{Weight: 1, Provider: "openai", Name: "gpt-4o-mini"},
+				{Provider: "anthropic", Name: "claude-3-haiku"},
+			}},
+			{Name: "fast", Strategy: "fastest"},
+		},
+		Providers: []config.Provider{
+			{Name: "openai", BaseURL: "api.openai.com/v1"},
+		},
+		Tenants: []config.Tenant{{Name: "acme", Groups: []string{"smart"}}},
+	}
+
+	var found []string
+	for _, p := range ValidateConfig(cfg) {
+		found = append(found, p.String())
+	}
+	expected := []string{
+		`error: providers[0].base_url: base_url "api.openai.com/v1" is not an http or https URL`,
+		`error: providers[0].api_keys: provider "openai" has no API keys`,
+		`error: groups[0].models[1].provider: model "claude-3-haiku" references undefined provider "anthropic"`,
+		`warning: groups[0].models[1].weight: weight 0 routes every request of group "fast" to model "claude-3-haiku" while it is available`,
+		`error: groups[1].name: duplicate group name "fast"`,
+		`error: groups[1].models: group "fast" has no models`,
+		`error: groups[1].strategy: "fastest" is not one of ["balanced" "cheapest"]`,
+		`error: tenants[0].groups[0]: tenant "acme" allows undefined group "smart"`,
+	}
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected all problems at once:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(found, "\n"))
+	}
+
+	valid := &config.Config{
+		Groups:    []config.Group{{Name: "fast", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o-mini"}}}},
+		Providers: []config.Provider{{Name: "openai", BaseURL: "https://api.openai.com/v1", APIKeys: []string{"sk-key"}}},
+	}
+	if problems := ValidateConfig(valid); len(problems) != 0 || HasErrors(problems) {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+
+	suspicious := &config.Config{
+		Groups: []config.Group{{Name: "fast", Models: []config.Model{
+			{Provider: "openai", Name: "gpt-4o-mini"},
+			{Provider: "openai", Name: "gpt-4o"},
+		}}},
+		Providers: []config.Provider{
+			{Name: "openai", BaseURL: "https://api.openai.com/v1", APIKeys: []string{"sk-key"}},
+			{Name: "azure", BaseURL: "https://example.openai.azure.com/v1", APIKeys: []string{"sk-key"}},
+			{Name: "openrouter", BaseURL: "https://openrouter.ai/api/v1", APIKeys: []string{"sk-or"}, Models: []string{"*"}},
+		},
+	}
+	found = nil
+	for _, p := range ValidateConfig(suspicious) {
+		found = append(found, p.String())
+	}
+	expected = []string{
+		`warning: groups[0].models: all models of group "fast" have weight 0, which routes every request to the first one available`,
+		`warning: groups[0].models: all models of group "fast" are served by the same API key, leaving none to fall back on`,
+		`warning: providers[1].name: provider "azure" is referenced by no group, so no request is routed to it`,
+		`warning: providers[1].api_keys[0]: API key is also a key of provider "openai"`,
+	}
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected warnings of suspicious settings:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(found, "\n"))
+	}
+}
+
+func TestLogging(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.log")
+	logger, _, err := newLogger(&config.Config{
+		LogLevel: "info",
+		Logging: config.Logging{
+			Format:     "json",
+			File:       path,
+			MaxSize:    200,
+			MaxBackups: 1,
+			Components: map[string]string{"router": "warn", "server": "debug"},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := logger.With(slog.String("component", "server"))
+	events := logger.With(slog.String("component", "events"))
+	logger.Info("routed")
+	logger.Warn("reload failed")
+	server.Debug("request body")
+	events.Debug("event shipped")
+	events.Info("events dropped")
+
+	read := func(path string) string {
+		data, _ := os.ReadFile(path)
+		return string(data)
+	}
+	logs := read(path+".1") + read(path)
+	for _, message := range []string{"reload failed", "request body", "events dropped"} {
+		if !strings.Contains(logs, `"msg":"`+message+`"`) {
+			t.Errorf("Expected %q to be logged as JSON, got:\n%s", message, logs)
+		}
+	}
+	for _, message := range []string{"routed", "event shipped"} {
+		if strings.Contains(logs, message) {
+			t.Errorf("Expected %q to be filtered out by its component's level", message)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() > 200 || read(path+".1") == "" {
+		t.Errorf("Expected the log file to be rotated past 200 bytes, got %v", err)
+	}
+
+	// Fields are renamed for log pipelines and messages carry the ID of their request
+	var out strings.Builder
+	renamed := slog.New(newComponentHandler(&out, &config.Config{Logging: config.Logging{Format: "json", FieldNames: map[string]string{"msg": "message", "time": "@timestamp", "provider": "llm.provider"}}}, nil))
+	renamed.InfoContext(client.WithRequestID(context.Background(), "req-1"), "Routing request", slog.String("provider", "openai"))
+	for _, field := range []string{`"@timestamp":`, `"message":"Routing request"`, `"llm.provider":"openai"`, `"request_id":"req-1"`} {
+		if !strings.Contains(out.String(), field) {
+			t.Errorf("Expected %s in %s", field, out.String())
+		}
+	}
+
+	if accessLog, _, err := newAccessLogger(&config.Config{}, nil); accessLog != nil || err != nil {
+		t.Errorf("Expected the access log to be disabled by default")
+	}
+	accessPath := filepath.Join(t.TempDir(), "access.log")
+	accessLog, _, err := newAccessLogger(&config.Config{Logging: config.Logging{Format: "json", AccessLog: config.AccessLog{Enabled: true, File: accessPath}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessLog.Info("access", slog.Int("status", 200))
+	if logs := read(accessPath); !strings.Contains(logs, `"status":200`) {
+		t.Errorf("Expected the access log to be written to its file, got %q", logs)
+	}
+
+	problems := ValidateConfig(&config.Config{Logging: config.Logging{Format: "xml", Components: map[string]string{"client": "info", "server": "loud"}, FieldNames: map[string]string{"msg": ""},
+		File: "router.log", AccessLog: config.AccessLog{Enabled: true, File: "./router.log"}, Prompts: config.LogPrompts{Enabled: true}}})
+	for _, path := range []string{"logging.format", "logging.components.client", "logging.components.server", "logging.field_names.msg", "logging.access_log.file", "logging.prompts.max_length"} {
+		if !slices.ContainsFunc(problems, func(p Problem) bool { return p.Path == path }) {
+			t.Errorf("Expected a problem with %s, got %v", path, problems)
+		}
+	}
+}
+
+func TestLogRedaction(t *testing.T) {
+	cfg := &config.Config{
+		APIKey:    "router-client-key",
+		Providers: []config.Provider{{Name: "openai", APIKeys: []string{"sk-provider-key-1"}}},
+	}
+	secrets := newRedactor(cfg)
+	var out strings.Builder
+	logger := slog.New(newComponentHandler(&out, &config.Config{Logging: config.Logging{Format: "json"}}, secrets))
+	logger.Error("Upstream request failed", slog.Any("error", errors.New("invalid key sk-provider-key-1")), slog.String("authorization", "Bearer anything"))
+	if strings.Contains(out.String(), "sk-provider-key-1") || strings.Contains(out.String(), "anything") || !strings.Contains(out.String(), `"error":"invalid key [REDACTED]"`) {
+		t.Errorf("Expected keys to be redacted, got %s", out.String())
+	}
+
+	// Keys of reloaded configurations are redacted
+	cfg.Providers[0].APIKeys = []string{"sk-provider-key-2"}
+	secrets.update(cfg)
+	out.Reset()
+	logger.Warn("Retrying", slog.String("detail", "key sk-provider-key-2 rate limited"), slog.String("group", "smart"))
+	if strings.Contains(out.String(), "sk-provider-key-2") || !strings.Contains(out.String(), `"group":"smart"`) {
+		t.Errorf("Expected the reloaded key to be redacted, got %s", out.String())
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	var out strings.Builder
+	cfg := &config.Config{
+		Groups:    []config.Group{{Name: "smart", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}}},
+		Providers: []config.Provider{{Name: "openai", BaseURL: upstream.URL + "/v1", APIKeys: []string{"key"}}},
+		Logging:   config.Logging{Sampling: config.LogSampling{Ratio: 1e-12, SlowThreshold: time.Hour}},
+	}
+	app := &App{
+		Config:    cfg,
+		Logger:    slog.New(newComponentHandler(&out, cfg, nil)),
+		Groups:    getGroups(cfg),
+		Providers: getProviders(cfg),
+		clients:   mustClients(t, cfg),
+	}
+	req := openai.ChatCompletionRequest{Model: "smart", Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}}
+
+	if _, err := app.HandleRequest(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Expected the routine messages of a request that is not sampled to be dropped, got:\n%s", out.String())
+	}
+
+	// Every message of failed or slow requests is logged
+	req.Model = "missing"
+	app.HandleRequest(context.Background(), req)
+	if !strings.Contains(out.String(), "Failed to get client for group") {
+		t.Errorf("Expected the error of a failed request to be logged, got:\n%s", out.String())
+	}
+	out.Reset()
+	cfg.Logging.Sampling.SlowThreshold = time.Nanosecond
+	req.Model = "smart"
+	app.HandleRequest(context.Background(), req)
+	if !strings.Contains(out.String(), "Routing request") {
+		t.Errorf("Expected the messages of a slow request to be logged, got:\n%s", out.String())
+	}
+}
+
+func TestSlowRequestLogging(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Stream bool `json:"stream"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if !body.Stream {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(w, `data: {"id":"1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Hello"}}]}`+"\n\n")
+		io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	var out strings.Builder
+	cfg := &config.Config{
+		Groups:    []config.Group{{Name: "smart", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}}},
+		Providers: []config.Provider{{Name: "openai", BaseURL: upstream.URL + "/v1", APIKeys: []string{"key"}}},
+		Logging:   config.Logging{SlowRequests: config.SlowRequests{Duration: time.Hour, TimeToFirstToken: 40 * time.Millisecond}},
+	}
+	app := &App{
+		Config:    cfg,
+		Logger:    slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelWarn})),
+		Groups:    getGroups(cfg),
+		Providers: getProviders(cfg),
+		clients:   mustClients(t, cfg),
+	}
+	req := openai.ChatCompletionRequest{Model: "smart", Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}}
+
+	if _, err := app.HandleRequest(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Expected a fast request not to be logged, got:\n%s", out.String())
+	}
+
+	cfg.Logging.SlowRequests.Duration = time.Nanosecond
+	if _, err := app.HandleRequest(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`msg="Slow request"`, "group=smart", "provider=openai", "key_id=" + testKeyID("openai", "key"), "attempts=1", "stream=false", "duration_ms=", "upstream_ms="} {
+		if !strings.Contains(out.String(), field) {
+			t.Errorf("Expected %s in the warning, got:\n%s", field, out.String())
+		}
+	}
+
+	// A stream is logged for its first token even when its duration is within the threshold
+	out.Reset()
+	cfg.Logging.SlowRequests.Duration = time.Hour
+	req.Stream = true
+	stream, err := app.HandleStreamRequest(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := stream.Recv(); err != nil {
+			break
+		}
+	}
+	stream.Close()
+	if !strings.Contains(out.String(), "stream=true") || !strings.Contains(out.String(), "time_to_first_token_ms=") {
+		t.Errorf("Expected the slow first token to be logged, got:\n%s", out.String())
+	}
+}
+
+func TestListen(t *testing.T) {
+	listener, err := listen(&config.Config{Port: 8080, Listen: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := listener.Addr().(*net.TCPAddr); !addr.IP.IsLoopback() {
+		t.Errorf("Expected to listen on the loopback interface, got %s", addr)
+	}
+	listener.Close()
+
+	admin, err := listenAdmin(&config.Config{AdminPort: 9091, AdminListen: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := admin.Addr().(*net.TCPAddr); !addr.IP.IsLoopback() {
+		t.Errorf("Expected the admin API to listen on the loopback interface, got %s", addr)
+	}
+	admin.Close()
+	if admin, err := listenAdmin(&config.Config{Port: 8080}); admin != nil || err != nil {
+		t.Errorf("Expected no admin listener without admin_listen or admin_port, got %v, %v", admin, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "router.sock")
+	// A socket file left behind by a previous run is replaced
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err = listen(&config.Config{UnixSocket: config.UnixSocket{Path: path, Mode: "0600"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "OK") }))
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("Expected the socket to have mode 0600, got %v", err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to connect to the socket: %v", err)
+	}
+	conn.Close()
+
+	listeners, err := listenAll(&config.Config{Port: 8080, TLSCert: "cert.pem", Listeners: []config.Listener{
+		{Address: "127.0.0.1:0"},
+		{Address: "127.0.0.1:0", TLS: true},
+		{UnixSocket: config.UnixSocket{Path: filepath.Join(t.TempDir(), "api.sock")}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range listeners {
+		defer l.Close()
+	}
+	if len(listeners) != 3 || listeners[0].TLS || !listeners[1].TLS || listeners[2].Addr().Network() != "unix" {
+		t.Errorf("Expected the configured listeners, got %v", listeners)
+	}
+	busy := listeners[0].Addr().String()
+	if _, err := listenAll(&config.Config{Listeners: []config.Listener{{Address: "127.0.0.1:0"}, {Address: busy}}}); err == nil {
+		t.Errorf("Expected an error listening on an address in use")
+	}
+	listeners, err = listenAll(&config.Config{Listen: "127.0.0.1:0", TLSCert: "cert.pem"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners[0].Close()
+	if len(listeners) != 1 || !listeners[0].TLS {
+		t.Errorf("Expected the listener of listen over HTTPS with a certificate, got %v", listeners)
+	}
+
+	problems := ValidateConfig(&config.Config{Listen: "localhost", AdminListen: "127.0.0.1", UnixSocket: config.UnixSocket{Mode: "rw"}, TLSCert: "cert.pem"})
+	for _, path := range []string{"listen", "admin_listen", "admin_api_key", "unix_socket.mode", "unix_socket.path", "tls_cert"} {
+		if !slices.ContainsFunc(problems, func(p Problem) bool { return p.Path == path }) {
+			t.Errorf("Expected a problem with %s, got %v", path, problems)
+		}
+	}
+	problems = ValidateConfig(&config.Config{ACME: config.ACME{Domains: []string{"https://llm.example.com"}, DirectoryURL: "http://acme"}, TLSCert: "cert.pem", TLSKey: "key.pem"})
+	for _, path := range []string{"acme", "acme.cache_dir", "acme.domains[0]", "acme.directory_url"} {
+		if !slices.ContainsFunc(problems, func(p Problem) bool { return p.Path == path }) {
+			t.Errorf("Expected a problem with %s, got %v", path, problems)
+		}
+	}
+	// The certificate authority must reach the TLS-ALPN-01 challenge on port 443 or the HTTP-01 one
+	acme := config.ACME{Domains: []string{"llm.example.com"}, CacheDir: "/var/lib/llm-router/acme"}
+	if problems = ValidateConfig(&config.Config{Port: 8443, ACME: acme}); !slices.ContainsFunc(problems, func(p Problem) bool { return p.Path == "acme" && p.Warning }) {
+		t.Errorf("Expected a warning without HTTPS on port 443, got %v", problems)
+	}
+	for _, cfg := range []config.Config{
+		{Listen: "0.0.0.0:443", ACME: acme},
+		{Listeners: []config.Listener{{Address: ":8080"}, {Address: ":443", TLS: true}}, ACME: acme},
+		{Port: 8443, ACME: config.ACME{Domains: acme.Domains, CacheDir: acme.CacheDir, HTTPListen: ":80"}},
+	} {
+		if problems = ValidateConfig(&cfg); slices.ContainsFunc(problems, func(p Problem) bool { return strings.HasPrefix(p.Path, "acme") }) {
+			t.Errorf("Expected the ACME challenge to be reachable, got %v", problems)
+		}
+	}
+	acme.HTTPListen = "80"
+	if problems = ValidateConfig(&config.Config{Listen: ":443", ACME: acme}); !slices.ContainsFunc(problems, func(p Problem) bool { return p.Path == "acme.http_listen" }) {
+		t.Errorf("Expected a problem with acme.http_listen, got %v", problems)
+	}
+	problems = ValidateConfig(&config.Config{Listen: "127.0.0.1:8080", AdminListen: "127.0.0.1:9090", Listeners: []config.Listener{
+		{Address: "0.0.0.0:8080"},
+		{Address: "0.0.0.0:8080"},
+		{Address: ":8443", TLS: true},
+		{Address: "8080"},
+		{Address: "127.0.0.1:9090"},
+		{Address: ":8081", UnixSocket: config.UnixSocket{Path: "/run/router.sock"}},
+		{UnixSocket: config.UnixSocket{Path: "/run/router.sock", Mode: "rw"}},
+	}})
+	for _, path := range []string{"listeners", "listeners[1]", "listeners[2].tls", "listeners[3].address", "listeners[4].address", "listeners[5]", "listeners[6].unix_socket.mode"} {
+		if !slices.ContainsFunc(problems, func(p Problem) bool { return p.Path == path }) {
+			t.Errorf("Expected a problem with %s, got %v", path, problems)
+		}
+	}
+	if slices.ContainsFunc(problems, func(p Problem) bool { return p.Path == "listeners[0]" || p.Path == "listeners[0].address" }) {
+		t.Errorf("Expected the first listener to be valid, got %v", problems)
+	}
+	problems = ValidateConfig(&config.Config{TrustedProxies: []string{"10.0.0.0/8", "192.168.1.10", "unix", "::1/128", "10.0.0.0/33", "proxy.internal"}})
+	if slices.ContainsFunc(problems, func(p Problem) bool {
+		return slices.Contains([]string{"trusted_proxies[0]", "trusted_proxies[1]", "trusted_proxies[2]", "trusted_proxies[3]"}, p.Path)
+	}) {
+		t.Errorf("Expected CIDRs, addresses, and unix to be valid trusted proxies, got %v", problems)
+	}
+	for _, path := range []string{"trusted_proxies[4]", "trusted_proxies[5]"} {
+		if !slices.ContainsFunc(problems, func(p Problem) bool { return p.Path == path }) {
+			t.Errorf("Expected a problem with %s, got %v", path, problems)
+		}
+	}
+	if prefix, err := parseTrustedProxy("::ffff:192.168.1.10"); err != nil || prefix.String() != "192.168.1.10/32" {
+		t.Errorf("Expected an address to be trusted alone, got %v, %v", prefix, err)
+	}
+	problems = ValidateConfig(&config.Config{CORS: config.CORS{
+		AllowedOrigins: []string{"https://app.example.com", "https://*.example.com", "*", "app.example.com", "https://app.example.com/"},
+		AllowedMethods: []string{"POST", "get"},
+		AllowedHeaders: []string{"Authorization", "X-Api-Key: secret"},
+	}})
+	for _, path := range []string{"cors.allowed_origins[3]", "cors.allowed_origins[4]", "cors.allowed_methods[1]", "cors.allowed_headers[1]"} {
+		if !slices.ContainsFunc(problems, func(p Problem) bool { return p.Path == path }) {
+			t.Errorf("Expected a problem with %s, got %v", path, problems)
+		}
+	}
+	problems = ValidateConfig(&config.Config{Compression: config.Compression{
+		Levels:       config.CompressionLevels{Gzip: 10, Brotli: 11, Zstd: 19},
+		StreamLevels: config.CompressionLevels{Zstd: 23},
+		MinSize:      -1,
+	}})
+	for _, path := range []string{"compression.levels.gzip", "compression.stream_levels.zstd", "compression.min_size"} {
+		if !slices.ContainsFunc(problems, func(p Problem) bool { return p.Path == path }) {
+			t.Errorf("Expected a problem with %s, got %v", path, problems)
+		}
+	}
+	if slices.ContainsFunc(problems, func(p Problem) bool { return p.Path == "compression.levels.br" || p.Path == "compression.levels.zstd" }) {
+		t.Errorf("Expected levels within their range to be valid, got %v", problems)
+	}
+	for _, path := range []string{"cors.allowed_origins[0]", "cors.allowed_origins[1]", "cors.allowed_origins[2]", "cors.allowed_methods[0]", "cors.allowed_headers[0]"} {
+		if slices.ContainsFunc(problems, func(p Problem) bool { return p.Path == path }) {
+			t.Errorf("Expected no problem with %s, got %v", path, problems)
+		}
+	}
+}
+
+func TestHandoverListeners(t *testing.T) {
+	dir := t.TempDir()
+	var handedOver []net.Listener
+	for _, address := range []string{"127.0.0.1:0", "127.0.0.1:0", filepath.Join(dir, "router.sock")} {
+		network := "tcp"
+		if filepath.IsAbs(address) {
+			network = "unix"
+		}
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		handedOver = append(handedOver, listener)
+	}
+	inherited.listeners = slices.Clone(handedOver)
+	t.Cleanup(func() { inherited.listeners = nil })
+
+	api := handedOver[0].Addr().String()
+	listeners, err := listenAll(&config.Config{Listeners: []config.Listener{
+		{Address: "localhost:" + strconv.Itoa(handedOver[0].Addr().(*net.TCPAddr).Port)},
+		{UnixSocket: config.UnixSocket{Path: filepath.Join(dir, "router.sock")}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 || listeners[0].Listener != handedOver[0] || listeners[1].Listener != handedOver[2] {
+		t.Errorf("Expected the listeners of %s and the socket to be taken over, got %v", api, listeners)
+	}
+
+	for _, tt := range []struct {
+		addr    string
+		address string
+		want    bool
+	}{
+		{"[::]:8080", ":8080", true},
+		{"[::]:8080", "0.0.0.0:8080", true},
+		{"0.0.0.0:8080", ":8080", true},
+		{"127.0.0.1:8080", "127.0.0.1:8080", true},
+		{"127.0.0.1:8080", ":8080", false},
+		{"127.0.0.1:8080", "127.0.0.1:8081", false},
+		{"127.0.0.1:8080", "127.0.0.1:0", false},
+	} {
+		addr, _ := net.ResolveTCPAddr("tcp", tt.addr)
+		if got := sameAddress(addr, "tcp", tt.address); got != tt.want {
+			t.Errorf("Expected the listener of %s to match %s: %t, got %t", tt.addr, tt.address, tt.want, got)
+		}
+	}
+
+	// Listeners no longer configured are closed once the new process listens
+	pidFile := filepath.Join(dir, "router.pid")
+	a := &App{Config: &config.Config{PIDFile: pidFile}, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	a.reportListening()
+	if _, err := handedOver[1].Accept(); err == nil {
+		t.Error("Expected the inherited listener no longer configured to be closed")
+	}
+	if pid, err := os.ReadFile(pidFile); err != nil || string(pid) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Errorf("Expected the PID file to hold the PID of the process, got %q, %v", pid, err)
+	}
+	a.Server = &server.Server{}
+	a.usage, _ = usage.NewStore("")
+	a.shutdown(false)
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the PID file to be removed on shutdown, got %v", err)
+	}
+
+	// After a handover, the old process stops saving its usage and sends the new one the usage recorded since
+	usageFile := filepath.Join(dir, "usage.json")
+	old := &App{Config: &config.Config{UsageFile: usageFile}, Logger: a.Logger, Server: &server.Server{}}
+	old.usage, _ = usage.NewStore(usageFile)
+	key := usage.Key{Provider: "openai", KeyHash: "k0", Model: "gpt-4o"}
+	old.usage.Record(key, usage.Counts{Requests: 1, TotalTokens: 100})
+	old.startUsagePersistence(time.Millisecond)
+	old.usage.HandOver()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.usageHandover = writer
+	inherited.usage = reader
+	taking := &App{Config: &config.Config{UsageFile: usageFile}, Logger: a.Logger}
+	taking.usage, _ = usage.NewStore(usageFile)
+	taking.budgets = usage.NewBudgets(nil)
+	taking.receiveUsage()
+
+	old.usage.Record(key, usage.Counts{Requests: 1, TotalTokens: 20})
+	time.Sleep(10 * time.Millisecond)
+	if saved, _ := usage.NewStore(usageFile); saved.Entries(time.Unix(0, 0), time.Now().Add(time.Hour))[0].TotalTokens != 100 {
+		t.Errorf("Expected the old process not to save its usage over the new one's file")
+	}
+	old.shutdown(true)
+	for range 100 {
+		if entries := taking.usage.Entries(time.Unix(0, 0), time.Now().Add(time.Hour)); len(entries) == 1 && entries[0].TotalTokens == 120 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if entries := taking.usage.Entries(time.Unix(0, 0), time.Now().Add(time.Hour)); len(entries) != 1 || entries[0].Requests != 2 || entries[0].TotalTokens != 120 {
+		t.Errorf("Expected the usage recorded after the handover to be added, got %+v", entries)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); strings.Contains(string(body), `"stream":true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, `data: {"id":"2","model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":"Let me "}}]}`+"\n\n")
+			io.WriteString(w, `data: {"id":"2","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"check.","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"weather","arguments":"{\"city\""}}]}}]}`+"\n\n")
+			io.WriteString(w, `data: {"id":"2","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":":\"Paris\"}"}}]},"finish_reason":"tool_calls"}]}`+"\n\n")
+			io.WriteString(w, `data: {"id":"2","model":"gpt-4o","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`+"\n\n")
+			io.WriteString(w, "data: [DONE]\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"Hello there"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		Groups: []config.Group{
+			{Name: "audited", Capture: true, Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}},
+			{Name: "smart", Models: []config.Model{{Weight: 1, Provider: "openai", Name: "gpt-4o"}}},
+		},
+		Providers:  []config.Provider{{Name: "openai", BaseURL: upstream.URL + "/v1", APIKeys: []string{"key"}}},
+		ClientKeys: []config.ClientKey{{Name: "compliance", Key: "k1", Capture: true}, {Name: "backend", Key: "k2"}},
+	}
+	app := &App{
+		Config:    cfg,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Groups:    getGroups(cfg),
+		Providers: getProviders(cfg),
+		clients:   mustClients(t, cfg),
+		captures:  &captures{queue: make(chan transcript, 10), clientKeys: map[[2]string]bool{{"", "compliance"}: true}},
+	}
+	req := openai.ChatCompletionRequest{Model: "audited", Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "Hi"}}}
+	backend := client.WithRequestID(client.WithClientKey(context.Background(), "backend"), "req-1")
+
+	if _, err := app.HandleRequest(backend, req); err != nil {
+		t.Fatal(err)
+	}
+	captured := <-app.captures.queue
+	if captured.RequestID != "req-1" || captured.Group != "audited" || captured.Provider != "openai" || captured.Request.Messages[0].Content != "Hi" ||
+		captured.Response == nil || captured.Response.Choices[0].Message.Content != "Hello there" {
+		t.Errorf("Unexpected transcript %+v", captured)
+	}
+
+	// Requests of other groups are only captured for client keys with capture set
+	req.Model = "smart"
+	if _, err := app.HandleRequest(backend, req); err != nil {
+		t.Fatal(err)
+	}
+	if len(app.captures.queue) != 0 {
+		t.Errorf("Expected requests of groups and keys without capture not to be recorded")
+	}
+
+	stream, err := app.HandleStreamRequest(client.WithClientKey(context.Background(), "compliance"), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := stream.Recv(); err != nil {
+			break
+		}
+	}
+	stream.Close()
+	captured = <-app.captures.queue
+	if !captured.Stream || captured.ClientKey != "compliance" || captured.Response == nil {
+		t.Fatalf("Unexpected stream transcript %+v", captured)
+	}
+	message := captured.Response.Choices[0].Message
+	if message.Content != "Let me check." || len(message.ToolCalls) != 1 || message.ToolCalls[0].ID != "call_1" ||
+		message.ToolCalls[0].Function.Arguments != `{"city":"Paris"}` || captured.Response.Choices[0].FinishReason != "tool_calls" ||
+		captured.Response.Usage.TotalTokens != 15 {
+		t.Errorf("Expected the stream to be reassembled, got %+v", captured.Response)
+	}
+}
+
+func TestCaptureSinks(t *testing.T) {
+	transcripts := []transcript{{RequestID: "req-1", Group: "smart"}, {RequestID: "req-2", Group: "smart"}}
+
+	path := filepath.Join(t.TempDir(), "transcripts.jsonl")
+	file, err := utils.OpenRotatingFile(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fileCaptureSink(file)(context.Background(), transcripts); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); strings.Count(string(data), "\n") != 2 || !strings.Contains(string(data), `"request_id":"req-2"`) {
+		t.Errorf("Expected a JSON line per transcript, got %s", data)
+	}
+
+	var uploaded, authorization, contentHash string
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		uploaded, authorization, contentHash = r.URL.Path+"\n"+string(body), r.Header.Get("Authorization"), r.Header.Get("X-Amz-Content-Sha256")
+	}))
+	defer s3.Close()
+	send := s3CaptureSink(config.CaptureS3{Bucket: "audit", Prefix: "transcripts/", Region: "eu-west-1", AccessKeyID: "AKID", SecretAccessKey: "secret", Endpoint: s3.URL})
+	if err := send(context.Background(), transcripts); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(uploaded, "/audit/transcripts/") || !strings.Contains(uploaded, ".jsonl\n") || !strings.Contains(uploaded, `"request_id":"req-1"`) {
+		t.Errorf("Unexpected upload %q", uploaded)
+	}
+	if !strings.Contains(authorization, "Credential=AKID/") || !strings.Contains(authorization, "/eu-west-1/s3/aws4_request") || !strings.Contains(authorization, "x-amz-content-sha256") || len(contentHash) != 64 {
+		t.Errorf("Expected the upload to be signed, got %q", authorization)
+	}
+
+	// Without keys, the credentials of the AWS SDK's default chain sign the uploads
+	dir := t.TempDir()
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_ACCESS_KEY_ID", "ENVKEY")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	send = s3CaptureSink(config.CaptureS3{Bucket: "audit", Region: "eu-west-1", Endpoint: s3.URL})
+	if err := send(context.Background(), transcripts); err != nil || !strings.Contains(authorization, "Credential=ENVKEY/") {
+		t.Errorf("Expected the upload to be signed with the default credentials, got %q, %v", authorization, err)
+	}
+
+	problems := ValidateConfig(&config.Config{Capture: config.Capture{S3: config.CaptureS3{Bucket: "audit", AccessKeyID: "AKID"}}})
+	for _, path := range []string{"capture.s3.region", "capture.s3"} {
+		if !slices.ContainsFunc(problems, func(p Problem) bool { return p.Path == path }) {
+			t.Errorf("Expected a problem with %s, got %v", path, problems)
+		}
+	}
+}
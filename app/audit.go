@@ -0,0 +1,84 @@
+package app
+
+import (
+	"encoding/json"
+	"llm-router/server"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Actor and action of the audit log entries of configuration reloads
+const (
+	auditActorReload  = "reload"
+	auditConfigReload = "config.reload"
+)
+
+// auditLog appends the changes made through the admin API and by reloads to a file of JSON lines, which is
+// never truncated or rewritten
+type auditLog struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// openAuditLog opens the configured audit log, or returns nil when it is disabled or cannot be opened
+func (a *App) openAuditLog() *auditLog {
+	path := a.Config.AuditLogFile
+	if path == "" {
+		return nil
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			a.Logger.Error("Failed to create audit log directory, changes are not audited", slog.String("path", path), slog.Any("error", err))
+			return nil
+		}
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		a.Logger.Error("Failed to open audit log, changes are not audited", slog.String("path", path), slog.Any("error", err))
+		return nil
+	}
+	return &auditLog{file: file}
+}
+
+// record appends an entry as a JSON line
+func (l *auditLog) record(entry server.AdminAuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err = l.file.Write(append(data, '\n'))
+	return err
+}
+
+// audit records a change in the audit log, unless it is disabled
+func (a *App) audit(entry server.AdminAuditEntry) {
+	if a.auditLog == nil {
+		return
+	}
+	if err := a.auditLog.record(entry); err != nil {
+		a.Logger.Error("Failed to record change in audit log", slog.String("action", entry.Action), slog.Any("error", err))
+	}
+}
+
+// auditReload records a reload that changed the configuration being served from the one of hash before
+func (a *App) auditReload(before string) {
+	a.reloadMutex.RLock()
+	after := a.configHash
+	a.reloadMutex.RUnlock()
+	if after == before {
+		return
+	}
+	a.audit(server.AdminAuditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  auditActorReload,
+		Action: auditConfigReload,
+		Target: "config",
+		Before: map[string]string{"config_hash": before},
+		After:  map[string]string{"config_hash": after},
+	})
+}
@@ -0,0 +1,163 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"llm-router/client"
+	"llm-router/config"
+	"llm-router/server"
+	"llm-router/usage"
+	"slices"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// getBudgets collects the budgets configured for groups, providers, each provider key, client keys, and tenants,
+// and the daily token caps of models
+func getBudgets(cfg *config.Config) []usage.Budget {
+	budgets := make([]usage.Budget, 0)
+	modelCaps := make(map[usage.Budget]bool)
+	add := func(scope usage.Scope, cfgBudgets []config.Budget) {
+		for _, b := range cfgBudgets {
+			budgets = append(budgets, usage.Budget{Scope: scope, Period: b.Period, Tokens: b.Tokens, Cost: b.Cost})
+		}
+	}
+	for _, g := range cfg.Groups {
+		add(usage.Scope{Group: g.Name}, g.Budgets)
+		for _, m := range g.Models {
+			// Models listed by several groups share their usage, so a cap is only added once
+			budget := usage.Budget{Scope: usage.Scope{Provider: m.Provider, Model: m.Name}, Period: usage.PeriodDay, Tokens: m.DailyTokens}
+			if m.DailyTokens > 0 && !modelCaps[budget] {
+				modelCaps[budget] = true
+				budgets = append(budgets, budget)
+			}
+		}
+	}
+	for _, p := range cfg.Providers {
+		add(usage.Scope{Provider: p.Name}, p.Budgets)
+		for _, key := range slices.Concat(p.APIKeys, p.FreeAPIKeys) {
+			add(usage.Scope{KeyID: usage.KeyID(p.Name, usage.KeyHash(key))}, p.KeyBudgets)
+		}
+	}
+	for _, k := range cfg.ClientKeys {
+		add(usage.Scope{ClientKey: k.Name}, k.Budgets)
+	}
+	for _, t := range cfg.Tenants {
+		add(usage.Scope{Tenant: t.Name}, t.Budgets)
+		for _, k := range t.ClientKeys {
+			add(usage.Scope{ClientKey: k.Name}, k.Budgets)
+		}
+	}
+	return budgets
+}
+
+// clientWithinBudget returns an error wrapping usage.ErrSpendCapExceeded if the client key of the
+// context or its tenant has used up one of its budgets
+func (a *App) clientWithinBudget(ctx context.Context) error {
+	name := client.ClientKeyFromContext(ctx)
+	if name == "" {
+		return nil
+	}
+	return a.budgets.Exceeded(usage.Key{ClientKey: name, Tenant: client.TenantFromContext(ctx)})
+}
+
+// clientBudget returns what is left of the budgets of a client key and its tenant
+func (a *App) clientBudget(name string) (usage.Remaining, bool) {
+	return a.budgets.Remaining(usage.Key{ClientKey: name, Tenant: a.clientKeyTenant(name)})
+}
+
+// loadBudgets creates the budget tracker, counting the recorded usage of the budgets' current periods,
+// with notifications of crossed thresholds
+func (a *App) loadBudgets() *usage.Budgets {
+	budgets := usage.NewBudgets(getBudgets(a.Config))
+	for _, e := range a.usage.Entries(budgets.Earliest(), time.Now()) {
+		budgets.Record(e)
+	}
+	// Thresholds crossed before the start are not notified again
+	budgets.Thresholds = a.Config.BudgetAlerts.Thresholds
+	if len(budgets.Thresholds) == 0 {
+		budgets.Thresholds = defaultAlertThresholds
+	}
+	budgets.OnThreshold = a.notifyBudgetAlert
+	return budgets
+}
+
+// keyWithinBudget reports whether a provider key and its provider are within their budgets
+func (a *App) keyWithinBudget(provider string, kClient *client.KeyClient) bool {
+	return a.budgets.Exceeded(providerKey(provider, kClient)) == nil
+}
+
+// providerKey returns the usage key checked against the budgets of a provider key
+func providerKey(provider string, kClient *client.KeyClient) usage.Key {
+	return usage.Key{Provider: provider, KeyHash: usage.KeyHash(kClient.APIKey)}
+}
+
+// modelKey returns the usage key checked against the daily token cap of a model. It has no key hash,
+// which matches no key budget, so only the budgets of the model and its provider apply.
+func modelKey(m *Model) usage.Key {
+	return usage.Key{Provider: m.Provider, Model: m.Name}
+}
+
+// modelWithinBudget reports whether a model is within its daily token cap
+func (a *App) modelWithinBudget(m *Model) bool {
+	return a.budgets.Exceeded(modelKey(m)) == nil
+}
+
+// noCandidateError explains why no candidate of a group could be selected, reporting an exceeded
+// budget when some model of the group is only skipped because of its own or its keys' budgets
+func (a *App) noCandidateError(groupName string, models []*Model) error {
+	for _, m := range models {
+		if err := a.budgets.Exceeded(modelKey(m)); errors.Is(err, usage.ErrBudgetExceeded) {
+			return fmt.Errorf("no model of group %s is within budget: %w", groupName, err)
+		}
+		if pClient, exists := a.clients[m.Provider]; exists {
+			for _, kClient := range pClient.KeyClients {
+				if kClient.Drained() {
+					continue
+				}
+				if err := a.budgets.Exceeded(providerKey(m.Provider, kClient)); errors.Is(err, usage.ErrBudgetExceeded) {
+					return fmt.Errorf("no key of group %s is within budget: %w", groupName, err)
+				}
+			}
+		}
+	}
+	return fmt.Errorf("no clients available for group: %s", groupName)
+}
+
+// worstCaseCost is the most a request may cost on a model: its prompt tokens at the input price and its
+// max_tokens at the output price, or the rest of the context window when max_tokens is not set and the
+// context window is known
+func worstCaseCost(m *Model, promptTokens int64, maxTokens int64) float64 {
+	completionTokens := maxTokens
+	if completionTokens == 0 && m.ContextWindow > promptTokens {
+		completionTokens = m.ContextWindow - promptTokens
+	}
+	return m.Price.Cost(client.UsageRecord{PromptTokens: promptTokens, CompletionTokens: completionTokens, TotalTokens: promptTokens + completionTokens})
+}
+
+// requestWithinMaxCost returns an error wrapping server.ErrRequestTooExpensive if the worst-case cost of a
+// request on the model selected for it exceeds the maximum cost per request of its group
+func (a *App) requestWithinMaxCost(groupName string, provider string, model string, req openai.ChatCompletionRequest) error {
+	group := a.findGroup(groupName)
+	if group == nil || group.MaxRequestCost == 0 {
+		return nil
+	}
+	for _, m := range group.Models {
+		if m.Provider != provider || m.Name != model || m.Price == (client.Price{}) {
+			continue
+		}
+		maxTokens := int64(req.MaxCompletionTokens)
+		if maxTokens == 0 {
+			maxTokens = int64(req.MaxTokens)
+		}
+		cost := worstCaseCost(m, int64(a.countPromptTokens(m.Name, req)), maxTokens)
+		if cost > group.MaxRequestCost {
+			return fmt.Errorf("%w: the request could cost up to $%.4f on %s, more than the maximum of $%.4f per request of group %s; shorten the prompt or lower max_tokens",
+				server.ErrRequestTooExpensive, cost, model, group.MaxRequestCost, groupName)
+		}
+		return nil
+	}
+	return nil
+}
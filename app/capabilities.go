@@ -0,0 +1,64 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// requiredCapabilities returns the model capabilities a request needs beyond plain chat
+func requiredCapabilities(req openai.ChatCompletionRequest) []string {
+	vision, audio := false, false
+	for _, m := range req.Messages {
+		for _, part := range m.MultiContent {
+			switch part.Type {
+			case openai.ChatMessagePartTypeImageURL:
+				vision = true
+			case "input_audio":
+				audio = true
+			}
+		}
+	}
+
+	required := make([]string, 0)
+	if vision {
+		required = append(required, CapabilityVision)
+	}
+	if audio {
+		required = append(required, CapabilityAudio)
+	}
+	return required
+}
+
+// eligibleModels returns the models able to serve a request with the required capabilities.
+// Models declaring the capabilities are preferred; models without any known capabilities
+// are only used when no model in the group declares them.
+func eligibleModels(groupName string, models []*Model, required []string) ([]*Model, error) {
+	if len(required) == 0 {
+		return models, nil
+	}
+
+	capable := make([]*Model, 0)
+	unknown := make([]*Model, 0)
+	for _, m := range models {
+		if len(m.Capabilities) == 0 {
+			unknown = append(unknown, m)
+			continue
+		}
+		hasAll := true
+		for _, c := range required {
+			hasAll = hasAll && m.HasCapability(c)
+		}
+		if hasAll {
+			capable = append(capable, m)
+		}
+	}
+
+	if len(capable) > 0 {
+		return capable, nil
+	}
+	if len(unknown) > 0 {
+		return unknown, nil
+	}
+	return nil, fmt.Errorf("no models in group %s support the request's required capabilities: %v", groupName, required)
+}
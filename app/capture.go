@@ -0,0 +1,361 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"llm-router/client"
+	"llm-router/config"
+	"llm-router/utils"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	defaultCaptureQueueSize = 1000
+	// captureBatchSize is the maximum number of transcripts recorded at once, as one S3 object
+	captureBatchSize = 100
+	// captureFlushInterval is the longest time a transcript waits for its batch to fill up
+	captureFlushInterval = 10 * time.Second
+)
+
+// transcript is the complete record of a chat completion: the request as the client sent it and the response,
+// reassembled from the chunks of streams
+type transcript struct {
+	RequestID  string                         `json:"request_id"`
+	Time       time.Time                      `json:"time"`
+	ClientKey  string                         `json:"client_key,omitempty"`
+	Tenant     string                         `json:"tenant,omitempty"`
+	Group      string                         `json:"group"`
+	Provider   string                         `json:"provider,omitempty"`
+	Model      string                         `json:"model,omitempty"`
+	KeyID      string                         `json:"key_id,omitempty"`
+	Stream     bool                           `json:"stream"`
+	DurationMs int64                          `json:"duration_ms"`
+	Request    openai.ChatCompletionRequest   `json:"request"`
+	Response   *openai.ChatCompletionResponse `json:"response,omitempty"`
+	Error      string                         `json:"error,omitempty"`
+}
+
+// captureSink records batches of transcripts
+type captureSink struct {
+	name   string
+	record func(ctx context.Context, transcripts []transcript) error
+}
+
+// captures queues the transcripts of the requests of the groups and client keys with capture set and records
+// them to the sinks in batches, in the background, like usage events
+type captures struct {
+	queue   chan transcript
+	sinks   []captureSink
+	dropped atomic.Int64
+	logger  *slog.Logger
+	// clientKeys are the client keys with capture set, by tenant and name
+	clientKeys map[[2]string]bool
+}
+
+// startCapture starts recording transcripts to the configured sinks, or returns nil when none is configured
+func (a *App) startCapture() *captures {
+	cfg := a.Config.Capture
+	c := &captures{logger: a.componentLogger(logEvents), clientKeys: make(map[[2]string]bool)}
+	if cfg.File != "" {
+		file, err := utils.OpenRotatingFile(cfg.File, int64(cfg.MaxSize), cfg.MaxBackups)
+		if err != nil {
+			a.Logger.Error("Failed to open capture file, transcripts are not written to it", slog.String("path", cfg.File), slog.Any("error", err))
+		} else {
+			a.addRotatingFile(file)
+			c.sinks = append(c.sinks, captureSink{name: "file " + cfg.File, record: fileCaptureSink(file)})
+		}
+	}
+	if cfg.S3.Bucket != "" {
+		c.sinks = append(c.sinks, captureSink{name: "s3 bucket " + cfg.S3.Bucket, record: s3CaptureSink(cfg.S3)})
+	}
+	if len(c.sinks) == 0 {
+		return nil
+	}
+	for _, key := range a.Config.ClientKeys {
+		c.clientKeys[[2]string{"", key.Name}] = key.Capture
+	}
+	for _, tenant := range a.Config.Tenants {
+		for _, key := range tenant.ClientKeys {
+			c.clientKeys[[2]string{tenant.Name, key.Name}] = key.Capture
+		}
+	}
+
+	size := cfg.QueueSize
+	if size <= 0 {
+		size = defaultCaptureQueueSize
+	}
+	c.queue = make(chan transcript, size)
+	go c.run()
+	return c
+}
+
+// capturesRequest reports whether the transcript of a request of ctx to a group is recorded
+func (a *App) capturesRequest(ctx context.Context, groupName string) bool {
+	if a.captures == nil {
+		return false
+	}
+	if a.captures.clientKeys[[2]string{client.TenantFromContext(ctx), client.ClientKeyFromContext(ctx)}] {
+		return true
+	}
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	group := a.findGroup(groupName)
+	return group != nil && group.Capture
+}
+
+// newTranscript starts the transcript of a request of ctx to a group, as the client sent it
+func newTranscript(ctx context.Context, groupName string, req openai.ChatCompletionRequest) *transcript {
+	id := client.RequestIDFromContext(ctx)
+	if id == "" {
+		random := make([]byte, 16)
+		rand.Read(random)
+		id = hex.EncodeToString(random)
+	}
+	return &transcript{
+		RequestID: id,
+		Time:      time.Now().UTC(),
+		ClientKey: client.ClientKeyFromContext(ctx),
+		Tenant:    client.TenantFromContext(ctx),
+		Group:     groupName,
+		Stream:    req.Stream,
+		Request:   req,
+	}
+}
+
+// end completes the transcript of a request started at start, served on a route with a response or failed
+func (t *transcript) end(start time.Time, route client.Route, resp *openai.ChatCompletionResponse, err error) {
+	t.Provider, t.Model, t.KeyID = route.Provider, route.Model, route.KeyID
+	t.DurationMs = time.Since(start).Milliseconds()
+	t.Response = resp
+	if err != nil {
+		t.Error = err.Error()
+	}
+}
+
+// record queues a transcript, dropping it if the queue is full
+func (c *captures) record(t *transcript) {
+	select {
+	case c.queue <- *t:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// run records the queued transcripts once a batch is full or has waited for captureFlushInterval
+func (c *captures) run() {
+	ticker := time.NewTicker(captureFlushInterval)
+	defer ticker.Stop()
+	batch := make([]transcript, 0, captureBatchSize)
+	for {
+		select {
+		case t := <-c.queue:
+			batch = append(batch, t)
+			if len(batch) < captureBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if dropped := c.dropped.Swap(0); dropped > 0 {
+				c.logger.Warn("Capture queue full, transcripts dropped", slog.Int64("dropped", dropped))
+			}
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		c.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush records a batch to every sink, retrying failed sends with a growing delay
+func (c *captures) flush(batch []transcript) {
+	for _, sink := range c.sinks {
+		var err error
+		for attempt := 1; attempt <= eventAttempts; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+			err = sink.record(ctx, batch)
+			cancel()
+			if err == nil {
+				break
+			}
+			if attempt < eventAttempts {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+		if err != nil {
+			c.logger.Error("Failed to record transcripts", slog.String("sink", sink.name), slog.Int("transcripts", len(batch)), slog.Any("error", err))
+		}
+	}
+}
+
+// encodeTranscripts encodes transcripts as JSON lines
+func encodeTranscripts(transcripts []transcript) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, t := range transcripts {
+		if err := encoder.Encode(t); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// fileCaptureSink appends transcripts as JSON lines to a rotating file, a batch at once so that a rotation
+// never splits a transcript
+func fileCaptureSink(file *utils.RotatingFile) func(ctx context.Context, transcripts []transcript) error {
+	return func(ctx context.Context, transcripts []transcript) error {
+		data, err := encodeTranscripts(transcripts)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(data)
+		return err
+	}
+}
+
+// s3CaptureSink uploads each batch as a JSON lines object named after the date and a random ID under the
+// prefix, e.g. transcripts/2025/03/01/120000-9f86d081884c7d65.jsonl
+func s3CaptureSink(cfg config.CaptureS3) func(ctx context.Context, transcripts []transcript) error {
+	base := "https://" + cfg.Bucket + ".s3." + cfg.Region + ".amazonaws.com"
+	if cfg.Endpoint != "" {
+		base = strings.TrimSuffix(cfg.Endpoint, "/") + "/" + cfg.Bucket
+	}
+	signer := v4.NewSigner()
+	// The credentials of the default chain are cached and refreshed by the provider, loaded with the first batch
+	loadCredentials := sync.OnceValues(func() (aws.CredentialsProvider, error) {
+		if cfg.AccessKeyID != "" {
+			return credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken), nil
+		}
+		awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(), awsconfig.WithRegion(cfg.Region))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the AWS configuration: %w", err)
+		}
+		return awsCfg.Credentials, nil
+	})
+	return func(ctx context.Context, transcripts []transcript) error {
+		data, err := encodeTranscripts(transcripts)
+		if err != nil {
+			return err
+		}
+		random := make([]byte, 8)
+		rand.Read(random)
+		key := cfg.Prefix + time.Now().UTC().Format("2006/01/02/150405") + "-" + hex.EncodeToString(random) + ".jsonl"
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, base+"/"+key, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		provider, err := loadCredentials()
+		if err != nil {
+			return err
+		}
+		creds, err := provider.Retrieve(ctx)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(data)
+		payloadHash := hex.EncodeToString(hash[:])
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+		if err := signer.SignHTTP(ctx, creds, req, payloadHash, "s3", cfg.Region, time.Now()); err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("s3 returned status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// streamTranscript reassembles the response of a stream from its chunks: the content, reasoning, and tool calls
+// of every choice, and the final usage
+type streamTranscript struct {
+	mutex    sync.Mutex
+	response openai.ChatCompletionResponse
+	// choices are the reassembled choices by index
+	choices map[int]*openai.ChatCompletionChoice
+}
+
+// add adds a chunk to the response
+func (s *streamTranscript) add(chunk openai.ChatCompletionStreamResponse) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.choices == nil {
+		s.choices = make(map[int]*openai.ChatCompletionChoice)
+		s.response = openai.ChatCompletionResponse{ID: chunk.ID, Object: "chat.completion", Created: chunk.Created, Model: chunk.Model, SystemFingerprint: chunk.SystemFingerprint}
+	}
+	if chunk.Usage != nil {
+		s.response.Usage = *chunk.Usage
+	}
+	for _, delta := range chunk.Choices {
+		choice, exists := s.choices[delta.Index]
+		if !exists {
+			choice = &openai.ChatCompletionChoice{Index: delta.Index, Message: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}}
+			s.choices[delta.Index] = choice
+		}
+		if delta.Delta.Role != "" {
+			choice.Message.Role = delta.Delta.Role
+		}
+		choice.Message.Content += delta.Delta.Content
+		choice.Message.ReasoningContent += delta.Delta.ReasoningContent
+		choice.Message.Refusal += delta.Delta.Refusal
+		for _, call := range delta.Delta.ToolCalls {
+			index := len(choice.Message.ToolCalls)
+			if call.Index != nil {
+				index = *call.Index
+			}
+			for len(choice.Message.ToolCalls) <= index {
+				choice.Message.ToolCalls = append(choice.Message.ToolCalls, openai.ToolCall{})
+			}
+			merged := &choice.Message.ToolCalls[index]
+			if call.ID != "" {
+				merged.ID = call.ID
+			}
+			if call.Type != "" {
+				merged.Type = call.Type
+			}
+			merged.Function.Name += call.Function.Name
+			merged.Function.Arguments += call.Function.Arguments
+		}
+		if delta.FinishReason != "" {
+			choice.FinishReason = delta.FinishReason
+		}
+	}
+}
+
+// result returns the reassembled response, nil when no chunk was received
+func (s *streamTranscript) result() *openai.ChatCompletionResponse {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.choices == nil {
+		return nil
+	}
+	resp := s.response
+	indices := slices.Sorted(maps.Keys(s.choices))
+	resp.Choices = make([]openai.ChatCompletionChoice, len(indices))
+	for i, index := range indices {
+		resp.Choices[i] = *s.choices[index]
+	}
+	return &resp
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"llm-router/client"
+	"llm-router/server"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// debugRouting returns the routing state: the candidates of every group as getClient sees them now and the
+// usage, penalties, and cooldowns of every key
+func (a *App) debugRouting() server.DebugRouting {
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	now := time.Now()
+	routing := server.DebugRouting{
+		Time:   now,
+		Groups: make([]server.DebugRoutingGroup, 0, len(a.Groups)),
+		Keys:   make([]server.DebugRoutingKey, 0),
+	}
+	for _, g := range a.Groups {
+		group := server.DebugRoutingGroup{Name: g.Name, Strategy: g.Strategy}
+		if group.Strategy == "" {
+			group.Strategy = StrategyBalanced
+		}
+		// A request without content selects as a plain text request of the group would
+		explanation := &routeExplanation{}
+		if _, _, _, err := a.selectClientForGroup(openai.ChatCompletionRequest{Model: g.Name}, nil, "", explanation); err != nil {
+			group.Error = err.Error()
+		}
+		group.Candidates = explanation.list()
+		if group.Candidates == nil {
+			group.Candidates = make([]client.Candidate, 0)
+		}
+		routing.Groups = append(routing.Groups, group)
+	}
+	for _, p := range a.Providers {
+		pClient, exists := a.clients[p.Name]
+		if !exists {
+			continue
+		}
+		for _, kClient := range pClient.KeyClients {
+			health := kClient.Health()
+			key := server.DebugRoutingKey{
+				KeyID:      providerKeyID(p.Name, kClient),
+				Free:       kClient.Free,
+				Tenant:     kClient.Tenant,
+				Drained:    health.Drained,
+				Circuit:    server.CircuitClosed,
+				Usage:      kClient.ModelUsage(),
+				OverBudget: !a.keyWithinBudget(p.Name, kClient),
+			}
+			if now.Before(health.RateLimitedUntil) {
+				key.Circuit = server.CircuitOpen
+				key.RateLimitedUntil = &health.RateLimitedUntil
+			}
+			for model := range key.Usage {
+				if penalties := kClient.Penalties(model); penalties != 0 {
+					if key.Penalties == nil {
+						key.Penalties = make(map[string]int64)
+					}
+					key.Penalties[model] = penalties
+				}
+			}
+			routing.Keys = append(routing.Keys, key)
+		}
+	}
+	return routing
+}
@@ -0,0 +1,159 @@
+package app
+
+import (
+	"llm-router/config"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errorRateBuckets is the number of buckets the error rate window is split into, the oldest expiring at once
+const errorRateBuckets = 10
+
+// errorRates measures the share of failed attempts at every provider over a sliding window and whether it
+// exceeds the provider's threshold. The zero value is ready to use.
+type errorRates struct {
+	mutex     sync.Mutex
+	providers map[string]*providerErrorRate
+}
+
+// providerErrorRate holds the attempts at a provider in buckets of time, oldest first
+type providerErrorRate struct {
+	buckets  []errorRateBucket
+	alerting bool
+}
+
+type errorRateBucket struct {
+	start    time.Time
+	requests int
+	errors   int
+}
+
+// errorRate is the error rate of a provider within the window
+type errorRate struct {
+	Requests int
+	Errors   int
+	// Alerting is set while the rate exceeds the threshold
+	Alerting bool
+}
+
+// rate returns the share of the requests that failed
+func (r errorRate) rate() float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+	return float64(r.Errors) / float64(r.Requests)
+}
+
+// observe counts an attempt at a provider and returns the provider's error rate within the window ending now,
+// alerting once at least minRequests were made and more than threshold of them failed. changed is set when the
+// attempt raised or resolved the alert.
+func (r *errorRates) observe(provider string, failed bool, now time.Time, window time.Duration, threshold float64, minRequests int) (rate errorRate, changed bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.providers == nil {
+		r.providers = make(map[string]*providerErrorRate)
+	}
+	p, exists := r.providers[provider]
+	if !exists {
+		p = &providerErrorRate{}
+		r.providers[provider] = p
+	}
+	expired := 0
+	for expired < len(p.buckets) && now.Sub(p.buckets[expired].start) >= window {
+		expired++
+	}
+	p.buckets = p.buckets[expired:]
+	width := window / errorRateBuckets
+	if n := len(p.buckets); n == 0 || now.Sub(p.buckets[n-1].start) >= width {
+		p.buckets = append(p.buckets, errorRateBucket{start: now})
+	}
+	last := &p.buckets[len(p.buckets)-1]
+	last.requests++
+	if failed {
+		last.errors++
+	}
+	for _, b := range p.buckets {
+		rate.Requests += b.requests
+		rate.Errors += b.errors
+	}
+	alerting := rate.Requests >= minRequests && rate.rate() > threshold
+	changed = alerting != p.alerting
+	p.alerting = alerting
+	rate.Alerting = alerting
+	return rate, changed
+}
+
+// errorRateThreshold returns the error rate over which a provider alerts, disabled when 0. The caller holds
+// reloadMutex.
+func (a *App) errorRateThreshold(provider string) float64 {
+	if a.Config == nil {
+		return 0
+	}
+	for _, p := range a.Config.Providers {
+		if p.Name == provider && p.ErrorRateThreshold > 0 {
+			return p.ErrorRateThreshold
+		}
+	}
+	return a.Config.ErrorRateAlerts.Threshold
+}
+
+// observeErrorRate counts an attempt at a provider towards its error rate, raising an alert when the rate
+// exceeds the provider's threshold and resolving it once a later attempt finds the rate back under it. Attempts
+// canceled by their client or rejected as invalid are not counted as failures of the provider.
+func (a *App) observeErrorRate(provider string, err error) {
+	if provider == "" {
+		return
+	}
+	a.reloadMutex.RLock()
+	threshold := a.errorRateThreshold(provider)
+	var settings config.ErrorRateAlerts
+	if a.Config != nil {
+		settings = a.Config.ErrorRateAlerts
+	}
+	a.reloadMutex.RUnlock()
+	if threshold <= 0 {
+		return
+	}
+	window := settings.Window
+	if window <= 0 {
+		window = config.DefaultErrorRateWindow
+	}
+	failed := err != nil && errorClass(err) != errorClassCanceled && errorClass(err) != errorClassInvalidRequest
+	rate, changed := a.errorRates.observe(provider, failed, time.Now(), window, threshold, settings.MinRequests)
+	if !changed {
+		return
+	}
+	if a.metrics != nil {
+		value := 0.0
+		if rate.Alerting {
+			value = 1
+		}
+		a.metrics.errorRateAlert.Set(value, provider)
+	}
+	alert := errorRateAlert{
+		Type:          "error_rate.resolved",
+		Provider:      provider,
+		ErrorRate:     rate.rate(),
+		Threshold:     threshold,
+		Requests:      rate.Requests,
+		Errors:        rate.Errors,
+		WindowSeconds: int64(window.Seconds()),
+		Time:          time.Now().UTC(),
+	}
+	attrs := []any{slog.String("provider", provider), slog.Float64("error_rate", alert.ErrorRate), slog.Float64("threshold", threshold),
+		slog.Int("requests", rate.Requests), slog.Int("errors", rate.Errors), slog.Duration("window", window)}
+	if rate.Alerting {
+		alert.Type = "error_rate.threshold"
+		a.Logger.Error("Provider error rate over threshold", attrs...)
+	} else {
+		a.Logger.Info("Provider error rate back under threshold", attrs...)
+	}
+	for _, webhook := range settings.Webhooks {
+		go func() {
+			if err := postWebhook(webhook, alert); err != nil {
+				a.Logger.Error("Failed to deliver error rate alert", slog.String("url", webhook.URL), slog.Any("error", err))
+			}
+		}()
+	}
+}
@@ -0,0 +1,301 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"llm-router/config"
+	"llm-router/kafka"
+	"llm-router/ledger"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultEventQueueSize = 10000
+	// eventBatchSize is the maximum number of events shipped at once
+	eventBatchSize = 100
+	// eventFlushInterval is the longest time an event waits for its batch to fill up
+	eventFlushInterval = time.Second
+	// eventAttempts is the number of times a batch is sent to a sink before it is given up
+	eventAttempts = 3
+)
+
+// usageEventType is the type of the event of a completed request
+const usageEventType = "request.completed"
+
+// usageEvent is the event of a completed request: its ledger entry with an identifier to deduplicate retries by
+type usageEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	ledger.Entry
+}
+
+// eventSink ships batches of events to an external system, from a queue of its own so that a slow or
+// unavailable sink does not hold up the others
+type eventSink struct {
+	name  string
+	send  func(ctx context.Context, events []usageEvent) error
+	close func() error
+	// batches waits for shipping, further batches being dropped while it is full
+	batches chan []usageEvent
+	dropped atomic.Int64
+}
+
+// usageEvents queues the events of completed requests and ships them to the sinks in batches, in the background,
+// so that slow or unavailable sinks never delay requests
+type usageEvents struct {
+	// mutex is held to queue events and to stop, so that no event is queued once the queue is drained
+	mutex    sync.RWMutex
+	stopped  bool
+	stopping chan struct{}
+	// done is closed once the sinks shipped the batches left when stopping
+	done    chan struct{}
+	queue   chan usageEvent
+	sinks   []*eventSink
+	dropped atomic.Int64
+	logger  *slog.Logger
+}
+
+// startUsageEvents starts shipping usage events to the configured sinks, or returns nil when none is configured
+func (a *App) startUsageEvents() *usageEvents {
+	cfg := a.Config.UsageEvents
+	events := &usageEvents{logger: a.componentLogger(logEvents)}
+	for _, webhook := range cfg.Webhooks {
+		events.sinks = append(events.sinks, &eventSink{name: "webhook " + webhook.URL, send: webhookEventSink(webhook)})
+	}
+	if cfg.File != "" {
+		send, closeFile, err := fileEventSink(cfg.File)
+		if err != nil {
+			a.Logger.Error("Failed to open usage event file, events are not written to it", slog.String("path", cfg.File), slog.Any("error", err))
+		} else {
+			events.sinks = append(events.sinks, &eventSink{name: "file " + cfg.File, send: send, close: closeFile})
+		}
+	}
+	if len(cfg.Kafka.Brokers) > 0 {
+		producer, err := kafka.NewProducer(kafkaOptions(cfg.Kafka))
+		if err != nil {
+			a.Logger.Error("Failed to create Kafka producer, events are not produced", slog.String("topic", cfg.Kafka.Topic), slog.Any("error", err))
+		} else {
+			events.sinks = append(events.sinks, &eventSink{name: "kafka topic " + cfg.Kafka.Topic, send: kafkaEventSink(producer), close: producer.Close})
+		}
+	}
+	if len(events.sinks) == 0 {
+		return nil
+	}
+
+	size := cfg.QueueSize
+	if size <= 0 {
+		size = defaultEventQueueSize
+	}
+	events.queue = make(chan usageEvent, size)
+	events.stopping = make(chan struct{})
+	events.done = make(chan struct{})
+	var shipping sync.WaitGroup
+	for _, sink := range events.sinks {
+		sink.batches = make(chan []usageEvent, max(size/eventBatchSize, 1))
+		shipping.Go(func() { events.ship(sink) })
+	}
+	go func() {
+		events.run()
+		shipping.Wait()
+		close(events.done)
+	}()
+	return events
+}
+
+// kafkaOptions returns the producer options of the configured topic
+func kafkaOptions(cfg config.Kafka) kafka.Options {
+	options := kafka.Options{
+		Brokers: cfg.Brokers,
+		Topic:   cfg.Topic,
+		SASL:    kafka.SASL{Mechanism: cfg.SASL.Mechanism, Username: cfg.SASL.Username, Password: cfg.SASL.Password},
+	}
+	if cfg.TLS {
+		options.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return options
+}
+
+// emit queues the event of a request, dropping it if the queue is full or the events stopped
+func (e *usageEvents) emit(entry ledger.Entry) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	if e.stopped {
+		e.dropped.Add(1)
+		return
+	}
+	select {
+	case e.queue <- usageEvent{ID: hex.EncodeToString(id), Type: usageEventType, Entry: entry}:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// stop ships the queued events and waits for the sinks to finish, for at most as long as ctx allows.
+// Events emitted afterwards are dropped.
+func (e *usageEvents) stop(ctx context.Context) error {
+	e.mutex.Lock()
+	if !e.stopped {
+		e.stopped = true
+		close(e.stopping)
+	}
+	e.mutex.Unlock()
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run hands the queued events to the sinks once a batch is full or has waited for eventFlushInterval, and
+// the events left in the queue once stopping
+func (e *usageEvents) run() {
+	ticker := time.NewTicker(eventFlushInterval)
+	defer ticker.Stop()
+	batch := make([]usageEvent, 0, eventBatchSize)
+	for {
+		select {
+		case event := <-e.queue:
+			batch = append(batch, event)
+			if len(batch) < eventBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			e.reportDropped()
+			if len(batch) == 0 {
+				continue
+			}
+		case <-e.stopping:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+				if len(batch) == eventBatchSize {
+					e.dispatch(batch)
+					batch = make([]usageEvent, 0, eventBatchSize)
+				}
+			}
+			if len(batch) > 0 {
+				e.dispatch(batch)
+			}
+			for _, sink := range e.sinks {
+				close(sink.batches)
+			}
+			e.reportDropped()
+			return
+		}
+		e.dispatch(batch)
+		batch = make([]usageEvent, 0, eventBatchSize)
+	}
+}
+
+// dispatch queues a batch for every sink, dropping it for sinks that fell too far behind
+func (e *usageEvents) dispatch(batch []usageEvent) {
+	for _, sink := range e.sinks {
+		select {
+		case sink.batches <- batch:
+		default:
+			sink.dropped.Add(int64(len(batch)))
+		}
+	}
+}
+
+// reportDropped logs the events dropped since the last report
+func (e *usageEvents) reportDropped() {
+	if dropped := e.dropped.Swap(0); dropped > 0 {
+		e.logger.Warn("Usage event queue full, events dropped", slog.Int64("dropped", dropped))
+	}
+	for _, sink := range e.sinks {
+		if dropped := sink.dropped.Swap(0); dropped > 0 {
+			e.logger.Warn("Usage event sink behind, events dropped", slog.String("sink", sink.name), slog.Int64("dropped", dropped))
+		}
+	}
+}
+
+// ship sends the batches queued for a sink until its queue is closed, retrying failed sends with a growing
+// delay, then closes the sink
+func (e *usageEvents) ship(sink *eventSink) {
+	for batch := range sink.batches {
+		var err error
+		for attempt := 1; attempt <= eventAttempts; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+			err = sink.send(ctx, batch)
+			cancel()
+			if err == nil {
+				break
+			}
+			if attempt < eventAttempts {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+		if err != nil {
+			e.logger.Error("Failed to ship usage events", slog.String("sink", sink.name), slog.Int("events", len(batch)), slog.Any("error", err))
+		}
+	}
+	if sink.close != nil {
+		if err := sink.close(); err != nil {
+			e.logger.Error("Failed to close usage event sink", slog.String("sink", sink.name), slog.Any("error", err))
+		}
+	}
+}
+
+// webhookEventSink posts batches as JSON arrays
+func webhookEventSink(webhook config.Webhook) func(ctx context.Context, events []usageEvent) error {
+	return func(ctx context.Context, events []usageEvent) error {
+		body, err := json.Marshal(events)
+		if err != nil {
+			return err
+		}
+		return postJSON(ctx, webhook, body)
+	}
+}
+
+// fileEventSink appends events as JSON lines to the file at path, creating it and its directory if needed,
+// and returns the function closing the file
+func fileEventSink(path string) (func(ctx context.Context, events []usageEvent) error, func() error, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, nil, err
+		}
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(ctx context.Context, events []usageEvent) error {
+		// A batch is appended at once, so that the lines of the processes of a handover never interleave
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		for _, event := range events {
+			if err := encoder.Encode(event); err != nil {
+				return err
+			}
+		}
+		_, err := file.Write(buf.Bytes())
+		return err
+	}, file.Close, nil
+}
+
+// kafkaEventSink produces an event per message, keyed by client key
+func kafkaEventSink(producer *kafka.Producer) func(ctx context.Context, events []usageEvent) error {
+	return func(ctx context.Context, events []usageEvent) error {
+		messages := make([]kafka.Message, len(events))
+		for i, event := range events {
+			value, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			messages[i] = kafka.Message{Key: []byte(event.ClientKey), Value: value}
+		}
+		return producer.Produce(ctx, messages)
+	}
+}
@@ -0,0 +1,112 @@
+package app
+
+import (
+	"context"
+	"llm-router/client"
+	"log/slog"
+)
+
+// Reasons candidates are skipped, reported in route explanations
+const (
+	skipDrained       = "drained"
+	skipRateLimited   = "rate_limited"
+	skipFailed        = "failed_this_request"
+	skipKeyBudget     = "key_over_budget"
+	skipModelBudget   = "model_over_budget"
+	skipFreeFirst     = "free_key_available"
+	skipCapability    = "missing_capability"
+	skipContextWindow = "context_window_too_small"
+	skipPricier       = "pricier"
+	// skipTenant is the reason of keys dedicated to another tenant, which are left out of explanations
+	skipTenant = "other_tenant"
+)
+
+// routeExplanation collects the candidates evaluated when routing a request. Its methods do nothing on a nil
+// explanation, which is passed when no explanation is wanted.
+type routeExplanation struct {
+	candidates []client.Candidate
+}
+
+// explainsRouting reports whether the routing of a request is explained, because the request asked for it or
+// explain_routing is set
+func (a *App) explainsRouting(ctx context.Context) bool {
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	return client.RouteExplanationRequested(ctx) || (a.Config != nil && a.Config.ExplainRouting)
+}
+
+// newRouteExplanation returns an empty explanation if the routing of the request is explained, nil otherwise
+func (a *App) newRouteExplanation(ctx context.Context) *routeExplanation {
+	if !a.explainsRouting(ctx) {
+		return nil
+	}
+	return &routeExplanation{}
+}
+
+// add records a key of a model's provider as a candidate, skipped for a reason unless empty.
+// It returns the index of the candidate, -1 if it was not recorded.
+func (e *routeExplanation) add(m *Model, kClient *client.KeyClient, score int64, skipped string) int {
+	if e == nil || skipped == skipTenant {
+		return -1
+	}
+	e.candidates = append(e.candidates, client.Candidate{
+		Provider:  m.Provider,
+		Model:     m.Name,
+		KeyID:     providerKeyID(m.Provider, kClient),
+		Weight:    m.Weight,
+		Usage:     kClient.BalanceUsage(m.Name, m.BalanceOn),
+		Penalties: kClient.Penalties(m.Name),
+		Score:     score,
+		Skipped:   skipped,
+	})
+	return len(e.candidates) - 1
+}
+
+// selected marks the candidate at index i as the winner
+func (e *routeExplanation) selected(i int) {
+	if e == nil || i < 0 {
+		return
+	}
+	e.candidates[i].Selected = true
+}
+
+// list returns the candidates, nil for a nil explanation
+func (e *routeExplanation) list() []client.Candidate {
+	if e == nil {
+		return nil
+	}
+	return e.candidates
+}
+
+// skipModels records the keys of the models left out of kept as candidates skipped for a reason
+func (a *App) skipModels(e *routeExplanation, models []*Model, kept []*Model, reason string, tenant string) {
+	if e == nil {
+		return
+	}
+	remaining := make(map[*Model]bool, len(kept))
+	for _, m := range kept {
+		remaining[m] = true
+	}
+	for _, m := range models {
+		if remaining[m] {
+			continue
+		}
+		if pClient, exists := a.clients[m.Provider]; exists {
+			for _, kClient := range pClient.KeyClients {
+				skipped := reason
+				if !a.keyServesTenant(m.Provider, kClient, tenant) {
+					skipped = skipTenant
+				}
+				e.add(m, kClient, kClient.BalanceUsage(m.Name, m.BalanceOn)*m.Weight, skipped)
+			}
+		}
+	}
+}
+
+// logRouteExplanation logs the candidates evaluated for a request of a group
+func (a *App) logRouteExplanation(groupName string, e *routeExplanation) {
+	if e == nil {
+		return
+	}
+	a.Logger.Info("Route explanation", slog.String("group", groupName), slog.Any("candidates", e.candidates))
+}
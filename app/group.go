@@ -1,6 +1,67 @@
 package app
 
+import (
+	"llm-router/config"
+
+	"github.com/sashabaranov/go-openai"
+)
+
 type Group struct {
 	Name   string
 	Models []*Model
+
+	ValidateResponseFormat bool
+	// Strategy is StrategyBalanced or StrategyCheapest, empty for balanced
+	Strategy string
+	// MaxRequestCost is the maximum worst-case cost in USD of a request, unlimited when 0
+	MaxRequestCost float64
+	// Defaults are the parameters applied to requests that omit them
+	Defaults config.RequestDefaults
+	// Capture records the transcripts of the group's requests
+	Capture bool
+}
+
+// applyDefaults sets the group's default parameters that the request omits. Requests setting either
+// max_tokens or max_completion_tokens keep their limit.
+func (g *Group) applyDefaults(req *openai.ChatCompletionRequest) {
+	if g.Defaults.MaxTokens > 0 && req.MaxTokens == 0 && req.MaxCompletionTokens == 0 {
+		req.MaxTokens = g.Defaults.MaxTokens
+	}
+	if g.Defaults.Temperature > 0 && req.Temperature == 0 {
+		req.Temperature = g.Defaults.Temperature
+	}
+	if g.Defaults.System == "" {
+		return
+	}
+	for _, message := range req.Messages {
+		if message.Role == openai.ChatMessageRoleSystem || message.Role == openai.ChatMessageRoleDeveloper {
+			return
+		}
+	}
+	system := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: g.Defaults.System}
+	req.Messages = append([]openai.ChatCompletionMessage{system}, req.Messages...)
+}
+
+// ContextWindow returns the largest context window among the group's models
+func (g *Group) ContextWindow() int64 {
+	var window int64
+	for _, m := range g.Models {
+		window = max(window, m.ContextWindow)
+	}
+	return window
+}
+
+// Capabilities returns the capabilities offered by at least one of the group's models
+func (g *Group) Capabilities() []string {
+	capabilities := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, m := range g.Models {
+		for _, c := range m.Capabilities {
+			if !seen[c] {
+				seen[c] = true
+				capabilities = append(capabilities, c)
+			}
+		}
+	}
+	return capabilities
 }
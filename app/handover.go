@@ -0,0 +1,329 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"llm-router/usage"
+	"llm-router/utils"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// envInheritedListeners is the number of listeners a process started by a handover inherits, as the file
+// descriptors from 3 on, followed by the pipe it reports listening on and the pipe the previous process sends
+// the usage it records after the handover on
+const envInheritedListeners = "LLM_ROUTER_INHERITED_LISTENERS"
+
+// handoverTimeout is how long the new process of a handover is given to start listening
+const handoverTimeout = time.Minute
+
+// inherited holds the listeners handed over by the previous process until those of the same addresses take
+// them over, the pipe that process waits on for this one to listen, and the pipe it sends its last usage on
+var inherited struct {
+	mu        sync.Mutex
+	listeners []net.Listener
+	ready     *os.File
+	usage     *os.File
+}
+
+// inheritListeners takes the listeners handed over by the previous process, when this one was started by a
+// handover
+func inheritListeners() error {
+	count := os.Getenv(envInheritedListeners)
+	if count == "" {
+		return nil
+	}
+	// The processes this one hands over to later inherit listeners of their own
+	os.Unsetenv(envInheritedListeners)
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%s=%q is not a number of listeners", envInheritedListeners, count)
+	}
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	for i := range n {
+		file := os.NewFile(uintptr(3+i), "listener")
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to inherit listener %d: %w", i, err)
+		}
+		inherited.listeners = append(inherited.listeners, listener)
+	}
+	inherited.ready = os.NewFile(uintptr(3+n), "ready")
+	inherited.usage = os.NewFile(uintptr(4+n), "usage")
+	return nil
+}
+
+// takeInherited returns the inherited listener of an address, nil when none was handed over
+func takeInherited(network string, address string) net.Listener {
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	for i, listener := range inherited.listeners {
+		if sameAddress(listener.Addr(), network, address) {
+			inherited.listeners = slices.Delete(inherited.listeners, i, i+1)
+			return listener
+		}
+	}
+	return nil
+}
+
+// sameAddress returns whether a listener's address is that of a setting, the path of a Unix socket or a TCP
+// address, whose unspecified hosts match any interface
+func sameAddress(addr net.Addr, network string, address string) bool {
+	if addr.Network() != network {
+		return false
+	}
+	if network == "unix" {
+		return addr.String() == address
+	}
+	listening, ok := addr.(*net.TCPAddr)
+	want, err := net.ResolveTCPAddr("tcp", address)
+	if !ok || err != nil || want.Port == 0 || want.Port != listening.Port {
+		return false
+	}
+	return listening.IP.Equal(want.IP) || (listening.IP.IsUnspecified() && (want.IP == nil || want.IP.IsUnspecified()))
+}
+
+// reportListening writes the PID file and, after a handover, closes the inherited listeners no setting took
+// over any longer and tells the previous process this one is listening
+func (a *App) reportListening() {
+	if a.Config.PIDFile != "" {
+		if err := writePIDFile(a.Config.PIDFile); err != nil {
+			a.Logger.Error("Failed to write the PID file", slog.String("path", a.Config.PIDFile), slog.Any("error", err))
+		}
+	}
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	for _, listener := range inherited.listeners {
+		a.Logger.Info("Closing inherited listener no longer configured", slog.String("address", listener.Addr().String()))
+		listener.Close()
+	}
+	inherited.listeners = nil
+	if inherited.ready != nil {
+		inherited.ready.Write([]byte{1})
+		inherited.ready.Close()
+		inherited.ready = nil
+	}
+}
+
+// writePIDFile writes the PID of the process to a file, replacing it at once so that it is never read partly
+// written
+func writePIDFile(path string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// watchSignals shuts the router down on SIGINT and SIGTERM, and hands its listeners over to a new process
+// of its executable on SIGUSR2, finishing the requests in flight either way
+func (a *App) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, handoverSignals...)...)
+	go func() {
+		for sig := range signals {
+			handover := slices.Contains(handoverSignals, sig)
+			if handover {
+				a.Logger.Info("Handing over to a new process", slog.String("signal", sig.String()))
+				pid, err := a.handOver()
+				if err != nil {
+					a.Logger.Error("Failed to hand over to a new process, serving on", slog.Any("error", err))
+					continue
+				}
+				a.Logger.Info("Handed over to a new process, finishing the requests in flight", slog.Int("pid", pid))
+			} else {
+				a.Logger.Info("Shutting down, finishing the requests in flight", slog.String("signal", sig.String()))
+			}
+			signal.Stop(signals)
+			a.shutdown(handover)
+			return
+		}
+	}()
+}
+
+// handOver starts a new process of the router's executable with the same arguments and environment, handing
+// it the listeners, and returns its PID once it listens. The usage history is saved first for it to load, and
+// the usage recorded from then on is no longer saved but sent to it by shutdown.
+func (a *App) handOver() (pid int, err error) {
+	if err := a.usage.HandOver(); err != nil {
+		a.Logger.Error("Failed to save usage history", slog.Any("error", err))
+	}
+	defer func() {
+		if err != nil {
+			// Serving on, this process saves its usage again
+			a.usage.Changes()
+		}
+	}()
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, listener := range a.listeners {
+		filer, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return 0, fmt.Errorf("listener %s cannot be handed over", listener.Addr())
+		}
+		file, err := filer.File()
+		if err != nil {
+			return 0, fmt.Errorf("failed to hand over listener %s: %w", listener.Addr(), err)
+		}
+		files = append(files, file)
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+	files = append(files, readyWriter)
+	usageReader, usageWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			usageWriter.Close()
+		}
+	}()
+	files = append(files, usageReader)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", envInheritedListeners, len(a.listeners)))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	// The pipe reads EOF once the new process exits without reporting, unless this one keeps it open
+	readyWriter.Close()
+	go cmd.Wait()
+
+	reported := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		reported <- err
+	}()
+	select {
+	case err := <-reported:
+		if errors.Is(err, io.EOF) {
+			return 0, errors.New("the new process exited before listening")
+		} else if err != nil {
+			return 0, err
+		}
+	case <-time.After(handoverTimeout):
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("the new process did not listen within %s", handoverTimeout)
+	}
+	// The sockets are the new process's to remove once it stops
+	for _, listener := range a.listeners {
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+	// Both processes append to the log and capture files until the requests in flight end, only the new one
+	// rotating them
+	for _, file := range a.rotatingFiles {
+		file.Follow()
+	}
+	a.usageHandover = usageWriter
+	return cmd.Process.Pid, nil
+}
+
+// addRotatingFile keeps a file the logs or transcripts are appended to, for it to stop rotating once handed
+// over; nil files are ignored
+func (a *App) addRotatingFile(file *utils.RotatingFile) {
+	if file != nil {
+		a.rotatingFiles = append(a.rotatingFiles, file)
+	}
+}
+
+// sendUsage sends the new process of a handover the usage recorded since, once the requests in flight ended
+func (a *App) sendUsage() {
+	if a.usageHandover == nil {
+		return
+	}
+	defer a.usageHandover.Close()
+	a.usageHandover.SetWriteDeadline(time.Now().Add(handoverTimeout))
+	if err := json.NewEncoder(a.usageHandover).Encode(a.usage.Changes()); err != nil {
+		a.Logger.Error("Failed to send the usage recorded since the handover to the new process", slog.Any("error", err))
+	}
+}
+
+// receiveUsage adds the usage the previous process of a handover sends once it finished its requests in
+// flight, when this process was started by a handover
+func (a *App) receiveUsage() {
+	inherited.mu.Lock()
+	pipe := inherited.usage
+	inherited.usage = nil
+	inherited.mu.Unlock()
+	if pipe == nil {
+		return
+	}
+	go func() {
+		defer pipe.Close()
+		var entries []usage.Entry
+		if err := json.NewDecoder(pipe).Decode(&entries); err != nil {
+			a.Logger.Error("Failed to receive the usage the previous process recorded after the handover", slog.Any("error", err))
+			return
+		}
+		a.usage.Add(entries)
+		for _, e := range entries {
+			a.budgets.Record(e)
+		}
+		a.Logger.Info("Added the usage the previous process recorded after the handover", slog.Int("entries", len(entries)))
+	}()
+}
+
+// shutdown stops the listeners and waits for the requests in flight to end, for at most the shutdown
+// timeout, and ships the usage events still queued within the same timeout. It then saves the usage history
+// and removes the PID file, or, once handed over to a new process, which took them over, sends it the usage
+// recorded since the handover instead.
+func (a *App) shutdown(handedOver bool) {
+	a.stopping.Add(1)
+	defer a.stopping.Done()
+	if a.usageSaves != nil {
+		close(a.usageSaves)
+	}
+	ctx := context.Background()
+	if timeout := a.Config.ServerTimeouts.ShutdownTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := a.Server.Shutdown(ctx); err != nil {
+		a.Logger.Warn("Closed the connections of the requests still in flight", slog.Any("error", err))
+	}
+	if a.events != nil {
+		if err := a.events.stop(ctx); err != nil {
+			a.Logger.Warn("Gave up shipping the usage events still queued", slog.Any("error", err))
+		}
+	}
+	if handedOver {
+		a.sendUsage()
+		return
+	}
+	if err := a.usage.Save(); err != nil {
+		a.Logger.Error("Failed to save usage history", slog.Any("error", err))
+	}
+	if a.Config.PIDFile != "" {
+		os.Remove(a.Config.PIDFile)
+	}
+}
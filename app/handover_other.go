@@ -0,0 +1,8 @@
+//go:build !unix
+
+package app
+
+import "os"
+
+// handoverSignals hand the listeners over to a new process, which is only supported on Unix systems
+var handoverSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package app
+
+import (
+	"os"
+	"syscall"
+)
+
+// handoverSignals hand the listeners over to a new process
+var handoverSignals = []os.Signal{syscall.SIGUSR2}
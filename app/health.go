@@ -0,0 +1,96 @@
+package app
+
+import (
+	"context"
+	"llm-router/server"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// probeTimeout bounds a single key probe
+const probeTimeout = 10 * time.Second
+
+// probeKeys probes every provider key concurrently
+func (a *App) probeKeys(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	a.reloadMutex.RLock()
+	clients := a.clients
+	a.reloadMutex.RUnlock()
+	var wg sync.WaitGroup
+	for _, pClient := range clients {
+		for _, kClient := range pClient.KeyClients {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				kClient.Probe(ctx, pClient.BaseURL)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// startHealthProber probes the provider keys in the background at the given interval
+func (a *App) startHealthProber(interval time.Duration) {
+	a.Logger.Info("Starting upstream health prober", slog.Duration("interval", interval))
+	go func() {
+		for {
+			a.probeKeys(context.Background())
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// DeepHealth reports the reachability of the providers and the validity of their keys, using the
+// background prober's results or probing now when the prober is disabled
+func (a *App) DeepHealth(ctx context.Context) server.DeepHealth {
+	if a.Config.HealthCheckInterval <= 0 {
+		a.probeKeys(ctx)
+	}
+
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	health := server.DeepHealth{
+		Status:    server.HealthStatusOK,
+		Groups:    make([]server.GroupHealth, 0, len(a.Groups)),
+		Providers: make([]server.ProviderHealth, 0, len(a.Providers)),
+	}
+
+	healthyProviders := make(map[string]bool)
+	for _, p := range a.Providers {
+		provider := server.ProviderHealth{Name: p.Name, Keys: make([]server.KeyHealth, 0)}
+		if pClient, exists := a.clients[p.Name]; exists {
+			for i, kClient := range pClient.KeyClients {
+				state := kClient.Health()
+				key := server.KeyHealth{Index: i, Drained: state.Drained}
+				if probe := state.Probe; probe != nil {
+					key.Reachable = probe.Reachable
+					key.Valid = probe.Valid
+					key.StatusCode = probe.StatusCode
+					key.Error = probe.Error
+					key.ProbedAt = probe.ProbedAt
+				}
+				provider.Reachable = provider.Reachable || key.Reachable
+				if key.Reachable && key.Valid && !key.Drained {
+					healthyProviders[p.Name] = true
+				}
+				provider.Keys = append(provider.Keys, key)
+			}
+		}
+		health.Providers = append(health.Providers, provider)
+	}
+
+	for _, g := range a.Groups {
+		group := server.GroupHealth{Name: g.Name}
+		for _, m := range g.Models {
+			group.Healthy = group.Healthy || healthyProviders[m.Provider]
+		}
+		if !group.Healthy {
+			health.Status = server.HealthStatusUnhealthy
+		}
+		health.Groups = append(health.Groups, group)
+	}
+	return health
+}
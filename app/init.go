@@ -1,9 +1,15 @@
 package app
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"llm-router/client"
 	"llm-router/config"
 	"llm-router/server"
+	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 )
@@ -12,15 +18,39 @@ import (
 func getGroups(cfg *config.Config) []*Group {
 	groups := make([]*Group, 0)
 	for _, cfgGroup := range cfg.Groups {
+		if cfgGroup.Disabled {
+			continue
+		}
 		group := &Group{
-			Name:   cfgGroup.Name,
-			Models: make([]*Model, 0),
+			Name:                   cfgGroup.Name,
+			Models:                 make([]*Model, 0),
+			ValidateResponseFormat: cfgGroup.ValidateResponseFormat,
+			Strategy:               cfgGroup.Strategy,
+			MaxRequestCost:         cfgGroup.MaxRequestCost,
+			Defaults:               cfgGroup.Defaults,
+			Capture:                cfgGroup.Capture,
+		}
+		if group.MaxRequestCost == 0 {
+			group.MaxRequestCost = cfg.MaxRequestCost
 		}
 		for _, cfgModel := range cfgGroup.Models {
 			model := &Model{
-				Weight:   cfgModel.Weight,
-				Provider: cfgModel.Provider,
-				Name:     cfgModel.Name,
+				Weight:    cfgModel.Weight,
+				Provider:  cfgModel.Provider,
+				Name:      cfgModel.Name,
+				BalanceOn: cfgGroup.BalanceOn,
+				KeyPolicy: cfgGroup.KeyPolicy,
+				Price:     client.Price{Input: cfgModel.InputPrice, Output: cfgModel.OutputPrice, CachedInput: cfgModel.CachedInputPrice},
+			}
+			// Fill metadata from the registry unless overridden in the configuration
+			meta, _ := lookupModelMeta(cfgModel.Name)
+			model.ContextWindow = meta.ContextWindow
+			if cfgModel.ContextWindow > 0 {
+				model.ContextWindow = cfgModel.ContextWindow
+			}
+			model.Capabilities = meta.Capabilities
+			if len(cfgModel.Capabilities) > 0 {
+				model.Capabilities = cfgModel.Capabilities
 			}
 			group.Models = append(group.Models, model)
 		}
@@ -37,56 +67,197 @@ func getProviders(cfg *config.Config) []*Provider {
 			Name:    cfgProvider.Name,
 			BaseURL: cfgProvider.BaseURL,
 			APIKeys: cfgProvider.APIKeys,
+			Models:  cfgProvider.Models,
 		}
 		providers = append(providers, provider)
 	}
 	return providers
 }
 
-// getClients initializes provider clients based on the configuration
-func getClients(cfg *config.Config) map[string]*client.ProviderClient {
+// getClients initializes provider clients based on the configuration. The free keys of a provider follow
+// its api_keys, so that the indices of the paid keys are those of api_keys, and the keys dedicated to tenants
+// follow the shared keys. Providers whose clients cannot be built are left out and their errors returned
+// together.
+func getClients(cfg *config.Config) (map[string]*client.ProviderClient, error) {
 	clients := make(map[string]*client.ProviderClient)
+	var errs []error
 	for _, provider := range cfg.Providers {
+		if base, err := url.Parse(provider.BaseURL); err != nil || base.Host == "" {
+			errs = append(errs, fmt.Errorf("provider %s: base_url %q is not an absolute URL", provider.Name, provider.BaseURL))
+			continue
+		}
 		pClient := &client.ProviderClient{
 			ProviderName: provider.Name,
+			BaseURL:      provider.BaseURL,
 		}
 		for _, apiKey := range provider.APIKeys {
-			openAIConfig := openai.DefaultConfig(apiKey)
-			openAIConfig.BaseURL = provider.BaseURL
-			keyClient := client.NewKeyClient(
-				apiKey,
-				openai.NewClientWithConfig(openAIConfig),
-				cfg.ErrorPenalty,
-				cfg.RequestPenalty,
-			)
+			pClient.KeyClients = append(pClient.KeyClients, newKeyClient(cfg, provider, apiKey))
+		}
+		for _, apiKey := range provider.FreeAPIKeys {
+			keyClient := newKeyClient(cfg, provider, apiKey)
+			keyClient.Free = true
 			pClient.KeyClients = append(pClient.KeyClients, keyClient)
 		}
+		for _, tenant := range cfg.Tenants {
+			for _, keys := range tenant.ProviderKeys {
+				if keys.Provider != provider.Name {
+					continue
+				}
+				for _, apiKey := range keys.APIKeys {
+					keyClient := newKeyClient(cfg, provider, apiKey)
+					keyClient.Tenant = tenant.Name
+					pClient.KeyClients = append(pClient.KeyClients, keyClient)
+				}
+			}
+		}
 		clients[provider.Name] = pClient
 	}
-	return clients
+	return clients, errors.Join(errs...)
 }
 
-// getServer creates a new server instance with request handlers
-func (a *App) getServer() *server.Server {
-	// build a models function that exposes configured groups as models
-	modelsFunc := func() []server.ModelInfo {
-		models := make([]server.ModelInfo, 0)
-		for _, g := range a.Groups {
-			mi := server.ModelInfo{
-				ID:      g.Name,
-				Object:  "model",
-				OwnedBy: "llm-router",
+// newKeyClient creates the client of an API key of a provider
+func newKeyClient(cfg *config.Config, provider config.Provider, apiKey string) *client.KeyClient {
+	openAIConfig := openai.DefaultConfig(apiKey)
+	openAIConfig.BaseURL = provider.BaseURL
+	limits := cfg.ProviderLimits(provider)
+	doer := client.NewHTTPDoer(client.NewHTTPClient(limits.RequestTimeout, limits.StreamIdleTimeout))
+	doer.UnsupportedParams = provider.UnsupportedParams
+	openAIConfig.HTTPClient = doer
+	keyClient := client.NewKeyClient(
+		apiKey,
+		openai.NewClientWithConfig(openAIConfig),
+		cfg.ErrorPenalty,
+		cfg.RequestPenalty,
+	)
+	keyClient.Prices = getPrices(cfg, provider.Name)
+	keyClient.ErrorPenaltyHalfLife = time.Duration(cfg.ErrorPenaltyHalfLife) * time.Second
+	return keyClient
+}
+
+// getPrices collects the configured prices of a provider's models. When a model is priced
+// in several groups, the first price applies.
+func getPrices(cfg *config.Config, provider string) map[string]client.Price {
+	prices := make(map[string]client.Price)
+	for _, cfgGroup := range cfg.Groups {
+		for _, cfgModel := range cfgGroup.Models {
+			if cfgModel.Provider != provider || (cfgModel.InputPrice == 0 && cfgModel.OutputPrice == 0) {
+				continue
 			}
-			models = append(models, mi)
+			if _, exists := prices[cfgModel.Name]; !exists {
+				prices[cfgModel.Name] = client.Price{Input: cfgModel.InputPrice, Output: cfgModel.OutputPrice, CachedInput: cfgModel.CachedInputPrice}
+			}
+		}
+	}
+	return prices
+}
+
+// listModels exposes the configured groups the tenant of the context may use as models
+func (a *App) listModels(ctx context.Context) []server.ModelInfo {
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	models := make([]server.ModelInfo, 0)
+	for _, g := range a.Groups {
+		if a.tenantAllowsGroup(ctx, g.Name) != nil {
+			continue
 		}
-		return models
+		models = append(models, server.ModelInfo{
+			ID:            g.Name,
+			Object:        "model",
+			Created:       a.startedAt.Unix(),
+			OwnedBy:       "llm-router",
+			ContextWindow: g.ContextWindow(),
+			Capabilities:  g.Capabilities(),
+		})
 	}
+	return models
+}
 
-	return server.NewServer(
+// getServer creates a new server instance with request handlers
+func (a *App) getServer() *server.Server {
+	batches, files := a.getPassthroughHandlers()
+	var metrics http.Handler
+	if a.metrics != nil && a.Config.Features.EnableMetrics {
+		metrics = a.metrics.registry
+	}
+
+	s := server.NewServer(
 		a.Config.APIKey,
-		a.Logger,
-		a.HandleRequest,
-		a.HandleStreamRequest,
-		modelsFunc,
+		a.componentLogger(logServer),
+		server.Handlers{
+			Request:       a.HandleRequest,
+			StreamRequest: a.HandleStreamRequest,
+			Models:        a.listModels,
+			Batches:       batches,
+			Files:         files,
+			Assistants:    a.getAssistantsTargets(),
+			Tokenize:      a.HandleTokenize,
+			Detokenize:    a.HandleDetokenize,
+			Rerank:        a.HandleRerank,
+			Admin:         a.adminHandlers(),
+			DeepHealth:    a.DeepHealth,
+			Usage:         a.usage.Entries,
+			Version:       a.versionInfo,
+			Metrics:       metrics,
+			DebugRouting:  a.debugRouting,
+		},
 	)
+	s.AdminAPIKey = a.Config.AdminAPIKey
+	s.EndUserHeader = a.Config.EndUserHeader
+	s.DisableCompression = !a.Config.Features.EnableCompression
+	s.Compression = server.Compression{
+		Levels:       server.CompressionLevels(a.Config.Compression.Levels),
+		StreamLevels: server.CompressionLevels(a.Config.Compression.StreamLevels),
+		MinSize:      int64(a.Config.Compression.MinSize),
+	}
+	s.Profiling = a.Config.Features.EnableProfiling
+	s.TLSCert = a.Config.TLSCert
+	s.TLSKey = a.Config.TLSKey
+	s.ACME = server.ACME{
+		Domains:      a.Config.ACME.Domains,
+		CacheDir:     a.Config.ACME.CacheDir,
+		Email:        a.Config.ACME.Email,
+		DirectoryURL: a.Config.ACME.DirectoryURL,
+	}
+	s.H2C = a.Config.HTTP2.H2C
+	s.HTTP2MaxConcurrentStreams = a.Config.HTTP2.MaxConcurrentStreams
+	s.ReadHeaderTimeout = a.Config.ServerTimeouts.ReadHeaderTimeout
+	s.WriteTimeout = a.Config.ServerTimeouts.WriteTimeout
+	s.IdleTimeout = a.Config.ServerTimeouts.IdleTimeout
+	s.CORS = server.CORS(a.Config.CORS)
+	for _, entry := range a.Config.TrustedProxies {
+		if entry == "unix" {
+			s.TrustUnixSocket = true
+		} else if prefix, err := parseTrustedProxy(entry); err == nil {
+			s.TrustedProxies = append(s.TrustedProxies, prefix)
+		}
+	}
+	s.ClientIPRPM = a.Config.ClientIPRPM
+	s.Tracer = a.tracer
+	s.AccessLog = a.accessLog
+	if a.Config.Logging.Prompts.Enabled {
+		s.PromptLogLength = a.Config.Logging.Prompts.MaxLength
+	}
+	addClientKey := func(key config.ClientKey, tenant string) {
+		s.ClientKeys = append(s.ClientKeys, server.ClientKey{
+			Name:              key.Name,
+			Key:               key.Key,
+			RequestsPerMinute: key.RequestsPerMinute,
+			TokensPerMinute:   key.TokensPerMinute,
+			TokensPerDay:      key.TokensPerDay,
+			Tenant:            tenant,
+		})
+	}
+	for _, key := range a.Config.ClientKeys {
+		addClientKey(key, "")
+	}
+	for _, tenant := range a.Config.Tenants {
+		for _, key := range tenant.ClientKeys {
+			addClientKey(key, tenant.Name)
+		}
+	}
+	s.ChatBatchConcurrency = a.Config.ChatBatch.Concurrency
+	s.ChatBatchMaxRequests = a.Config.ChatBatch.MaxRequests
+	s.MaxBodySize = int64(a.Config.Limits.MaxBodySize)
+	s.MaxUploadSize = int64(a.Config.Limits.MaxUploadSize)
+	return s
 }
@@ -0,0 +1,167 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"llm-router/client"
+	"llm-router/ledger"
+	"llm-router/server"
+	"llm-router/usage"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Classes of failed requests recorded in the ledger
+const (
+	errorClassSpendCap       = "spend_cap_exceeded"
+	errorClassBudget         = "budget_exceeded"
+	errorClassCanceled       = "canceled"
+	errorClassTimeout        = "timeout"
+	errorClassRateLimited    = "rate_limited"
+	errorClassAuth           = "upstream_auth"
+	errorClassInvalidRequest = "invalid_request"
+	errorClassUpstream       = "upstream_error"
+	errorClassRouting        = "routing_error"
+)
+
+// openLedger opens the configured request ledger, or returns nil when it is disabled or cannot be opened
+func (a *App) openLedger() *ledger.Ledger {
+	if a.Config.LedgerFile == "" {
+		return nil
+	}
+	l, err := ledger.Open(a.Config.LedgerFile, a.Config.LedgerRetention)
+	if err != nil {
+		a.Logger.Error("Failed to open request ledger, requests are not recorded", slog.String("path", a.Config.LedgerFile), slog.Any("error", err))
+		return nil
+	}
+	return l
+}
+
+// recordRequest adds a chat completion request to the metrics, the ledger, usage events, and lifecycle events
+// with its response or error
+func (a *App) recordRequest(ctx context.Context, start time.Time, group string, resp *client.ChatCompletionResponse, err error) {
+	var route client.Route
+	if resp != nil {
+		route = resp.Route
+	}
+	a.observeRequest(ctx, start, group, false, route, err)
+	if a.ledger == nil && a.events == nil && !a.lifecycle.subscribed() {
+		return
+	}
+	entry := newLedgerEntry(ctx, start, group)
+	if resp != nil {
+		setLedgerRoute(&entry, resp.Route)
+		entry.PromptTokens = int64(resp.Usage.PromptTokens)
+		entry.CompletionTokens = int64(resp.Usage.CompletionTokens)
+		entry.TotalTokens = int64(resp.Usage.TotalTokens)
+		entry.Cost = resp.Cost
+	}
+	a.addLedgerEntry(ctx, entry, err)
+}
+
+// recordStream adds a streaming request to the metrics, the ledger, usage events, and lifecycle events with the usage of its
+// stream, once the stream has ended, or with the error that prevented it from starting
+func (a *App) recordStream(ctx context.Context, start time.Time, group string, stream *client.ChatCompletionStream, err error) {
+	var route client.Route
+	if stream != nil {
+		route = stream.Route
+	}
+	a.observeRequest(ctx, start, group, true, route, err)
+	if a.ledger == nil && a.events == nil && !a.lifecycle.subscribed() {
+		return
+	}
+	entry := newLedgerEntry(ctx, start, group)
+	entry.Stream = true
+	if stream != nil {
+		setLedgerRoute(&entry, stream.Route)
+		record := stream.Usage()
+		entry.PromptTokens = record.PromptTokens
+		entry.CompletionTokens = record.CompletionTokens
+		entry.TotalTokens = record.TotalTokens
+		entry.Cost = record.Cost
+	}
+	a.addLedgerEntry(ctx, entry, err)
+}
+
+// newLedgerEntry returns the entry of a request started at start, attributed like its usage
+func newLedgerEntry(ctx context.Context, start time.Time, group string) ledger.Entry {
+	return ledger.Entry{
+		Time:      start.UTC(),
+		ClientKey: client.ClientKeyFromContext(ctx),
+		Tenant:    client.TenantFromContext(ctx),
+		User:      client.EndUserFromContext(ctx),
+		Group:     group,
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
+}
+
+func setLedgerRoute(entry *ledger.Entry, route client.Route) {
+	entry.Provider = route.Provider
+	entry.Model = route.Model
+	entry.KeyID = route.KeyID
+	entry.Attempts = route.Attempts
+	entry.UpstreamIDs = route.UpstreamIDs
+}
+
+// addLedgerEntry sets the outcome of an entry of the request of ctx, appends it to the ledger, ships it as a
+// usage event, and publishes its request_completed event
+func (a *App) addLedgerEntry(ctx context.Context, entry ledger.Entry, err error) {
+	entry.Status = ledger.StatusSuccess
+	if err != nil {
+		entry.Status = ledger.StatusError
+		entry.ErrorClass = errorClass(err)
+		entry.Error = err.Error()
+		if ids := client.UpstreamIDs(err); ids != nil {
+			entry.UpstreamIDs = ids
+		}
+	}
+	if a.events != nil {
+		a.events.emit(entry)
+	}
+	a.publish(ctx, LifecycleEvent{Type: EventRequestCompleted, Group: entry.Group, Stream: entry.Stream, Request: &entry})
+	if a.ledger == nil {
+		return
+	}
+	if err := a.ledger.Record(entry); err != nil {
+		a.Logger.Error("Failed to record request in ledger", slog.Any("error", err))
+	}
+}
+
+// errorClass categorizes the error of a failed request
+func errorClass(err error) string {
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	switch {
+	case errors.Is(err, usage.ErrSpendCapExceeded):
+		return errorClassSpendCap
+	case errors.Is(err, usage.ErrBudgetExceeded):
+		return errorClassBudget
+	case errors.Is(err, server.ErrRequestTooExpensive):
+		return errorClassInvalidRequest
+	case errors.Is(err, context.Canceled):
+		return errorClassCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, client.ErrStreamIdle):
+		return errorClassTimeout
+	case errors.As(err, &apiErr):
+		return statusErrorClass(apiErr.HTTPStatusCode)
+	case errors.As(err, &reqErr):
+		return statusErrorClass(reqErr.HTTPStatusCode)
+	}
+	return errorClassRouting
+}
+
+// statusErrorClass categorizes a provider's error response by its HTTP status
+func statusErrorClass(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return errorClassRateLimited
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return errorClassAuth
+	case status >= 400 && status < 500:
+		return errorClassInvalidRequest
+	}
+	return errorClassUpstream
+}
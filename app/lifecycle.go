@@ -0,0 +1,211 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"llm-router/client"
+	"llm-router/config"
+	"llm-router/ledger"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of the lifecycle events of requests
+const (
+	// EventRequestStarted is published when a chat completion request is received
+	EventRequestStarted = "request_started"
+	// EventRouteSelected is published when a key and model are selected for an attempt at a request
+	EventRouteSelected = "route_selected"
+	// EventAttemptFailed is published when an attempt fails, whether or not the request is retried
+	EventAttemptFailed = "attempt_failed"
+	// EventRequestCompleted is published when a request is answered, a stream ends, or a request fails
+	EventRequestCompleted = "request_completed"
+)
+
+// lifecycleEventTypes are the types of lifecycle events
+var lifecycleEventTypes = []string{EventRequestStarted, EventRouteSelected, EventAttemptFailed, EventRequestCompleted}
+
+// LifecycleEvent is a step in serving a chat completion request. The events of a request share its RequestID.
+type LifecycleEvent struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Group     string    `json:"group"`
+	Stream    bool      `json:"stream,omitempty"`
+	ClientKey string    `json:"client_key,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	// Provider, Model, KeyID, and Attempt are the route of route_selected and attempt_failed events
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model,omitempty"`
+	KeyID    string `json:"api_key_id,omitempty"`
+	Attempt  int    `json:"attempt,omitempty"`
+	// Error is why the attempt of an attempt_failed event failed, categorized like the requests of the ledger
+	Error      string `json:"error,omitempty"`
+	ErrorClass string `json:"error_class,omitempty"`
+	// Request is the usage and outcome of the request of a request_completed event, as recorded in the ledger
+	Request *ledger.Entry `json:"request,omitempty"`
+}
+
+// Subscriber receives the lifecycle events of requests. HandleEvent is called on the goroutine serving the
+// request, so it must return quickly and hand slow work, e.g. network calls, off to another goroutine.
+type Subscriber interface {
+	HandleEvent(event LifecycleEvent)
+}
+
+// SubscriberFunc adapts a function to a Subscriber
+type SubscriberFunc func(event LifecycleEvent)
+
+// HandleEvent calls f(event)
+func (f SubscriberFunc) HandleEvent(event LifecycleEvent) {
+	f(event)
+}
+
+// lifecycle holds the subscribers to the lifecycle events of requests. The zero value has none.
+type lifecycle struct {
+	mutex       sync.RWMutex
+	subscribers []Subscriber
+}
+
+// Subscribe adds a subscriber to the lifecycle events of the requests served from then on
+func (a *App) Subscribe(subscriber Subscriber) {
+	a.lifecycle.mutex.Lock()
+	defer a.lifecycle.mutex.Unlock()
+	a.lifecycle.subscribers = append(a.lifecycle.subscribers, subscriber)
+}
+
+// subscribed reports whether lifecycle events have any subscriber
+func (l *lifecycle) subscribed() bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return len(l.subscribers) > 0
+}
+
+// publish sends an event of the request of ctx to the subscribers, attributed like its usage
+func (a *App) publish(ctx context.Context, event LifecycleEvent) {
+	a.lifecycle.mutex.RLock()
+	defer a.lifecycle.mutex.RUnlock()
+	if len(a.lifecycle.subscribers) == 0 {
+		return
+	}
+	event.Time = time.Now().UTC()
+	event.RequestID = client.RequestIDFromContext(ctx)
+	event.ClientKey = client.ClientKeyFromContext(ctx)
+	event.Tenant = client.TenantFromContext(ctx)
+	for _, subscriber := range a.lifecycle.subscribers {
+		subscriber.HandleEvent(event)
+	}
+}
+
+// publishAttempt publishes an event of an attempt at a request on a route, failed with err for attempt_failed
+func (a *App) publishAttempt(ctx context.Context, eventType string, group string, stream bool, route client.Route, err error) {
+	event := LifecycleEvent{
+		Type:     eventType,
+		Group:    group,
+		Stream:   stream,
+		Provider: route.Provider,
+		Model:    route.Model,
+		KeyID:    route.KeyID,
+		Attempt:  route.Attempts,
+	}
+	if err != nil {
+		event.Error = err.Error()
+		event.ErrorClass = errorClass(err)
+	}
+	a.publish(ctx, event)
+}
+
+// webhookSubscriber posts lifecycle events to webhooks as JSON arrays in batches, in the background, so that slow
+// or unavailable webhooks never delay requests
+type webhookSubscriber struct {
+	queue    chan LifecycleEvent
+	webhooks []config.Webhook
+	// types are the event types posted, every type when empty
+	types   []string
+	dropped atomic.Int64
+	logger  *slog.Logger
+}
+
+// startLifecycleWebhooks subscribes the configured webhooks to lifecycle events, unless none is configured
+func (a *App) startLifecycleWebhooks() {
+	cfg := a.Config.LifecycleEvents
+	if len(cfg.Webhooks) == 0 {
+		return
+	}
+	size := cfg.QueueSize
+	if size <= 0 {
+		size = defaultEventQueueSize
+	}
+	subscriber := &webhookSubscriber{
+		queue:    make(chan LifecycleEvent, size),
+		webhooks: cfg.Webhooks,
+		types:    cfg.Types,
+		logger:   a.componentLogger(logEvents),
+	}
+	go subscriber.run()
+	a.Subscribe(subscriber)
+}
+
+// HandleEvent queues an event of a posted type, dropping it if the queue is full
+func (s *webhookSubscriber) HandleEvent(event LifecycleEvent) {
+	if len(s.types) > 0 && !slices.Contains(s.types, event.Type) {
+		return
+	}
+	select {
+	case s.queue <- event:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// run posts the queued events once a batch is full or has waited for eventFlushInterval
+func (s *webhookSubscriber) run() {
+	ticker := time.NewTicker(eventFlushInterval)
+	defer ticker.Stop()
+	batch := make([]LifecycleEvent, 0, eventBatchSize)
+	for {
+		select {
+		case event := <-s.queue:
+			batch = append(batch, event)
+			if len(batch) < eventBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if dropped := s.dropped.Swap(0); dropped > 0 {
+				s.logger.Warn("Lifecycle event queue full, events dropped", slog.Int64("dropped", dropped))
+			}
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		s.post(batch)
+		batch = batch[:0]
+	}
+}
+
+// post sends a batch to every webhook, retrying failed posts with a growing delay
+func (s *webhookSubscriber) post(batch []LifecycleEvent) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		s.logger.Error("Failed to encode lifecycle events", slog.Any("error", err))
+		return
+	}
+	for _, webhook := range s.webhooks {
+		for attempt := 1; attempt <= eventAttempts; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+			err = postJSON(ctx, webhook, body)
+			cancel()
+			if err == nil {
+				break
+			}
+			if attempt < eventAttempts {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+		if err != nil {
+			s.logger.Error("Failed to post lifecycle events", slog.String("webhook", webhook.URL), slog.Int("events", len(batch)), slog.Any("error", err))
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"fmt"
+	"io/fs"
+	"llm-router/config"
+	"llm-router/server"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+)
+
+// listen opens the listener of the router's API: the Unix socket of unix_socket when set, or else the TCP
+// address of listen, or port on every interface
+func listen(cfg *config.Config) (net.Listener, error) {
+	if cfg.UnixSocket.Path != "" {
+		return listenUnix(cfg.UnixSocket)
+	}
+	return listenTCP(listenAddress(cfg))
+}
+
+// listenAll opens the listeners the router's API is served on: those of listeners, or else the single one
+// of listen, port, or unix_socket, served over HTTPS when a certificate is configured
+func listenAll(cfg *config.Config) ([]server.Listener, error) {
+	if len(cfg.Listeners) == 0 {
+		listener, err := listen(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return []server.Listener{{Listener: listener, TLS: cfg.TLSCert != "" || len(cfg.ACME.Domains) > 0}}, nil
+	}
+	var opened []server.Listener
+	for _, l := range cfg.Listeners {
+		var listener net.Listener
+		var err error
+		if l.UnixSocket.Path != "" {
+			listener, err = listenUnix(l.UnixSocket)
+		} else {
+			listener, err = listenTCP(l.Address)
+		}
+		if err != nil {
+			for _, o := range opened {
+				o.Close()
+			}
+			return nil, err
+		}
+		opened = append(opened, server.Listener{Listener: listener, TLS: l.TLS})
+	}
+	return opened, nil
+}
+
+// listenAddress returns the TCP address the router listens on
+func listenAddress(cfg *config.Config) string {
+	if cfg.Listen != "" {
+		return cfg.Listen
+	}
+	return fmt.Sprintf(":%d", cfg.Port)
+}
+
+// listenAdmin opens the listener of the admin API and metrics on the address of admin_listen or admin_port,
+// nil when neither is set and they are served with the router's API
+func listenAdmin(cfg *config.Config) (net.Listener, error) {
+	switch {
+	case cfg.AdminListen != "":
+		return listenTCP(cfg.AdminListen)
+	case cfg.AdminPort != 0:
+		return listenTCP(fmt.Sprintf(":%d", cfg.AdminPort))
+	}
+	return nil, nil
+}
+
+// listenACME opens the listener the ACME HTTP-01 challenge is answered on, nil when acme.http_listen is not set
+func listenACME(cfg *config.Config) (net.Listener, error) {
+	if len(cfg.ACME.Domains) == 0 || cfg.ACME.HTTPListen == "" {
+		return nil, nil
+	}
+	return listenTCP(cfg.ACME.HTTPListen)
+}
+
+// listenTCP listens on a TCP address, with the listener of the address handed over by the previous process
+// when there is one
+func listenTCP(address string) (net.Listener, error) {
+	if listener := takeInherited("tcp", address); listener != nil {
+		return listener, nil
+	}
+	return net.Listen("tcp", address)
+}
+
+// listenUnix listens on a Unix socket, replacing the socket file a previous run left behind, and sets the
+// permissions of the socket file. The socket handed over by the previous process is taken over as it is.
+func listenUnix(socket config.UnixSocket) (net.Listener, error) {
+	if listener := takeInherited("unix", socket.Path); listener != nil {
+		// Removed on close like the sockets listened on, unless handed over again
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(true)
+		}
+		return listener, nil
+	}
+	if info, err := os.Lstat(socket.Path); err == nil && info.Mode()&fs.ModeSocket != 0 {
+		if err := os.Remove(socket.Path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", socket.Path)
+	if err != nil {
+		return nil, err
+	}
+	if socket.Mode != "" {
+		mode, err := parseSocketMode(socket.Mode)
+		if err == nil {
+			err = os.Chmod(socket.Path, mode)
+		}
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// parseSocketMode parses the octal permissions of a socket file, e.g. 0660
+func parseSocketMode(mode string) (fs.FileMode, error) {
+	bits, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || bits > 0o777 {
+		return 0, fmt.Errorf("mode %q is not octal permissions such as 0660", mode)
+	}
+	return fs.FileMode(bits), nil
+}
+
+// parseTrustedProxy parses an entry of trusted_proxies, a CIDR such as 10.0.0.0/8 or a single address
+func parseTrustedProxy(entry string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(entry); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not a CIDR, an IP address, or unix", entry)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,366 @@
+package app
+
+import (
+	"context"
+	"io"
+	"llm-router/client"
+	"llm-router/config"
+	"llm-router/utils"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Components whose log levels can be set apart, as the value of their loggers' component attribute
+const (
+	// logRouter is the component of the messages of loggers without a component: routing, reloads, and
+	// the rest of the application
+	logRouter = "router"
+	logServer = "server"
+	logEvents = "events"
+)
+
+// logComponents are the components of logging.components
+var logComponents = []string{logRouter, logServer, logEvents}
+
+// newLogger creates the logger of the configuration's log_level and logging settings, redacting the keys of
+// secrets, and returns the log file it writes to, nil for standard output. When the log file cannot be opened,
+// the logger writes to standard output and the error is returned.
+func newLogger(cfg *config.Config, secrets *redactor) (*slog.Logger, *utils.RotatingFile, error) {
+	var out io.Writer = os.Stdout
+	var file *utils.RotatingFile
+	var err error
+	if cfg.Logging.File != "" {
+		if file, err = utils.OpenRotatingFile(cfg.Logging.File, int64(cfg.Logging.MaxSize), cfg.Logging.MaxBackups); err == nil {
+			out = file
+		}
+	}
+	return slog.New(newComponentHandler(out, cfg, secrets)), file, err
+}
+
+// componentHandler filters the messages of a logger by the level of its component
+type componentHandler struct {
+	slog.Handler
+	levels map[string]slog.Level
+	level  slog.Level
+}
+
+// newComponentHandler creates the handler writing the messages of the components over their levels to out
+func newComponentHandler(out io.Writer, cfg *config.Config, secrets *redactor) *componentHandler {
+	h := &componentHandler{levels: make(map[string]slog.Level)}
+	for _, component := range logComponents {
+		h.levels[component] = logLevel(cfg.LogLevel)
+		if setting, exists := cfg.Logging.Components[component]; exists {
+			h.levels[component] = logLevel(setting)
+		}
+	}
+	h.level = h.levels[logRouter]
+	// The components filter the messages, the underlying handler none of them
+	lowest := h.level
+	for _, level := range h.levels {
+		lowest = min(lowest, level)
+	}
+	h.Handler = newFormatHandler(out, cfg, lowest, secrets)
+	return h
+}
+
+// newFormatHandler creates the handler writing the messages over a level to out in the format and with the
+// field names of the logging settings, redacting the keys of secrets
+func newFormatHandler(out io.Writer, cfg *config.Config, level slog.Level, secrets *redactor) slog.Handler {
+	rename := renameFields(cfg.Logging.FieldNames)
+	replace := func(groups []string, attr slog.Attr) slog.Attr {
+		attr = secrets.redactAttr(attr)
+		if rename != nil {
+			attr = rename(groups, attr)
+		}
+		return attr
+	}
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: replace}
+	if cfg.Logging.Format == "json" {
+		return slog.NewJSONHandler(out, options)
+	}
+	return slog.NewTextHandler(out, options)
+}
+
+// newAccessLogger creates the logger of the access log, or returns nil when it is disabled. It writes to
+// its own file, rotated like the log file and returned along, or to standard output, and the error of a file
+// that cannot be opened is returned with a logger writing to standard output.
+func newAccessLogger(cfg *config.Config, secrets *redactor) (*slog.Logger, *utils.RotatingFile, error) {
+	if !cfg.Logging.AccessLog.Enabled {
+		return nil, nil, nil
+	}
+	var out io.Writer = os.Stdout
+	var file *utils.RotatingFile
+	var err error
+	if path := cfg.Logging.AccessLog.File; path != "" {
+		if file, err = utils.OpenRotatingFile(path, int64(cfg.Logging.MaxSize), cfg.Logging.MaxBackups); err == nil {
+			out = file
+		}
+	}
+	return slog.New(newFormatHandler(out, cfg, slog.LevelInfo, secrets)), file, err
+}
+
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+// Handle adds the ID of the request a message is logged for, if any, and holds the routine messages of
+// requests that are not sampled
+func (h *componentHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := client.RequestIDFromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if sample, _ := ctx.Value(logSampleKey{}).(*logSample); sample != nil && record.Level < slog.LevelWarn && sample.hold(h.Handler, record) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := *h
+	next.Handler = h.Handler.WithAttrs(attrs)
+	for _, attr := range attrs {
+		if level, exists := h.levels[attr.Value.String()]; exists && attr.Key == "component" {
+			next.level = level
+		}
+	}
+	return &next
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	next := *h
+	next.Handler = h.Handler.WithGroup(name)
+	return &next
+}
+
+// renameFields returns the function renaming the top-level fields of messages, including the built-in time,
+// level, and msg, to the names of logging.field_names, or nil when none is renamed
+func renameFields(names map[string]string) func(groups []string, attr slog.Attr) slog.Attr {
+	if len(names) == 0 {
+		return nil
+	}
+	return func(groups []string, attr slog.Attr) slog.Attr {
+		if name, exists := names[attr.Key]; exists && len(groups) == 0 {
+			attr.Key = name
+		}
+		return attr
+	}
+}
+
+// redactedValue replaces secrets in the logs
+const redactedValue = "[REDACTED]"
+
+// minSecretLength is the length under which keys are not redacted from the text of messages, as short values
+// would mangle unrelated text; keys that short are rejected by the providers anyway
+const minSecretLength = 8
+
+// secretFields are the fields whose values are redacted whatever they hold
+var secretFields = map[string]bool{
+	"authorization": true,
+	"api_key":       true,
+	"x-api-key":     true,
+	"admin_api_key": true,
+}
+
+// redactor keeps the keys of the configuration out of the logs, replacing them in the string and error values
+// of messages, in case one ends up in an upstream error or a field. It follows the keys of reloaded
+// configurations. The methods of a nil redactor only redact secretFields.
+type redactor struct {
+	replacer atomic.Pointer[strings.Replacer]
+}
+
+// newRedactor creates the redactor of the keys of a configuration whose secrets are resolved
+func newRedactor(cfg *config.Config) *redactor {
+	r := &redactor{}
+	r.update(cfg)
+	return r
+}
+
+// update replaces the keys redacted by those of a configuration
+func (r *redactor) update(cfg *config.Config) {
+	if r == nil {
+		return
+	}
+	keys := []string{cfg.APIKey, cfg.AdminAPIKey}
+	for _, key := range cfg.ClientKeys {
+		keys = append(keys, key.Key)
+	}
+	for _, provider := range cfg.Providers {
+		keys = append(keys, provider.APIKeys...)
+		keys = append(keys, provider.FreeAPIKeys...)
+	}
+	for _, tenant := range cfg.Tenants {
+		for _, key := range tenant.ClientKeys {
+			keys = append(keys, key.Key)
+		}
+		for _, providerKeys := range tenant.ProviderKeys {
+			keys = append(keys, providerKeys.APIKeys...)
+		}
+	}
+	var pairs []string
+	for _, key := range keys {
+		if len(key) >= minSecretLength {
+			pairs = append(pairs, key, redactedValue)
+		}
+	}
+	r.replacer.Store(strings.NewReplacer(pairs...))
+}
+
+// redact replaces the keys in a text
+func (r *redactor) redact(text string) string {
+	if r == nil {
+		return text
+	}
+	return r.replacer.Load().Replace(text)
+}
+
+// redactAttr redacts the value of a secret field and the keys in string and error values
+func (r *redactor) redactAttr(attr slog.Attr) slog.Attr {
+	if secretFields[strings.ToLower(attr.Key)] && attr.Value.String() != "" {
+		return slog.String(attr.Key, redactedValue)
+	}
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		if redacted := r.redact(attr.Value.String()); redacted != attr.Value.String() {
+			return slog.String(attr.Key, redacted)
+		}
+	case slog.KindAny:
+		if err, ok := attr.Value.Any().(error); ok {
+			if redacted := r.redact(err.Error()); redacted != err.Error() {
+				return slog.String(attr.Key, redacted)
+			}
+		}
+	}
+	return attr
+}
+
+// componentLogger returns the logger of a component of the application
+func (a *App) componentLogger(component string) *slog.Logger {
+	return a.Logger.With(slog.String("component", component))
+}
+
+type logSampleKey struct{}
+
+// logSample holds the routine messages of a request that is not sampled until it ends, when they are logged
+// if the request failed or was slow and dropped otherwise
+type logSample struct {
+	mutex sync.Mutex
+	held  []heldRecord
+	ended bool
+	kept  bool
+}
+
+type heldRecord struct {
+	handler slog.Handler
+	record  slog.Record
+}
+
+// hold holds a message of the request, reporting whether it did rather than the message being logged now
+func (s *logSample) hold(handler slog.Handler, record slog.Record) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ended {
+		return !s.kept
+	}
+	s.held = append(s.held, heldRecord{handler: handler, record: record.Clone()})
+	return true
+}
+
+// end logs the held messages if kept and drops them otherwise, as well as the messages logged afterwards
+func (s *logSample) end(ctx context.Context, kept bool) {
+	s.mutex.Lock()
+	held := s.held
+	s.held, s.ended, s.kept = nil, true, kept
+	s.mutex.Unlock()
+	if !kept {
+		return
+	}
+	for _, h := range held {
+		h.handler.Handle(ctx, h.record)
+	}
+}
+
+// sampleLogs decides whether the routine messages of a request are logged by logging.sampling, returning the
+// context to serve the request with
+func (a *App) sampleLogs(ctx context.Context) context.Context {
+	if a.Config == nil {
+		return ctx
+	}
+	ratio := a.Config.Logging.Sampling.Ratio
+	if ratio <= 0 || ratio >= 1 || rand.Float64() < ratio {
+		return ctx
+	}
+	return context.WithValue(ctx, logSampleKey{}, &logSample{})
+}
+
+// endLogSample logs the held messages of a request started at start that is not sampled if it failed or was
+// slow, and drops them otherwise
+func (a *App) endLogSample(ctx context.Context, start time.Time, err error) {
+	sample, _ := ctx.Value(logSampleKey{}).(*logSample)
+	if sample == nil {
+		return
+	}
+	threshold := a.Config.Logging.Sampling.SlowThreshold
+	sample.end(ctx, err != nil || (threshold > 0 && time.Since(start) >= threshold))
+}
+
+// logSlowRequest warns about a request of a group received at start whose last attempt, on route, started at
+// attemptStart if it took longer than logging.slow_requests.duration, or if its stream's first token, zero when
+// none came, arrived later than time_to_first_token
+func (a *App) logSlowRequest(ctx context.Context, start time.Time, group string, stream bool, route client.Route, attemptStart time.Time, firstToken time.Time, err error) {
+	if a.Config == nil {
+		return
+	}
+	thresholds := a.Config.Logging.SlowRequests
+	duration := time.Since(start)
+	slowDuration := thresholds.Duration > 0 && duration >= thresholds.Duration
+	slowFirstToken := stream && thresholds.TimeToFirstToken > 0 && !firstToken.IsZero() && firstToken.Sub(start) >= thresholds.TimeToFirstToken
+	if !slowDuration && !slowFirstToken {
+		return
+	}
+	attrs := []any{
+		slog.String("group", group),
+		slog.String("provider", route.Provider),
+		slog.String("model", route.Model),
+		slog.String("key_id", route.KeyID),
+		slog.Int("attempts", route.Attempts),
+		slog.Bool("stream", stream),
+		slog.String("client_key", client.ClientKeyFromContext(ctx)),
+		slog.String("tenant", client.TenantFromContext(ctx)),
+		slog.Int64("duration_ms", duration.Milliseconds()),
+	}
+	// Time spent before the last attempt, routing and on failed attempts, and on the last attempt
+	if !attemptStart.IsZero() {
+		attrs = append(attrs,
+			slog.Int64("routing_ms", attemptStart.Sub(start).Milliseconds()),
+			slog.Int64("upstream_ms", time.Since(attemptStart).Milliseconds()))
+	}
+	if !firstToken.IsZero() {
+		attrs = append(attrs, slog.Int64("time_to_first_token_ms", firstToken.Sub(start).Milliseconds()))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	ids := route.UpstreamIDs
+	if ids == nil {
+		ids = client.UpstreamIDs(err)
+	}
+	attrs = append(attrs, upstreamIDsAttr(ids))
+	a.Logger.WarnContext(ctx, "Slow request", attrs...)
+}
+
+// upstreamIDsAttr returns the identifiers a provider gave a request as the upstream_ids group, which is not
+// logged when there are none
+func upstreamIDsAttr(ids map[string]string) slog.Attr {
+	attrs := make([]any, 0, len(ids))
+	for _, name := range client.UpstreamIDHeaders {
+		if id, ok := ids[name]; ok {
+			attrs = append(attrs, slog.String(name, id))
+		}
+	}
+	return slog.Group("upstream_ids", attrs...)
+}
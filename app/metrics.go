@@ -0,0 +1,336 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"llm-router/client"
+	"llm-router/config"
+	"llm-router/metrics"
+	"llm-router/server"
+	"llm-router/usage"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// usageMetrics counts the usage of every provider key as Prometheus counters,
+// labeled by provider, model, key alias ("provider/hash"), and client key, and the
+// latencies and errors of chat completion requests, labeled by group and the route they took
+type usageMetrics struct {
+	registry         *metrics.Registry
+	requests         *metrics.CounterVec
+	promptTokens     *metrics.CounterVec
+	completionTokens *metrics.CounterVec
+	cost             *metrics.CounterVec
+
+	chatRequests     *metrics.CounterVec
+	outcomes         *metrics.CounterVec
+	errors           *metrics.CounterVec
+	upstreamErrors   *metrics.CounterVec
+	requestDuration  *metrics.HistogramVec
+	upstreamDuration *metrics.HistogramVec
+	timeToFirstToken *metrics.HistogramVec
+	streamThroughput *metrics.HistogramVec
+	streamDuration   *metrics.HistogramVec
+	streamChunks     *metrics.HistogramVec
+	streamBytes      *metrics.HistogramVec
+	streamEnds       *metrics.CounterVec
+	errorRateAlert   *metrics.GaugeVec
+}
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms, from quick completions to long
+// generations
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// firstTokenBuckets are the upper bounds in seconds of the time to first token histogram
+var firstTokenBuckets = []float64{0.05, 0.1, 0.25, 0.5, 0.75, 1, 1.5, 2, 3, 5, 10, 30}
+
+// throughputBuckets are the upper bounds in tokens per second of the stream throughput histogram
+var throughputBuckets = []float64{5, 10, 20, 35, 50, 75, 100, 150, 200, 300, 500}
+
+// chunkBuckets are the upper bounds of the histogram of the chunks per stream, from short answers streamed
+// in a few chunks to long generations
+var chunkBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// byteBuckets are the upper bounds of the histogram of the bytes relayed per stream
+var byteBuckets = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// metricsNamespace prefixes the names of the metrics
+const metricsNamespace = "llmrouter"
+
+// metricLabels describe the labels of the metrics in their catalog
+var metricLabels = map[string]string{
+	"group":      "Group the request was made for, as requested or resolved from an alias.",
+	"provider":   "Provider the request was served by, empty when it failed before reaching one.",
+	"model":      "Model of the provider the request was served by.",
+	"key_alias":  "Provider key the request was served with, as provider/hash.",
+	"client_key": "Name of the client key the request was authenticated with.",
+	"status":     "success or error.",
+	"class":      "Error class, as in the request ledger, e.g. rate_limited or routing_error.",
+	"stream":     "Whether the request was streamed, true or false.",
+	"outcome":    "How the request ended: completed, client_canceled, upstream_error, or rejected.",
+	"reason":     "Why the stream ended: completed, client_canceled, idle_timeout, timeout, upstream_error, or closed.",
+}
+
+func newUsageMetrics() *usageMetrics {
+	registry := metrics.NewRegistry(metricsNamespace)
+	registry.DescribeLabels(metricLabels)
+	labels := []string{"provider", "model", "key_alias", "client_key"}
+	routeLabels := []string{"group", "provider", "model", "key_alias"}
+	return &usageMetrics{
+		registry:         registry,
+		requests:         registry.Counter("llmrouter_requests_total", "Requests served by provider keys.", labels...),
+		promptTokens:     registry.Counter("llmrouter_prompt_tokens_total", "Prompt tokens used, as reported by the provider or estimated.", labels...),
+		completionTokens: registry.Counter("llmrouter_completion_tokens_total", "Completion tokens used, as reported by the provider or estimated.", labels...),
+		cost:             registry.Counter("llmrouter_cost_usd_total", "Estimated cost in USD of the tokens used, from the configured prices.", labels...),
+		chatRequests:     registry.Counter("llmrouter_chat_requests_total", "Chat completion requests handled, by the route they were served on and status.", append(routeLabels, "status")...),
+		outcomes:         registry.Counter("llmrouter_request_outcomes_total", "Chat completion requests by how they ended: completed, canceled by the client, failed at providers, or rejected.", "group", "stream", "outcome"),
+		errors:           registry.Counter("llmrouter_errors_total", "Chat completion requests that failed, by error class.", append(routeLabels, "class")...),
+		upstreamErrors:   registry.Counter("llmrouter_upstream_errors_total", "Attempts at providers that failed, retried or not, by error class.", append(routeLabels, "class")...),
+		requestDuration:  registry.Histogram("llmrouter_request_duration_seconds", "Latency of chat completion requests, until their stream ended for streams.", latencyBuckets, routeLabels...),
+		upstreamDuration: registry.Histogram("llmrouter_upstream_duration_seconds", "Latency of attempts at providers, until their stream started for streams.", latencyBuckets, routeLabels...),
+		timeToFirstToken: registry.Histogram("llmrouter_time_to_first_token_seconds", "Time from the request of a stream to a provider to its first generated token.", firstTokenBuckets, routeLabels...),
+		streamThroughput: registry.Histogram("llmrouter_stream_tokens_per_second", "Completion tokens of streams generated per second after their first token.", throughputBuckets, routeLabels...),
+		streamDuration:   registry.Histogram("llmrouter_stream_duration_seconds", "Time from the request of a stream to a provider to its end.", latencyBuckets, routeLabels...),
+		streamChunks:     registry.Histogram("llmrouter_stream_chunks", "Chunks received from providers per stream.", chunkBuckets, routeLabels...),
+		streamBytes:      registry.Histogram("llmrouter_stream_bytes", "Bytes of chunks relayed per stream.", byteBuckets, routeLabels...),
+		streamEnds:       registry.Counter("llmrouter_stream_ends_total", "Streams that ended, by the reason they ended for.", append(routeLabels, "reason")...),
+		errorRateAlert:   registry.Gauge("llmrouter_error_rate_alert", "Whether the error rate of a provider is over its threshold, 1 while it is.", "provider"),
+	}
+}
+
+// startStatsD forwards the metrics to the configured DogStatsD agent, if any
+func (a *App) startStatsD() {
+	cfg := a.Config.StatsD
+	if cfg.Address == "" {
+		return
+	}
+	interval := cfg.FlushInterval
+	if interval <= 0 {
+		interval = config.DefaultStatsDFlushInterval
+	}
+	statsd, err := metrics.NewStatsD(cfg.Address, cfg.Prefix, cfg.Tags, interval)
+	if err != nil {
+		a.Logger.Error("Failed to connect to the DogStatsD agent", slog.String("address", cfg.Address), slog.Any("error", err))
+		return
+	}
+	a.metrics.registry.Forward(statsd)
+	a.Logger.Info("Sending metrics to DogStatsD", slog.String("address", cfg.Address), slog.Duration("flush_interval", interval))
+}
+
+// record counts a usage record of a provider key, identified by its hash
+func (m *usageMetrics) record(provider string, keyHash string, record client.UsageRecord) {
+	labels := []string{provider, record.Model, usage.KeyID(provider, keyHash), record.ClientKey}
+	m.requests.Add(float64(record.Requests), labels...)
+	m.promptTokens.Add(float64(record.PromptTokens), labels...)
+	m.completionTokens.Add(float64(record.CompletionTokens), labels...)
+	m.cost.Add(record.Cost, labels...)
+}
+
+// Outcomes of chat completion requests, telling the requests clients gave up on from those providers failed
+const (
+	outcomeCompleted      = "completed"
+	outcomeClientCanceled = "client_canceled"
+	outcomeUpstreamError  = "upstream_error"
+	outcomeRejected       = "rejected"
+)
+
+// requestOutcome returns how the request of ctx that ended with err ended. Requests whose client went away
+// are canceled whatever error their provider call ended with, and requests refused by the router, e.g. over
+// budget or with no route available, or as invalid by their provider are rejected.
+func requestOutcome(ctx context.Context, err error) string {
+	if err == nil {
+		return outcomeCompleted
+	}
+	if errors.Is(ctx.Err(), context.Canceled) || errors.Is(err, context.Canceled) {
+		return outcomeClientCanceled
+	}
+	switch errorClass(err) {
+	case errorClassTimeout, errorClassRateLimited, errorClassAuth, errorClassUpstream:
+		return outcomeUpstreamError
+	}
+	return outcomeRejected
+}
+
+// observeRequest counts a chat completion request of a group as it ends, with the route it was served on,
+// which is empty when it failed before reaching a provider or on the provider
+func (a *App) observeRequest(ctx context.Context, start time.Time, group string, stream bool, route client.Route, err error) {
+	if a.metrics == nil {
+		return
+	}
+	labels := []string{group, route.Provider, route.Model, route.KeyID}
+	status := "success"
+	if err != nil {
+		status = "error"
+		a.metrics.errors.Add(1, append(labels, errorClass(err))...)
+	}
+	a.metrics.chatRequests.Add(1, append(labels, status)...)
+	a.metrics.requestDuration.Observe(time.Since(start).Seconds(), labels...)
+	a.metrics.outcomes.Add(1, group, strconv.FormatBool(stream), requestOutcome(ctx, err))
+}
+
+// observeAttempt records the latency and error of an attempt at a request of a group on a route, counting it
+// towards the error rate of the provider
+func (a *App) observeAttempt(start time.Time, group string, route client.Route, err error) {
+	a.observeErrorRate(route.Provider, err)
+	if a.metrics == nil {
+		return
+	}
+	labels := []string{group, route.Provider, route.Model, route.KeyID}
+	a.metrics.upstreamDuration.Observe(time.Since(start).Seconds(), labels...)
+	if err != nil {
+		a.metrics.upstreamErrors.Add(1, append(labels, errorClass(err))...)
+	}
+}
+
+// streamTiming records when the first token of a stream requested from a provider at start arrived. It is
+// safe for concurrent use, as streams may be closed from another goroutine than the one receiving them.
+type streamTiming struct {
+	start      time.Time
+	mutex      sync.Mutex
+	firstToken time.Time
+}
+
+// chunk notes the arrival of a chunk, the first token being the first content, reasoning, or tool call
+func (t *streamTiming) chunk(chunk openai.ChatCompletionStreamResponse) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.firstToken.IsZero() {
+		return
+	}
+	for _, choice := range chunk.Choices {
+		if choice.Delta.Content != "" || choice.Delta.ReasoningContent != "" || len(choice.Delta.ToolCalls) > 0 {
+			t.firstToken = time.Now()
+			return
+		}
+	}
+}
+
+// firstTokenAt returns when the first token arrived, zero if none did
+func (t *streamTiming) firstTokenAt() time.Time {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.firstToken
+}
+
+// Reasons streams end for
+const (
+	streamEndCompleted      = "completed"
+	streamEndClientCanceled = "client_canceled"
+	streamEndIdleTimeout    = "idle_timeout"
+	streamEndTimeout        = "timeout"
+	streamEndUpstreamError  = "upstream_error"
+	streamEndClosed         = "closed"
+)
+
+// streamEndReason returns why the stream of the request of ctx ended: the provider finished it, the client
+// went away, the provider went idle or out of time or failed, or it was closed before its end otherwise
+func streamEndReason(ctx context.Context, stream *client.ChatCompletionStream) string {
+	err := stream.Err()
+	switch {
+	case stream.Finished():
+		return streamEndCompleted
+	case errors.Is(ctx.Err(), context.Canceled) || errors.Is(err, context.Canceled):
+		return streamEndClientCanceled
+	case errors.Is(err, client.ErrStreamIdle):
+		return streamEndIdleTimeout
+	case errors.Is(err, context.DeadlineExceeded):
+		return streamEndTimeout
+	case err != nil:
+		return streamEndUpstreamError
+	}
+	return streamEndClosed
+}
+
+// observeStream records the duration, chunks, bytes, and end reason of a stream of a group that ended, and the
+// time to first token and the throughput of those that generated tokens
+func (a *App) observeStream(ctx context.Context, group string, stream *client.ChatCompletionStream, timing *streamTiming) {
+	route := stream.Route
+	labels := []string{group, route.Provider, route.Model, route.KeyID}
+	if a.metrics != nil {
+		a.metrics.streamDuration.Observe(time.Since(timing.start).Seconds(), labels...)
+		a.metrics.streamChunks.Observe(float64(stream.Chunks()), labels...)
+		a.metrics.streamBytes.Observe(float64(stream.Bytes()), labels...)
+		a.metrics.streamEnds.Add(1, append(labels, streamEndReason(ctx, stream))...)
+	}
+	firstToken := timing.firstTokenAt()
+	if firstToken.IsZero() {
+		return
+	}
+	ttft := firstToken.Sub(timing.start)
+	var throughput float64
+	if generation := time.Since(firstToken); generation > 0 && stream.Usage().CompletionTokens > 0 {
+		throughput = float64(stream.Usage().CompletionTokens) / generation.Seconds()
+	}
+	a.streamStats.observe(route.Provider, route.Model, ttft, throughput)
+	if a.metrics == nil {
+		return
+	}
+	a.metrics.timeToFirstToken.Observe(ttft.Seconds(), labels...)
+	if throughput > 0 {
+		a.metrics.streamThroughput.Observe(throughput, labels...)
+	}
+}
+
+// streamStatsWeight is the weight of the latest stream in the moving averages of streamStats
+const streamStatsWeight = 0.1
+
+// streamStats keeps moving averages of the time to first token and throughput of the streams of every
+// provider and model, reported by the admin API. The zero value is ready to use.
+type streamStats struct {
+	mutex sync.Mutex
+	// models are the averages by provider and model
+	models map[[2]string]*modelStreamStats
+}
+
+// modelStreamStats are the averages of the streams of a model, throughput being averaged over the streams
+// it was measured for
+type modelStreamStats struct {
+	streams    int64
+	ttft       float64
+	measured   int64
+	throughput float64
+}
+
+// observe adds a stream of a model of a provider to the averages, its throughput when not zero
+func (s *streamStats) observe(provider string, model string, ttft time.Duration, throughput float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.models == nil {
+		s.models = make(map[[2]string]*modelStreamStats)
+	}
+	stats, exists := s.models[[2]string{provider, model}]
+	if !exists {
+		stats = &modelStreamStats{}
+		s.models[[2]string{provider, model}] = stats
+	}
+	stats.streams++
+	stats.ttft = movingAverage(stats.ttft, float64(ttft.Milliseconds()), stats.streams)
+	if throughput > 0 {
+		stats.measured++
+		stats.throughput = movingAverage(stats.throughput, throughput, stats.measured)
+	}
+}
+
+// provider returns the averages of the models of a provider, by model
+func (s *streamStats) provider(name string) map[string]server.AdminStreamStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	models := make(map[string]server.AdminStreamStats)
+	for key, stats := range s.models {
+		if key[0] == name {
+			models[key[1]] = server.AdminStreamStats{Streams: stats.streams, TimeToFirstTokenMs: stats.ttft, TokensPerSecond: stats.throughput}
+		}
+	}
+	return models
+}
+
+// movingAverage adds the nth value to an exponentially weighted moving average, the first values being
+// averaged evenly so that the average does not start biased towards zero
+func movingAverage(average float64, value float64, n int64) float64 {
+	weight := max(streamStatsWeight, 1/float64(n))
+	return average + weight*(value-average)
+}
@@ -1,7 +1,37 @@
 package app
 
+import "llm-router/client"
+
 type Model struct {
 	Weight   int64
 	Provider string
 	Name     string
+
+	ContextWindow int64
+	Capabilities  []string
+	// Price of the model as configured in its group, zero when not priced
+	Price client.Price
+
+	// Token dimension the model's usage is balanced on, see client.BalanceUsage
+	BalanceOn string
+	// KeyPolicy is KeyPolicyBalanced or KeyPolicyFreeFirst, empty for balanced
+	KeyPolicy string
+}
+
+// Key policies of groups
+const (
+	// KeyPolicyBalanced balances requests across all keys
+	KeyPolicyBalanced = "balanced"
+	// KeyPolicyFreeFirst only routes to paid keys while no free key is available
+	KeyPolicyFreeFirst = "free_first"
+)
+
+// HasCapability reports whether the model declares the given capability
+func (m *Model) HasCapability(capability string) bool {
+	for _, c := range m.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
 }
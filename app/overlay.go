@@ -0,0 +1,242 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"llm-router/config"
+	"llm-router/server"
+	"llm-router/utils"
+	"log/slog"
+	"os"
+	"slices"
+)
+
+// configOverlay holds the changes made through the admin API, applied over the configuration as loaded so
+// that they survive reloads and, saved to overlay_file, restarts
+type configOverlay struct {
+	// AddedKeys are the keys added to providers, by provider name
+	AddedKeys map[string][]overlayKey `json:"added_keys,omitempty"`
+	// RemovedKeys are the configured keys removed from providers, by provider name
+	RemovedKeys map[string][]string `json:"removed_keys,omitempty"`
+	// Weights override the weights of models of groups
+	Weights []overlayWeight `json:"weights,omitempty"`
+	// Groups enable or disable groups by name
+	Groups map[string]bool `json:"groups,omitempty"`
+}
+
+// overlayKey is a provider key added through the admin API
+type overlayKey struct {
+	Key  string `json:"key"`
+	Free bool   `json:"free,omitempty"`
+}
+
+// overlayWeight is the weight of a model of a group set through the admin API
+type overlayWeight struct {
+	Group    string `json:"group"`
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Weight   int64  `json:"weight"`
+}
+
+// clone returns a deep copy of the overlay to change
+func (o *configOverlay) clone() *configOverlay {
+	if o == nil {
+		o = &configOverlay{}
+	}
+	next := &configOverlay{
+		AddedKeys:   make(map[string][]overlayKey, len(o.AddedKeys)),
+		RemovedKeys: make(map[string][]string, len(o.RemovedKeys)),
+		Weights:     slices.Clone(o.Weights),
+		Groups:      make(map[string]bool, len(o.Groups)),
+	}
+	for provider, keys := range o.AddedKeys {
+		next.AddedKeys[provider] = slices.Clone(keys)
+	}
+	for provider, keys := range o.RemovedKeys {
+		next.RemovedKeys[provider] = slices.Clone(keys)
+	}
+	for group, enabled := range o.Groups {
+		next.Groups[group] = enabled
+	}
+	return next
+}
+
+// apply returns a copy of the configuration with the overlay's changes. Changes to providers, groups, and
+// models the configuration no longer has are left out.
+func (o *configOverlay) apply(cfg *config.Config) *config.Config {
+	if o == nil {
+		return cfg
+	}
+	applied := *cfg
+	applied.Providers = slices.Clone(cfg.Providers)
+	for i := range applied.Providers {
+		p := &applied.Providers[i]
+		removed := o.RemovedKeys[p.Name]
+		keep := func(keys []string) []string {
+			return slices.DeleteFunc(slices.Clone(keys), func(key string) bool { return slices.Contains(removed, key) })
+		}
+		p.APIKeys, p.FreeAPIKeys = keep(p.APIKeys), keep(p.FreeAPIKeys)
+		for _, key := range o.AddedKeys[p.Name] {
+			if key.Free {
+				p.FreeAPIKeys = append(p.FreeAPIKeys, key.Key)
+			} else {
+				p.APIKeys = append(p.APIKeys, key.Key)
+			}
+		}
+	}
+	applied.Groups = slices.Clone(cfg.Groups)
+	for i := range applied.Groups {
+		g := &applied.Groups[i]
+		if enabled, exists := o.Groups[g.Name]; exists {
+			g.Disabled = !enabled
+		}
+		g.Models = slices.Clone(g.Models)
+		for j := range g.Models {
+			m := &g.Models[j]
+			for _, w := range o.Weights {
+				if w.Group == g.Name && w.Provider == m.Provider && w.Model == m.Name {
+					m.Weight = w.Weight
+				}
+			}
+		}
+	}
+	return &applied
+}
+
+// loadOverlay reads the overlay saved to overlay_file, empty when there is none
+func loadOverlay(path string) (*configOverlay, error) {
+	overlay := &configOverlay{}
+	if path == "" {
+		return overlay, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return overlay, nil
+	}
+	if err != nil {
+		return overlay, err
+	}
+	if err := json.Unmarshal(data, overlay); err != nil {
+		return &configOverlay{}, fmt.Errorf("invalid overlay file %s: %w", path, err)
+	}
+	return overlay, nil
+}
+
+// changeOverlay applies a change of the overlay, saving it to overlay_file, unless the configuration with the
+// change is invalid
+func (a *App) changeOverlay(change func(overlay *configOverlay, cfg *config.Config) error) error {
+	a.reloading.Lock()
+	defer a.reloading.Unlock()
+
+	next := a.overlay.clone()
+	if err := change(next, a.overlay.apply(a.loaded)); err != nil {
+		return err
+	}
+	cfg, err := resolveSecrets(a.secrets, next.apply(a.loaded))
+	if err != nil {
+		return err
+	}
+	if problems := ValidateConfig(cfg); HasErrors(problems) {
+		return fmt.Errorf("the change makes the configuration invalid: %w", problemsError(problems))
+	}
+	// The change is only saved once the state it is applied with is built
+	state, err := a.prepare(cfg)
+	if err != nil {
+		return err
+	}
+	if path := a.Config.OverlayFile; path != "" {
+		data, err := json.MarshalIndent(next, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := utils.WriteFileAtomic(path, data); err != nil {
+			a.Logger.Error("Failed to save overlay", slog.String("path", path), slog.Any("error", err))
+			return fmt.Errorf("failed to save the change: %w", err)
+		}
+	}
+	a.overlay = next
+	a.commit(state)
+	return nil
+}
+
+// addKey adds a key to a provider, returning its index
+func (a *App) addKey(provider string, key string, free bool) (int, error) {
+	var index int
+	err := a.changeOverlay(func(overlay *configOverlay, cfg *config.Config) error {
+		i := slices.IndexFunc(cfg.Providers, func(p config.Provider) bool { return p.Name == provider })
+		if i < 0 {
+			return fmt.Errorf("%w: no provider %s", server.ErrAdminNotFound, provider)
+		}
+		if key == "" {
+			return errors.New("key is required")
+		}
+		p := cfg.Providers[i]
+		if slices.Contains(p.APIKeys, key) || slices.Contains(p.FreeAPIKeys, key) {
+			return fmt.Errorf("provider %s already has the key", provider)
+		}
+		// A key removed before is restored rather than added
+		if removed := overlay.RemovedKeys[provider]; slices.Contains(removed, key) {
+			overlay.RemovedKeys[provider] = slices.DeleteFunc(removed, func(k string) bool { return k == key })
+		} else {
+			overlay.AddedKeys[provider] = append(overlay.AddedKeys[provider], overlayKey{Key: key, Free: free})
+		}
+		index = len(p.APIKeys)
+		if free {
+			index += len(p.FreeAPIKeys)
+		}
+		return nil
+	})
+	return index, err
+}
+
+// removeKey removes the key at an index of a provider's api_keys followed by its free_api_keys
+func (a *App) removeKey(provider string, index int) error {
+	return a.changeOverlay(func(overlay *configOverlay, cfg *config.Config) error {
+		i := slices.IndexFunc(cfg.Providers, func(p config.Provider) bool { return p.Name == provider })
+		if i < 0 {
+			return fmt.Errorf("%w: no provider %s", server.ErrAdminNotFound, provider)
+		}
+		keys := slices.Concat(cfg.Providers[i].APIKeys, cfg.Providers[i].FreeAPIKeys)
+		if index < 0 || index >= len(keys) {
+			return fmt.Errorf("%w: no key %d for provider %s, dedicated tenant keys are only configured in tenants", server.ErrAdminNotFound, index, provider)
+		}
+		key := keys[index]
+		added := overlay.AddedKeys[provider]
+		if j := slices.IndexFunc(added, func(k overlayKey) bool { return k.Key == key }); j >= 0 {
+			overlay.AddedKeys[provider] = slices.Delete(added, j, j+1)
+		} else {
+			overlay.RemovedKeys[provider] = append(overlay.RemovedKeys[provider], key)
+		}
+		return nil
+	})
+}
+
+// setModelWeight sets the weight of the model at an index of a group
+func (a *App) setModelWeight(group string, index int, weight int64) error {
+	return a.changeOverlay(func(overlay *configOverlay, cfg *config.Config) error {
+		i := slices.IndexFunc(cfg.Groups, func(g config.Group) bool { return g.Name == group })
+		if i < 0 || index < 0 || index >= len(cfg.Groups[i].Models) {
+			return fmt.Errorf("%w: no model %d in group %s", server.ErrAdminNotFound, index, group)
+		}
+		m := cfg.Groups[i].Models[index]
+		w := overlayWeight{Group: group, Provider: m.Provider, Model: m.Name, Weight: weight}
+		overlay.Weights = slices.DeleteFunc(overlay.Weights, func(o overlayWeight) bool {
+			return o.Group == w.Group && o.Provider == w.Provider && o.Model == w.Model
+		})
+		overlay.Weights = append(overlay.Weights, w)
+		return nil
+	})
+}
+
+// setGroupEnabled enables or disables a group
+func (a *App) setGroupEnabled(group string, enabled bool) error {
+	return a.changeOverlay(func(overlay *configOverlay, cfg *config.Config) error {
+		if !slices.ContainsFunc(cfg.Groups, func(g config.Group) bool { return g.Name == group }) {
+			return fmt.Errorf("%w: no group %s", server.ErrAdminNotFound, group)
+		}
+		overlay.Groups[group] = enabled
+		return nil
+	})
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"fmt"
+	"llm-router/client"
+	"llm-router/config"
+	"llm-router/server"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// passthroughTarget resolves the provider key designated for a passthrough endpoint
+func (a *App) passthroughTarget(cfg config.Passthrough) (*client.ProviderClient, *client.KeyClient, error) {
+	pClient, exists := a.clients[cfg.Provider]
+	if !exists {
+		return nil, nil, fmt.Errorf("unknown provider: %s", cfg.Provider)
+	}
+	if cfg.KeyIndex < 0 || cfg.KeyIndex >= len(pClient.KeyClients) {
+		return nil, nil, fmt.Errorf("key index %d out of range for provider: %s", cfg.KeyIndex, cfg.Provider)
+	}
+	return pClient, pClient.KeyClients[cfg.KeyIndex], nil
+}
+
+// resolveModelName maps a model name reported by a provider (e.g. a dated snapshot)
+// onto the configured model name of that provider it extends, if any
+func (a *App) resolveModelName(provider string, name string) string {
+	resolved := name
+	for _, group := range a.Groups {
+		for _, m := range group.Models {
+			if m.Provider != provider || !strings.HasPrefix(name, m.Name) {
+				continue
+			}
+			// Prefer the longest matching configured name
+			if resolved == name || len(m.Name) > len(resolved) {
+				resolved = m.Name
+			}
+		}
+	}
+	return resolved
+}
+
+// getPassthroughHandlers builds the proxies for the Batch and Files APIs.
+// The Files API defaults to the batch provider key, since batches read their input from uploaded files.
+// A handler is nil if its endpoints are not configured.
+func (a *App) getPassthroughHandlers() (batches http.Handler, files http.Handler) {
+	filesCfg := a.Config.Files
+	if filesCfg.Provider == "" {
+		filesCfg = a.Config.Batch
+	}
+
+	if a.Config.Batch.Provider != "" {
+		if proxy, _, err := a.newPassthroughProxy(a.Config.Batch); err != nil {
+			a.Logger.Error("Batch API disabled", slog.Any("error", err))
+		} else {
+			a.Logger.Info("Batch API enabled", slog.String("provider", a.Config.Batch.Provider))
+			batches = proxy
+		}
+	}
+
+	if filesCfg.Provider != "" {
+		if proxy, usage, err := a.newPassthroughProxy(filesCfg); err != nil {
+			a.Logger.Error("Files API disabled", slog.Any("error", err))
+		} else {
+			a.Logger.Info("Files API enabled", slog.String("provider", filesCfg.Provider))
+			// Batch results are downloaded as output files, so count their usage here
+			proxy.ModifyResponse = usage.ModifyResponse
+			files = proxy
+		}
+	}
+	return batches, files
+}
+
+// newPassthroughProxy creates a proxy to the designated provider key together with a tracker
+// for the usage of batch results downloaded from that key
+func (a *App) newPassthroughProxy(cfg config.Passthrough) (*httputil.ReverseProxy, *client.BatchUsage, error) {
+	pClient, keyClient, err := a.passthroughTarget(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	proxy, err := client.NewProxy(pClient.BaseURL, keyClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	proxy.ErrorHandler = server.ProxyError
+	usage := client.NewBatchUsage(keyClient, func(model string) string {
+		return a.resolveModelName(pClient.ProviderName, model)
+	})
+	return proxy, usage, nil
+}
+
+// getAssistantsTargets builds the proxies of the groups with a designated Assistants API provider key.
+// A group's name given as model is replaced with the group's first model on that provider.
+func (a *App) getAssistantsTargets() map[string]server.AssistantsTarget {
+	targets := make(map[string]server.AssistantsTarget)
+	for _, cfgGroup := range a.Config.Groups {
+		if cfgGroup.Assistants.Provider == "" {
+			continue
+		}
+		proxy, _, err := a.newPassthroughProxy(cfgGroup.Assistants)
+		if err != nil {
+			a.Logger.Error("Assistants API disabled for group", slog.String("group", cfgGroup.Name), slog.Any("error", err))
+			continue
+		}
+		target := server.AssistantsTarget{Proxy: proxy}
+		for _, m := range cfgGroup.Models {
+			if m.Provider == cfgGroup.Assistants.Provider {
+				target.Model = m.Name
+				break
+			}
+		}
+		a.Logger.Info("Assistants API enabled for group", slog.String("group", cfgGroup.Name), slog.String("provider", cfgGroup.Assistants.Provider))
+		targets[cfgGroup.Name] = target
+	}
+	return targets
+}
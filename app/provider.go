@@ -1,7 +1,38 @@
 package app
 
+import (
+	"slices"
+	"strings"
+)
+
 type Provider struct {
 	Name    string
 	BaseURL string
 	APIKeys []string
+	// Patterns of the requested model names passed through to the provider
+	Models []string
+}
+
+// servesModel reports whether a requested model name matches one of the provider's model patterns
+func (p *Provider) servesModel(name string) bool {
+	return slices.ContainsFunc(p.Models, func(pattern string) bool { return matchModel(pattern, name) })
+}
+
+// matchModel reports whether a model name matches a pattern, where * matches any characters, slashes included
+func matchModel(pattern string, name string) bool {
+	prefix, rest, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	name = name[len(prefix):]
+	// The rest of the pattern matches some suffix of the name
+	for i := 0; i <= len(name); i++ {
+		if matchModel(rest, name[i:]) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,318 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"llm-router/client"
+	"llm-router/server"
+	"llm-router/usage"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultRedisPrefix       = "llm-router:"
+	defaultRedisSyncInterval = time.Second
+	// redisTimeout bounds each exchange with Redis so that an unreachable server does not stall requests
+	redisTimeout = time.Second
+)
+
+// redisPrefix returns the configured key prefix or its default
+func (a *App) redisPrefix() string {
+	if a.Config.Redis.Prefix != "" {
+		return a.Config.Redis.Prefix
+	}
+	return defaultRedisPrefix
+}
+
+// connectRedis shares the client key quotas through Redis when configured and returns the client
+// used to synchronize the usage counters
+func (a *App) connectRedis() *redis.Client {
+	cfg := a.Config.Redis
+	if cfg.Address == "" {
+		return nil
+	}
+	options := &redis.Options{
+		Addr:     cfg.Address,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+		// Exchanges are bounded by redisTimeout through their contexts
+		ContextTimeoutEnabled: true,
+	}
+	if cfg.TLS {
+		host, _, err := net.SplitHostPort(cfg.Address)
+		if err != nil {
+			host = cfg.Address
+		}
+		options.TLSConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	}
+	rc := redis.NewClient(options)
+	a.Server.SetQuotaCounters(&redisQuotaCounters{client: rc, prefix: a.redisPrefix()})
+	return rc
+}
+
+// admitScript reads the counters of the quota windows in KEYS, whose limits, deltas, and TTLs in milliseconds
+// are the triples of ARGV, and adds the deltas only if no counter has reached its limit. It returns whether
+// the deltas were added, followed by the counters before.
+var admitScript = redis.NewScript(`
+local usage = {}
+local admitted = 1
+for i, key in ipairs(KEYS) do
+	usage[i] = tonumber(redis.call("GET", key) or "0")
+	local limit = tonumber(ARGV[3 * i - 2])
+	if limit > 0 and usage[i] >= limit then
+		admitted = 0
+	end
+end
+if admitted == 1 then
+	for i, key in ipairs(KEYS) do
+		local delta = tonumber(ARGV[3 * i - 1])
+		if delta ~= 0 then
+			redis.call("INCRBY", key, delta)
+			redis.call("PEXPIRE", key, ARGV[3 * i])
+		end
+	end
+end
+table.insert(usage, 1, admitted)
+return usage
+`)
+
+// redisQuotaCounters holds the client key quota counters in keys expiring after their window, under prefix
+type redisQuotaCounters struct {
+	client *redis.Client
+	prefix string
+}
+
+func (c *redisQuotaCounters) Admit(ctx context.Context, windows []server.QuotaWindow) ([]int64, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	keys := make([]string, len(windows))
+	args := make([]any, 0, 3*len(windows))
+	for i, window := range windows {
+		keys[i] = c.prefix + window.Key
+		args = append(args, window.Limit, window.Delta, window.TTL.Milliseconds())
+	}
+	reply, err := admitScript.Run(ctx, c.client, keys, args...).Int64Slice()
+	if err != nil {
+		return nil, false, err
+	}
+	if len(reply) != len(windows)+1 {
+		return nil, false, fmt.Errorf("unexpected reply of %d values to the admission of %d quota windows", len(reply), len(windows))
+	}
+	return reply[1:], reply[0] == 1, nil
+}
+
+func (c *redisQuotaCounters) Add(ctx context.Context, windows []server.QuotaWindow) error {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, window := range windows {
+			pipe.IncrBy(ctx, c.prefix+window.Key, window.Delta)
+			pipe.Expire(ctx, c.prefix+window.Key, window.TTL)
+		}
+		return nil
+	})
+	return err
+}
+
+// startUsageSync periodically exchanges the usage counters of every key with the other instances
+func (a *App) startUsageSync(rc *redis.Client, interval time.Duration) {
+	a.Logger.Info("Sharing usage counters through Redis", slog.String("address", a.Config.Redis.Address), slog.Duration("interval", interval))
+	go func() {
+		for range time.Tick(interval) {
+			a.syncUsage(rc)
+		}
+	}()
+}
+
+// syncUsage exchanges the usage counters of every key once
+func (a *App) syncUsage(rc *redis.Client) {
+	a.reloadMutex.RLock()
+	clients := a.clients
+	schedules := a.resetSchedules
+	a.reloadMutex.RUnlock()
+	for _, pClient := range clients {
+		var periods []time.Time
+		var expiry time.Time
+		if schedule, exists := schedules[pClient.ProviderName]; exists {
+			if periods = schedule.periods(); periods != nil {
+				expiry = schedule.expiry(periods[0])
+			}
+		}
+		for _, kClient := range pClient.KeyClients {
+			hash := a.usageHash(pClient.ProviderName, kClient)
+			apply := redisUsageApplier(rc, hash)
+			if periods != nil {
+				apply = redisPeriodUsageApplier(rc, hash, periods, expiry)
+			}
+			if err := kClient.SyncUsage(apply); err != nil {
+				a.Logger.Error("Failed to sync usage counters",
+					slog.String("provider", pClient.ProviderName),
+					slog.String("key_id", providerKeyID(pClient.ProviderName, kClient)),
+					slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// usageHash returns the Redis hash of the usage counters of a provider's key, named after the key's hash so
+// that it stays the key's as keys are added, removed, or reordered
+func (a *App) usageHash(provider string, kClient *client.KeyClient) string {
+	return fmt.Sprintf("%susage:%s:%s", a.redisPrefix(), provider, usage.KeyHash(kClient.APIKey))
+}
+
+// periodHash returns the Redis hash of the usage counters of a key in the usage window ending at period
+func periodHash(hash string, period time.Time) string {
+	return hash + ":" + strconv.FormatInt(period.Unix(), 10)
+}
+
+// addRedisUsage adds usage deltas to the counters in a Redis hash expiring at expiry
+func addRedisUsage(rc *redis.Client, hash string, deltas map[string]int64, expiry time.Time) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	_, err := rc.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for field, delta := range deltas {
+			pipe.HIncrBy(ctx, hash, field, delta)
+		}
+		pipe.ExpireAt(ctx, hash, expiry)
+		return nil
+	})
+	return err
+}
+
+// batchTTL is how long the sequence number of the latest batch of usage deltas of a source is kept, bounding
+// how long after a lost reply a batch can be retried without being added twice
+const batchTTL = 24 * time.Hour
+
+// applyBatchScript adds the deltas of a batch of usage counters to the hash KEYS[1], for the first ARGV[4]
+// field and delta pairs of ARGV from the fifth on, and to the hash KEYS[3] for the others, unless the latest
+// batch of its source, whose sequence number is kept in KEYS[2] for ARGV[2] milliseconds, is the same or a
+// later one than ARGV[3]. KEYS[1] expires at the Unix time in milliseconds ARGV[1], unless 0.
+var applyBatchScript = redis.NewScript(`
+local latest = tonumber(redis.call("GET", KEYS[2]) or "0")
+if latest >= tonumber(ARGV[3]) then
+	return 0
+end
+local windowed = 4 + 2 * tonumber(ARGV[4])
+for i = 5, #ARGV, 2 do
+	local hash = KEYS[1]
+	if i > windowed then
+		hash = KEYS[3]
+	end
+	redis.call("HINCRBY", hash, ARGV[i], ARGV[i + 1])
+end
+if ARGV[1] ~= "0" and windowed > 4 then
+	redis.call("PEXPIREAT", KEYS[1], ARGV[1])
+end
+redis.call("SET", KEYS[2], ARGV[3], "PX", ARGV[2])
+return 1
+`)
+
+// applyBatch adds a batch of usage deltas once only, the sequence numbers of the batches applied being kept
+// along the usage hash: the counters counted per usage window to those in target, expiring at expiry unless
+// zero, and those accumulating across windows, i.e. the cost, to those in the usage hash itself
+func applyBatch(ctx context.Context, rc *redis.Client, hash string, target string, batch client.UsageBatch, expiry time.Time) error {
+	if len(batch.Deltas) == 0 {
+		return nil
+	}
+	var expiresAt int64
+	if !expiry.IsZero() {
+		expiresAt = expiry.UnixMilli()
+	}
+	var windowed, accumulating []any
+	for field, delta := range batch.Deltas {
+		if client.Windowed(field) {
+			windowed = append(windowed, field, delta)
+		} else {
+			accumulating = append(accumulating, field, delta)
+		}
+	}
+	args := append([]any{expiresAt, batchTTL.Milliseconds(), batch.Seq, len(windowed) / 2}, windowed...)
+	args = append(args, accumulating...)
+	return applyBatchScript.Run(ctx, rc, []string{target, hash + ":batch:" + batch.Source, hash}, args...).Err()
+}
+
+// redisPeriodUsageApplier adds a batch of usage deltas to the counters of the current usage window, the first
+// of periods, whose hash expires at expiry, and returns the counters of all kept windows summed up, along with
+// the cost accumulated across windows
+func redisPeriodUsageApplier(rc *redis.Client, hash string, periods []time.Time, expiry time.Time) func(batch client.UsageBatch) (map[string]int64, error) {
+	return func(batch client.UsageBatch) (map[string]int64, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		if err := applyBatch(ctx, rc, hash, periodHash(hash, periods[0]), batch, expiry); err != nil {
+			return nil, err
+		}
+		windows := make([]*redis.MapStringStringCmd, len(periods))
+		var accumulated *redis.MapStringStringCmd
+		_, err := rc.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, period := range periods {
+				windows[i] = pipe.HGetAll(ctx, periodHash(hash, period))
+			}
+			accumulated = pipe.HGetAll(ctx, hash)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		values, err := parseCounters(hash, accumulated.Val())
+		if err != nil {
+			return nil, err
+		}
+		counters := make(map[string]int64)
+		for field, n := range values {
+			// The hash holds the counters of the usage before usage_reset was configured too
+			if !client.Windowed(field) {
+				counters[field] = n
+			}
+		}
+		for i, window := range windows {
+			values, err := parseCounters(periodHash(hash, periods[i]), window.Val())
+			if err != nil {
+				return nil, err
+			}
+			for field, n := range values {
+				counters[field] += n
+			}
+		}
+		return counters, nil
+	}
+}
+
+// redisUsageApplier adds a batch of usage deltas to the counters in a Redis hash and returns all of its
+// counters
+func redisUsageApplier(rc *redis.Client, hash string) func(batch client.UsageBatch) (map[string]int64, error) {
+	return func(batch client.UsageBatch) (map[string]int64, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		if err := applyBatch(ctx, rc, hash, hash, batch, time.Time{}); err != nil {
+			return nil, err
+		}
+		totals, err := rc.HGetAll(ctx, hash).Result()
+		if err != nil {
+			return nil, err
+		}
+		return parseCounters(hash, totals)
+	}
+}
+
+// parseCounters parses the counters of a Redis hash
+func parseCounters(hash string, values map[string]string) (map[string]int64, error) {
+	counters := make(map[string]int64, len(values))
+	for field, value := range values {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("counter %s of %s is not an integer: %w", field, hash, err)
+		}
+		counters[field] = n
+	}
+	return counters, nil
+}
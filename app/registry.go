@@ -0,0 +1,61 @@
+package app
+
+import "strings"
+
+// Model capabilities known to the registry
+const (
+	CapabilityChat       = "chat"
+	CapabilityTools      = "tools"
+	CapabilityVision     = "vision"
+	CapabilityAudio      = "audio"
+	CapabilityJSONSchema = "json_schema"
+	CapabilityReasoning  = "reasoning"
+	CapabilityRerank     = "rerank"
+)
+
+// ModelMeta describes an upstream model's context window and capabilities
+type ModelMeta struct {
+	ContextWindow int64
+	Capabilities  []string
+}
+
+// knownModels holds metadata for well-known upstream models, matched by name prefix.
+// More specific prefixes must come before the prefixes they extend.
+var knownModels = []struct {
+	prefix string
+	meta   ModelMeta
+}{
+	{"gpt-4o-audio", ModelMeta{128000, []string{CapabilityChat, CapabilityTools, CapabilityAudio}}},
+	{"gpt-4o", ModelMeta{128000, []string{CapabilityChat, CapabilityTools, CapabilityVision, CapabilityJSONSchema}}},
+	{"gpt-4.1", ModelMeta{1047576, []string{CapabilityChat, CapabilityTools, CapabilityVision, CapabilityJSONSchema}}},
+	{"gpt-4-turbo", ModelMeta{128000, []string{CapabilityChat, CapabilityTools, CapabilityVision}}},
+	{"gpt-4-32k", ModelMeta{32768, []string{CapabilityChat, CapabilityTools}}},
+	{"gpt-4", ModelMeta{8192, []string{CapabilityChat, CapabilityTools}}},
+	{"gpt-3.5-turbo", ModelMeta{16385, []string{CapabilityChat, CapabilityTools}}},
+	{"gpt-5", ModelMeta{400000, []string{CapabilityChat, CapabilityTools, CapabilityVision, CapabilityJSONSchema, CapabilityReasoning}}},
+	{"o1", ModelMeta{200000, []string{CapabilityChat, CapabilityTools, CapabilityVision, CapabilityJSONSchema, CapabilityReasoning}}},
+	{"o3", ModelMeta{200000, []string{CapabilityChat, CapabilityTools, CapabilityVision, CapabilityJSONSchema, CapabilityReasoning}}},
+	{"o4", ModelMeta{200000, []string{CapabilityChat, CapabilityTools, CapabilityVision, CapabilityJSONSchema, CapabilityReasoning}}},
+	{"claude", ModelMeta{200000, []string{CapabilityChat, CapabilityTools, CapabilityVision}}},
+	{"gemini", ModelMeta{1048576, []string{CapabilityChat, CapabilityTools, CapabilityVision, CapabilityJSONSchema}}},
+	{"deepseek-reasoner", ModelMeta{65536, []string{CapabilityChat, CapabilityReasoning}}},
+	{"deepseek", ModelMeta{65536, []string{CapabilityChat, CapabilityTools}}},
+	{"rerank", ModelMeta{4096, []string{CapabilityRerank}}},
+	{"jina-reranker", ModelMeta{8192, []string{CapabilityRerank}}},
+	{"bge-reranker", ModelMeta{8192, []string{CapabilityRerank}}},
+}
+
+// lookupModelMeta returns the registry metadata for a model name.
+// Vendor prefixes such as "openai/" used by aggregators are ignored.
+func lookupModelMeta(name string) (ModelMeta, bool) {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.ToLower(name)
+	for _, known := range knownModels {
+		if strings.HasPrefix(name, known.prefix) {
+			return known.meta, true
+		}
+	}
+	return ModelMeta{}, false
+}
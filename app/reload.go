@@ -0,0 +1,306 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"llm-router/client"
+	"llm-router/config"
+	"llm-router/server"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// reloadableSettings are the top-level settings applied by Reload; the others only apply on restart
+var reloadableSettings = map[string]bool{
+	"groups":                  true,
+	"group_templates":         true,
+	"providers":               true,
+	"aliases":                 true,
+	"explain_routing":         true,
+	"max_request_cost":        true,
+	"error_penalty":           true,
+	"request_penalty":         true,
+	"error_penalty_half_life": true,
+}
+
+// WatchConfig reloads the configuration at path, a file or a remote configuration, with load on SIGHUP and,
+// with config_watch_interval set, whenever it changes
+func (a *App) WatchConfig(path string, load func(path string) (*config.Config, error)) {
+	reload := func() {
+		cfg, err := load(path)
+		if err != nil {
+			a.reloadFailed(fmt.Errorf("failed to load %s: %w", config.Redact(path), err))
+			return
+		}
+		a.Reload(cfg)
+	}
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			a.Logger.Info("Reloading configuration on SIGHUP", slog.String("path", config.Redact(path)))
+			reload()
+		}
+	}()
+
+	if a.Config.ConfigWatchInterval <= 0 {
+		return
+	}
+	go func() {
+		last := configVersion(path)
+		for range time.Tick(time.Duration(a.Config.ConfigWatchInterval) * time.Second) {
+			if current := configVersion(path); current != "" && current != last {
+				last = current
+				a.Logger.Info("Reloading changed configuration", slog.String("path", config.Redact(path)))
+				reload()
+			}
+		}
+	}()
+}
+
+// configVersion identifies the current version of a configuration, the modification time of a file or the
+// checksum of a remote configuration, empty when it cannot be read
+func configVersion(path string) string {
+	if config.IsRemote(path) {
+		checksum, _ := config.Checksum(context.Background(), path)
+		return checksum
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return info.ModTime().String()
+}
+
+// Reload applies the groups, providers, and routing settings of a new configuration without dropping the
+// requests in flight, which finish on the candidates they were routed to. Provider keys that remain keep their
+// usage and health. Settings that only apply on restart keep their current values and are logged. The changes
+// made through the admin API are applied over it and provider keys referencing secrets are resolved first.
+// A configuration that fails to resolve, validate, or build is not applied at all, and the failure is logged
+// and reported by the admin API.
+func (a *App) Reload(cfg *config.Config) {
+	// Only reloads change the configuration, which they can read without holding reloadMutex
+	a.reloading.Lock()
+	defer a.reloading.Unlock()
+
+	resolved, err := resolveSecrets(a.secrets, a.overlay.apply(cfg))
+	if err != nil {
+		a.reloadFailed(fmt.Errorf("failed to resolve secrets: %w", err))
+		return
+	}
+	a.reloadMutex.RLock()
+	hash := a.configHash
+	a.reloadMutex.RUnlock()
+	if err := a.apply(resolved); err != nil {
+		a.reloadFailed(err)
+		return
+	}
+	a.auditReload(hash)
+	a.loaded = cfg
+	a.reloadMutex.Lock()
+	a.reloadStatus.LastError = ""
+	a.reloadStatus.Failures = 0
+	a.reloadMutex.Unlock()
+}
+
+// reloadFailed logs a reload that failed, keeping the current configuration, and records it for the admin API
+func (a *App) reloadFailed(err error) {
+	a.Logger.Error("Failed to reload configuration, keeping the current one", slog.Any("error", err))
+	now := time.Now().UTC()
+	a.reloadMutex.Lock()
+	a.reloadStatus.LastError = err.Error()
+	a.reloadStatus.LastFailedAt = &now
+	a.reloadStatus.Failures++
+	a.reloadMutex.Unlock()
+}
+
+// configStatus reports the configuration being served and the outcome of the latest reload
+func (a *App) configStatus() server.AdminConfigStatus {
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	status := a.reloadStatus
+	status.ConfigHash = a.configHash
+	return status
+}
+
+// reloadState is the state of a configuration being applied, built in full before any of it replaces the
+// current state
+type reloadState struct {
+	config    config.Config
+	groups    []*Group
+	providers []*Provider
+	clients   map[string]*client.ProviderClient
+	warnings  []string
+
+	kept, added, removed int
+}
+
+// apply validates a configuration whose secrets are resolved and applies it. reloading must be held.
+func (a *App) apply(cfg *config.Config) error {
+	state, err := a.prepare(cfg)
+	if err != nil {
+		return err
+	}
+	a.commit(state)
+	return nil
+}
+
+// prepare validates a configuration whose secrets are resolved and builds the state it is applied with,
+// without changing the current one. reloading must be held.
+func (a *App) prepare(cfg *config.Config) (*reloadState, error) {
+	problems := ValidateConfig(cfg)
+	a.logProblems(problems)
+	if HasErrors(problems) {
+		return nil, fmt.Errorf("invalid configuration: %w", problemsError(problems))
+	}
+
+	applied := *a.Config
+	applied.Groups = cfg.Groups
+	applied.GroupTemplates = cfg.GroupTemplates
+	applied.Providers = cfg.Providers
+	applied.Aliases = cfg.Aliases
+	applied.ExplainRouting = cfg.ExplainRouting
+	applied.MaxRequestCost = cfg.MaxRequestCost
+	applied.ErrorPenalty = cfg.ErrorPenalty
+	applied.RequestPenalty = cfg.RequestPenalty
+	applied.ErrorPenaltyHalfLife = cfg.ErrorPenaltyHalfLife
+
+	clients, err := getClients(&applied)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create provider clients: %w", err)
+	}
+	state := &reloadState{
+		config:    applied,
+		groups:    getGroups(&applied),
+		providers: getProviders(&applied),
+		clients:   clients,
+		warnings:  problemWarnings(problems),
+	}
+	if ignored := a.restartSettings(cfg); len(ignored) > 0 {
+		a.Logger.Warn("Changed settings only apply on restart", slog.Any("settings", ignored))
+	}
+	// The new clients share the state of the current ones, which stay untouched until the state is committed
+	state.kept, state.added, state.removed = a.carryOverKeys(a.clients, clients)
+	a.attachKeyClients(clients)
+	return state, nil
+}
+
+// commit replaces the current state with a prepared one at once. reloading must be held.
+func (a *App) commit(state *reloadState) {
+	applied := state.config
+	a.reloadMutex.Lock()
+	a.Config.Groups = applied.Groups
+	a.Config.GroupTemplates = applied.GroupTemplates
+	a.Config.Providers = applied.Providers
+	a.Config.Aliases = applied.Aliases
+	a.Config.ExplainRouting = applied.ExplainRouting
+	a.Config.MaxRequestCost = applied.MaxRequestCost
+	a.Config.ErrorPenalty = applied.ErrorPenalty
+	a.Config.RequestPenalty = applied.RequestPenalty
+	a.Config.ErrorPenaltyHalfLife = applied.ErrorPenaltyHalfLife
+	a.Groups = state.groups
+	a.Providers = state.providers
+	a.clients = state.clients
+	a.configHash = hashConfig(a.Config)
+	a.reloadStatus.AppliedAt = time.Now().UTC()
+	a.reloadStatus.Warnings = state.warnings
+	a.reloadMutex.Unlock()
+	a.redactor.update(&applied)
+
+	a.Logger.Info("Configuration reloaded",
+		slog.Int("groups", len(state.groups)),
+		slog.Int("providers", len(state.providers)),
+		slog.Int("keys_kept", state.kept),
+		slog.Int("keys_added", state.added),
+		slog.Int("keys_removed", state.removed))
+}
+
+// carryOverKeys makes the new clients of the keys that remain share the usage and health of their current
+// clients, and starts the usage windows of added keys of providers with a usage reset schedule. It returns
+// the number of keys kept, added, and removed.
+func (a *App) carryOverKeys(current map[string]*client.ProviderClient, next map[string]*client.ProviderClient) (kept int, added int, removed int) {
+	a.reloadMutex.RLock()
+	schedules := a.resetSchedules
+	a.reloadMutex.RUnlock()
+
+	for name, pClient := range next {
+		var remaining []*client.KeyClient
+		if currentClient, exists := current[name]; exists {
+			remaining = slices.Clone(currentClient.KeyClients)
+		}
+		for _, kClient := range pClient.KeyClients {
+			// The same key may be listed twice, each list entry carrying over one client
+			i := slices.IndexFunc(remaining, func(k *client.KeyClient) bool {
+				return k != nil && k.APIKey == kClient.APIKey && k.Tenant == kClient.Tenant
+			})
+			if i < 0 {
+				added++
+				if schedule, exists := schedules[name]; exists {
+					kClient.RotateUsage(schedule.windows())
+				}
+				continue
+			}
+			kClient.ShareState(remaining[i])
+			remaining[i] = nil
+			kept++
+		}
+		for _, kClient := range remaining {
+			if kClient != nil {
+				removed++
+			}
+		}
+	}
+	for name, pClient := range current {
+		if _, exists := next[name]; !exists {
+			removed += len(pClient.KeyClients)
+		}
+	}
+	return kept, added, removed
+}
+
+// restartSettings lists the settings of a new configuration that differ from the current ones but only apply on
+// restart, including the budgets, usage reset schedules, and Assistants API passthroughs of groups and providers
+func (a *App) restartSettings(cfg *config.Config) []string {
+	var changed []string
+	current, next := reflect.ValueOf(*a.Config), reflect.ValueOf(*cfg)
+	for i := range current.NumField() {
+		name := current.Type().Field(i).Tag.Get("mapstructure")
+		if !reloadableSettings[name] && !reflect.DeepEqual(current.Field(i).Interface(), next.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	if !reflect.DeepEqual(getBudgets(a.Config), getBudgets(cfg)) {
+		changed = append(changed, "budgets")
+	}
+	usageResets := func(cfg *config.Config) map[string]config.UsageReset {
+		resets := make(map[string]config.UsageReset)
+		for _, p := range cfg.Providers {
+			if p.UsageReset != (config.UsageReset{}) {
+				resets[p.Name] = p.UsageReset
+			}
+		}
+		return resets
+	}
+	if !reflect.DeepEqual(usageResets(a.Config), usageResets(cfg)) {
+		changed = append(changed, "usage_reset")
+	}
+	assistants := func(cfg *config.Config) map[string]config.Passthrough {
+		targets := make(map[string]config.Passthrough)
+		for _, g := range cfg.Groups {
+			if g.Assistants.Provider != "" {
+				targets[g.Name] = g.Assistants
+			}
+		}
+		return targets
+	}
+	if !reflect.DeepEqual(assistants(a.Config), assistants(cfg)) {
+		changed = append(changed, "assistants")
+	}
+	return changed
+}
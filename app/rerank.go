@@ -0,0 +1,77 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"llm-router/client"
+	"llm-router/server"
+	"llm-router/usage"
+	"log/slog"
+)
+
+// HandleRerank routes a rerank request to the least used rerank model of its group
+func (a *App) HandleRerank(ctx context.Context, req server.RerankRequest, body []byte) ([]byte, error) {
+	req.Model = a.resolveAlias(req.Model)
+	provider, model, keyClient, baseURL, err := a.selectRerankClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	ctx = client.WithGroup(ctx, req.Model)
+	a.Logger.Info("Routing rerank request", slog.String("provider", provider), slog.String("model", model), slog.String("client_key", client.ClientKeyFromContext(ctx)), slog.String("tenant", client.TenantFromContext(ctx)))
+
+	resp, err := keyClient.Rerank(ctx, baseURL, model, body, int64(a.countRerankTokens(model, req)))
+	if err != nil {
+		a.Logger.Error("Rerank error", slog.Any("error", err))
+		return nil, err
+	}
+	return resp, nil
+}
+
+// selectRerankClient selects the provider, model, KeyClient, and provider base URL of a rerank request,
+// holding the configuration steady while it does
+func (a *App) selectRerankClient(ctx context.Context, req server.RerankRequest) (provider string, model string, keyClient *client.KeyClient, baseURL string, err error) {
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	group := a.findGroup(req.Model)
+	if group == nil || len(group.Models) == 0 {
+		return "", "", nil, "", fmt.Errorf("no models found for group: %s", req.Model)
+	}
+	if err := a.tenantAllowsGroup(ctx, group.Name); err != nil {
+		return "", "", nil, "", err
+	}
+	models, err := eligibleModels(group.Name, group.Models, []string{CapabilityRerank})
+	if err != nil {
+		return "", "", nil, "", err
+	}
+	if err := a.budgets.Exceeded(usage.Key{Group: group.Name}); err != nil {
+		return "", "", nil, "", err
+	}
+	if err := a.clientWithinBudget(ctx); err != nil {
+		return "", "", nil, "", err
+	}
+
+	provider, model, keyClient = a.selectClient(models, nil, client.TenantFromContext(ctx), nil)
+	if keyClient == nil {
+		return "", "", nil, "", a.noCandidateError(group.Name, models)
+	}
+	return provider, model, keyClient, a.clients[provider].BaseURL, nil
+}
+
+// countRerankTokens estimates the tokens of a rerank request, where the query is scored against every document
+func (a *App) countRerankTokens(model string, req server.RerankRequest) int {
+	query := a.countTokens(model, req.Query)
+	tokens := 0
+	for _, doc := range req.Documents {
+		var text string
+		if json.Unmarshal(doc, &text) != nil {
+			var obj struct {
+				Text string `json:"text"`
+			}
+			json.Unmarshal(doc, &obj)
+			text = obj.Text
+		}
+		tokens += query + a.countTokens(model, text)
+	}
+	return tokens
+}
@@ -0,0 +1,193 @@
+package app
+
+import (
+	"fmt"
+	"llm-router/config"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Usage reset schedules
+const (
+	ResetDaily   = "daily"
+	ResetMonthly = "monthly"
+	ResetRolling = "rolling"
+)
+
+// rollingWindowSteps is the number of steps a rolling window advances in, so that usage expires
+// at most a step later than the window length
+const rollingWindowSteps = 12
+
+// usagePeriodGrace is how long the shared usage counters of a window outlive it, for instances whose clocks
+// or syncs lag behind
+const usagePeriodGrace = time.Hour
+
+// resetSchedule computes when the usage of a provider's keys is reset
+type resetSchedule struct {
+	schedule string
+	hour     int
+	minute   int
+	day      int
+	location *time.Location
+	step     time.Duration
+
+	mutex sync.Mutex
+	// period is the end of the current usage window, zero before the first rotation
+	period time.Time
+}
+
+// parseResetSchedule validates a provider's reset configuration
+func parseResetSchedule(cfg config.UsageReset) (*resetSchedule, error) {
+	s := &resetSchedule{schedule: cfg.Schedule, day: max(cfg.Day, 1), location: time.UTC}
+	switch cfg.Schedule {
+	case ResetDaily, ResetMonthly:
+	case ResetRolling:
+		if cfg.Window <= 0 {
+			return nil, fmt.Errorf("rolling usage reset requires a window")
+		}
+		s.step = time.Duration(cfg.Window) * time.Second / rollingWindowSteps
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown usage reset schedule %q", cfg.Schedule)
+	}
+	if cfg.Time != "" {
+		t, err := time.Parse("15:04", cfg.Time)
+		if err != nil {
+			return nil, fmt.Errorf("invalid usage reset time %q", cfg.Time)
+		}
+		s.hour, s.minute = t.Hour(), t.Minute()
+	}
+	if cfg.TimeZone != "" {
+		location, err := time.LoadLocation(cfg.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid usage reset time zone %q: %w", cfg.TimeZone, err)
+		}
+		s.location = location
+	}
+	return s, nil
+}
+
+// next returns the first reset after t
+func (s *resetSchedule) next(t time.Time) time.Time {
+	if s.schedule == ResetRolling {
+		return t.Truncate(s.step).Add(s.step)
+	}
+	t = t.In(s.location)
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, s.hour, s.minute, 0, 0, s.location)
+	}
+	if s.schedule == ResetDaily {
+		reset := at(t.Year(), t.Month(), t.Day())
+		if !reset.After(t) {
+			reset = at(t.Year(), t.Month(), t.Day()+1)
+		}
+		return reset
+	}
+	monthly := func(year int, month time.Month) time.Time {
+		lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, s.location).Day()
+		return at(year, month, min(s.day, lastDay))
+	}
+	reset := monthly(t.Year(), t.Month())
+	if !reset.After(t) {
+		reset = monthly(t.Year(), t.Month()+1)
+	}
+	return reset
+}
+
+// windows returns the number of usage windows kept by the keys
+func (s *resetSchedule) windows() int {
+	if s.schedule == ResetRolling {
+		return rollingWindowSteps
+	}
+	return 1
+}
+
+// rotate starts the usage window current at now and returns the end of the previous one, zero on the
+// first rotation
+func (s *resetSchedule) rotate(now time.Time) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous := s.period
+	s.period = s.next(now)
+	return previous
+}
+
+// periods returns the ends of the usage windows kept, the current one first, or nil before the first
+// rotation. The ends identify the windows alike on every instance.
+func (s *resetSchedule) periods() []time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.period.IsZero() {
+		return nil
+	}
+	periods := make([]time.Time, s.windows())
+	for i := range periods {
+		periods[i] = s.period.Add(-time.Duration(i) * s.step)
+	}
+	return periods
+}
+
+// expiry returns when the usage of the window ending at period is no longer kept
+func (s *resetSchedule) expiry(period time.Time) time.Time {
+	return period.Add(time.Duration(s.windows()-1)*s.step + usagePeriodGrace)
+}
+
+// startUsageResets resets the usage of the keys of providers with a reset schedule
+func (a *App) startUsageResets() {
+	schedules := make(map[string]*resetSchedule)
+	for _, cfgProvider := range a.Config.Providers {
+		if cfgProvider.UsageReset.Schedule == "" {
+			continue
+		}
+		schedule, err := parseResetSchedule(cfgProvider.UsageReset)
+		if err != nil {
+			a.Logger.Error("Usage of the provider is never reset", slog.String("provider", cfgProvider.Name), slog.Any("error", err))
+			continue
+		}
+		if _, exists := a.clients[cfgProvider.Name]; !exists {
+			continue
+		}
+		schedules[cfgProvider.Name] = schedule
+		a.rotateUsage(cfgProvider.Name, schedule, time.Now())
+		go func() {
+			for {
+				time.Sleep(time.Until(schedule.next(time.Now())))
+				if schedule.schedule != ResetRolling {
+					a.Logger.Info("Resetting key usage", slog.String("provider", cfgProvider.Name))
+				}
+				a.rotateUsage(cfgProvider.Name, schedule, time.Now())
+			}
+		}()
+	}
+	a.reloadMutex.Lock()
+	a.resetSchedules = schedules
+	a.reloadMutex.Unlock()
+}
+
+// rotateUsage starts the usage window current at now for every key of a provider, as configured at the
+// time. Usage shared through Redis is kept per window, so the usage of expired windows is dropped from the
+// shared counters by all instances alike, including usage counted by instances that have stopped since.
+func (a *App) rotateUsage(provider string, schedule *resetSchedule, now time.Time) {
+	a.reloadMutex.RLock()
+	pClient, exists := a.clients[provider]
+	a.reloadMutex.RUnlock()
+	if !exists {
+		return
+	}
+	previous := schedule.rotate(now)
+	for _, kClient := range pClient.KeyClients {
+		if a.redis == nil || previous.IsZero() {
+			kClient.RotateUsage(schedule.windows())
+			continue
+		}
+		deltas := kClient.RotateSharedUsage(schedule.windows())
+		hash := periodHash(a.usageHash(provider, kClient), previous)
+		if err := addRedisUsage(a.redis, hash, deltas, schedule.expiry(previous)); err != nil {
+			a.Logger.Error("Failed to share the usage counted before the reset",
+				slog.String("provider", provider),
+				slog.String("key_id", providerKeyID(provider, kClient)),
+				slog.Any("error", err))
+		}
+	}
+}
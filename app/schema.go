@@ -0,0 +1,76 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"llm-router/client"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/sashabaranov/go-openai"
+)
+
+// compileSchema compiles the JSON Schema of a response_format, as of draft 2020-12 unless it declares
+// another draft with $schema. Only references within the schema are resolved.
+func compileSchema(schema any) (*jsonschema.Schema, error) {
+	encoded, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+	document, err := jsonschema.UnmarshalJSON(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("response_format.json", document); err != nil {
+		return nil, err
+	}
+	return compiler.Compile("response_format.json")
+}
+
+// validateResponseFormat checks that the assistant messages of a response conform to the
+// requested response_format: valid JSON for json_object, and the schema for json_schema.
+// Refusals are accepted as they are not meant to follow the format.
+func validateResponseFormat(format *openai.ChatCompletionResponseFormat, resp *client.ChatCompletionResponse) error {
+	if format == nil {
+		return nil
+	}
+
+	var schema *jsonschema.Schema
+	switch format.Type {
+	case openai.ChatCompletionResponseFormatTypeJSONObject:
+	case openai.ChatCompletionResponseFormatTypeJSONSchema:
+		if format.JSONSchema == nil || format.JSONSchema.Schema == nil {
+			return nil
+		}
+		// A schema that does not compile cannot be checked, and is left to the provider to reject
+		var err error
+		if schema, err = compileSchema(format.JSONSchema.Schema); err != nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	for _, choice := range resp.Choices {
+		if choice.Message.Refusal != "" {
+			continue
+		}
+		content := []byte(choice.Message.Content)
+		if schema == nil {
+			var obj map[string]any
+			if err := json.Unmarshal(content, &obj); err != nil {
+				return fmt.Errorf("choice %d is not a JSON object: %w", choice.Index, err)
+			}
+			continue
+		}
+		document, err := jsonschema.UnmarshalJSON(bytes.NewReader(content))
+		if err != nil {
+			return fmt.Errorf("choice %d is not valid JSON: %w", choice.Index, err)
+		}
+		if err := schema.Validate(document); err != nil {
+			return fmt.Errorf("choice %d does not match the response schema: %w", choice.Index, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"llm-router/config"
+	"llm-router/secrets"
+	"log/slog"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// newSecretsResolver creates the resolver of the secrets referenced by provider keys
+func newSecretsResolver(cfg config.Secrets) *secrets.Resolver {
+	return secrets.NewResolver(secrets.Options{
+		VaultAddress:       cfg.Vault.Address,
+		VaultToken:         cfg.Vault.Token,
+		AWSRegion:          cfg.AWS.Region,
+		AWSAccessKeyID:     cfg.AWS.AccessKeyID,
+		AWSSecretAccessKey: cfg.AWS.SecretAccessKey,
+		AWSSessionToken:    cfg.AWS.SessionToken,
+		AWSEndpoint:        cfg.AWS.Endpoint,
+		GCPAccessToken:     cfg.GCP.AccessToken,
+		KMSMasterKey:       cfg.Encryption.KMSMasterKey,
+		KMSEndpoint:        cfg.Encryption.KMSEndpoint,
+	})
+}
+
+// EncryptKey encrypts a provider key with the master key of the configuration's secrets, returning the
+// reference to use in its place
+func EncryptKey(cfg *config.Config, key string) (string, error) {
+	return newSecretsResolver(cfg.Secrets).Encrypt(context.Background(), key)
+}
+
+// resolveSecrets returns the configuration with the provider keys referencing secrets replaced by the secrets,
+// a copy when some keys do. Keys whose secrets cannot be resolved are left as references and the errors
+// returned together.
+func resolveSecrets(resolver *secrets.Resolver, cfg *config.Config) (*config.Config, error) {
+	if !hasSecretReferences(cfg) {
+		return cfg, nil
+	}
+	ctx := context.Background()
+	resolved := make(map[string]string)
+	var errs []error
+	resolve := func(keys []string) []string {
+		keys = slices.Clone(keys)
+		for i, key := range keys {
+			if !secrets.IsReference(key) {
+				continue
+			}
+			secret, done := resolved[key]
+			if !done {
+				ref, err := secrets.ParseReference(key)
+				if err == nil {
+					secret, err = resolver.Resolve(ctx, ref)
+				}
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				resolved[key] = secret
+			}
+			keys[i] = secret
+		}
+		return keys
+	}
+
+	applied := *cfg
+	applied.Providers = slices.Clone(cfg.Providers)
+	for i := range applied.Providers {
+		applied.Providers[i].APIKeys = resolve(applied.Providers[i].APIKeys)
+		applied.Providers[i].FreeAPIKeys = resolve(applied.Providers[i].FreeAPIKeys)
+	}
+	applied.Tenants = slices.Clone(cfg.Tenants)
+	for i := range applied.Tenants {
+		applied.Tenants[i].ProviderKeys = slices.Clone(applied.Tenants[i].ProviderKeys)
+		for j := range applied.Tenants[i].ProviderKeys {
+			applied.Tenants[i].ProviderKeys[j].APIKeys = resolve(applied.Tenants[i].ProviderKeys[j].APIKeys)
+		}
+	}
+	return &applied, errors.Join(errs...)
+}
+
+// hasSecretReferences reports whether some provider keys of the configuration reference secrets
+func hasSecretReferences(cfg *config.Config) bool {
+	for _, p := range cfg.Providers {
+		if slices.ContainsFunc(p.APIKeys, secrets.IsReference) || slices.ContainsFunc(p.FreeAPIKeys, secrets.IsReference) {
+			return true
+		}
+	}
+	for _, tenant := range cfg.Tenants {
+		for _, keys := range tenant.ProviderKeys {
+			if slices.ContainsFunc(keys.APIKeys, secrets.IsReference) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startSecretsRefresh resolves the secrets referenced by provider keys at every interval and reloads the
+// providers when they changed, e.g. after a key was rotated in its store
+func (a *App) startSecretsRefresh(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			a.refreshSecrets()
+		}
+	}()
+}
+
+// refreshSecrets resolves the secrets referenced by provider keys again, reloading the configuration with
+// the new keys when they changed
+func (a *App) refreshSecrets() {
+	a.reloading.Lock()
+	defer a.reloading.Unlock()
+	if a.loaded == nil {
+		return
+	}
+	refs := a.overlay.apply(a.loaded)
+	if !hasSecretReferences(refs) {
+		return
+	}
+	cfg, err := resolveSecrets(a.secrets, refs)
+	if err != nil {
+		a.Logger.Warn("Failed to refresh secrets, keeping the current keys", slog.Any("error", err))
+		return
+	}
+	if reflect.DeepEqual(cfg.Providers, a.Config.Providers) && reflect.DeepEqual(cfg.Tenants, a.Config.Tenants) {
+		return
+	}
+	a.Logger.Info("Provider keys changed in their secret stores, reloading")
+	if err := a.apply(cfg); err != nil {
+		a.reloadFailed(err)
+	}
+}
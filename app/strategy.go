@@ -0,0 +1,185 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"llm-router/client"
+	"llm-router/config"
+	"log/slog"
+	"math"
+	"net"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Routing strategies of groups
+const (
+	// StrategyBalanced balances requests across all models and keys by usage
+	StrategyBalanced = "balanced"
+	// StrategyCheapest routes requests to the cheapest model able to serve them, moving on to pricier
+	// models only while cheaper ones are rate limited or failing
+	StrategyCheapest = "cheapest"
+)
+
+// routesCheapest reports whether the group routes requests with the cheapest strategy
+func (a *App) routesCheapest(groupName string) bool {
+	group := a.findGroup(groupName)
+	return group != nil && group.Strategy == StrategyCheapest
+}
+
+// estimatedCost estimates the cost of a request served by a model: its prompt tokens at the input price and
+// its max_tokens, or as many tokens as the prompt when not set, at the output price
+func estimatedCost(m *Model, promptTokens int64, maxTokens int64) float64 {
+	completionTokens := maxTokens
+	if completionTokens == 0 {
+		completionTokens = promptTokens
+	}
+	return m.Price.Cost(client.UsageRecord{PromptTokens: promptTokens, CompletionTokens: completionTokens, TotalTokens: promptTokens + completionTokens})
+}
+
+// cheapestModels returns the models with the lowest estimated cost for the request among those with a key
+// available to the tenant, adding the rate limited keys of the models to excluded. When no model has an
+// available key, all models are returned for the caller to report why.
+func (a *App) cheapestModels(models []*Model, req openai.ChatCompletionRequest, excluded map[candidate]bool, tenant string) ([]*Model, map[candidate]bool) {
+	maxTokens := int64(req.MaxCompletionTokens)
+	if maxTokens == 0 {
+		maxTokens = int64(req.MaxTokens)
+	}
+	withoutRateLimited := make(map[candidate]bool, len(excluded))
+	for c := range excluded {
+		withoutRateLimited[c] = true
+	}
+
+	// Count once per encoding, only for models with a price
+	counts := make(map[string]int64)
+	cheapest := make([]*Model, 0, len(models))
+	minCost := math.Inf(1)
+	for _, m := range models {
+		available := false
+		if pClient, exists := a.clients[m.Provider]; exists && a.modelWithinBudget(m) {
+			for _, kClient := range pClient.KeyClients {
+				if kClient.RateLimited() {
+					withoutRateLimited[candidate{keyClient: kClient, model: m.Name}] = true
+					continue
+				}
+				available = available || a.keyAvailable(m, kClient, excluded, tenant)
+			}
+		}
+		if !available {
+			continue
+		}
+
+		// Models without a price are assumed to be the most expensive
+		cost := math.Inf(1)
+		if m.Price != (client.Price{}) {
+			encoding := encodingForModel(m.Name)
+			count, ok := counts[encoding]
+			if !ok {
+				count = int64(a.countPromptTokens(m.Name, req))
+				counts[encoding] = count
+			}
+			cost = estimatedCost(m, count, maxTokens)
+		}
+		switch {
+		case cost < minCost || len(cheapest) == 0:
+			minCost = cost
+			cheapest = append(cheapest[:0], m)
+		case cost == minCost:
+			cheapest = append(cheapest, m)
+		}
+	}
+
+	if len(cheapest) == 0 {
+		return models, excluded
+	}
+	return cheapest, withoutRateLimited
+}
+
+// escalates reports whether a failed request should move on to a pricier model: on rate limits, upstream
+// and authentication errors, and connection failures, but not on invalid requests, which no model would
+// accept either, or when the client went away
+func escalates(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return errorClass(err) != errorClassInvalidRequest
+}
+
+// retries returns the times a request is retried on another key or model after failing with the limits of
+// a provider: as many as configured, or when not configured, until no model is left with the cheapest strategy
+// and never otherwise
+func retries(limits config.Limits, cheapest bool) int {
+	switch {
+	case limits.Retries != nil:
+		return *limits.Retries
+	case cheapest:
+		return math.MaxInt
+	}
+	return 0
+}
+
+// attemptContext bounds the context of an attempt at a non-streaming request with a provider's request timeout
+func attemptContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// streamAttemptContext bounds the context of an attempt at a streaming request with a provider's request
+// timeout until the stream has started. started lifts the bound, reporting whether it expired already, and
+// cancel releases the context once the stream has ended.
+func streamAttemptContext(ctx context.Context, timeout time.Duration) (attemptCtx context.Context, started func() bool, cancel context.CancelFunc) {
+	attemptCtx, cancel = context.WithCancel(ctx)
+	if timeout <= 0 {
+		return attemptCtx, func() bool { return false }, cancel
+	}
+	timer := time.AfterFunc(timeout, cancel)
+	return attemptCtx, func() bool { return !timer.Stop() }, cancel
+}
+
+// retryAttempt reports whether a request moves on to another candidate after an attempt on a route failed
+// with err, streamed or not, counting the failures it retries: rate limited free keys are moved on from for
+// as long as free keys are left, and errors escalating or timeouts up to the retries of the provider's limits
+func (a *App) retryAttempt(ctx context.Context, stream bool, keyClient *client.KeyClient, route client.Route, err error, timedOut bool, failures *int, cheapest bool) bool {
+	if keyClient.Free && keyClient.RateLimited() {
+		// Move on to the next key, paid once no free key is left
+		a.Logger.WarnContext(ctx, "Free key rate limited", slog.String("provider", route.Provider), slog.String("key_id", route.KeyID), upstreamIDsAttr(client.UpstreamIDs(err)))
+		return true
+	}
+	if !escalates(err) && !timedOut {
+		return false
+	}
+	if *failures++; *failures > retries(a.providerLimits(route.Provider), cheapest) {
+		return false
+	}
+	// Move on to another key or model, the next cheapest one with the cheapest strategy
+	message := "Request failed, retrying"
+	if stream {
+		message = "Stream failed, retrying"
+	}
+	a.Logger.WarnContext(ctx, message, slog.String("provider", route.Provider), slog.String("model", route.Model), slog.Int("failures", *failures), slog.Any("error", err), upstreamIDsAttr(client.UpstreamIDs(err)))
+	return true
+}
+
+// isTimeout reports whether a request failed on a provider not responding in time
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// providerLimits returns the timeouts and retries of the requests to a provider
+func (a *App) providerLimits(name string) config.Limits {
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	if a.Config == nil {
+		return config.Limits{}
+	}
+	for _, p := range a.Config.Providers {
+		if p.Name == name {
+			return a.Config.ProviderLimits(p)
+		}
+	}
+	return a.Config.Limits
+}
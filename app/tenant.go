@@ -0,0 +1,72 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"llm-router/client"
+	"llm-router/config"
+	"llm-router/server"
+	"slices"
+)
+
+// Tenant is an isolated user of the router, see config.Tenant
+type Tenant struct {
+	Name string
+	// Groups the tenant may use, all groups when empty
+	Groups []string
+	// Providers with keys dedicated to the tenant, whose shared keys the tenant is not routed to
+	DedicatedProviders map[string]bool
+	// Names of the tenant's client keys
+	ClientKeys []string
+}
+
+// getTenants initializes the tenants by name based on the configuration
+func getTenants(cfg *config.Config) map[string]*Tenant {
+	tenants := make(map[string]*Tenant)
+	for _, cfgTenant := range cfg.Tenants {
+		tenant := &Tenant{
+			Name:               cfgTenant.Name,
+			Groups:             cfgTenant.Groups,
+			DedicatedProviders: make(map[string]bool),
+		}
+		for _, keys := range cfgTenant.ProviderKeys {
+			if len(keys.APIKeys) > 0 {
+				tenant.DedicatedProviders[keys.Provider] = true
+			}
+		}
+		for _, key := range cfgTenant.ClientKeys {
+			tenant.ClientKeys = append(tenant.ClientKeys, key.Name)
+		}
+		tenants[tenant.Name] = tenant
+	}
+	return tenants
+}
+
+// tenantAllowsGroup returns an error wrapping server.ErrGroupNotAllowed if the tenant of the context may not use the group
+func (a *App) tenantAllowsGroup(ctx context.Context, group string) error {
+	tenant, ok := a.tenants[client.TenantFromContext(ctx)]
+	if !ok || len(tenant.Groups) == 0 || slices.Contains(tenant.Groups, group) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", server.ErrGroupNotAllowed, group)
+}
+
+// keyServesTenant reports whether requests of a tenant, "" for clients outside of tenants, may be routed to a provider key.
+// Keys dedicated to a tenant only serve that tenant, which in turn does not use the shared keys of the provider.
+func (a *App) keyServesTenant(provider string, keyClient *client.KeyClient, tenant string) bool {
+	if keyClient.Tenant != "" {
+		return keyClient.Tenant == tenant
+	}
+	t, ok := a.tenants[tenant]
+	return !ok || !t.DedicatedProviders[provider]
+}
+
+// clientKeyTenant returns the tenant a client key belongs to, or "" if it belongs to none
+func (a *App) clientKeyTenant(name string) string {
+	for _, tenant := range a.tenants {
+		if slices.Contains(tenant.ClientKeys, name) {
+			return tenant.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+package app
+
+import (
+	"fmt"
+	"llm-router/client"
+	"llm-router/server"
+	"llm-router/utils"
+	"log/slog"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Tokenizer encodings used by the models of the registry
+const (
+	EncodingCL100k = "cl100k_base"
+	EncodingO200k  = "o200k_base"
+)
+
+// encodingForModel returns the tokenizer encoding of a model.
+// Models without a known encoding are approximated with cl100k_base.
+func encodingForModel(name string) string {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.ToLower(name)
+	for _, prefix := range []string{"gpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4"} {
+		if strings.HasPrefix(name, prefix) {
+			return EncodingO200k
+		}
+	}
+	return EncodingCL100k
+}
+
+// loadTokenizers loads the tiktoken encoding files configured under tokenizers, which take precedence over
+// the encodings embedded in the binary
+func (a *App) loadTokenizers() map[string]*utils.Tokenizer {
+	tokenizers := make(map[string]*utils.Tokenizer)
+	for encoding, path := range a.Config.Tokenizers {
+		tokenizer, err := utils.LoadTokenizer(encoding, path)
+		if err != nil {
+			a.Logger.Error("Failed to load tokenizer", slog.String("encoding", encoding), slog.String("path", path), slog.Any("error", err))
+			continue
+		}
+		tokenizers[encoding] = tokenizer
+	}
+	return tokenizers
+}
+
+// tokenizerFor returns the tokenizer of a model, the configured or else the embedded one of its encoding, or
+// nil if the encoding is neither configured nor embedded
+func (a *App) tokenizerFor(model string) *utils.Tokenizer {
+	encoding := encodingForModel(model)
+	if tokenizer, ok := a.tokenizers[encoding]; ok {
+		return tokenizer
+	}
+	return utils.EmbeddedTokenizer(encoding)
+}
+
+// countTokens counts the tokens of a text for a model, estimating them without a tokenizer
+func (a *App) countTokens(model string, text string) int {
+	if tokenizer := a.tokenizerFor(model); tokenizer != nil {
+		return tokenizer.Count(text)
+	}
+	return utils.EstimateTokens(text)
+}
+
+// countPromptTokens counts the prompt tokens of a request for a model,
+// including the few tokens of formatting added around each message and the images
+func (a *App) countPromptTokens(model string, req openai.ChatCompletionRequest) int {
+	return a.countTokens(model, client.PromptText(req)) + int(client.PromptOverheadTokens(req))
+}
+
+// fittingModels returns the models whose context window fits the request's prompt and maximum
+// completion length. Models with an unknown context window are assumed to fit.
+func (a *App) fittingModels(groupName string, models []*Model, req openai.ChatCompletionRequest) ([]*Model, error) {
+	maxTokens := req.MaxCompletionTokens
+	if maxTokens == 0 {
+		maxTokens = req.MaxTokens
+	}
+
+	// Count once per encoding, only when some model's context window is known
+	counts := make(map[string]int)
+	fitting := make([]*Model, 0, len(models))
+	needed := 0
+	for _, m := range models {
+		if m.ContextWindow == 0 {
+			fitting = append(fitting, m)
+			continue
+		}
+		encoding := encodingForModel(m.Name)
+		count, ok := counts[encoding]
+		if !ok {
+			count = a.countPromptTokens(m.Name, req)
+			counts[encoding] = count
+		}
+		needed = count + maxTokens
+		if int64(needed) <= m.ContextWindow {
+			fitting = append(fitting, m)
+		}
+	}
+
+	if len(fitting) == 0 {
+		return nil, fmt.Errorf("request of about %d tokens exceeds the context window of every model in group %s", needed, groupName)
+	}
+	return fitting, nil
+}
+
+// modelForTokenizing returns the model whose tokenizer is used for a group or model name
+func (a *App) modelForTokenizing(name string) (string, int64) {
+	name = a.resolveAlias(name)
+	a.reloadMutex.RLock()
+	defer a.reloadMutex.RUnlock()
+	for _, group := range a.Groups {
+		if group.Name == name && len(group.Models) > 0 {
+			return group.Models[0].Name, group.ContextWindow()
+		}
+	}
+	if meta, ok := lookupModelMeta(name); ok {
+		return name, meta.ContextWindow
+	}
+	return name, 0
+}
+
+// HandleTokenize tokenizes a prompt or counts the prompt tokens of chat messages
+func (a *App) HandleTokenize(req server.TokenizeRequest) (*server.TokenizeResponse, error) {
+	model, contextWindow := a.modelForTokenizing(req.Model)
+	resp := &server.TokenizeResponse{
+		Model:       req.Model,
+		MaxModelLen: contextWindow,
+	}
+
+	if len(req.Messages) > 0 {
+		resp.Count = a.countPromptTokens(model, openai.ChatCompletionRequest{Messages: req.Messages})
+		resp.Estimated = a.tokenizerFor(model) == nil
+		return resp, nil
+	}
+
+	tokenizer := a.tokenizerFor(model)
+	if tokenizer == nil {
+		resp.Count = utils.EstimateTokens(req.Prompt)
+		resp.Estimated = true
+		return resp, nil
+	}
+	resp.Tokens = tokenizer.Encode(req.Prompt)
+	resp.Count = len(resp.Tokens)
+	return resp, nil
+}
+
+// HandleDetokenize converts token IDs back into text
+func (a *App) HandleDetokenize(req server.DetokenizeRequest) (*server.DetokenizeResponse, error) {
+	model, _ := a.modelForTokenizing(req.Model)
+	tokenizer := a.tokenizerFor(model)
+	if tokenizer == nil {
+		return nil, fmt.Errorf("no tokenizer embedded or configured for encoding %s of model %s", encodingForModel(model), req.Model)
+	}
+	prompt, err := tokenizer.Decode(req.Tokens)
+	if err != nil {
+		return nil, err
+	}
+	return &server.DetokenizeResponse{Model: req.Model, Prompt: prompt}, nil
+}
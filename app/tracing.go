@@ -0,0 +1,42 @@
+package app
+
+import (
+	"llm-router/client"
+	"llm-router/tracing"
+	"log/slog"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// startTracing starts exporting the spans of requests to the configured collector, or returns nil when
+// tracing is disabled
+func (a *App) startTracing() *tracing.Tracer {
+	cfg := a.Config.Tracing
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	logger := a.componentLogger(logServer)
+	tracer, err := tracing.NewTracer(tracing.Options{
+		Endpoint:    cfg.Endpoint,
+		Headers:     cfg.Headers,
+		ServiceName: cfg.ServiceName,
+		SampleRatio: cfg.SampleRatio,
+		OnError: func(err error, spans int) {
+			logger.Error("Failed to export spans", slog.String("endpoint", cfg.Endpoint), slog.Int("spans", spans), slog.Any("error", err))
+		},
+	})
+	if err != nil {
+		logger.Error("Failed to start tracing", slog.String("endpoint", cfg.Endpoint), slog.Any("error", err))
+		return nil
+	}
+	return tracer
+}
+
+// routeAttributes describe the route of a request or attempt in its span
+func routeAttributes(route client.Route) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("llm_router.provider", route.Provider),
+		attribute.String("llm_router.model", route.Model),
+		attribute.String("llm_router.key_alias", route.KeyID),
+	}
+}
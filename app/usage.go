@@ -0,0 +1,63 @@
+package app
+
+import (
+	"llm-router/client"
+	"llm-router/usage"
+	"log/slog"
+	"time"
+)
+
+// usageSaveInterval is the interval at which the usage history is persisted
+const usageSaveInterval = 30 * time.Second
+
+// loadUsageStore loads the usage history from the configured file, falling back to an in-memory store
+func (a *App) loadUsageStore() *usage.Store {
+	store, err := usage.NewStore(a.Config.UsageFile)
+	if err != nil {
+		a.Logger.Error("Failed to load usage history, starting empty", slog.String("path", a.Config.UsageFile), slog.Any("error", err))
+		store, _ = usage.NewStore("")
+	}
+	return store
+}
+
+// usageRecorder returns the callback recording the usage of a provider key, identified by its hash, in the
+// usage history
+func (a *App) usageRecorder(provider string, keyHash string) func(record client.UsageRecord) {
+	return func(record client.UsageRecord) {
+		key := usage.Key{Group: record.Group, ClientKey: record.ClientKey, Tenant: record.Tenant, User: record.User, Provider: provider, KeyHash: keyHash, Model: record.Model}
+		entry := a.usage.Record(key, usage.Counts{
+			Requests:         record.Requests,
+			PromptTokens:     record.PromptTokens,
+			CompletionTokens: record.CompletionTokens,
+			ReasoningTokens:  record.ReasoningTokens,
+			TotalTokens:      record.TotalTokens,
+			Cost:             record.Cost,
+		})
+		a.budgets.Record(entry)
+		if a.metrics != nil {
+			a.metrics.record(provider, keyHash, record)
+		}
+		if record.ClientKey != "" && a.Server != nil {
+			a.Server.RecordClientTokens(record.ClientKey, record.TotalTokens)
+		}
+	}
+}
+
+// startUsagePersistence saves the usage history in the background at the given interval, until shutdown
+func (a *App) startUsagePersistence(interval time.Duration) {
+	a.usageSaves = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := a.usage.Save(); err != nil {
+					a.Logger.Error("Failed to save usage history", slog.Any("error", err))
+				}
+			case <-a.usageSaves:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,727 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"llm-router/client"
+	"llm-router/config"
+	"llm-router/kafka"
+	"llm-router/secrets"
+	"llm-router/usage"
+	"log/slog"
+	"maps"
+	"net"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Problem is an issue found in a configuration
+type Problem struct {
+	// Path locates the setting, e.g. groups[0].models[1].provider
+	Path    string
+	Message string
+	// Warning is set for settings that are valid but likely a mistake
+	Warning bool
+}
+
+func (p Problem) String() string {
+	severity := "error"
+	if p.Warning {
+		severity = "warning"
+	}
+	return fmt.Sprintf("%s: %s: %s", severity, p.Path, p.Message)
+}
+
+// HasErrors reports whether some of the problems are errors rather than warnings
+func HasErrors(problems []Problem) bool {
+	return slices.ContainsFunc(problems, func(p Problem) bool { return !p.Warning })
+}
+
+// problemsError joins the errors among the problems into one
+func problemsError(problems []Problem) error {
+	messages := make([]string, 0, len(problems))
+	for _, p := range problems {
+		if !p.Warning {
+			messages = append(messages, p.String())
+		}
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// problemWarnings returns the warnings among the problems
+func problemWarnings(problems []Problem) []string {
+	var warnings []string
+	for _, p := range problems {
+		if p.Warning {
+			warnings = append(warnings, p.String())
+		}
+	}
+	return warnings
+}
+
+// logProblems logs the problems found in the configuration
+func (a *App) logProblems(problems []Problem) {
+	for _, p := range problems {
+		level := slog.LevelError
+		if p.Warning {
+			level = slog.LevelWarn
+		}
+		a.Logger.Log(context.Background(), level, "Configuration problem", slog.String("path", p.Path), slog.String("problem", p.Message))
+	}
+}
+
+// problems collects the problems found in a configuration
+type problems []Problem
+
+func (ps *problems) errorf(path string, format string, args ...any) {
+	*ps = append(*ps, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (ps *problems) warnf(path string, format string, args ...any) {
+	*ps = append(*ps, Problem{Path: path, Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+// ValidateConfig checks a configuration for problems that would otherwise only surface when requests are
+// routed, e.g. models of undefined providers, and returns all of them
+func ValidateConfig(cfg *config.Config) []Problem {
+	var ps problems
+	providers := make(map[string]config.Provider)
+	for i, p := range cfg.Providers {
+		path := fmt.Sprintf("providers[%d]", i)
+		if p.Name == "" {
+			ps.errorf(path+".name", "provider name is required")
+		} else if _, exists := providers[p.Name]; exists {
+			ps.errorf(path+".name", "duplicate provider name %q", p.Name)
+		} else {
+			providers[p.Name] = p
+		}
+		if base, err := url.Parse(p.BaseURL); p.BaseURL == "" {
+			ps.errorf(path+".base_url", "base_url is required")
+		} else if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+			ps.errorf(path+".base_url", "base_url %q is not an http or https URL", p.BaseURL)
+		}
+		keys := len(p.APIKeys) + len(p.FreeAPIKeys)
+		for _, tenant := range cfg.Tenants {
+			for _, tenantKeys := range tenant.ProviderKeys {
+				if tenantKeys.Provider == p.Name {
+					keys += len(tenantKeys.APIKeys)
+				}
+			}
+		}
+		if keys == 0 {
+			ps.errorf(path+".api_keys", "provider %q has no API keys", p.Name)
+		}
+		validateKeys(&ps, path+".api_keys", p.APIKeys)
+		validateKeys(&ps, path+".free_api_keys", p.FreeAPIKeys)
+		if p.UsageReset != (config.UsageReset{}) {
+			if _, err := parseResetSchedule(p.UsageReset); err != nil {
+				ps.errorf(path+".usage_reset", "%v", err)
+			}
+		}
+		validateBudgets(&ps, path+".budgets", p.Budgets)
+		validateBudgets(&ps, path+".key_budgets", p.KeyBudgets)
+		if p.ErrorRateThreshold < 0 || p.ErrorRateThreshold > 1 {
+			ps.errorf(path+".error_rate_threshold", "error_rate_threshold must be between 0 and 1")
+		}
+		for j, pattern := range p.Models {
+			if pattern == "" {
+				ps.errorf(fmt.Sprintf("%s.models[%d]", path, j), "model pattern is empty")
+			}
+		}
+	}
+
+	groups := make(map[string]bool)
+	if len(cfg.Groups) == 0 {
+		ps.errorf("groups", "no groups are configured, so no request can be routed")
+	}
+	templates := make(map[string]bool)
+	for i, template := range cfg.GroupTemplates {
+		path := fmt.Sprintf("group_templates[%d].name", i)
+		if template.Name == "" {
+			ps.errorf(path, "group template name is required")
+		} else if templates[template.Name] {
+			ps.errorf(path, "duplicate group template name %q", template.Name)
+		}
+		templates[template.Name] = true
+	}
+	for i, g := range cfg.Groups {
+		path := fmt.Sprintf("groups[%d]", i)
+		if g.Name == "" {
+			ps.errorf(path+".name", "group name is required")
+		} else if groups[g.Name] {
+			ps.errorf(path+".name", "duplicate group name %q", g.Name)
+		}
+		groups[g.Name] = true
+		if len(g.Models) == 0 {
+			ps.errorf(path+".models", "group %q has no models", g.Name)
+		}
+		unweighted := len(g.Models) > 1 && !slices.ContainsFunc(g.Models, func(m config.Model) bool { return m.Weight != 0 })
+		if unweighted {
+			ps.warnf(path+".models", "all models of group %q have weight 0, which routes every request to the first one available", g.Name)
+		}
+		if len(g.Models) > 1 && groupKeys(g, providers) == 1 {
+			ps.warnf(path+".models", "all models of group %q are served by the same API key, leaving none to fall back on", g.Name)
+		}
+		for j, m := range g.Models {
+			modelPath := fmt.Sprintf("%s.models[%d]", path, j)
+			if m.Provider == "" {
+				ps.errorf(modelPath+".provider", "provider is required")
+			} else if _, exists := providers[m.Provider]; !exists {
+				ps.errorf(modelPath+".provider", "model %q references undefined provider %q", m.Name, m.Provider)
+			}
+			if m.Name == "" {
+				ps.errorf(modelPath+".name", "model name is required")
+			}
+			switch {
+			case m.Weight < 0:
+				ps.errorf(modelPath+".weight", "weight must not be negative")
+			case m.Weight == 0 && len(g.Models) > 1 && !unweighted:
+				ps.warnf(modelPath+".weight", "weight 0 routes every request of group %q to model %q while it is available", g.Name, m.Name)
+			}
+			if m.InputPrice < 0 || m.OutputPrice < 0 || m.CachedInputPrice < 0 {
+				ps.errorf(modelPath, "prices must not be negative")
+			}
+			if m.ContextWindow < 0 || m.DailyTokens < 0 {
+				ps.errorf(modelPath, "context_window and daily_tokens must not be negative")
+			}
+		}
+		validateChoice(&ps, path+".balance_on", g.BalanceOn, client.BalanceTotal, client.BalancePrompt, client.BalanceCompletion)
+		validateChoice(&ps, path+".key_policy", g.KeyPolicy, KeyPolicyBalanced, KeyPolicyFreeFirst)
+		validateChoice(&ps, path+".strategy", g.Strategy, StrategyBalanced, StrategyCheapest)
+		if g.MaxRequestCost < 0 {
+			ps.errorf(path+".max_request_cost", "max_request_cost must not be negative")
+		}
+		if g.Defaults.MaxTokens < 0 {
+			ps.errorf(path+".defaults.max_tokens", "max_tokens must not be negative")
+		}
+		if g.Defaults.Temperature < 0 || g.Defaults.Temperature > 2 {
+			ps.errorf(path+".defaults.temperature", "temperature must be between 0 and 2")
+		}
+		validateBudgets(&ps, path+".budgets", g.Budgets)
+		validatePassthrough(&ps, path+".assistants", g.Assistants, providers)
+	}
+
+	lintProviders(&ps, cfg)
+
+	for _, alias := range slices.Sorted(maps.Keys(cfg.Aliases)) {
+		group, path := cfg.Aliases[alias], "aliases."+alias
+		if !groups[group] {
+			ps.errorf(path, "alias %q maps to undefined group %q", alias, group)
+		}
+		if groups[alias] {
+			ps.warnf(path, "alias %q shadows the group of the same name", alias)
+		}
+	}
+
+	clientKeys := make(map[string]bool)
+	if cfg.APIKey != "" {
+		clientKeys[cfg.APIKey] = true
+	}
+	validateClientKeys := func(path string, keys []config.ClientKey) {
+		for i, key := range keys {
+			keyPath := fmt.Sprintf("%s[%d]", path, i)
+			if key.Name == "" {
+				ps.errorf(keyPath+".name", "client key name is required")
+			}
+			if key.Key == "" {
+				ps.errorf(keyPath+".key", "client key %q has no key", key.Name)
+			} else if clientKeys[key.Key] {
+				ps.errorf(keyPath+".key", "client key %q reuses a key accepted for another client", key.Name)
+			}
+			clientKeys[key.Key] = true
+			validateBudgets(&ps, keyPath+".budgets", key.Budgets)
+		}
+	}
+	validateClientKeys("client_keys", cfg.ClientKeys)
+	tenants := make(map[string]bool)
+	for i, tenant := range cfg.Tenants {
+		path := fmt.Sprintf("tenants[%d]", i)
+		if tenant.Name == "" {
+			ps.errorf(path+".name", "tenant name is required")
+		} else if tenants[tenant.Name] {
+			ps.errorf(path+".name", "duplicate tenant name %q", tenant.Name)
+		}
+		tenants[tenant.Name] = true
+		validateClientKeys(path+".client_keys", tenant.ClientKeys)
+		for j, group := range tenant.Groups {
+			if !groups[group] {
+				ps.errorf(fmt.Sprintf("%s.groups[%d]", path, j), "tenant %q allows undefined group %q", tenant.Name, group)
+			}
+		}
+		for j, keys := range tenant.ProviderKeys {
+			keysPath := fmt.Sprintf("%s.provider_keys[%d]", path, j)
+			if _, exists := providers[keys.Provider]; !exists {
+				ps.errorf(keysPath+".provider", "tenant %q has keys of undefined provider %q", tenant.Name, keys.Provider)
+			}
+			validateKeys(&ps, keysPath+".api_keys", keys.APIKeys)
+		}
+		validateBudgets(&ps, path+".budgets", tenant.Budgets)
+	}
+
+	validatePassthrough(&ps, "batch", cfg.Batch, providers)
+	validatePassthrough(&ps, "files", cfg.Files, providers)
+	if cfg.MaxRequestCost < 0 {
+		ps.errorf("max_request_cost", "max_request_cost must not be negative")
+	}
+	if _, exists := logLevels[cfg.LogLevel]; cfg.LogLevel != "" && !exists {
+		ps.errorf("log_level", "%q is not one of debug, info, warn, or error", cfg.LogLevel)
+	}
+	if cfg.AdminPort != 0 && cfg.AdminPort == cfg.Port {
+		ps.errorf("admin_port", "admin_port must differ from port")
+	}
+	if cfg.AdminListen != "" {
+		if _, _, err := net.SplitHostPort(cfg.AdminListen); err != nil {
+			ps.errorf("admin_listen", "%q is not a host:port address", cfg.AdminListen)
+		} else if cfg.AdminListen == cfg.Listen {
+			ps.errorf("admin_listen", "admin_listen must differ from listen")
+		}
+	}
+	if (cfg.AdminListen != "" || cfg.AdminPort != 0) && cfg.AdminAPIKey == "" {
+		ps.warnf("admin_api_key", "the admin listener serves nothing without admin_api_key")
+	}
+	if cfg.Features.EnableProfiling && cfg.AdminAPIKey == "" {
+		ps.warnf("features.enable_profiling", "profiles are not served without admin_api_key")
+	}
+	validateChoice(&ps, "logging.format", cfg.Logging.Format, "text", "json")
+	if cfg.Logging.MaxSize < 0 || cfg.Logging.MaxBackups < 0 {
+		ps.errorf("logging", "max_size and max_backups must not be negative")
+	}
+	if cfg.LedgerRetention < 0 {
+		ps.errorf("ledger_retention", "ledger_retention must not be negative")
+	}
+	for component, level := range cfg.Logging.Components {
+		path := "logging.components." + component
+		if !slices.Contains(logComponents, component) {
+			ps.errorf(path, "unknown component %q, expected one of %q", component, logComponents)
+		} else if _, exists := logLevels[level]; !exists {
+			ps.errorf(path, "%q is not one of debug, info, warn, or error", level)
+		}
+	}
+	if access := cfg.Logging.AccessLog; access.File != "" {
+		if !access.Enabled {
+			ps.warnf("logging.access_log.file", "the access log is only written with enabled set")
+		} else if filepath.Clean(access.File) == filepath.Clean(cfg.Logging.File) {
+			ps.errorf("logging.access_log.file", "the access log must be written to another file than the logs")
+		}
+	}
+	if cfg.Logging.Sampling.Ratio < 0 || cfg.Logging.Sampling.Ratio > 1 {
+		ps.errorf("logging.sampling.ratio", "ratio must be between 0 and 1")
+	}
+	if cfg.Logging.Sampling.SlowThreshold < 0 {
+		ps.errorf("logging.sampling.slow_threshold", "slow_threshold must not be negative")
+	}
+	if slow := cfg.Logging.SlowRequests; slow.Duration < 0 || slow.TimeToFirstToken < 0 {
+		ps.errorf("logging.slow_requests", "duration and time_to_first_token must not be negative")
+	}
+	if prompts := cfg.Logging.Prompts; prompts.Enabled && prompts.MaxLength <= 0 {
+		ps.errorf("logging.prompts.max_length", "max_length must be positive when prompts are logged")
+	}
+	for field, name := range cfg.Logging.FieldNames {
+		if name == "" {
+			ps.errorf("logging.field_names."+field, "field name is empty")
+		}
+	}
+	if cfg.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+			ps.errorf("listen", "%q is not a host:port address", cfg.Listen)
+		}
+		if cfg.UnixSocket.Path != "" {
+			ps.errorf("listen", "listen and unix_socket must not both be set")
+		}
+	}
+	if acme := cfg.ACME; len(acme.Domains) > 0 {
+		if cfg.TLSCert != "" || cfg.TLSKey != "" {
+			ps.errorf("acme", "acme and tls_cert must not both be set")
+		}
+		if acme.CacheDir == "" {
+			ps.errorf("acme.cache_dir", "cache_dir is required, or certificates are requested again on every restart")
+		}
+		for i, domain := range acme.Domains {
+			if domain == "" || strings.ContainsAny(domain, ":/ ") {
+				ps.errorf(fmt.Sprintf("acme.domains[%d]", i), "%q is not a domain name", domain)
+			}
+		}
+		if acme.DirectoryURL != "" {
+			if directory, err := url.Parse(acme.DirectoryURL); err != nil || directory.Scheme != "https" || directory.Host == "" {
+				ps.errorf("acme.directory_url", "directory_url %q is not an https URL", acme.DirectoryURL)
+			}
+		}
+		if acme.HTTPListen != "" {
+			if _, _, err := net.SplitHostPort(acme.HTTPListen); err != nil {
+				ps.errorf("acme.http_listen", "%q is not a host:port address", acme.HTTPListen)
+			}
+		} else if !servesHTTPSOn443(cfg) {
+			ps.warnf("acme", "no HTTPS listener is on port 443, where the certificate authority connects for the TLS-ALPN-01 challenge; forward port 443 to the router or set http_listen to answer the HTTP-01 challenge on port 80")
+		}
+	} else if acme.HTTPListen != "" {
+		ps.warnf("acme.http_listen", "http_listen has no effect without domains")
+	}
+	if cfg.HTTP2.MaxConcurrentStreams < 0 {
+		ps.errorf("http2.max_concurrent_streams", "max_concurrent_streams must not be negative")
+	}
+	if cfg.ServerTimeouts.ReadHeaderTimeout < 0 {
+		ps.errorf("server_timeouts.read_header_timeout", "read_header_timeout must not be negative")
+	}
+	if cfg.ServerTimeouts.WriteTimeout < 0 {
+		ps.errorf("server_timeouts.write_timeout", "write_timeout must not be negative")
+	}
+	if cfg.ServerTimeouts.IdleTimeout < 0 {
+		ps.errorf("server_timeouts.idle_timeout", "idle_timeout must not be negative")
+	}
+	if cfg.ServerTimeouts.ShutdownTimeout < 0 {
+		ps.errorf("server_timeouts.shutdown_timeout", "shutdown_timeout must not be negative")
+	}
+	certificate := cfg.TLSCert != "" || len(cfg.ACME.Domains) > 0
+	plain := !certificate
+	if len(cfg.Listeners) > 0 {
+		plain = slices.ContainsFunc(cfg.Listeners, func(l config.Listener) bool { return !l.TLS })
+	}
+	if cfg.HTTP2.H2C && !plain {
+		ps.warnf("http2.h2c", "h2c has no effect when HTTPS is served")
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		ps.errorf("tls_cert", "tls_cert and tls_key must both be set")
+	} else if cfg.TLSCert != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey); err != nil {
+			ps.errorf("tls_cert", "%v", err)
+		}
+	}
+	validateListeners(&ps, cfg)
+	if cfg.UnixSocket.Mode != "" {
+		if _, err := parseSocketMode(cfg.UnixSocket.Mode); err != nil {
+			ps.errorf("unix_socket.mode", "%v", err)
+		}
+		if cfg.UnixSocket.Path == "" {
+			ps.errorf("unix_socket.path", "path is required")
+		}
+	}
+	if cfg.Tracing.Endpoint != "" {
+		if endpoint, err := url.Parse(cfg.Tracing.Endpoint); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			ps.errorf("tracing.endpoint", "endpoint %q is not an http or https URL", cfg.Tracing.Endpoint)
+		}
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		ps.errorf("tracing.sample_ratio", "sample_ratio must be between 0 and 1")
+	}
+	if alerts := cfg.ErrorRateAlerts; alerts.Threshold < 0 || alerts.Threshold > 1 {
+		ps.errorf("error_rate_alerts.threshold", "threshold must be between 0 and 1")
+	} else if alerts.Window < 0 || alerts.MinRequests < 0 {
+		ps.errorf("error_rate_alerts", "window and min_requests must not be negative")
+	}
+	if cfg.StatsD.Address != "" {
+		if _, _, err := net.SplitHostPort(cfg.StatsD.Address); err != nil {
+			ps.errorf("statsd.address", "%q is not a host:port address", cfg.StatsD.Address)
+		}
+	}
+	if cfg.StatsD.FlushInterval < 0 {
+		ps.errorf("statsd.flush_interval", "flush_interval must not be negative")
+	}
+	for i, eventType := range cfg.LifecycleEvents.Types {
+		validateChoice(&ps, fmt.Sprintf("lifecycle_events.types[%d]", i), eventType, lifecycleEventTypes...)
+	}
+	if len(cfg.LifecycleEvents.Types) > 0 && len(cfg.LifecycleEvents.Webhooks) == 0 {
+		ps.warnf("lifecycle_events.types", "no event is posted without webhooks")
+	}
+	if len(cfg.UsageEvents.Kafka.Brokers) > 0 && cfg.UsageEvents.Kafka.Topic == "" {
+		ps.errorf("usage_events.kafka.topic", "topic is required with brokers")
+	}
+	validateChoice(&ps, "usage_events.kafka.sasl.mechanism", cfg.UsageEvents.Kafka.SASL.Mechanism, kafka.SASLPlain, kafka.SASLScramSHA256, kafka.SASLScramSHA512)
+	validateCapture(&ps, cfg)
+	for i, entry := range cfg.TrustedProxies {
+		if entry == "unix" {
+			continue
+		}
+		if _, err := parseTrustedProxy(entry); err != nil {
+			ps.errorf(fmt.Sprintf("trusted_proxies[%d]", i), "%v", err)
+		}
+	}
+	if cfg.ClientIPRPM < 0 {
+		ps.errorf("client_ip_rpm", "client_ip_rpm must not be negative")
+	}
+	validateCORS(&ps, cfg.CORS)
+	validateCompressionLevels(&ps, "compression.levels", cfg.Compression.Levels)
+	validateCompressionLevels(&ps, "compression.stream_levels", cfg.Compression.StreamLevels)
+	if cfg.Compression.MinSize < 0 {
+		ps.errorf("compression.min_size", "min_size must not be negative")
+	}
+	if cfg.Secrets.RefreshInterval < 0 {
+		ps.errorf("secrets.refresh_interval", "refresh_interval must not be negative")
+	}
+	if cfg.Limits.MaxBodySize < 0 {
+		ps.errorf("limits.max_body_size", "max_body_size must not be negative")
+	}
+	if cfg.Limits.MaxUploadSize < 0 {
+		ps.errorf("limits.max_upload_size", "max_upload_size must not be negative")
+	}
+	validateLimits(&ps, "limits", cfg.Limits)
+	for i, p := range cfg.Providers {
+		// Only the provider's own limits, the global ones being checked above
+		own := (&config.Config{}).ProviderLimits(p)
+		validateLimits(&ps, fmt.Sprintf("providers[%d].limits", i), own)
+	}
+	return ps
+}
+
+// groupKeys counts the shared and free API keys of the providers of a group's models
+func groupKeys(g config.Group, providers map[string]config.Provider) int {
+	keys := 0
+	seen := make(map[string]bool)
+	for _, m := range g.Models {
+		if p, exists := providers[m.Provider]; exists && !seen[m.Provider] {
+			seen[m.Provider] = true
+			keys += len(p.APIKeys) + len(p.FreeAPIKeys)
+		}
+	}
+	return keys
+}
+
+// lintProviders warns of providers that no request can be routed to and of API keys shared by providers,
+// whose usage is then tracked and limited apart although the upstream counts it together
+func lintProviders(ps *problems, cfg *config.Config) {
+	referenced := make(map[string]bool)
+	for _, g := range cfg.Groups {
+		for _, m := range g.Models {
+			referenced[m.Provider] = true
+		}
+		referenced[g.Assistants.Provider] = true
+	}
+	referenced[cfg.Batch.Provider] = true
+	referenced[cfg.Files.Provider] = true
+
+	owners := make(map[string]string)
+	for i, p := range cfg.Providers {
+		path := fmt.Sprintf("providers[%d]", i)
+		if p.Name != "" && !referenced[p.Name] && len(p.Models) == 0 {
+			ps.warnf(path+".name", "provider %q is referenced by no group, so no request is routed to it", p.Name)
+		}
+		check := func(keysPath string, keys []string) {
+			for j, key := range keys {
+				if key == "" {
+					continue
+				}
+				if owner, exists := owners[key]; exists && owner != p.Name {
+					ps.warnf(fmt.Sprintf("%s[%d]", keysPath, j), "API key is also a key of provider %q", owner)
+				} else if !exists {
+					owners[key] = p.Name
+				}
+			}
+		}
+		check(path+".api_keys", p.APIKeys)
+		check(path+".free_api_keys", p.FreeAPIKeys)
+	}
+}
+
+// validateKeys reports empty API keys, e.g. from an unset environment variable, and malformed references to
+// secrets
+func validateKeys(ps *problems, path string, keys []string) {
+	for i, key := range keys {
+		if key == "" {
+			ps.errorf(fmt.Sprintf("%s[%d]", path, i), "API key is empty")
+		} else if secrets.IsReference(key) {
+			if _, err := secrets.ParseReference(key); err != nil {
+				ps.errorf(fmt.Sprintf("%s[%d]", path, i), "%v", err)
+			}
+		}
+	}
+}
+
+// validateChoice reports a setting that is neither empty nor one of the allowed values
+func validateChoice(ps *problems, path string, value string, allowed ...string) {
+	if value != "" && !slices.Contains(allowed, value) {
+		ps.errorf(path, "%q is not one of %q", value, allowed)
+	}
+}
+
+// validateBudgets reports budgets with an unknown period or negative limits
+func validateBudgets(ps *problems, path string, budgets []config.Budget) {
+	for i, b := range budgets {
+		budgetPath := fmt.Sprintf("%s[%d]", path, i)
+		validateChoice(ps, budgetPath+".period", b.Period, usage.PeriodDay, usage.PeriodMonth)
+		if b.Period == "" {
+			ps.errorf(budgetPath+".period", "period is required")
+		}
+		if b.Tokens < 0 || b.Cost < 0 {
+			ps.errorf(budgetPath, "limits must not be negative")
+		}
+	}
+}
+
+// validatePassthrough reports a passthrough to an undefined provider or key
+func validatePassthrough(ps *problems, path string, p config.Passthrough, providers map[string]config.Provider) {
+	if p.Provider == "" {
+		return
+	}
+	provider, exists := providers[p.Provider]
+	if !exists {
+		ps.errorf(path+".provider", "undefined provider %q", p.Provider)
+		return
+	}
+	if p.KeyIndex < 0 || p.KeyIndex >= len(provider.APIKeys)+len(provider.FreeAPIKeys) {
+		ps.errorf(path+".key_index", "provider %q has no key %d", p.Provider, p.KeyIndex)
+	}
+}
+
+// validateLimits checks the timeouts and retries of provider requests
+func validateLimits(ps *problems, path string, limits config.Limits) {
+	if limits.RequestTimeout < 0 {
+		ps.errorf(path+".request_timeout", "request_timeout must not be negative")
+	}
+	if limits.StreamIdleTimeout < 0 {
+		ps.errorf(path+".stream_idle_timeout", "stream_idle_timeout must not be negative")
+	}
+	if limits.Retries != nil && *limits.Retries < 0 {
+		ps.errorf(path+".retries", "retries must not be negative")
+	}
+}
+
+// validateListeners checks that each of the listeners is an address or a Unix socket of its own, and that
+// those serving HTTPS have a certificate
+// servesHTTPSOn443 returns whether the router or admin API is served over HTTPS on TCP port 443, which the
+// TLS-ALPN-01 challenge of ACME connects to
+func servesHTTPSOn443(cfg *config.Config) bool {
+	var addresses []string
+	switch {
+	case len(cfg.Listeners) > 0:
+		for _, l := range cfg.Listeners {
+			if l.TLS && l.Address != "" {
+				addresses = append(addresses, l.Address)
+			}
+		}
+	case cfg.UnixSocket.Path == "":
+		addresses = append(addresses, listenAddress(cfg))
+	}
+	switch {
+	case cfg.AdminListen != "":
+		addresses = append(addresses, cfg.AdminListen)
+	case cfg.AdminPort != 0:
+		addresses = append(addresses, fmt.Sprintf(":%d", cfg.AdminPort))
+	}
+	return slices.ContainsFunc(addresses, func(address string) bool {
+		_, port, err := net.SplitHostPort(address)
+		return err == nil && port == "443"
+	})
+}
+
+func validateListeners(ps *problems, cfg *config.Config) {
+	if len(cfg.Listeners) == 0 {
+		return
+	}
+	if cfg.Listen != "" || cfg.UnixSocket.Path != "" {
+		ps.errorf("listeners", "listeners replace listen and unix_socket, which must not be set")
+	}
+	certificate := cfg.TLSCert != "" || len(cfg.ACME.Domains) > 0
+	seen := make(map[string]bool)
+	for i, l := range cfg.Listeners {
+		path := fmt.Sprintf("listeners[%d]", i)
+		name := l.Address
+		switch {
+		case (l.Address == "") == (l.UnixSocket.Path == ""):
+			ps.errorf(path, "either address or unix_socket.path is required")
+			continue
+		case l.UnixSocket.Path != "":
+			name = l.UnixSocket.Path
+			if l.UnixSocket.Mode != "" {
+				if _, err := parseSocketMode(l.UnixSocket.Mode); err != nil {
+					ps.errorf(path+".unix_socket.mode", "%v", err)
+				}
+			}
+		default:
+			if _, _, err := net.SplitHostPort(l.Address); err != nil {
+				ps.errorf(path+".address", "%q is not a host:port address", l.Address)
+			} else if l.Address == cfg.AdminListen {
+				ps.errorf(path+".address", "address must differ from admin_listen")
+			}
+		}
+		if seen[name] {
+			ps.errorf(path, "%s is listened on twice", name)
+		}
+		seen[name] = true
+		if l.TLS && !certificate {
+			ps.errorf(path+".tls", "tls requires tls_cert or acme")
+		}
+	}
+	if certificate && !slices.ContainsFunc(cfg.Listeners, func(l config.Listener) bool { return l.TLS }) {
+		ps.warnf("listeners", "no listener serves HTTPS with the certificate, as none sets tls")
+	}
+}
+
+// validateCORS checks that the allowed origins are origins, scheme://host[:port] without a path, and the
+// methods and headers names
+func validateCORS(ps *problems, cors config.CORS) {
+	for i, origin := range cors.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || strings.Contains(u.Host, "*") {
+			ps.errorf(fmt.Sprintf("cors.allowed_origins[%d]", i), "%q is not an origin such as https://app.example.com", origin)
+		}
+	}
+	for i, method := range cors.AllowedMethods {
+		if method == "" || method != strings.ToUpper(method) || strings.ContainsAny(method, ", ") {
+			ps.errorf(fmt.Sprintf("cors.allowed_methods[%d]", i), "%q is not an HTTP method", method)
+		}
+	}
+	for i, header := range cors.AllowedHeaders {
+		if header == "" || strings.ContainsAny(header, ",: ") {
+			ps.errorf(fmt.Sprintf("cors.allowed_headers[%d]", i), "%q is not a header name", header)
+		}
+	}
+	if cors.MaxAge < 0 {
+		ps.errorf("cors.max_age", "max_age must not be negative")
+	}
+	if len(cors.AllowedOrigins) == 0 && (len(cors.AllowedMethods) > 0 || len(cors.AllowedHeaders) > 0) {
+		ps.warnf("cors", "CORS is disabled without allowed_origins")
+	}
+}
+
+// validateCompressionLevels checks that compression levels are within the range of their encoding
+func validateCompressionLevels(ps *problems, path string, levels config.CompressionLevels) {
+	for _, level := range []struct {
+		name  string
+		level int
+		max   int
+	}{{"gzip", levels.Gzip, 9}, {"br", levels.Brotli, 11}, {"zstd", levels.Zstd, 22}} {
+		if level.level < 0 || level.level > level.max {
+			ps.errorf(path+"."+level.name, "%s level must be between 1 and %d", level.name, level.max)
+		}
+	}
+}
+
+// validateCapture checks the capture sinks and warns of requests set to be captured without a sink
+func validateCapture(ps *problems, cfg *config.Config) {
+	capture := cfg.Capture
+	if capture.File != "" && (filepath.Clean(capture.File) == filepath.Clean(cfg.Logging.File) || filepath.Clean(capture.File) == filepath.Clean(cfg.Logging.AccessLog.File)) {
+		ps.errorf("capture.file", "transcripts must be written to another file than the logs")
+	}
+	if s3 := capture.S3; s3.Bucket != "" {
+		if s3.Region == "" {
+			ps.errorf("capture.s3.region", "region is required")
+		}
+		if (s3.AccessKeyID == "") != (s3.SecretAccessKey == "") {
+			ps.errorf("capture.s3", "access_key_id and secret_access_key must be set together")
+		}
+		if s3.Endpoint != "" {
+			if endpoint, err := url.Parse(s3.Endpoint); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+				ps.errorf("capture.s3.endpoint", "endpoint %q is not an http or https URL", s3.Endpoint)
+			}
+		}
+	}
+	if capture.File != "" || capture.S3.Bucket != "" {
+		return
+	}
+	for i, group := range cfg.Groups {
+		if group.Capture {
+			ps.warnf(fmt.Sprintf("groups[%d].capture", i), "no capture sink is configured, so the transcripts of group %q are not recorded", group.Name)
+		}
+	}
+	for i, key := range cfg.ClientKeys {
+		if key.Capture {
+			ps.warnf(fmt.Sprintf("client_keys[%d].capture", i), "no capture sink is configured, so the transcripts of client key %q are not recorded", key.Name)
+		}
+	}
+}
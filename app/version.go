@@ -0,0 +1,57 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"llm-router/server"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Build information, injected at build time with
+//
+//	go build -ldflags "-X llm-router/app.Version=v1.2.3 -X llm-router/app.Commit=$(git rev-parse HEAD) -X llm-router/app.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// versionInfo reports the build and runtime information of the router
+func (a *App) versionInfo() server.VersionInfo {
+	a.reloadMutex.RLock()
+	configHash := a.configHash
+	a.reloadMutex.RUnlock()
+	info := server.VersionInfo{
+		Version:    Version,
+		Commit:     Commit,
+		BuildDate:  BuildDate,
+		GoVersion:  runtime.Version(),
+		ConfigHash: configHash,
+		StartedAt:  a.startedAt.UTC(),
+		Uptime:     time.Since(a.startedAt).Round(time.Second).String(),
+	}
+	// Fall back to the VCS information recorded by the Go toolchain
+	if info.Commit == "" {
+		if build, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range build.Settings {
+				if setting.Key == "vcs.revision" {
+					info.Commit = setting.Value
+				}
+			}
+		}
+	}
+	return info
+}
+
+// hashConfig returns a SHA-256 hash of the configuration, to tell apart instances running different configurations
+func hashConfig(cfg any) string {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
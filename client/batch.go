@@ -0,0 +1,148 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// BatchUsage counts the token usage of batch results against a key client when the batch
+// output files are downloaded through a proxy. Each output file is counted only once.
+type BatchUsage struct {
+	keyClient    *KeyClient
+	resolveModel func(model string) string
+	countedMutex sync.Mutex
+	counted      map[string]bool
+}
+
+// NewBatchUsage creates a BatchUsage for the key client. resolveModel maps the model names reported
+// in batch results (often dated snapshots) onto the model names used for routing.
+func NewBatchUsage(kc *KeyClient, resolveModel func(model string) string) *BatchUsage {
+	return &BatchUsage{
+		keyClient:    kc,
+		resolveModel: resolveModel,
+		counted:      make(map[string]bool),
+	}
+}
+
+// ModifyResponse wraps file content downloads so that batch results are counted once fully read.
+// It is meant to be used as the ModifyResponse hook of a reverse proxy.
+func (b *BatchUsage) ModifyResponse(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK || resp.Request == nil {
+		return nil
+	}
+	fileID, ok := fileContentID(resp.Request.URL.Path)
+	if !ok {
+		return nil
+	}
+
+	b.countedMutex.Lock()
+	counted := b.counted[fileID]
+	b.countedMutex.Unlock()
+	if counted {
+		return nil
+	}
+
+	resp.Body = &batchUsageReader{
+		ReadCloser: resp.Body,
+		usage:      make(map[string]UsageRecord),
+		onComplete: func(usage map[string]UsageRecord) {
+			b.countedMutex.Lock()
+			defer b.countedMutex.Unlock()
+			if b.counted[fileID] {
+				return
+			}
+			b.counted[fileID] = true
+			for model, record := range usage {
+				record.Model = b.resolveModel(model)
+				b.keyClient.recordUsage(record)
+			}
+		},
+	}
+	return nil
+}
+
+// fileContentID extracts the file ID from a ".../files/{id}/content" path
+func fileContentID(path string) (string, bool) {
+	rest, ok := strings.CutSuffix(path, "/content")
+	if !ok {
+		return "", false
+	}
+	i := strings.LastIndex(rest, "/files/")
+	if i < 0 {
+		return "", false
+	}
+	fileID := rest[i+len("/files/"):]
+	return fileID, fileID != "" && !strings.Contains(fileID, "/")
+}
+
+// batchResult is a single line of a batch output file
+type batchResult struct {
+	Response *struct {
+		Body struct {
+			Model string `json:"model"`
+			Usage *struct {
+				PromptTokens     int64 `json:"prompt_tokens"`
+				CompletionTokens int64 `json:"completion_tokens"`
+				TotalTokens      int64 `json:"total_tokens"`
+				Details          *struct {
+					ReasoningTokens int64 `json:"reasoning_tokens"`
+				} `json:"completion_tokens_details"`
+			} `json:"usage"`
+		} `json:"body"`
+	} `json:"response"`
+}
+
+// batchUsageReader sums the usage of batch output lines as they are read
+// and reports it once the whole file has been read
+type batchUsageReader struct {
+	io.ReadCloser
+	pending    []byte
+	usage      map[string]UsageRecord
+	onComplete func(usage map[string]UsageRecord)
+}
+
+func (r *batchUsageReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.pending = append(r.pending, p[:n]...)
+	for {
+		i := bytes.IndexByte(r.pending, '\n')
+		if i < 0 {
+			break
+		}
+		r.countLine(r.pending[:i])
+		r.pending = r.pending[i+1:]
+	}
+	if err == io.EOF {
+		r.countLine(r.pending)
+		r.pending = nil
+		r.onComplete(r.usage)
+	}
+	return n, err
+}
+
+func (r *batchUsageReader) countLine(line []byte) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	var result batchResult
+	if err := json.Unmarshal(line, &result); err != nil {
+		return
+	}
+	if result.Response == nil || result.Response.Body.Usage == nil {
+		return
+	}
+	body := result.Response.Body
+	record := r.usage[body.Model]
+	record.PromptTokens += body.Usage.PromptTokens
+	record.CompletionTokens += body.Usage.CompletionTokens
+	record.TotalTokens += body.Usage.TotalTokens
+	if body.Usage.Details != nil {
+		record.ReasoningTokens += body.Usage.Details.ReasoningTokens
+	}
+	r.usage[body.Model] = record
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestProxyCountsBatchOutputUsageOnce(t *testing.T) {
+	output := strings.Join([]string{
+		`{"id":"r1","custom_id":"a","response":{"status_code":200,"body":{"model":"gpt-4o-mini-2024-07-18","usage":{"total_tokens":100}}}}`,
+		`{"id":"r2","custom_id":"b","response":{"status_code":200,"body":{"model":"gpt-4o-mini-2024-07-18","usage":{"total_tokens":50}}}}`,
+		`{"id":"r3","custom_id":"c","response":null,"error":{"code":"server_error"}}`,
+	}, "\n")
+
+	var gotPath, gotAuth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		w.Write([]byte(output))
+	}))
+	defer upstream.Close()
+
+	kc := NewKeyClient("upstream-key", openai.NewClientWithConfig(openai.DefaultConfig("upstream-key")), 0, 0)
+	proxy, err := NewProxy(upstream.URL+"/v1", kc)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	usage := NewBatchUsage(kc, func(model string) string {
+		return strings.TrimSuffix(model, "-2024-07-18")
+	})
+	proxy.ModifyResponse = usage.ModifyResponse
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/v1/files/file-1/content", nil)
+		req.Header.Set("Authorization", "Bearer router-key")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+
+		body, _ := io.ReadAll(w.Result().Body)
+		if string(body) != output {
+			t.Errorf("Expected output file to be relayed unchanged, got %q", string(body))
+		}
+	}
+
+	if gotPath != "/v1/files/file-1/content" {
+		t.Errorf("Expected upstream path '/v1/files/file-1/content', got '%s'", gotPath)
+	}
+	if gotAuth != "Bearer upstream-key" {
+		t.Errorf("Expected upstream key to replace router key, got '%s'", gotAuth)
+	}
+	if u := kc.Usage("gpt-4o-mini"); u != 150 {
+		t.Errorf("Expected batch usage 150 counted once, got %d", u)
+	}
+}
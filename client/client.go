@@ -2,112 +2,461 @@ package client
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 )
 
 type ProviderClient struct {
 	ProviderName string
+	BaseURL      string
 	KeyClients   []*KeyClient
 }
 
 type KeyClient struct {
-	APIKey     string
-	modelUsage map[string]int64 // per-model usage tracking
-	usageMutex sync.RWMutex     // protects modelUsage map
-	Client     *openai.Client
+	APIKey string
+	// Tenant the key is dedicated to, empty for keys shared by all requests
+	Tenant string
+	// Free is set for keys on a free or trial tier, as opposed to paid keys
+	Free bool
+	// usage and health of the key, shared with the clients of the key built on reloads, see ShareState
+	*keyState
+	Client *openai.Client
+	// CountTokens counts the tokens of a text for a model, used to estimate usage when the
+	// provider does not report it. A rough estimate is used when nil.
+	CountTokens func(model string, text string) int
+	// RecordUsage, if set, receives the usage of the key's requests
+	RecordUsage func(record UsageRecord)
+	// Prices of the models served with this key, used to compute the cost of their usage
+	Prices map[string]Price
+	// ErrorPenaltyHalfLife is the time error penalties take to decay by half, see PenalizeError.
+	// Error penalties never decay when 0.
+	ErrorPenaltyHalfLife time.Duration
 
 	errorPenalty   int64
 	requestPenalty int64
 }
 
+// keyState is the usage and health of a key
+type keyState struct {
+	modelUsage  map[string]int64      // per-model usage tracking
+	modelTokens map[string]TokenUsage // per-model tokens by kind
+	modelCost   map[string]float64    // per-model cost in USD
+	pending     map[string]int64      // counter deltas since the last SyncUsage
+	unsynced    *UsageBatch           // batch whose sync failed, retried as is by the next SyncUsage
+	source      string                // random ID of the key's state, telling its batches from other instances'
+	batches     int64                 // batches synced so far
+	windows     []map[string]int64    // counter deltas of this instance per usage window, oldest first
+	// per-model error penalties decaying over ErrorPenaltyHalfLife, local to this instance
+	errorPenalties map[string]decayingPenalty
+	usageMutex     sync.RWMutex // protects modelUsage, modelTokens, modelCost, pending, unsynced, batches, windows, and errorPenalties
+
+	health      KeyHealth
+	healthMutex sync.Mutex // protects health
+}
+
 // NewKeyClient creates a new KeyClient with initialized model usage map
 func NewKeyClient(apiKey string, client *openai.Client, errorPenalty int64, requestPenalty int64) *KeyClient {
 	return &KeyClient{
-		APIKey:         apiKey,
-		modelUsage:     make(map[string]int64),
+		APIKey: apiKey,
+		keyState: &keyState{
+			modelUsage:  make(map[string]int64),
+			modelTokens: make(map[string]TokenUsage),
+			modelCost:   make(map[string]float64),
+			source:      randomID(),
+		},
 		Client:         client,
 		errorPenalty:   errorPenalty,
 		requestPenalty: requestPenalty,
 	}
 }
 
+// ShareState makes the key client count its usage and track its health together with another client of the
+// same key, e.g. the client replaced when the configuration is reloaded, so that requests still in flight on
+// either one count towards both. It must be called before the key client is used.
+func (kc *KeyClient) ShareState(other *KeyClient) {
+	kc.keyState = other.keyState
+}
+
 // IncrementUsage increases the usage count for a specific model
 func (kc *KeyClient) IncrementUsage(model string, tokens int64) {
 	kc.usageMutex.Lock()
 	defer kc.usageMutex.Unlock()
 	kc.modelUsage[model] += tokens
+	kc.countLocal(counterUsage, model, tokens)
 }
 
-// Usage returns the current usage count for a specific model
+// Usage returns the current usage count for a specific model, including its decaying error penalties
 func (kc *KeyClient) Usage(model string) int64 {
 	kc.usageMutex.RLock()
 	defer kc.usageMutex.RUnlock()
-	return kc.modelUsage[model]
+	return kc.modelUsage[model] + kc.decayedPenalty(model)
+}
+
+// TokenUsage returns the tokens by kind for a specific model
+func (kc *KeyClient) TokenUsage(model string) TokenUsage {
+	kc.usageMutex.RLock()
+	defer kc.usageMutex.RUnlock()
+	return kc.modelTokens[model]
+}
+
+// BalanceUsage returns the usage of a model counted on a dimension (BalanceTotal, BalancePrompt,
+// or BalanceCompletion), including the request and error penalties. Tokens not reported as
+// completion tokens count as prompt tokens, and cached prompt tokens at their discounted price.
+func (kc *KeyClient) BalanceUsage(model string, dimension string) int64 {
+	kc.usageMutex.RLock()
+	defer kc.usageMutex.RUnlock()
+	usage := kc.modelUsage[model] + kc.decayedPenalty(model)
+	tokens := kc.modelTokens[model]
+	switch dimension {
+	case BalancePrompt:
+		return usage - tokens.CompletionTokens
+	case BalanceCompletion:
+		return usage - (tokens.TotalTokens - tokens.CompletionTokens - kc.cacheDiscount(model, tokens.CachedTokens))
+	}
+	return usage
+}
+
+// Penalties returns the request and error penalties counted in the usage of a model
+func (kc *KeyClient) Penalties(model string) int64 {
+	kc.usageMutex.RLock()
+	defer kc.usageMutex.RUnlock()
+	tokens := kc.modelTokens[model]
+	return kc.modelUsage[model] + kc.decayedPenalty(model) - (tokens.TotalTokens - kc.cacheDiscount(model, tokens.CachedTokens))
+}
+
+// Cost returns the accumulated cost in USD for a specific model
+func (kc *KeyClient) Cost(model string) float64 {
+	kc.usageMutex.RLock()
+	defer kc.usageMutex.RUnlock()
+	return kc.modelCost[model]
+}
+
+// Route describes how a request was served
+type Route struct {
+	Provider string
+	Model    string
+	// KeyID identifies the provider key as "provider/hash"
+	KeyID string
+	// Attempts is the number of upstream requests made, including retries
+	Attempts int
+	// Candidates are the key and model pairs evaluated for the last attempt, set when an explanation
+	// was requested with WithRouteExplanation
+	Candidates []Candidate
+	// UpstreamIDs are the identifiers the provider gave the last attempt, by response header name
+	UpstreamIDs map[string]string
+}
+
+// Candidate is a key and model pair evaluated when routing a request, with its balancing usage
+type Candidate struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	KeyID    string `json:"key"`
+	Weight   int64  `json:"weight"`
+	// Usage is the usage balanced on, including Penalties
+	Usage     int64 `json:"usage"`
+	Penalties int64 `json:"penalties"`
+	// Score is the usage multiplied by the weight; the available candidate with the lowest score wins
+	Score    int64 `json:"score"`
+	Selected bool  `json:"selected,omitempty"`
+	// Skipped is the reason the candidate was not available, empty if it was
+	Skipped string `json:"skipped,omitempty"`
+}
+
+type routeExplanationKey struct{}
+
+// WithRouteExplanation asks the router to explain how it routes a request, in the Candidates of its Route
+func WithRouteExplanation(ctx context.Context) context.Context {
+	return context.WithValue(ctx, routeExplanationKey{}, true)
+}
+
+// RouteExplanationRequested reports whether an explanation of the route was requested with WithRouteExplanation
+func RouteExplanationRequested(ctx context.Context) bool {
+	requested, _ := ctx.Value(routeExplanationKey{}).(bool)
+	return requested
 }
 
 // ChatCompletionResponse wraps the OpenAI response
 type ChatCompletionResponse struct {
 	openai.ChatCompletionResponse
+	// Route is set by the router
+	Route Route `json:"-"`
+	// Cost in USD of the request, zero for models without a price
+	Cost float64 `json:"-"`
+	// UpstreamIDs are the identifiers the provider gave the request, by response header name
+	UpstreamIDs map[string]string `json:"-"`
+	// Response body as sent by the provider
+	raw []byte
+}
+
+// MarshalJSON encodes the response keeping the provider's original encoding of every unchanged field,
+// e.g. logprob bytes that go-openai would re-encode as base64
+func (r ChatCompletionResponse) MarshalJSON() ([]byte, error) {
+	encoded, err := json.Marshal(r.ChatCompletionResponse)
+	if err != nil || r.raw == nil {
+		return encoded, err
+	}
+	var decoded openai.ChatCompletionResponse
+	if err := json.Unmarshal(r.raw, &decoded); err != nil {
+		return encoded, nil
+	}
+	canonical, err := json.Marshal(decoded)
+	if err != nil {
+		return encoded, nil
+	}
+	return mergeRaw(r.raw, canonical, encoded), nil
 }
 
 // ChatCompletionStream wraps the OpenAI stream to track usage
 type ChatCompletionStream struct {
+	// Route is set by the router
+	Route Route
+	// UpstreamIDs are the identifiers the provider gave the request, by response header name
+	UpstreamIDs map[string]string
+	// OnClose, if set, is called once when the stream is closed, with its final usage and error
+	OnClose func()
+	// OnChunk, if set, is called with every chunk received
+	OnChunk   func(chunk openai.ChatCompletionStreamResponse)
 	stream    *openai.ChatCompletionStream
 	keyClient *KeyClient
 	model     string
+	// attribution is the group and client key the stream's usage is attributed to
+	attribution UsageRecord
 	// Different providers report usage in very different ways.
 	// In case of reporting multiple times, we track usage here to avoid double counting.
-	usage int64
+	usage           int64
+	promptUsage     int64
+	completionUsage int64
+	reasoningUsage  int64
+	cachedUsage     int64
+	cost            float64
+	// Generated text per choice index and the request, used to estimate usage
+	// when the provider does not report it
+	generated  map[int]*strings.Builder
+	request    openai.ChatCompletionRequest
+	reconciled bool
+	// chunks and bytes are the chunks received and the bytes of their JSON
+	chunks int64
+	bytes  int64
+	// err is the error that ended the stream, other than io.EOF
+	err      error
+	finished bool
+	closed   bool
+	// peeked is the first chunk received by Peek, returned by the next Recv
+	peeked *peekedChunk
+}
+
+// peekedChunk is a chunk received ahead of Recv, or the error receiving it
+type peekedChunk struct {
+	resp openai.ChatCompletionStreamResponse
+	raw  []byte
+	err  error
 }
 
 // Recv receives the next stream chunk and tracks usage
 func (w *ChatCompletionStream) Recv() (openai.ChatCompletionStreamResponse, error) {
-	resp, err := w.stream.Recv()
+	resp, _, err := w.RecvRaw()
+	return resp, err
+}
+
+// RecvRaw receives the next stream chunk together with its raw JSON as sent by the provider,
+// so that it can be relayed without losing fields, and tracks usage
+func (w *ChatCompletionStream) RecvRaw() (openai.ChatCompletionStreamResponse, []byte, error) {
+	if peeked := w.peeked; peeked != nil {
+		w.peeked = nil
+		return peeked.resp, peeked.raw, peeked.err
+	}
+	var resp openai.ChatCompletionStreamResponse
+	raw, err := w.stream.RecvRaw()
 	if err != nil {
-		return resp, err
+		// The provider bills the tokens generated before a stream fails as well
+		w.reconcileUsage()
+		if errors.Is(err, io.EOF) {
+			w.finished = true
+		} else {
+			w.err = err
+		}
+		return resp, nil, err
+	}
+	w.chunks++
+	w.bytes += int64(len(raw))
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return resp, nil, err
+	}
+
+	// With n > 1 the chunks of all choices are interleaved and told apart by their index
+	for _, choice := range resp.Choices {
+		text, ok := w.generated[choice.Index]
+		if !ok {
+			text = &strings.Builder{}
+			w.generated[choice.Index] = text
+		}
+		text.WriteString(messageText(choice.Delta.Content, choice.Delta.ReasoningContent, choice.Delta.ToolCalls))
 	}
 
-	// Empty response choices
-	finish := len(resp.Choices) == 0
+	// Usage is only taken from explicit usage reports, never inferred from the chunk content:
+	// tool call and reasoning chunks carry no content, and the final usage chunk has no choices.
+	if resp.Usage != nil {
+		w.trackUsage(resp.Usage, raw)
+	}
+	if w.OnChunk != nil {
+		w.OnChunk(resp)
+	}
 
-	// Response choice with finish reason
-	finish = finish || resp.Choices[0].FinishReason != ""
+	return resp, raw, nil
+}
 
-	// Response choice with empty content
-	finish = finish || resp.Choices[0].Delta.Content+resp.Choices[0].Delta.ReasoningContent == ""
+// Peek receives the first chunk of the stream ahead of Recv, which returns it next, so that a stream failing
+// before its first chunk can be retried before anything was relayed. It returns the error the stream failed
+// with, nil if it ended without chunks.
+func (w *ChatCompletionStream) Peek() error {
+	resp, raw, err := w.RecvRaw()
+	w.peeked = &peekedChunk{resp: resp, raw: raw, err: err}
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// trackUsage counts the increase of a usage report over the previous ones. Providers may report cumulative
+// usage several times, e.g. the prompt tokens first and the completion tokens in a final chunk, and some
+// leave out the total.
+func (w *ChatCompletionStream) trackUsage(usage *openai.Usage, raw []byte) {
+	record := w.attribution
+	record.PromptTokens = max(int64(usage.PromptTokens)-w.promptUsage, 0)
+	record.CachedTokens = max(cachedTokens(usage, raw)-w.cachedUsage, 0)
+	record.CompletionTokens = max(int64(usage.CompletionTokens)-w.completionUsage, 0)
+	record.ReasoningTokens = max(reasoningTokens(usage)-w.reasoningUsage, 0)
+	total := max(int64(usage.TotalTokens), int64(usage.PromptTokens+usage.CompletionTokens))
+	record.TotalTokens = max(total-w.usage, record.PromptTokens+record.CompletionTokens)
+	if record.TotalTokens == 0 {
+		return
+	}
+	w.cost += w.keyClient.recordUsage(record)
+	w.usage += record.TotalTokens
+	w.promptUsage += record.PromptTokens
+	w.completionUsage += record.CompletionTokens
+	w.reasoningUsage += record.ReasoningTokens
+	w.cachedUsage += record.CachedTokens
+}
 
-	// Increment usage if finish and usage info is available
-	if finish && resp.Usage != nil {
-		delta := int64(resp.Usage.TotalTokens) - w.usage
-		if delta > 0 {
-			w.keyClient.IncrementUsage(w.model, delta)
-			w.usage += delta
+// reconcileUsage estimates, once the stream has ended, the prompt and completion tokens the provider did not
+// report: all of them when it reported no usage, or the missing side when it only reported prompt or completion
+// tokens, e.g. because the stream failed before the final usage chunk
+func (w *ChatCompletionStream) reconcileUsage() {
+	if w.reconciled {
+		return
+	}
+	w.reconciled = true
+	// A total reported without its breakdown cannot be completed
+	if w.usage > w.promptUsage+w.completionUsage {
+		return
+	}
+	record := w.attribution
+	if w.promptUsage == 0 {
+		record.PromptTokens = w.keyClient.countPromptTokens(w.request)
+	}
+	if w.completionUsage == 0 {
+		for _, text := range w.generated {
+			record.CompletionTokens += w.keyClient.countTokens(w.model, text.String())
 		}
 	}
+	record.TotalTokens = record.PromptTokens + record.CompletionTokens
+	if record.TotalTokens == 0 {
+		return
+	}
+	w.cost += w.keyClient.recordUsage(record)
+	w.usage += record.TotalTokens
+	w.promptUsage += record.PromptTokens
+	w.completionUsage += record.CompletionTokens
+}
+
+// Usage returns the usage and cost of the stream received so far, final once the stream has ended
+func (w *ChatCompletionStream) Usage() UsageRecord {
+	record := w.attribution
+	record.Requests = 1
+	record.PromptTokens = w.promptUsage
+	record.CachedTokens = w.cachedUsage
+	record.CompletionTokens = w.completionUsage
+	record.ReasoningTokens = w.reasoningUsage
+	record.TotalTokens = w.usage
+	record.Cost = w.cost
+	return record
+}
+
+// Err returns the error that ended the stream, or nil if it has not ended or ended normally
+func (w *ChatCompletionStream) Err() error {
+	return w.err
+}
 
-	return resp, nil
+// Finished reports whether the provider ended the stream normally, rather than it failing or being closed
+// before its end
+func (w *ChatCompletionStream) Finished() bool {
+	return w.finished
 }
 
-// Close closes the underlying stream
+// Chunks returns the number of chunks received so far
+func (w *ChatCompletionStream) Chunks() int64 {
+	return w.chunks
+}
+
+// Bytes returns the size of the JSON of the chunks received so far, as relayed to clients
+func (w *ChatCompletionStream) Bytes() int64 {
+	return w.bytes
+}
+
+// Cost returns the cost in USD of the usage received so far, final once the stream has ended
+func (w *ChatCompletionStream) Cost() float64 {
+	return w.cost
+}
+
+// Close closes the underlying stream, estimating the usage of streams closed before the provider reported it
 func (w *ChatCompletionStream) Close() error {
-	return w.stream.Close()
+	w.reconcileUsage()
+	err := w.stream.Close()
+	if !w.closed && w.OnClose != nil {
+		w.OnClose()
+	}
+	w.closed = true
+	return err
 }
 
 // ChatCompletion wraps the CreateChatCompletion method and increments usage
 func (kc *KeyClient) ChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (*ChatCompletionResponse, error) {
 	kc.IncrementUsage(req.Model, kc.requestPenalty)
+	kc.recordRequest()
 
+	ctx, raw := withRawResponse(ctx)
+	ctx, upstream := withUpstreamIDs(ctx)
 	resp, err := kc.Client.CreateChatCompletion(ctx, req)
 	if err != nil {
-		kc.IncrementUsage(req.Model, kc.errorPenalty)
-		return nil, err
+		kc.recordError(req.Model, err)
+		return nil, withUpstreamIDsError(err, upstream.ids)
 	}
-	kc.IncrementUsage(req.Model, int64(resp.Usage.TotalTokens))
+	// The reported usage covers all n choices; without it, estimate from every choice rather than the first
+	record := attributedRecord(ctx, req.Model)
+	record.Requests = 1
+	record.PromptTokens = int64(resp.Usage.PromptTokens)
+	record.CachedTokens = cachedTokens(&resp.Usage, raw.body)
+	record.CompletionTokens = int64(resp.Usage.CompletionTokens)
+	record.ReasoningTokens = reasoningTokens(&resp.Usage)
+	record.TotalTokens = int64(resp.Usage.TotalTokens)
+	if record.TotalTokens == 0 {
+		record.PromptTokens, record.CompletionTokens = kc.estimateResponseTokens(req, resp)
+		record.TotalTokens = record.PromptTokens + record.CompletionTokens
+	}
+	cost := kc.recordUsage(record)
 
 	wrapped := &ChatCompletionResponse{
 		ChatCompletionResponse: resp,
+		Cost:                   cost,
+		UpstreamIDs:            upstream.ids,
+		raw:                    raw.body,
 	}
 	return wrapped, nil
 }
@@ -115,18 +464,29 @@ func (kc *KeyClient) ChatCompletion(ctx context.Context, req openai.ChatCompleti
 // ChatCompletionStream wraps the CreateChatCompletionStream method and tracks usage
 func (kc *KeyClient) ChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (*ChatCompletionStream, error) {
 	kc.IncrementUsage(req.Model, kc.requestPenalty)
+	kc.recordRequest()
 
+	ctx, upstream := withUpstreamIDs(ctx)
 	stream, err := kc.Client.CreateChatCompletionStream(ctx, req)
 	if err != nil {
-		kc.IncrementUsage(req.Model, kc.errorPenalty)
-		return nil, err
+		kc.recordError(req.Model, err)
+		return nil, withUpstreamIDsError(err, upstream.ids)
 	}
 
+	attribution := attributedRecord(ctx, req.Model)
+	requests := attribution
+	requests.Requests = 1
+	kc.recordUsage(requests)
+
 	wrapper := &ChatCompletionStream{
-		stream:    stream,
-		keyClient: kc,
-		model:     req.Model,
-		usage:     0,
+		stream:      stream,
+		keyClient:   kc,
+		model:       req.Model,
+		attribution: attribution,
+		usage:       0,
+		generated:   make(map[int]*strings.Builder),
+		request:     req,
+		UpstreamIDs: upstream.ids,
 	}
 
 	return wrapper, nil
@@ -1,7 +1,15 @@
 package client
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 )
@@ -80,3 +88,487 @@ func TestConcurrentUsageTracking(t *testing.T) {
 		t.Errorf("Expected concurrent usage for gpt-4 to be 100, got %d", usage)
 	}
 }
+
+// toolCallStreamChunks is a streamed tool call as sent by OpenAI, ending with a separate usage chunk
+var toolCallStreamChunks = []string{
+	`{"id":"c1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]},"finish_reason":null}],"usage":null}`,
+	`{"id":"c1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]},"finish_reason":null}],"usage":null}`,
+	`{"id":"c1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]},"finish_reason":null}],"usage":null}`,
+	`{"id":"c1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}],"usage":null}`,
+	`{"id":"c1","object":"chat.completion.chunk","model":"gpt-4","choices":[],"usage":{"prompt_tokens":20,"completion_tokens":10,"total_tokens":30}}`,
+}
+
+func newStreamServer(chunks []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+}
+
+func TestStreamToolCallPassthrough(t *testing.T) {
+	upstream := newStreamServer(toolCallStreamChunks)
+	defer upstream.Close()
+
+	config := openai.DefaultConfig("test-key")
+	config.BaseURL = upstream.URL + "/v1"
+	kc := NewKeyClient("test-key", openai.NewClientWithConfig(config), 0, 0)
+
+	stream, err := kc.ChatCompletionStream(context.Background(), openai.ChatCompletionRequest{Model: "gpt-4"})
+	if err != nil {
+		t.Fatalf("Failed to create stream: %v", err)
+	}
+	defer stream.Close()
+
+	var arguments string
+	var finishReason openai.FinishReason
+	for i := 0; ; i++ {
+		resp, raw, err := stream.RecvRaw()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected stream error: %v", err)
+		}
+		if string(raw) != toolCallStreamChunks[i] {
+			t.Errorf("Expected raw chunk %d to be unchanged, got %s", i, raw)
+		}
+		for _, choice := range resp.Choices {
+			for _, call := range choice.Delta.ToolCalls {
+				arguments += call.Function.Arguments
+			}
+			if choice.FinishReason != "" {
+				finishReason = choice.FinishReason
+			}
+		}
+	}
+
+	if arguments != `{"city":"Paris"}` {
+		t.Errorf("Expected reassembled arguments, got %s", arguments)
+	}
+	if finishReason != openai.FinishReasonToolCalls {
+		t.Errorf("Expected finish reason 'tool_calls', got '%s'", finishReason)
+	}
+	if usage := kc.Usage("gpt-4"); usage != 30 {
+		t.Errorf("Expected usage from the final usage chunk to be 30, got %d", usage)
+	}
+	var size int64
+	for _, chunk := range toolCallStreamChunks {
+		size += int64(len(chunk))
+	}
+	if !stream.Finished() || stream.Chunks() != int64(len(toolCallStreamChunks)) || stream.Bytes() != size {
+		t.Errorf("Expected a finished stream of %d chunks and %d bytes, got %v, %d, and %d", len(toolCallStreamChunks), size, stream.Finished(), stream.Chunks(), stream.Bytes())
+	}
+}
+
+func TestMultipleChoicesUsage(t *testing.T) {
+	// Two choices with interleaved chunks and no usage report
+	chunks := []string{
+		`{"id":"1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{"role":"assistant","content":"aaaa"}}]}`,
+		`{"id":"1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":1,"delta":{"role":"assistant","content":"bbbbbbbb"}}]}`,
+		`{"id":"1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{"content":"aaaa"},"finish_reason":"stop"}]}`,
+		`{"id":"1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":1,"delta":{},"finish_reason":"stop"}]}`,
+	}
+	upstream := newStreamServer(chunks)
+	defer upstream.Close()
+
+	config := openai.DefaultConfig("test-key")
+	config.BaseURL = upstream.URL + "/v1"
+	kc := NewKeyClient("test-key", openai.NewClientWithConfig(config), 0, 0)
+
+	stream, err := kc.ChatCompletionStream(context.Background(), openai.ChatCompletionRequest{Model: "gpt-4", N: 2})
+	if err != nil {
+		t.Fatalf("Failed to create stream: %v", err)
+	}
+	defer stream.Close()
+
+	indexes := make(map[int]string)
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected stream error: %v", err)
+		}
+		for _, choice := range resp.Choices {
+			indexes[choice.Index] += choice.Delta.Content
+		}
+	}
+
+	if indexes[0] != "aaaaaaaa" || indexes[1] != "bbbbbbbb" {
+		t.Errorf("Expected both choices to be received by index, got %v", indexes)
+	}
+	if usage := kc.Usage("gpt-4"); usage != 4 {
+		t.Errorf("Expected estimated usage of both choices to be 4, got %d", usage)
+	}
+
+	// Non-streaming responses without usage are estimated from all choices as well
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"1","model":"gpt-4","choices":[`+
+			`{"index":0,"message":{"role":"assistant","content":"aaaaaaaa"}},`+
+			`{"index":1,"message":{"role":"assistant","content":"bbbbbbbbbbbbbbbb"}}]}`)
+	}))
+	defer upstream.Close()
+
+	config.BaseURL = upstream.URL + "/v1"
+	kc = NewKeyClient("test-key", openai.NewClientWithConfig(config), 0, 0)
+	resp, err := kc.ChatCompletion(context.Background(), openai.ChatCompletionRequest{Model: "gpt-4", N: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(resp.Choices) != 2 {
+		t.Errorf("Expected 2 choices, got %d", len(resp.Choices))
+	}
+	if usage := kc.Usage("gpt-4"); usage != 6 {
+		t.Errorf("Expected estimated usage of both choices to be 6, got %d", usage)
+	}
+}
+
+func TestUsageCost(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],`+
+			`"usage":{"prompt_tokens":1000,"completion_tokens":200,"total_tokens":1200}}`)
+	}))
+	defer upstream.Close()
+
+	config := openai.DefaultConfig("test-key")
+	config.BaseURL = upstream.URL + "/v1"
+	kc := NewKeyClient("test-key", openai.NewClientWithConfig(config), 0, 0)
+	kc.Prices = map[string]Price{"gpt-4o": {Input: 2.5, Output: 10}}
+	var records []UsageRecord
+	kc.RecordUsage = func(record UsageRecord) { records = append(records, record) }
+
+	if _, err := kc.ChatCompletion(context.Background(), openai.ChatCompletionRequest{Model: "gpt-4o"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// 1000 * 2.5 / 1M + 200 * 10 / 1M
+	const expected = 0.0045
+	if len(records) != 1 || records[0].PromptTokens != 1000 || records[0].CompletionTokens != 200 {
+		t.Fatalf("Expected one record with prompt and completion tokens, got %+v", records)
+	}
+	if math.Abs(records[0].Cost-expected) > 1e-12 || math.Abs(kc.Cost("gpt-4o")-expected) > 1e-12 {
+		t.Errorf("Expected cost %v, got %v (accumulated %v)", expected, records[0].Cost, kc.Cost("gpt-4o"))
+	}
+
+	// Tokens without a prompt/completion breakdown are priced as input
+	if cost := (Price{Input: 2, Output: 8}).Cost(UsageRecord{TotalTokens: 500_000}); cost != 1 {
+		t.Errorf("Expected unattributed tokens to be priced as input, got %v", cost)
+	}
+}
+
+func TestCachedTokensDiscounted(t *testing.T) {
+	tests := []struct {
+		name  string
+		usage string
+	}{
+		{name: "OpenAI cached tokens", usage: `"usage":{"prompt_tokens":1000,"completion_tokens":200,"total_tokens":1200,"prompt_tokens_details":{"cached_tokens":800}}`},
+		{name: "Anthropic cache reads", usage: `"usage":{"prompt_tokens":1000,"completion_tokens":200,"total_tokens":1200,"cache_read_input_tokens":800}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],`+tt.usage+`}`)
+			}))
+			defer upstream.Close()
+
+			config := openai.DefaultConfig("test-key")
+			config.BaseURL = upstream.URL + "/v1"
+			config.HTTPClient = NewHTTPDoer(http.DefaultClient)
+			kc := NewKeyClient("test-key", openai.NewClientWithConfig(config), 0, 0)
+			kc.Prices = map[string]Price{"gpt-4o": {Input: 2.5, Output: 10, CachedInput: 1.25}}
+
+			resp, err := kc.ChatCompletion(context.Background(), openai.ChatCompletionRequest{Model: "gpt-4o"})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			// 200 * 2.5 / 1M + 800 * 1.25 / 1M + 200 * 10 / 1M
+			const expected = 0.0035
+			if math.Abs(resp.Cost-expected) > 1e-12 {
+				t.Errorf("Expected cost %v, got %v", expected, resp.Cost)
+			}
+			// The 800 cached tokens count half, as their price
+			if usage := kc.BalanceUsage("gpt-4o", BalanceTotal); usage != 800 {
+				t.Errorf("Expected balancing usage of 800, got %d", usage)
+			}
+			if usage := kc.BalanceUsage("gpt-4o", BalanceCompletion); usage != 200 {
+				t.Errorf("Expected completion balancing usage of 200, got %d", usage)
+			}
+			if tokens := kc.TokenUsage("gpt-4o"); tokens.CachedTokens != 800 || tokens.PromptTokens != 1000 {
+				t.Errorf("Expected 800 of the 1000 prompt tokens cached, got %+v", tokens)
+			}
+		})
+	}
+
+	// Without a cached price, cached tokens are priced and counted in full
+	kc := NewKeyClient("key", nil, 0, 0)
+	kc.Prices = map[string]Price{"gpt-4o": {Input: 2, Output: 8}}
+	if cost := kc.recordUsage(UsageRecord{Model: "gpt-4o", PromptTokens: 500_000, CachedTokens: 400_000, TotalTokens: 500_000}); cost != 1 {
+		t.Errorf("Expected cached tokens priced as input, got %v", cost)
+	}
+	if usage := kc.Usage("gpt-4o"); usage != 500_000 {
+		t.Errorf("Expected cached tokens counted in full, got %d", usage)
+	}
+}
+
+func TestRotateUsage(t *testing.T) {
+	kc := NewKeyClient("key", nil, 0, 0)
+	kc.IncrementUsage("gpt-4o", 50) // before tracking by window, never expires
+	kc.RotateUsage(2)
+	kc.recordUsage(UsageRecord{Model: "gpt-4o", PromptTokens: 70, CompletionTokens: 30, TotalTokens: 100})
+	kc.RotateUsage(2)
+	kc.IncrementUsage("gpt-4o", 10)
+
+	if usage := kc.Usage("gpt-4o"); usage != 160 {
+		t.Fatalf("Expected usage of all kept windows, got %d", usage)
+	}
+	kc.RotateUsage(2)
+	if usage, tokens := kc.Usage("gpt-4o"), kc.TokenUsage("gpt-4o"); usage != 60 || tokens.TotalTokens != 0 || tokens.PromptTokens != 0 {
+		t.Errorf("Expected the usage of the oldest window to expire, got %d %+v", usage, tokens)
+	}
+
+	// Expired usage is removed from the shared counters with the next sync
+	var deltas map[string]int64
+	kc.SyncUsage(func(batch UsageBatch) (map[string]int64, error) {
+		deltas = batch.Deltas
+		return batch.Deltas, nil
+	})
+	if deltas["usage/gpt-4o"] != 60 || deltas["total/gpt-4o"] != 0 {
+		t.Errorf("Expected the net deltas since the last sync, got %v", deltas)
+	}
+
+	// Counters kept per window drop expired usage themselves, and take the deltas of the window that ended
+	kc.IncrementUsage("gpt-4o", 5)
+	deltas = kc.RotateSharedUsage(2)
+	if usage := kc.Usage("gpt-4o"); usage != 55 || deltas["usage/gpt-4o"] != 5 {
+		t.Errorf("Expected the expired usage subtracted and the pending deltas returned, got %d %v", usage, deltas)
+	}
+	kc.SyncUsage(func(batch UsageBatch) (map[string]int64, error) {
+		deltas = batch.Deltas
+		return nil, nil
+	})
+	if len(deltas) != 0 {
+		t.Errorf("Expected no deltas to sync for the expired usage, got %v", deltas)
+	}
+	if usage := kc.Usage("gpt-4o"); usage != 0 {
+		t.Errorf("Expected counters missing from the shared totals to be zero, got %d", usage)
+	}
+}
+
+func TestSyncUsageRetriesFailedBatch(t *testing.T) {
+	kc := NewKeyClient("key", nil, 0, 0)
+	kc.IncrementUsage("gpt-4o", 10)
+	var failed UsageBatch
+	err := kc.SyncUsage(func(batch UsageBatch) (map[string]int64, error) {
+		failed = batch
+		return nil, errors.New("reply lost")
+	})
+	if err == nil || failed.Deltas["usage/gpt-4o"] != 10 {
+		t.Fatalf("Expected the sync to fail with the deltas, got %v %v", failed, err)
+	}
+
+	// The failed batch is retried as is, and usage counted meanwhile waits for the next sync
+	kc.IncrementUsage("gpt-4o", 5)
+	var retried UsageBatch
+	kc.SyncUsage(func(batch UsageBatch) (map[string]int64, error) {
+		retried = batch
+		return map[string]int64{"usage/gpt-4o": 10}, nil
+	})
+	if retried.Source != failed.Source || retried.Seq != failed.Seq || len(retried.Deltas) != 1 || retried.Deltas["usage/gpt-4o"] != 10 {
+		t.Errorf("Expected the failed batch to be retried as is, got %v", retried)
+	}
+	if usage := kc.Usage("gpt-4o"); usage != 15 {
+		t.Errorf("Expected the usage counted meanwhile on top of the totals, got %d", usage)
+	}
+	var next UsageBatch
+	kc.SyncUsage(func(batch UsageBatch) (map[string]int64, error) {
+		next = batch
+		return map[string]int64{"usage/gpt-4o": 15}, nil
+	})
+	if next.Seq != failed.Seq+1 || next.Deltas["usage/gpt-4o"] != 5 {
+		t.Errorf("Expected the usage counted meanwhile in the next batch, got %v", next)
+	}
+}
+
+func TestStreamUsageEstimatedWhenClosedEarly(t *testing.T) {
+	upstream := newStreamServer([]string{
+		`{"id":"1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{"role":"assistant","content":"aaaaaaaa"}}]}`,
+		`{"id":"1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{"content":"aaaa"}}]}`,
+	})
+	defer upstream.Close()
+
+	config := openai.DefaultConfig("test-key")
+	config.BaseURL = upstream.URL + "/v1"
+	kc := NewKeyClient("test-key", openai.NewClientWithConfig(config), 0, 0)
+	kc.CountTokens = func(model string, text string) int { return len(text) }
+
+	req := openai.ChatCompletionRequest{
+		Model: "gpt-4",
+		Messages: []openai.ChatCompletionMessage{{
+			Role: "user",
+			MultiContent: []openai.ChatMessagePart{
+				{Type: openai.ChatMessagePartTypeText, Text: "hi"},
+				{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "https://example.com/a.png", Detail: openai.ImageURLDetailLow}},
+			},
+		}},
+	}
+	stream, err := kc.ChatCompletionStream(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Failed to create stream: %v", err)
+	}
+	// The client goes away after the first chunk
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Unexpected stream error: %v", err)
+	}
+	stream.Close()
+	stream.Close()
+
+	// "user" and "hi", the message formatting and reply priming, the low detail image, and the received completion
+	expected := TokenUsage{PromptTokens: 6 + 3 + 3 + 85, CompletionTokens: 8}
+	expected.TotalTokens = expected.PromptTokens + expected.CompletionTokens
+	if tokens := kc.TokenUsage("gpt-4"); tokens != expected {
+		t.Errorf("Expected the usage until the stream was closed to be estimated once, got %+v, want %+v", tokens, expected)
+	}
+}
+
+func TestStreamUsageReconciled(t *testing.T) {
+	tests := []struct {
+		name     string
+		chunks   []string
+		expected TokenUsage
+	}{
+		{
+			name: "usage in a final chunk without choices or total",
+			chunks: []string{
+				`{"id":"1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{"content":"aaaa"}}]}`,
+				`{"id":"1","object":"chat.completion.chunk","model":"gpt-4","choices":[],"usage":{"prompt_tokens":20,"completion_tokens":7}}`,
+			},
+			expected: TokenUsage{PromptTokens: 20, CompletionTokens: 7, TotalTokens: 27},
+		},
+		{
+			name: "prompt and completion tokens reported in separate chunks",
+			chunks: []string{
+				`{"id":"1","object":"chat.completion.chunk","model":"gpt-4","choices":[],"usage":{"prompt_tokens":20,"completion_tokens":0,"total_tokens":20}}`,
+				`{"id":"1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{"content":"aaaa"}}]}`,
+				`{"id":"1","object":"chat.completion.chunk","model":"gpt-4","choices":[],"usage":{"prompt_tokens":20,"completion_tokens":7,"total_tokens":27}}`,
+			},
+			expected: TokenUsage{PromptTokens: 20, CompletionTokens: 7, TotalTokens: 27},
+		},
+		{
+			name: "completion tokens never reported",
+			chunks: []string{
+				`{"id":"1","object":"chat.completion.chunk","model":"gpt-4","choices":[],"usage":{"prompt_tokens":20,"completion_tokens":0,"total_tokens":20}}`,
+				`{"id":"1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{"content":"aaaa"}}]}`,
+			},
+			expected: TokenUsage{PromptTokens: 20, CompletionTokens: 4, TotalTokens: 24},
+		},
+		{
+			name: "total reported without its breakdown",
+			chunks: []string{
+				`{"id":"1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{"content":"aaaa"}}],"usage":{"total_tokens":30}}`,
+			},
+			expected: TokenUsage{TotalTokens: 30},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newStreamServer(tt.chunks)
+			defer upstream.Close()
+
+			config := openai.DefaultConfig("test-key")
+			config.BaseURL = upstream.URL + "/v1"
+			kc := NewKeyClient("test-key", openai.NewClientWithConfig(config), 0, 0)
+			kc.CountTokens = func(model string, text string) int { return len(text) }
+
+			stream, err := kc.ChatCompletionStream(context.Background(), openai.ChatCompletionRequest{Model: "gpt-4"})
+			if err != nil {
+				t.Fatalf("Failed to create stream: %v", err)
+			}
+			for {
+				if _, err := stream.Recv(); err != nil {
+					break
+				}
+			}
+			stream.Close()
+
+			if tokens := kc.TokenUsage("gpt-4"); tokens != tt.expected {
+				t.Errorf("Expected usage %+v, got %+v", tt.expected, tokens)
+			}
+			if usage := stream.Usage(); usage.TotalTokens != tt.expected.TotalTokens {
+				t.Errorf("Expected stream usage of %d tokens, got %+v", tt.expected.TotalTokens, usage)
+			}
+		})
+	}
+}
+
+func TestErrorPenaltyDecay(t *testing.T) {
+	kc := NewKeyClient("key", nil, 1000, 0)
+	kc.recordError("gpt-4o", errors.New("upstream error"))
+	if usage := kc.Usage("gpt-4o"); usage != 1000 {
+		t.Errorf("Expected the error penalty counted for good without a half-life, got %d", usage)
+	}
+
+	kc = NewKeyClient("key", nil, 1000, 0)
+	kc.ErrorPenaltyHalfLife = time.Hour
+	kc.recordUsage(UsageRecord{Model: "gpt-4o", PromptTokens: 70, CompletionTokens: 30, TotalTokens: 100})
+	kc.recordError("gpt-4o", errors.New("upstream error"))
+	if usage := kc.BalanceUsage("gpt-4o", BalanceTotal); usage != 1100 {
+		t.Errorf("Expected the fresh error penalty in full, got %d", usage)
+	}
+
+	// An hour later half of the penalty is left, and a new error adds to what is left
+	kc.errorPenalties["gpt-4o"] = decayingPenalty{value: 1000, at: time.Now().Add(-time.Hour)}
+	if usage, penalties := kc.BalanceUsage("gpt-4o", BalanceTotal), kc.Penalties("gpt-4o"); usage != 600 || penalties != 500 {
+		t.Errorf("Expected half of the penalty after one half-life, got usage %d and penalties %d", usage, penalties)
+	}
+	kc.errorPenalties["gpt-4o"] = decayingPenalty{value: 1000, at: time.Now().Add(-2 * time.Hour)}
+	kc.recordError("gpt-4o", errors.New("upstream error"))
+	if usage := kc.Usage("gpt-4o"); usage != 1350 {
+		t.Errorf("Expected a quarter of the old penalty plus the new one, got %d", usage)
+	}
+	if usage := kc.ModelUsage()["gpt-4o"]; usage != 1350 {
+		t.Errorf("Expected the decaying penalty in the model usage, got %d", usage)
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: %s\n\n", toolCallStreamChunks[0])
+		w.(http.Flusher).Flush()
+		// The provider stalls after the first chunk
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	config := openai.DefaultConfig("test-key")
+	config.BaseURL = upstream.URL + "/v1"
+	config.HTTPClient = NewHTTPClient(time.Second, 50*time.Millisecond)
+	kc := NewKeyClient("test-key", openai.NewClientWithConfig(config), 0, 0)
+
+	stream, err := kc.ChatCompletionStream(context.Background(), openai.ChatCompletionRequest{Model: "gpt-4"})
+	if err != nil {
+		t.Fatalf("Failed to create stream: %v", err)
+	}
+	defer stream.Close()
+	if _, _, err := stream.RecvRaw(); err != nil {
+		t.Fatalf("Expected the first chunk, got %v", err)
+	}
+	started := time.Now()
+	if _, _, err := stream.RecvRaw(); !errors.Is(err, ErrStreamIdle) {
+		t.Errorf("Expected the idle stream to fail with ErrStreamIdle, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Expected the idle stream to fail after the idle timeout, took %s", elapsed)
+	}
+}
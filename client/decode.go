@@ -0,0 +1,60 @@
+package client
+
+import (
+	"encoding/json"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// DecodeChatCompletionRequest decodes a chat completion request body.
+// Unlike plain unmarshalling into go-openai types, the json_schema of a response_format is kept
+// as raw JSON: go-openai only accepts the subset of JSON Schema its Definition type can hold.
+func DecodeChatCompletionRequest(body []byte) (openai.ChatCompletionRequest, error) {
+	var req openai.ChatCompletionRequest
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return req, err
+	}
+	rawFormat, hasFormat := fields["response_format"]
+	if hasFormat {
+		delete(fields, "response_format")
+		stripped, err := json.Marshal(fields)
+		if err != nil {
+			return req, err
+		}
+		body = stripped
+	}
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		return req, err
+	}
+	if !hasFormat || string(rawFormat) == "null" {
+		return req, nil
+	}
+
+	var format struct {
+		Type       openai.ChatCompletionResponseFormatType `json:"type"`
+		JSONSchema *struct {
+			Name        string          `json:"name"`
+			Description string          `json:"description,omitempty"`
+			Schema      json.RawMessage `json:"schema"`
+			Strict      bool            `json:"strict"`
+		} `json:"json_schema"`
+	}
+	if err := json.Unmarshal(rawFormat, &format); err != nil {
+		return req, err
+	}
+	req.ResponseFormat = &openai.ChatCompletionResponseFormat{Type: format.Type}
+	if format.JSONSchema != nil {
+		req.ResponseFormat.JSONSchema = &openai.ChatCompletionResponseFormatJSONSchema{
+			Name:        format.JSONSchema.Name,
+			Description: format.JSONSchema.Description,
+			Strict:      format.JSONSchema.Strict,
+		}
+		if len(format.JSONSchema.Schema) > 0 {
+			req.ResponseFormat.JSONSchema.Schema = format.JSONSchema.Schema
+		}
+	}
+	return req, nil
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// rateLimitCooldown is how long a key is reported as rate limited after the provider rejected a request with status 429
+const rateLimitCooldown = time.Minute
+
+// KeyHealth is a snapshot of the request outcomes and state of a key
+type KeyHealth struct {
+	Requests    int64
+	Errors      int64
+	LastError   string
+	LastErrorAt time.Time
+	// Drained keys receive no new requests
+	Drained bool
+	// RateLimitedUntil is the end of the cooldown after the provider last rate limited the key
+	RateLimitedUntil time.Time
+	// Probe is the result of the latest probe, nil if the key was never probed
+	Probe *ProbeResult
+}
+
+// recordRequest records a request sent with the key
+func (kc *KeyClient) recordRequest() {
+	kc.healthMutex.Lock()
+	defer kc.healthMutex.Unlock()
+	kc.health.Requests++
+}
+
+// recordError records a failed request and applies the error penalty to the model
+func (kc *KeyClient) recordError(model string, err error) {
+	kc.PenalizeError(model, kc.errorPenalty)
+
+	kc.healthMutex.Lock()
+	defer kc.healthMutex.Unlock()
+	kc.health.Errors++
+	kc.health.LastError = err.Error()
+	kc.health.LastErrorAt = time.Now()
+	if isRateLimit(err) {
+		kc.health.RateLimitedUntil = kc.health.LastErrorAt.Add(rateLimitCooldown)
+	}
+}
+
+// isRateLimit reports whether err is a provider's response with status 429
+func isRateLimit(err error) bool {
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr.HTTPStatusCode == http.StatusTooManyRequests
+	case errors.As(err, &reqErr):
+		return reqErr.HTTPStatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// RateLimited reports whether the provider rate limited the key within the last minute
+func (kc *KeyClient) RateLimited() bool {
+	kc.healthMutex.Lock()
+	defer kc.healthMutex.Unlock()
+	return time.Now().Before(kc.health.RateLimitedUntil)
+}
+
+// Health returns a snapshot of the key's request outcomes and state
+func (kc *KeyClient) Health() KeyHealth {
+	kc.healthMutex.Lock()
+	defer kc.healthMutex.Unlock()
+	health := kc.health
+	if health.Probe != nil {
+		probe := *health.Probe
+		health.Probe = &probe
+	}
+	return health
+}
+
+// SetDrained drains or undrains the key. Requests in flight are not affected.
+func (kc *KeyClient) SetDrained(drained bool) {
+	kc.healthMutex.Lock()
+	defer kc.healthMutex.Unlock()
+	kc.health.Drained = drained
+}
+
+// Drained reports whether the key is drained
+func (kc *KeyClient) Drained() bool {
+	kc.healthMutex.Lock()
+	defer kc.healthMutex.Unlock()
+	return kc.health.Drained
+}
+
+// ModelUsage returns a copy of the usage counts per model, including their decaying error penalties
+func (kc *KeyClient) ModelUsage() map[string]int64 {
+	kc.usageMutex.RLock()
+	defer kc.usageMutex.RUnlock()
+	usage := make(map[string]int64, len(kc.modelUsage))
+	for model, tokens := range kc.modelUsage {
+		usage[model] = tokens
+	}
+	for model := range kc.errorPenalties {
+		usage[model] += kc.decayedPenalty(model)
+	}
+	return usage
+}
+
+// ModelTokenUsage returns a copy of the tokens by kind per model
+func (kc *KeyClient) ModelTokenUsage() map[string]TokenUsage {
+	kc.usageMutex.RLock()
+	defer kc.usageMutex.RUnlock()
+	tokens := make(map[string]TokenUsage, len(kc.modelTokens))
+	for model, usage := range kc.modelTokens {
+		tokens[model] = usage
+	}
+	return tokens
+}
+
+// ModelCost returns a copy of the accumulated cost in USD per model
+func (kc *KeyClient) ModelCost() map[string]float64 {
+	kc.usageMutex.RLock()
+	defer kc.usageMutex.RUnlock()
+	cost := make(map[string]float64, len(kc.modelCost))
+	for model, value := range kc.modelCost {
+		cost[model] = value
+	}
+	return cost
+}
+
+// ProbeResult is the outcome of probing a key against its provider
+type ProbeResult struct {
+	// Reachable reports whether the provider answered
+	Reachable bool
+	// Valid reports whether the provider accepted the key
+	Valid      bool
+	StatusCode int
+	Error      string
+	ProbedAt   time.Time
+}
+
+// Probe checks the provider's reachability and the key's validity by listing the provider's models,
+// and records the result in the key's health
+func (kc *KeyClient) Probe(ctx context.Context, baseURL string) ProbeResult {
+	result := ProbeResult{ProbedAt: time.Now()}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/models", nil)
+	if err == nil {
+		req.Header.Set("Authorization", "Bearer "+kc.APIKey)
+		var resp *http.Response
+		if resp, err = http.DefaultClient.Do(req); err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			result.Reachable = true
+			result.StatusCode = resp.StatusCode
+			// Providers without a models endpoint still prove reachable, and rate limits imply a valid key
+			result.Valid = resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden && resp.StatusCode < 500
+			if !result.Valid {
+				result.Error = fmt.Sprintf("provider responded with status %d", resp.StatusCode)
+			}
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	kc.healthMutex.Lock()
+	defer kc.healthMutex.Unlock()
+	kc.health.Probe = &result
+	return result
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"math"
+	"time"
+)
+
+// decayingPenalty is the error penalty of a model as of a point in time, halving every ErrorPenaltyHalfLife after
+type decayingPenalty struct {
+	value float64
+	at    time.Time
+}
+
+// valueAt returns what is left of the penalty at a point in time
+func (p decayingPenalty) valueAt(now time.Time, halfLife time.Duration) float64 {
+	return p.value * math.Exp2(-float64(now.Sub(p.at))/float64(halfLife))
+}
+
+// PenalizeError adds an error penalty to the usage of a model: for good, or decaying over ErrorPenaltyHalfLife
+// when set, so that a key that failed for a while is not deprioritized forever
+func (kc *KeyClient) PenalizeError(model string, penalty int64) {
+	if kc.ErrorPenaltyHalfLife <= 0 {
+		kc.IncrementUsage(model, penalty)
+		return
+	}
+	kc.usageMutex.Lock()
+	defer kc.usageMutex.Unlock()
+	if kc.errorPenalties == nil {
+		kc.errorPenalties = make(map[string]decayingPenalty)
+	}
+	now := time.Now()
+	kc.errorPenalties[model] = decayingPenalty{
+		value: kc.errorPenalties[model].valueAt(now, kc.ErrorPenaltyHalfLife) + float64(penalty),
+		at:    now,
+	}
+}
+
+// decayedPenalty returns what is left of the decaying error penalties of a model. The caller holds usageMutex.
+func (kc *KeyClient) decayedPenalty(model string) int64 {
+	penalty, ok := kc.errorPenalties[model]
+	if !ok {
+		return 0
+	}
+	return int64(math.Round(penalty.valueAt(time.Now(), kc.ErrorPenaltyHalfLife)))
+}
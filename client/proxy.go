@@ -0,0 +1,29 @@
+package client
+
+import (
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// NewProxy returns a reverse proxy that forwards OpenAI API requests under /v1 to the provider's
+// base URL, replacing the caller's credentials with the key client's API key
+func NewProxy(baseURL string, kc *KeyClient) (*httputil.ReverseProxy, error) {
+	target, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Path = strings.TrimPrefix(pr.In.URL.Path, "/v1")
+			pr.Out.URL.RawPath = ""
+			pr.SetURL(target)
+
+			pr.Out.Header.Set("Authorization", "Bearer "+kc.APIKey)
+			pr.Out.Header.Del("x-api-key")
+			// Let the transport negotiate compression so response bodies can be inspected
+			pr.Out.Header.Del("Accept-Encoding")
+		},
+	}, nil
+}
@@ -0,0 +1,212 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"llm-router/tracing"
+	"net/http"
+	"strings"
+)
+
+type rawRequestKey struct{}
+
+// WithRawRequest records the client's original chat completion request body in the context.
+// Requests sent with this context forward every field the router did not change exactly as
+// the client sent it, including content go-openai cannot represent (e.g. input_audio parts).
+func WithRawRequest(ctx context.Context, body []byte) context.Context {
+	return context.WithValue(ctx, rawRequestKey{}, body)
+}
+
+// rawRequest returns the original request body recorded in the context, if any
+func rawRequest(ctx context.Context) []byte {
+	body, _ := ctx.Value(rawRequestKey{}).([]byte)
+	return body
+}
+
+type rawResponseKey struct{}
+
+// rawResponse holds the body of a non-streaming response as sent by the provider
+type rawResponse struct {
+	body []byte
+}
+
+// withRawResponse asks the HTTPDoer to record the chat completion response body in the returned holder
+func withRawResponse(ctx context.Context) (context.Context, *rawResponse) {
+	holder := &rawResponse{}
+	return context.WithValue(ctx, rawResponseKey{}, holder), holder
+}
+
+// HTTPDoer restores the original request fields recorded with WithRawRequest
+// in the chat completion requests sent by go-openai
+type HTTPDoer struct {
+	Client *http.Client
+	// Request parameters the provider does not support, removed before sending
+	UnsupportedParams []string
+}
+
+// NewHTTPDoer creates an HTTPDoer to be used as the HTTPClient of a go-openai client configuration
+func NewHTTPDoer(httpClient *http.Client) *HTTPDoer {
+	return &HTTPDoer{Client: httpClient}
+}
+
+// Do sends the request with the trace context of its context, restoring the original request fields first
+func (d *HTTPDoer) Do(req *http.Request) (*http.Response, error) {
+	tracing.Inject(req.Context(), req.Header)
+	if req.Body == nil || req.Method != http.MethodPost || !strings.HasSuffix(req.URL.Path, "/chat/completions") {
+		return d.Client.Do(req)
+	}
+	original := rawRequest(req.Context())
+	if original == nil && len(d.UnsupportedParams) == 0 {
+		return d.doCapture(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if original != nil {
+		if merged, err := restoreRequest(original, body); err == nil {
+			body = merged
+		}
+	}
+	if len(d.UnsupportedParams) > 0 {
+		if stripped, err := removeParams(body, d.UnsupportedParams); err == nil {
+			body = stripped
+		}
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	return d.doCapture(req)
+}
+
+// doCapture sends the request and records the identifiers of the response if requested with withUpstreamIDs
+// and its body if requested with withRawResponse
+func (d *HTTPDoer) doCapture(req *http.Request) (*http.Response, error) {
+	resp, err := d.Client.Do(req)
+	if err == nil {
+		recordUpstreamIDs(req.Context(), resp.Header)
+	}
+	holder, _ := req.Context().Value(rawResponseKey{}).(*rawResponse)
+	if err != nil || holder == nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	holder.body = body
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// removeParams removes top-level parameters from a JSON request body
+func removeParams(body []byte, params []string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	removed := false
+	for _, param := range params {
+		if _, ok := fields[param]; ok {
+			delete(fields, param)
+			removed = true
+		}
+	}
+	if !removed {
+		return body, nil
+	}
+	return json.Marshal(fields)
+}
+
+// restoreRequest merges the original request body into the body encoded by go-openai
+func restoreRequest(original []byte, encoded []byte) ([]byte, error) {
+	// Re-encode the original request the same way to see what the router left unchanged
+	req, err := DecodeChatCompletionRequest(original)
+	if err != nil {
+		return nil, err
+	}
+	canonical, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return mergeRaw(original, canonical, encoded), nil
+}
+
+// mergeRaw merges JSON values where canonical is the original value after a decode/encode round trip
+// through go-openai types and encoded is the value actually being sent. Parts the router left unchanged
+// (encoded equals canonical) are taken verbatim from the original; changed parts are taken from encoded.
+func mergeRaw(original, canonical, encoded json.RawMessage) json.RawMessage {
+	if bytes.Equal(canonical, encoded) {
+		return original
+	}
+
+	var origObj, canonObj, encObj map[string]json.RawMessage
+	if json.Unmarshal(original, &origObj) == nil && json.Unmarshal(canonical, &canonObj) == nil && json.Unmarshal(encoded, &encObj) == nil &&
+		origObj != nil && canonObj != nil && encObj != nil {
+		merged := make(map[string]json.RawMessage, len(encObj))
+		for k, enc := range encObj {
+			orig, inOrig := origObj[k]
+			canon, inCanon := canonObj[k]
+			if inOrig && inCanon {
+				merged[k] = mergeRaw(orig, canon, enc)
+			} else {
+				merged[k] = enc
+			}
+		}
+		for k, orig := range origObj {
+			// Fields lost in the round trip (unknown to go-openai or zero values dropped by omitempty)
+			// are restored, while fields the router removed stay removed
+			if _, inCanon := canonObj[k]; !inCanon {
+				if _, inEnc := encObj[k]; !inEnc {
+					merged[k] = orig
+				}
+			}
+		}
+		result, err := json.Marshal(merged)
+		if err != nil {
+			return encoded
+		}
+		return result
+	}
+
+	var origArr, canonArr, encArr []json.RawMessage
+	if json.Unmarshal(original, &origArr) == nil && json.Unmarshal(canonical, &canonArr) == nil && json.Unmarshal(encoded, &encArr) == nil &&
+		len(origArr) == len(canonArr) {
+		merged := make([]json.RawMessage, len(encArr))
+		if len(encArr) == len(canonArr) {
+			// Same length: elements correspond by position
+			for i := range encArr {
+				merged[i] = mergeRaw(origArr[i], canonArr[i], encArr[i])
+			}
+		} else {
+			// Elements were inserted or removed: match unchanged elements in order
+			next := 0
+			for i, enc := range encArr {
+				merged[i] = enc
+				for j := next; j < len(canonArr); j++ {
+					if bytes.Equal(canonArr[j], enc) {
+						merged[i] = origArr[j]
+						next = j + 1
+						break
+					}
+				}
+			}
+		}
+		result, err := json.Marshal(merged)
+		if err != nil {
+			return encoded
+		}
+		return result
+	}
+
+	return encoded
+}
@@ -0,0 +1,254 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"llm-router/tracing"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRawRequestRoundTrip(t *testing.T) {
+	original := `{
+		"model": "group",
+		"temperature": 0,
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "text", "text": "Transcribe and describe"},
+				{"type": "input_audio", "input_audio": {"data": "UklGRg==", "format": "wav"}},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,AAAA", "detail": "high"}}
+			]}
+		],
+		"modalities": ["text"]
+	}`
+
+	var received map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &received)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"1","choices":[],"usage":{"total_tokens":1}}`))
+	}))
+	defer upstream.Close()
+
+	config := openai.DefaultConfig("test-key")
+	config.BaseURL = upstream.URL + "/v1"
+	config.HTTPClient = NewHTTPDoer(&http.Client{})
+	kc := NewKeyClient("test-key", openai.NewClientWithConfig(config), 0, 0)
+
+	var req openai.ChatCompletionRequest
+	if err := json.Unmarshal([]byte(original), &req); err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+	// The router rewrites the model and prepends a system message
+	req.Model = "gpt-4o"
+	req.Messages = append([]openai.ChatCompletionMessage{{Role: "system", Content: "Be brief"}}, req.Messages...)
+
+	ctx := WithRawRequest(context.Background(), []byte(original))
+	if _, err := kc.ChatCompletion(ctx, req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if received["model"] != "gpt-4o" {
+		t.Errorf("Expected rewritten model 'gpt-4o', got %v", received["model"])
+	}
+	if temperature, ok := received["temperature"]; !ok || temperature != float64(0) {
+		t.Errorf("Expected explicit temperature 0 to be kept, got %v", temperature)
+	}
+	if _, ok := received["modalities"]; !ok {
+		t.Errorf("Expected unknown field 'modalities' to be kept")
+	}
+
+	messages := received["messages"].([]any)
+	if len(messages) != 2 || messages[0].(map[string]any)["role"] != "system" {
+		t.Fatalf("Expected system message followed by the user message, got %v", messages)
+	}
+	parts := messages[1].(map[string]any)["content"].([]any)
+	audio, ok := parts[1].(map[string]any)["input_audio"].(map[string]any)
+	if !ok || audio["data"] != "UklGRg==" || audio["format"] != "wav" {
+		t.Errorf("Expected input_audio part to survive unmodified, got %v", parts[1])
+	}
+	image := parts[2].(map[string]any)["image_url"].(map[string]any)
+	if image["detail"] != "high" {
+		t.Errorf("Expected image_url part to survive unmodified, got %v", parts[2])
+	}
+}
+
+func TestJSONSchemaResponseFormatPassthrough(t *testing.T) {
+	// Type arrays and numeric enums cannot be decoded into go-openai's schema Definition
+	original := `{"model":"group","messages":[{"role":"user","content":"hi"}],"response_format":{"type":"json_schema","json_schema":{"name":"answer","strict":true,"schema":{"type":"object","properties":{"value":{"type":["string","null"]},"level":{"enum":[1,2,3]}},"required":["value","level"],"additionalProperties":false}}}}`
+
+	req, err := DecodeChatCompletionRequest([]byte(original))
+	if err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+	if req.ResponseFormat == nil || req.ResponseFormat.JSONSchema == nil || req.ResponseFormat.JSONSchema.Name != "answer" {
+		t.Fatalf("Expected json_schema response format, got %+v", req.ResponseFormat)
+	}
+
+	var received map[string]json.RawMessage
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &received)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"1","choices":[],"usage":{"total_tokens":1}}`))
+	}))
+	defer upstream.Close()
+
+	config := openai.DefaultConfig("test-key")
+	config.BaseURL = upstream.URL + "/v1"
+	config.HTTPClient = NewHTTPDoer(&http.Client{})
+	kc := NewKeyClient("test-key", openai.NewClientWithConfig(config), 0, 0)
+
+	req.Model = "gpt-4o"
+	ctx := WithRawRequest(context.Background(), []byte(original))
+	if _, err := kc.ChatCompletion(ctx, req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var sent, expected any
+	json.Unmarshal(received["response_format"], &sent)
+	var originalFields map[string]json.RawMessage
+	json.Unmarshal([]byte(original), &originalFields)
+	json.Unmarshal(originalFields["response_format"], &expected)
+	if !reflect.DeepEqual(sent, expected) {
+		t.Errorf("Expected response_format to be forwarded unchanged, got %s", received["response_format"])
+	}
+}
+
+func TestLogprobsPassthrough(t *testing.T) {
+	response := `{"id":"1","object":"chat.completion","created":1,"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"Hi"},"logprobs":{"content":[{"token":"Hi","logprob":-0.01,"bytes":[72,105],"top_logprobs":[{"token":"Hi","logprob":-0.01,"bytes":[72,105]}]}],"refusal":null},"finish_reason":"stop"}],"usage":{"prompt_tokens":5,"completion_tokens":1,"total_tokens":6}}`
+
+	var received map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = nil
+		json.Unmarshal(body, &received)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(response))
+	}))
+	defer upstream.Close()
+
+	original := `{"model":"group","messages":[{"role":"user","content":"hi"}],"logprobs":true,"top_logprobs":1}`
+	req, err := DecodeChatCompletionRequest([]byte(original))
+	if err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+	req.Model = "gpt-4o"
+
+	config := openai.DefaultConfig("test-key")
+	config.BaseURL = upstream.URL + "/v1"
+	doer := NewHTTPDoer(&http.Client{})
+	config.HTTPClient = doer
+	kc := NewKeyClient("test-key", openai.NewClientWithConfig(config), 0, 0)
+
+	resp, err := kc.ChatCompletion(WithRawRequest(context.Background(), []byte(original)), req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if received["logprobs"] != true || received["top_logprobs"] != float64(1) {
+		t.Errorf("Expected logprobs options to be forwarded, got %v", received)
+	}
+	encoded, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("Failed to encode response: %v", err)
+	}
+	if string(encoded) != response {
+		t.Errorf("Expected response to be relayed unchanged, got %s", encoded)
+	}
+
+	// Providers that do not support logprobs never receive the options
+	doer.UnsupportedParams = []string{"logprobs", "top_logprobs"}
+	if _, err := kc.ChatCompletion(WithRawRequest(context.Background(), []byte(original)), req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := received["logprobs"]; ok {
+		t.Errorf("Expected logprobs to be removed, got %v", received)
+	}
+	if _, ok := received["top_logprobs"]; ok {
+		t.Errorf("Expected top_logprobs to be removed, got %v", received)
+	}
+}
+
+func TestUpstreamIDs(t *testing.T) {
+	fail := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", "req_123")
+		w.Header().Set("CF-Ray", "8a1b2c3d4e5f-AMS")
+		w.Header().Set("Content-Type", "application/json")
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":{"message":"The server had an error","type":"server_error"}}`))
+			return
+		}
+		w.Write([]byte(`{"id":"1","choices":[],"usage":{"total_tokens":1}}`))
+	}))
+	defer upstream.Close()
+
+	config := openai.DefaultConfig("test-key")
+	config.BaseURL = upstream.URL + "/v1"
+	config.HTTPClient = NewHTTPDoer(&http.Client{})
+	kc := NewKeyClient("test-key", openai.NewClientWithConfig(config), 0, 0)
+	req := openai.ChatCompletionRequest{Model: "gpt-4o"}
+
+	resp, err := kc.ChatCompletion(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]string{"x-request-id": "req_123", "cf-ray": "8a1b2c3d4e5f-AMS"}
+	if !reflect.DeepEqual(resp.UpstreamIDs, expected) {
+		t.Errorf("Expected the identifiers of the response, got %v", resp.UpstreamIDs)
+	}
+
+	fail = true
+	_, err = kc.ChatCompletion(context.Background(), req)
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatusCode != http.StatusInternalServerError {
+		t.Fatalf("Expected the provider's error, got %v", err)
+	}
+	if ids := UpstreamIDs(err); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected the identifiers of the failed request, got %v", ids)
+	}
+}
+
+func TestTraceContextPropagated(t *testing.T) {
+	var traceparent, tracestate string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent, tracestate = r.Header.Get("traceparent"), r.Header.Get("tracestate")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"1","choices":[],"usage":{"total_tokens":1}}`))
+	}))
+	defer upstream.Close()
+
+	config := openai.DefaultConfig("test-key")
+	config.BaseURL = upstream.URL + "/v1"
+	config.HTTPClient = NewHTTPDoer(&http.Client{})
+	kc := NewKeyClient("test-key", openai.NewClientWithConfig(config), 0, 0)
+
+	caller := http.Header{}
+	caller.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	caller.Set("tracestate", "congo=t61rcWkgMzE")
+	ctx := tracing.Extract(context.Background(), caller)
+	if _, err := kc.ChatCompletion(ctx, openai.ChatCompletionRequest{Model: "gpt-4o"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if traceparent != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" || tracestate != "congo=t61rcWkgMzE" {
+		t.Errorf("Expected the trace context to be passed on, got %q and %q", traceparent, tracestate)
+	}
+
+	if _, err := kc.ChatCompletion(context.Background(), openai.ChatCompletionRequest{Model: "gpt-4o"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	received := http.Header{}
+	received.Set("traceparent", traceparent)
+	if sc := trace.SpanContextFromContext(tracing.Extract(context.Background(), received)); !sc.IsValid() || sc.TraceID().String() == "4bf92f3577b34da6a3ce929d0e0e4736" || tracestate != "" {
+		t.Errorf("Expected a new trace context, got %q and %q", traceparent, tracestate)
+	}
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// rerankUsage is the usage reported by rerank providers: Jina-style usage or Cohere-style billed units
+type rerankUsage struct {
+	Usage *struct {
+		TotalTokens int64 `json:"total_tokens"`
+	} `json:"usage"`
+	Meta *struct {
+		BilledUnits *struct {
+			InputTokens  int64 `json:"input_tokens"`
+			OutputTokens int64 `json:"output_tokens"`
+			SearchUnits  int64 `json:"search_units"`
+		} `json:"billed_units"`
+	} `json:"meta"`
+}
+
+// tokens returns the reported token usage, or 0 if the provider reported none
+func (u rerankUsage) tokens() int64 {
+	if u.Usage != nil && u.Usage.TotalTokens > 0 {
+		return u.Usage.TotalTokens
+	}
+	if u.Meta != nil && u.Meta.BilledUnits != nil {
+		return u.Meta.BilledUnits.InputTokens + u.Meta.BilledUnits.OutputTokens
+	}
+	return 0
+}
+
+// Rerank sends a rerank request (Cohere/Jina shape) for the model to the provider's /rerank endpoint
+// and returns the provider's response body. The request body is forwarded as is except for the model.
+// estimatedTokens is counted as usage when the provider does not report any.
+func (kc *KeyClient) Rerank(ctx context.Context, baseURL string, model string, body []byte, estimatedTokens int64) ([]byte, error) {
+	kc.IncrementUsage(model, kc.requestPenalty)
+	kc.recordRequest()
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	fields["model"], _ = json.Marshal(model)
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(baseURL, "/")+"/rerank", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+kc.APIKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		kc.recordError(model, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		kc.recordError(model, err)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("rerank request failed with status %d: %s", resp.StatusCode, respBody)
+		kc.recordError(model, err)
+		return nil, err
+	}
+
+	var usage rerankUsage
+	_ = json.Unmarshal(respBody, &usage)
+	tokens := usage.tokens()
+	if tokens == 0 {
+		tokens = estimatedTokens
+	}
+	record := attributedRecord(ctx, model)
+	record.Requests = 1
+	record.PromptTokens = tokens
+	record.TotalTokens = tokens
+	kc.recordUsage(record)
+
+	return respBody, nil
+}
@@ -0,0 +1,238 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"strings"
+)
+
+// Kinds of the usage counters exchanged by SyncUsage
+const (
+	counterUsage      = "usage"
+	counterPrompt     = "prompt"
+	counterCached     = "cached"
+	counterCompletion = "completion"
+	counterReasoning  = "reasoning"
+	counterTotal      = "total"
+	// counterCost counts the cost in billionths of a USD, precise enough for the price of a single token
+	counterCost = "cost"
+)
+
+// nanosPerUSD is the number of units of counterCost in a USD
+const nanosPerUSD = 1e9
+
+// costNanos returns a cost in USD in units of counterCost
+func costNanos(cost float64) int64 {
+	return int64(math.Round(cost * nanosPerUSD))
+}
+
+// tokenCounters are the kinds of the token counters of a model
+var tokenCounters = []string{counterPrompt, counterCached, counterCompletion, counterReasoning, counterTotal}
+
+// counterField names the counter of a kind for a model, e.g. "prompt/gpt-4o"
+func counterField(kind string, model string) string {
+	return kind + "/" + model
+}
+
+// countLocal counts a change of a counter made by this instance towards the next sync and the
+// current usage window, apart from the cost, which keeps accumulating across windows. The caller holds
+// usageMutex.
+func (kc *KeyClient) countLocal(kind string, model string, delta int64) {
+	if delta == 0 {
+		return
+	}
+	field := counterField(kind, model)
+	kc.addPending(field, delta)
+	if n := len(kc.windows); n > 0 && kind != counterCost {
+		kc.windows[n-1][field] += delta
+	}
+}
+
+// addPending counts a delta of a counter towards the next sync. The caller holds usageMutex.
+func (kc *KeyClient) addPending(field string, delta int64) {
+	if kc.pending == nil {
+		kc.pending = make(map[string]int64)
+	}
+	kc.pending[field] += delta
+}
+
+// Windowed reports whether a counter exchanged by SyncUsage, named "kind/model", is counted per usage window,
+// as usage and tokens are, rather than accumulating across windows, as the cost does
+func Windowed(field string) bool {
+	kind, _, _ := strings.Cut(field, "/")
+	return kind != counterCost
+}
+
+// counter returns the value of a counter. The caller holds usageMutex.
+func (kc *KeyClient) counter(kind string, model string) int64 {
+	tokens := kc.modelTokens[model]
+	switch kind {
+	case counterUsage:
+		return kc.modelUsage[model]
+	case counterPrompt:
+		return tokens.PromptTokens
+	case counterCached:
+		return tokens.CachedTokens
+	case counterCompletion:
+		return tokens.CompletionTokens
+	case counterReasoning:
+		return tokens.ReasoningTokens
+	case counterTotal:
+		return tokens.TotalTokens
+	case counterCost:
+		return costNanos(kc.modelCost[model])
+	}
+	return 0
+}
+
+// setCounter sets the value of a counter. The caller holds usageMutex.
+func (kc *KeyClient) setCounter(kind string, model string, value int64) {
+	switch kind {
+	case counterUsage:
+		kc.modelUsage[model] = value
+		return
+	case counterCost:
+		kc.modelCost[model] = float64(value) / nanosPerUSD
+		return
+	}
+	tokens := kc.modelTokens[model]
+	switch kind {
+	case counterPrompt:
+		tokens.PromptTokens = value
+	case counterCached:
+		tokens.CachedTokens = value
+	case counterCompletion:
+		tokens.CompletionTokens = value
+	case counterReasoning:
+		tokens.ReasoningTokens = value
+	case counterTotal:
+		tokens.TotalTokens = value
+	default:
+		return
+	}
+	kc.modelTokens[model] = tokens
+}
+
+// UsageBatch is a batch of counter deltas synced by SyncUsage
+type UsageBatch struct {
+	// Source identifies the key state the batch comes from, and Seq the batch among those of the source,
+	// increasing, so that a batch retried after its reply was lost can be told from the next one
+	Source string
+	Seq    int64
+	Deltas map[string]int64
+}
+
+// SyncUsage exchanges the usage counted since the last sync for shared totals, so that several router
+// instances balance on the same counters. apply adds the deltas of the batch to the shared state, unless a
+// batch of the source with the same or a later sequence number was added already, and returns the shared
+// totals of all counters, keyed by "kind/model", where counters missing are zero, e.g. once the usage window
+// they were counted in ended. On error the batch is kept and retried as is by the next sync, so that a batch
+// added whose reply was lost is not added twice. Usage counted meanwhile waits for the sync after it.
+func (kc *KeyClient) SyncUsage(apply func(batch UsageBatch) (map[string]int64, error)) error {
+	kc.usageMutex.Lock()
+	if kc.unsynced == nil && len(kc.pending) > 0 {
+		kc.batches++
+		kc.unsynced = &UsageBatch{Source: kc.source, Seq: kc.batches, Deltas: kc.pending}
+		kc.pending = nil
+	}
+	batch := UsageBatch{Source: kc.source, Seq: kc.batches}
+	if kc.unsynced != nil {
+		batch = *kc.unsynced
+	}
+	kc.usageMutex.Unlock()
+
+	totals, err := apply(batch)
+
+	kc.usageMutex.Lock()
+	defer kc.usageMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	kc.unsynced = nil
+	for field, total := range totals {
+		kind, model, ok := strings.Cut(field, "/")
+		if !ok {
+			continue
+		}
+		// Usage counted while syncing is not part of the totals yet
+		kc.setCounter(kind, model, total+kc.pending[field])
+	}
+	reset := func(kind string, model string) {
+		field := counterField(kind, model)
+		if _, shared := totals[field]; !shared {
+			kc.setCounter(kind, model, kc.pending[field])
+		}
+	}
+	for model := range kc.modelUsage {
+		reset(counterUsage, model)
+	}
+	for model := range kc.modelTokens {
+		for _, kind := range tokenCounters {
+			reset(kind, model)
+		}
+	}
+	for model := range kc.modelCost {
+		reset(counterCost, model)
+	}
+	return nil
+}
+
+// randomID returns a random hexadecimal ID
+func randomID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// UsageSnapshot is the usage counted for a key per model, saved and restored to move it between router instances
+type UsageSnapshot struct {
+	Usage  map[string]int64
+	Tokens map[string]TokenUsage
+	Cost   map[string]float64
+}
+
+// SnapshotUsage returns a copy of the usage counted for the key, without its decaying error penalties
+func (kc *KeyClient) SnapshotUsage() UsageSnapshot {
+	kc.usageMutex.RLock()
+	defer kc.usageMutex.RUnlock()
+	snapshot := UsageSnapshot{
+		Usage:  make(map[string]int64, len(kc.modelUsage)),
+		Tokens: make(map[string]TokenUsage, len(kc.modelTokens)),
+		Cost:   make(map[string]float64, len(kc.modelCost)),
+	}
+	for model, usage := range kc.modelUsage {
+		snapshot.Usage[model] = usage
+	}
+	for model, tokens := range kc.modelTokens {
+		snapshot.Tokens[model] = tokens
+	}
+	for model, cost := range kc.modelCost {
+		snapshot.Cost[model] = cost
+	}
+	return snapshot
+}
+
+// RestoreUsage sets the counters of the models in a snapshot, leaving the other models unchanged. The changes
+// are counted towards the next sync, so that instances sharing the counters converge on the restored values.
+func (kc *KeyClient) RestoreUsage(snapshot UsageSnapshot) {
+	kc.usageMutex.Lock()
+	defer kc.usageMutex.Unlock()
+	restore := func(kind string, model string, value int64) {
+		kc.countLocal(kind, model, value-kc.counter(kind, model))
+		kc.setCounter(kind, model, value)
+	}
+	for model, usage := range snapshot.Usage {
+		restore(counterUsage, model, usage)
+	}
+	for model, tokens := range snapshot.Tokens {
+		restore(counterPrompt, model, tokens.PromptTokens)
+		restore(counterCached, model, tokens.CachedTokens)
+		restore(counterCompletion, model, tokens.CompletionTokens)
+		restore(counterReasoning, model, tokens.ReasoningTokens)
+		restore(counterTotal, model, tokens.TotalTokens)
+	}
+	for model, cost := range snapshot.Cost {
+		restore(counterCost, model, costNanos(cost))
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrStreamIdle ends the streams of providers that sent nothing for longer than the stream idle timeout
+var ErrStreamIdle = errors.New("stream idle timeout")
+
+// NewHTTPClient creates the HTTP client of a provider's requests, which fail when the provider takes longer
+// than requestTimeout to respond and, for streamed responses, sends nothing for longer than streamIdleTimeout.
+// Timeouts of 0 are not applied.
+func NewHTTPClient(requestTimeout time.Duration, streamIdleTimeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = requestTimeout
+	if streamIdleTimeout <= 0 {
+		return &http.Client{Transport: transport}
+	}
+	return &http.Client{Transport: &idleTimeoutTransport{base: transport, timeout: streamIdleTimeout}}
+}
+
+// idleTimeoutTransport applies the stream idle timeout to the bodies of streamed responses
+type idleTimeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *idleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		resp.Body = newIdleTimeoutBody(resp.Body, t.timeout)
+	}
+	return resp, err
+}
+
+// idleTimeoutBody closes a response body nothing was read from for longer than its timeout, failing the
+// pending read with ErrStreamIdle
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	idle    atomic.Bool
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration) *idleTimeoutBody {
+	b := &idleTimeoutBody{ReadCloser: body, timeout: timeout}
+	b.timer = time.AfterFunc(timeout, func() {
+		b.idle.Store(true)
+		body.Close()
+	})
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.idle.Load() {
+		return n, ErrStreamIdle
+	}
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// UpstreamIDHeaders are the response headers providers identify requests by, which their support asks for:
+// x-request-id (OpenAI and most others), request-id (Anthropic), apim-request-id (Azure OpenAI), and cf-ray
+// (providers behind Cloudflare)
+var UpstreamIDHeaders = []string{"x-request-id", "request-id", "apim-request-id", "cf-ray"}
+
+type upstreamIDsKey struct{}
+
+// upstreamIDs holds the identifiers a provider gave a request
+type upstreamIDs struct {
+	ids map[string]string
+}
+
+// withUpstreamIDs asks the HTTPDoer to record the identifiers of the chat completion response, successful or
+// not, in the returned holder
+func withUpstreamIDs(ctx context.Context) (context.Context, *upstreamIDs) {
+	holder := &upstreamIDs{}
+	return context.WithValue(ctx, upstreamIDsKey{}, holder), holder
+}
+
+// recordUpstreamIDs records the identifiers in the headers of a response if requested with withUpstreamIDs
+func recordUpstreamIDs(ctx context.Context, header http.Header) {
+	holder, _ := ctx.Value(upstreamIDsKey{}).(*upstreamIDs)
+	if holder == nil {
+		return
+	}
+	for _, name := range UpstreamIDHeaders {
+		if value := header.Get(name); value != "" {
+			if holder.ids == nil {
+				holder.ids = make(map[string]string)
+			}
+			holder.ids[name] = value
+		}
+	}
+}
+
+// UpstreamError is the error of a request the provider answered, with the identifiers it gave the request
+type UpstreamError struct {
+	// IDs are the identifiers by response header name, e.g. x-request-id
+	IDs map[string]string
+	Err error
+}
+
+func (e *UpstreamError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// withUpstreamIDsError wraps the error of a request in an UpstreamError, unless the provider gave no identifier
+func withUpstreamIDsError(err error, ids map[string]string) error {
+	if len(ids) == 0 {
+		return err
+	}
+	return &UpstreamError{IDs: ids, Err: err}
+}
+
+// UpstreamIDs returns the identifiers the provider gave the request that failed with err, nil if none
+func UpstreamIDs(err error) map[string]string {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamErr.IDs
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"llm-router/utils"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// UsageRecord is the usage of requests to a model
+type UsageRecord struct {
+	Model string
+	// Group the request was routed through, see WithGroup
+	Group string
+	// ClientKey is the name of the router client key the request was made with, see WithClientKey
+	ClientKey string
+	// Tenant the client key belongs to, see WithTenant
+	Tenant string
+	// User is the end user the request was made for, see WithEndUser
+	User             string
+	Requests         int64
+	PromptTokens     int64
+	CompletionTokens int64
+	// CachedTokens are the part of the prompt tokens read from the provider's prompt cache
+	CachedTokens int64
+	// ReasoningTokens are the part of the completion tokens spent on reasoning, as reported by the provider
+	ReasoningTokens int64
+	TotalTokens     int64
+	// Cost in USD of the tokens, set from the model's price when known
+	Cost float64
+}
+
+// TokenUsage is the accumulated tokens of a model by kind
+type TokenUsage struct {
+	PromptTokens     int64
+	CachedTokens     int64
+	CompletionTokens int64
+	ReasoningTokens  int64
+	TotalTokens      int64
+}
+
+// Token dimensions routing can balance on
+const (
+	BalanceTotal      = "total"
+	BalancePrompt     = "prompt"
+	BalanceCompletion = "completion"
+)
+
+// reasoningTokens returns the reasoning tokens reported in a usage, or 0 if none
+func reasoningTokens(usage *openai.Usage) int64 {
+	if usage.CompletionTokensDetails == nil {
+		return 0
+	}
+	return int64(usage.CompletionTokensDetails.ReasoningTokens)
+}
+
+// cachedTokens returns the prompt tokens read from the provider's prompt cache, reported as
+// prompt_tokens_details.cached_tokens, or as cache_read_input_tokens by Anthropic-compatible providers
+func cachedTokens(usage *openai.Usage, raw []byte) int64 {
+	var cached int64
+	if usage.PromptTokensDetails != nil {
+		cached = int64(usage.PromptTokensDetails.CachedTokens)
+	}
+	if cached == 0 && bytes.Contains(raw, []byte(`"cache_read_input_tokens"`)) {
+		var body struct {
+			Usage struct {
+				CacheReadInputTokens int64 `json:"cache_read_input_tokens"`
+			} `json:"usage"`
+		}
+		if json.Unmarshal(raw, &body) == nil {
+			cached = body.Usage.CacheReadInputTokens
+		}
+	}
+	return min(cached, int64(usage.PromptTokens))
+}
+
+// Price is the price of a model in USD per million tokens
+type Price struct {
+	Input  float64
+	Output float64
+	// CachedInput is the discounted price of prompt tokens read from the prompt cache, Input when 0
+	CachedInput float64
+}
+
+// Cost returns the cost of a record's tokens. Tokens not reported as completion tokens,
+// e.g. when a provider only reports the total, are priced as input.
+func (p Price) Cost(record UsageRecord) float64 {
+	prompt := record.PromptTokens
+	if rest := record.TotalTokens - record.PromptTokens - record.CompletionTokens; rest > 0 {
+		prompt += rest
+	}
+	cached := min(record.CachedTokens, prompt)
+	cachedPrice := p.Input
+	if p.CachedInput > 0 {
+		cachedPrice = p.CachedInput
+	}
+	return (float64(prompt-cached)*p.Input + float64(cached)*cachedPrice + float64(record.CompletionTokens)*p.Output) / 1_000_000
+}
+
+// cacheDiscount returns the tokens the cached prompt tokens of a model are discounted by in its balancing usage,
+// in proportion to the discount of their price. Cached tokens of models without a cached price count in full.
+func (kc *KeyClient) cacheDiscount(model string, cached int64) int64 {
+	price, ok := kc.Prices[model]
+	if !ok || cached <= 0 || price.Input <= 0 || price.CachedInput <= 0 || price.CachedInput >= price.Input {
+		return 0
+	}
+	return int64(float64(cached) * (1 - price.CachedInput/price.Input))
+}
+
+type groupKey struct{}
+
+type clientKeyKey struct{}
+
+type endUserKey struct{}
+
+type tenantKey struct{}
+
+type requestIDKey struct{}
+
+// WithRequestID attaches the ID of a request, which the messages logged while serving it carry
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID attached by WithRequestID, or "" if none
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// WithClientKey attaches the name of the router client key a request was made with, so its usage is attributed to it
+func WithClientKey(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, clientKeyKey{}, name)
+}
+
+// ClientKeyFromContext returns the client key name attached by WithClientKey, or "" if none
+func ClientKeyFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(clientKeyKey{}).(string)
+	return name
+}
+
+// WithTenant attaches the tenant a request was made by, so its usage is attributed to it
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant attached by WithTenant, or "" if none
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// WithEndUser attaches the end user a request was made for, so its usage is attributed to them
+func WithEndUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, endUserKey{}, user)
+}
+
+// EndUserFromContext returns the end user attached by WithEndUser, or "" if none
+func EndUserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(endUserKey{}).(string)
+	return user
+}
+
+// WithGroup attaches the name of the group a request is routed through, so its usage is attributed to the group
+func WithGroup(ctx context.Context, group string) context.Context {
+	return context.WithValue(ctx, groupKey{}, group)
+}
+
+// attributedRecord returns an empty usage record of a model, attributed to the group, client key, tenant, and end user of the context
+func attributedRecord(ctx context.Context, model string) UsageRecord {
+	group, _ := ctx.Value(groupKey{}).(string)
+	return UsageRecord{Model: model, Group: group, ClientKey: ClientKeyFromContext(ctx), Tenant: TenantFromContext(ctx), User: EndUserFromContext(ctx)}
+}
+
+// recordUsage counts the tokens of a record towards the model's usage, with cached prompt tokens discounted, prices them,
+// and reports the record to RecordUsage. It returns the cost of the record.
+func (kc *KeyClient) recordUsage(record UsageRecord) float64 {
+	kc.IncrementUsage(record.Model, record.TotalTokens-kc.cacheDiscount(record.Model, record.CachedTokens))
+	kc.usageMutex.Lock()
+	tokens := kc.modelTokens[record.Model]
+	tokens.PromptTokens += record.PromptTokens
+	tokens.CachedTokens += record.CachedTokens
+	tokens.CompletionTokens += record.CompletionTokens
+	tokens.ReasoningTokens += record.ReasoningTokens
+	tokens.TotalTokens += record.TotalTokens
+	kc.modelTokens[record.Model] = tokens
+	kc.countLocal(counterPrompt, record.Model, record.PromptTokens)
+	kc.countLocal(counterCached, record.Model, record.CachedTokens)
+	kc.countLocal(counterCompletion, record.Model, record.CompletionTokens)
+	kc.countLocal(counterReasoning, record.Model, record.ReasoningTokens)
+	kc.countLocal(counterTotal, record.Model, record.TotalTokens)
+	kc.usageMutex.Unlock()
+	if price, ok := kc.Prices[record.Model]; ok {
+		record.Cost = price.Cost(record)
+		kc.usageMutex.Lock()
+		kc.modelCost[record.Model] += record.Cost
+		kc.countLocal(counterCost, record.Model, costNanos(record.Cost))
+		kc.usageMutex.Unlock()
+	}
+	if kc.RecordUsage != nil {
+		kc.RecordUsage(record)
+	}
+	return record.Cost
+}
+
+// countTokens counts the tokens of a text for a model, for providers that do not report usage
+func (kc *KeyClient) countTokens(model string, text string) int64 {
+	if kc.CountTokens != nil {
+		return int64(kc.CountTokens(model, text))
+	}
+	return int64(utils.EstimateTokens(text))
+}
+
+// Prompt tokens besides the text of the messages, following OpenAI's accounting
+const (
+	messageFormatTokens  = 3   // around each message
+	replyPrimingTokens   = 3   // priming the reply
+	lowDetailImageTokens = 85  // an image in low detail
+	imageTokens          = 765 // a 1024x1024 image in high detail, the typical size of an image in auto detail
+)
+
+// PromptText returns the text of a request's messages, tool definitions, and response format schema
+// as sent to the model
+func PromptText(req openai.ChatCompletionRequest) string {
+	var b strings.Builder
+	for _, m := range req.Messages {
+		b.WriteString(m.Role)
+		b.WriteString(m.Name)
+		b.WriteString(m.Content)
+		for _, part := range m.MultiContent {
+			b.WriteString(part.Text)
+		}
+		b.WriteString(messageText("", m.ReasoningContent, m.ToolCalls))
+	}
+	for _, tool := range req.Tools {
+		if tool.Function != nil {
+			b.WriteString(tool.Function.Name)
+			b.WriteString(tool.Function.Description)
+			if tool.Function.Parameters != nil {
+				parameters, _ := json.Marshal(tool.Function.Parameters)
+				b.Write(parameters)
+			}
+		}
+	}
+	if req.ResponseFormat != nil && req.ResponseFormat.JSONSchema != nil && req.ResponseFormat.JSONSchema.Schema != nil {
+		schema, _ := json.Marshal(req.ResponseFormat.JSONSchema.Schema)
+		b.Write(schema)
+	}
+	return b.String()
+}
+
+// PromptOverheadTokens estimates the prompt tokens of a request that are not part of its PromptText:
+// the formatting around each message and the images
+func PromptOverheadTokens(req openai.ChatCompletionRequest) int64 {
+	if len(req.Messages) == 0 {
+		return 0
+	}
+	tokens := int64(messageFormatTokens*len(req.Messages) + replyPrimingTokens)
+	for _, m := range req.Messages {
+		for _, part := range m.MultiContent {
+			if part.Type != openai.ChatMessagePartTypeImageURL || part.ImageURL == nil {
+				continue
+			}
+			if part.ImageURL.Detail == openai.ImageURLDetailLow {
+				tokens += lowDetailImageTokens
+			} else {
+				tokens += imageTokens
+			}
+		}
+	}
+	return tokens
+}
+
+// countPromptTokens estimates the prompt tokens of a request, for providers that do not report usage
+func (kc *KeyClient) countPromptTokens(req openai.ChatCompletionRequest) int64 {
+	return kc.countTokens(req.Model, PromptText(req)) + PromptOverheadTokens(req)
+}
+
+// messageText returns the generated text of a message, including tool calls
+func messageText(content, reasoning string, toolCalls []openai.ToolCall) string {
+	text := content + reasoning
+	for _, call := range toolCalls {
+		text += call.Function.Name + call.Function.Arguments
+	}
+	return text
+}
+
+// estimateResponseTokens estimates the prompt and completion tokens of a response from the prompt and all of its choices
+func (kc *KeyClient) estimateResponseTokens(req openai.ChatCompletionRequest, resp openai.ChatCompletionResponse) (prompt int64, completion int64) {
+	prompt = kc.countPromptTokens(req)
+	for _, choice := range resp.Choices {
+		completion += kc.countTokens(req.Model, messageText(choice.Message.Content, choice.Message.ReasoningContent, choice.Message.ToolCalls))
+	}
+	return prompt, completion
+}
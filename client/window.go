@@ -0,0 +1,52 @@
+package client
+
+import "strings"
+
+// RotateUsage starts a new usage window of the key, keeping the given number of most recent windows
+// (at least one). The usage this instance counted in the dropped windows is subtracted from the
+// counters and, with the next SyncUsage, from the counters shared with other instances.
+// Usage is tracked by window from the first rotation on.
+func (kc *KeyClient) RotateUsage(keep int) {
+	kc.usageMutex.Lock()
+	defer kc.usageMutex.Unlock()
+	kc.rotate(keep, true)
+}
+
+// RotateSharedUsage starts a new usage window of the key like RotateUsage, for usage shared in counters kept
+// per window, which drop the usage of the expired windows themselves. The deltas counted since the last
+// SyncUsage are returned to be added to the counters of the window that ended, rather than synced into
+// those of the new window, apart from those of the cost, which accumulates across windows and is left for
+// the next sync. A batch whose sync failed is retried as is into the new window.
+func (kc *KeyClient) RotateSharedUsage(keep int) map[string]int64 {
+	kc.usageMutex.Lock()
+	defer kc.usageMutex.Unlock()
+	var deltas map[string]int64
+	for field, delta := range kc.pending {
+		if Windowed(field) {
+			if deltas == nil {
+				deltas = make(map[string]int64)
+			}
+			deltas[field] = delta
+			delete(kc.pending, field)
+		}
+	}
+	kc.rotate(keep, false)
+	return deltas
+}
+
+// rotate starts a new usage window, subtracting the usage of the dropped windows from the counters and, if
+// syncExpired, from the shared counters with the next sync. The caller holds usageMutex.
+func (kc *KeyClient) rotate(keep int, syncExpired bool) {
+	kc.windows = append(kc.windows, make(map[string]int64))
+	for len(kc.windows) > max(keep, 1) {
+		expired := kc.windows[0]
+		kc.windows = kc.windows[1:]
+		for field, delta := range expired {
+			kind, model, _ := strings.Cut(field, "/")
+			kc.setCounter(kind, model, kc.counter(kind, model)-delta)
+			if syncExpired {
+				kc.addPending(field, -delta)
+			}
+		}
+	}
+}
@@ -1,46 +1,805 @@
 package config
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Port   int64  `mapstructure:"port"`
-	APIKey string `mapstructure:"api_key"`
+	Port int64 `mapstructure:"port"`
+	// Address the router listens on as host:port, e.g. 127.0.0.1:8080, instead of Port on every interface
+	Listen string `mapstructure:"listen"`
+	// Unix domain socket the router listens on instead of a TCP address, when its path is set
+	UnixSocket UnixSocket `mapstructure:"unix_socket"`
+	// Addresses and Unix sockets the router listens on at once, each over HTTP or HTTPS, instead of Port,
+	// Listen, and UnixSocket
+	Listeners []Listener `mapstructure:"listeners"`
+	// Port the admin API and metrics are served on instead of Port, when set
+	AdminPort int64 `mapstructure:"admin_port"`
+	// Address the admin API and metrics are served on as host:port, e.g. 127.0.0.1:9090, instead of AdminPort
+	// on every interface
+	AdminListen string `mapstructure:"admin_listen"`
+	// PEM certificate and private key files HTTPS is served with, for deployments without a TLS-terminating
+	// proxy in front. The certificate is reloaded when the files change, e.g. on renewal.
+	TLSCert string `mapstructure:"tls_cert"`
+	TLSKey  string `mapstructure:"tls_key"`
+	// Certificates obtained and renewed automatically with ACME, e.g. from Let's Encrypt, instead of TLSCert
+	ACME ACME `mapstructure:"acme"`
+	// HTTP/2 settings; HTTP/2 is served over TLS, and without it with h2c
+	HTTP2 HTTP2 `mapstructure:"http2"`
+	// File the PID of the router is written to once it listens, e.g. for systemd to follow the new process of
+	// a handover
+	PIDFile string `mapstructure:"pid_file"`
+	// Timeouts of the connections clients make to the router
+	ServerTimeouts ServerTimeouts `mapstructure:"server_timeouts"`
+	// Reverse proxies and load balancers in front of the router, as CIDRs, addresses, or unix for the peers of
+	// Unix sockets, whose X-Forwarded-For and X-Real-IP headers name the client of requests. The headers of
+	// other peers are ignored, so that clients cannot forge their address.
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	// Requests per minute each client IP, behind the trusted proxies, may make to the API, whatever its key;
+	// unlimited when 0
+	ClientIPRPM int64 `mapstructure:"client_ip_rpm"`
+	// Origins of browser-based apps allowed to call the API endpoints directly, and how
+	CORS CORS `mapstructure:"cors"`
+	// Levels responses are compressed at, when compression is enabled
+	Compression Compression `mapstructure:"compression"`
+	// Minimum level of the logged messages: debug, info (default), warn, or error
+	LogLevel string `mapstructure:"log_level"`
+	// Format, destination, and per-component levels of the logs
+	Logging Logging `mapstructure:"logging"`
+	APIKey  string  `mapstructure:"api_key"`
+	// Named client keys with quotas, accepted in addition to api_key
+	ClientKeys []ClientKey `mapstructure:"client_keys"`
+	// Tenants isolated from each other, each with its own client keys
+	Tenants []Tenant `mapstructure:"tenants"`
+	// Key for the admin API, which is disabled when empty
+	AdminAPIKey string `mapstructure:"admin_api_key"`
+	// Request header identifying the end user usage is attributed to, instead of the request's user field
+	EndUserHeader string `mapstructure:"end_user_header"`
+	// Port of the gRPC chat completion service, disabled when 0
+	GRPCPort int64 `mapstructure:"grpc_port"`
+	// Log the candidates evaluated when routing every request, as requests can ask for with X-LLM-Router-Explain
+	ExplainRouting bool `mapstructure:"explain_routing"`
+	// Maximum worst-case cost in USD of a request, its prompt plus max_tokens at the selected model's prices,
+	// unlimited when 0. Groups may set their own.
+	MaxRequestCost float64 `mapstructure:"max_request_cost"`
 
 	ErrorPenalty   int64 `mapstructure:"error_penalty"`
 	RequestPenalty int64 `mapstructure:"request_penalty"`
+	// Seconds error penalties take to decay by half, never decaying when 0
+	ErrorPenaltyHalfLife int64 `mapstructure:"error_penalty_half_life"`
+
+	// Interval in seconds between checks of the configuration file for changes, which are reloaded; when 0, the
+	// configuration is only reloaded on SIGHUP
+	ConfigWatchInterval int64 `mapstructure:"config_watch_interval"`
+
+	// Interval in seconds between upstream health probes; when 0, upstreams are only probed on deep health checks
+	HealthCheckInterval int64 `mapstructure:"health_check_interval"`
+
+	// Timeouts of provider requests and size limit of client requests
+	Limits Limits `mapstructure:"limits"`
+
+	// Subsystems switched on or off per deployment, only read on startup
+	Features Features `mapstructure:"features"`
 
 	Groups    []Group    `mapstructure:"groups"`
 	Providers []Provider `mapstructure:"providers"`
+	// Shared settings of groups, which groups extend to override parts of them
+	GroupTemplates []Group `mapstructure:"group_templates"`
+	// Model names clients request mapped to the groups serving them, e.g. gpt-4o to azure-gpt-4o, matched
+	// case-insensitively before groups are looked up
+	Aliases map[string]string `mapstructure:"aliases"`
+
+	ChatBatch ChatBatch `mapstructure:"chat_batch"`
+
+	Batch Passthrough `mapstructure:"batch"`
+	Files Passthrough `mapstructure:"files"`
+
+	// Notifications of budgets nearing their limits
+	BudgetAlerts BudgetAlerts `mapstructure:"budget_alerts"`
+	// Alerts raised when too many of a provider's requests fail
+	ErrorRateAlerts ErrorRateAlerts `mapstructure:"error_rate_alerts"`
+
+	// File the changes made through the admin API are saved to and applied over the configuration on load,
+	// kept in memory only when empty
+	OverlayFile string `mapstructure:"overlay_file"`
+
+	// File the usage history is persisted to, kept in memory only when empty
+	UsageFile string `mapstructure:"usage_file"`
+	// SQLite database a row per chat completion request is recorded in, disabled when empty
+	LedgerFile string `mapstructure:"ledger_file"`
+	// How long ledger rows are kept, forever when 0
+	LedgerRetention time.Duration `mapstructure:"ledger_retention"`
+	// File the changes made through the admin API and by reloads are appended to, disabled when empty
+	AuditLogFile string `mapstructure:"audit_log_file"`
+	// Sinks an event per completed chat completion request is shipped to
+	UsageEvents UsageEvents `mapstructure:"usage_events"`
+	// Webhooks posted the lifecycle events of requests
+	LifecycleEvents LifecycleEvents `mapstructure:"lifecycle_events"`
+	// OpenTelemetry collector the spans of requests are exported to
+	Tracing Tracing `mapstructure:"tracing"`
+	// DogStatsD agent the metrics are sent to, e.g. the Datadog agent, besides being served to Prometheus
+	StatsD StatsD `mapstructure:"statsd"`
+	// Sinks the transcripts of the groups and client keys with capture set are recorded to
+	Capture Capture `mapstructure:"capture"`
+
+	// Redis server sharing usage counters and client key quotas across instances
+	Redis Redis `mapstructure:"redis"`
+
+	// Secret stores provider API keys may reference instead of holding the keys
+	Secrets Secrets `mapstructure:"secrets"`
+
+	// Tiktoken encoding files by encoding name, e.g. cl100k_base and o200k_base
+	Tokenizers map[string]string `mapstructure:"tokenizers"`
+}
+
+// ClientKey is a named API key of a router client. Zero quotas are unlimited.
+type ClientKey struct {
+	Name              string `mapstructure:"name"`
+	Key               string `mapstructure:"key"`
+	RequestsPerMinute int64  `mapstructure:"rpm"`
+	TokensPerMinute   int64  `mapstructure:"tpm"`
+	TokensPerDay      int64  `mapstructure:"daily_tokens"`
+	// Spend caps of the key, rejecting its requests once used up until the period ends
+	Budgets []Budget `mapstructure:"budgets"`
+	// Record the transcripts of the key's chat completions to the capture sinks
+	Capture bool `mapstructure:"capture"`
+}
+
+// Tenant is an isolated user of a shared router, identified by its client keys
+type Tenant struct {
+	Name       string      `mapstructure:"name"`
+	ClientKeys []ClientKey `mapstructure:"client_keys"`
+	// Groups the tenant may use, all groups when empty
+	Groups []string `mapstructure:"groups"`
+	// Usage limits of the tenant as a whole
+	Budgets []Budget `mapstructure:"budgets"`
+	// Provider keys only the tenant's requests are routed to. A tenant with keys for a provider
+	// is not routed to the provider's shared keys.
+	ProviderKeys []TenantProviderKeys `mapstructure:"provider_keys"`
+}
+
+// TenantProviderKeys are API keys of a provider dedicated to a tenant
+type TenantProviderKeys struct {
+	Provider string   `mapstructure:"provider"`
+	APIKeys  []string `mapstructure:"api_keys"`
+}
+
+// ChatBatch limits the router-native chat completion batches
+type ChatBatch struct {
+	// Maximum number of requests of a batch running at once
+	Concurrency int `mapstructure:"concurrency"`
+	// Maximum number of requests in a batch
+	MaxRequests int `mapstructure:"max_requests"`
+}
+
+// Redis configures the Redis server shared by router instances, disabled when Address is empty
+type Redis struct {
+	Address string `mapstructure:"address"`
+	// Username of Redis 6 ACL users, empty for the default user
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	DB       int    `mapstructure:"db"`
+	// TLS connects to the server over TLS
+	TLS bool `mapstructure:"tls"`
+	// Prefix of the keys, defaulting to "llm-router:"
+	Prefix string `mapstructure:"prefix"`
+	// Interval in milliseconds between usage counter synchronizations, defaulting to 1000
+	SyncInterval int64 `mapstructure:"sync_interval"`
+}
+
+// Secrets configures access to the secret stores referenced by provider API keys, e.g.
+// "vault:secret/data/llm-router#openai". Empty settings fall back to the stores' environment variables.
+type Secrets struct {
+	// Interval in seconds between refreshes of the referenced keys, whose changes are reloaded; when 0, keys
+	// are only resolved when the configuration is loaded
+	RefreshInterval int64      `mapstructure:"refresh_interval"`
+	Vault           Vault      `mapstructure:"vault"`
+	AWS             AWSSecrets `mapstructure:"aws"`
+	GCP             GCPSecrets `mapstructure:"gcp"`
+	// Encryption decrypts the provider keys stored encrypted in the configuration
+	Encryption Encryption `mapstructure:"encryption"`
+}
+
+// Vault configures access to a HashiCorp Vault server
+type Vault struct {
+	Address string `mapstructure:"address"`
+	Token   string `mapstructure:"token"`
+}
+
+// AWSSecrets configures access to AWS Secrets Manager, defaulting to the region and credentials of the AWS
+// SDK's default chain
+type AWSSecrets struct {
+	Region          string `mapstructure:"region"`
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	SessionToken    string `mapstructure:"session_token"`
+	// Endpoint overrides the regional endpoint, e.g. for LocalStack
+	Endpoint string `mapstructure:"endpoint"`
+}
+
+// GCPSecrets configures access to GCP Secret Manager
+type GCPSecrets struct {
+	// Access token of the requests, defaulting to one of Google's application default credentials
+	AccessToken string `mapstructure:"access_token"`
+}
+
+// Logging configures the format and destination of the logs and the levels of components
+type Logging struct {
+	// Format of the logs: text (default) or json
+	Format string `mapstructure:"format"`
+	// File the logs are appended to instead of standard output
+	File string `mapstructure:"file"`
+	// Size past which File is rotated, never when 0
+	MaxSize ByteSize `mapstructure:"max_size"`
+	// Rotated files kept, File.1 being the most recent
+	MaxBackups int `mapstructure:"max_backups"`
+	// Minimum levels of the messages of components, overriding log_level, by component name: router,
+	// server, or events
+	Components map[string]string `mapstructure:"components"`
+	// Names the fields of messages are logged under, by field, e.g. msg: message or time: "@timestamp" to
+	// match what a log pipeline expects
+	FieldNames map[string]string `mapstructure:"field_names"`
+	// Line per HTTP request served, apart from the application's messages
+	AccessLog AccessLog `mapstructure:"access_log"`
+	// Requests whose routine messages are logged
+	Sampling LogSampling `mapstructure:"sampling"`
+	// Requests warned about for their latency
+	SlowRequests SlowRequests `mapstructure:"slow_requests"`
+	// Request and response bodies logged at debug for debugging, never logged unless enabled
+	Prompts LogPrompts `mapstructure:"prompts"`
+}
+
+// DefaultPromptLogLength is the number of characters of the bodies logged when logging.prompts is enabled
+const DefaultPromptLogLength = 500
+
+// LogPrompts configures the logging of the bodies of chat completion requests and responses, which hold the
+// messages of the conversations
+type LogPrompts struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Characters of each body logged, the rest being truncated
+	MaxLength int `mapstructure:"max_length"`
+}
+
+// DefaultSlowThreshold is the duration past which the messages of requests are logged whatever the sampling
+const DefaultSlowThreshold = 10 * time.Second
+
+// LogSampling limits the info and debug messages logged about requests to a fraction of them. Warnings and
+// errors are always logged, and so are all the messages of requests that failed or were slow.
+type LogSampling struct {
+	// Fraction of the requests whose info and debug messages are logged, every request's at 0 or 1
+	Ratio float64 `mapstructure:"ratio"`
+	// Duration past which the messages of a request are logged whether it is sampled or not
+	SlowThreshold time.Duration `mapstructure:"slow_threshold"`
+}
+
+// SlowRequests configures the warning logged about each request slower than a threshold, with its route and
+// timings. Thresholds of 0 are disabled, as they are by default.
+type SlowRequests struct {
+	// Duration of a request, to its response or the end of its stream, past which it is logged
+	Duration time.Duration `mapstructure:"duration"`
+	// Time from receiving a streaming request to its first token past which it is logged
+	TimeToFirstToken time.Duration `mapstructure:"time_to_first_token"`
+}
+
+// AccessLog configures the access log, written in the format of the logs
+type AccessLog struct {
+	Enabled bool `mapstructure:"enabled"`
+	// File the access log is appended to, rotated like the log file, instead of standard output
+	File string `mapstructure:"file"`
+}
+
+// UnixSocket configures the Unix domain socket the router listens on
+type UnixSocket struct {
+	Path string `mapstructure:"path"`
+	// Permissions of the socket file in octal, e.g. 0660, left to the umask when empty
+	Mode string `mapstructure:"mode"`
+}
+
+// Listener is an address or a Unix socket the router listens on
+type Listener struct {
+	// Address as host:port, e.g. 0.0.0.0:8080 or :8443
+	Address string `mapstructure:"address"`
+	// Unix domain socket, instead of an address
+	UnixSocket UnixSocket `mapstructure:"unix_socket"`
+	// Serve HTTPS with the certificate of tls_cert or acme, HTTP otherwise
+	TLS bool `mapstructure:"tls"`
+}
+
+// ACME configures the certificates obtained automatically from an ACME certificate authority
+type ACME struct {
+	// Domains certificates are obtained for, which must resolve to the router; ACME is disabled when empty
+	Domains []string `mapstructure:"domains"`
+	// Directory the certificates and account key are kept in, so that restarts do not request new ones
+	CacheDir string `mapstructure:"cache_dir"`
+	// Contact address the certificate authority notifies of problems with the certificates
+	Email string `mapstructure:"email"`
+	// ACME directory of the certificate authority, Let's Encrypt's production one when empty
+	DirectoryURL string `mapstructure:"directory_url"`
+	// Address the HTTP-01 challenge is answered on, e.g. :80, redirecting other requests to HTTPS; only the
+	// TLS-ALPN-01 challenge on the HTTPS port is answered when empty
+	HTTPListen string `mapstructure:"http_listen"`
+}
+
+// HTTP2 configures the HTTP/2 connections clients multiplex their requests over
+type HTTP2 struct {
+	// Serve HTTP/2 without TLS as well, to clients using it with prior knowledge such as load balancers
+	H2C bool `mapstructure:"h2c"`
+	// Maximum number of concurrent requests, e.g. streams, per connection, 250 when 0
+	MaxConcurrentStreams int `mapstructure:"max_concurrent_streams"`
+}
+
+// Defaults of the server timeouts, none of which bounds the duration of a stream but the shutdown timeout
+const (
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultIdleTimeout       = 2 * time.Minute
+	DefaultShutdownTimeout   = 5 * time.Minute
+)
+
+// ServerTimeouts bound the time clients' connections take, so that slow or idle clients do not hold them
+// open. A timeout set to 0 is not applied.
+type ServerTimeouts struct {
+	// Time a client takes to send the headers of a request
+	ReadHeaderTimeout time.Duration `mapstructure:"read_header_timeout"`
+	// Time from the headers of a request to the end of its response; streams are exempt from it
+	WriteTimeout time.Duration `mapstructure:"write_timeout"`
+	// Time a keep-alive connection waits for the next request
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+	// Time the requests in flight, streams included, are given to end when the router stops or hands over to a
+	// new process, without limit when 0
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+}
+
+// DefaultCORSMaxAge is how long browsers cache the result of a preflight request by default
+const DefaultCORSMaxAge = 10 * time.Minute
+
+// CORS configures the cross-origin requests browsers let apps of other origins make to the API endpoints
+type CORS struct {
+	// Origins allowed, e.g. https://app.example.com, * for any and https://*.example.com for any subdomain;
+	// CORS is disabled when empty
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+	// Methods allowed, GET, POST, and DELETE when empty
+	AllowedMethods []string `mapstructure:"allowed_methods"`
+	// Request headers allowed, those of the OpenAI and Anthropic SDKs when empty, * for any
+	AllowedHeaders []string `mapstructure:"allowed_headers"`
+	// Duration browsers cache the result of a preflight request for
+	MaxAge time.Duration `mapstructure:"max_age"`
+}
+
+// DefaultCompressionMinSize is the size under which responses are not compressed by default, about that of
+// a network packet
+const DefaultCompressionMinSize = KB
+
+// Compression sets the levels responses are compressed at, higher ones trading CPU for smaller responses
+type Compression struct {
+	// Levels of JSON responses
+	Levels CompressionLevels `mapstructure:"levels"`
+	// Levels of streams, whose events are compressed as they are flushed and gain little from higher levels
+	StreamLevels CompressionLevels `mapstructure:"stream_levels"`
+	// Size under which responses are not compressed, streams being compressed whatever their size
+	MinSize ByteSize `mapstructure:"min_size"`
+}
+
+// CompressionLevels are the levels of each encoding, the router's defaults when 0
+type CompressionLevels struct {
+	// 1 (fastest) to 9 (smallest)
+	Gzip int `mapstructure:"gzip"`
+	// 1 (fastest) to 11 (smallest)
+	Brotli int `mapstructure:"br"`
+	// 1 (fastest) to 22 (smallest), as the zstd command
+	Zstd int `mapstructure:"zstd"`
+}
+
+// Features switches subsystems on and off, so that risky ones can be shipped disabled and enabled per
+// deployment
+type Features struct {
+	// EnableCompression compresses responses for clients accepting zstd, brotli, or gzip, enabled by default
+	EnableCompression bool `mapstructure:"enable_compression"`
+	// EnableMetrics counts usage for Prometheus and serves /metrics, enabled by default. Metrics sent to a
+	// DogStatsD agent are counted without it.
+	EnableMetrics bool `mapstructure:"enable_metrics"`
+	// EnableProfiling serves the runtime profiles of net/http/pprof under /debug/pprof/ with the admin API,
+	// disabled by default
+	EnableProfiling bool `mapstructure:"enable_profiling"`
+	// PassthroughUnknownModels routes requests for a model no group or alias is named after to the
+	// providers of the groups' models of that name, disabled by default
+	PassthroughUnknownModels bool `mapstructure:"passthrough_unknown_models"`
+}
+
+// Encryption configures the master key of encrypted provider keys, read from LLM_ROUTER_MASTER_KEY when it is
+// set
+type Encryption struct {
+	// KMSMasterKey is the master key encrypted with AWS KMS, base64-encoded, which is decrypted with the AWS
+	// credentials of aws
+	KMSMasterKey string `mapstructure:"kms_master_key"`
+	// KMSEndpoint overrides the regional KMS endpoint
+	KMSEndpoint string `mapstructure:"kms_endpoint"`
+}
+
+// Passthrough designates the provider key that stateful endpoints are proxied to
+type Passthrough struct {
+	Provider string `mapstructure:"provider"`
+	KeyIndex int    `mapstructure:"key_index"`
+}
+
+// BudgetAlerts configures the webhooks notified when usage crosses percentage thresholds of a budget
+type BudgetAlerts struct {
+	// Percentages of the limits that trigger a notification, defaulting to 50, 80, and 100
+	Thresholds []float64 `mapstructure:"thresholds"`
+	Webhooks   []Webhook `mapstructure:"webhooks"`
+}
+
+// Defaults of the error rate alerts
+const (
+	DefaultErrorRateWindow      = 5 * time.Minute
+	DefaultErrorRateMinRequests = 10
+)
+
+// ErrorRateAlerts configures the alerts raised when the share of a provider's requests that failed within a
+// window exceeds a threshold, disabled for the providers without a threshold
+type ErrorRateAlerts struct {
+	// Fraction of failed requests, e.g. 0.25, over which providers without an error_rate_threshold alert
+	Threshold float64 `mapstructure:"threshold"`
+	// Time the error rate is measured over, a sliding window
+	Window time.Duration `mapstructure:"window"`
+	// Requests a provider must have been sent within the window for its error rate to alert
+	MinRequests int `mapstructure:"min_requests"`
+	// Webhooks are notified when an alert is raised and when it is resolved
+	Webhooks []Webhook `mapstructure:"webhooks"`
+}
+
+// UsageEvents configures the sinks usage events are shipped to in the background, disabled when none is set
+type UsageEvents struct {
+	// Webhooks are posted batches of events as JSON arrays
+	Webhooks []Webhook `mapstructure:"webhooks"`
+	// File events are appended to as JSON lines
+	File  string `mapstructure:"file"`
+	Kafka Kafka  `mapstructure:"kafka"`
+	// Maximum number of events waiting to be shipped, defaulting to 10000; further events are dropped
+	QueueSize int `mapstructure:"queue_size"`
+}
+
+// LifecycleEvents configures the webhooks posted the lifecycle events of requests, from their start to their
+// completion, in batches in the background, disabled when none is set
+type LifecycleEvents struct {
+	// Webhooks are posted batches of events as JSON arrays
+	Webhooks []Webhook `mapstructure:"webhooks"`
+	// Types of the events posted: request_started, route_selected, attempt_failed, and request_completed, all
+	// of them when empty
+	Types []string `mapstructure:"types"`
+	// Maximum number of events waiting to be posted, defaulting to 10000; further events are dropped
+	QueueSize int `mapstructure:"queue_size"`
+}
+
+// Tracing configures the export of request spans over OTLP/HTTP, disabled when Endpoint is empty
+type Tracing struct {
+	// OTLP/HTTP endpoint of the collector, e.g. http://localhost:4318
+	Endpoint string `mapstructure:"endpoint"`
+	// Headers sent with every export, e.g. for authentication
+	Headers map[string]string `mapstructure:"headers"`
+	// Service name of the router in the traces, defaulting to llm-router
+	ServiceName string `mapstructure:"service_name"`
+	// Fraction of the traces started by the router that are exported, from 0 to 1
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+// DefaultStatsDFlushInterval is the interval between the flushes of the metrics sent to a DogStatsD agent
+const DefaultStatsDFlushInterval = time.Second
+
+// StatsD configures the export of the metrics to a DogStatsD agent, with the labels of the Prometheus metrics as
+// tags, disabled when Address is empty
+type StatsD struct {
+	// Address of the agent, e.g. localhost:8125 over UDP or unix:///var/run/datadog/dsd.socket
+	Address string `mapstructure:"address"`
+	// Prefix of the metric names, e.g. "myteam.", followed by a dot unless it ends with one
+	Prefix string `mapstructure:"prefix"`
+	// Tags of every metric, e.g. env:prod
+	Tags []string `mapstructure:"tags"`
+	// Interval between the flushes of the aggregated and buffered metrics
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+}
+
+// Capture configures the sinks the complete prompts and completions of chat completions are recorded to, for
+// the groups and client keys with capture set, disabled when no sink is set
+type Capture struct {
+	// File transcripts are appended to as JSON lines, rotated with MaxSize and MaxBackups
+	File string `mapstructure:"file"`
+	// Size past which File is rotated, never when 0
+	MaxSize ByteSize `mapstructure:"max_size"`
+	// Rotated files kept, File.1 being the most recent
+	MaxBackups int       `mapstructure:"max_backups"`
+	S3         CaptureS3 `mapstructure:"s3"`
+	// Maximum number of transcripts waiting to be recorded, defaulting to 1000; further transcripts are dropped
+	QueueSize int `mapstructure:"queue_size"`
+}
+
+// CaptureS3 designates the S3 bucket batches of transcripts are uploaded to as JSON lines objects, disabled
+// when Bucket is empty. The credentials default to those of the AWS SDK's default chain.
+type CaptureS3 struct {
+	Bucket string `mapstructure:"bucket"`
+	// Prefix of the object keys, followed by the date and a random name
+	Prefix          string `mapstructure:"prefix"`
+	Region          string `mapstructure:"region"`
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	SessionToken    string `mapstructure:"session_token"`
+	// Endpoint overrides the regional endpoint, e.g. for MinIO or LocalStack, with the bucket in the path
+	Endpoint string `mapstructure:"endpoint"`
+}
+
+// Kafka designates the topic usage events are produced to, disabled when Brokers is empty
+type Kafka struct {
+	Brokers []string `mapstructure:"brokers"`
+	Topic   string   `mapstructure:"topic"`
+	// TLS connects to the brokers over TLS
+	TLS  bool      `mapstructure:"tls"`
+	SASL KafkaSASL `mapstructure:"sasl"`
+}
+
+// KafkaSASL authenticates the connections to the Kafka brokers, disabled when Mechanism is empty
+type KafkaSASL struct {
+	// Mechanism is PLAIN, SCRAM-SHA-256, or SCRAM-SHA-512
+	Mechanism string `mapstructure:"mechanism"`
+	Username  string `mapstructure:"username"`
+	Password  string `mapstructure:"password"`
+}
+
+// Webhook is an HTTP endpoint notifications are posted to
+type Webhook struct {
+	URL string `mapstructure:"url"`
+	// Format of the payload: json (default) or slack
+	Format  string            `mapstructure:"format"`
+	Headers map[string]string `mapstructure:"headers"`
 }
 
 type Group struct {
 	Name   string  `mapstructure:"name"`
 	Models []Model `mapstructure:"models"`
+	// Disabled groups are not routed to, as if they were not configured
+	Disabled bool `mapstructure:"disabled"`
+	// Name of the group template whose settings the group inherits, overriding those it sets itself
+	Extends string `mapstructure:"extends"`
+
+	// Validate structured outputs against the requested response_format and retry on another model/key
+	ValidateResponseFormat bool `mapstructure:"validate_response_format"`
+	// Token dimension balanced on: total (default), prompt, or completion
+	BalanceOn string `mapstructure:"balance_on"`
+	// Keys routed to: balanced (default) across all keys, or free_first to use the free keys of the
+	// providers until they are rate limited or over budget before touching paid keys
+	KeyPolicy string `mapstructure:"key_policy"`
+	// Models routed to: balanced (default) by usage, or cheapest to route each request to the cheapest model
+	// able to serve it, moving on to pricier models only while cheaper ones are rate limited or failing
+	Strategy string `mapstructure:"strategy"`
+	// Maximum worst-case cost in USD of a request to the group, max_request_cost when 0
+	MaxRequestCost float64 `mapstructure:"max_request_cost"`
+	// Usage limits of the group, which is not routed to once exceeded
+	Budgets []Budget `mapstructure:"budgets"`
+	// Generation parameters of the requests to the group that omit them
+	Defaults RequestDefaults `mapstructure:"defaults"`
+	// Record the transcripts of the group's chat completions to the capture sinks
+	Capture bool `mapstructure:"capture"`
+
+	// Provider key the Assistants API is proxied to for this group
+	Assistants Passthrough `mapstructure:"assistants"`
+}
+
+// RequestDefaults are generation parameters applied to chat completion requests that omit them; zero values
+// are not applied
+type RequestDefaults struct {
+	MaxTokens   int     `mapstructure:"max_tokens"`
+	Temperature float32 `mapstructure:"temperature"`
+	// System prompt prepended to requests without a system or developer message
+	System string `mapstructure:"system"`
 }
 
 type Model struct {
 	Weight   int64  `mapstructure:"weight"`
 	Provider string `mapstructure:"provider"`
 	Name     string `mapstructure:"name"`
+
+	// Optional overrides for the metadata known to the model registry
+	ContextWindow int64    `mapstructure:"context_window"`
+	Capabilities  []string `mapstructure:"capabilities"`
+
+	// Prices in USD per million input (prompt) and output (completion) tokens, used for cost accounting
+	InputPrice  float64 `mapstructure:"input_price"`
+	OutputPrice float64 `mapstructure:"output_price"`
+	// Discounted price in USD per million prompt tokens read from the provider's prompt cache, the input price when 0
+	CachedInputPrice float64 `mapstructure:"cached_input_price"`
+
+	// Tokens the model may use per UTC day across all keys of its provider, unlimited when 0.
+	// The model is not selected once the cap is reached.
+	DailyTokens int64 `mapstructure:"daily_tokens"`
 }
 
 type Provider struct {
 	Name    string   `mapstructure:"name"`
 	BaseURL string   `mapstructure:"base_url"`
 	APIKeys []string `mapstructure:"api_keys"`
+	// Keys on a free or trial tier, indexed after api_keys. Groups with the free_first key policy
+	// use them before the paid api_keys.
+	FreeAPIKeys []string `mapstructure:"free_api_keys"`
+
+	// Request parameters the provider rejects, e.g. logprobs, removed before forwarding
+	UnsupportedParams []string `mapstructure:"unsupported_params"`
+
+	// Patterns of the model names requested by clients that are passed through to the provider when no group
+	// or alias is named after them, e.g. "*" or "meta-llama/*", where * matches any characters
+	Models []string `mapstructure:"models"`
+
+	// Usage limits of the provider as a whole and of each of its keys
+	Budgets    []Budget `mapstructure:"budgets"`
+	KeyBudgets []Budget `mapstructure:"key_budgets"`
+
+	// Schedule on which the usage the keys are balanced on is reset, never when empty
+	UsageReset UsageReset `mapstructure:"usage_reset"`
+
+	// Timeouts and retries of the provider's requests, overriding those of limits
+	Limits ProviderLimits `mapstructure:"limits"`
+
+	// Fraction of failed requests over which the provider alerts, overriding error_rate_alerts.threshold
+	ErrorRateThreshold float64 `mapstructure:"error_rate_threshold"`
+}
+
+// UsageReset schedules the reset of a provider's key usage to follow the provider's quota cycle
+type UsageReset struct {
+	// Schedule is daily, monthly, or rolling
+	Schedule string `mapstructure:"schedule"`
+	// Time of day of daily and monthly resets as HH:MM, defaulting to 00:00
+	Time string `mapstructure:"time"`
+	// Day of the month of monthly resets, defaulting to 1; later than the last day resets on the last day
+	Day int `mapstructure:"day"`
+	// IANA time zone of the reset time, defaulting to UTC
+	TimeZone string `mapstructure:"timezone"`
+	// Length in seconds of rolling windows
+	Window int64 `mapstructure:"window"`
+}
+
+// Budget limits the tokens and/or cost in USD within a calendar day or month (UTC).
+// A zero limit is unlimited.
+type Budget struct {
+	Period string  `mapstructure:"period"` // day or month
+	Tokens int64   `mapstructure:"tokens"`
+	Cost   float64 `mapstructure:"cost"`
+}
+
+// DefaultPaths are the configuration files looked for when none is given, in order
+var DefaultPaths = []string{"config.yaml", "config.yml", "config.json", "config.toml"}
+
+// EnvPrefix prefixes the environment variables overriding settings, e.g. LLM_ROUTER_PORT
+const EnvPrefix = "LLM_ROUTER"
+
+// Overrides are the settings that environment variables and command-line flags override, by flag name
+var Overrides = map[string]string{
+	"port":         "port",
+	"listen":       "listen",
+	"admin-port":   "admin_port",
+	"admin-listen": "admin_listen",
+	"log-level":    "log_level",
+}
+
+// DefaultPath returns the path in LLM_ROUTER_CONFIG or else the first of DefaultPaths that exists, or the
+// first one when none does
+func DefaultPath() string {
+	if path := os.Getenv(EnvPrefix + "_CONFIG"); path != "" {
+		return path
+	}
+	for _, path := range DefaultPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return DefaultPaths[0]
+}
+
+// isFormat reports whether a file extension is that of a supported configuration format
+func isFormat(extension string) bool {
+	return slices.Contains([]string{"yaml", "yml", "json", "toml"}, extension)
 }
 
+// LoadConfig reads the configuration file at path, in the format of its extension: YAML (.yaml, .yml),
+// JSON (.json), or TOML (.toml), or the remote configuration path is the URL of (see Fetch). Environment
+// variables override the settings of Overrides.
 func LoadConfig(path string) (*Config, error) {
+	return LoadConfigWithFlags(path, nil)
+}
+
+// LoadConfigWithFlags reads the configuration file at path like LoadConfig, with the flags of Overrides
+// that are set taking precedence over both the environment and the file
+func LoadConfigWithFlags(path string, flags *pflag.FlagSet) (*Config, error) {
 	v := viper.New()
-	v.SetConfigFile(path)
-	if err := v.ReadInConfig(); err != nil {
-		return nil, err
+	if IsRemote(path) {
+		content, format, err := Fetch(context.Background(), path)
+		if err != nil {
+			return nil, err
+		}
+		v.SetConfigType(format)
+		if err := v.ReadConfig(bytes.NewReader(content)); err != nil {
+			return nil, err
+		}
+	} else {
+		if format := strings.TrimPrefix(filepath.Ext(path), "."); !isFormat(format) {
+			return nil, fmt.Errorf("configuration file %s is not .yaml, .yml, .json, or .toml", path)
+		}
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, err
+		}
+	}
+	v.SetDefault("port", 8080)
+	v.SetDefault("error_penalty", 10000)
+	v.SetDefault("request_penalty", 500)
+	v.SetDefault("limits.request_timeout", DefaultRequestTimeout)
+	v.SetDefault("limits.stream_idle_timeout", DefaultStreamIdleTimeout)
+	v.SetDefault("limits.max_body_size", DefaultMaxBodySize)
+	v.SetDefault("limits.max_upload_size", DefaultMaxUploadSize)
+	v.SetDefault("server_timeouts.read_header_timeout", DefaultReadHeaderTimeout)
+	v.SetDefault("server_timeouts.idle_timeout", DefaultIdleTimeout)
+	v.SetDefault("server_timeouts.shutdown_timeout", DefaultShutdownTimeout)
+	v.SetDefault("cors.max_age", DefaultCORSMaxAge)
+	v.SetDefault("compression.min_size", DefaultCompressionMinSize)
+	v.SetDefault("logging.max_backups", 3)
+	v.SetDefault("logging.sampling.slow_threshold", DefaultSlowThreshold)
+	v.SetDefault("logging.prompts.max_length", DefaultPromptLogLength)
+	v.SetDefault("error_rate_alerts.window", DefaultErrorRateWindow)
+	v.SetDefault("error_rate_alerts.min_requests", DefaultErrorRateMinRequests)
+	v.SetDefault("features.enable_compression", true)
+	v.SetDefault("features.enable_metrics", true)
+	v.SetDefault("statsd.flush_interval", DefaultStatsDFlushInterval)
+	v.SetDefault("tracing.service_name", "llm-router")
+	v.SetDefault("tracing.sample_ratio", 1.0)
+	v.SetEnvPrefix(EnvPrefix)
+	for name, setting := range Overrides {
+		if err := v.BindEnv(setting); err != nil {
+			return nil, err
+		}
+		if flags == nil {
+			continue
+		}
+		if flag := flags.Lookup(name); flag != nil && flag.Changed {
+			if err := v.BindPFlag(setting, flag); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := applyTemplates(v); err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %w", Redact(path), err)
 	}
 	var config Config
-	if err := v.Unmarshal(&config); err != nil {
-		return nil, err
+	// Unknown settings are rejected so that a misspelled setting fails loudly instead of taking its default
+	if err := v.Unmarshal(&config, func(dc *mapstructure.DecoderConfig) {
+		dc.ErrorUnused = true
+		dc.DecodeHook = decodeHook()
+	}); err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %w", Redact(path), err)
 	}
+	defaultWeights(v, &config)
 	return &config, nil
 }
+
+// defaultWeights sets the weight of the models that omit it to 1, weight 0 routing every request of the
+// group to the model while it is available
+func defaultWeights(v *viper.Viper, config *Config) {
+	groups, _ := v.Get("groups").([]any)
+	for i, group := range groups {
+		fields, _ := group.(map[string]any)
+		models, _ := fields["models"].([]any)
+		for j, model := range models {
+			if fields, ok := model.(map[string]any); ok && i < len(config.Groups) && j < len(config.Groups[i].Models) {
+				if _, set := fields["weight"]; !set {
+					config.Groups[i].Models[j].Weight = 1
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+func TestLoadConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `port: 9090
+groups:
+  - name: smart
+    models:
+      - provider: openai
+        name: gpt-4o
+        weight: 1
+providers:
+  - name: openai
+    base_url: https://api.openai.com/v1
+    api_keys: [sk-1, sk-2]
+`,
+		"config.json": `{
+  "port": 9090,
+  "groups": [{"name": "smart", "models": [{"provider": "openai", "name": "gpt-4o", "weight": 1}]}],
+  "providers": [{"name": "openai", "base_url": "https://api.openai.com/v1", "api_keys": ["sk-1", "sk-2"]}]
+}`,
+		"config.toml": `port = 9090
+
+[[groups]]
+name = "smart"
+
+[[groups.models]]
+provider = "openai"
+name = "gpt-4o"
+weight = 1
+
+[[providers]]
+name = "openai"
+base_url = "https://api.openai.com/v1"
+api_keys = ["sk-1", "sk-2"]
+`,
+	}
+	dir := t.TempDir()
+	var loaded []*Config
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("Failed to load %s: %v", name, err)
+		}
+		loaded = append(loaded, cfg)
+	}
+	if loaded[0].Port != 9090 || len(loaded[0].Groups) != 1 || len(loaded[0].Providers[0].APIKeys) != 2 {
+		t.Fatalf("Unexpected configuration %+v", loaded[0])
+	}
+	for _, cfg := range loaded[1:] {
+		if !reflect.DeepEqual(cfg, loaded[0]) {
+			t.Errorf("Expected every format to load the same configuration, got %+v and %+v", cfg, loaded[0])
+		}
+	}
+
+	path := filepath.Join(dir, "config.ini")
+	os.WriteFile(path, []byte("port=9090"), 0o600)
+	if _, err := LoadConfig(path); err == nil {
+		t.Errorf("Expected an unsupported extension to be rejected")
+	}
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("port: 9090\nadmin_port: 9091\nlog_level: warn\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LLM_ROUTER_PORT", "7070")
+	t.Setenv("LLM_ROUTER_LOG_LEVEL", "debug")
+	flags := pflag.NewFlagSet("llm-router", pflag.ContinueOnError)
+	flags.Int64("port", 8080, "")
+	flags.Int64("admin-port", 0, "")
+	flags.String("log-level", "info", "")
+	if err := flags.Parse([]string{"--log-level", "error"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfigWithFlags(path, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flags set take precedence over the environment, which takes precedence over the file
+	if cfg.Port != 7070 || cfg.AdminPort != 9091 || cfg.LogLevel != "error" {
+		t.Errorf("Unexpected overridden settings: port %d, admin_port %d, log_level %q", cfg.Port, cfg.AdminPort, cfg.LogLevel)
+	}
+
+	os.WriteFile(path, []byte("log_level: warn\n"), 0o600)
+	t.Setenv("LLM_ROUTER_PORT", "")
+	if cfg, err = LoadConfig(path); err != nil || cfg.Port != 8080 || cfg.LogLevel != "debug" {
+		t.Errorf("Expected the default port and the environment's log level, got %+v, %v", cfg, err)
+	}
+}
+
+func TestLoadConfigStrict(t *testing.T) {
+	dir := t.TempDir()
+	load := func(name string, content string) (*Config, error) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return LoadConfig(path)
+	}
+
+	_, err := load("typo.yaml", "providers:\n  - name: openai\n    basse_url: https://api.openai.com/v1\n")
+	if err == nil || !strings.Contains(err.Error(), "basse_url") {
+		t.Errorf("Expected the misspelled setting to be rejected, got %v", err)
+	}
+
+	for name, content := range map[string]string{
+		"defaults.yaml": "groups:\n  - name: smart\n    models:\n      - {provider: openai, name: gpt-4o}\n      - {provider: openai, name: gpt-4o-mini, weight: 0}\n",
+		"defaults.toml": "[[groups]]\nname = \"smart\"\n[[groups.models]]\nprovider = \"openai\"\nname = \"gpt-4o\"\n[[groups.models]]\nprovider = \"openai\"\nname = \"gpt-4o-mini\"\nweight = 0\n",
+	} {
+		cfg, err := load(name, content)
+		if err != nil {
+			t.Fatalf("Failed to load %s: %v", name, err)
+		}
+		if cfg.Port != 8080 || cfg.ErrorPenalty != 10000 || cfg.RequestPenalty != 500 {
+			t.Errorf("Expected default port and penalties from %s, got %+v", name, cfg)
+		}
+		if models := cfg.Groups[0].Models; models[0].Weight != 1 || models[1].Weight != 0 {
+			t.Errorf("Expected omitted weights of %s to default to 1 and explicit ones to be kept, got %+v", name, models)
+		}
+	}
+}
+
+func TestLoadConfigLimits(t *testing.T) {
+	dir := t.TempDir()
+	load := func(name string, content string) (*Config, error) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return LoadConfig(path)
+	}
+
+	cfg, err := load("defaults.yaml", "port: 9090\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Limits != (Limits{RequestTimeout: DefaultRequestTimeout, StreamIdleTimeout: DefaultStreamIdleTimeout, MaxBodySize: DefaultMaxBodySize, MaxUploadSize: DefaultMaxUploadSize}) {
+		t.Errorf("Expected the default limits, got %+v", cfg.Limits)
+	}
+	if cfg.ServerTimeouts != (ServerTimeouts{ReadHeaderTimeout: DefaultReadHeaderTimeout, IdleTimeout: DefaultIdleTimeout, ShutdownTimeout: DefaultShutdownTimeout}) {
+		t.Errorf("Expected the default server timeouts without a write timeout, got %+v", cfg.ServerTimeouts)
+	}
+	if cfg.Compression != (Compression{MinSize: DefaultCompressionMinSize}) {
+		t.Errorf("Expected the default compression settings, got %+v", cfg.Compression)
+	}
+	if cfg.Features != (Features{EnableCompression: true, EnableMetrics: true}) {
+		t.Errorf("Expected the default features, got %+v", cfg.Features)
+	}
+	if cfg.Logging.Sampling != (LogSampling{SlowThreshold: DefaultSlowThreshold}) {
+		t.Errorf("Expected every request's messages to be logged by default, got %+v", cfg.Logging.Sampling)
+	}
+	if cfg.LedgerRetention != 0 {
+		t.Errorf("Expected ledger rows kept forever by default, got %s", cfg.LedgerRetention)
+	}
+	if cfg.ErrorRateAlerts.Threshold != 0 || cfg.ErrorRateAlerts.Window != DefaultErrorRateWindow || cfg.ErrorRateAlerts.MinRequests != DefaultErrorRateMinRequests {
+		t.Errorf("Expected error rate alerts disabled with the default settings, got %+v", cfg.ErrorRateAlerts)
+	}
+	if cfg.StatsD.Address != "" || cfg.StatsD.FlushInterval != DefaultStatsDFlushInterval {
+		t.Errorf("Expected the DogStatsD export disabled with the default settings, got %+v", cfg.StatsD)
+	}
+	if cfg.Tracing.Endpoint != "" || cfg.Tracing.ServiceName != "llm-router" || cfg.Tracing.SampleRatio != 1 {
+		t.Errorf("Expected tracing disabled with the default settings, got %+v", cfg.Tracing)
+	}
+
+	for name, content := range map[string]string{
+		"limits.yaml": "limits:\n  request_timeout: 2m\n  stream_idle_timeout: 15\n  max_body_size: 512KB\n",
+		"limits.json": `{"limits": {"request_timeout": "120s", "stream_idle_timeout": 15, "max_body_size": 524288}}`,
+		"limits.toml": "[limits]\nrequest_timeout = \"2m\"\nstream_idle_timeout = \"15s\"\nmax_body_size = \"0.5MiB\"\n",
+	} {
+		cfg, err := load(name, content)
+		if err != nil {
+			t.Fatalf("Failed to load %s: %v", name, err)
+		}
+		if cfg.Limits.RequestTimeout != 2*time.Minute || cfg.Limits.StreamIdleTimeout != 15*time.Second || cfg.Limits.MaxBodySize != 512*KB {
+			t.Errorf("Unexpected limits from %s: %+v", name, cfg.Limits)
+		}
+	}
+
+	if _, err := load("invalid.yaml", "limits:\n  max_body_size: 2 parsecs\n"); err == nil || !strings.Contains(err.Error(), "max_body_size") {
+		t.Errorf("Expected an invalid size to be rejected, got %v", err)
+	}
+	if _, err := load("invalid.yaml", "limits:\n  request_timeout: soon\n"); err == nil {
+		t.Errorf("Expected an invalid duration to be rejected")
+	}
+	cfg, err = load("providers.yaml", `limits: {request_timeout: 30s, retries: 2}
+providers:
+  - {name: local, base_url: "http://localhost:8000/v1", limits: {request_timeout: 10m, retries: 0}}
+  - {name: openai, base_url: "https://api.openai.com/v1", limits: {stream_idle_timeout: 90}}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, openai := cfg.ProviderLimits(cfg.Providers[0]), cfg.ProviderLimits(cfg.Providers[1])
+	if local.RequestTimeout != 10*time.Minute || local.StreamIdleTimeout != DefaultStreamIdleTimeout || local.Retries == nil || *local.Retries != 0 {
+		t.Errorf("Unexpected limits of local: %+v", local)
+	}
+	if openai.RequestTimeout != 30*time.Second || openai.StreamIdleTimeout != 90*time.Second || openai.Retries == nil || *openai.Retries != 2 {
+		t.Errorf("Unexpected limits of openai: %+v", openai)
+	}
+
+	if size := 3 * MB; size.String() != "3MB" || ByteSize(1500).String() != "1500B" {
+		t.Errorf("Unexpected formatted sizes %s and %s", size, ByteSize(1500))
+	}
+}
+
+func TestLoadConfigTemplates(t *testing.T) {
+	dir := t.TempDir()
+	load := func(content string) (*Config, error) {
+		path := filepath.Join(dir, "config.yaml")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return LoadConfig(path)
+	}
+
+	cfg, err := load(`group_templates:
+  - name: base
+    strategy: cheapest
+    defaults: {max_tokens: 1024, temperature: 0.2}
+    models:
+      - {provider: openai, name: gpt-4o-mini}
+      - {provider: openai, name: gpt-4o, weight: 2}
+  - name: staging
+    extends: base
+    max_request_cost: 0.5
+groups:
+  - name: smart
+    extends: base
+  - name: smart-staging
+    extends: staging
+    defaults: {max_tokens: 256}
+  - name: fast
+    extends: base
+    strategy: balanced
+    models:
+      - {provider: openai, name: gpt-4o-mini}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smart, staging, fast := cfg.Groups[0], cfg.Groups[1], cfg.Groups[2]
+	if smart.Strategy != "cheapest" || len(smart.Models) != 2 || smart.Models[0].Weight != 1 || smart.Models[1].Weight != 2 {
+		t.Errorf("Expected the template's settings and models, got %+v", smart)
+	}
+	if staging.Name != "smart-staging" || staging.MaxRequestCost != 0.5 || staging.Strategy != "cheapest" || len(staging.Models) != 2 {
+		t.Errorf("Expected the settings of the templates extended in turn, got %+v", staging)
+	}
+	if staging.Defaults != (RequestDefaults{MaxTokens: 256, Temperature: 0.2}) {
+		t.Errorf("Expected the defaults to be merged setting by setting, got %+v", staging.Defaults)
+	}
+	if fast.Strategy != "balanced" || len(fast.Models) != 1 {
+		t.Errorf("Expected the group's own strategy and models to replace the template's, got %+v", fast)
+	}
+
+	if _, err := load("groups:\n  - name: smart\n    extends: missing\n"); err == nil || !strings.Contains(err.Error(), `undefined group template "missing"`) {
+		t.Errorf("Expected an undefined template to be rejected, got %v", err)
+	}
+	_, err = load("group_templates:\n  - {name: a, extends: b}\n  - {name: b, extends: a}\ngroups:\n  - {name: smart, extends: a}\n")
+	if err == nil || !strings.Contains(err.Error(), "extends itself") {
+		t.Errorf("Expected a template cycle to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-viper/mapstructure/v2"
+)
+
+// Defaults of the limits settings
+const (
+	DefaultRequestTimeout    = 60 * time.Second
+	DefaultStreamIdleTimeout = 30 * time.Second
+	DefaultMaxBodySize       = 2 * MB
+	DefaultMaxUploadSize     = 512 * MB
+)
+
+// Limits bounds the time provider requests take, their retries, and the size of client requests. A limit set
+// to 0 is not applied.
+type Limits struct {
+	// Time a provider takes to answer a non-streaming request, or to start streaming a streaming one
+	RequestTimeout time.Duration `mapstructure:"request_timeout"`
+	// Time a provider streaming a response may go without sending anything
+	StreamIdleTimeout time.Duration `mapstructure:"stream_idle_timeout"`
+	// Times a failed request is retried on another key or model. When not set, cheapest groups move on
+	// through all their models and other groups do not retry.
+	Retries *int `mapstructure:"retries"`
+	// Size of the body of client requests
+	MaxBodySize ByteSize `mapstructure:"max_body_size"`
+	// Size of the files clients upload to the Files API, which are larger than requests
+	MaxUploadSize ByteSize `mapstructure:"max_upload_size"`
+}
+
+// ProviderLimits override the limits of a provider's requests; those not set are the global ones
+type ProviderLimits struct {
+	RequestTimeout    *time.Duration `mapstructure:"request_timeout"`
+	StreamIdleTimeout *time.Duration `mapstructure:"stream_idle_timeout"`
+	Retries           *int           `mapstructure:"retries"`
+}
+
+// ProviderLimits returns the limits of a provider's requests, its own where it sets them and the global ones
+// otherwise
+func (c *Config) ProviderLimits(provider Provider) Limits {
+	limits := c.Limits
+	if provider.Limits.RequestTimeout != nil {
+		limits.RequestTimeout = *provider.Limits.RequestTimeout
+	}
+	if provider.Limits.StreamIdleTimeout != nil {
+		limits.StreamIdleTimeout = *provider.Limits.StreamIdleTimeout
+	}
+	if provider.Limits.Retries != nil {
+		limits.Retries = provider.Limits.Retries
+	}
+	return limits
+}
+
+// ByteSize is a size in bytes, configured as a number of bytes or with a unit, e.g. 512KB or 2MB
+type ByteSize int64
+
+// Units of byte sizes, decimal like KB and binary like KiB alike being powers of 1024
+const (
+	KB ByteSize = 1 << (10 * (iota + 1))
+	MB
+	GB
+)
+
+// byteUnits are the units of byte sizes by their lowercase name
+var byteUnits = map[string]ByteSize{
+	"": 1, "b": 1,
+	"k": KB, "kb": KB, "kib": KB,
+	"m": MB, "mb": MB, "mib": MB,
+	"g": GB, "gb": GB, "gib": GB,
+}
+
+// ParseByteSize parses a byte size, a number of bytes optionally followed by a unit: B, KB, MB, or GB
+func ParseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(s)
+	split := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) && r != '.' })
+	if split < 0 {
+		split = len(s)
+	}
+	unit, exists := byteUnits[strings.ToLower(strings.TrimSpace(s[split:]))]
+	n, err := strconv.ParseFloat(s[:split], 64)
+	if !exists || err != nil {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes with an optional unit, e.g. 2MB", s)
+	}
+	return ByteSize(n * float64(unit)), nil
+}
+
+// String formats the size with the largest unit that divides it
+func (b ByteSize) String() string {
+	for _, unit := range []struct {
+		size ByteSize
+		name string
+	}{{GB, "GB"}, {MB, "MB"}, {KB, "KB"}} {
+		if b != 0 && b%unit.size == 0 {
+			return strconv.FormatInt(int64(b/unit.size), 10) + unit.name
+		}
+	}
+	return strconv.FormatInt(int64(b), 10) + "B"
+}
+
+// decodeHook converts the settings of configuration files to the types of durations and byte sizes:
+// durations as Go durations, e.g. 90s or 2m, or as a number of seconds, and byte sizes as parsed by
+// ParseByteSize or as a number of bytes
+func decodeHook() mapstructure.DecodeHookFunc {
+	return mapstructure.ComposeDecodeHookFunc(
+		func(from reflect.Type, to reflect.Type, data any) (any, error) {
+			switch to {
+			case reflect.TypeFor[time.Duration]():
+				if s, ok := data.(string); ok {
+					return time.ParseDuration(s)
+				}
+				if seconds, ok := toFloat(data); ok {
+					return time.Duration(seconds * float64(time.Second)), nil
+				}
+			case reflect.TypeFor[ByteSize]():
+				if s, ok := data.(string); ok {
+					return ParseByteSize(s)
+				}
+			}
+			return data, nil
+		},
+		mapstructure.StringToSliceHookFunc(","),
+	)
+}
+
+// toFloat converts the numbers configuration files decode to
+func toFloat(data any) (float64, bool) {
+	switch n := data.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
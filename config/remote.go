@@ -0,0 +1,145 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// remoteTimeout bounds fetching a remote configuration
+const remoteTimeout = 10 * time.Second
+
+// IsRemote reports whether a configuration source is a URL rather than a file: http(s)://, etcd://, or
+// consul://, the latter two with a +https suffix for TLS, e.g. consul+https://
+func IsRemote(source string) bool {
+	scheme, _, found := strings.Cut(source, "://")
+	if !found {
+		return false
+	}
+	switch strings.TrimSuffix(scheme, "+https") {
+	case "http", "https", "etcd", "consul":
+		return true
+	}
+	return false
+}
+
+// Fetch reads a remote configuration, returning its content and its format, that of the extension of the
+// URL's path or key, YAML without one:
+//
+//	https://config.internal/llm-router.json   HTTP GET, with the URL's user info as basic authentication
+//	etcd://etcd:2379/llm-router/config.yaml   value of key llm-router/config.yaml, with the v3 JSON API
+//	consul://consul:8500/llm-router/config    value of key llm-router/config, with CONSUL_HTTP_TOKEN if set
+func Fetch(ctx context.Context, source string) ([]byte, string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, "", err
+	}
+	format := strings.TrimPrefix(path.Ext(u.Path), ".")
+	if !isFormat(format) {
+		format = "yaml"
+	}
+	ctx, cancel := context.WithTimeout(ctx, remoteTimeout)
+	defer cancel()
+
+	scheme := "http"
+	if u.Scheme == "https" || strings.HasSuffix(u.Scheme, "+https") {
+		scheme = "https"
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	var content []byte
+	switch strings.TrimSuffix(u.Scheme, "+https") {
+	case "http", "https":
+		content, err = fetch(ctx, http.MethodGet, u.String(), nil, nil)
+	case "etcd":
+		content, err = fetchEtcd(ctx, scheme+"://"+u.Host, key)
+	case "consul":
+		headers := map[string]string{}
+		if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+			headers["X-Consul-Token"] = token
+		}
+		content, err = fetch(ctx, http.MethodGet, scheme+"://"+u.Host+"/v1/kv/"+key+"?raw", nil, headers)
+	default:
+		err = fmt.Errorf("unsupported configuration source %s", u.Redacted())
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch configuration from %s: %w", u.Redacted(), err)
+	}
+	return content, format, nil
+}
+
+// Redact removes the credentials of a remote configuration's URL for logging
+func Redact(source string) string {
+	if u, err := url.Parse(source); err == nil && IsRemote(source) {
+		return u.Redacted()
+	}
+	return source
+}
+
+// Checksum returns the SHA-256 checksum of a remote configuration, by which changes are detected
+func Checksum(ctx context.Context, source string) (string, error) {
+	content, _, err := Fetch(ctx, source)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// fetchEtcd reads the value of a key with the JSON gateway of the etcd v3 API
+func fetchEtcd(ctx context.Context, endpoint string, key string) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(key))})
+	if err != nil {
+		return nil, err
+	}
+	content, err := fetch(ctx, http.MethodPost, endpoint+"/v3/kv/range", body, map[string]string{"Content-Type": "application/json"})
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		KVs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.Unmarshal(content, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.KVs) == 0 {
+		return nil, fmt.Errorf("key %s not found", key)
+	}
+	return base64.StdEncoding.DecodeString(resp.KVs[0].Value)
+}
+
+// fetch sends a request and returns the body of its successful response
+func fetch(ctx context.Context, method string, url string, body []byte, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server responded %s", resp.Status)
+	}
+	return content, nil
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoadRemoteConfig(t *testing.T) {
+	yaml := "port: 9090\ngroups:\n  - name: smart\n    models:\n      - {provider: openai, name: gpt-4o}\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/llm-router.json":
+			if user, password, _ := r.BasicAuth(); user != "ops" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"port": 9090, "groups": [{"name": "smart", "models": [{"provider": "openai", "name": "gpt-4o"}]}]}`))
+		case r.URL.Path == "/v3/kv/range":
+			var req struct{ Key string }
+			json.NewDecoder(r.Body).Decode(&req)
+			if key, _ := base64.StdEncoding.DecodeString(req.Key); string(key) != "llm-router/config.yaml" {
+				w.Write([]byte(`{"kvs":[]}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"kvs": []map[string]string{{"value": base64.StdEncoding.EncodeToString([]byte(yaml))}}})
+		case r.URL.Path == "/v1/kv/llm-router/config" && r.URL.Query().Has("raw"):
+			w.Write([]byte(yaml))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	for _, source := range []string{
+		"http://ops:secret@" + host + "/llm-router.json",
+		"etcd://" + host + "/llm-router/config.yaml",
+		"consul://" + host + "/llm-router/config",
+	} {
+		if !IsRemote(source) {
+			t.Errorf("Expected %s to be remote", source)
+		}
+		cfg, err := LoadConfig(source)
+		if err != nil {
+			t.Errorf("Failed to load %s: %v", source, err)
+			continue
+		}
+		if cfg.Port != 9090 || len(cfg.Groups) != 1 || cfg.Groups[0].Models[0].Weight != 1 {
+			t.Errorf("Unexpected configuration from %s: %+v", source, cfg)
+		}
+	}
+
+	first, err := Checksum(context.Background(), "consul://"+host+"/llm-router/config")
+	if err != nil || len(first) != 64 {
+		t.Errorf("Unexpected checksum %q, %v", first, err)
+	}
+	yaml = "port: 9091\n"
+	if second, _ := Checksum(context.Background(), "consul://"+host+"/llm-router/config"); second == first {
+		t.Errorf("Expected the checksum to change with the configuration")
+	}
+
+	_, err = LoadConfig("http://ops:wrong@" + host + "/llm-router.json")
+	if err == nil || strings.Contains(err.Error(), "wrong") {
+		t.Errorf("Expected a failure without the password, got %v", err)
+	}
+	if _, err := LoadConfig("etcd://" + host + "/missing"); err == nil {
+		t.Errorf("Expected a missing key to fail")
+	}
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/spf13/viper"
+)
+
+// applyTemplates merges the group templates groups extend into the groups' settings before they are decoded.
+// Settings a group sets override those of its template, nested settings like defaults key by key, while lists
+// like models and budgets are replaced as a whole. Templates may extend other templates.
+func applyTemplates(v *viper.Viper) error {
+	templates := make(map[string]map[string]any)
+	rawTemplates, _ := v.Get("group_templates").([]any)
+	for _, template := range rawTemplates {
+		if fields, ok := template.(map[string]any); ok {
+			name, _ := fields["name"].(string)
+			templates[name] = fields
+		}
+	}
+	groups, _ := v.Get("groups").([]any)
+	extended := false
+	merged := make([]any, len(groups))
+	for i, group := range groups {
+		merged[i] = group
+		fields, ok := group.(map[string]any)
+		if !ok || fields["extends"] == nil {
+			continue
+		}
+		resolved, err := extend(fields, templates, nil)
+		if err != nil {
+			return fmt.Errorf("groups[%d]: %w", i, err)
+		}
+		merged[i] = resolved
+		extended = true
+	}
+	if extended {
+		v.Set("groups", merged)
+	}
+	return nil
+}
+
+// extend returns the settings of a group or template merged over those of the template it extends, seen
+// being the templates extended on the way
+func extend(fields map[string]any, templates map[string]map[string]any, seen []string) (map[string]any, error) {
+	base, _ := fields["extends"].(string)
+	if base == "" {
+		return fields, nil
+	}
+	if slices.Contains(seen, base) {
+		return nil, fmt.Errorf("group template %q extends itself", base)
+	}
+	template, exists := templates[base]
+	if !exists {
+		return nil, fmt.Errorf("extends undefined group template %q", base)
+	}
+	inherited, err := extend(template, templates, append(seen, base))
+	if err != nil {
+		return nil, err
+	}
+	inherited = maps.Clone(inherited)
+	// The name of the template is not inherited, so that groups without one are reported
+	delete(inherited, "name")
+	return mergeSettings(inherited, fields), nil
+}
+
+// mergeSettings returns the settings of base with those of override replacing them, maps merged key by key
+func mergeSettings(base map[string]any, override map[string]any) map[string]any {
+	merged := maps.Clone(base)
+	for key, value := range override {
+		nested, isMap := value.(map[string]any)
+		baseNested, baseIsMap := merged[key].(map[string]any)
+		if isMap && baseIsMap {
+			merged[key] = mergeSettings(baseNested, nested)
+		} else {
+			merged[key] = value
+		}
+	}
+	return merged
+}
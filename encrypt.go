@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"llm-router/app"
+	"llm-router/config"
+	"llm-router/secrets"
+	"os"
+	"strings"
+)
+
+// encryptKey runs the encrypt-key command, printing the encrypted reference of the provider key read from
+// standard input, or a new master key
+func encryptKey(args []string) error {
+	flags := flag.NewFlagSet("encrypt-key", flag.ExitOnError)
+	configPath := flags.String("config", config.DefaultPath(), "configuration file: YAML, JSON, or TOML, whose secrets settings are used")
+	generate := flags.Bool("generate-master-key", false, "print a new random master key instead")
+	flags.Parse(args)
+
+	if *generate {
+		key, err := secrets.GenerateMasterKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+	}
+
+	// The key is read from standard input so that it stays out of the shell history
+	key, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && key == "" {
+		return errors.New("no key on standard input")
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return errors.New("no key on standard input")
+	}
+	cfg := &config.Config{}
+	if _, err := os.Stat(*configPath); err == nil {
+		if cfg, err = config.LoadConfig(*configPath); err != nil {
+			return err
+		}
+	}
+	encrypted, err := app.EncryptKey(cfg, key)
+	if err != nil {
+		return err
+	}
+	fmt.Println(encrypted)
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"llm-router/config"
+	"llm-router/usage"
+	"os"
+	"time"
+)
+
+// exportUsage runs the export-usage command, writing the daily usage and cost recorded in the
+// configured usage_file within a date range as CSV or JSON
+func exportUsage(args []string) error {
+	flags := flag.NewFlagSet("export-usage", flag.ExitOnError)
+	configPath := flags.String("config", config.DefaultPath(), "configuration file: YAML, JSON, or TOML")
+	startDate := flags.String("start", "", "first day to export as YYYY-MM-DD (required)")
+	endDate := flags.String("end", "", "last day to export as YYYY-MM-DD (default: today)")
+	format := flags.String("format", "csv", "output format: csv or json")
+	output := flags.String("output", "", "output file (default: standard output)")
+	flags.Parse(args)
+
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("format must be csv or json")
+	}
+	if *startDate == "" {
+		return errors.New("-start is required")
+	}
+	start, err := time.Parse(time.DateOnly, *startDate)
+	if err != nil {
+		return fmt.Errorf("invalid start date: %s", *startDate)
+	}
+	end := time.Now().UTC().Truncate(24 * time.Hour)
+	if *endDate != "" {
+		if end, err = time.Parse(time.DateOnly, *endDate); err != nil {
+			return fmt.Errorf("invalid end date: %s", *endDate)
+		}
+	}
+	// The end date is inclusive
+	end = end.Add(24 * time.Hour)
+	if !start.Before(end) {
+		return errors.New("start must not be after end")
+	}
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if cfg.UsageFile == "" {
+		return errors.New("usage_file is not configured, so no usage history is recorded")
+	}
+	store, err := usage.NewStore(cfg.UsageFile)
+	if err != nil {
+		return err
+	}
+	rows := usage.Export(store.Entries(start, end), start, end)
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(map[string]any{"object": "list", "data": rows})
+	}
+	return usage.WriteCSV(w, rows)
+}
@@ -0,0 +1,144 @@
+// Package kafka produces the usage events to a Kafka topic with segmentio/kafka-go, over TLS and with SASL
+// authentication if configured.
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// SASL mechanisms
+const (
+	SASLPlain       = "PLAIN"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+	SASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+// maxBatchSize is the largest number of messages sent to a partition in a single produce request
+const maxBatchSize = 100
+
+// batchTimeout is how long the messages of a call to Produce are gathered before being sent, which are
+// queued all at once
+const batchTimeout = 10 * time.Millisecond
+
+// Options configures the producer
+type Options struct {
+	// Brokers are the addresses of the bootstrap brokers, e.g. "kafka:9092"
+	Brokers []string
+	Topic   string
+	// ClientID identifies the producer to the brokers, defaulting to "llm-router"
+	ClientID string
+	// Timeout bounds each exchange with a broker, defaulting to 10 seconds
+	Timeout time.Duration
+	// TLS connects to the brokers over TLS when set, verifying their certificates for the hosts of their
+	// addresses unless the configuration names a server
+	TLS *tls.Config
+	// SASL authenticates the connections to the brokers when its mechanism is set
+	SASL SASL
+}
+
+// SASL configures the authentication of the connections to the brokers
+type SASL struct {
+	// Mechanism is SASLPlain, SASLScramSHA256, or SASLScramSHA512; connections are not authenticated when empty
+	Mechanism string
+	Username  string
+	Password  string
+}
+
+// mechanism returns the kafka-go mechanism of the configuration, nil when connections are not authenticated
+func (s SASL) mechanism() (sasl.Mechanism, error) {
+	switch s.Mechanism {
+	case "":
+		return nil, nil
+	case SASLPlain:
+		return plain.Mechanism{Username: s.Username, Password: s.Password}, nil
+	case SASLScramSHA256:
+		return scram.Mechanism(scram.SHA256, s.Username, s.Password)
+	case SASLScramSHA512:
+		return scram.Mechanism(scram.SHA512, s.Username, s.Password)
+	}
+	return nil, fmt.Errorf("unsupported SASL mechanism %q", s.Mechanism)
+}
+
+// Message is a record produced to the topic
+type Message struct {
+	Key   []byte
+	Value []byte
+}
+
+// Producer produces messages to the partitions of a topic in turn, waiting for all in-sync replicas.
+// The partitions of the topic are looked up when the producer is created and every 15 seconds, and a
+// connection is kept open to the leader of every partition.
+type Producer struct {
+	writer  *kafkago.Writer
+	timeout time.Duration
+}
+
+// NewProducer creates a producer of the topic
+func NewProducer(options Options) (*Producer, error) {
+	if len(options.Brokers) == 0 || options.Topic == "" {
+		return nil, errors.New("kafka: brokers and topic are required")
+	}
+	if options.ClientID == "" {
+		options.ClientID = "llm-router"
+	}
+	if options.Timeout == 0 {
+		options.Timeout = 10 * time.Second
+	}
+	mechanism, err := options.SASL.mechanism()
+	if err != nil {
+		return nil, fmt.Errorf("kafka: %w", err)
+	}
+	writer := kafkago.NewWriter(kafkago.WriterConfig{
+		Brokers: options.Brokers,
+		Topic:   options.Topic,
+		Dialer: &kafkago.Dialer{
+			ClientID:      options.ClientID,
+			Timeout:       options.Timeout,
+			DualStack:     true,
+			TLS:           options.TLS,
+			SASLMechanism: mechanism,
+		},
+		Balancer: &kafkago.RoundRobin{},
+		// Failed batches are sent again by the callers
+		MaxAttempts:  1,
+		BatchSize:    maxBatchSize,
+		BatchTimeout: batchTimeout,
+		ReadTimeout:  options.Timeout,
+		WriteTimeout: options.Timeout,
+		RequiredAcks: -1,
+	})
+	return &Producer{writer: writer, timeout: options.Timeout}, nil
+}
+
+// Produce appends the messages to the partitions of the topic, returning once all were written or one
+// failed, for at most the timeout of the options unless the context has a deadline of its own
+func (p *Producer) Produce(ctx context.Context, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	records := make([]kafkago.Message, len(messages))
+	for i, message := range messages {
+		records[i] = kafkago.Message{Key: message.Key, Value: message.Value}
+	}
+	return p.writer.WriteMessages(ctx, records...)
+}
+
+// Close sends the messages being produced and closes the connections to the brokers; the producer cannot
+// be used afterwards
+func (p *Producer) Close() error {
+	return p.writer.Close()
+}
@@ -0,0 +1,70 @@
+package kafka
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewProducer(t *testing.T) {
+	for _, tt := range []struct {
+		options Options
+		valid   bool
+	}{
+		{Options{Brokers: []string{"kafka:9092"}, Topic: "usage"}, true},
+		{Options{Brokers: []string{"kafka:9092"}, Topic: "usage", SASL: SASL{Mechanism: SASLPlain, Username: "router", Password: "secret"}}, true},
+		{Options{Brokers: []string{"kafka:9092"}, Topic: "usage", SASL: SASL{Mechanism: SASLScramSHA256, Username: "router", Password: "secret"}}, true},
+		{Options{Brokers: []string{"kafka:9092"}, Topic: "usage", SASL: SASL{Mechanism: SASLScramSHA512, Username: "router", Password: "secret"}}, true},
+		{Options{Brokers: []string{"kafka:9092"}, Topic: "usage", SASL: SASL{Mechanism: "GSSAPI"}}, false},
+		{Options{Brokers: []string{"kafka:9092"}}, false},
+		{Options{Topic: "usage"}, false},
+	} {
+		p, err := NewProducer(tt.options)
+		if (err == nil) != tt.valid {
+			t.Errorf("Expected the producer of %+v to be created: %t, got %v", tt.options, tt.valid, err)
+		}
+		if p != nil {
+			p.Close()
+		}
+	}
+
+	sasl := SASL{Mechanism: SASLScramSHA512, Username: "router", Password: "secret"}
+	if mechanism, err := sasl.mechanism(); err != nil || mechanism.Name() != SASLScramSHA512 {
+		t.Errorf("Expected the %s mechanism, got %v", SASLScramSHA512, err)
+	}
+}
+
+func TestProducerUnavailable(t *testing.T) {
+	// A broker that accepts connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	p, err := NewProducer(Options{Brokers: []string{listener.Addr().String()}, Topic: "usage", Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	start := time.Now()
+	if err := p.Produce(context.Background(), []Message{{Key: []byte("ci"), Value: []byte("lost")}}); err == nil {
+		t.Error("Expected an error while the broker does not answer")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected Produce to give up within its timeout, took %s", elapsed)
+	}
+	if err := p.Produce(context.Background(), nil); err != nil {
+		t.Errorf("Expected nothing to be produced without messages, got %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+// Package ledger records one row per routed request in a SQLite database, for debugging and auditing
+// without external infrastructure.
+package ledger
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Request outcomes
+const (
+	StatusSuccess = "success"
+	StatusError   = "error"
+)
+
+// Entry is the record of a single request
+type Entry struct {
+	Time      time.Time `json:"time"`
+	ClientKey string    `json:"client_key,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Group     string    `json:"group"`
+	Provider  string    `json:"provider,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	// KeyID identifies the provider key as "provider/hash"
+	KeyID    string `json:"api_key_id,omitempty"`
+	Stream   bool   `json:"stream,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+	// LatencyMs is the time from receiving the request to its response, or to the end of a stream
+	LatencyMs int64 `json:"latency_ms"`
+
+	Status string `json:"status"`
+	// ErrorClass categorizes failed requests, e.g. rate_limited or budget_exceeded
+	ErrorClass string `json:"error_class,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// UpstreamIDs are the identifiers the provider gave the last attempt, by response header name, e.g.
+	// x-request-id, to reference in support tickets
+	UpstreamIDs map[string]string `json:"upstream_ids,omitempty"`
+}
+
+// Filter selects entries within [Start, End). Empty fields match any entry.
+type Filter struct {
+	Start     time.Time
+	End       time.Time
+	ClientKey string
+	Group     string
+	Status    string
+	// Limit is the maximum number of entries returned, the most recent first; 0 is unlimited
+	Limit int
+}
+
+// where returns the WHERE clause selecting the filter's rows, and its arguments
+func (f Filter) where() (string, []any) {
+	conditions := []string{"time >= ?", "time < ?"}
+	args := []any{f.Start.UnixNano(), f.End.UnixNano()}
+	for _, field := range []struct{ column, value string }{
+		{"client_key", f.ClientKey},
+		{`"group"`, f.Group},
+		{"status", f.Status},
+	} {
+		if field.value != "" {
+			conditions = append(conditions, field.column+" = ?")
+			args = append(args, field.value)
+		}
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// Usage is the usage of a provider key and model within a bucket of time
+type Usage struct {
+	// Bucket is the index of the bucket from the start of the range
+	Bucket           int
+	Provider         string
+	Model            string
+	KeyID            string
+	Requests         int64
+	Errors           int64
+	PromptTokens     int64
+	CompletionTokens int64
+	TotalTokens      int64
+	Cost             float64
+}
+
+// schema creates the requests table, whose time is in Unix nanoseconds, and the indexes of the columns
+// queries filter on
+const schema = `
+CREATE TABLE IF NOT EXISTS requests (
+	id INTEGER PRIMARY KEY,
+	time INTEGER NOT NULL,
+	client_key TEXT NOT NULL,
+	tenant TEXT NOT NULL,
+	user TEXT NOT NULL,
+	"group" TEXT NOT NULL,
+	provider TEXT NOT NULL,
+	model TEXT NOT NULL,
+	api_key_id TEXT NOT NULL,
+	stream INTEGER NOT NULL,
+	attempts INTEGER NOT NULL,
+	prompt_tokens INTEGER NOT NULL,
+	completion_tokens INTEGER NOT NULL,
+	total_tokens INTEGER NOT NULL,
+	cost REAL NOT NULL,
+	latency_ms INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	error_class TEXT NOT NULL,
+	error TEXT NOT NULL,
+	upstream_ids TEXT
+);
+CREATE INDEX IF NOT EXISTS requests_time ON requests (time);
+CREATE INDEX IF NOT EXISTS requests_client_key ON requests (client_key, time);
+CREATE INDEX IF NOT EXISTS requests_group ON requests ("group", time);
+CREATE INDEX IF NOT EXISTS requests_status ON requests (status, time);
+`
+
+// columns are the columns of an entry, in the order of Record and scan
+const columns = `time, client_key, tenant, user, "group", provider, model, api_key_id, stream, attempts,
+	prompt_tokens, completion_tokens, total_tokens, cost, latency_ms, status, error_class, error, upstream_ids`
+
+// pruneInterval is how often rows older than the retention are deleted
+const pruneInterval = time.Hour
+
+// Ledger records entries in the requests table of a SQLite database
+type Ledger struct {
+	db        *sql.DB
+	retention time.Duration
+	// mutex guards pruned
+	mutex  sync.Mutex
+	pruned time.Time
+	now    func() time.Time
+}
+
+// Open opens the ledger database at path, creating it and its directory if needed. Rows older than retention
+// are deleted, none when it is 0. The database is written ahead of its log and waits for the locks of other
+// connections, so that queries do not hold up the requests being recorded, and several processes can share it.
+func Open(path string, retention time.Duration) (*Ledger, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath() + "?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL"
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Ledger{db: db, retention: retention, now: time.Now}, nil
+}
+
+// Record inserts an entry, deleting the rows past the retention at most once per pruneInterval
+func (l *Ledger) Record(e Entry) error {
+	var upstreamIDs []byte
+	if len(e.UpstreamIDs) > 0 {
+		var err error
+		if upstreamIDs, err = json.Marshal(e.UpstreamIDs); err != nil {
+			return err
+		}
+	}
+	_, err := l.db.Exec("INSERT INTO requests ("+columns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		e.Time.UnixNano(), e.ClientKey, e.Tenant, e.User, e.Group, e.Provider, e.Model, e.KeyID, e.Stream, e.Attempts,
+		e.PromptTokens, e.CompletionTokens, e.TotalTokens, e.Cost, e.LatencyMs, e.Status, e.ErrorClass, e.Error, upstreamIDs)
+	if err != nil {
+		return err
+	}
+	return l.prune()
+}
+
+// prune deletes the rows older than the retention, unless they were deleted within pruneInterval
+func (l *Ledger) prune() error {
+	if l.retention <= 0 {
+		return nil
+	}
+	now := l.now()
+	l.mutex.Lock()
+	if now.Sub(l.pruned) < pruneInterval {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.pruned = now
+	l.mutex.Unlock()
+	_, err := l.db.Exec("DELETE FROM requests WHERE time < ?", now.Add(-l.retention).UnixNano())
+	return err
+}
+
+// Entries returns the entries matching the filter, the most recent first
+func (l *Ledger) Entries(filter Filter) ([]Entry, error) {
+	where, args := filter.where()
+	query := "SELECT " + columns + " FROM requests" + where + " ORDER BY time DESC, id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	rows, err := l.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]Entry, 0)
+	for rows.Next() {
+		var e Entry
+		var nanos int64
+		var upstreamIDs sql.NullString
+		err := rows.Scan(&nanos, &e.ClientKey, &e.Tenant, &e.User, &e.Group, &e.Provider, &e.Model, &e.KeyID, &e.Stream, &e.Attempts,
+			&e.PromptTokens, &e.CompletionTokens, &e.TotalTokens, &e.Cost, &e.LatencyMs, &e.Status, &e.ErrorClass, &e.Error, &upstreamIDs)
+		if err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(0, nanos).UTC()
+		if upstreamIDs.Valid {
+			if err := json.Unmarshal([]byte(upstreamIDs.String), &e.UpstreamIDs); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Usage sums the entries matching the filter per bucket of time from its start, provider, model, and key, ordered
+// by bucket, provider, model, and key. The filter's limit is ignored.
+func (l *Ledger) Usage(filter Filter, bucket time.Duration) ([]Usage, error) {
+	where, args := filter.where()
+	query := `SELECT (time - ?) / ? AS bucket, provider, model, api_key_id, COUNT(*), SUM(status = ?),
+		SUM(prompt_tokens), SUM(completion_tokens), SUM(total_tokens), SUM(cost)
+		FROM requests` + where + `
+		GROUP BY bucket, provider, model, api_key_id
+		ORDER BY bucket, provider, model, api_key_id`
+	rows, err := l.db.Query(query, append([]any{filter.Start.UnixNano(), bucket.Nanoseconds(), StatusError}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make([]Usage, 0)
+	for rows.Next() {
+		var u Usage
+		err := rows.Scan(&u.Bucket, &u.Provider, &u.Model, &u.KeyID, &u.Requests, &u.Errors,
+			&u.PromptTokens, &u.CompletionTokens, &u.TotalTokens, &u.Cost)
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// Close closes the database
+func (l *Ledger) Close() error {
+	return l.db.Close()
+}
@@ -0,0 +1,164 @@
+package ledger
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "requests.db")
+	l, err := Open(path, 0)
+	if err != nil {
+		t.Fatalf("Failed to open ledger: %v", err)
+	}
+	start := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	for _, e := range []Entry{
+		{Time: start, ClientKey: "ci", Group: "smart", Provider: "openai", Model: "gpt-4o", TotalTokens: 100, Status: StatusSuccess,
+			UpstreamIDs: map[string]string{"x-request-id": "req_1"}},
+		{Time: start.Add(time.Minute), ClientKey: "ci", Group: "smart", Status: StatusError, ErrorClass: "budget_exceeded"},
+		{Time: start.Add(2 * time.Minute), ClientKey: "web", Group: "fast", Status: StatusSuccess},
+	} {
+		if err := l.Record(e); err != nil {
+			t.Fatalf("Failed to record entry: %v", err)
+		}
+	}
+	l.Close()
+
+	// Entries survive reopening
+	l, err = Open(path, 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen ledger: %v", err)
+	}
+	defer l.Close()
+
+	day := Filter{Start: start.Truncate(24 * time.Hour), End: start.Add(24 * time.Hour)}
+	entries, err := l.Entries(day)
+	if err != nil {
+		t.Fatalf("Failed to read entries: %v", err)
+	}
+	if len(entries) != 3 || entries[0].ClientKey != "web" || entries[2].TotalTokens != 100 || !entries[2].Time.Equal(start) ||
+		entries[2].UpstreamIDs["x-request-id"] != "req_1" {
+		t.Fatalf("Expected all entries, the most recent first, got %+v", entries)
+	}
+
+	filter := day
+	filter.ClientKey = "ci"
+	filter.Status = StatusError
+	if entries, _ := l.Entries(filter); len(entries) != 1 || entries[0].ErrorClass != "budget_exceeded" {
+		t.Errorf("Expected the failed request of the client key, got %+v", entries)
+	}
+	filter = day
+	filter.Limit = 2
+	if entries, _ := l.Entries(filter); len(entries) != 2 || entries[1].Group != "smart" {
+		t.Errorf("Expected the 2 most recent entries, got %+v", entries)
+	}
+	filter = day
+	filter.End = start.Add(time.Minute)
+	if entries, _ := l.Entries(filter); len(entries) != 1 {
+		t.Errorf("Expected entries before the end only, got %+v", entries)
+	}
+
+	// Queries filtering on a client key or group search their index rather than the table
+	for _, column := range []string{"client_key", `"group"`} {
+		var id, parent, unused int
+		var plan string
+		err := l.db.QueryRow("EXPLAIN QUERY PLAN SELECT * FROM requests WHERE "+column+" = ? AND time >= ? AND time < ?", "ci", 0, 1).
+			Scan(&id, &parent, &unused, &plan)
+		if err != nil || !strings.Contains(plan, "USING INDEX") {
+			t.Errorf("Expected the query on %s to use an index, got %q: %v", column, plan, err)
+		}
+	}
+}
+
+func TestLedgerUsage(t *testing.T) {
+	l, err := Open(filepath.Join(t.TempDir(), "requests.db"), 0)
+	if err != nil {
+		t.Fatalf("Failed to open ledger: %v", err)
+	}
+	defer l.Close()
+	nine := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	for _, e := range []Entry{
+		{Time: nine.Add(10 * time.Minute), Group: "smart", Provider: "openai", Model: "gpt-4o", KeyID: "openai/0", TotalTokens: 100, Cost: 0.5, Status: StatusSuccess},
+		{Time: nine.Add(20 * time.Minute), Group: "smart", Provider: "openai", Model: "gpt-4o", KeyID: "openai/0", TotalTokens: 50, Cost: 0.25, Status: StatusSuccess},
+		{Time: nine.Add(30 * time.Minute), Group: "smart", Provider: "openai", Model: "gpt-4o", KeyID: "openai/1", Status: StatusError},
+		{Time: nine.Add(2*time.Hour + time.Minute), Group: "smart", Provider: "anthropic", Model: "claude-sonnet-4", KeyID: "anthropic/0", TotalTokens: 10, Status: StatusSuccess},
+		{Time: nine.Add(2*time.Hour + time.Minute), Group: "fast", Provider: "openai", Model: "gpt-4o-mini", KeyID: "openai/0", TotalTokens: 10, Status: StatusSuccess},
+	} {
+		if err := l.Record(e); err != nil {
+			t.Fatalf("Failed to record entry: %v", err)
+		}
+	}
+
+	usage, err := l.Usage(Filter{Start: nine, End: nine.Add(3 * time.Hour), Group: "smart"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to sum usage: %v", err)
+	}
+	want := []Usage{
+		{Bucket: 0, Provider: "openai", Model: "gpt-4o", KeyID: "openai/0", Requests: 2, TotalTokens: 150, Cost: 0.75},
+		{Bucket: 0, Provider: "openai", Model: "gpt-4o", KeyID: "openai/1", Requests: 1, Errors: 1},
+		{Bucket: 2, Provider: "anthropic", Model: "claude-sonnet-4", KeyID: "anthropic/0", Requests: 1, TotalTokens: 10},
+	}
+	if len(usage) != len(want) {
+		t.Fatalf("Expected the usage per bucket, provider, model, and key, got %+v", usage)
+	}
+	for i := range want {
+		if usage[i] != want[i] {
+			t.Errorf("Expected %+v, got %+v", want[i], usage[i])
+		}
+	}
+}
+
+func TestLedgerRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.db")
+	l, err := Open(path, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to open ledger: %v", err)
+	}
+	defer l.Close()
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	for _, age := range []time.Duration{48 * time.Hour, 25 * time.Hour, time.Hour} {
+		l.pruned = time.Time{}
+		if err := l.Record(Entry{Time: now.Add(-age), Group: "smart", Status: StatusSuccess}); err != nil {
+			t.Fatalf("Failed to record entry: %v", err)
+		}
+	}
+	entries, err := l.Entries(Filter{Start: now.Add(-72 * time.Hour), End: now})
+	if err != nil {
+		t.Fatalf("Failed to read entries: %v", err)
+	}
+	if len(entries) != 1 || !entries[0].Time.Equal(now.Add(-time.Hour)) {
+		t.Errorf("Expected the rows past the retention deleted, got %+v", entries)
+	}
+
+	// Another process recording in the same database waits for its lock rather than failing
+	other, err := Open(path, 0)
+	if err != nil {
+		t.Fatalf("Failed to open ledger again: %v", err)
+	}
+	defer other.Close()
+	done := make(chan error)
+	go func() {
+		for range 100 {
+			if err := other.Record(Entry{Time: now, Group: "fast", Status: StatusSuccess}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for range 100 {
+		if err := l.Record(Entry{Time: now, Group: "smart", Status: StatusSuccess}); err != nil {
+			t.Errorf("Failed to record entry: %v", err)
+			break
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Failed to record entry in the other ledger: %v", err)
+	}
+	if entries, _ := l.Entries(Filter{Start: now, End: now.Add(time.Second)}); len(entries) != 200 {
+		t.Errorf("Expected the entries of both ledgers, got %d", len(entries))
+	}
+}
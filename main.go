@@ -1,15 +1,55 @@
 package main
 
 import (
+	"fmt"
 	"llm-router/app"
 	"llm-router/config"
+	"os"
+
+	"github.com/spf13/pflag"
 )
 
 func main() {
-	c, err := config.LoadConfig("config.yaml")
+	if len(os.Args) > 1 && (os.Args[1] == "validate" || os.Args[1] == "--validate") {
+		if err := validateConfig(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "validate:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "encrypt-key" {
+		if err := encryptKey(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "encrypt-key:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export-usage" {
+		if err := exportUsage(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "export-usage:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Flags override the settings of the configuration file, as do the LLM_ROUTER_* environment variables
+	flags := pflag.NewFlagSet("llm-router", pflag.ExitOnError)
+	configPath := flags.String("config", config.DefaultPath(), "configuration file: YAML, JSON, or TOML (env LLM_ROUTER_CONFIG)")
+	flags.Int64("port", 8080, "port to listen on (env LLM_ROUTER_PORT)")
+	flags.String("listen", "", "address to listen on as host:port instead of --port (env LLM_ROUTER_LISTEN)")
+	flags.Int64("admin-port", 0, "port to serve the admin API and metrics on instead of --port (env LLM_ROUTER_ADMIN_PORT)")
+	flags.String("admin-listen", "", "address to serve the admin API and metrics on as host:port instead of --admin-port (env LLM_ROUTER_ADMIN_LISTEN)")
+	flags.String("log-level", "info", "minimum level of the logged messages: debug, info, warn, or error (env LLM_ROUTER_LOG_LEVEL)")
+	flags.Parse(os.Args[1:])
+	load := func(path string) (*config.Config, error) {
+		return config.LoadConfigWithFlags(path, flags)
+	}
+
+	c, err := load(*configPath)
 	if err != nil {
 		panic(err)
 	}
 	a := app.NewApp(c)
+	a.WatchConfig(*configPath, load)
 	a.Run()
 }
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Descriptor describes a metric family of a registry, so that dashboards and alerts can be generated from the
+// metrics of the running binary rather than from its documentation
+type Descriptor struct {
+	Name string `json:"name"`
+	// Kind is KindCounter, KindHistogram, or KindGauge
+	Kind   string  `json:"kind"`
+	Help   string  `json:"help"`
+	Labels []Label `json:"labels"`
+	// Buckets are the upper bounds of the buckets of histograms, ascending
+	Buckets []float64 `json:"buckets,omitempty"`
+	// Series are the names of the samples of the family as scraped, e.g. the _bucket, _sum, and _count samples
+	// of histograms
+	Series []string `json:"series"`
+}
+
+// Label describes a label of a metric family
+type Label struct {
+	Name string `json:"name"`
+	Help string `json:"help"`
+}
+
+// validName matches the metric and label names following the Prometheus naming conventions, lowercase words
+// separated by underscores
+var validName = regexp.MustCompile(`^[a-z][a-z0-9]*(_[a-z0-9]+)*$`)
+
+// histogramSuffixes are the suffixes of the samples of histograms, which no metric name may end with
+var histogramSuffixes = []string{"_bucket", "_sum", "_count"}
+
+// register adds a family to the registry, panicking when its name or labels do not follow the naming
+// conventions, so that a misnamed metric fails the tests rather than reaching dashboards: names are lowercase
+// words separated by underscores, prefixed with the namespace of the registry, unique, and end with _total for
+// counters only, and labels are lowercase words too, le being reserved for histogram buckets. The family is
+// created by collector only once its descriptor passed these checks.
+func (r *Registry) register(d Descriptor, labels []string, collector func() prometheus.Collector) {
+	name, kind := d.Name, d.Kind
+	if !validName.MatchString(name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", name))
+	}
+	if r.namespace != "" && !strings.HasPrefix(name, r.namespace+"_") {
+		panic(fmt.Sprintf("metrics: metric name %q is not in namespace %q", name, r.namespace))
+	}
+	if (kind == KindCounter) != strings.HasSuffix(name, "_total") {
+		panic(fmt.Sprintf("metrics: %s name %q must end with _total for counters only", kind, name))
+	}
+	for _, suffix := range histogramSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			panic(fmt.Sprintf("metrics: metric name %q ends with the reserved suffix %s", name, suffix))
+		}
+	}
+	for i, label := range labels {
+		if !validName.MatchString(label) || label == "le" || slices.Contains(labels[:i], label) {
+			panic(fmt.Sprintf("metrics: invalid or duplicate label %q of %s", label, name))
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, registered := range r.families {
+		if registered.Name == name {
+			panic(fmt.Sprintf("metrics: metric %s registered twice", name))
+		}
+	}
+	r.gatherer.MustRegister(collector())
+	r.families = append(r.families, d)
+}
+
+// DescribeLabels sets the descriptions of label names in the catalog, shared by every family with the label
+func (r *Registry) DescribeLabels(descriptions map[string]string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.labels == nil {
+		r.labels = make(map[string]string)
+	}
+	for name, help := range descriptions {
+		r.labels[name] = help
+	}
+}
+
+// Catalog describes the metric families of the registry in registration order
+func (r *Registry) Catalog() []Descriptor {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	catalog := make([]Descriptor, 0, len(r.families))
+	for _, d := range r.families {
+		d.Labels = slices.Clone(d.Labels)
+		d.Buckets = slices.Clone(d.Buckets)
+		for i := range d.Labels {
+			d.Labels[i].Help = r.labels[d.Labels[i].Name]
+		}
+		catalog = append(catalog, d)
+	}
+	return catalog
+}
+
+// descriptor describes a family of a kind with the given labels
+func descriptor(kind string, name string, help string, labels []string) Descriptor {
+	d := Descriptor{Name: name, Kind: kind, Help: help, Labels: make([]Label, len(labels)), Series: []string{name}}
+	for i, label := range labels {
+		d.Labels[i] = Label{Name: label}
+	}
+	return d
+}
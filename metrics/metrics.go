@@ -0,0 +1,216 @@
+// Package metrics registers counters, histograms, and gauges with a Prometheus registry served to scrapes,
+// checks that they follow the naming conventions of the router, describes them in a catalog, and optionally
+// forwards their updates to a DogStatsD agent.
+package metrics
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Registry holds counters, histograms, and gauges, describing them in registration order
+type Registry struct {
+	// namespace prefixes the names of the metrics, e.g. "llmrouter" for llmrouter_requests_total
+	namespace string
+	gatherer  *prometheus.Registry
+	handler   http.Handler
+	mutex     sync.Mutex
+	// families describe the registered families, see Catalog
+	families []Descriptor
+	// labels are the descriptions of the label names, see DescribeLabels
+	labels map[string]string
+	// sink the updates of the metrics are forwarded to, nil when none is
+	sink Sink
+}
+
+// Kinds of the metrics whose updates are forwarded to sinks
+const (
+	KindCounter   = "counter"
+	KindHistogram = "histogram"
+	KindGauge     = "gauge"
+)
+
+// Sink receives the updates of the metrics of a registry as they happen, e.g. to send them to another monitoring
+// system than Prometheus
+type Sink interface {
+	// Send records a counter increment, histogram observation, or gauge value of a metric of a kind, with the
+	// label names and values of its series
+	Send(kind string, name string, value float64, labels []string, labelValues []string)
+}
+
+// Forward forwards the updates of the registry's metrics to a sink, besides counting them
+func (r *Registry) Forward(sink Sink) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sink = sink
+}
+
+// forward sends an update to the registry's sink, if any
+func (r *Registry) forward(kind string, name string, value float64, labels []string, labelValues []string) {
+	r.mutex.Lock()
+	sink := r.sink
+	r.mutex.Unlock()
+	if sink != nil {
+		sink.Send(kind, name, value, labels, labelValues)
+	}
+}
+
+// NewRegistry creates an empty registry of metrics named with the namespace as prefix, any names being
+// accepted when it is empty
+func NewRegistry(namespace string) *Registry {
+	gatherer := prometheus.NewRegistry()
+	return &Registry{
+		namespace: namespace,
+		gatherer:  gatherer,
+		handler:   promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}),
+	}
+}
+
+// CounterVec is a family of monotonically increasing counters distinguished by label values
+type CounterVec struct {
+	registry *Registry
+	name     string
+	labels   []string
+	vec      *prometheus.CounterVec
+}
+
+// Counter registers a counter family with the given label names, panicking when the name does not follow the
+// naming conventions, see register
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{registry: r, name: name, labels: labels}
+	r.register(descriptor(KindCounter, name, help, labels), labels, func() prometheus.Collector {
+		c.vec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+		return c.vec
+	})
+	return c
+}
+
+// Add increases the counter of the label values, given in the order of the label names, by value.
+// Negative values are ignored, as counters never decrease.
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	c.vec.WithLabelValues(values(c.labels, labelValues)...).Add(value)
+	c.registry.forward(KindCounter, c.name, value, c.labels, labelValues)
+}
+
+// Value returns the counter of the label values
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	return find(c.vec, c.labels, labelValues).GetCounter().GetValue()
+}
+
+// GaugeVec is a family of values that go up and down, e.g. states, distinguished by label values
+type GaugeVec struct {
+	registry *Registry
+	name     string
+	labels   []string
+	vec      *prometheus.GaugeVec
+}
+
+// Gauge registers a gauge family with the given label names, panicking when the name does not follow the
+// naming conventions, see register
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{registry: r, name: name, labels: labels}
+	r.register(descriptor(KindGauge, name, help, labels), labels, func() prometheus.Collector {
+		g.vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+		return g.vec
+	})
+	return g
+}
+
+// Set sets the gauge of the label values, given in the order of the label names
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.vec.WithLabelValues(values(g.labels, labelValues)...).Set(value)
+	g.registry.forward(KindGauge, g.name, value, g.labels, labelValues)
+}
+
+// Value returns the gauge of the label values
+func (g *GaugeVec) Value(labelValues ...string) float64 {
+	return find(g.vec, g.labels, labelValues).GetGauge().GetValue()
+}
+
+// HistogramVec is a family of histograms of observed values, e.g. latencies, distinguished by label values
+type HistogramVec struct {
+	registry *Registry
+	name     string
+	labels   []string
+	vec      *prometheus.HistogramVec
+}
+
+// Histogram registers a histogram family with the given bucket upper bounds and label names, panicking when
+// the name does not follow the naming conventions, see register
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{registry: r, name: name, labels: labels}
+	d := descriptor(KindHistogram, name, help, labels)
+	d.Buckets = slices.Sorted(slices.Values(buckets))
+	d.Series = []string{name + "_bucket", name + "_sum", name + "_count"}
+	r.register(d, labels, func() prometheus.Collector {
+		h.vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: d.Buckets}, labels)
+		return h.vec
+	})
+	return h
+}
+
+// Observe adds a value to the histogram of the label values, given in the order of the label names
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.vec.WithLabelValues(values(h.labels, labelValues)...).Observe(value)
+	h.registry.forward(KindHistogram, h.name, value, h.labels, labelValues)
+}
+
+// Count returns the number of values observed in the histogram of the label values
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	return find(h.vec, h.labels, labelValues).GetHistogram().GetSampleCount()
+}
+
+// values returns the label values of a series, one per label name, missing values being empty and invalid
+// UTF-8 replaced, which Prometheus rejects
+func values(labels []string, labelValues []string) []string {
+	padded := make([]string, len(labels))
+	for i := range padded {
+		if i < len(labelValues) {
+			padded[i] = strings.ToValidUTF8(labelValues[i], "�")
+		}
+	}
+	return padded
+}
+
+// find returns the sample of the series of a family with the label values, nil when it has none, without
+// creating the series as looking it up through the family would
+func find(collector prometheus.Collector, labels []string, labelValues []string) *dto.Metric {
+	want := make(map[string]string, len(labels))
+	for i, value := range values(labels, labelValues) {
+		want[labels[i]] = value
+	}
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(metrics)
+		close(metrics)
+	}()
+	var found *dto.Metric
+	for metric := range metrics {
+		var sample dto.Metric
+		if found != nil || metric.Write(&sample) != nil {
+			continue
+		}
+		matches := true
+		for _, pair := range sample.GetLabel() {
+			matches = matches && want[pair.GetName()] == pair.GetValue()
+		}
+		if matches {
+			found = &sample
+		}
+	}
+	return found
+}
+
+// ServeHTTP serves the metrics to Prometheus scrapes, in the format negotiated with the scraper
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.handler.ServeHTTP(w, req)
+}
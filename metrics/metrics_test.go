@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	registry := NewRegistry("llmrouter")
+	tokens := registry.Counter("llmrouter_prompt_tokens_total", "Prompt tokens.", "provider", "model")
+	cost := registry.Counter("llmrouter_cost_usd_total", "Cost in USD.")
+	tokens.Add(10, "openai", "gpt-4o")
+	tokens.Add(5, "openai", "gpt-4o")
+	tokens.Add(7, "anthropic", `claude "sonnet"`)
+	tokens.Add(-3, "openai", "gpt-4o")
+	cost.Add(0.25)
+
+	if v := tokens.Value("openai", "gpt-4o"); v != 15 {
+		t.Errorf("Expected counters to add up and ignore decreases, got %v", v)
+	}
+	if v := tokens.Value("openai", "gpt-4o-mini"); v != 0 {
+		t.Errorf("Expected a counter never added to to be 0, got %v", v)
+	}
+
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	want := `# HELP llmrouter_cost_usd_total Cost in USD.
+# TYPE llmrouter_cost_usd_total counter
+llmrouter_cost_usd_total 0.25
+# HELP llmrouter_prompt_tokens_total Prompt tokens.
+# TYPE llmrouter_prompt_tokens_total counter
+llmrouter_prompt_tokens_total{model="claude \"sonnet\"",provider="anthropic"} 7
+llmrouter_prompt_tokens_total{model="gpt-4o",provider="openai"} 15
+`
+	if w.Body.String() != want {
+		t.Errorf("Unexpected exposition:\n%s", w.Body.String())
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestHistograms(t *testing.T) {
+	registry := NewRegistry("llmrouter")
+	latency := registry.Histogram("llmrouter_request_duration_seconds", "Latency.", []float64{1, 0.5}, "provider")
+	latency.Observe(0.2, "openai")
+	latency.Observe(0.5, "openai")
+	latency.Observe(3, "openai")
+
+	if n := latency.Count("openai"); n != 3 {
+		t.Errorf("Expected 3 observations, got %d", n)
+	}
+
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	want := `# HELP llmrouter_request_duration_seconds Latency.
+# TYPE llmrouter_request_duration_seconds histogram
+llmrouter_request_duration_seconds_bucket{provider="openai",le="0.5"} 2
+llmrouter_request_duration_seconds_bucket{provider="openai",le="1"} 2
+llmrouter_request_duration_seconds_bucket{provider="openai",le="+Inf"} 3
+llmrouter_request_duration_seconds_sum{provider="openai"} 3.7
+llmrouter_request_duration_seconds_count{provider="openai"} 3
+`
+	if w.Body.String() != want {
+		t.Errorf("Unexpected exposition:\n%s", w.Body.String())
+	}
+}
+
+func TestGauges(t *testing.T) {
+	registry := NewRegistry("llmrouter")
+	alerting := registry.Gauge("llmrouter_error_rate_alert", "Alerting providers.", "provider")
+	alerting.Set(1, "openai")
+	alerting.Set(1, "anthropic")
+	alerting.Set(0, "openai")
+
+	if v := alerting.Value("anthropic"); v != 1 {
+		t.Errorf("Expected gauge to be set, got %v", v)
+	}
+
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	want := `# HELP llmrouter_error_rate_alert Alerting providers.
+# TYPE llmrouter_error_rate_alert gauge
+llmrouter_error_rate_alert{provider="anthropic"} 1
+llmrouter_error_rate_alert{provider="openai"} 0
+`
+	if w.Body.String() != want {
+		t.Errorf("Unexpected exposition:\n%s", w.Body.String())
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	registry := NewRegistry("llmrouter")
+	registry.DescribeLabels(map[string]string{"provider": "Provider name."})
+	registry.Counter("llmrouter_requests_total", "Requests.", "provider", "model")
+	registry.Histogram("llmrouter_request_duration_seconds", "Latency.", []float64{1, 0.5}, "provider")
+
+	catalog := registry.Catalog()
+	want := []Descriptor{
+		{Name: "llmrouter_requests_total", Kind: KindCounter, Help: "Requests.", Labels: []Label{{Name: "provider", Help: "Provider name."}, {Name: "model"}}, Series: []string{"llmrouter_requests_total"}},
+		{Name: "llmrouter_request_duration_seconds", Kind: KindHistogram, Help: "Latency.", Labels: []Label{{Name: "provider", Help: "Provider name."}}, Buckets: []float64{0.5, 1},
+			Series: []string{"llmrouter_request_duration_seconds_bucket", "llmrouter_request_duration_seconds_sum", "llmrouter_request_duration_seconds_count"}},
+	}
+	if !reflect.DeepEqual(catalog, want) {
+		t.Errorf("Unexpected catalog %+v", catalog)
+	}
+
+	for name, register := range map[string]func(){
+		"outside the namespace":     func() { registry.Counter("router_requests_total", "Requests.") },
+		"counter without _total":    func() { registry.Counter("llmrouter_errors", "Errors.") },
+		"gauge with _total":         func() { registry.Gauge("llmrouter_alerts_total", "Alerts.") },
+		"histogram with a suffix":   func() { registry.Histogram("llmrouter_latency_count", "Latency.", nil) },
+		"uppercase name":            func() { registry.Gauge("llmrouter_Alert", "Alert.") },
+		"reserved label":            func() { registry.Counter("llmrouter_tokens_total", "Tokens.", "le") },
+		"duplicate label":           func() { registry.Counter("llmrouter_tokens_total", "Tokens.", "model", "model") },
+		"metric registered twice":   func() { registry.Counter("llmrouter_requests_total", "Requests.") },
+		"label with a capital":      func() { registry.Counter("llmrouter_tokens_total", "Tokens.", "keyAlias") },
+		"name with a double _":      func() { registry.Gauge("llmrouter__alert", "Alert.") },
+		"name with a trailing _":    func() { registry.Gauge("llmrouter_alert_", "Alert.") },
+		"name starting with digits": func() { NewRegistry("").Gauge("1_alert", "Alert.") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected a %s to be rejected", name)
+				}
+			}()
+			register()
+		}()
+	}
+}
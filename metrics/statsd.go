@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+)
+
+// StatsD is a sink sending the updates of metrics to a DogStatsD agent, e.g. the Datadog agent, with their label
+// values as tags. Counters are sent as counts, histograms as distributions, and gauges as gauges, aggregated and
+// flushed at an interval by the Datadog client. Metrics the agent does not receive are lost.
+type StatsD struct {
+	client *statsd.Client
+
+	mutex sync.Mutex
+	// remainders are the fractions of the increments of counters not sent yet, by name and tags, as counts are
+	// integers, e.g. of the cost in USD
+	remainders map[string]float64
+}
+
+// NewStatsD creates a sink sending metrics to the agent at an address, e.g. localhost:8125 or
+// unix:///var/run/datadog/dsd.socket, their names prefixed with prefix, followed by a dot unless it ends with one,
+// and tagged with tags besides their labels, and flushing them every interval
+func NewStatsD(address string, prefix string, tags []string, interval time.Duration) (*StatsD, error) {
+	options := []statsd.Option{
+		statsd.WithTags(tags),
+		statsd.WithBufferFlushInterval(interval),
+		statsd.WithAggregationInterval(interval),
+		statsd.WithoutTelemetry(),
+	}
+	if prefix != "" {
+		options = append(options, statsd.WithNamespace(prefix))
+	}
+	client, err := statsd.New(address, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsD{client: client, remainders: make(map[string]float64)}, nil
+}
+
+// tagReplacer replaces the characters separating the fields and tags of DogStatsD datagrams
+var tagReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// Send sends an update of a metric, e.g. llmrouter_requests_total:1|c|#provider:openai. Labels with empty values
+// are left out of the tags. Errors are counted by the Datadog client rather than returned.
+func (s *StatsD) Send(kind string, name string, value float64, labels []string, labelValues []string) {
+	var tags []string
+	for i, label := range labels {
+		if i < len(labelValues) && labelValues[i] != "" {
+			tags = append(tags, label+":"+tagReplacer.Replace(labelValues[i]))
+		}
+	}
+	switch kind {
+	case KindCounter:
+		if count := s.count(name, tags, value); count > 0 {
+			s.client.Count(name, count, tags, 1)
+		}
+	case KindHistogram:
+		s.client.Distribution(name, value, tags, 1)
+	case KindGauge:
+		s.client.Gauge(name, value, tags, 1)
+	}
+}
+
+// count adds an increment to the remainder of a counter and returns the whole part to send, keeping the rest
+func (s *StatsD) count(name string, tags []string, value float64) int64 {
+	series := name + "|" + strings.Join(tags, ",")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	total := s.remainders[series] + value
+	count := math.Floor(total)
+	if remainder := total - count; remainder > 0 {
+		s.remainders[series] = remainder
+	} else {
+		delete(s.remainders, series)
+	}
+	return int64(count)
+}
+
+// Flush sends the aggregated and buffered metrics to the agent
+func (s *StatsD) Flush() error {
+	return s.client.Flush()
+}
+
+// Close flushes the metrics and stops sending them
+func (s *StatsD) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsD(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	statsd, err := NewStatsD(agent.LocalAddr().String(), "", []string{"env:prod"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statsd.Close()
+
+	registry := NewRegistry("llmrouter")
+	registry.Forward(statsd)
+	requests := registry.Counter("llmrouter_requests_total", "Requests.", "provider", "client_key")
+	cost := registry.Counter("llmrouter_cost_usd_total", "Cost.")
+	latency := registry.Histogram("llmrouter_request_duration_seconds", "Latency.", []float64{1}, "provider")
+	alerting := registry.Gauge("llmrouter_error_rate_alert", "Alerting.", "provider")
+	requests.Add(2, "open|ai", "")
+	cost.Add(0.75)
+	cost.Add(0.5)
+	latency.Observe(0.25, "openai")
+	alerting.Set(1, "openai")
+	if err := statsd.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"llmrouter_cost_usd_total:1|c|#env:prod",
+		"llmrouter_error_rate_alert:1|g|#env:prod,provider:openai",
+		"llmrouter_request_duration_seconds:0.25|d|#env:prod,provider:openai",
+		"llmrouter_requests_total:2|c|#env:prod,provider:open_ai",
+	}
+	var lines []string
+	agent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packet := make([]byte, 8192)
+	for len(lines) < len(want) {
+		n, _, err := agent.ReadFrom(packet)
+		if err != nil {
+			t.Fatalf("Expected %d lines, got %q: %v", len(want), lines, err)
+		}
+		lines = append(lines, strings.Split(strings.TrimSpace(string(packet[:n])), "\n")...)
+	}
+	if slices.Sort(lines); !slices.Equal(lines, want) {
+		t.Errorf("Unexpected lines:\n%s", strings.Join(lines, "\n"))
+	}
+	if v := requests.Value("open|ai", ""); v != 2 {
+		t.Errorf("Expected forwarded metrics to be counted too, got %v", v)
+	}
+	if v := cost.Value(); v != 1.25 {
+		t.Errorf("Expected the fractions of forwarded counters to be counted, got %v", v)
+	}
+}
@@ -0,0 +1,175 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: proto/chat.proto
+
+package llmrouterv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ChatCompletions_Create_FullMethodName       = "/llmrouter.v1.ChatCompletions/Create"
+	ChatCompletions_CreateStream_FullMethodName = "/llmrouter.v1.ChatCompletions/CreateStream"
+)
+
+// ChatCompletionsClient is the client API for ChatCompletions service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// ChatCompletions mirrors POST /v1/chat/completions for gRPC callers.
+// Fields are named as in the OpenAI chat completion API; request fields not defined here, including
+// provider-specific ones, can be passed in extra_body.
+type ChatCompletionsClient interface {
+	// Create returns a complete chat completion.
+	Create(ctx context.Context, in *ChatCompletionRequest, opts ...grpc.CallOption) (*ChatCompletionResponse, error)
+	// CreateStream streams chat completion chunks.
+	CreateStream(ctx context.Context, in *ChatCompletionRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ChatCompletionChunk], error)
+}
+
+type chatCompletionsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewChatCompletionsClient(cc grpc.ClientConnInterface) ChatCompletionsClient {
+	return &chatCompletionsClient{cc}
+}
+
+func (c *chatCompletionsClient) Create(ctx context.Context, in *ChatCompletionRequest, opts ...grpc.CallOption) (*ChatCompletionResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ChatCompletionResponse)
+	err := c.cc.Invoke(ctx, ChatCompletions_Create_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chatCompletionsClient) CreateStream(ctx context.Context, in *ChatCompletionRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ChatCompletionChunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ChatCompletions_ServiceDesc.Streams[0], ChatCompletions_CreateStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ChatCompletionRequest, ChatCompletionChunk]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ChatCompletions_CreateStreamClient = grpc.ServerStreamingClient[ChatCompletionChunk]
+
+// ChatCompletionsServer is the server API for ChatCompletions service.
+// All implementations must embed UnimplementedChatCompletionsServer
+// for forward compatibility.
+//
+// ChatCompletions mirrors POST /v1/chat/completions for gRPC callers.
+// Fields are named as in the OpenAI chat completion API; request fields not defined here, including
+// provider-specific ones, can be passed in extra_body.
+type ChatCompletionsServer interface {
+	// Create returns a complete chat completion.
+	Create(context.Context, *ChatCompletionRequest) (*ChatCompletionResponse, error)
+	// CreateStream streams chat completion chunks.
+	CreateStream(*ChatCompletionRequest, grpc.ServerStreamingServer[ChatCompletionChunk]) error
+	mustEmbedUnimplementedChatCompletionsServer()
+}
+
+// UnimplementedChatCompletionsServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedChatCompletionsServer struct{}
+
+func (UnimplementedChatCompletionsServer) Create(context.Context, *ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Create not implemented")
+}
+func (UnimplementedChatCompletionsServer) CreateStream(*ChatCompletionRequest, grpc.ServerStreamingServer[ChatCompletionChunk]) error {
+	return status.Errorf(codes.Unimplemented, "method CreateStream not implemented")
+}
+func (UnimplementedChatCompletionsServer) mustEmbedUnimplementedChatCompletionsServer() {}
+func (UnimplementedChatCompletionsServer) testEmbeddedByValue()                         {}
+
+// UnsafeChatCompletionsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ChatCompletionsServer will
+// result in compilation errors.
+type UnsafeChatCompletionsServer interface {
+	mustEmbedUnimplementedChatCompletionsServer()
+}
+
+func RegisterChatCompletionsServer(s grpc.ServiceRegistrar, srv ChatCompletionsServer) {
+	// If the following call pancis, it indicates UnimplementedChatCompletionsServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ChatCompletions_ServiceDesc, srv)
+}
+
+func _ChatCompletions_Create_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChatCompletionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChatCompletionsServer).Create(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChatCompletions_Create_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChatCompletionsServer).Create(ctx, req.(*ChatCompletionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChatCompletions_CreateStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ChatCompletionRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ChatCompletionsServer).CreateStream(m, &grpc.GenericServerStream[ChatCompletionRequest, ChatCompletionChunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ChatCompletions_CreateStreamServer = grpc.ServerStreamingServer[ChatCompletionChunk]
+
+// ChatCompletions_ServiceDesc is the grpc.ServiceDesc for ChatCompletions service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ChatCompletions_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "llmrouter.v1.ChatCompletions",
+	HandlerType: (*ChatCompletionsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Create",
+			Handler:    _ChatCompletions_Create_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "CreateStream",
+			Handler:       _ChatCompletions_CreateStream_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "proto/chat.proto",
+}
@@ -0,0 +1,5 @@
+// Package llmrouterv1 holds the messages and service stubs of the gRPC API of proto/chat.proto, generated with
+// protoc-gen-go and protoc-gen-go-grpc
+package llmrouterv1
+
+//go:generate protoc -I.. --go_out=.. --go_opt=paths=source_relative --go-grpc_out=.. --go-grpc_opt=paths=source_relative proto/chat.proto
@@ -0,0 +1,172 @@
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// MasterKeySize is the size of master keys, which are AES-256 keys
+const MasterKeySize = 32
+
+// GenerateMasterKey returns a random master key, base64-encoded
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, MasterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ParseMasterKey decodes a base64-encoded master key
+func ParseMasterKey(value string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("secrets: master key is not base64: %w", err)
+	}
+	if len(key) != MasterKeySize {
+		return nil, fmt.Errorf("secrets: master key has %d bytes instead of %d", len(key), MasterKeySize)
+	}
+	return key, nil
+}
+
+// Encrypt encrypts a secret with a master key using AES-256-GCM, returning its reference "enc:<ciphertext>",
+// the ciphertext being the base64-encoded nonce followed by the sealed secret
+func Encrypt(masterKey []byte, secret string) (string, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), nil)
+	return StoreEncrypted + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Encrypt encrypts a secret with the resolver's master key, as the package's Encrypt does
+func (r *Resolver) Encrypt(ctx context.Context, secret string) (string, error) {
+	key, err := r.loadMasterKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	return Encrypt(key, secret)
+}
+
+// decrypt opens a ciphertext sealed by Encrypt
+func decrypt(masterKey []byte, ciphertext string) (string, error) {
+	sealed, err := decodeCiphertext(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return "", err
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	secret, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", errors.New("cannot be decrypted with the master key")
+	}
+	return string(secret), nil
+}
+
+// decodeCiphertext decodes a ciphertext, checking that it is long enough to hold a nonce and a tag
+func decodeCiphertext(ciphertext string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, errors.New("ciphertext is not base64")
+	}
+	// The GCM nonce and tag sizes
+	if len(sealed) < 12+16 {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return sealed, nil
+}
+
+func newAEAD(masterKey []byte) (cipher.AEAD, error) {
+	if len(masterKey) != MasterKeySize {
+		return nil, fmt.Errorf("secrets: master key has %d bytes instead of %d", len(masterKey), MasterKeySize)
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// resolveEncrypted decrypts an encrypted secret with the master key
+func (r *Resolver) resolveEncrypted(ctx context.Context, ref Reference) (string, error) {
+	key, err := r.loadMasterKey(ctx)
+	if err != nil {
+		return "", fmt.Errorf("secrets: %s: %w", ref, err)
+	}
+	secret, err := decrypt(key, ref.Name)
+	if err != nil {
+		return "", fmt.Errorf("secrets: %s: %w", ref, err)
+	}
+	return secret, nil
+}
+
+// loadMasterKey returns the configured master key, or the KMS-encrypted one decrypted with KMS, which is
+// only asked once
+func (r *Resolver) loadMasterKey(ctx context.Context) ([]byte, error) {
+	r.masterMutex.Lock()
+	defer r.masterMutex.Unlock()
+	if r.masterKey != nil {
+		return r.masterKey, nil
+	}
+	var key []byte
+	var err error
+	switch {
+	case r.options.MasterKey != "":
+		key, err = ParseMasterKey(r.options.MasterKey)
+	case r.options.KMSMasterKey != "":
+		key, err = r.decryptKMS(ctx, r.options.KMSMasterKey)
+	default:
+		return nil, errors.New("no master key is configured, set LLM_ROUTER_MASTER_KEY or a KMS-encrypted master key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.masterKey = key
+	return key, nil
+}
+
+// decryptKMS decrypts a master key encrypted with AWS KMS
+func (r *Resolver) decryptKMS(ctx context.Context, ciphertext string) ([]byte, error) {
+	ref := Reference{Store: "aws-kms", Name: "master key"}
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(ciphertext))
+	if err != nil {
+		return nil, fmt.Errorf("secrets: %s is not base64: %w", ref, err)
+	}
+	cfg, err := r.loadAWSConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: %s: %w", ref, err)
+	}
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("secrets: %s: no AWS region is configured", ref)
+	}
+	client := kms.NewFromConfig(cfg, func(o *kms.Options) {
+		if r.options.KMSEndpoint != "" {
+			o.BaseEndpoint = aws.String(r.options.KMSEndpoint)
+		}
+	})
+	out, err := client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		return nil, fmt.Errorf("secrets: %s: %w", ref, err)
+	}
+	if len(out.Plaintext) != MasterKeySize {
+		return nil, fmt.Errorf("secrets: %s has %d bytes instead of %d", ref, len(out.Plaintext), MasterKeySize)
+	}
+	return out.Plaintext, nil
+}
@@ -0,0 +1,370 @@
+// Package secrets resolves references to secrets kept in HashiCorp Vault, AWS Secrets Manager, and GCP
+// Secret Manager, covering what the router uses to read provider API keys, and decrypts keys stored
+// encrypted in the configuration. AWS is accessed with the credentials of the AWS SDK's default chain and
+// GCP with Google's application default credentials, unless credentials are configured.
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Stores of the references, each the prefix of its references
+const (
+	StoreVault = "vault"
+	StoreAWS   = "aws-sm"
+	StoreGCP   = "gcp-sm"
+	// StoreEncrypted references are secrets encrypted with the master key rather than kept in a store
+	StoreEncrypted = "enc"
+)
+
+const (
+	defaultGCPEndpoint = "https://secretmanager.googleapis.com"
+	// gcpScope is the OAuth scope of the access tokens to Secret Manager
+	gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// Options configures access to the secret stores. Empty settings fall back to the environment variables
+// the stores' own tools read.
+type Options struct {
+	// VaultAddress is the URL of the Vault server, defaulting to VAULT_ADDR
+	VaultAddress string
+	// VaultToken authenticates to Vault, defaulting to VAULT_TOKEN
+	VaultToken string
+
+	// AWSRegion defaults to the region of the AWS SDK's shared configuration, e.g. AWS_REGION; references by
+	// ARN use the ARN's region
+	AWSRegion string
+	// AWS credentials, defaulting to those of the AWS SDK's default chain: the environment variables, the
+	// shared configuration and credentials files, web identity tokens, and the ECS and EC2 roles
+	AWSAccessKeyID     string
+	AWSSecretAccessKey string
+	AWSSessionToken    string
+	// AWSEndpoint overrides the regional Secrets Manager endpoint, e.g. for LocalStack
+	AWSEndpoint string
+
+	// GCPAccessToken authenticates to Secret Manager, defaulting to Google's application default credentials:
+	// GOOGLE_APPLICATION_CREDENTIALS, the gcloud credentials, or the service account of the metadata server
+	GCPAccessToken string
+	// GCPEndpoint overrides the Secret Manager endpoint
+	GCPEndpoint string
+
+	// MasterKey decrypts encrypted secrets, base64-encoded, defaulting to LLM_ROUTER_MASTER_KEY
+	MasterKey string
+	// KMSMasterKey is the master key encrypted with AWS KMS, base64-encoded, decrypted with the AWS
+	// credentials when MasterKey is empty
+	KMSMasterKey string
+	// KMSEndpoint overrides the regional KMS endpoint
+	KMSEndpoint string
+
+	// Timeout bounds each request to a store, defaulting to 10 seconds
+	Timeout time.Duration
+}
+
+// Reference designates a secret in a store, written as "<store>:<name>#<field>", e.g.
+// "vault:secret/data/llm-router#openai", "aws-sm:llm-router/openai", or
+// "gcp-sm:projects/acme/secrets/openai". The field selects a value of a secret holding a JSON object,
+// and is required for Vault. Encrypted secrets are written as "enc:<ciphertext>", the name being the
+// secret encrypted with Encrypt.
+type Reference struct {
+	Store string
+	Name  string
+	Field string
+}
+
+func (r Reference) String() string {
+	// Ciphertexts are too long to be readable in messages
+	if r.Store == StoreEncrypted && len(r.Name) > 12 {
+		return r.Store + ":" + r.Name[:12] + "..."
+	}
+	if r.Field == "" {
+		return r.Store + ":" + r.Name
+	}
+	return r.Store + ":" + r.Name + "#" + r.Field
+}
+
+// IsReference reports whether a value references a secret rather than being one
+func IsReference(value string) bool {
+	store, _, found := strings.Cut(value, ":")
+	return found && (store == StoreVault || store == StoreAWS || store == StoreGCP || store == StoreEncrypted)
+}
+
+// ParseReference parses a reference to a secret
+func ParseReference(value string) (Reference, error) {
+	if !IsReference(value) {
+		return Reference{}, fmt.Errorf("secrets: %q is not a reference to a secret", value)
+	}
+	store, rest, _ := strings.Cut(value, ":")
+	if store == StoreEncrypted {
+		ref := Reference{Store: store, Name: rest}
+		if _, err := decodeCiphertext(rest); err != nil {
+			return ref, fmt.Errorf("secrets: encrypted secret %s: %w", ref, err)
+		}
+		return ref, nil
+	}
+	name, field, _ := strings.Cut(rest, "#")
+	ref := Reference{Store: store, Name: name, Field: field}
+	if name == "" {
+		return ref, fmt.Errorf("secrets: reference %q has no secret name", value)
+	}
+	switch store {
+	case StoreVault:
+		if field == "" {
+			return ref, fmt.Errorf("secrets: Vault reference %q has no #field", value)
+		}
+	case StoreGCP:
+		if !strings.HasPrefix(name, "projects/") || !strings.Contains(name, "/secrets/") {
+			return ref, fmt.Errorf("secrets: GCP reference %q is not of the form projects/<project>/secrets/<secret>", value)
+		}
+	}
+	return ref, nil
+}
+
+// Resolver reads referenced secrets from their stores
+type Resolver struct {
+	options Options
+	client  *http.Client
+
+	// awsConfig holds the AWS credentials and region, loaded once AWS is first accessed
+	awsMutex  sync.Mutex
+	awsConfig *aws.Config
+
+	// gcpTokens are the access tokens of the application default credentials, found once GCP is first
+	// accessed
+	gcpMutex  sync.Mutex
+	gcpTokens oauth2.TokenSource
+
+	masterMutex sync.Mutex
+	masterKey   []byte
+}
+
+// NewResolver creates a resolver; stores are only contacted to resolve references
+func NewResolver(options Options) *Resolver {
+	fallback := func(value *string, variables ...string) {
+		for _, variable := range variables {
+			if *value == "" {
+				*value = os.Getenv(variable)
+			}
+		}
+	}
+	fallback(&options.VaultAddress, "VAULT_ADDR")
+	fallback(&options.VaultToken, "VAULT_TOKEN")
+	fallback(&options.MasterKey, "LLM_ROUTER_MASTER_KEY")
+	if options.GCPEndpoint == "" {
+		options.GCPEndpoint = defaultGCPEndpoint
+	}
+	if options.Timeout == 0 {
+		options.Timeout = 10 * time.Second
+	}
+	return &Resolver{options: options, client: &http.Client{Timeout: options.Timeout}}
+}
+
+// Resolve returns the current value of a referenced secret
+func (r *Resolver) Resolve(ctx context.Context, ref Reference) (string, error) {
+	var value string
+	var err error
+	switch ref.Store {
+	case StoreVault:
+		return r.resolveVault(ctx, ref)
+	case StoreAWS:
+		value, err = r.resolveAWS(ctx, ref)
+	case StoreGCP:
+		value, err = r.resolveGCP(ctx, ref)
+	case StoreEncrypted:
+		return r.resolveEncrypted(ctx, ref)
+	default:
+		return "", fmt.Errorf("secrets: unknown store %q", ref.Store)
+	}
+	if err != nil || ref.Field == "" {
+		return value, err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("secrets: %s is not a JSON object: %w", ref, err)
+	}
+	return field(ref, fields)
+}
+
+// resolveVault reads a secret of a KV secrets engine, either version
+func (r *Resolver) resolveVault(ctx context.Context, ref Reference) (string, error) {
+	if r.options.VaultAddress == "" {
+		return "", fmt.Errorf("secrets: %s: no Vault address is configured", ref)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(r.options.VaultAddress, "/")+"/v1/"+ref.Name, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", r.options.VaultToken)
+	var body struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := r.do(req, ref, &body); err != nil {
+		return "", err
+	}
+	// Version 2 nests the secret's data next to its metadata
+	data := body.Data
+	if nested, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+		data = nested
+	}
+	return field(ref, data)
+}
+
+// resolveAWS reads the string of a secret with GetSecretValue
+func (r *Resolver) resolveAWS(ctx context.Context, ref Reference) (string, error) {
+	cfg, err := r.loadAWSConfig(ctx)
+	if err != nil {
+		return "", fmt.Errorf("secrets: %s: %w", ref, err)
+	}
+	region := cfg.Region
+	// arn:aws:secretsmanager:<region>:<account>:secret:<name>
+	if parts := strings.Split(ref.Name, ":"); len(parts) > 3 && parts[0] == "arn" {
+		region = parts[3]
+	}
+	if region == "" {
+		return "", fmt.Errorf("secrets: %s: no AWS region is configured", ref)
+	}
+	client := secretsmanager.NewFromConfig(cfg, func(o *secretsmanager.Options) {
+		o.Region = region
+		if r.options.AWSEndpoint != "" {
+			o.BaseEndpoint = aws.String(r.options.AWSEndpoint)
+		}
+	})
+	out, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(ref.Name)})
+	if err != nil {
+		return "", fmt.Errorf("secrets: %s: %w", ref, err)
+	}
+	if out.SecretString == nil {
+		return "", fmt.Errorf("secrets: %s is a binary secret", ref)
+	}
+	return *out.SecretString, nil
+}
+
+// loadAWSConfig returns the configured AWS region and credentials, or else those of the AWS SDK's default
+// chain, which caches and refreshes the credentials it finds
+func (r *Resolver) loadAWSConfig(ctx context.Context) (aws.Config, error) {
+	r.awsMutex.Lock()
+	defer r.awsMutex.Unlock()
+	if r.awsConfig != nil {
+		return *r.awsConfig, nil
+	}
+	// The SDK's client, unlike r.client, takes the CA bundle of AWS_CA_BUNDLE
+	client := awshttp.NewBuildableClient().WithTimeout(r.options.Timeout)
+	options := []func(*awsconfig.LoadOptions) error{awsconfig.WithHTTPClient(client)}
+	if r.options.AWSRegion != "" {
+		options = append(options, awsconfig.WithRegion(r.options.AWSRegion))
+	}
+	if r.options.AWSAccessKeyID != "" {
+		options = append(options, awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			r.options.AWSAccessKeyID, r.options.AWSSecretAccessKey, r.options.AWSSessionToken)))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load the AWS configuration: %w", err)
+	}
+	r.awsConfig = &cfg
+	return cfg, nil
+}
+
+// resolveGCP accesses a version of a secret, the latest unless the name ends with one
+func (r *Resolver) resolveGCP(ctx context.Context, ref Reference) (string, error) {
+	name := ref.Name
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	token, err := r.gcpAccessToken(ctx)
+	if err != nil {
+		return "", fmt.Errorf("secrets: %s: %w", ref, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(r.options.GCPEndpoint, "/")+"/v1/"+name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	var body struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := r.do(req, ref, &body); err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(body.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("secrets: %s: %w", ref, err)
+	}
+	return string(data), nil
+}
+
+// gcpAccessToken returns the configured access token, or one of the application default credentials,
+// which are cached until shortly before they expire
+func (r *Resolver) gcpAccessToken(ctx context.Context) (string, error) {
+	if r.options.GCPAccessToken != "" {
+		return r.options.GCPAccessToken, nil
+	}
+	r.gcpMutex.Lock()
+	if r.gcpTokens == nil {
+		// The token source outlives ctx, refreshing the tokens with the resolver's client
+		credentials, err := google.FindDefaultCredentials(context.WithValue(context.Background(), oauth2.HTTPClient, r.client), gcpScope)
+		if err != nil {
+			r.gcpMutex.Unlock()
+			return "", err
+		}
+		r.gcpTokens = credentials.TokenSource
+	}
+	tokens := r.gcpTokens
+	r.gcpMutex.Unlock()
+	token, err := tokens.Token()
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// do sends a request to a store and decodes its JSON response into v
+func (r *Resolver) do(req *http.Request, ref Reference, v any) error {
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("secrets: %s: %w", ref, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("secrets: %s: %w", ref, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("secrets: %s: store responded %d: %s", ref, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("secrets: %s: %w", ref, err)
+	}
+	return nil
+}
+
+// field returns the string value of the referenced field
+func field(ref Reference, fields map[string]any) (string, error) {
+	value, exists := fields[ref.Field]
+	if !exists {
+		return "", fmt.Errorf("secrets: %s: no field %q", ref, ref.Field)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("secrets: %s: field is not a string", ref)
+	}
+	return s, nil
+}
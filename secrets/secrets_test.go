@@ -0,0 +1,155 @@
+package secrets
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	ref, err := ParseReference("vault:secret/data/llm-router#openai")
+	if err != nil || ref != (Reference{Store: StoreVault, Name: "secret/data/llm-router", Field: "openai"}) {
+		t.Errorf("Unexpected Vault reference %+v, %v", ref, err)
+	}
+	for _, value := range []string{"vault:secret/data/llm-router", "aws-sm:", "gcp-sm:openai", "sk-123"} {
+		if _, err := ParseReference(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+	if IsReference("sk-vault:123") || !IsReference("aws-sm:llm-router/openai") {
+		t.Errorf("Unexpected references detected")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	var awsAuthorization string
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/secret/data/llm-router":
+			if r.Header.Get("X-Vault-Token") != "vault-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(`{"data":{"data":{"openai":"sk-vault"},"metadata":{"version":3}}}`))
+		case r.URL.Path == "/" && r.Header.Get("X-Amz-Target") == "secretsmanager.GetSecretValue":
+			awsAuthorization = r.Header.Get("Authorization")
+			w.Write([]byte(`{"Name":"llm-router","SecretString":"{\"openai\":\"sk-aws\"}"}`))
+		case r.URL.Path == "/token" && r.FormValue("refresh_token") == "gcp-refresh-token":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"gcp-token","expires_in":3600,"token_type":"Bearer"}`))
+		case r.URL.Path == "/v1/projects/acme/secrets/openai/versions/latest:access":
+			if r.Header.Get("Authorization") != "Bearer gcp-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"payload":{"data":"c2stZ2Nw"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer store.Close()
+
+	// The AWS and GCP credentials are found by the default chains
+	dir := t.TempDir()
+	gcpCredentials := filepath.Join(dir, "gcp.json")
+	os.WriteFile(gcpCredentials, []byte(`{"type":"authorized_user","client_id":"id","client_secret":"secret","refresh_token":"gcp-refresh-token","token_uri":"`+store.URL+`/token"}`), 0o600)
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", gcpCredentials)
+	isolateAWS(t)
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	r := NewResolver(Options{
+		VaultAddress: store.URL,
+		VaultToken:   "vault-token",
+		AWSEndpoint:  store.URL,
+		GCPEndpoint:  store.URL,
+	})
+	for value, expected := range map[string]string{
+		"vault:secret/data/llm-router#openai": "sk-vault",
+		"aws-sm:llm-router#openai":            "sk-aws",
+		"gcp-sm:projects/acme/secrets/openai": "sk-gcp",
+	} {
+		ref, err := ParseReference(value)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", value, err)
+		}
+		secret, err := r.Resolve(context.Background(), ref)
+		if err != nil || secret != expected {
+			t.Errorf("Expected %q to resolve to %q, got %q, %v", value, expected, secret, err)
+		}
+	}
+	if !strings.HasPrefix(awsAuthorization, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(awsAuthorization, "/eu-west-1/secretsmanager/aws4_request") {
+		t.Errorf("Unexpected AWS authorization %q", awsAuthorization)
+	}
+
+	for _, value := range []string{"vault:secret/data/llm-router#anthropic", "gcp-sm:projects/acme/secrets/missing"} {
+		ref, _ := ParseReference(value)
+		if _, err := r.Resolve(context.Background(), ref); err == nil {
+			t.Errorf("Expected %q to fail", value)
+		}
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	masterKey, err := GenerateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ParseMasterKey(masterKey)
+	encrypted, err := Encrypt(key, "sk-encrypted")
+	if err != nil || !IsReference(encrypted) || strings.Contains(encrypted, "sk-encrypted") {
+		t.Fatalf("Unexpected encrypted key %q, %v", encrypted, err)
+	}
+	ref, err := ParseReference(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := NewResolver(Options{MasterKey: masterKey}).Resolve(context.Background(), ref); err != nil || secret != "sk-encrypted" {
+		t.Errorf("Expected the key to decrypt, got %q, %v", secret, err)
+	}
+	other, _ := GenerateMasterKey()
+	if _, err := NewResolver(Options{MasterKey: other}).Resolve(context.Background(), ref); err == nil {
+		t.Errorf("Expected a different master key to fail")
+	}
+	for _, value := range []string{"enc:not base64!", "enc:c2stZ2Nw"} {
+		if _, err := ParseReference(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+
+	isolateAWS(t)
+	var kmsAuthorization string
+	kms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kmsAuthorization = r.Header.Get("Authorization")
+		if r.Header.Get("X-Amz-Target") != "TrentService.Decrypt" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"Plaintext":"` + masterKey + `"}`))
+	}))
+	defer kms.Close()
+	r := NewResolver(Options{KMSMasterKey: "AQICAHhrbXMtbWFzdGVyLWtleQ==", KMSEndpoint: kms.URL, AWSRegion: "eu-west-1", AWSAccessKeyID: "AKID", AWSSecretAccessKey: "secret"})
+	r.options.MasterKey = ""
+	if secret, err := r.Resolve(context.Background(), ref); err != nil || secret != "sk-encrypted" {
+		t.Errorf("Expected the key to decrypt with the KMS master key, got %q, %v", secret, err)
+	}
+	if !strings.HasPrefix(kmsAuthorization, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(kmsAuthorization, "/eu-west-1/kms/aws4_request") {
+		t.Errorf("Unexpected KMS authorization %q", kmsAuthorization)
+	}
+}
+
+// isolateAWS keeps the AWS SDK from finding the credentials and configuration of the machine running the tests
+func isolateAWS(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	for _, name := range []string{"AWS_PROFILE", "AWS_REGION", "AWS_DEFAULT_REGION", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"} {
+		t.Setenv(name, "")
+	}
+}
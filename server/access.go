@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// statusRecorder records the status and size of a response for its span and access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush flushes streamed responses
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type accessEntryKey struct{}
+
+// accessEntry collects what the handlers of a request learn about it for its access log line
+type accessEntry struct {
+	clientKey string
+}
+
+// accessEntryFrom returns the access log entry of a request's context, or nil when access logging is disabled
+func accessEntryFrom(ctx context.Context) *accessEntry {
+	entry, _ := ctx.Value(accessEntryKey{}).(*accessEntry)
+	return entry
+}
+
+// accessLog logs a line per request served by a handler to the access log, unless it is disabled
+func (s *Server) accessLog(next http.Handler) http.Handler {
+	if s.AccessLog == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessEntry{}
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), accessEntryKey{}, entry)))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		header := w.Header()
+		s.AccessLog.LogAttrs(r.Context(), slog.LevelInfo, "access",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Int64("bytes", recorder.bytes),
+			slog.Int64("duration_ms", time.Since(start).Milliseconds()),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("client_ip", clientIPFromContext(r.Context())),
+			slog.String("client_key", entry.clientKey),
+			slog.String("provider", header.Get(HeaderProvider)),
+			slog.String("model", header.Get(HeaderModel)),
+			slog.String("key_alias", header.Get(HeaderKeyAlias)),
+			slog.String("request_id", header.Get(HeaderRequestID)))
+	})
+}
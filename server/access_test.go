@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var out strings.Builder
+	s := NewServer("", slog.New(slog.NewTextHandler(io.Discard, nil)), Handlers{})
+	s.ClientKeys = []ClientKey{{Name: "backend", Key: "sk-backend"}}
+	s.AccessLog = slog.New(slog.NewJSONHandler(&out, nil))
+	handler := s.accessLog(s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderProvider, "openai")
+		w.Header().Set(HeaderModel, "gpt-4o")
+		w.Header().Set(HeaderKeyAlias, "openai/1")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "hello")
+	})))
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	req.Header.Set("Authorization", "Bearer sk-backend")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	var line map[string]any
+	if err := json.Unmarshal([]byte(out.String()), &line); err != nil {
+		t.Fatalf("Expected a JSON line, got %q", out.String())
+	}
+	for field, want := range map[string]any{"method": "POST", "path": "/v1/chat/completions", "status": 201.0, "bytes": 5.0,
+		"client_key": "backend", "provider": "openai", "model": "gpt-4o", "key_alias": "openai/1"} {
+		if line[field] != want {
+			t.Errorf("Expected %s %v, got %v", field, want, line[field])
+		}
+	}
+	if strings.Contains(out.String(), "sk-backend") {
+		t.Errorf("Expected the client key itself not to be logged")
+	}
+
+	// Rejected requests are logged too
+	out.Reset()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/models", nil))
+	if !strings.Contains(out.String(), `"status":401`) {
+		t.Errorf("Expected the unauthorized request to be logged, got %s", out.String())
+	}
+}
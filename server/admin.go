@@ -0,0 +1,521 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"llm-router/ledger"
+	"llm-router/metrics"
+	"llm-router/utils"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrAdminNotFound is returned by the admin callbacks changing the configuration for a provider, key, group, or
+// model that does not exist
+var ErrAdminNotFound = errors.New("not found")
+
+// AdminGroup describes a configured group in the admin API
+type AdminGroup struct {
+	Name   string       `json:"name"`
+	Models []AdminModel `json:"models"`
+	// Disabled is set for groups disabled in the configuration or through the admin API, which are not routed to
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// AdminModel describes a model of a group in the admin API
+type AdminModel struct {
+	Provider      string   `json:"provider"`
+	Name          string   `json:"name"`
+	Weight        int64    `json:"weight"`
+	ContextWindow int64    `json:"context_window,omitempty"`
+	Capabilities  []string `json:"capabilities,omitempty"`
+}
+
+// AdminProvider describes a provider and the state of its keys in the admin API
+type AdminProvider struct {
+	Name    string     `json:"name"`
+	BaseURL string     `json:"base_url"`
+	Keys    []AdminKey `json:"keys"`
+	// Streaming is the recent streaming performance of the provider's models, by model
+	Streaming map[string]AdminStreamStats `json:"streaming,omitempty"`
+}
+
+// AdminStreamStats is the recent streaming performance of a model of a provider, as moving averages weighing
+// the latest streams most
+type AdminStreamStats struct {
+	// Streams counts the streams that generated tokens
+	Streams int64 `json:"streams"`
+	// TimeToFirstTokenMs is the time from the request of a stream to its first generated token
+	TimeToFirstTokenMs float64 `json:"time_to_first_token_ms"`
+	// TokensPerSecond is the rate completion tokens are generated at after the first token
+	TokensPerSecond float64 `json:"tokens_per_second"`
+}
+
+// AdminKey describes the health, state, and per-model usage of a provider key.
+// Keys are identified by their index in the provider's api_keys, followed by free_api_keys, and never exposed in full.
+type AdminKey struct {
+	Index       int        `json:"index"`
+	Key         string     `json:"key"`
+	Status      string     `json:"status"`
+	Requests    int64      `json:"requests"`
+	Errors      int64      `json:"errors"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	// Free is set for keys on a free or trial tier
+	Free bool `json:"free,omitempty"`
+	// RateLimitedUntil is the end of the cooldown of a key the provider rate limited
+	RateLimitedUntil *time.Time       `json:"rate_limited_until,omitempty"`
+	Usage            map[string]int64 `json:"usage"`
+	// Tokens are the prompt, completion, and reasoning tokens per model
+	Tokens map[string]AdminTokens `json:"tokens,omitempty"`
+	// Cost is the accumulated cost in USD per model with a configured price
+	Cost map[string]float64 `json:"cost,omitempty"`
+}
+
+// AdminTokens are the tokens of a model by kind
+type AdminTokens struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CachedTokens     int64 `json:"cached_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	ReasoningTokens  int64 `json:"reasoning_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+}
+
+// AdminKeyStatus reports the state of a provider key bearing on whether requests are routed to it, listed by
+// GET /admin/keys
+type AdminKeyStatus struct {
+	// Alias identifies the key as "provider/hash", as in the metrics and the request ledger
+	Alias    string `json:"alias"`
+	Provider string `json:"provider"`
+	Index    int    `json:"index"`
+	Key      string `json:"key"`
+	Free     bool   `json:"free,omitempty"`
+	// Tenant is the tenant the key is dedicated to, if any
+	Tenant string `json:"tenant,omitempty"`
+	Status string `json:"status"`
+	// Health is the outcome of the latest probe of the key, KeyHealthUnknown when it was never probed
+	Health string `json:"health"`
+	// HealthError is why the latest probe found the key unhealthy
+	HealthError string `json:"health_error,omitempty"`
+	// Circuit is open while the key cools down after the provider rate limited it
+	Circuit          string     `json:"circuit"`
+	CircuitOpenUntil *time.Time `json:"circuit_open_until,omitempty"`
+	// Unavailable is why new requests are not routed to the key, empty when they are
+	Unavailable string     `json:"unavailable,omitempty"`
+	Requests    int64      `json:"requests"`
+	Errors      int64      `json:"errors"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	// Budgets are the budgets of the key and its provider with their usage in the current periods
+	Budgets []AdminBudgetUsage `json:"budgets,omitempty"`
+}
+
+// AdminBudgetUsage is the usage of a budget in its current period against its limits, zero limits being
+// unlimited
+type AdminBudgetUsage struct {
+	// Scope is what the budget limits, e.g. "key openai/3f2a9c1d0b7e" or "provider openai"
+	Scope       string    `json:"scope"`
+	Period      string    `json:"period"`
+	Tokens      int64     `json:"tokens"`
+	TokensLimit int64     `json:"tokens_limit,omitempty"`
+	Cost        float64   `json:"cost"`
+	CostLimit   float64   `json:"cost_limit,omitempty"`
+	ResetsAt    time.Time `json:"resets_at"`
+}
+
+// AdminUsageSnapshot is the usage counted for every provider key, returned by /admin/usage/snapshot and
+// accepted by /admin/usage/restore to move usage between router instances or correct it after an incident
+type AdminUsageSnapshot struct {
+	Object    string               `json:"object"`
+	CreatedAt int64                `json:"created_at"`
+	Providers []AdminProviderUsage `json:"providers"`
+}
+
+// AdminProviderUsage is the usage counted for the keys of a provider in a usage snapshot
+type AdminProviderUsage struct {
+	Name string          `json:"name"`
+	Keys []AdminKeyUsage `json:"keys"`
+}
+
+// AdminKeyUsage is the usage counted for a provider key per model in a usage snapshot. Key is the redacted
+// key, which restores check against the key at Index when set.
+type AdminKeyUsage struct {
+	Index  int                    `json:"index"`
+	Key    string                 `json:"key,omitempty"`
+	Usage  map[string]int64       `json:"usage,omitempty"`
+	Tokens map[string]AdminTokens `json:"tokens,omitempty"`
+	Cost   map[string]float64     `json:"cost,omitempty"`
+}
+
+// Key statuses reported by the admin API
+const (
+	KeyStatusActive  = "active"
+	KeyStatusDrained = "drained"
+)
+
+// Key health and circuit states reported by GET /admin/keys
+const (
+	KeyHealthHealthy   = "healthy"
+	KeyHealthUnhealthy = "unhealthy"
+	KeyHealthUnknown   = "unknown"
+	CircuitClosed      = "closed"
+	CircuitOpen        = "open"
+)
+
+// AdminHandlers holds the application callbacks serving the admin API
+type AdminHandlers struct {
+	Groups    func() []AdminGroup
+	Providers func() []AdminProvider
+	// KeyStatus returns the state of every provider key
+	KeyStatus func() []AdminKeyStatus
+	// SetKeyDrained drains or undrains a provider key, returning false if it does not exist
+	SetKeyDrained func(provider string, index int, drained bool) bool
+	// Requests returns the recorded requests matching a filter, nil when the request ledger is disabled
+	Requests func(filter ledger.Filter) ([]ledger.Entry, error)
+	// RequestUsage sums the recorded requests matching a filter per bucket of time, provider, model, and key, set
+	// along Requests
+	RequestUsage func(filter ledger.Filter, bucket time.Duration) ([]ledger.Usage, error)
+	// SnapshotUsage returns the usage counted for every provider key
+	SnapshotUsage func() AdminUsageSnapshot
+	// RestoreUsage sets the usage of the keys and models in a snapshot, changing none if a key does not exist
+	RestoreUsage func(snapshot AdminUsageSnapshot) error
+	// AddKey adds a key to a provider, returning its index
+	AddKey func(provider string, key string, free bool) (int, error)
+	// RemoveKey removes a provider key
+	RemoveKey func(provider string, index int) error
+	// SetModelWeight sets the weight of the model at an index of a group
+	SetModelWeight func(group string, index int, weight int64) error
+	// SetGroupEnabled enables or disables a group
+	SetGroupEnabled func(group string, enabled bool) error
+	// ConfigStatus reports the configuration being served and the outcome of the latest reload
+	ConfigStatus func() AdminConfigStatus
+	// Audit records a change made through the admin API, nil when the audit log is disabled
+	Audit func(entry AdminAuditEntry)
+	// Metrics describes the metrics the router exposes, nil when metrics are disabled
+	Metrics func() []metrics.Descriptor
+}
+
+// AdminConfigStatus reports the configuration being served and the outcome of the latest reload
+type AdminConfigStatus struct {
+	// ConfigHash identifies the configuration being served, as reported by /version
+	ConfigHash string `json:"config_hash"`
+	// AppliedAt is when the configuration being served was loaded, reloaded, or changed through the admin API
+	AppliedAt time.Time `json:"applied_at"`
+	// LastError is why the latest reload failed, empty when it succeeded
+	LastError string `json:"last_error,omitempty"`
+	// LastFailedAt is when a reload last failed
+	LastFailedAt *time.Time `json:"last_failed_at,omitempty"`
+	// Failures counts the reloads that failed since the last one that succeeded
+	Failures int `json:"failures"`
+	// Warnings are the settings of the configuration being served that are valid but likely a mistake
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// AdminKeyRequest is the body of POST /admin/providers/{provider}/keys
+type AdminKeyRequest struct {
+	Key  string `json:"key"`
+	Free bool   `json:"free,omitempty"`
+}
+
+// AdminWeightRequest is the body of PUT /admin/groups/{group}/models/{index}/weight
+type AdminWeightRequest struct {
+	Weight *int64 `json:"weight"`
+}
+
+// Limits of the requests listed by /admin/requests
+const (
+	defaultAdminRequestsLimit = 100
+	maxAdminRequestsLimit     = 1000
+)
+
+// adminMiddleware rejects requests without the admin API key
+func (s *Server) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		key := strings.TrimPrefix(authHeader, "Bearer ")
+		if !strings.HasPrefix(authHeader, "Bearer ") || subtle.ConstantTimeCompare([]byte(key), []byte(s.AdminAPIKey)) != 1 {
+			s.Logger.Warn("Invalid or missing admin API key",
+				slog.String("path", r.URL.Path),
+				slog.String("receivedAuthHeader", utils.RedactAuthorization(authHeader)))
+			writeOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "Invalid or missing admin API key")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminMux returns the handler of the admin API:
+//
+//	GET  /admin/groups                                  configured groups and their models
+//	GET  /admin/providers                               providers with per-key health, state, and usage
+//	GET  /admin/keys                                    every key's health, circuit, budgets, and why it is not routed to
+//	GET  /admin/usage                                   per-key, per-model usage
+//	GET  /admin/usage/snapshot                          usage counters of every key, to be restored later or elsewhere
+//	POST /admin/usage/restore                           set the usage counters of the keys in a snapshot
+//	GET  /admin/usage/export                            daily usage and cost as CSV or JSON for billing
+//	GET  /admin/chargeback                              monthly usage and cost per tenant and model
+//	GET  /admin/requests                                recorded requests, the most recent first
+//	GET  /admin/config/status                           configuration being served and outcome of the latest reload
+//	GET  /admin/usage/history                           usage and cost per model and key in time buckets
+//	GET  /admin/metrics                                 catalog of the metrics with their kind, labels, and buckets
+//	GET  /admin/dashboard                               web dashboard, the only endpoint without authentication
+//	POST /admin/providers/{provider}/keys/{index}/drain    stop routing new requests to a key
+//	POST /admin/providers/{provider}/keys/{index}/undrain  resume routing requests to a key
+//	POST /admin/providers/{provider}/keys                  add a key to a provider
+//	DELETE /admin/providers/{provider}/keys/{index}        remove a key from a provider
+//	PUT  /admin/groups/{group}/models/{index}/weight       set the weight of a model of a group
+//	POST /admin/groups/{group}/disable                     stop routing requests to a group
+//	POST /admin/groups/{group}/enable                      resume routing requests to a group
+//
+// The endpoints changing the configuration apply the change like a reload and persist it to overlay_file.
+func (s *Server) AdminMux(handlers AdminHandlers) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/groups", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": handlers.Groups()})
+	})
+	mux.HandleFunc("GET /admin/providers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": handlers.Providers()})
+	})
+	if handlers.KeyStatus != nil {
+		mux.HandleFunc("GET /admin/keys", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": handlers.KeyStatus()})
+		})
+	}
+	if handlers.ConfigStatus != nil {
+		mux.HandleFunc("GET /admin/config/status", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, handlers.ConfigStatus())
+		})
+	}
+	mux.HandleFunc("GET /admin/usage", func(w http.ResponseWriter, r *http.Request) {
+		usage := make(map[string]map[string]map[string]int64)
+		for _, provider := range handlers.Providers() {
+			keys := make(map[string]map[string]int64)
+			for _, key := range provider.Keys {
+				keys[strconv.Itoa(key.Index)] = key.Usage
+			}
+			usage[provider.Name] = keys
+		}
+		writeJSON(w, http.StatusOK, usage)
+	})
+	if handlers.SnapshotUsage != nil {
+		mux.HandleFunc("GET /admin/usage/snapshot", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, handlers.SnapshotUsage())
+		})
+	}
+	if handlers.RestoreUsage != nil {
+		restore := s.handleAdminUsageRestore(handlers.RestoreUsage)
+		if handlers.SnapshotUsage != nil {
+			restore = audited(handlers.Audit, AuditUsageRestore, auditUsageTarget, auditUsage(handlers.SnapshotUsage), restore)
+		}
+		mux.HandleFunc("POST /admin/usage/restore", restore)
+	}
+	if s.handleUsage != nil {
+		mux.HandleFunc("GET /admin/usage/export", s.HandleUsageExportRequest(s.handleUsage))
+		mux.HandleFunc("GET /admin/chargeback", s.HandleChargebackRequest(s.handleUsage))
+	}
+	if handlers.Metrics != nil {
+		mux.HandleFunc("GET /admin/metrics", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": handlers.Metrics()})
+		})
+	}
+	if handlers.Requests != nil {
+		mux.HandleFunc("GET /admin/requests", s.handleAdminRequests(handlers.Requests))
+		mux.HandleFunc("GET /admin/usage/history", s.handleAdminUsageHistory(handlers.RequestUsage))
+	}
+	setDrained := func(drained bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			provider := r.PathValue("provider")
+			index, err := strconv.Atoi(r.PathValue("index"))
+			if err != nil || !handlers.SetKeyDrained(provider, index, drained) {
+				writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "key_not_found", "No key "+r.PathValue("index")+" for provider "+provider)
+				return
+			}
+			s.Logger.Info("Key state changed by admin", slog.String("provider", provider), slog.Int("index", index), slog.Bool("drained", drained))
+			status := KeyStatusActive
+			if drained {
+				status = KeyStatusDrained
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"provider": provider, "index": index, "status": status})
+		}
+	}
+	// Changes are recorded in the audit log with the state of what they changed before and after them
+	key, keys := auditKey(handlers.Providers), auditKeys(handlers.Providers)
+	mux.HandleFunc("POST /admin/providers/{provider}/keys/{index}/drain", audited(handlers.Audit, AuditKeyDrain, auditKeyTarget, key, setDrained(true)))
+	mux.HandleFunc("POST /admin/providers/{provider}/keys/{index}/undrain", audited(handlers.Audit, AuditKeyUndrain, auditKeyTarget, key, setDrained(false)))
+	if handlers.AddKey != nil {
+		mux.HandleFunc("POST /admin/providers/{provider}/keys", audited(handlers.Audit, AuditKeyAdd, auditProviderTarget, keys, s.handleAdminAddKey(handlers.AddKey)))
+	}
+	if handlers.RemoveKey != nil {
+		mux.HandleFunc("DELETE /admin/providers/{provider}/keys/{index}", audited(handlers.Audit, AuditKeyRemove, auditProviderTarget, keys, s.handleAdminRemoveKey(handlers.RemoveKey)))
+	}
+	if handlers.SetModelWeight != nil {
+		mux.HandleFunc("PUT /admin/groups/{group}/models/{index}/weight", audited(handlers.Audit, AuditModelWeight, auditModelTarget, auditWeight(handlers.Groups), s.handleAdminSetWeight(handlers.SetModelWeight)))
+	}
+	if handlers.SetGroupEnabled != nil {
+		group := auditGroup(handlers.Groups)
+		mux.HandleFunc("POST /admin/groups/{group}/disable", audited(handlers.Audit, AuditGroupDisable, auditGroupTarget, group, s.handleAdminSetGroupEnabled(handlers.SetGroupEnabled, false)))
+		mux.HandleFunc("POST /admin/groups/{group}/enable", audited(handlers.Audit, AuditGroupEnable, auditGroupTarget, group, s.handleAdminSetGroupEnabled(handlers.SetGroupEnabled, true)))
+	}
+
+	root := http.NewServeMux()
+	root.HandleFunc("GET /admin/dashboard", handleDashboard)
+	root.Handle("/admin/", s.adminMiddleware(mux))
+	return root
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// handleAdminRequests lists the recorded requests within the range of HandleUsageRequest, optionally filtered by
+// client_key, group, and status, up to limit requests
+func (s *Server) handleAdminRequests(requests func(filter ledger.Filter) ([]ledger.Entry, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, end, err := parseUsageRange(r)
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+			return
+		}
+		query := r.URL.Query()
+		filter := ledger.Filter{
+			Start:     start,
+			End:       end,
+			ClientKey: query.Get("client_key"),
+			Group:     query.Get("group"),
+			Status:    query.Get("status"),
+			Limit:     defaultAdminRequestsLimit,
+		}
+		if v := query.Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > maxAdminRequestsLimit {
+				writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "limit must be between 1 and "+strconv.Itoa(maxAdminRequestsLimit))
+				return
+			}
+			filter.Limit = limit
+		}
+		entries, err := requests(filter)
+		if err != nil {
+			s.Logger.Error("Failed to read request ledger", slog.Any("error", err))
+			writeOpenAIError(w, http.StatusInternalServerError, "server_error", "", "failed to read request ledger")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": entries})
+	}
+}
+
+// handleAdminUsageRestore sets the usage counters of the keys in a snapshot posted as JSON
+func (s *Server) handleAdminUsageRestore(restore func(snapshot AdminUsageSnapshot) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var snapshot AdminUsageSnapshot
+		if err := json.NewDecoder(r.Body).Decode(&snapshot); err != nil {
+			if writeBodyError(w, err) {
+				return
+			}
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "Invalid usage snapshot: "+err.Error())
+			return
+		}
+		if err := restore(snapshot); err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+			return
+		}
+		keys := 0
+		for _, provider := range snapshot.Providers {
+			keys += len(provider.Keys)
+		}
+		s.Logger.Info("Usage restored by admin", slog.Int("keys", keys))
+		writeJSON(w, http.StatusOK, map[string]any{"object": "usage_restore", "keys": keys})
+	}
+}
+
+// writeAdminChangeError writes a 404 error if a configuration change failed on something that does not exist,
+// or a 400 error otherwise
+func writeAdminChangeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrAdminNotFound) {
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "not_found", err.Error())
+		return
+	}
+	writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+}
+
+// handleAdminAddKey adds the key posted as JSON to a provider
+func (s *Server) handleAdminAddKey(addKey func(provider string, key string, free bool) (int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req AdminKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			if writeBodyError(w, err) {
+				return
+			}
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "Invalid key: "+err.Error())
+			return
+		}
+		provider := r.PathValue("provider")
+		index, err := addKey(provider, req.Key, req.Free)
+		if err != nil {
+			writeAdminChangeError(w, err)
+			return
+		}
+		s.Logger.Info("Key added by admin", slog.String("provider", provider), slog.Int("index", index), slog.Bool("free", req.Free))
+		writeJSON(w, http.StatusCreated, map[string]any{"provider": provider, "index": index, "status": KeyStatusActive})
+	}
+}
+
+// handleAdminRemoveKey removes a provider key
+func (s *Server) handleAdminRemoveKey(removeKey func(provider string, index int) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider := r.PathValue("provider")
+		index, err := strconv.Atoi(r.PathValue("index"))
+		if err != nil {
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "key_not_found", "No key "+r.PathValue("index")+" for provider "+provider)
+			return
+		}
+		if err := removeKey(provider, index); err != nil {
+			writeAdminChangeError(w, err)
+			return
+		}
+		s.Logger.Info("Key removed by admin", slog.String("provider", provider), slog.Int("index", index))
+		writeJSON(w, http.StatusOK, map[string]any{"provider": provider, "index": index, "deleted": true})
+	}
+}
+
+// handleAdminSetWeight sets the weight posted as JSON of a model of a group
+func (s *Server) handleAdminSetWeight(setWeight func(group string, index int, weight int64) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group := r.PathValue("group")
+		index, err := strconv.Atoi(r.PathValue("index"))
+		if err != nil {
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "not_found", "No model "+r.PathValue("index")+" in group "+group)
+			return
+		}
+		var req AdminWeightRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Weight == nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "Expected a weight")
+			return
+		}
+		if err := setWeight(group, index, *req.Weight); err != nil {
+			writeAdminChangeError(w, err)
+			return
+		}
+		s.Logger.Info("Model weight changed by admin", slog.String("group", group), slog.Int("index", index), slog.Int64("weight", *req.Weight))
+		writeJSON(w, http.StatusOK, map[string]any{"group": group, "index": index, "weight": *req.Weight})
+	}
+}
+
+// handleAdminSetGroupEnabled enables or disables a group
+func (s *Server) handleAdminSetGroupEnabled(setEnabled func(group string, enabled bool) error, enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group := r.PathValue("group")
+		if err := setEnabled(group, enabled); err != nil {
+			writeAdminChangeError(w, err)
+			return
+		}
+		s.Logger.Info("Group state changed by admin", slog.String("group", group), slog.Bool("enabled", enabled))
+		writeJSON(w, http.StatusOK, map[string]any{"group": group, "disabled": !enabled})
+	}
+}
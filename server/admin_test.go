@@ -0,0 +1,457 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"llm-router/ledger"
+	"llm-router/usage"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAPI(t *testing.T) {
+	drained := false
+	s := &Server{
+		APIKey:      "router-key",
+		AdminAPIKey: "admin-key",
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	handler := s.AdminMux(AdminHandlers{
+		Groups: func() []AdminGroup {
+			return []AdminGroup{{Name: "fast", Models: []AdminModel{{Provider: "openai", Name: "gpt-4o-mini", Weight: 1}}}}
+		},
+		Providers: func() []AdminProvider {
+			status := KeyStatusActive
+			if drained {
+				status = KeyStatusDrained
+			}
+			return []AdminProvider{{Name: "openai", Keys: []AdminKey{{Index: 0, Key: "sk-...abcd", Status: status, Usage: map[string]int64{"gpt-4o-mini": 42}}}}}
+		},
+		KeyStatus: func() []AdminKeyStatus {
+			return []AdminKeyStatus{{Alias: "openai/0", Provider: "openai", Health: KeyHealthHealthy, Circuit: CircuitClosed}}
+		},
+		SetKeyDrained: func(provider string, index int, value bool) bool {
+			if provider != "openai" || index != 0 {
+				return false
+			}
+			drained = value
+			return true
+		},
+	})
+
+	do := func(method, path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("GET", "/admin/providers", "router-key"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the client API key to be rejected, got %d", w.Code)
+	}
+
+	w := do("GET", "/admin/usage", "admin-key")
+	var usage map[string]map[string]map[string]int64
+	if err := json.Unmarshal(w.Body.Bytes(), &usage); err != nil || usage["openai"]["0"]["gpt-4o-mini"] != 42 {
+		t.Errorf("Expected per-key usage, got %s (%v)", w.Body.String(), err)
+	}
+
+	if w := do("POST", "/admin/providers/openai/keys/0/drain", "admin-key"); w.Code != http.StatusOK || !drained {
+		t.Errorf("Expected key to be drained, got %d: %s", w.Code, w.Body.String())
+	}
+	w = do("GET", "/admin/providers", "admin-key")
+	var providers struct {
+		Data []AdminProvider `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &providers); err != nil || providers.Data[0].Keys[0].Status != KeyStatusDrained {
+		t.Errorf("Expected drained key status, got %s (%v)", w.Body.String(), err)
+	}
+	if w := do("POST", "/admin/providers/openai/keys/0/undrain", "admin-key"); w.Code != http.StatusOK || drained {
+		t.Errorf("Expected key to be undrained, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/admin/providers/openai/keys/5/drain", "admin-key"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown key, got %d", w.Code)
+	}
+
+	w = do("GET", "/admin/keys", "admin-key")
+	var keys struct {
+		Data []AdminKeyStatus `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &keys); err != nil || len(keys.Data) != 1 || keys.Data[0].Alias != "openai/0" {
+		t.Errorf("Expected the key status, got %s (%v)", w.Body.String(), err)
+	}
+
+	// The dashboard page opens without the key, which it asks for to call the API
+	w = do("GET", "/admin/dashboard", "")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), "/admin/providers") {
+		t.Errorf("Expected the dashboard page, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestAdminUsageExport(t *testing.T) {
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := &Server{
+		AdminAPIKey: "admin-key",
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		handleUsage: func(start, end time.Time) []usage.Entry {
+			return []usage.Entry{{
+				Key:    usage.Key{Hour: day.Add(time.Hour).Unix(), ClientKey: "ci", Provider: "openai", KeyHash: "3f2a9c1d0b7e", Model: "gpt-4o"},
+				Counts: usage.Counts{Requests: 1, TotalTokens: 100, Cost: 0.5},
+			}}
+		},
+	}
+	handler := s.AdminMux(AdminHandlers{})
+	do := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/usage/export?start_date=2025-03-01&end_date=2025-03-01"+query, nil)
+		req.Header.Set("Authorization", "Bearer admin-key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" || !strings.Contains(w.Header().Get("Content-Disposition"), "usage-2025-03-01-2025-03-01.csv") {
+		t.Fatalf("Expected a CSV attachment, got %d %v", w.Code, w.Header())
+	}
+	if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); len(lines) != 2 || lines[1] != "2025-03-01,,ci,,openai,openai/3f2a9c1d0b7e,gpt-4o,1,0,0,0,100,0.5" {
+		t.Errorf("Unexpected CSV export: %s", w.Body.String())
+	}
+
+	w = do("&format=json")
+	var export struct {
+		Data []usage.ExportRow `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &export); err != nil || len(export.Data) != 1 || export.Data[0].Cost != 0.5 {
+		t.Errorf("Expected a JSON export, got %s (%v)", w.Body.String(), err)
+	}
+	if w := do("&format=xml"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unsupported format, got %d", w.Code)
+	}
+}
+
+func TestAdminRequests(t *testing.T) {
+	var received ledger.Filter
+	s := &Server{AdminAPIKey: "admin-key", Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	handler := s.AdminMux(AdminHandlers{
+		Requests: func(filter ledger.Filter) ([]ledger.Entry, error) {
+			received = filter
+			return []ledger.Entry{{ClientKey: "ci", Group: "smart", Status: ledger.StatusError, ErrorClass: "rate_limited"}}, nil
+		},
+	})
+	do := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/requests"+query, nil)
+		req.Header.Set("Authorization", "Bearer admin-key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("?start_date=2025-03-01&end_date=2025-03-01&client_key=ci&status=error&limit=10")
+	var list struct {
+		Data []ledger.Entry `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || w.Code != http.StatusOK || len(list.Data) != 1 || list.Data[0].ErrorClass != "rate_limited" {
+		t.Fatalf("Expected the recorded requests, got %d %s", w.Code, w.Body.String())
+	}
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	if !received.Start.Equal(day) || !received.End.Equal(day.Add(24*time.Hour)) || received.ClientKey != "ci" || received.Status != "error" || received.Limit != 10 {
+		t.Errorf("Unexpected filter: %+v", received)
+	}
+
+	if do(""); received.Limit != defaultAdminRequestsLimit {
+		t.Errorf("Expected the default limit, got %d", received.Limit)
+	}
+	if w := do("?limit=5000"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a limit over the maximum, got %d", w.Code)
+	}
+
+	// Without a ledger the endpoint does not exist
+	handler = s.AdminMux(AdminHandlers{})
+	if w := do(""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 without a ledger, got %d", w.Code)
+	}
+}
+
+func TestAdminChargeback(t *testing.T) {
+	march := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	var requested [2]time.Time
+	s := &Server{
+		AdminAPIKey: "admin-key",
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		handleUsage: func(start, end time.Time) []usage.Entry {
+			requested = [2]time.Time{start, end}
+			return []usage.Entry{
+				{Key: usage.Key{Hour: march.Add(time.Hour).Unix(), Tenant: "acme", Provider: "openai", Model: "gpt-4o"}, Counts: usage.Counts{Requests: 1, TotalTokens: 100, Cost: 0.5}},
+				{Key: usage.Key{Hour: march.Add(time.Hour).Unix(), Tenant: "globex", Provider: "openai", Model: "gpt-4o"}, Counts: usage.Counts{Requests: 1, TotalTokens: 10}},
+			}
+		},
+	}
+	handler := s.AdminMux(AdminHandlers{})
+	do := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/chargeback"+query, nil)
+		req.Header.Set("Authorization", "Bearer admin-key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("?month=2025-03&tenant=acme")
+	var reports struct {
+		Data []usage.TenantReport `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &reports); err != nil || w.Code != http.StatusOK || len(reports.Data) != 1 || reports.Data[0].Cost != 0.5 || len(reports.Data[0].Models) != 1 {
+		t.Fatalf("Expected the tenant's report, got %d %s", w.Code, w.Body.String())
+	}
+	if !requested[0].Equal(march) || !requested[1].Equal(march.AddDate(0, 1, 0)) {
+		t.Errorf("Expected the usage of the month, got %v", requested)
+	}
+
+	w = do("?month=2025-03&format=csv")
+	if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); w.Header().Get("Content-Type") != "text/csv" || len(lines) != 3 {
+		t.Errorf("Expected a CSV line per tenant and model, got %s", w.Body.String())
+	}
+	if w := do("?month=March"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid month, got %d", w.Code)
+	}
+}
+
+func TestAdminUsageHistory(t *testing.T) {
+	nine := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	var received ledger.Filter
+	var receivedBucket time.Duration
+	s := &Server{AdminAPIKey: "admin-key", Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	handler := s.AdminMux(AdminHandlers{
+		Requests: func(filter ledger.Filter) ([]ledger.Entry, error) { return nil, nil },
+		RequestUsage: func(filter ledger.Filter, bucket time.Duration) ([]ledger.Usage, error) {
+			received = filter
+			receivedBucket = bucket
+			return []ledger.Usage{
+				{Bucket: 0, Provider: "openai", Model: "gpt-4o", KeyID: "openai/0", Requests: 2, TotalTokens: 150, Cost: 0.75},
+				{Bucket: 0, Provider: "openai", Model: "gpt-4o", KeyID: "openai/1", Requests: 1, Errors: 1},
+				{Bucket: 2, Provider: "anthropic", Model: "claude-sonnet-4", KeyID: "anthropic/0", Requests: 1, TotalTokens: 10},
+			}, nil
+		},
+	})
+	do := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/usage/history"+query, nil)
+		req.Header.Set("Authorization", "Bearer admin-key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("?bucket=1h&from=2025-03-01T09:15:00Z&to=2025-03-01T11:30:00Z&group=smart")
+	var page struct {
+		Bucket string          `json:"bucket"`
+		Data   []HistoryBucket `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the usage history, got %d %s", w.Code, w.Body.String())
+	}
+	if !received.Start.Equal(nine) || !received.End.Equal(nine.Add(3*time.Hour)) || received.Group != "smart" || receivedBucket != time.Hour {
+		t.Errorf("Expected the range aligned to the buckets, got %+v in buckets of %s", received, receivedBucket)
+	}
+	if page.Bucket != "1h" || len(page.Data) != 3 || page.Data[0].StartTime != nine.Unix() || len(page.Data[1].Results) != 0 {
+		t.Fatalf("Expected every bucket of the range, got %+v", page)
+	}
+	results := page.Data[0].Results
+	if len(results) != 2 || results[0].KeyID != "openai/0" || results[0].Requests != 2 || results[0].TotalTokens != 150 || results[0].Cost != 0.75 ||
+		results[1].KeyID != "openai/1" || results[1].Errors != 1 {
+		t.Errorf("Expected the usage per model and key, got %+v", results)
+	}
+	if results := page.Data[2].Results; len(results) != 1 || results[0].Model != "claude-sonnet-4" {
+		t.Errorf("Unexpected results of the last bucket: %+v", results)
+	}
+
+	for _, query := range []string{"?bucket=30s", "?bucket=1w", "?from=yesterday", "?bucket=1m&from=2025-01-01T00:00:00Z&to=2025-03-01T00:00:00Z"} {
+		if w := do(query); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", query, w.Code)
+		}
+	}
+	if w := do("?bucket=1d"); w.Code != http.StatusOK {
+		t.Errorf("Expected daily buckets, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdminUsageRestore(t *testing.T) {
+	var restored AdminUsageSnapshot
+	s := &Server{AdminAPIKey: "admin-key", Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	handler := s.AdminMux(AdminHandlers{
+		SnapshotUsage: func() AdminUsageSnapshot {
+			return AdminUsageSnapshot{Object: "usage_snapshot", Providers: []AdminProviderUsage{{Name: "openai", Keys: []AdminKeyUsage{{Index: 0, Usage: map[string]int64{"gpt-4o": 42}}}}}}
+		},
+		RestoreUsage: func(snapshot AdminUsageSnapshot) error {
+			if snapshot.Providers[0].Name != "openai" {
+				return errors.New("unknown provider")
+			}
+			restored = snapshot
+			return nil
+		},
+	})
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("GET", "/admin/usage/snapshot", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected a snapshot, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/admin/usage/restore", w.Body.String()); w.Code != http.StatusOK || restored.Providers[0].Keys[0].Usage["gpt-4o"] != 42 {
+		t.Errorf("Expected the snapshot to be restored, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/admin/usage/restore", `{"providers":[{"name":"other","keys":[]}]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a rejected restore to fail, got %d", w.Code)
+	}
+	if w := do("POST", "/admin/usage/restore", "not json"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid snapshot to fail, got %d", w.Code)
+	}
+}
+
+func TestAdminConfigChanges(t *testing.T) {
+	keys := []string{"sk-1"}
+	disabled := map[string]bool{}
+	s := &Server{AdminAPIKey: "admin-key", Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	handler := s.AdminMux(AdminHandlers{
+		AddKey: func(provider string, key string, free bool) (int, error) {
+			if provider != "openai" {
+				return 0, ErrAdminNotFound
+			}
+			keys = append(keys, key)
+			return len(keys) - 1, nil
+		},
+		RemoveKey: func(provider string, index int) error {
+			if provider != "openai" || index >= len(keys) {
+				return ErrAdminNotFound
+			}
+			keys = append(keys[:index], keys[index+1:]...)
+			return nil
+		},
+		SetModelWeight: func(group string, index int, weight int64) error {
+			if weight < 0 {
+				return errors.New("weight must not be negative")
+			}
+			return nil
+		},
+		SetGroupEnabled: func(group string, enabled bool) error {
+			disabled[group] = !enabled
+			return nil
+		},
+		ConfigStatus: func() AdminConfigStatus {
+			return AdminConfigStatus{ConfigHash: "abc", LastError: "invalid configuration", Failures: 1}
+		},
+	})
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/admin/providers/openai/keys", `{"key": "sk-2"}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"index":1`) || len(keys) != 2 {
+		t.Errorf("Expected the key to be added, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/admin/providers/anthropic/keys", `{"key": "sk-2"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown provider, got %d", w.Code)
+	}
+	if w := do("DELETE", "/admin/providers/openai/keys/0", ""); w.Code != http.StatusOK || len(keys) != 1 || keys[0] != "sk-2" {
+		t.Errorf("Expected the key to be removed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("DELETE", "/admin/providers/openai/keys/3", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown key, got %d", w.Code)
+	}
+	if w := do("PUT", "/admin/groups/smart/models/0/weight", `{"weight": 3}`); w.Code != http.StatusOK {
+		t.Errorf("Expected the weight to be set, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, body := range []string{`{"weight": -1}`, `{}`} {
+		if w := do("PUT", "/admin/groups/smart/models/0/weight", body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, w.Code)
+		}
+	}
+	if w := do("POST", "/admin/groups/smart/disable", ""); w.Code != http.StatusOK || !disabled["smart"] {
+		t.Errorf("Expected the group to be disabled, got %d", w.Code)
+	}
+	if w := do("POST", "/admin/groups/smart/enable", ""); w.Code != http.StatusOK || disabled["smart"] {
+		t.Errorf("Expected the group to be enabled, got %d", w.Code)
+	}
+	if w := do("GET", "/admin/config/status", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"last_error":"invalid configuration","failures":1`) {
+		t.Errorf("Expected the failed reload to be reported, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdminAudit(t *testing.T) {
+	drained := false
+	weight := int64(1)
+	var entries []AdminAuditEntry
+	s := &Server{AdminAPIKey: "admin-key", Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	handler := s.AdminMux(AdminHandlers{
+		Groups: func() []AdminGroup {
+			return []AdminGroup{{Name: "smart", Models: []AdminModel{{Provider: "openai", Name: "gpt-4o", Weight: weight}}}}
+		},
+		Providers: func() []AdminProvider {
+			status := KeyStatusActive
+			if drained {
+				status = KeyStatusDrained
+			}
+			return []AdminProvider{{Name: "openai", Keys: []AdminKey{{Index: 0, Key: "sk-...abcd", Status: status}}}}
+		},
+		SetKeyDrained: func(provider string, index int, value bool) bool {
+			if provider != "openai" || index != 0 {
+				return false
+			}
+			drained = value
+			return true
+		},
+		SetModelWeight: func(group string, index int, value int64) error {
+			weight = value
+			return nil
+		},
+		Audit: func(entry AdminAuditEntry) {
+			entries = append(entries, entry)
+		},
+	})
+	do := func(method, path, body, actor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-key")
+		if actor != "" {
+			req.Header.Set(HeaderActor, actor)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	do("POST", "/admin/providers/openai/keys/0/drain", "", "alice@example.com")
+	do("POST", "/admin/providers/openai/keys/7/drain", "", "alice@example.com")
+	do("PUT", "/admin/groups/smart/models/0/weight", `{"weight": 3}`, "")
+
+	if len(entries) != 2 {
+		t.Fatalf("Expected an entry per change made, got %+v", entries)
+	}
+	drain := entries[0]
+	if drain.Actor != "alice@example.com" || drain.Action != AuditKeyDrain || drain.Target != "openai/0" || drain.RemoteAddr == "" || drain.Time.IsZero() {
+		t.Errorf("Unexpected entry of the drained key: %+v", drain)
+	}
+	if before, after := drain.Before.(AdminAuditKey), drain.After.(AdminAuditKey); before.Status != KeyStatusActive || after.Status != KeyStatusDrained {
+		t.Errorf("Expected the status of the key before and after, got %+v and %+v", before, after)
+	}
+	change := entries[1]
+	if change.Actor != ActorAdmin || change.Action != AuditModelWeight || change.Target != "smart/0" {
+		t.Errorf("Unexpected entry of the weight change: %+v", change)
+	}
+	data, _ := json.Marshal(change)
+	if !strings.Contains(string(data), `"before":{"model":"gpt-4o","provider":"openai","weight":1},"after":{"model":"gpt-4o","provider":"openai","weight":3}`) {
+		t.Errorf("Expected the weight before and after, got %s", data)
+	}
+}
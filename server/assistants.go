@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// AssistantsGroupHeader selects the group whose provider key serves an Assistants API request
+const AssistantsGroupHeader = "X-Router-Group"
+
+// AssistantsTarget is the provider key designated by a group for the Assistants API
+type AssistantsTarget struct {
+	// Proxy forwards requests to the designated provider key
+	Proxy http.Handler
+	// Model is the group's model on the designated provider, substituted when a request body names the group as model
+	Model string
+}
+
+// HandleAssistantsRequest routes Assistants and Threads API requests to the provider key designated by a group.
+// Assistants, threads, and runs are stateful, so all requests of a group go to the same key.
+// The group is taken from the model of the request body, then the X-Router-Group header,
+// and defaults to the only group when a single one is configured.
+func (s *Server) HandleAssistantsRequest(targets map[string]AssistantsTarget) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group := r.Header.Get(AssistantsGroupHeader)
+		if r.Body != nil && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			body, err := io.ReadAll(r.Body)
+			if writeBodyError(w, err) {
+				return
+			}
+			if err != nil {
+				writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "error reading request body")
+				return
+			}
+			if model, rewritten, ok := substituteGroupModel(body, targets); ok {
+				group = model
+				body = rewritten
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+		if group == "" && len(targets) == 1 {
+			for name := range targets {
+				group = name
+			}
+		}
+
+		target, ok := targets[group]
+		if !ok {
+			names := make([]string, 0, len(targets))
+			for name := range targets {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "",
+				"select a group with the "+AssistantsGroupHeader+" header, one of: "+strings.Join(names, ", "))
+			return
+		}
+
+		s.Logger.Info("Incoming assistants request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("group", group))
+		r.Header.Del(AssistantsGroupHeader)
+		target.Proxy.ServeHTTP(w, r)
+	})
+}
+
+// substituteGroupModel replaces a group name given as the model of a JSON request body
+// with the group's model on its designated provider
+func substituteGroupModel(body []byte, targets map[string]AssistantsTarget) (group string, rewritten []byte, ok bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return "", nil, false
+	}
+	var model string
+	if err := json.Unmarshal(fields["model"], &model); err != nil {
+		return "", nil, false
+	}
+	target, exists := targets[model]
+	if !exists || target.Model == "" {
+		return "", nil, false
+	}
+	fields["model"], _ = json.Marshal(target.Model)
+	rewritten, err := json.Marshal(fields)
+	if err != nil {
+		return "", nil, false
+	}
+	return model, rewritten, true
+}
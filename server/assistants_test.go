@@ -0,0 +1,63 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAssistantsRouting(t *testing.T) {
+	var lastGroup, lastBody string
+	target := func(group string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			lastGroup, lastBody = group, string(body)
+			if r.Header.Get(AssistantsGroupHeader) != "" {
+				t.Errorf("Expected the group header to be removed")
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+	s := &Server{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	handler := s.HandleAssistantsRequest(map[string]AssistantsTarget{
+		"fast":  {Proxy: target("fast"), Model: "gpt-4o-mini"},
+		"smart": {Proxy: target("smart"), Model: "gpt-4o"},
+	})
+
+	// The group given as model selects the key and is replaced with the provider's model
+	req := httptest.NewRequest("POST", "/v1/assistants", strings.NewReader(`{"model":"smart","name":"helper"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || lastGroup != "smart" || !strings.Contains(lastBody, `"model":"gpt-4o"`) || !strings.Contains(lastBody, `"name":"helper"`) {
+		t.Errorf("Expected request routed to smart with model gpt-4o, got %d %s %s", w.Code, lastGroup, lastBody)
+	}
+
+	// Requests without a model are routed by header
+	req = httptest.NewRequest("GET", "/v1/threads/thread_abc/messages", nil)
+	req.Header.Set(AssistantsGroupHeader, "fast")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || lastGroup != "fast" {
+		t.Errorf("Expected request routed to fast, got %d %s", w.Code, lastGroup)
+	}
+
+	// Without a group, the request is ambiguous
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v1/assistants", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without a group, got %d", w.Code)
+	}
+
+	// A single group is the default
+	single := s.HandleAssistantsRequest(map[string]AssistantsTarget{"fast": {Proxy: target("fast")}})
+	lastGroup = ""
+	w = httptest.NewRecorder()
+	single.ServeHTTP(w, httptest.NewRequest("GET", "/v1/assistants", nil))
+	if w.Code != http.StatusOK || lastGroup != "fast" {
+		t.Errorf("Expected request routed to the only group, got %d %s", w.Code, lastGroup)
+	}
+}
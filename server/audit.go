@@ -0,0 +1,179 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HeaderActor names who makes a change through the admin API in the audit log, e.g. an operator's email. It is
+// taken as sent, since every admin shares the admin API key.
+const HeaderActor = "X-LLM-Router-Actor"
+
+// maxActorLength bounds the actors taken from requests
+const maxActorLength = 128
+
+// ActorAdmin is the actor of admin changes made without HeaderActor
+const ActorAdmin = "admin"
+
+// AdminAuditEntry records a change made through the admin API or by a configuration reload
+type AdminAuditEntry struct {
+	Time time.Time `json:"time"`
+	// Actor is who made the change: the HeaderActor of the admin request, ActorAdmin without it, or reload
+	Actor string `json:"actor"`
+	// RemoteAddr is the address the admin request came from, and ClientIP that of its client, behind trusted
+	// proxies
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	ClientIP   string `json:"client_ip,omitempty"`
+	// Action is the change made, e.g. key.drain or group.weight
+	Action string `json:"action"`
+	// Target is what was changed, e.g. a key as "provider/index" or a group
+	Target string `json:"target"`
+	Before any    `json:"before"`
+	After  any    `json:"after"`
+}
+
+// Actions of the audit log entries of admin changes
+const (
+	AuditKeyDrain     = "key.drain"
+	AuditKeyUndrain   = "key.undrain"
+	AuditKeyAdd       = "key.add"
+	AuditKeyRemove    = "key.remove"
+	AuditModelWeight  = "model.weight"
+	AuditGroupDisable = "group.disable"
+	AuditGroupEnable  = "group.enable"
+	AuditUsageRestore = "usage.restore"
+)
+
+// AdminAuditKey is the state of a provider key in the audit log
+type AdminAuditKey struct {
+	Index  int    `json:"index"`
+	Key    string `json:"key"`
+	Status string `json:"status"`
+	Free   bool   `json:"free,omitempty"`
+}
+
+// adminActor returns the actor of an admin request
+func adminActor(r *http.Request) string {
+	actor := r.Header.Get(HeaderActor)
+	if actor == "" || len(actor) > maxActorLength {
+		return ActorAdmin
+	}
+	return actor
+}
+
+// audited records the changes an admin handler makes to an audit log, with the state of their target returned
+// by state before and after them. Requests the handler rejects are not recorded.
+func audited(audit func(entry AdminAuditEntry), action string, target func(r *http.Request) string, state func(r *http.Request) any, next http.HandlerFunc) http.HandlerFunc {
+	if audit == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		before := state(r)
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r)
+		if recorder.status >= http.StatusMultipleChoices {
+			return
+		}
+		audit(AdminAuditEntry{
+			Time:       time.Now().UTC(),
+			Actor:      adminActor(r),
+			RemoteAddr: r.RemoteAddr,
+			ClientIP:   clientIPFromContext(r.Context()),
+			Action:     action,
+			Target:     target(r),
+			Before:     before,
+			After:      state(r),
+		})
+	}
+}
+
+// auditKeyTarget is the target of changes to a key: the key as "provider/index"
+func auditKeyTarget(r *http.Request) string {
+	return r.PathValue("provider") + "/" + r.PathValue("index")
+}
+
+// auditProviderTarget is the target of changes to the keys of a provider: the provider
+func auditProviderTarget(r *http.Request) string {
+	return r.PathValue("provider")
+}
+
+// auditModelTarget is the target of changes to a model of a group: the group and the model's index
+func auditModelTarget(r *http.Request) string {
+	return r.PathValue("group") + "/" + r.PathValue("index")
+}
+
+// auditGroupTarget is the target of changes to a group: the group
+func auditGroupTarget(r *http.Request) string {
+	return r.PathValue("group")
+}
+
+// auditKeys returns the state of the keys of the request's provider, before and after keys are added or removed
+func auditKeys(providers func() []AdminProvider) func(r *http.Request) any {
+	return func(r *http.Request) any {
+		keys := make([]AdminAuditKey, 0)
+		for _, p := range providers() {
+			if p.Name != r.PathValue("provider") {
+				continue
+			}
+			for _, k := range p.Keys {
+				keys = append(keys, AdminAuditKey{Index: k.Index, Key: k.Key, Status: k.Status, Free: k.Free})
+			}
+		}
+		return keys
+	}
+}
+
+// auditKey returns the state of the request's key, nil when it does not exist
+func auditKey(providers func() []AdminProvider) func(r *http.Request) any {
+	keys := auditKeys(providers)
+	return func(r *http.Request) any {
+		for _, k := range keys(r).([]AdminAuditKey) {
+			if strconv.Itoa(k.Index) == r.PathValue("index") {
+				return k
+			}
+		}
+		return nil
+	}
+}
+
+// auditWeight returns the weight of the request's model of a group, nil when it does not exist
+func auditWeight(groups func() []AdminGroup) func(r *http.Request) any {
+	return func(r *http.Request) any {
+		for _, g := range groups() {
+			if g.Name != r.PathValue("group") {
+				continue
+			}
+			for i, m := range g.Models {
+				if strconv.Itoa(i) == r.PathValue("index") {
+					return map[string]any{"provider": m.Provider, "model": m.Name, "weight": m.Weight}
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// auditGroup returns whether the request's group is disabled, nil when it does not exist
+func auditGroup(groups func() []AdminGroup) func(r *http.Request) any {
+	return func(r *http.Request) any {
+		for _, g := range groups() {
+			if g.Name == r.PathValue("group") {
+				return map[string]any{"disabled": g.Disabled}
+			}
+		}
+		return nil
+	}
+}
+
+// auditUsage returns the usage counters of every key, before and after a restore
+func auditUsage(snapshot func() AdminUsageSnapshot) func(r *http.Request) any {
+	return func(r *http.Request) any {
+		return snapshot().Providers
+	}
+}
+
+// auditUsageTarget is the target of usage restores
+func auditUsageTarget(r *http.Request) string {
+	return "usage"
+}
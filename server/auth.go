@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"llm-router/client"
+	"llm-router/utils"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// DefaultClientKeyName names the client key configured as the single API key
+const DefaultClientKeyName = "default"
+
+// ClientKey is an API key of a router client. Usage is attributed to its name. Zero quotas are unlimited.
+type ClientKey struct {
+	Name              string
+	Key               string
+	RequestsPerMinute int64
+	TokensPerMinute   int64
+	TokensPerDay      int64
+	// Tenant the key belongs to, empty for keys outside of tenants
+	Tenant string
+}
+
+// errInvalidAPIKey is returned for requests without a known client key
+var errInvalidAPIKey = errors.New("invalid or missing API key")
+
+// clientKey returns the client key matching the given key, or nil if none matches
+func (s *Server) clientKey(key string) *ClientKey {
+	var found *ClientKey
+	// Use constant-time comparison to prevent timing attacks, comparing every key
+	if s.APIKey != "" || len(s.ClientKeys) == 0 {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(s.APIKey)) == 1 {
+			found = &ClientKey{Name: DefaultClientKeyName, Key: s.APIKey}
+		}
+	}
+	for i := range s.ClientKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(s.ClientKeys[i].Key)) == 1 {
+			found = &s.ClientKeys[i]
+		}
+	}
+	return found
+}
+
+// authorize resolves the client key of a request and admits the request within the key's quotas.
+// The returned context attributes the request's usage to the key and its tenant, and carries the key's rate limit
+// state for setRateLimitHeaders, also when the request is over quota. Errors are errInvalidAPIKey
+// or wrap ErrQuotaExceeded.
+func (s *Server) authorize(ctx context.Context, key string) (context.Context, error) {
+	clientKey := s.clientKey(key)
+	if clientKey == nil {
+		return ctx, errInvalidAPIKey
+	}
+	if entry := accessEntryFrom(ctx); entry != nil {
+		entry.clientKey = clientKey.Name
+	}
+	limit, err := s.quotas.admit(clientKey)
+	ctx = withRateLimit(ctx, limit)
+	if err != nil {
+		s.Logger.Warn("Client key quota exceeded", slog.String("client_key", clientKey.Name), slog.String("tenant", clientKey.Tenant),
+			slog.String("client_ip", clientIPFromContext(ctx)), slog.Any("error", err))
+		return ctx, err
+	}
+	ctx = client.WithClientKey(ctx, clientKey.Name)
+	if clientKey.Tenant != "" {
+		ctx = client.WithTenant(ctx, clientKey.Tenant)
+	}
+	return ctx, nil
+}
+
+// withEndUser attributes the request's usage to the end user named by the EndUserHeader, if configured and present.
+// Otherwise the usage is attributed to the user field of the request body.
+func (s *Server) withEndUser(ctx context.Context, r *http.Request) context.Context {
+	if s.EndUserHeader == "" {
+		return ctx
+	}
+	if user := r.Header.Get(s.EndUserHeader); user != "" {
+		return client.WithEndUser(ctx, user)
+	}
+	return ctx
+}
+
+// authMiddleware rejects requests without a valid bearer API key or over the key's quotas
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		ctx, err := r.Context(), errInvalidAPIKey
+		if strings.HasPrefix(authHeader, "Bearer ") {
+			ctx, err = s.authorize(ctx, strings.TrimPrefix(authHeader, "Bearer "))
+		}
+		setRateLimitHeaders(w, ctx)
+		switch {
+		case errors.Is(err, ErrQuotaExceeded):
+			writeOpenAIError(w, http.StatusTooManyRequests, "rate_limit_exceeded", "rate_limit_exceeded", err.Error())
+			return
+		case err != nil:
+			s.Logger.Warn("Invalid or missing API key",
+				slog.String("path", r.URL.Path),
+				slog.String("receivedAuthHeader", utils.RedactAuthorization(authHeader)))
+			writeOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "Invalid or missing API key")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(s.withEndUser(ctx, r)))
+	})
+}
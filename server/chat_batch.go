@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"llm-router/client"
+	"llm-router/usage"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// Defaults for router-native chat completion batches
+const (
+	DefaultChatBatchConcurrency = 8
+	DefaultChatBatchMaxRequests = 100
+)
+
+// chatBatchRequest is the body of /v1/chat/completions/batch when given as an object.
+// A plain array of chat completion requests is accepted as well.
+type chatBatchRequest struct {
+	Requests       []json.RawMessage `json:"requests"`
+	MaxConcurrency int               `json:"max_concurrency,omitempty"`
+}
+
+// chatBatchResult is the outcome of one request of a batch, in request order
+type chatBatchResult struct {
+	Index    int                            `json:"index"`
+	Status   int                            `json:"status"`
+	Response *client.ChatCompletionResponse `json:"response,omitempty"`
+	Error    *errorDetail                   `json:"error,omitempty"`
+}
+
+// HandleChatBatchRequest serves /v1/chat/completions/batch, running the chat completion requests of a batch
+// concurrently through the groups, at most ChatBatchConcurrency (or the lower max_concurrency) at a time
+func (s *Server) HandleChatBatchRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "", "method not allowed")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if writeBodyError(w, err) {
+		return
+	}
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "error reading request body")
+		return
+	}
+	var batch chatBatchRequest
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(body, &batch.Requests)
+	} else {
+		err = json.Unmarshal(body, &batch)
+	}
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "invalid request body: "+err.Error())
+		return
+	}
+
+	maxRequests := s.ChatBatchMaxRequests
+	if maxRequests <= 0 {
+		maxRequests = DefaultChatBatchMaxRequests
+	}
+	if len(batch.Requests) == 0 || len(batch.Requests) > maxRequests {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "",
+			fmt.Sprintf("a batch must contain between 1 and %d requests", maxRequests))
+		return
+	}
+	concurrency := s.ChatBatchConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultChatBatchConcurrency
+	}
+	if batch.MaxConcurrency > 0 && batch.MaxConcurrency < concurrency {
+		concurrency = batch.MaxConcurrency
+	}
+
+	s.Logger.Info("Incoming chat completion batch", slog.Int("requests", len(batch.Requests)), slog.Int("concurrency", concurrency))
+
+	results := make([]chatBatchResult, len(batch.Requests))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, raw := range batch.Requests {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			results[i] = s.runChatBatchRequest(r, i, raw)
+		}()
+	}
+	wg.Wait()
+
+	writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": results})
+}
+
+// runChatBatchRequest runs a single non-streaming chat completion request of a batch
+func (s *Server) runChatBatchRequest(r *http.Request, index int, raw json.RawMessage) chatBatchResult {
+	fail := func(status int, errType string, message string) chatBatchResult {
+		return chatBatchResult{Index: index, Status: status, Error: &errorDetail{Message: message, Type: errType}}
+	}
+
+	req, err := client.DecodeChatCompletionRequest(raw)
+	if err != nil {
+		return fail(http.StatusBadRequest, "invalid_request_error", "invalid chat completion request: "+err.Error())
+	}
+	if req.Model == "" {
+		return fail(http.StatusBadRequest, "invalid_request_error", "model is required")
+	}
+	if req.Stream {
+		return fail(http.StatusBadRequest, "invalid_request_error", "streaming is not supported in batches")
+	}
+
+	ctx := client.WithRawRequest(r.Context(), raw)
+	response, err := s.handleRequest(ctx, req)
+	if errors.Is(err, ErrGroupNotAllowed) {
+		return fail(http.StatusNotFound, "invalid_request_error", err.Error())
+	}
+	if errors.Is(err, usage.ErrSpendCapExceeded) {
+		return fail(http.StatusPaymentRequired, "insufficient_quota", err.Error())
+	}
+	if errors.Is(err, usage.ErrBudgetExceeded) {
+		return fail(http.StatusTooManyRequests, "insufficient_quota", err.Error())
+	}
+	if errors.Is(err, ErrRequestTooExpensive) {
+		return fail(http.StatusBadRequest, "invalid_request_error", err.Error())
+	}
+	if isTimeout(err) {
+		return fail(http.StatusGatewayTimeout, "server_error", err.Error())
+	}
+	if err != nil {
+		return fail(http.StatusInternalServerError, "api_error", "Error handling request: "+err.Error())
+	}
+	return chatBatchResult{Index: index, Status: http.StatusOK, Response: response}
+}
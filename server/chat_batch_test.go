@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"llm-router/client"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestChatBatch(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	s := &Server{
+		APIKey:               "router-key",
+		Logger:               slog.New(slog.NewTextHandler(io.Discard, nil)),
+		ChatBatchConcurrency: 4,
+		handleRequest: func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionResponse, error) {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			if req.Model == "missing" {
+				return nil, errors.New("no models found for group: missing")
+			}
+			return &client.ChatCompletionResponse{ChatCompletionResponse: openai.ChatCompletionResponse{Model: req.Model}}, nil
+		},
+	}
+
+	requests := make([]string, 0)
+	for i := 0; i < 6; i++ {
+		requests = append(requests, `{"model":"fast","messages":[{"role":"user","content":"hi"}]}`)
+	}
+	requests = append(requests, `{"model":"missing","messages":[]}`, `{"model":"fast","stream":true,"messages":[]}`)
+	body := `{"max_concurrency":2,"requests":[` + strings.Join(requests, ",") + `]}`
+
+	w := httptest.NewRecorder()
+	s.HandleChatBatchRequest(w, httptest.NewRequest("POST", "/v1/chat/completions/batch", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp struct {
+		Data []struct {
+			Index    int                            `json:"index"`
+			Status   int                            `json:"status"`
+			Response *openai.ChatCompletionResponse `json:"response"`
+			Error    *errorDetail                   `json:"error"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Data) != len(requests) {
+		t.Fatalf("Expected %d results, got %d", len(requests), len(resp.Data))
+	}
+	for i := 0; i < 6; i++ {
+		if resp.Data[i].Index != i || resp.Data[i].Status != http.StatusOK || resp.Data[i].Response.Model != "fast" {
+			t.Errorf("Expected successful result %d, got %+v", i, resp.Data[i])
+		}
+	}
+	if r := resp.Data[6]; r.Status != http.StatusInternalServerError || r.Error == nil {
+		t.Errorf("Expected error result for unknown group, got %+v", r)
+	}
+	if r := resp.Data[7]; r.Status != http.StatusBadRequest || r.Error == nil {
+		t.Errorf("Expected error result for streaming request, got %+v", r)
+	}
+	if maxRunning.Load() > 2 {
+		t.Errorf("Expected at most 2 concurrent requests, got %d", maxRunning.Load())
+	}
+
+	// A plain array of requests is accepted as well
+	w = httptest.NewRecorder()
+	s.HandleChatBatchRequest(w, httptest.NewRequest("POST", "/v1/chat/completions/batch", strings.NewReader("["+requests[0]+"]")))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":200`) {
+		t.Errorf("Expected plain array batch to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+}
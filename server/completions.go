@@ -13,15 +13,14 @@ package server
 
 import (
 	"bytes"
-	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"io"
+	"llm-router/client"
 	"llm-router/utils"
 	"log/slog"
 	"net/http"
 	"strings"
-
-	"github.com/sashabaranov/go-openai"
 )
 
 // HandleCompletionsRequest is the main HTTP handler function that processes incoming requests
@@ -38,14 +37,9 @@ func (s *Server) HandleCompletionsRequest(w http.ResponseWriter, r *http.Request
 			if n > 0 {
 				peeked = peeked[:n]
 				isStreaming = strings.Contains(string(peeked), "\"stream\":true")
-				// Restore the body
+				// Restore the body, whose length is unchanged
 				combinedReader := io.MultiReader(bytes.NewReader(peeked), r.Body)
 				r.Body = io.NopCloser(combinedReader)
-
-				// Update ContentLength to account for the peek operation
-				if r.ContentLength > 0 {
-					r.ContentLength = int64(n) + r.ContentLength
-				}
 			}
 		}
 	}
@@ -53,9 +47,13 @@ func (s *Server) HandleCompletionsRequest(w http.ResponseWriter, r *http.Request
 	// Create a response recorder to capture the response
 	recorder := utils.NewResponseRecorder(w)
 
-	// Log the full incoming request if debug is enabled
+	// Log the full incoming request if debug is enabled, its body only when prompts are logged
+	s.Logger.Debug("Incoming request",
+		slog.String("path", r.URL.Path),
+		slog.String("method", r.Method),
+		slog.Bool("streaming", isStreaming))
 	var reqBody string
-	if r.Body != nil {
+	if r.Body != nil && s.PromptLogLength > 0 {
 		// For streaming, use a more careful approach to draining the body
 		if isStreaming {
 			r.Body, reqBody = utils.DrainAndCapture(r.Body, isStreaming)
@@ -68,70 +66,34 @@ func (s *Server) HandleCompletionsRequest(w http.ResponseWriter, r *http.Request
 			bodyBytes := []byte(reqBody)
 			r.ContentLength = int64(len(bodyBytes))
 		}
-
-		s.Logger.Debug("Incoming request",
-			slog.String("path", r.URL.Path),
-			slog.String("method", r.Method),
-			slog.Bool("streaming", isStreaming))
-		utils.LogRequestResponse(s.Logger, r, nil, reqBody, "")
 	}
+	utils.LogRequestResponse(s.Logger, r, nil, utils.Truncate(reqBody, s.PromptLogLength), "")
 
-	// Special handling for OPTIONS requests (CORS preflight)
-	if r.Method == "OPTIONS" {
-		s.Logger.Debug("Handling OPTIONS request for CORS preflight")
-
-		// Get the request headers
-		reqHeaders := r.Header.Get("Access-Control-Request-Headers")
-		origin := r.Header.Get("Origin")
-		if origin == "" {
-			origin = "*"
-		}
-
-		// Log the request method requested in preflight
-		if reqMethod := r.Header.Get("Access-Control-Request-Method"); reqMethod != "" {
-			s.Logger.Debug("Preflight requested method", slog.String("method", reqMethod))
-		}
-
-		// Set CORS headers for OPTIONS requests
-		recorder.Header().Set("Access-Control-Allow-Origin", origin)
-		recorder.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
-
-		if reqHeaders != "" {
-			recorder.Header().Set("Access-Control-Allow-Headers", reqHeaders)
-		} else {
-			recorder.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Accept")
-		}
-
-		recorder.Header().Set("Access-Control-Allow-Credentials", "true")
-		recorder.Header().Set("Access-Control-Max-Age", "86400") // 24 hours
-		recorder.Header().Set("Content-Type", "text/plain")
-		recorder.Header().Set("Content-Length", "0")
-		recorder.Header().Set("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
-
-		// Return 204 No Content for OPTIONS requests
-		recorder.WriteHeader(http.StatusNoContent)
-
-		// Log the response
+	// Authenticate the request, preflight requests having been answered by the CORS middleware
+	authHeader := r.Header.Get("Authorization")
+	ctx, err := r.Context(), errInvalidAPIKey
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		ctx, err = s.authorize(ctx, strings.TrimPrefix(authHeader, "Bearer "))
+	}
+	setRateLimitHeaders(recorder, ctx)
+	if errors.Is(err, ErrQuotaExceeded) {
+		writeOpenAIError(recorder, http.StatusTooManyRequests, "rate_limit_exceeded", "rate_limit_exceeded", err.Error())
 		s.logResponse(s.Logger, recorder)
 		return
 	}
-	// Authenticate the request - only for non-OPTIONS requests
-	authHeader := r.Header.Get("Authorization")
-	expectedAuthHeader := "Bearer " + s.APIKey
-
-	// Use constant-time comparison to prevent timing attacks
-	if subtle.ConstantTimeCompare([]byte(authHeader), []byte(expectedAuthHeader)) != 1 {
+	if err != nil {
 		s.Logger.Warn("Invalid or missing API key",
-			slog.String("receivedAuthHeader", utils.RedactAuthorization(authHeader)),
-			slog.String("expectedAuthHeader", utils.RedactAuthorization(expectedAuthHeader)))
+			slog.String("receivedAuthHeader", utils.RedactAuthorization(authHeader)))
 		http.Error(recorder, "Invalid or missing API key", http.StatusUnauthorized)
 
 		// Log the response
 		s.logResponse(s.Logger, recorder)
 		return
 	}
+	r = r.WithContext(withRouteExplanation(s.withEndUser(ctx, r), r))
 	s.Logger.Info("API key validated successfully",
-		slog.String("Authorization", utils.RedactAuthorization(authHeader)))
+		slog.String("client_key", client.ClientKeyFromContext(ctx)),
+		slog.String("tenant", client.TenantFromContext(ctx)))
 
 	// Process specific API endpoint logic if applicable
 	if r.Method == "POST" {
@@ -147,18 +109,22 @@ func (s *Server) HandleCompletionsRequest(w http.ResponseWriter, r *http.Request
 	s.logResponse(s.Logger, recorder)
 }
 
-// logResponse logs the details of the HTTP response
+// logResponse logs the details of the HTTP response, its body only when prompts are logged
 func (s *Server) logResponse(logger *slog.Logger, recorder *utils.ResponseRecorder) {
 	// Log response status and headers
-	logger.Debug("Response details",
-		slog.Int("status", recorder.StatusCode),
-		slog.Any("headers", recorder.Header()),
-		slog.String("body", recorder.GetBody()))
+	attrs := []any{slog.Int("status", recorder.StatusCode), slog.Any("headers", recorder.Header())}
+	if s.PromptLogLength > 0 {
+		attrs = append(attrs, slog.String("body", utils.Truncate(recorder.GetBody(), s.PromptLogLength)))
+	}
+	logger.Debug("Response details", attrs...)
 }
 
 // handleChatCompletions processes specific logic for the chat completions endpoint
 func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
+	if writeBodyError(w, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error reading request body", http.StatusInternalServerError)
 		return
@@ -176,17 +142,24 @@ func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Keep the original body so fields go-openai cannot represent reach the provider unmodified
+	ctx := client.WithRawRequest(r.Context(), body)
+
 	if stream, ok := chatReq["stream"].(bool); ok && stream {
 		s.Logger.Info("Incoming streaming request for model(group)", slog.String("model", modelName))
 
 		// Parse the full request
-		var req openai.ChatCompletionRequest
-		if err := json.Unmarshal(body, &req); err != nil {
+		req, err := client.DecodeChatCompletionRequest(body)
+		if err != nil {
 			http.Error(w, "Error parsing request", http.StatusBadRequest)
 			return
 		}
 
-		stream, err := s.handleStreamRequest(r.Context(), req)
+		stream, err := s.handleStreamRequest(ctx, req)
+		s.setBudgetHeaders(w, ctx)
+		if writeRoutingError(w, err) {
+			return
+		}
 		if err != nil {
 			http.Error(w, "Error handling streaming request: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -194,6 +167,8 @@ func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 		defer stream.Close()
 
 		// Set headers for SSE streaming
+		clearWriteDeadline(w)
+		setRouteHeaders(w, stream.Route)
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Connection", "keep-alive")
@@ -208,25 +183,20 @@ func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 
 		// Stream the responses
 		for {
-			response, err := stream.Recv()
+			// Relay the provider's chunks verbatim so tool call fragments and other fields survive intact
+			_, jsonData, err := stream.RecvRaw()
 			if err != nil {
 				if err == io.EOF {
 					// Stream finished successfully
 					w.Write([]byte("data: [DONE]\n\n"))
 					flusher.Flush()
+					setCostTrailer(w, stream.Cost())
 					return
 				}
 				s.Logger.Error("Error receiving stream", slog.String("error", err.Error()))
 				return
 			}
 
-			// Marshal and send the response chunk
-			jsonData, err := json.Marshal(response)
-			if err != nil {
-				s.Logger.Error("Error marshaling stream response", slog.String("error", err.Error()))
-				return
-			}
-
 			// Write in SSE format
 			w.Write([]byte("data: "))
 			w.Write(jsonData)
@@ -239,20 +209,26 @@ func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 	s.Logger.Info("Incoming request for model(group)", slog.String("model", modelName))
 
 	// Parse the full request
-	var req openai.ChatCompletionRequest
-	if err := json.Unmarshal(body, &req); err != nil {
+	req, err := client.DecodeChatCompletionRequest(body)
+	if err != nil {
 		http.Error(w, "Error parsing request", http.StatusBadRequest)
 		return
 	}
 
 	// Call the handler
-	response, err := s.handleRequest(r.Context(), req)
+	response, err := s.handleRequest(ctx, req)
+	s.setBudgetHeaders(w, ctx)
+	if writeRoutingError(w, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error handling request: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Set response headers
+	setRouteHeaders(w, response.Route)
+	setCostHeader(w, response.Cost)
 	w.Header().Set("Content-Type", "application/json")
 
 	// Marshal and send the response
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"llm-router/client"
+	"llm-router/usage"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestStreamingToolCallsRelayedVerbatim(t *testing.T) {
+	chunks := []string{
+		`{"id":"c1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]},"finish_reason":null}]}`,
+		`{"id":"c1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":\"Paris\"}"}}]},"finish_reason":null}]}`,
+		`{"id":"c1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	config := openai.DefaultConfig("upstream-key")
+	config.BaseURL = upstream.URL + "/v1"
+	kc := client.NewKeyClient("upstream-key", openai.NewClientWithConfig(config), 0, 0)
+
+	s := &Server{
+		APIKey: "router-key",
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		handleStreamRequest: func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionStream, error) {
+			return kc.ChatCompletionStream(ctx, req)
+		},
+	}
+
+	body := `{"model":"group","stream":true,"messages":[{"role":"user","content":"weather?"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer router-key")
+	w := httptest.NewRecorder()
+
+	s.HandleCompletionsRequest(w, req)
+
+	output := w.Body.String()
+	for _, chunk := range chunks {
+		if !strings.Contains(output, "data: "+chunk+"\n\n") {
+			t.Errorf("Expected chunk to be relayed verbatim: %s\ngot: %s", chunk, output)
+		}
+	}
+	if !strings.HasSuffix(output, "data: [DONE]\n\n") {
+		t.Errorf("Expected stream to end with [DONE], got: %s", output)
+	}
+}
+
+func TestRouteHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		usage := `{"prompt_tokens":1000,"completion_tokens":500,"total_tokens":1500}`
+		if body, _ := io.ReadAll(r.Body); strings.Contains(string(body), `"stream":true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, `data: {"id":"1","object":"chat.completion.chunk","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"hi"}}]}`+"\n\n")
+			fmt.Fprint(w, `data: {"id":"1","object":"chat.completion.chunk","model":"gpt-4o","choices":[],"usage":`+usage+`}`+"\n\n")
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":`+usage+`}`)
+	}))
+	defer upstream.Close()
+
+	config := openai.DefaultConfig("upstream-key")
+	config.BaseURL = upstream.URL + "/v1"
+	kc := client.NewKeyClient("upstream-key", openai.NewClientWithConfig(config), 0, 0)
+	kc.Prices = map[string]client.Price{"gpt-4o": {Input: 2.5, Output: 10}}
+	route := client.Route{Provider: "openai", Model: "gpt-4o", KeyID: "openai/1", Attempts: 2}
+
+	s := &Server{
+		APIKey: "router-key",
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		handleRequest: func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionResponse, error) {
+			req.Model = "gpt-4o"
+			resp, err := kc.ChatCompletion(ctx, req)
+			if resp != nil {
+				resp.Route = route
+				if client.RouteExplanationRequested(ctx) {
+					resp.Route.Candidates = []client.Candidate{{Provider: "openai", Model: "gpt-4o", KeyID: "openai/1", Weight: 1, Usage: 10, Score: 10, Selected: true}}
+				}
+			}
+			return resp, err
+		},
+		handleStreamRequest: func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionStream, error) {
+			req.Model = "gpt-4o"
+			stream, err := kc.ChatCompletionStream(ctx, req)
+			if stream != nil {
+				stream.Route = route
+			}
+			return stream, err
+		},
+	}
+	router := httptest.NewServer(http.HandlerFunc(s.HandleCompletionsRequest))
+	defer router.Close()
+
+	explain := false
+	do := func(body string) *http.Response {
+		req, _ := http.NewRequest("POST", router.URL+"/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer router-key")
+		if explain {
+			req.Header.Set(HeaderExplain, "true")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	check := func(name string, header http.Header) {
+		for key, expected := range map[string]string{
+			HeaderProvider: "openai",
+			HeaderModel:    "gpt-4o",
+			HeaderKeyAlias: "openai/1",
+			HeaderAttempts: "2",
+		} {
+			if value := header.Get(key); value != expected {
+				t.Errorf("Expected %s header %s to be %q, got %q", name, key, expected, value)
+			}
+		}
+	}
+
+	// 1000 prompt tokens at $2.50 and 500 completion tokens at $10 per million
+	resp := do(`{"model":"group","messages":[{"role":"user","content":"hi"}]}`)
+	check("response", resp.Header)
+	if cost := resp.Header.Get(HeaderCost); cost != "0.0075" {
+		t.Errorf("Expected the cost header, got %q", cost)
+	}
+	if candidates := resp.Header.Get(HeaderCandidates); candidates != "" {
+		t.Errorf("Expected candidates only when requested, got %s", candidates)
+	}
+	explain = true
+	resp = do(`{"model":"group","messages":[{"role":"user","content":"hi"}]}`)
+	expected := `[{"provider":"openai","model":"gpt-4o","key":"openai/1","weight":1,"usage":10,"penalties":0,"score":10,"selected":true}]`
+	if candidates := resp.Header.Get(HeaderCandidates); candidates != expected {
+		t.Errorf("Expected the candidates header %s, got %s", expected, candidates)
+	}
+	explain = false
+
+	resp = do(`{"model":"group","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	check("stream", resp.Header)
+	if cost := resp.Trailer.Get(HeaderCost); cost != "0.0075" {
+		t.Errorf("Expected the cost trailer of the stream, got %q", cost)
+	}
+}
+
+func TestClientSpendCapResponses(t *testing.T) {
+	reset := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	s := &Server{
+		APIKey:     "router-key",
+		ClientKeys: []ClientKey{{Name: "ci", Key: "ci-key"}},
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		handleRequest: func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionResponse, error) {
+			return nil, fmt.Errorf("%w: month budget of client key ci", usage.ErrSpendCapExceeded)
+		},
+		handleClientBudget: func(name string) (usage.Remaining, bool) {
+			if name != "ci" {
+				return usage.Remaining{Tokens: -1, Cost: -1}, false
+			}
+			return usage.Remaining{Tokens: -1, Cost: 0, Reset: reset}, true
+		},
+	}
+
+	do := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"group","messages":[]}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		s.HandleCompletionsRequest(w, req)
+		return w
+	}
+
+	w := do("ci-key")
+	if w.Code != http.StatusPaymentRequired || !strings.Contains(w.Body.String(), "spend_cap_exceeded") {
+		t.Errorf("Expected status 402 over the spend cap, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get(HeaderBudgetRemaining) != "0" || w.Header().Get(HeaderBudgetReset) != "2025-04-01T00:00:00Z" {
+		t.Errorf("Expected the remaining budget in the headers, got %v", w.Header())
+	}
+	if w.Header().Get(HeaderBudgetRemainingTokens) != "" {
+		t.Errorf("Expected no token header without a token budget")
+	}
+	if w := do("router-key"); w.Header().Get(HeaderBudgetRemaining) != "" {
+		t.Errorf("Expected no budget headers for keys without budgets")
+	}
+}
+
+func TestRequestTooExpensiveResponse(t *testing.T) {
+	s := &Server{
+		APIKey: "router-key",
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		handleRequest: func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionResponse, error) {
+			return nil, fmt.Errorf("%w: the request could cost up to $0.2400", ErrRequestTooExpensive)
+		},
+	}
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"group","messages":[]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer router-key")
+	w := httptest.NewRecorder()
+	s.HandleCompletionsRequest(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "request_too_expensive") || !strings.Contains(w.Body.String(), "$0.2400") {
+		t.Errorf("Expected status 400 with the worst-case cost, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	s := &Server{
+		APIKey:      "router-key",
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		MaxBodySize: 64,
+		handleRequest: func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionResponse, error) {
+			return nil, fmt.Errorf("provider openai did not respond within 1m0s: %w", context.DeadlineExceeded)
+		},
+	}
+	handler := s.limitBody(s.HandleCompletionsRequest)
+	do := func(body string, chunked bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		if chunked {
+			req.ContentLength = -1
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer router-key")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	if w := do(`{"model":"group","messages":[]}`, false); w.Code != http.StatusGatewayTimeout || !strings.Contains(w.Body.String(), `"timeout"`) {
+		t.Errorf("Expected status 504 for a request over the timeout, got %d: %s", w.Code, w.Body.String())
+	}
+	large := `{"model":"group","messages":[{"role":"user","content":"` + strings.Repeat("a", 100) + `"}]}`
+	for _, chunked := range []bool{false, true} {
+		if w := do(large, chunked); w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "request_too_large") {
+			t.Errorf("Expected status 413 for a body over the limit (chunked: %t), got %d: %s", chunked, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := identify(func(w http.ResponseWriter, r *http.Request) {
+		seen = client.RequestIDFromContext(r.Context())
+	})
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	req.Header.Set(HeaderRequestID, "caller-42")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if seen != "caller-42" || w.Header().Get(HeaderRequestID) != "caller-42" {
+		t.Errorf("Expected the caller's request ID to be kept, got %q", seen)
+	}
+
+	req.Header.Set(HeaderRequestID, "not valid")
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if len(seen) != 32 || w.Header().Get(HeaderRequestID) != seen {
+		t.Errorf("Expected a random request ID instead of an invalid one, got %q", seen)
+	}
+}
+
+func TestPromptLogging(t *testing.T) {
+	var out strings.Builder
+	s := &Server{
+		APIKey: "router-key",
+		Logger: slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		handleRequest: func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionResponse, error) {
+			return &client.ChatCompletionResponse{ChatCompletionResponse: openai.ChatCompletionResponse{ID: "1", Model: "gpt-4o",
+				Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Role: "assistant", Content: "the secret answer"}}}}}, nil
+		},
+	}
+	do := func() {
+		out.Reset()
+		body := `{"model":"group","messages":[{"role":"user","content":"my private question ` + strings.Repeat("x", 300) + `"}]}`
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer router-key")
+		req.Header.Set("X-Api-Key", "router-key")
+		w := httptest.NewRecorder()
+		s.HandleCompletionsRequest(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the request to succeed, got %d", w.Code)
+		}
+	}
+
+	do()
+	for _, secret := range []string{"router-key", "private question", "secret answer"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("Expected %q not to be logged by default, got:\n%s", secret, out.String())
+		}
+	}
+
+	s.PromptLogLength = 150
+	do()
+	if !strings.Contains(out.String(), "private question") || !strings.Contains(out.String(), "more characters") || strings.Contains(out.String(), strings.Repeat("x", 300)) {
+		t.Errorf("Expected the prompt to be logged truncated, got:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "router-key") {
+		t.Errorf("Expected keys never to be logged, got:\n%s", out.String())
+	}
+}
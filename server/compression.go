@@ -1,43 +1,202 @@
 package server
 
 import (
+	"cmp"
 	"compress/gzip"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
-// gzipResponseWriter wraps http.ResponseWriter to provide gzip compression
-type gzipResponseWriter struct {
-	io.Writer
+// Compression sets the levels responses are compressed at, in the scale of each encoding: 1 to 9 for gzip,
+// 1 to 11 for brotli, and 1 to 22 for zstd. Levels left at 0 are the defaults.
+type Compression struct {
+	// Levels compress the JSON responses, DefaultCompressionLevels by default
+	Levels CompressionLevels
+	// StreamLevels compress the server-sent events of streams, which are flushed a token at a time and gain
+	// little from higher levels, DefaultStreamCompressionLevels by default
+	StreamLevels CompressionLevels
+	// MinSize is the size in bytes under which responses are not compressed, as compressing them saves
+	// little; streams are compressed from their first flush whatever their size
+	MinSize int64
+}
+
+// CompressionLevels are the levels of the encodings responses are compressed with
+type CompressionLevels struct {
+	Gzip   int
+	Brotli int
+	Zstd   int
+}
+
+// Default compression levels: the encodings' defaults for JSON responses, favoring their ratio, and their
+// fastest levels for streams, favoring the latency of each token
+var (
+	DefaultCompressionLevels       = CompressionLevels{Gzip: gzip.DefaultCompression, Brotli: brotli.DefaultCompression, Zstd: 3}
+	DefaultStreamCompressionLevels = CompressionLevels{Gzip: gzip.BestSpeed, Brotli: 1, Zstd: 1}
+)
+
+// level returns the level of an encoding, the default's when not set
+func (l CompressionLevels) level(encoding string, defaults CompressionLevels) int {
+	switch encoding {
+	case "zstd":
+		return cmp.Or(l.Zstd, defaults.Zstd)
+	case "br":
+		return cmp.Or(l.Brotli, defaults.Brotli)
+	default:
+		return cmp.Or(l.Gzip, defaults.Gzip)
+	}
+}
+
+// encoder is a compressing writer of one of the encodings
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoderKey identifies the pool of the encoders of an encoding and level
+type encoderKey struct {
+	encoding string
+	level    int
+}
+
+// encoderPools pools the encoders of each encoding and level for reuse, by encoderKey
+var encoderPools sync.Map
+
+// getEncoder returns an encoder of an encoding and level writing to w, from its pool
+func getEncoder(key encoderKey, w io.Writer) encoder {
+	pool, ok := encoderPools.Load(key)
+	if !ok {
+		pool, _ = encoderPools.LoadOrStore(key, &sync.Pool{New: func() any { return newEncoder(key) }})
+	}
+	enc := pool.(*sync.Pool).Get().(encoder)
+	enc.Reset(w)
+	return enc
+}
+
+// putEncoder returns an encoder to its pool once closed
+func putEncoder(key encoderKey, enc encoder) {
+	if pool, ok := encoderPools.Load(key); ok {
+		pool.(*sync.Pool).Put(enc)
+	}
+}
+
+// newEncoder creates an encoder of an encoding and level
+func newEncoder(key encoderKey) encoder {
+	switch key.encoding {
+	case "zstd":
+		// A single goroutine per response, and at most the 8MB window browsers decode
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(key.level)),
+			zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(8<<20))
+		return enc
+	case "br":
+		return brotli.NewWriterLevel(io.Discard, key.level)
+	default:
+		gz, err := gzip.NewWriterLevel(io.Discard, key.level)
+		if err != nil {
+			gz = gzip.NewWriter(io.Discard)
+		}
+		return gz
+	}
+}
+
+// compressResponseWriter wraps http.ResponseWriter to compress the response with an encoding, at the level of
+// streams or of other responses depending on the Content-Type the handler sets. The start of the body is held
+// until it reaches the minimum size, so that smaller responses, and those of content types that do not
+// compress, are written as they are.
+type compressResponseWriter struct {
 	http.ResponseWriter
-	wroteHeader bool
+	encoding    string
+	compression Compression
+	// status is the status of the response, written once whether to compress it is decided
+	status  int
+	buf     []byte
+	decided bool
+	key     encoderKey
+	// enc compresses the body, nil when the response is not compressed
+	enc encoder
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	header := w.Header()
+	bodiless := status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified
+	if bodiless || header.Get("Content-Encoding") != "" || !compressible(header.Get("Content-Type")) {
+		w.decide(false)
+		return
+	}
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length < w.compression.MinSize {
+		w.decide(false)
+	}
+}
+
+// decide writes the headers of the response, compressed or not, and the start of the body held so far
+func (w *compressResponseWriter) decide(compress bool) error {
+	w.decided = true
+	if compress {
+		level := w.compression.Levels.level(w.encoding, DefaultCompressionLevels)
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+			level = w.compression.StreamLevels.level(w.encoding, DefaultStreamCompressionLevels)
+		}
+		w.key = encoderKey{encoding: w.encoding, level: level}
+		w.enc = getEncoder(w.key, w.ResponseWriter)
+		w.Header().Set("Content-Encoding", w.encoding)
+		// Remove Content-Length header since we're compressing
+		w.Header().Del("Content-Length")
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	buf := w.buf
+	w.buf = nil
+	_, err := w.write(buf)
+	return err
 }
 
-func (w *gzipResponseWriter) WriteHeader(status int) {
-	w.wroteHeader = true
-	w.ResponseWriter.WriteHeader(status)
+// write writes to the encoder, or to the response when it is not compressed
+func (w *compressResponseWriter) write(b []byte) (int, error) {
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
 }
 
-func (w *gzipResponseWriter) Write(b []byte) (int, error) {
-	if !w.wroteHeader {
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
 		w.WriteHeader(http.StatusOK)
 	}
-	return w.Writer.Write(b)
+	if w.decided {
+		return w.write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if int64(len(w.buf)) >= w.compression.MinSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
 }
 
 // Implement http.Flusher interface for streaming support
-func (w *gzipResponseWriter) Flush() {
-	// Flush the gzip writer if it supports flushing
-	if gw, ok := w.Writer.(*gzip.Writer); ok {
-		gw.Flush()
+func (w *compressResponseWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	// A flushed response is streamed, and compressed whatever the size of its start
+	if !w.decided {
+		w.decide(true)
 	}
-	// Flush the brotli writer if it supports flushing
-	if bw, ok := w.Writer.(*brotli.Writer); ok {
-		bw.Flush()
+	if w.enc != nil {
+		w.enc.Flush()
 	}
 	// Flush the underlying response writer if it supports flushing
 	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
@@ -45,75 +204,122 @@ func (w *gzipResponseWriter) Flush() {
 	}
 }
 
-// gzipWriterPool pools gzip writers for reuse
-var gzipWriterPool = sync.Pool{
-	New: func() any {
-		return gzip.NewWriter(io.Discard)
-	},
+// Unwrap returns the underlying response writer, for http.ResponseController
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
-// brotliWriterPool pools brotli writers for reuse
-var brotliWriterPool = sync.Pool{
-	New: func() any {
-		return brotli.NewWriter(io.Discard)
-	},
+// close ends the response, writing it uncompressed if it ended below the minimum size, and returns the
+// encoder to its pool
+func (w *compressResponseWriter) close() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.enc != nil {
+		w.enc.Close()
+		putEncoder(w.key, w.enc)
+	}
 }
 
-// compressionMiddleware wraps an http.Handler to add compression support
-// Prioritizes Brotli (br) over gzip
-func compressionMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		acceptEncoding := r.Header.Get("Accept-Encoding")
-
-		// Check for Brotli support first (prioritize br over gzip)
-		if strings.Contains(acceptEncoding, "br") {
-			// Get a brotli writer from the pool
-			br := brotliWriterPool.Get().(*brotli.Writer)
-			defer brotliWriterPool.Put(br)
-
-			br.Reset(w)
-			defer br.Close()
-
-			// Set the content encoding header
-			w.Header().Set("Content-Encoding", "br")
-			// Remove Content-Length header since we're compressing
-			w.Header().Del("Content-Length")
-
-			// Wrap the response writer
-			brw := &gzipResponseWriter{
-				Writer:         br,
-				ResponseWriter: w,
-			}
-
-			next(brw, r)
-			return
-		}
-
-		// Check if client accepts gzip encoding
-		if strings.Contains(acceptEncoding, "gzip") {
-			// Get a gzip writer from the pool
-			gz := gzipWriterPool.Get().(*gzip.Writer)
-			defer gzipWriterPool.Put(gz)
+// incompressibleTypes are the media types of application/ that are compressed already, apart from those of
+// images, audio, and video
+var incompressibleTypes = map[string]bool{
+	"application/gzip":         true,
+	"application/x-gzip":       true,
+	"application/zip":          true,
+	"application/zstd":         true,
+	"application/octet-stream": true,
+	"application/pdf":          true,
+}
 
-			gz.Reset(w)
-			defer gz.Close()
+// compressible returns whether responses of a Content-Type gain from compression: text, JSON, and the like,
+// but not images, audio, video, or archives. Responses without a Content-Type are compressed.
+func compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	switch {
+	case mediaType == "image/svg+xml":
+		return true
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "audio/"), strings.HasPrefix(mediaType, "video/"):
+		return false
+	}
+	return !incompressibleTypes[mediaType]
+}
 
-			// Set the content encoding header
-			w.Header().Set("Content-Encoding", "gzip")
-			// Remove Content-Length header since we're compressing
-			w.Header().Del("Content-Length")
+// encodingPreference are the encodings responses are compressed with, in order of preference when a client
+// accepts several of them equally
+var encodingPreference = []string{"zstd", "br", "gzip"}
 
-			// Wrap the response writer
-			gzw := &gzipResponseWriter{
-				Writer:         gz,
-				ResponseWriter: w,
+// acceptedEncoding returns the encoding to compress a response with for an Accept-Encoding header: the one
+// with the highest q-value, then by encodingPreference, or none when the client accepts none of them
+func acceptedEncoding(acceptEncoding string) string {
+	qualities := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(key), "q") {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil || parsed < 0 || parsed > 1 {
+					parsed = 0
+				}
+				q = parsed
 			}
+		}
+		if name == "*" {
+			wildcard = q
+			continue
+		}
+		// x-gzip is an alias of gzip
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+		qualities[name] = q
+	}
+	best, bestQ := "", 0.0
+	for _, encoding := range encodingPreference {
+		q, listed := qualities[encoding]
+		if !listed {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
 
-			next(gzw, r)
+// compress compresses the responses of a handler unless compression is disabled
+func (s *Server) compress(next http.HandlerFunc) http.HandlerFunc {
+	if s.DisableCompression {
+		return next
+	}
+	return s.Compression.middleware(next)
+}
+
+// middleware wraps an http.Handler to add compression support at the levels of c, with the encoding of
+// highest q-value the client accepts, preferring zstd, then Brotli (br), over gzip
+func (c Compression) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			// No compression
+			next(w, r)
 			return
 		}
 
-		// No compression
-		next(w, r)
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding, compression: c}
+		defer cw.close()
+		next(cw, r)
 	}
 }
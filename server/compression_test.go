@@ -10,11 +10,12 @@ import (
 	"testing"
 
 	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 func TestCompressionMiddleware(t *testing.T) {
 	// Create a simple handler that returns JSON
-	handler := compressionMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	handler := Compression{}.middleware(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"message":"hello world","data":"this is a test response that should be compressed"}`))
@@ -167,16 +168,33 @@ func TestCompressionMiddleware(t *testing.T) {
 			t.Errorf("Expected body '%s', got '%s'", expected, string(body))
 		}
 	})
+
+	// Test 6: Compression disabled on the server
+	t.Run("WithCompressionDisabled", func(t *testing.T) {
+		s := &Server{DisableCompression: true}
+		handler := s.compress(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"message":"hello world"}`))
+		})
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("Accept-Encoding", "gzip, br")
+		w := httptest.NewRecorder()
+
+		handler(w, req)
+
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "" || w.Body.String() != `{"message":"hello world"}` {
+			t.Errorf("Expected an uncompressed response, got Content-Encoding '%s'", encoding)
+		}
+	})
 }
 
 func TestGzipResponseWriterFlusher(t *testing.T) {
-	// Test that the gzipResponseWriter implements http.Flusher for streaming
+	// Test that the compressResponseWriter implements http.Flusher for streaming
 	t.Run("GzipFlusher", func(t *testing.T) {
-		handler := compressionMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		handler := Compression{}.middleware(func(w http.ResponseWriter, r *http.Request) {
 			// Verify that w implements http.Flusher
 			flusher, ok := w.(http.Flusher)
 			if !ok {
-				t.Error("gzipResponseWriter does not implement http.Flusher")
+				t.Error("compressResponseWriter does not implement http.Flusher")
 				return
 			}
 
@@ -224,7 +242,7 @@ func TestGzipResponseWriterFlusher(t *testing.T) {
 
 	// Test Brotli flusher support
 	t.Run("BrotliFlusher", func(t *testing.T) {
-		handler := compressionMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		handler := Compression{}.middleware(func(w http.ResponseWriter, r *http.Request) {
 			// Verify that w implements http.Flusher
 			flusher, ok := w.(http.Flusher)
 			if !ok {
@@ -281,7 +299,7 @@ func TestCompressionSavesSpace(t *testing.T) {
 	}
 	largeJSON += `]}`
 
-	handler := compressionMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	handler := Compression{}.middleware(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.Write([]byte(largeJSON))
 	})
@@ -357,9 +375,80 @@ func TestCompressionSavesSpace(t *testing.T) {
 	}
 }
 
+func TestZstdCompression(t *testing.T) {
+	handler := Compression{}.middleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			w.Write([]byte("data: chunk\n\n"))
+			w.(http.Flusher).Flush()
+		}
+	})
+
+	// zstd is preferred over brotli and gzip, as it compresses as well for less CPU
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("Accept-Encoding", "gzip, deflate, br, zstd")
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "zstd" {
+			t.Fatalf("Expected Content-Encoding to be 'zstd', got '%s'", encoding)
+		}
+		decoder, err := zstd.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(decoder)
+		decoder.Close()
+		if err != nil {
+			t.Fatalf("Request %d: Failed to read decompressed body: %v", i, err)
+		}
+		if count := strings.Count(string(body), "data: chunk"); count != 3 {
+			t.Errorf("Request %d: Expected 3 chunks, got %d", i, count)
+		}
+	}
+}
+
+func TestCompressionLevels(t *testing.T) {
+	levels := func(c Compression, encoding string, contentType string) int {
+		var level int
+		handler := c.middleware(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write([]byte("{}"))
+			level = w.(*compressResponseWriter).key.level
+		})
+		req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		handler(httptest.NewRecorder(), req)
+		return level
+	}
+
+	for _, tc := range []struct {
+		encoding    string
+		contentType string
+		c           Compression
+		expected    int
+	}{
+		{"gzip", "application/json", Compression{}, gzip.DefaultCompression},
+		{"gzip", "text/event-stream", Compression{}, gzip.BestSpeed},
+		{"br", "application/json", Compression{}, brotli.DefaultCompression},
+		{"br", "text/event-stream; charset=utf-8", Compression{}, 1},
+		{"zstd", "application/json", Compression{}, 3},
+		{"zstd", "text/event-stream", Compression{}, 1},
+		{"gzip", "application/json", Compression{Levels: CompressionLevels{Gzip: 9}}, 9},
+		{"br", "application/json", Compression{Levels: CompressionLevels{Gzip: 9}}, brotli.DefaultCompression},
+		{"zstd", "text/event-stream", Compression{Levels: CompressionLevels{Zstd: 19}, StreamLevels: CompressionLevels{Zstd: 2}}, 2},
+		{"zstd", "application/json", Compression{Levels: CompressionLevels{Zstd: 19}, StreamLevels: CompressionLevels{Zstd: 2}}, 19},
+	} {
+		if level := levels(tc.c, tc.encoding, tc.contentType); level != tc.expected {
+			t.Errorf("Expected %s level %d for %s with %+v, got %d", tc.encoding, tc.expected, tc.contentType, tc.c, level)
+		}
+	}
+}
+
 func TestGzipWriterPooling(t *testing.T) {
 	// Test that gzip writers are properly pooled and reused
-	handler := compressionMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	handler := Compression{}.middleware(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("test response"))
 	})
 
@@ -398,7 +487,7 @@ func TestGzipWriterPooling(t *testing.T) {
 
 func TestBrotliWriterPooling(t *testing.T) {
 	// Test that brotli writers are properly pooled and reused
-	handler := compressionMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	handler := Compression{}.middleware(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("test response"))
 	})
 
@@ -433,7 +522,7 @@ func TestBrotliWriterPooling(t *testing.T) {
 func BenchmarkCompressionMiddleware(b *testing.B) {
 	largeJSON := bytes.Repeat([]byte(`{"key":"value","description":"some text"}`), 100)
 
-	handler := compressionMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	handler := Compression{}.middleware(func(w http.ResponseWriter, r *http.Request) {
 		w.Write(largeJSON)
 	})
 
@@ -463,3 +552,124 @@ func BenchmarkCompressionMiddleware(b *testing.B) {
 		}
 	})
 }
+
+func TestAcceptedEncoding(t *testing.T) {
+	for header, expected := range map[string]string{
+		"":                                "",
+		"gzip":                            "gzip",
+		"x-gzip":                          "gzip",
+		"GZIP, deflate":                   "gzip",
+		"gzip, deflate, br, zstd":         "zstd",
+		"identity;q=0, br;q=0":            "",
+		"br;q=0, gzip":                    "gzip",
+		"br;q=0.5, gzip;q=0.8":            "gzip",
+		"br;q=0.8, gzip;q=0.8":            "br",
+		"zstd;q=0.1, br; q=0.9, gzip":     "gzip",
+		"*":                               "zstd",
+		"*;q=0":                           "",
+		"gzip;q=0.2, *;q=0.5, zstd;q=0":   "br",
+		"deflate, identity":               "",
+		"brotli, gzip":                    "gzip",
+		"gzip;q=invalid, br;q=2":          "",
+		"gzip;level=1;q=0.5, deflate;q=1": "gzip",
+	} {
+		if encoding := acceptedEncoding(header); encoding != expected {
+			t.Errorf("Expected %q for Accept-Encoding %q, got %q", expected, header, encoding)
+		}
+	}
+}
+
+func TestCompressionGating(t *testing.T) {
+	serve := func(c Compression, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1/models", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		c.middleware(handler)(w, req)
+		return w
+	}
+	c := Compression{MinSize: 1024}
+	body := strings.Repeat(`{"id":"gpt-4o","object":"model"}`, 64)
+
+	w := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"object":"list","data":[]}`))
+	})
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != `{"object":"list","data":[]}` {
+		t.Errorf("Expected a response under the minimum size to be uncompressed, got %q", w.Header().Get("Content-Encoding"))
+	}
+	if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("Expected Vary: Accept-Encoding, got %q", vary)
+	}
+
+	w = serve(c, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// written in pieces under the minimum size
+		for i := 0; i < len(body); i += 100 {
+			w.Write([]byte(body[i:min(i+100, len(body))]))
+		}
+	})
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a response over the minimum size to be compressed, got %q", w.Header().Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decompressed, err := io.ReadAll(gz); err != nil || string(decompressed) != body {
+		t.Errorf("Expected the whole body once decompressed, got %d bytes, %v", len(decompressed), err)
+	}
+
+	w = serve(c, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "27")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"object":"list","data":[]}`))
+	})
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Encoding") != "" || w.Header().Get("Content-Length") != "27" {
+		t.Errorf("Expected a response declaring a length under the minimum size to be uncompressed, got %d %v", w.Code, w.Header())
+	}
+
+	for _, contentType := range []string{"audio/mpeg", "image/png", "application/octet-stream", "application/zip"} {
+		w = serve(c, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write([]byte(body))
+		})
+		if w.Header().Get("Content-Encoding") != "" || w.Body.String() != body {
+			t.Errorf("Expected %s to be uncompressed, got %q", contentType, w.Header().Get("Content-Encoding"))
+		}
+	}
+	for _, contentType := range []string{"text/plain; charset=utf-8", "image/svg+xml", "application/x-ndjson"} {
+		w = serve(c, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write([]byte(body))
+		})
+		if w.Header().Get("Content-Encoding") != "gzip" {
+			t.Errorf("Expected %s to be compressed, got %q", contentType, w.Header().Get("Content-Encoding"))
+		}
+	}
+
+	w = serve(c, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	if w.Code != http.StatusNoContent || w.Header().Get("Content-Encoding") != "" || w.Body.Len() != 0 {
+		t.Errorf("Expected a response without a body to be uncompressed, got %d %v", w.Code, w.Header())
+	}
+
+	// Streams are compressed from their first event
+	w = serve(c, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: chunk\n\n"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("data: [DONE]\n\n"))
+	})
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a stream to be compressed, got %q", w.Header().Get("Content-Encoding"))
+	}
+	gz, err = gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decompressed, err := io.ReadAll(gz); err != nil || string(decompressed) != "data: chunk\n\ndata: [DONE]\n\n" {
+		t.Errorf("Expected the stream's events once decompressed, got %q, %v", decompressed, err)
+	}
+}
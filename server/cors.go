@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS lets browser-based apps served from other origins call the API endpoints directly, without a proxy of
+// their own adding the Access-Control headers
+type CORS struct {
+	// AllowedOrigins are the origins allowed, e.g. https://app.example.com, with * allowing any origin and
+	// https://*.example.com any subdomain. CORS is disabled when empty.
+	AllowedOrigins []string
+	// AllowedMethods are the methods allowed, DefaultCORSMethods when empty
+	AllowedMethods []string
+	// AllowedHeaders are the request headers allowed, DefaultCORSHeaders when empty, with * allowing any
+	AllowedHeaders []string
+	// MaxAge is how long browsers cache the result of a preflight request, their own default when 0
+	MaxAge time.Duration
+}
+
+// Defaults of the methods and request headers allowed from other origins: those of the OpenAI and Anthropic
+// SDKs' requests
+var (
+	DefaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodDelete}
+	DefaultCORSHeaders = []string{"Authorization", "Content-Type", "X-Api-Key", "Anthropic-Version", HeaderExplain}
+)
+
+// corsExposedHeaders are the response headers the router sets for clients, which browsers only let apps of
+// other origins read when exposed
+var corsExposedHeaders = strings.Join([]string{
+	HeaderProvider, HeaderModel, HeaderKeyAlias, HeaderCost, HeaderAttempts, HeaderRequestID,
+	HeaderBudgetRemaining, HeaderBudgetRemainingTokens, HeaderBudgetReset,
+	HeaderLimitRequests, HeaderRemainingRequests, HeaderResetRequests,
+	HeaderLimitTokens, HeaderRemainingTokens, HeaderResetTokens,
+}, ", ")
+
+// allowsOrigin returns whether an origin is allowed, exactly, by a wildcard subdomain, or by *
+func (c CORS) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.AllowedOrigins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		scheme, domain, found := strings.Cut(allowed, "://*.")
+		if !found {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err == nil && u.Scheme == scheme && strings.HasSuffix(u.Host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// cors adds the Access-Control headers to the responses of the API endpoints to requests from allowed origins
+// and answers their preflight requests, unless CORS is disabled
+func (s *Server) cors(next http.Handler) http.Handler {
+	if len(s.CORS.AllowedOrigins) == 0 {
+		return next
+	}
+	methods := s.CORS.AllowedMethods
+	if len(methods) == 0 {
+		methods = DefaultCORSMethods
+	}
+	headers := s.CORS.AllowedHeaders
+	if len(headers) == 0 {
+		headers = DefaultCORSHeaders
+	}
+	anyHeader := slices.Contains(headers, "*")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		allowed := s.CORS.allowsOrigin(origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !preflight {
+			if allowed {
+				header.Set("Access-Control-Allow-Origin", origin)
+				header.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Preflight requests carry no credentials, so they are answered without authentication. Those of
+		// origins not allowed are answered without the headers, which fails them in the browser.
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		if allowed {
+			header.Set("Access-Control-Allow-Origin", origin)
+			header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			if anyHeader {
+				header.Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+			} else {
+				header.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			}
+			if s.CORS.MaxAge > 0 {
+				header.Set("Access-Control-Max-Age", strconv.Itoa(int(s.CORS.MaxAge.Seconds())))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	s := &Server{CORS: CORS{AllowedOrigins: []string{"https://app.example.com", "https://*.example.org"}, MaxAge: 10 * time.Minute}}
+	handler := s.cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			http.Error(w, "Invalid or missing API key", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set(HeaderProvider, "openai")
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(method string, path string, origin string, header http.Header) *http.Response {
+		req := httptest.NewRequest(method, path, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+	preflight := http.Header{"Access-Control-Request-Method": {"POST"}, "Access-Control-Request-Headers": {"authorization,content-type"}}
+
+	resp := serve(http.MethodOptions, "/v1/chat/completions", "https://app.example.com", preflight)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected the preflight request to be answered without authentication, got %d", resp.StatusCode)
+	}
+	if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "https://app.example.com" {
+		t.Errorf("Expected the origin to be allowed, got %q", origin)
+	}
+	if methods := resp.Header.Get("Access-Control-Allow-Methods"); methods != "GET, POST, DELETE" {
+		t.Errorf("Expected the default methods, got %q", methods)
+	}
+	if headers := resp.Header.Get("Access-Control-Allow-Headers"); headers != "Authorization, Content-Type, X-Api-Key, Anthropic-Version, X-LLM-Router-Explain" {
+		t.Errorf("Expected the default headers, got %q", headers)
+	}
+	if maxAge := resp.Header.Get("Access-Control-Max-Age"); maxAge != "600" {
+		t.Errorf("Expected preflight results to be cached for 600 seconds, got %q", maxAge)
+	}
+
+	resp = serve(http.MethodOptions, "/v1/messages", "https://api.example.org", preflight)
+	if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "https://api.example.org" {
+		t.Errorf("Expected a subdomain to be allowed, got %q", origin)
+	}
+	for _, origin := range []string{"https://evil.example.com", "http://api.example.org", "https://example.org.evil.com"} {
+		resp = serve(http.MethodOptions, "/v1/chat/completions", origin, preflight)
+		if allowed := resp.Header.Get("Access-Control-Allow-Origin"); allowed != "" || resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Expected %s not to be allowed, got %d %q", origin, resp.StatusCode, allowed)
+		}
+	}
+
+	resp = serve(http.MethodPost, "/v1/chat/completions", "https://app.example.com", http.Header{"Authorization": {"Bearer key"}})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("Expected the request to be served with its origin allowed, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if exposed := resp.Header.Get("Access-Control-Expose-Headers"); exposed != corsExposedHeaders {
+		t.Errorf("Expected the router's headers to be exposed, got %q", exposed)
+	}
+	resp = serve(http.MethodPost, "/v1/chat/completions", "https://evil.example.com", nil)
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected the request of another origin to be served without CORS headers, got %d %v", resp.StatusCode, resp.Header)
+	}
+	resp = serve(http.MethodOptions, "/admin/keys", "https://app.example.com", preflight)
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected CORS to be limited to the API endpoints, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	s = &Server{CORS: CORS{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"POST"}, AllowedHeaders: []string{"*"}}}
+	handler = s.cors(http.NotFoundHandler())
+	resp = serve(http.MethodOptions, "/v1/chat/completions", "https://anywhere.example.net", preflight)
+	if resp.Header.Get("Access-Control-Allow-Origin") != "https://anywhere.example.net" || resp.Header.Get("Access-Control-Allow-Methods") != "POST" {
+		t.Errorf("Expected any origin to be allowed the configured methods, got %v", resp.Header)
+	}
+	if headers := resp.Header.Get("Access-Control-Allow-Headers"); headers != "authorization,content-type" {
+		t.Errorf("Expected the requested headers to be allowed, got %q", headers)
+	}
+	if resp.Header.Get("Access-Control-Max-Age") != "" {
+		t.Errorf("Expected the browsers' default cache duration, got %v", resp.Header)
+	}
+
+	handler = (&Server{}).cors(http.NotFoundHandler())
+	if resp := serve(http.MethodOptions, "/v1/chat/completions", "https://app.example.com", preflight); resp.StatusCode != http.StatusNotFound || resp.Header.Get("Vary") != "" {
+		t.Errorf("Expected CORS to be disabled without allowed origins, got %d %v", resp.StatusCode, resp.Header)
+	}
+}
@@ -0,0 +1,20 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// dashboardPage is the admin dashboard, a single page polling the admin API
+//
+//go:embed dashboard/index.html
+var dashboardPage []byte
+
+// handleDashboard serves the dashboard page. The page holds no data and is served without authentication,
+// so that browsers can open it; it asks for the admin API key to call the admin API with.
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Write(dashboardPage)
+}
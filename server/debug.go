@@ -0,0 +1,65 @@
+package server
+
+import (
+	"llm-router/client"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// DebugRouting is the routing state served by /debug/routing: what the next request to each group would be
+// routed on, and the counters of every key the selection is based on
+type DebugRouting struct {
+	Time   time.Time           `json:"time"`
+	Groups []DebugRoutingGroup `json:"groups"`
+	Keys   []DebugRoutingKey   `json:"keys"`
+}
+
+// DebugRoutingGroup lists the candidates of a group as a request without particular requirements, e.g. images
+// or a long prompt, would find them now
+type DebugRoutingGroup struct {
+	Name     string `json:"name"`
+	Strategy string `json:"strategy"`
+	// Candidates are the shared keys of the group's models with their scores, the one a request would be routed to
+	// being selected
+	Candidates []client.Candidate `json:"candidates"`
+	// Error is why a request could not be routed, empty when it could
+	Error string `json:"error,omitempty"`
+}
+
+// DebugRoutingKey is the state of a provider key bearing on routing
+type DebugRoutingKey struct {
+	// KeyID identifies the key as "provider/hash"
+	KeyID   string `json:"key"`
+	Free    bool   `json:"free,omitempty"`
+	Tenant  string `json:"tenant,omitempty"`
+	Drained bool   `json:"drained,omitempty"`
+	// Circuit is open until RateLimitedUntil while the key cools down after the provider rate limited it
+	Circuit          string     `json:"circuit"`
+	RateLimitedUntil *time.Time `json:"rate_limited_until,omitempty"`
+	// Usage is the usage counted per model, including Penalties
+	Usage map[string]int64 `json:"usage"`
+	// Penalties are what is left of the error and request penalties per model
+	Penalties map[string]int64 `json:"penalties,omitempty"`
+	// OverBudget is set when the key or its provider used up a budget
+	OverBudget bool `json:"over_budget,omitempty"`
+}
+
+// HandleDebugRoutingRequest returns an http.HandlerFunc serving the routing state
+func (s *Server) HandleDebugRoutingRequest(routing func() DebugRouting) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, routing())
+	}
+}
+
+// profiles returns a handler serving the runtime profiles of net/http/pprof, e.g. /debug/pprof/profile for a
+// CPU profile and /debug/pprof/heap for a heap profile
+func profiles() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
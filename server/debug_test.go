@@ -0,0 +1,38 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	s := &Server{
+		APIKey:      "router-key",
+		AdminAPIKey: "admin-key",
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	handler := s.adminMiddleware(profiles())
+
+	do := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("/debug/pprof/goroutine?debug=1", "router-key"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected profiles to require the admin key, got %d", rec.Code)
+	}
+	rec := do("/debug/pprof/goroutine?debug=1", "admin-key")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "goroutine profile") {
+		t.Errorf("Expected the goroutine profile, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("/debug/pprof/", "admin-key"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "heap") {
+		t.Errorf("Expected the index of profiles, got %d", rec.Code)
+	}
+}
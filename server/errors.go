@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"llm-router/usage"
+	"net/http"
+)
+
+// ErrRequestTooExpensive is returned for requests whose worst-case cost exceeds the maximum cost per request
+var ErrRequestTooExpensive = errors.New("request too expensive")
+
+// errorResponse is the OpenAI error envelope
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// writeOpenAIError writes an error in the OpenAI error format
+func writeOpenAIError(w http.ResponseWriter, status int, errType string, code string, message string) {
+	detail := errorDetail{
+		Message: message,
+		Type:    errType,
+	}
+	if code != "" {
+		detail.Code = &code
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errorResponse{Error: detail})
+}
+
+// writeRoutingError writes a 404 error if err is caused by a group the client may not use, a 429 error if it is
+// caused by an exceeded budget, a 402 error for a client key's spend cap, a 400 error for a request over the
+// maximum cost, or a 504 error for a request that timed out, reporting whether it did
+func writeRoutingError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, ErrGroupNotAllowed):
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "model_not_found", err.Error())
+	case errors.Is(err, usage.ErrSpendCapExceeded):
+		writeOpenAIError(w, http.StatusPaymentRequired, "insufficient_quota", "spend_cap_exceeded", err.Error())
+	case errors.Is(err, usage.ErrBudgetExceeded):
+		writeOpenAIError(w, http.StatusTooManyRequests, "insufficient_quota", "budget_exceeded", err.Error())
+	case errors.Is(err, ErrRequestTooExpensive):
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "request_too_expensive", err.Error())
+	case isTimeout(err):
+		writeOpenAIError(w, http.StatusGatewayTimeout, "server_error", "timeout", err.Error())
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Headers reverse proxies name the client of a request with
+const (
+	HeaderForwardedFor = "X-Forwarded-For"
+	HeaderRealIP       = "X-Real-IP"
+)
+
+type clientIPKey struct{}
+
+// clientIPFromContext returns the address of the client of a request, as set by the clientIP middleware
+func clientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// clientIP sets the address of the client of each request in its context, for the access log, audit log,
+// quota warnings, and the client IP rate limit
+func (s *Server) clientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, s.resolveClientIP(r))))
+	})
+}
+
+// resolveClientIP returns the address of the client of a request: the peer's, unless it is a trusted proxy, in
+// which case the rightmost address of X-Forwarded-For that is not a trusted proxy, or X-Real-IP without
+// X-Forwarded-For. Addresses left of the first untrusted one could be forged by the client, so they are never
+// used.
+func (s *Server) resolveClientIP(r *http.Request) string {
+	peer, unix := peerAddr(r.RemoteAddr)
+	if !s.trustedPeer(peer, unix) {
+		if unix {
+			return r.RemoteAddr
+		}
+		return peer.String()
+	}
+	var forwarded []string
+	for _, header := range r.Header.Values(HeaderForwardedFor) {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	if len(forwarded) == 0 {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get(HeaderRealIP))); err == nil {
+			return addr.Unmap().String()
+		}
+	}
+	client := r.RemoteAddr
+	if !unix {
+		client = peer.String()
+	}
+	for _, value := range slices.Backward(forwarded) {
+		addr, err := netip.ParseAddr(strings.TrimSpace(value))
+		if err != nil {
+			// A malformed hop cannot be attributed, so the client is the last proxy that forwarded it
+			break
+		}
+		client = addr.Unmap().String()
+		if !s.trusted(addr.Unmap()) {
+			break
+		}
+	}
+	return client
+}
+
+// peerAddr parses the address of the peer of a connection, reporting whether it is a Unix socket, whose
+// peers have no address
+func peerAddr(remoteAddr string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, true
+	}
+	return addr.Unmap(), false
+}
+
+// trustedPeer returns whether the peer of a connection is a trusted proxy
+func (s *Server) trustedPeer(peer netip.Addr, unix bool) bool {
+	if unix {
+		return s.TrustUnixSocket
+	}
+	return s.trusted(peer)
+}
+
+// trusted returns whether an address is in the networks of the trusted proxies
+func (s *Server) trusted(addr netip.Addr) bool {
+	return slices.ContainsFunc(s.TrustedProxies, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+}
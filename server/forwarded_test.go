@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	s := &Server{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{"untrusted peer", "203.0.113.7:4711", []string{"198.51.100.1"}, "198.51.100.2", "203.0.113.7"},
+		{"trusted peer", "10.0.0.1:4711", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"forged hops", "10.0.0.1:4711", []string{"1.2.3.4, 198.51.100.1, 10.0.0.2"}, "", "198.51.100.1"},
+		{"several headers", "10.0.0.1:4711", []string{"1.2.3.4", "198.51.100.1"}, "", "198.51.100.1"},
+		{"only proxies", "10.0.0.1:4711", []string{"10.0.0.3, 10.0.0.2"}, "", "10.0.0.3"},
+		{"malformed hop", "10.0.0.1:4711", []string{"198.51.100.1, unknown, 10.0.0.2"}, "", "10.0.0.2"},
+		{"real ip", "10.0.0.1:4711", nil, "198.51.100.1", "198.51.100.1"},
+		{"forwarded over real ip", "10.0.0.1:4711", []string{"198.51.100.1"}, "198.51.100.2", "198.51.100.1"},
+		{"no headers", "10.0.0.1:4711", nil, "", "10.0.0.1"},
+		{"ipv6", "[2001:db8::1]:4711", []string{"2001:db8:1::2, 2001:db9::1"}, "", "2001:db9::1"},
+		{"mapped ipv4", "[::ffff:10.0.0.1]:4711", []string{"::ffff:198.51.100.1"}, "", "198.51.100.1"},
+		{"untrusted unix socket", "@", []string{"198.51.100.1"}, "", "@"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				req.Header.Add(HeaderForwardedFor, value)
+			}
+			if tt.realIP != "" {
+				req.Header.Set(HeaderRealIP, tt.realIP)
+			}
+			var got string
+			s.clientIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = clientIPFromContext(r.Context())
+			})).ServeHTTP(httptest.NewRecorder(), req)
+			if got != tt.want {
+				t.Errorf("Expected client IP %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	s = &Server{TrustUnixSocket: true}
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	req.RemoteAddr = "@"
+	req.Header.Set(HeaderForwardedFor, "198.51.100.1")
+	if got := s.resolveClientIP(req); got != "198.51.100.1" {
+		t.Errorf("Expected the client behind a trusted Unix socket, got %q", got)
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"llm-router/client"
+	llmrouterv1 "llm-router/proto"
+	"llm-router/usage"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxGRPCMessageSize bounds the size of a received gRPC message
+const maxGRPCMessageSize = 32 << 20
+
+// ServeGRPC serves the gRPC chat completion service of proto/chat.proto on a listener, until Shutdown stops it
+func (s *Server) ServeGRPC(listener net.Listener) error {
+	s.Logger.Info("gRPC server listening", slog.String("address", listener.Addr().String()))
+	srv := grpc.NewServer(grpc.MaxRecvMsgSize(maxGRPCMessageSize))
+	llmrouterv1.RegisterChatCompletionsServer(srv, &chatCompletions{server: s})
+	if !s.httpServers.trackGRPC(srv) {
+		listener.Close()
+		return http.ErrServerClosed
+	}
+	return srv.Serve(listener)
+}
+
+// chatCompletions serves chat completions to gRPC callers through the handlers of the HTTP API
+type chatCompletions struct {
+	llmrouterv1.UnimplementedChatCompletionsServer
+	server *Server
+}
+
+func (c *chatCompletions) Create(ctx context.Context, in *llmrouterv1.ChatCompletionRequest) (*llmrouterv1.ChatCompletionResponse, error) {
+	ctx, req, err := c.server.grpcRequest(ctx, in, false)
+	if err != nil {
+		return nil, c.server.grpcStatus(ctx, err)
+	}
+	c.server.Logger.Info("Incoming gRPC request for model(group)", slog.String("model", req.Model))
+	response, err := c.server.handleRequest(ctx, req)
+	if err != nil {
+		return nil, c.server.grpcStatus(ctx, err)
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, c.server.grpcStatus(ctx, err)
+	}
+	out := &llmrouterv1.ChatCompletionResponse{}
+	if err := fromJSON(data, out); err != nil {
+		return nil, c.server.grpcStatus(ctx, err)
+	}
+	return out, nil
+}
+
+func (c *chatCompletions) CreateStream(in *llmrouterv1.ChatCompletionRequest, out grpc.ServerStreamingServer[llmrouterv1.ChatCompletionChunk]) error {
+	ctx, req, err := c.server.grpcRequest(out.Context(), in, true)
+	if err != nil {
+		return c.server.grpcStatus(ctx, err)
+	}
+	c.server.Logger.Info("Incoming gRPC streaming request for model(group)", slog.String("model", req.Model))
+	stream, err := c.server.handleStreamRequest(ctx, req)
+	if err != nil {
+		return c.server.grpcStatus(ctx, err)
+	}
+	defer stream.Close()
+	for {
+		_, data, err := stream.RecvRaw()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return c.server.grpcStatus(ctx, err)
+		}
+		chunk := &llmrouterv1.ChatCompletionChunk{}
+		if err := fromJSON(data, chunk); err != nil {
+			return c.server.grpcStatus(ctx, err)
+		}
+		if err := out.Send(chunk); err != nil {
+			return err
+		}
+	}
+}
+
+// grpcRequest authenticates a gRPC call with the bearer API key of its authorization metadata and decodes its
+// request as the HTTP API would the same JSON body
+func (s *Server) grpcRequest(ctx context.Context, in *llmrouterv1.ChatCompletionRequest, stream bool) (context.Context, openai.ChatCompletionRequest, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	authHeader := firstValue(md, "authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return ctx, openai.ChatCompletionRequest{}, status.Error(codes.Unauthenticated, "invalid or missing API key")
+	}
+	ctx, err := s.authorize(ctx, strings.TrimPrefix(authHeader, "Bearer "))
+	if errors.Is(err, ErrQuotaExceeded) {
+		return ctx, openai.ChatCompletionRequest{}, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if err != nil {
+		return ctx, openai.ChatCompletionRequest{}, status.Error(codes.Unauthenticated, "invalid or missing API key")
+	}
+	if s.EndUserHeader != "" {
+		if user := firstValue(md, s.EndUserHeader); user != "" {
+			ctx = client.WithEndUser(ctx, user)
+		}
+	}
+
+	body, err := requestJSON(in, stream)
+	if err != nil {
+		return ctx, openai.ChatCompletionRequest{}, status.Error(codes.InvalidArgument, "invalid chat completion request: "+err.Error())
+	}
+	req, err := client.DecodeChatCompletionRequest(body)
+	if err != nil {
+		return ctx, openai.ChatCompletionRequest{}, status.Error(codes.InvalidArgument, "invalid chat completion request: "+err.Error())
+	}
+	return client.WithRawRequest(ctx, body), req, nil
+}
+
+// firstValue returns the first value of a metadata key, or "" if it has none
+func firstValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// grpcStatus returns the gRPC status of the error of a call, logging it
+func (s *Server) grpcStatus(ctx context.Context, err error) error {
+	code := codes.Internal
+	if st, ok := status.FromError(err); ok {
+		code = st.Code()
+	} else {
+		switch {
+		case errors.Is(err, ErrGroupNotAllowed):
+			code = codes.NotFound
+		case errors.Is(err, usage.ErrBudgetExceeded):
+			code = codes.ResourceExhausted
+		case errors.Is(err, ErrRequestTooExpensive):
+			code = codes.InvalidArgument
+		case isTimeout(err):
+			code = codes.DeadlineExceeded
+		}
+		err = status.Error(code, err.Error())
+	}
+	method, _ := grpc.Method(ctx)
+	s.Logger.Warn("gRPC request failed", slog.String("method", method), slog.String("code", code.String()), slog.String("error", status.Convert(err).Message()))
+	return err
+}
+
+// requestJSON encodes a gRPC chat completion request as the JSON body of the same request to the HTTP API,
+// whose fields have the same names, with the fields of extra_body added unless defined already
+func requestJSON(in *llmrouterv1.ChatCompletionRequest, stream bool) ([]byte, error) {
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	// protojson encodes 64-bit integers as strings
+	if in.Seed != nil {
+		fields["seed"] = json.RawMessage(strconv.FormatInt(in.GetSeed(), 10))
+	}
+	if messages, exists := fields["messages"]; exists {
+		var decoded []map[string]json.RawMessage
+		if err := json.Unmarshal(messages, &decoded); err != nil {
+			return nil, err
+		}
+		// The content of multimodal messages is a list of parts rather than text
+		for _, message := range decoded {
+			if parts, exists := message["content_parts"]; exists {
+				message["content"] = parts
+				delete(message, "content_parts")
+			}
+		}
+		if fields["messages"], err = json.Marshal(decoded); err != nil {
+			return nil, err
+		}
+	}
+	if extra, exists := fields["extra_body"]; exists {
+		delete(fields, "extra_body")
+		var extraFields map[string]json.RawMessage
+		if err := json.Unmarshal(extra, &extraFields); err != nil {
+			return nil, err
+		}
+		for name, value := range extraFields {
+			if _, defined := fields[name]; !defined {
+				fields[name] = value
+			}
+		}
+	}
+	if stream {
+		fields["stream"] = json.RawMessage("true")
+	} else {
+		delete(fields, "stream")
+	}
+	return json.Marshal(fields)
+}
+
+// fromJSON decodes a chat completion or chunk of the HTTP API into its gRPC message, dropping the fields the
+// message does not define
+func fromJSON(data []byte, out proto.Message) error {
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, out)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"llm-router/client"
+	llmrouterv1 "llm-router/proto"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestGRPCChatCompletions(t *testing.T) {
+	chunks := []string{
+		`{"id":"c1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}`,
+		`{"id":"c1","object":"chat.completion.chunk","model":"gpt-4","choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}],"usage":null}`,
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	config := openai.DefaultConfig("upstream-key")
+	config.BaseURL = upstream.URL + "/v1"
+	kc := client.NewKeyClient("upstream-key", openai.NewClientWithConfig(config), 0, 0)
+
+	var streamed bool
+	s := &Server{
+		APIKey: "router-key",
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		handleRequest: func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionResponse, error) {
+			return &client.ChatCompletionResponse{ChatCompletionResponse: openai.ChatCompletionResponse{
+				ID:      "c1",
+				Model:   req.Model,
+				Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Role: "assistant", Content: "Hello"}, FinishReason: openai.FinishReasonStop}},
+				Usage:   openai.Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5},
+			}}, nil
+		},
+		handleStreamRequest: func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionStream, error) {
+			streamed = req.Stream
+			return kc.ChatCompletionStream(ctx, req)
+		},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeGRPC(listener)
+	defer s.Shutdown(context.Background())
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	chat := llmrouterv1.NewChatCompletionsClient(conn)
+	authorized := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer router-key")
+	req := &llmrouterv1.ChatCompletionRequest{Model: "group", Messages: []*llmrouterv1.ChatMessage{{Role: "user", Content: proto.String("hi")}}}
+
+	t.Run("Unary", func(t *testing.T) {
+		resp, err := chat.Create(authorized, req)
+		if err != nil {
+			t.Fatalf("Expected a chat completion, got %v", err)
+		}
+		if resp.Model != "group" || len(resp.Choices) != 1 || resp.Choices[0].Message.GetContent() != "Hello" ||
+			resp.Choices[0].FinishReason != "stop" || resp.Usage.GetTotalTokens() != 5 {
+			t.Errorf("Unexpected chat completion %v", resp)
+		}
+	})
+
+	t.Run("Streaming", func(t *testing.T) {
+		stream, err := chat.CreateStream(authorized, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var content, finishReason string
+		var received int
+		for {
+			chunk, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Stream failed: %v", err)
+			}
+			received++
+			content += chunk.Choices[0].Delta.GetContent()
+			if chunk.Choices[0].FinishReason != "" {
+				finishReason = chunk.Choices[0].FinishReason
+			}
+		}
+		if !streamed {
+			t.Errorf("Expected the request to be streamed")
+		}
+		if received != len(chunks) || content != "Hello" || finishReason != "stop" {
+			t.Errorf("Expected %d chunks of Hello, got %d of %q ending with %q", len(chunks), received, content, finishReason)
+		}
+	})
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		wrongKey := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer wrong-key")
+		if _, err := chat.Create(wrongKey, req); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("Expected the call to be unauthenticated, got %v", err)
+		}
+	})
+}
+
+func TestGRPCRequestJSON(t *testing.T) {
+	extra, _ := structpb.NewStruct(map[string]any{"top_k": 40, "model": "other"})
+	body, err := requestJSON(&llmrouterv1.ChatCompletionRequest{
+		Model: "group",
+		Messages: []*llmrouterv1.ChatMessage{
+			{Role: "system", Content: proto.String("Be brief")},
+			{Role: "user", ContentParts: []*llmrouterv1.ContentPart{
+				{Type: "text", Text: "Describe"},
+				{Type: "image_url", ImageUrl: &llmrouterv1.ImageURL{Url: "data:image/png;base64,AAAA"}},
+			}},
+		},
+		Temperature: proto.Float64(0),
+		Seed:        proto.Int64(1 << 40),
+		ExtraBody:   extra,
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	json.Unmarshal(body, &got)
+	want := map[string]any{
+		"model": "group",
+		"messages": []any{
+			map[string]any{"role": "system", "content": "Be brief"},
+			map[string]any{"role": "user", "content": []any{
+				map[string]any{"type": "text", "text": "Describe"},
+				map[string]any{"type": "image_url", "image_url": map[string]any{"url": "data:image/png;base64,AAAA"}},
+			}},
+		},
+		"temperature": 0.0,
+		"seed":        float64(1 << 40),
+		"top_k":       40.0,
+		"stream":      true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected request body %s", body)
+	}
+}
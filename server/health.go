@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// DeepHealth reports the health of the router's upstreams
+type DeepHealth struct {
+	// Status is "ok" when every group has a healthy upstream, "unhealthy" otherwise
+	Status    string           `json:"status"`
+	Groups    []GroupHealth    `json:"groups"`
+	Providers []ProviderHealth `json:"providers"`
+}
+
+// GroupHealth reports whether a group has at least one model with a healthy key
+type GroupHealth struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+}
+
+// ProviderHealth reports the reachability of a provider and the validity of its keys
+type ProviderHealth struct {
+	Name      string      `json:"name"`
+	Reachable bool        `json:"reachable"`
+	Keys      []KeyHealth `json:"keys"`
+}
+
+// KeyHealth reports the latest probe of a provider key, identified by its index
+type KeyHealth struct {
+	Index      int       `json:"index"`
+	Reachable  bool      `json:"reachable"`
+	Valid      bool      `json:"valid"`
+	Drained    bool      `json:"drained,omitempty"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ProbedAt   time.Time `json:"probed_at"`
+}
+
+// Health statuses reported by the deep health check
+const (
+	HealthStatusOK        = "ok"
+	HealthStatusUnhealthy = "unhealthy"
+)
+
+// HandleHealthzRequest returns an http.HandlerFunc serving /healthz. With ?deep=1 the upstreams are checked
+// and 503 is returned when a group has no healthy upstream, so load balancers can eject the instance.
+func (s *Server) HandleHealthzRequest(deepHealth func(ctx context.Context) DeepHealth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deep := r.URL.Query().Get("deep")
+		if deepHealth == nil || (deep != "1" && deep != "true") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("OK"))
+			return
+		}
+
+		health := deepHealth(r.Context())
+		status := http.StatusOK
+		if health.Status != HealthStatusOK {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, health)
+	}
+}
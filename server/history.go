@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"llm-router/ledger"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultHistoryRange is the range of usage history returned when from is not specified
+	defaultHistoryRange = 24 * time.Hour
+	// maxHistoryBuckets limits the number of buckets of a usage history query
+	maxHistoryBuckets = 1000
+)
+
+// HistoryBucket is the usage within a time bucket of the usage history
+type HistoryBucket struct {
+	StartTime int64           `json:"start_time"`
+	EndTime   int64           `json:"end_time"`
+	Results   []HistoryResult `json:"results"`
+}
+
+// HistoryResult is the usage of a model served with a provider key within a HistoryBucket
+type HistoryResult struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	// KeyID identifies the provider key as "provider/hash"
+	KeyID            string  `json:"api_key_id"`
+	Requests         int64   `json:"requests"`
+	Errors           int64   `json:"errors"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// parseHistoryTime parses a time given as RFC 3339 or Unix seconds
+func parseHistoryTime(v string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// parseHistoryBucket parses a bucket width such as 5m, 1h, or 1d
+func parseHistoryBucket(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid bucket: %s", v)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	bucket, err := time.ParseDuration(v)
+	if err != nil || bucket < time.Minute || bucket%time.Minute != 0 {
+		return 0, fmt.Errorf("invalid bucket: %s, must be whole minutes, hours, or days", v)
+	}
+	return bucket, nil
+}
+
+// parseHistoryQuery returns the buckets and range of a usage history query. The range defaults to the last
+// 24 hours and is aligned to the buckets, which are aligned to the Unix epoch (UTC).
+func parseHistoryQuery(r *http.Request) (bucket time.Duration, start, end time.Time, err error) {
+	query := r.URL.Query()
+	bucket = time.Hour
+	if v := query.Get("bucket"); v != "" {
+		if bucket, err = parseHistoryBucket(v); err != nil {
+			return 0, start, end, err
+		}
+	}
+	end = time.Now()
+	if v := query.Get("to"); v != "" {
+		if end, err = parseHistoryTime(v); err != nil {
+			return 0, start, end, fmt.Errorf("invalid to: %s", v)
+		}
+	}
+	start = end.Add(-defaultHistoryRange)
+	if v := query.Get("from"); v != "" {
+		if start, err = parseHistoryTime(v); err != nil {
+			return 0, start, end, fmt.Errorf("invalid from: %s", v)
+		}
+	}
+
+	start = start.UTC().Truncate(bucket)
+	if aligned := end.UTC().Truncate(bucket); !aligned.Equal(end) {
+		end = aligned.Add(bucket)
+	}
+	if !start.Before(end) {
+		return 0, start, end, fmt.Errorf("from must be before to")
+	}
+	if end.Sub(start)/bucket > maxHistoryBuckets {
+		return 0, start, end, fmt.Errorf("range must not exceed %d buckets", maxHistoryBuckets)
+	}
+	return bucket, start, end, nil
+}
+
+// usageHistory places the usage summed per bucket, provider, model, and key in every bucket of the range, empty
+// ones included. The results of a bucket keep the order of the usage, by provider, model, and key.
+func usageHistory(usage []ledger.Usage, bucket time.Duration, start, end time.Time) []HistoryBucket {
+	buckets := make([]HistoryBucket, end.Sub(start)/bucket)
+	for i := range buckets {
+		bucketStart := start.Add(time.Duration(i) * bucket)
+		buckets[i] = HistoryBucket{StartTime: bucketStart.Unix(), EndTime: bucketStart.Add(bucket).Unix(), Results: make([]HistoryResult, 0)}
+	}
+	for _, u := range usage {
+		if u.Bucket < 0 || u.Bucket >= len(buckets) {
+			continue
+		}
+		buckets[u.Bucket].Results = append(buckets[u.Bucket].Results, HistoryResult{
+			Provider:         u.Provider,
+			Model:            u.Model,
+			KeyID:            u.KeyID,
+			Requests:         u.Requests,
+			Errors:           u.Errors,
+			PromptTokens:     u.PromptTokens,
+			CompletionTokens: u.CompletionTokens,
+			TotalTokens:      u.TotalTokens,
+			Cost:             u.Cost,
+		})
+	}
+	return buckets
+}
+
+// handleAdminUsageHistory serves the usage recorded in the request ledger as a time series per provider, model,
+// and key, for building dashboards. Requests can be filtered by client_key and group.
+func (s *Server) handleAdminUsageHistory(history func(filter ledger.Filter, bucket time.Duration) ([]ledger.Usage, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket, start, end, err := parseHistoryQuery(r)
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+			return
+		}
+		query := r.URL.Query()
+		width := query.Get("bucket")
+		if width == "" {
+			width = "1h"
+		}
+		usage, err := history(ledger.Filter{Start: start, End: end, ClientKey: query.Get("client_key"), Group: query.Get("group")}, bucket)
+		if err != nil {
+			s.Logger.Error("Failed to read request ledger", slog.Any("error", err))
+			writeOpenAIError(w, http.StatusInternalServerError, "server_error", "", "failed to read request ledger")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"object": "list",
+			"bucket": width,
+			"data":   usageHistory(usage, bucket, start, end),
+		})
+	}
+}
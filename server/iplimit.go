@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientIPLimits counts the requests of each client IP in the current minute (UTC) against ClientIPRPM, in
+// memory or in the shared quota counters
+type clientIPLimits struct {
+	mutex    sync.Mutex
+	minute   time.Time
+	requests map[string]int64
+	now      func() time.Time
+}
+
+func (l *clientIPLimits) clock() time.Time {
+	if l.now == nil {
+		return time.Now()
+	}
+	return l.now()
+}
+
+// admit counts a request of a client IP unless it made limit requests in the current minute already, and
+// returns when the minute ends. When the shared counter fails, the limit is enforced per instance.
+func (l *clientIPLimits) admit(ip string, limit int64, counters QuotaCounters) (bool, time.Duration) {
+	now := l.clock().UTC()
+	minute := now.Truncate(time.Minute)
+	reset := minute.Add(time.Minute).Sub(now)
+	if counters != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		key := "quota_ip:" + ip + ":requests:" + strconv.FormatInt(minute.Unix(), 10)
+		if _, admitted, err := counters.Admit(ctx, []QuotaWindow{{Key: key, Limit: limit, Delta: 1, TTL: time.Minute}}); err == nil {
+			return admitted, reset
+		}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	// The counters of ended minutes are dropped at once, so that the addresses seen do not pile up
+	if !minute.Equal(l.minute) || l.requests == nil {
+		l.minute = minute
+		l.requests = make(map[string]int64)
+	}
+	if l.requests[ip] >= limit {
+		return false, reset
+	}
+	l.requests[ip]++
+	return true, reset
+}
+
+// limitClientIP rejects the requests of client IPs over ClientIPRPM with status 429, before they are
+// authenticated, so that a single client cannot flood the router whatever keys it holds. Health checks and
+// clients without an IP address, on Unix sockets, are not limited.
+func (s *Server) limitClientIP(next http.Handler) http.Handler {
+	if s.ClientIPRPM <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIPFromContext(r.Context())
+		if _, err := netip.ParseAddr(ip); err != nil || r.URL.Path == "/health" || r.URL.Path == "/healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		admitted, reset := s.ipLimits.admit(ip, s.ClientIPRPM, s.quotas.counters)
+		if admitted {
+			next.ServeHTTP(w, r)
+			return
+		}
+		err := fmt.Errorf("%w: %d requests per minute of client IP %s", ErrQuotaExceeded, s.ClientIPRPM, ip)
+		s.Logger.Warn("Client IP rate limit exceeded", slog.String("client_ip", ip), slog.String("path", r.URL.Path))
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(reset.Seconds())), 10))
+		if strings.HasPrefix(r.URL.Path, "/v1/messages") {
+			writeAnthropicError(w, http.StatusTooManyRequests, "rate_limit_error", err.Error())
+			return
+		}
+		writeOpenAIError(w, http.StatusTooManyRequests, "rate_limit_exceeded", "rate_limit_exceeded", err.Error())
+	})
+}
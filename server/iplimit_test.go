@@ -0,0 +1,82 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientIPRateLimit(t *testing.T) {
+	s := &Server{
+		ClientIPRPM:    2,
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	clock := time.Date(2025, 3, 1, 12, 0, 45, 0, time.UTC)
+	s.ipLimits.now = func() time.Time { return clock }
+	handler := s.clientIP(s.limitClientIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	do := func(path string, remoteAddr string, forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set(HeaderForwardedFor, forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Clients behind the same proxy are limited separately
+	for range 2 {
+		if w := do("/v1/chat/completions", "10.0.0.1:4711", "198.51.100.1"); w.Code != http.StatusOK {
+			t.Fatalf("Expected the requests within the limit to be served, got %d", w.Code)
+		}
+	}
+	w := do("/v1/chat/completions", "10.0.0.1:4711", "198.51.100.1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "15" || !strings.Contains(w.Body.String(), "rate_limit_exceeded") {
+		t.Errorf("Expected status 429 retrying after the minute, got %d %q %s", w.Code, w.Header().Get("Retry-After"), w.Body)
+	}
+	if w := do("/v1/messages", "10.0.0.1:4711", "198.51.100.1"); w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "rate_limit_error") {
+		t.Errorf("Expected an Anthropic error on /v1/messages, got %d %s", w.Code, w.Body)
+	}
+	if w := do("/v1/chat/completions", "10.0.0.1:4711", "198.51.100.2"); w.Code != http.StatusOK {
+		t.Errorf("Expected another client behind the proxy to be served, got %d", w.Code)
+	}
+	// A forwarded address is ignored from untrusted peers
+	for range 2 {
+		do("/v1/chat/completions", "203.0.113.7:4711", "198.51.100.3")
+	}
+	if w := do("/v1/chat/completions", "203.0.113.7:4711", "198.51.100.4"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the untrusted peer to be limited whatever it forwards, got %d", w.Code)
+	}
+	if w := do("/healthz", "10.0.0.1:4711", "198.51.100.1"); w.Code != http.StatusOK {
+		t.Errorf("Expected health checks not to be limited, got %d", w.Code)
+	}
+	clock = clock.Add(15 * time.Second)
+	if w := do("/v1/chat/completions", "10.0.0.1:4711", "198.51.100.1"); w.Code != http.StatusOK {
+		t.Errorf("Expected the limit to reset after the minute, got %d", w.Code)
+	}
+
+	// Instances sharing the counters limit a client IP together
+	counters := &memoryQuotaCounters{counters: make(map[string]int64)}
+	s1, s2 := &Server{ClientIPRPM: 2, Logger: s.Logger}, &Server{ClientIPRPM: 2, Logger: s.Logger}
+	s1.ipLimits.now, s2.ipLimits.now = s.ipLimits.now, s.ipLimits.now
+	s1.SetQuotaCounters(counters)
+	s2.SetQuotaCounters(counters)
+	codes := make([]int, 0, 3)
+	for _, server := range []*Server{s1, s2, s1} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		req.RemoteAddr = "198.51.100.1:4711"
+		server.clientIP(server.limitClientIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))).ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("Expected the third request across the instances to be limited, got %v", codes)
+	}
+}
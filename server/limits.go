@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"llm-router/client"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// limitBody rejects requests whose body is larger than the maximum body size with a 413 error, at once when
+// they declare their length and otherwise when the handler reads past the limit
+func (s *Server) limitBody(next http.HandlerFunc) http.HandlerFunc {
+	return limitBodySize(s.MaxBodySize, next)
+}
+
+// limitUpload rejects requests whose body is larger than the maximum upload size like limitBody, for the
+// files uploaded to the Files API, which are larger than requests
+func (s *Server) limitUpload(next http.HandlerFunc) http.HandlerFunc {
+	return limitBodySize(s.MaxUploadSize, next)
+}
+
+// limitBodySize rejects requests whose body is larger than limit, unless it is 0
+func limitBodySize(limit int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limit > 0 && r.Body != nil {
+			if r.ContentLength > limit {
+				writeBodyTooLarge(w, limit)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next(w, r)
+	}
+}
+
+// writeBodyTooLarge writes the 413 error of a request body larger than limit
+func writeBodyTooLarge(w http.ResponseWriter, limit int64) {
+	writeOpenAIError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", "request_too_large",
+		"request body is larger than the maximum of "+strconv.FormatInt(limit, 10)+" bytes")
+}
+
+// writeBodyError writes a 413 error if reading a request body failed on the maximum body size, reporting
+// whether it did
+func writeBodyError(w http.ResponseWriter, err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) {
+		return false
+	}
+	writeBodyTooLarge(w, maxBytesErr.Limit)
+	return true
+}
+
+// ProxyError is the error handler of the proxies of the passthrough endpoints, answering requests whose body
+// is larger than the limit with a 413 error and those the provider could not be reached for with a 502 error
+func ProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if writeBodyError(w, err) {
+		return
+	}
+	writeOpenAIError(w, http.StatusBadGateway, "api_error", "", "error reaching the provider: "+err.Error())
+}
+
+// isTimeout reports whether a request failed on the request timeout, the stream idle timeout, or a
+// provider not responding in time
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, client.ErrStreamIdle) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPassthroughBodyLimits(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorHandler = ProxyError
+
+	s := &Server{MaxBodySize: 64, MaxUploadSize: 256, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	do := func(handler http.HandlerFunc, body string, chunked bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/files", strings.NewReader(body))
+		if chunked {
+			req.ContentLength = -1
+		}
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	upload := strings.Repeat("a", 128)
+	if w := do(s.limitUpload(proxy.ServeHTTP), upload, true); w.Code != http.StatusOK {
+		t.Errorf("Expected an upload under the upload limit to be proxied, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, chunked := range []bool{false, true} {
+		if w := do(s.limitUpload(proxy.ServeHTTP), upload+upload+upload, chunked); w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "request_too_large") {
+			t.Errorf("Expected status 413 for an upload over the limit (chunked: %t), got %d: %s", chunked, w.Code, w.Body.String())
+		}
+		if w := do(s.limitBody(proxy.ServeHTTP), upload, chunked); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413 for a body over the limit (chunked: %t), got %d: %s", chunked, w.Code, w.Body.String())
+		}
+	}
+
+	assistants := s.limitBody(s.HandleAssistantsRequest(map[string]AssistantsTarget{"fast": {Proxy: proxy}}).ServeHTTP)
+	if w := do(assistants, `{"model":"fast","instructions":"`+upload+`"}`, true); w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "request_too_large") {
+		t.Errorf("Expected status 413 for an Assistants API body over the limit, got %d: %s", w.Code, w.Body.String())
+	}
+
+	upstream.Close()
+	if w := do(s.limitUpload(proxy.ServeHTTP), upload, false); w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "api_error") {
+		t.Errorf("Expected status 502 when the provider cannot be reached, got %d: %s", w.Code, w.Body.String())
+	}
+}
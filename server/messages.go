@@ -0,0 +1,599 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"llm-router/usage"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// anthropicMessagesRequest is the request body accepted by the Anthropic-compatible /v1/messages endpoint
+type anthropicMessagesRequest struct {
+	Model         string               `json:"model"`
+	Messages      []anthropicMessage   `json:"messages"`
+	System        anthropicContent     `json:"system,omitempty"`
+	MaxTokens     int                  `json:"max_tokens"`
+	Temperature   *float32             `json:"temperature,omitempty"`
+	TopP          *float32             `json:"top_p,omitempty"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Stream        bool                 `json:"stream,omitempty"`
+	Tools         []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *anthropicToolChoice `json:"tool_choice,omitempty"`
+	Metadata      *anthropicMetadata   `json:"metadata,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content anthropicContent `json:"content"`
+}
+
+// anthropicContent is a list of content blocks; a plain string is accepted as a single text block
+type anthropicContent []anthropicContentBlock
+
+func (c *anthropicContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = anthropicContent{{Type: "text", Text: text}}
+		return nil
+	}
+	var blocks []anthropicContentBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+	*c = blocks
+	return nil
+}
+
+// text joins all text blocks of the content
+func (c anthropicContent) text() string {
+	var parts []string
+	for _, block := range c {
+		if block.Type == "text" {
+			parts = append(parts, block.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+type anthropicContentBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+
+	// image
+	Source *anthropicImageSource `json:"source,omitempty"`
+
+	// tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// tool_result
+	ToolUseID string           `json:"tool_use_id,omitempty"`
+	Content   anthropicContent `json:"content,omitempty"`
+	IsError   bool             `json:"is_error,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type anthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type anthropicMetadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+// anthropicMessagesResponse is the non-streaming response body of /v1/messages
+type anthropicMessagesResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []anthropicContentBlock `json:"content"`
+	StopReason   *string                 `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        anthropicUsage          `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens          int `json:"input_tokens"`
+	OutputTokens         int `json:"output_tokens"`
+	CacheReadInputTokens int `json:"cache_read_input_tokens,omitempty"`
+}
+
+// HandleMessagesRequest serves the Anthropic-compatible /v1/messages endpoint by translating
+// requests onto the OpenAI chat completions handlers and translating the responses back
+func (s *Server) HandleMessagesRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAnthropicError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method not allowed")
+		return
+	}
+
+	// Anthropic SDKs send the key in x-api-key, while bearer tokens are used with ANTHROPIC_AUTH_TOKEN
+	key := r.Header.Get("x-api-key")
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	ctx, err := s.authorize(r.Context(), key)
+	setRateLimitHeaders(w, ctx)
+	if errors.Is(err, ErrQuotaExceeded) {
+		writeAnthropicError(w, http.StatusTooManyRequests, "rate_limit_error", err.Error())
+		return
+	}
+	if err != nil {
+		s.Logger.Warn("Invalid or missing API key", slog.String("path", r.URL.Path))
+		writeAnthropicError(w, http.StatusUnauthorized, "authentication_error", "invalid x-api-key")
+		return
+	}
+	r = r.WithContext(withRouteExplanation(s.withEndUser(ctx, r), r))
+
+	body, err := io.ReadAll(r.Body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeAnthropicError(w, http.StatusRequestEntityTooLarge, "request_too_large", fmt.Sprintf("request body is larger than the maximum of %d bytes", maxBytesErr.Limit))
+		return
+	}
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "error reading request body")
+		return
+	}
+	var msgReq anthropicMessagesRequest
+	if err := json.Unmarshal(body, &msgReq); err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "error parsing request: "+err.Error())
+		return
+	}
+	if msgReq.Model == "" {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "model: field required")
+		return
+	}
+
+	req := anthropicToOpenAI(msgReq)
+
+	if msgReq.Stream {
+		s.Logger.Info("Incoming streaming messages request for model(group)", slog.String("model", msgReq.Model))
+
+		stream, err := s.handleStreamRequest(r.Context(), req)
+		s.setBudgetHeaders(w, r.Context())
+		if errors.Is(err, ErrGroupNotAllowed) {
+			writeAnthropicError(w, http.StatusNotFound, "not_found_error", err.Error())
+			return
+		}
+		if errors.Is(err, usage.ErrSpendCapExceeded) {
+			writeAnthropicError(w, http.StatusPaymentRequired, "billing_error", err.Error())
+			return
+		}
+		if errors.Is(err, usage.ErrBudgetExceeded) {
+			writeAnthropicError(w, http.StatusTooManyRequests, "rate_limit_error", err.Error())
+			return
+		}
+		if errors.Is(err, ErrRequestTooExpensive) {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		if isTimeout(err) {
+			writeAnthropicError(w, http.StatusGatewayTimeout, "timeout_error", err.Error())
+			return
+		}
+		if err != nil {
+			writeAnthropicError(w, http.StatusInternalServerError, "api_error", "error handling streaming request: "+err.Error())
+			return
+		}
+		defer stream.Close()
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeAnthropicError(w, http.StatusInternalServerError, "api_error", "streaming unsupported")
+			return
+		}
+
+		clearWriteDeadline(w)
+		setRouteHeaders(w, stream.Route)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		if err := writeAnthropicStream(w, flusher, stream.Recv); err != nil {
+			s.Logger.Error("Error relaying messages stream", slog.String("error", err.Error()))
+			return
+		}
+		setCostTrailer(w, stream.Cost())
+		return
+	}
+
+	s.Logger.Info("Incoming messages request for model(group)", slog.String("model", msgReq.Model))
+
+	response, err := s.handleRequest(r.Context(), req)
+	s.setBudgetHeaders(w, r.Context())
+	if errors.Is(err, ErrGroupNotAllowed) {
+		writeAnthropicError(w, http.StatusNotFound, "not_found_error", err.Error())
+		return
+	}
+	if errors.Is(err, usage.ErrSpendCapExceeded) {
+		writeAnthropicError(w, http.StatusPaymentRequired, "billing_error", err.Error())
+		return
+	}
+	if errors.Is(err, usage.ErrBudgetExceeded) {
+		writeAnthropicError(w, http.StatusTooManyRequests, "rate_limit_error", err.Error())
+		return
+	}
+	if errors.Is(err, ErrRequestTooExpensive) {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	if isTimeout(err) {
+		writeAnthropicError(w, http.StatusGatewayTimeout, "timeout_error", err.Error())
+		return
+	}
+	if err != nil {
+		writeAnthropicError(w, http.StatusInternalServerError, "api_error", "error handling request: "+err.Error())
+		return
+	}
+
+	jsonData, err := json.Marshal(openAIToAnthropic(response.ChatCompletionResponse))
+	if err != nil {
+		writeAnthropicError(w, http.StatusInternalServerError, "api_error", "error marshaling response")
+		return
+	}
+	setRouteHeaders(w, response.Route)
+	setCostHeader(w, response.Cost)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// anthropicToOpenAI converts an Anthropic messages request into an OpenAI chat completion request
+func anthropicToOpenAI(msgReq anthropicMessagesRequest) openai.ChatCompletionRequest {
+	req := openai.ChatCompletionRequest{
+		Model:     msgReq.Model,
+		MaxTokens: msgReq.MaxTokens,
+		Stop:      msgReq.StopSequences,
+		Stream:    msgReq.Stream,
+	}
+	if msgReq.Temperature != nil {
+		req.Temperature = *msgReq.Temperature
+	}
+	if msgReq.TopP != nil {
+		req.TopP = *msgReq.TopP
+	}
+	if msgReq.Metadata != nil {
+		req.User = msgReq.Metadata.UserID
+	}
+
+	if system := msgReq.System.text(); system != "" {
+		req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: system,
+		})
+	}
+	for _, m := range msgReq.Messages {
+		req.Messages = append(req.Messages, anthropicMessageToOpenAI(m)...)
+	}
+
+	for _, t := range msgReq.Tools {
+		req.Tools = append(req.Tools, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.InputSchema,
+			},
+		})
+	}
+	if msgReq.ToolChoice != nil {
+		switch msgReq.ToolChoice.Type {
+		case "auto", "none":
+			req.ToolChoice = msgReq.ToolChoice.Type
+		case "any":
+			req.ToolChoice = "required"
+		case "tool":
+			req.ToolChoice = openai.ToolChoice{
+				Type:     openai.ToolTypeFunction,
+				Function: openai.ToolFunction{Name: msgReq.ToolChoice.Name},
+			}
+		}
+	}
+	return req
+}
+
+// anthropicMessageToOpenAI converts one Anthropic message into one or more OpenAI messages.
+// Tool results become separate tool messages, which must directly follow the assistant tool calls.
+func anthropicMessageToOpenAI(m anthropicMessage) []openai.ChatCompletionMessage {
+	var messages []openai.ChatCompletionMessage
+
+	if m.Role == "assistant" {
+		msg := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+		var text []string
+		for _, block := range m.Content {
+			switch block.Type {
+			case "text":
+				text = append(text, block.Text)
+			case "tool_use":
+				args := string(block.Input)
+				if args == "" {
+					args = "{}"
+				}
+				msg.ToolCalls = append(msg.ToolCalls, openai.ToolCall{
+					ID:       block.ID,
+					Type:     openai.ToolTypeFunction,
+					Function: openai.FunctionCall{Name: block.Name, Arguments: args},
+				})
+			}
+		}
+		msg.Content = strings.Join(text, "\n")
+		return append(messages, msg)
+	}
+
+	var parts []openai.ChatMessagePart
+	for _, block := range m.Content {
+		switch block.Type {
+		case "text":
+			parts = append(parts, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeText, Text: block.Text})
+		case "image":
+			if block.Source == nil {
+				continue
+			}
+			url := block.Source.URL
+			if block.Source.Type == "base64" {
+				url = fmt.Sprintf("data:%s;base64,%s", block.Source.MediaType, block.Source.Data)
+			}
+			parts = append(parts, openai.ChatMessagePart{
+				Type:     openai.ChatMessagePartTypeImageURL,
+				ImageURL: &openai.ChatMessageImageURL{URL: url},
+			})
+		case "tool_result":
+			content := block.Content.text()
+			if block.IsError {
+				content = "Error: " + content
+			}
+			messages = append(messages, openai.ChatCompletionMessage{
+				Role:       openai.ChatMessageRoleTool,
+				Content:    content,
+				ToolCallID: block.ToolUseID,
+			})
+		}
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0].Type == openai.ChatMessagePartTypeText:
+		messages = append(messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: parts[0].Text})
+	case len(parts) > 0:
+		messages = append(messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, MultiContent: parts})
+	}
+	return messages
+}
+
+// openAIToAnthropic converts an OpenAI chat completion response into an Anthropic messages response
+func openAIToAnthropic(resp openai.ChatCompletionResponse) anthropicMessagesResponse {
+	msgResp := anthropicMessagesResponse{
+		ID:      resp.ID,
+		Type:    "message",
+		Role:    "assistant",
+		Model:   resp.Model,
+		Content: make([]anthropicContentBlock, 0),
+		Usage:   anthropicUsageFromOpenAI(&resp.Usage),
+	}
+	if len(resp.Choices) == 0 {
+		return msgResp
+	}
+
+	choice := resp.Choices[0]
+	if choice.Message.Content != "" {
+		msgResp.Content = append(msgResp.Content, anthropicContentBlock{Type: "text", Text: choice.Message.Content})
+	}
+	for _, call := range choice.Message.ToolCalls {
+		msgResp.Content = append(msgResp.Content, anthropicContentBlock{
+			Type:  "tool_use",
+			ID:    call.ID,
+			Name:  call.Function.Name,
+			Input: toolInput(call.Function.Arguments),
+		})
+	}
+	stopReason := anthropicStopReason(choice.FinishReason)
+	msgResp.StopReason = &stopReason
+	return msgResp
+}
+
+// anthropicUsageFromOpenAI maps OpenAI usage, where cached tokens are part of the prompt tokens,
+// onto Anthropic usage, where cache reads are reported separately from input tokens
+func anthropicUsageFromOpenAI(usage *openai.Usage) anthropicUsage {
+	if usage == nil {
+		return anthropicUsage{}
+	}
+	u := anthropicUsage{
+		InputTokens:  usage.PromptTokens,
+		OutputTokens: usage.CompletionTokens,
+	}
+	if usage.PromptTokensDetails != nil {
+		u.CacheReadInputTokens = usage.PromptTokensDetails.CachedTokens
+		u.InputTokens -= usage.PromptTokensDetails.CachedTokens
+	}
+	return u
+}
+
+// anthropicStopReason maps an OpenAI finish reason onto an Anthropic stop reason
+func anthropicStopReason(reason openai.FinishReason) string {
+	switch reason {
+	case openai.FinishReasonLength:
+		return "max_tokens"
+	case openai.FinishReasonToolCalls, openai.FinishReasonFunctionCall:
+		return "tool_use"
+	case openai.FinishReasonContentFilter:
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+// toolInput returns the tool call arguments as a JSON object, falling back to an empty object
+func toolInput(arguments string) json.RawMessage {
+	if arguments == "" || !json.Valid([]byte(arguments)) {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
+}
+
+// writeAnthropicStream relays OpenAI stream chunks as Anthropic server-sent events
+func writeAnthropicStream(w io.Writer, flusher http.Flusher, recv func() (openai.ChatCompletionStreamResponse, error)) error {
+	send := func(event string, data any) error {
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, jsonData)
+		flusher.Flush()
+		return nil
+	}
+
+	started := false
+	blockIndex := -1
+	blockType := ""
+	toolIndex := -1
+	stopReason := "end_turn"
+	var usage anthropicUsage
+
+	start := func(id string, model string) error {
+		started = true
+		return send("message_start", map[string]any{
+			"type": "message_start",
+			"message": anthropicMessagesResponse{
+				ID:      id,
+				Type:    "message",
+				Role:    "assistant",
+				Model:   model,
+				Content: make([]anthropicContentBlock, 0),
+			},
+		})
+	}
+	closeBlock := func() error {
+		if blockType == "" {
+			return nil
+		}
+		blockType = ""
+		return send("content_block_stop", map[string]any{"type": "content_block_stop", "index": blockIndex})
+	}
+	// Blocks are sent as maps so that empty text and input fields are still present
+	openBlock := func(block map[string]any) error {
+		if err := closeBlock(); err != nil {
+			return err
+		}
+		blockIndex++
+		blockType = block["type"].(string)
+		return send("content_block_start", map[string]any{"type": "content_block_start", "index": blockIndex, "content_block": block})
+	}
+
+	for {
+		chunk, err := recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			send("error", map[string]any{
+				"type":  "error",
+				"error": map[string]string{"type": "api_error", "message": err.Error()},
+			})
+			return err
+		}
+
+		if !started {
+			if err := start(chunk.ID, chunk.Model); err != nil {
+				return err
+			}
+		}
+
+		if chunk.Usage != nil {
+			usage = anthropicUsageFromOpenAI(chunk.Usage)
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+
+		choice := chunk.Choices[0]
+		if choice.Delta.Content != "" {
+			if blockType != "text" {
+				if err := openBlock(map[string]any{"type": "text", "text": ""}); err != nil {
+					return err
+				}
+			}
+			if err := send("content_block_delta", map[string]any{
+				"type":  "content_block_delta",
+				"index": blockIndex,
+				"delta": map[string]string{"type": "text_delta", "text": choice.Delta.Content},
+			}); err != nil {
+				return err
+			}
+		}
+		for _, call := range choice.Delta.ToolCalls {
+			index := toolIndex
+			if call.Index != nil {
+				index = *call.Index
+			}
+			if blockType != "tool_use" || index != toolIndex || call.ID != "" {
+				toolIndex = index
+				if err := openBlock(map[string]any{
+					"type":  "tool_use",
+					"id":    call.ID,
+					"name":  call.Function.Name,
+					"input": map[string]any{},
+				}); err != nil {
+					return err
+				}
+			}
+			if call.Function.Arguments != "" {
+				if err := send("content_block_delta", map[string]any{
+					"type":  "content_block_delta",
+					"index": blockIndex,
+					"delta": map[string]string{"type": "input_json_delta", "partial_json": call.Function.Arguments},
+				}); err != nil {
+					return err
+				}
+			}
+		}
+		if choice.FinishReason != "" {
+			stopReason = anthropicStopReason(choice.FinishReason)
+		}
+	}
+
+	if !started {
+		if err := start("", ""); err != nil {
+			return err
+		}
+	}
+	if err := closeBlock(); err != nil {
+		return err
+	}
+	if err := send("message_delta", map[string]any{
+		"type":  "message_delta",
+		"delta": map[string]any{"stop_reason": stopReason, "stop_sequence": nil},
+		"usage": usage,
+	}); err != nil {
+		return err
+	}
+	return send("message_stop", map[string]string{"type": "message_stop"})
+}
+
+// writeAnthropicError writes an error in the Anthropic error format
+func writeAnthropicError(w http.ResponseWriter, status int, errType string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"type":  "error",
+		"error": map[string]string{"type": errType, "message": message},
+	})
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestAnthropicToOpenAI(t *testing.T) {
+	body := `{
+		"model": "claude-group",
+		"max_tokens": 1024,
+		"system": [{"type": "text", "text": "You are helpful."}],
+		"messages": [
+			{"role": "user", "content": "What is the weather?"},
+			{"role": "assistant", "content": [
+				{"type": "text", "text": "Let me check."},
+				{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "Paris"}}
+			]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "tool_use_id": "toolu_1", "content": "Sunny"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "AAAA"}},
+				{"type": "text", "text": "And this picture?"}
+			]}
+		],
+		"tools": [{"name": "get_weather", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "any"}
+	}`
+
+	var msgReq anthropicMessagesRequest
+	if err := json.Unmarshal([]byte(body), &msgReq); err != nil {
+		t.Fatalf("Failed to unmarshal request: %v", err)
+	}
+	req := anthropicToOpenAI(msgReq)
+
+	if req.Model != "claude-group" || req.MaxTokens != 1024 {
+		t.Errorf("Expected model and max_tokens to be preserved, got %q and %d", req.Model, req.MaxTokens)
+	}
+
+	roles := make([]string, 0)
+	for _, m := range req.Messages {
+		roles = append(roles, m.Role)
+	}
+	if got := strings.Join(roles, ","); got != "system,user,assistant,tool,user" {
+		t.Fatalf("Expected roles 'system,user,assistant,tool,user', got '%s'", got)
+	}
+
+	assistant := req.Messages[2]
+	if len(assistant.ToolCalls) != 1 || assistant.ToolCalls[0].Function.Arguments != `{"city": "Paris"}` {
+		t.Errorf("Expected tool call arguments to be preserved, got %+v", assistant.ToolCalls)
+	}
+	if req.Messages[3].ToolCallID != "toolu_1" || req.Messages[3].Content != "Sunny" {
+		t.Errorf("Expected tool result to become a tool message, got %+v", req.Messages[3])
+	}
+
+	parts := req.Messages[4].MultiContent
+	if len(parts) != 2 || parts[0].ImageURL == nil || parts[0].ImageURL.URL != "data:image/png;base64,AAAA" {
+		t.Errorf("Expected image to become a data URL part, got %+v", parts)
+	}
+	if req.ToolChoice != "required" {
+		t.Errorf("Expected tool_choice 'required', got %v", req.ToolChoice)
+	}
+}
+
+func TestOpenAIToAnthropic(t *testing.T) {
+	resp := openai.ChatCompletionResponse{
+		ID:    "chatcmpl-1",
+		Model: "gpt-4",
+		Choices: []openai.ChatCompletionChoice{{
+			Message: openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleAssistant,
+				Content: "Calling a tool",
+				ToolCalls: []openai.ToolCall{{
+					ID:       "call_1",
+					Type:     openai.ToolTypeFunction,
+					Function: openai.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`},
+				}},
+			},
+			FinishReason: openai.FinishReasonToolCalls,
+		}},
+		Usage: openai.Usage{
+			PromptTokens:        100,
+			CompletionTokens:    20,
+			PromptTokensDetails: &openai.PromptTokensDetails{CachedTokens: 40},
+		},
+	}
+
+	msgResp := openAIToAnthropic(resp)
+
+	if len(msgResp.Content) != 2 || msgResp.Content[1].Type != "tool_use" || string(msgResp.Content[1].Input) != `{"city":"Paris"}` {
+		t.Errorf("Expected text and tool_use blocks, got %+v", msgResp.Content)
+	}
+	if msgResp.StopReason == nil || *msgResp.StopReason != "tool_use" {
+		t.Errorf("Expected stop_reason 'tool_use', got %v", msgResp.StopReason)
+	}
+	if msgResp.Usage.InputTokens != 60 || msgResp.Usage.CacheReadInputTokens != 40 || msgResp.Usage.OutputTokens != 20 {
+		t.Errorf("Expected usage 60/40/20, got %+v", msgResp.Usage)
+	}
+}
+
+func TestWriteAnthropicStream(t *testing.T) {
+	index := 0
+	chunks := []openai.ChatCompletionStreamResponse{
+		{ID: "chatcmpl-1", Model: "gpt-4", Choices: []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{Content: "Hel"}}}},
+		{ID: "chatcmpl-1", Model: "gpt-4", Choices: []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{Content: "lo"}}}},
+		{ID: "chatcmpl-1", Model: "gpt-4", Choices: []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{
+			ToolCalls: []openai.ToolCall{{Index: &index, ID: "call_1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "get_weather"}}},
+		}}}},
+		{ID: "chatcmpl-1", Model: "gpt-4", Choices: []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{
+			ToolCalls: []openai.ToolCall{{Index: &index, Function: openai.FunctionCall{Arguments: `{"city":`}}},
+		}}}},
+		{ID: "chatcmpl-1", Model: "gpt-4", Choices: []openai.ChatCompletionStreamChoice{{FinishReason: openai.FinishReasonToolCalls}}},
+		{ID: "chatcmpl-1", Model: "gpt-4", Choices: []openai.ChatCompletionStreamChoice{}, Usage: &openai.Usage{PromptTokens: 10, CompletionTokens: 5}},
+	}
+	recv := func() (openai.ChatCompletionStreamResponse, error) {
+		if len(chunks) == 0 {
+			return openai.ChatCompletionStreamResponse{}, io.EOF
+		}
+		chunk := chunks[0]
+		chunks = chunks[1:]
+		return chunk, nil
+	}
+
+	w := httptest.NewRecorder()
+	if err := writeAnthropicStream(w, w, recv); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	events := make([]string, 0)
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if event, ok := strings.CutPrefix(line, "event: "); ok {
+			events = append(events, event)
+		}
+	}
+	expected := []string{
+		"message_start",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"message_delta", "message_stop",
+	}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected events %v, got %v", expected, events)
+	}
+
+	output := w.Body.String()
+	if !strings.Contains(output, `"content_block":{"text":"","type":"text"}`) {
+		t.Errorf("Expected text block start with empty text, got %s", output)
+	}
+	if !strings.Contains(output, `"partial_json":"{\"city\":"`) {
+		t.Errorf("Expected input_json_delta with argument fragment, got %s", output)
+	}
+	if !strings.Contains(output, `"stop_reason":"tool_use"`) || !strings.Contains(output, `"output_tokens":5`) {
+		t.Errorf("Expected message_delta with stop reason and usage, got %s", output)
+	}
+}
@@ -1,16 +1,21 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 )
 
 // ModelInfo represents the minimal model metadata returned by the /v1/models endpoint
 type ModelInfo struct {
-	ID      string                 `json:"id"`
-	Object  string                 `json:"object"`
-	OwnedBy string                 `json:"owned_by"`
-	Extra   map[string]interface{} `json:"-"`
+	ID            string                 `json:"id"`
+	Object        string                 `json:"object"`
+	Created       int64                  `json:"created"`
+	OwnedBy       string                 `json:"owned_by"`
+	ContextWindow int64                  `json:"context_window,omitempty"`
+	Capabilities  []string               `json:"capabilities,omitempty"`
+	Extra         map[string]interface{} `json:"-"`
 }
 
 // ModelsListResponse is the JSON envelope returned for list models
@@ -20,8 +25,8 @@ type ModelsListResponse struct {
 }
 
 // HandleModelsRequest returns an http.HandlerFunc that serves the models list.
-// The provided modelsFunc should return the list of ModelInfo to expose.
-func (s *Server) HandleModelsRequest(modelsFunc func() []ModelInfo) http.HandlerFunc {
+// The provided modelsFunc should return the list of ModelInfo to expose to the caller of the request's context.
+func (s *Server) HandleModelsRequest(modelsFunc func(ctx context.Context) []ModelInfo) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Only allow GET
 		if r.Method != http.MethodGet {
@@ -30,7 +35,7 @@ func (s *Server) HandleModelsRequest(modelsFunc func() []ModelInfo) http.Handler
 		}
 
 		// Build response
-		models := modelsFunc()
+		models := modelsFunc(r.Context())
 		resp := ModelsListResponse{
 			Object: "list",
 			Data:   models,
@@ -41,3 +46,27 @@ func (s *Server) HandleModelsRequest(modelsFunc func() []ModelInfo) http.Handler
 		_ = json.NewEncoder(w).Encode(resp)
 	}
 }
+
+// HandleModelRequest returns an http.HandlerFunc that serves a single model by its ID.
+// The ID is taken from the {id} path wildcard and may itself contain slashes.
+func (s *Server) HandleModelRequest(modelsFunc func(ctx context.Context) []ModelInfo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "", "method not allowed")
+			return
+		}
+
+		id := r.PathValue("id")
+		for _, model := range modelsFunc(r.Context()) {
+			if model.ID == id {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				_ = json.NewEncoder(w).Encode(model)
+				return
+			}
+		}
+
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "model_not_found",
+			fmt.Sprintf("The model '%s' does not exist", id))
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleModelRequest(t *testing.T) {
+	s := &Server{}
+	modelsFunc := func(ctx context.Context) []ModelInfo {
+		return []ModelInfo{
+			{ID: "fast-model", Object: "model", OwnedBy: "llm-router"},
+			{ID: "openai/gpt-4o", Object: "model", OwnedBy: "llm-router", ContextWindow: 128000, Capabilities: []string{"chat", "vision"}},
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/models/{id...}", s.HandleModelRequest(modelsFunc))
+
+	t.Run("ExistingModelWithSlash", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/v1/models/openai/gpt-4o", nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		var model ModelInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &model); err != nil {
+			t.Fatalf("Failed to decode model: %v", err)
+		}
+		if model.ID != "openai/gpt-4o" || model.ContextWindow != 128000 || len(model.Capabilities) != 2 {
+			t.Errorf("Unexpected model metadata: %+v", model)
+		}
+	})
+
+	t.Run("UnknownModel", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/v1/models/missing", nil))
+
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("Expected status 404, got %d", w.Code)
+		}
+		var resp errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to decode error: %v", err)
+		}
+		if resp.Error.Code == nil || *resp.Error.Code != "model_not_found" {
+			t.Errorf("Expected code 'model_not_found', got %+v", resp.Error)
+		}
+	})
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned when a client key has used up one of its quotas
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaWindow is the counter of a client key's quota window shared by all router instances
+type QuotaWindow struct {
+	Key string
+	// Limit is the quota of the window, unchecked when 0
+	Limit int64
+	// Delta is added to the counter when a request is admitted
+	Delta int64
+	// TTL is how long the counter outlives the window's last change
+	TTL time.Duration
+}
+
+// QuotaCounters holds the client key quota counters shared by all router instances
+type QuotaCounters interface {
+	// Admit reads the counters of the windows and, only if none has reached its limit, adds their deltas, as a
+	// single atomic step. It returns the counters before the deltas were added and whether they were.
+	Admit(ctx context.Context, windows []QuotaWindow) (usage []int64, admitted bool, err error)
+	// Add adds the deltas of the windows to their counters as a single atomic step, so that either all or none
+	// of them are counted
+	Add(ctx context.Context, windows []QuotaWindow) error
+}
+
+// clientUsage is the usage of a client key in the current minute and day (UTC)
+type clientUsage struct {
+	minute       time.Time
+	requests     int64
+	minuteTokens int64
+	day          time.Time
+	dayTokens    int64
+}
+
+// rollover resets the counters of windows that ended
+func (u *clientUsage) rollover(now time.Time) {
+	if minute := now.UTC().Truncate(time.Minute); !minute.Equal(u.minute) {
+		u.minute = minute
+		u.requests = 0
+		u.minuteTokens = 0
+	}
+	if day := now.UTC().Truncate(24 * time.Hour); !day.Equal(u.day) {
+		u.day = day
+		u.dayTokens = 0
+	}
+}
+
+// clientQuotas tracks the usage of client keys against their quotas, in memory or in a shared counter
+type clientQuotas struct {
+	mutex    sync.Mutex
+	usage    map[string]*clientUsage
+	now      func() time.Time
+	counters QuotaCounters
+}
+
+// sharedKeys returns the shared counter keys of a client key's current request, minute token, and day token windows
+func (q *clientQuotas) sharedKeys(name string) (requests, minuteTokens, dayTokens string) {
+	now := q.clock().UTC()
+	minute := strconv.FormatInt(now.Truncate(time.Minute).Unix(), 10)
+	day := strconv.FormatInt(now.Truncate(24*time.Hour).Unix(), 10)
+	prefix := "quota:" + name + ":"
+	return prefix + "requests:" + minute, prefix + "tokens:" + minute, prefix + "daily_tokens:" + day
+}
+
+// sharedAdmit counts a request of the key in the shared counters unless one of its quotas is used up, and
+// returns the usage of its windows before the request. Only windows with a quota are read.
+func (q *clientQuotas) sharedAdmit(key *ClientKey) (*clientUsage, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	requestsKey, minuteKey, dayKey := q.sharedKeys(key.Name)
+	windows := []QuotaWindow{{Key: requestsKey, Limit: key.RequestsPerMinute, Delta: 1, TTL: time.Minute}}
+	if key.TokensPerMinute > 0 {
+		windows = append(windows, QuotaWindow{Key: minuteKey, Limit: key.TokensPerMinute, TTL: time.Minute})
+	}
+	if key.TokensPerDay > 0 {
+		windows = append(windows, QuotaWindow{Key: dayKey, Limit: key.TokensPerDay, TTL: 24 * time.Hour})
+	}
+	usage, admitted, err := q.counters.Admit(ctx, windows)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(usage) != len(windows) {
+		return nil, false, fmt.Errorf("expected the usage of %d quota windows, got %d", len(windows), len(usage))
+	}
+	u := clientUsage{requests: usage[0]}
+	for i, window := range windows[1:] {
+		switch window.Key {
+		case minuteKey:
+			u.minuteTokens = usage[i+1]
+		case dayKey:
+			u.dayTokens = usage[i+1]
+		}
+	}
+	return &u, admitted, nil
+}
+
+func (q *clientQuotas) get(name string) *clientUsage {
+	if q.usage == nil {
+		q.usage = make(map[string]*clientUsage)
+	}
+	u, ok := q.usage[name]
+	if !ok {
+		u = &clientUsage{}
+		q.usage[name] = u
+	}
+	u.rollover(q.clock())
+	return u
+}
+
+func (q *clientQuotas) clock() time.Time {
+	if q.now == nil {
+		return time.Now()
+	}
+	return q.now()
+}
+
+// admit counts a request of the key, or returns an error wrapping ErrQuotaExceeded if a quota is used up.
+// Token quotas are checked against the tokens of completed requests, so a request may exceed them once.
+// When the shared counter fails, the quotas are enforced per instance.
+// The returned rate limit is nil for keys without quotas.
+func (q *clientQuotas) admit(key *ClientKey) (*rateLimit, error) {
+	if key.RequestsPerMinute == 0 && key.TokensPerMinute == 0 && key.TokensPerDay == 0 {
+		return nil, nil
+	}
+	now := q.clock()
+	if q.counters != nil {
+		if u, admitted, err := q.sharedAdmit(key); err == nil {
+			if !admitted {
+				err := key.check(u)
+				if err == nil {
+					err = fmt.Errorf("%w: client key %s", ErrQuotaExceeded, key.Name)
+				}
+				return key.rateLimit(u, now, err), err
+			}
+			u.requests++
+			return key.rateLimit(u, now, nil), nil
+		}
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	u := q.get(key.Name)
+	if err := key.check(u); err != nil {
+		return key.rateLimit(u, now, err), err
+	}
+	u.requests++
+	return key.rateLimit(u, now, nil), nil
+}
+
+// check returns an error wrapping ErrQuotaExceeded if the usage reaches a quota of the key
+func (key *ClientKey) check(u *clientUsage) error {
+	switch {
+	case key.RequestsPerMinute > 0 && u.requests >= key.RequestsPerMinute:
+		return fmt.Errorf("%w: %d requests per minute of client key %s", ErrQuotaExceeded, key.RequestsPerMinute, key.Name)
+	case key.TokensPerMinute > 0 && u.minuteTokens >= key.TokensPerMinute:
+		return fmt.Errorf("%w: %d tokens per minute of client key %s", ErrQuotaExceeded, key.TokensPerMinute, key.Name)
+	case key.TokensPerDay > 0 && u.dayTokens >= key.TokensPerDay:
+		return fmt.Errorf("%w: %d tokens per day of client key %s", ErrQuotaExceeded, key.TokensPerDay, key.Name)
+	}
+	return nil
+}
+
+// Rate limit headers, as sent by OpenAI so that client SDKs back off on their own
+const (
+	HeaderLimitRequests     = "x-ratelimit-limit-requests"
+	HeaderRemainingRequests = "x-ratelimit-remaining-requests"
+	HeaderResetRequests     = "x-ratelimit-reset-requests"
+	HeaderLimitTokens       = "x-ratelimit-limit-tokens"
+	HeaderRemainingTokens   = "x-ratelimit-remaining-tokens"
+	HeaderResetTokens       = "x-ratelimit-reset-tokens"
+)
+
+// rateLimit is the state of a client key's per-minute quotas after admitting or rejecting a request
+type rateLimit struct {
+	limitRequests     int64
+	remainingRequests int64
+	limitTokens       int64
+	remainingTokens   int64
+	// reset is the time until the minute window ends
+	reset time.Duration
+	// retryAfter is the time until the used up quota resets, zero for admitted requests
+	retryAfter time.Duration
+}
+
+// rateLimit returns the state of the key's quotas for the usage at now, and when to retry if rejected by err
+func (key *ClientKey) rateLimit(u *clientUsage, now time.Time, err error) *rateLimit {
+	now = now.UTC()
+	limit := &rateLimit{
+		limitRequests:     key.RequestsPerMinute,
+		remainingRequests: max(key.RequestsPerMinute-u.requests, 0),
+		limitTokens:       key.TokensPerMinute,
+		remainingTokens:   max(key.TokensPerMinute-u.minuteTokens, 0),
+		reset:             now.Truncate(time.Minute).Add(time.Minute).Sub(now),
+	}
+	if err != nil {
+		limit.retryAfter = limit.reset
+		// Only the daily quota is used up when the per-minute quotas are not
+		if (key.RequestsPerMinute == 0 || u.requests < key.RequestsPerMinute) &&
+			(key.TokensPerMinute == 0 || u.minuteTokens < key.TokensPerMinute) {
+			limit.retryAfter = now.Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+		}
+	}
+	return limit
+}
+
+type rateLimitKey struct{}
+
+// withRateLimit attaches the rate limit state of the request's client key
+func withRateLimit(ctx context.Context, limit *rateLimit) context.Context {
+	if limit == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, rateLimitKey{}, limit)
+}
+
+// setRateLimitHeaders sets the x-ratelimit headers of the per-minute quotas of the context's client key,
+// and Retry-After if the request was rejected. Keys without quotas get no headers.
+func setRateLimitHeaders(w http.ResponseWriter, ctx context.Context) {
+	limit, ok := ctx.Value(rateLimitKey{}).(*rateLimit)
+	if !ok {
+		return
+	}
+	header := w.Header()
+	// OpenAI reports resets as durations such as "1s" or "6m0s"
+	reset := (time.Duration(math.Ceil(limit.reset.Seconds())) * time.Second).String()
+	if limit.limitRequests > 0 {
+		header.Set(HeaderLimitRequests, strconv.FormatInt(limit.limitRequests, 10))
+		header.Set(HeaderRemainingRequests, strconv.FormatInt(limit.remainingRequests, 10))
+		header.Set(HeaderResetRequests, reset)
+	}
+	if limit.limitTokens > 0 {
+		header.Set(HeaderLimitTokens, strconv.FormatInt(limit.limitTokens, 10))
+		header.Set(HeaderRemainingTokens, strconv.FormatInt(limit.remainingTokens, 10))
+		header.Set(HeaderResetTokens, reset)
+	}
+	if limit.retryAfter > 0 {
+		header.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(limit.retryAfter.Seconds())), 10))
+	}
+}
+
+// record counts tokens used by the key. The minute and day windows are counted together, so that when the
+// shared counter fails, the tokens are counted per instance in both windows without being counted twice.
+func (q *clientQuotas) record(name string, tokens int64) {
+	if q.counters != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, minuteKey, dayKey := q.sharedKeys(name)
+		err := q.counters.Add(ctx, []QuotaWindow{
+			{Key: minuteKey, Delta: tokens, TTL: time.Minute},
+			{Key: dayKey, Delta: tokens, TTL: 24 * time.Hour},
+		})
+		if err == nil {
+			return
+		}
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	u := q.get(name)
+	u.minuteTokens += tokens
+	u.dayTokens += tokens
+}
+
+// SetQuotaCounters shares the client key quotas of all router instances through the counters
+func (s *Server) SetQuotaCounters(counters QuotaCounters) {
+	s.quotas.counters = counters
+}
+
+// RecordClientTokens counts tokens used on behalf of a client key towards its token quotas
+func (s *Server) RecordClientTokens(name string, tokens int64) {
+	s.quotas.record(name, tokens)
+}
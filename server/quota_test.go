@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"llm-router/client"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientKeyQuotas(t *testing.T) {
+	s := &Server{
+		APIKey: "router-key",
+		ClientKeys: []ClientKey{
+			{Name: "ci", Key: "ci-key", RequestsPerMinute: 2},
+			{Name: "batch", Key: "batch-key", TokensPerDay: 1000},
+		},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	clock := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.quotas.now = func() time.Time { return clock }
+
+	var caller string
+	handler := s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller = client.ClientKeyFromContext(r.Context())
+	}))
+	do := func(key string) int {
+		req := httptest.NewRequest("POST", "/v1/rerank", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := do("router-key"); code != http.StatusOK || caller != DefaultClientKeyName {
+		t.Errorf("Expected the api_key to be accepted as %q, got %d %q", DefaultClientKeyName, code, caller)
+	}
+	if code := do("unknown-key"); code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for an unknown key, got %d", code)
+	}
+
+	// Requests per minute
+	for i := 0; i < 2; i++ {
+		if code := do("ci-key"); code != http.StatusOK || caller != "ci" {
+			t.Fatalf("Expected request %d of ci to be accepted, got %d %q", i, code, caller)
+		}
+	}
+	if code := do("ci-key"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 over the request quota, got %d", code)
+	}
+	clock = clock.Add(time.Minute)
+	if code := do("ci-key"); code != http.StatusOK {
+		t.Errorf("Expected the request quota to reset after a minute, got %d", code)
+	}
+
+	// Tokens per day, counted from completed requests
+	s.RecordClientTokens("batch", 1000)
+	if code := do("batch-key"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 over the daily token quota, got %d", code)
+	}
+	if code := do("router-key"); code != http.StatusOK {
+		t.Errorf("Expected other keys to be unaffected, got %d", code)
+	}
+	clock = clock.Add(12 * time.Hour)
+	if code := do("batch-key"); code != http.StatusOK || caller != "batch" {
+		t.Errorf("Expected the daily token quota to reset, got %d", code)
+	}
+}
+
+func TestSharedClientKeyQuotas(t *testing.T) {
+	counters := &memoryQuotaCounters{counters: make(map[string]int64)}
+	clock := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	newInstance := func() *Server {
+		s := &Server{
+			ClientKeys: []ClientKey{{Name: "ci", Key: "ci-key", RequestsPerMinute: 3, TokensPerMinute: 500}},
+			Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		}
+		s.quotas.now = func() time.Time { return clock }
+		s.SetQuotaCounters(counters)
+		return s
+	}
+	s1, s2 := newInstance(), newInstance()
+	key := &s1.ClientKeys[0]
+
+	for i, s := range []*Server{s1, s2, s1} {
+		if _, err := s.quotas.admit(key); err != nil {
+			t.Fatalf("Expected request %d to be admitted, got %v", i, err)
+		}
+	}
+	if _, err := s2.quotas.admit(key); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected the request quota to be shared across instances, got %v", err)
+	}
+
+	clock = clock.Add(time.Minute)
+	s1.RecordClientTokens("ci", 500)
+	if _, err := s2.quotas.admit(key); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected the token quota to be shared across instances, got %v", err)
+	}
+	// Rejected requests are not counted
+	requestsKey, _, _ := s1.quotas.sharedKeys("ci")
+	if requests := counters.counters[requestsKey]; requests != 0 {
+		t.Errorf("Expected rejected requests not to be counted, got %d", requests)
+	}
+}
+
+func TestClientKeyQuotasWithoutSharedCounters(t *testing.T) {
+	s := &Server{
+		ClientKeys: []ClientKey{{Name: "ci", Key: "ci-key", TokensPerMinute: 500, TokensPerDay: 1000}},
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	clock := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.quotas.now = func() time.Time { return clock }
+	s.SetQuotaCounters(failingQuotaCounters{})
+	key := &s.ClientKeys[0]
+
+	// Tokens the shared counters failed to count are counted once per instance in both windows
+	s.RecordClientTokens("ci", 400)
+	if _, err := s.quotas.admit(key); err != nil {
+		t.Fatalf("Expected the request to be admitted, got %v", err)
+	}
+	if u := s.quotas.get("ci"); u.minuteTokens != 400 || u.dayTokens != 400 {
+		t.Errorf("Expected the tokens to be counted once in each window, got %d and %d", u.minuteTokens, u.dayTokens)
+	}
+}
+
+// failingQuotaCounters stands in for shared counters that cannot be reached
+type failingQuotaCounters struct{}
+
+func (failingQuotaCounters) Admit(ctx context.Context, windows []QuotaWindow) ([]int64, bool, error) {
+	return nil, false, errors.New("connection refused")
+}
+
+func (failingQuotaCounters) Add(ctx context.Context, windows []QuotaWindow) error {
+	return errors.New("connection refused")
+}
+
+// memoryQuotaCounters is an in-memory stand-in for the counters shared by all instances
+type memoryQuotaCounters struct {
+	mutex    sync.Mutex
+	counters map[string]int64
+}
+
+func (c *memoryQuotaCounters) Admit(ctx context.Context, windows []QuotaWindow) ([]int64, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	usage := make([]int64, len(windows))
+	admitted := true
+	for i, window := range windows {
+		usage[i] = c.counters[window.Key]
+		if window.Limit > 0 && usage[i] >= window.Limit {
+			admitted = false
+		}
+	}
+	if admitted {
+		for _, window := range windows {
+			c.counters[window.Key] += window.Delta
+		}
+	}
+	return usage, admitted, nil
+}
+
+func (c *memoryQuotaCounters) Add(ctx context.Context, windows []QuotaWindow) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, window := range windows {
+		c.counters[window.Key] += window.Delta
+	}
+	return nil
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	s := &Server{
+		APIKey: "router-key",
+		ClientKeys: []ClientKey{
+			{Name: "ci", Key: "ci-key", RequestsPerMinute: 2, TokensPerMinute: 1000},
+			{Name: "batch", Key: "batch-key", TokensPerDay: 1000},
+		},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	clock := time.Date(2025, 3, 1, 12, 0, 45, 0, time.UTC)
+	s.quotas.now = func() time.Time { return clock }
+	handler := s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/rerank", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("ci-key")
+	s.RecordClientTokens("ci", 300)
+	for header, want := range map[string]string{
+		HeaderLimitRequests:     "2",
+		HeaderRemainingRequests: "1",
+		HeaderResetRequests:     "15s",
+		HeaderLimitTokens:       "1000",
+		HeaderRemainingTokens:   "1000",
+		HeaderResetTokens:       "15s",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("Expected %s to be %q, got %q", header, want, got)
+		}
+	}
+	if w := do("ci-key"); w.Header().Get(HeaderRemainingRequests) != "0" || w.Header().Get(HeaderRemainingTokens) != "700" {
+		t.Errorf("Expected the remaining quotas to decrease, got %v", w.Header())
+	}
+	w = do("ci-key")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "15" || w.Header().Get(HeaderRemainingRequests) != "0" {
+		t.Errorf("Expected status 429 with Retry-After until the minute resets, got %d %v", w.Code, w.Header())
+	}
+
+	// Daily quotas have no x-ratelimit headers, but tell when to retry
+	s.RecordClientTokens("batch", 1000)
+	w = do("batch-key")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "43155" || w.Header().Get(HeaderLimitTokens) != "" {
+		t.Errorf("Expected Retry-After until the day resets, got %d %v", w.Code, w.Header())
+	}
+	if w := do("router-key"); len(w.Header()) != 0 {
+		t.Errorf("Expected no rate limit headers for keys without quotas, got %v", w.Header())
+	}
+}
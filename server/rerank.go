@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// RerankRequest is the body of /v1/rerank in the Cohere/Jina shape.
+// Documents are either strings or objects with a text field.
+type RerankRequest struct {
+	Model           string            `json:"model"`
+	Query           string            `json:"query"`
+	Documents       []json.RawMessage `json:"documents"`
+	TopN            int               `json:"top_n,omitempty"`
+	ReturnDocuments bool              `json:"return_documents,omitempty"`
+}
+
+// HandleRerankRequest returns an http.HandlerFunc that routes rerank requests through the groups.
+// The provider's response is returned as is.
+func (s *Server) HandleRerankRequest(rerank func(ctx context.Context, req RerankRequest, body []byte) ([]byte, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "", "method not allowed")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if writeBodyError(w, err) {
+			return
+		}
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "error reading request body")
+			return
+		}
+		var req RerankRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "invalid request body: "+err.Error())
+			return
+		}
+		if req.Model == "" || req.Query == "" || len(req.Documents) == 0 {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "model, query, and documents are required")
+			return
+		}
+
+		s.Logger.Info("Incoming rerank request for model(group)", slog.String("model", req.Model))
+		resp, err := rerank(r.Context(), req, body)
+		s.setBudgetHeaders(w, r.Context())
+		if writeRoutingError(w, err) {
+			return
+		}
+		if err != nil {
+			writeOpenAIError(w, http.StatusInternalServerError, "api_error", "", "Error handling rerank request: "+err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(resp)
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"llm-router/client"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Response headers describing how a chat completion was served
+const (
+	HeaderProvider = "X-LLM-Router-Provider"
+	HeaderModel    = "X-LLM-Router-Model"
+	// HeaderKeyAlias identifies the provider key as "provider/hash"
+	HeaderKeyAlias = "X-LLM-Router-Key-Alias"
+	// HeaderCost is the cost in USD, sent as a trailer of streams since it is only known at their end
+	HeaderCost     = "X-LLM-Router-Cost"
+	HeaderAttempts = "X-LLM-Router-Attempts"
+	// HeaderCandidates lists the candidates evaluated as JSON, when requested with HeaderExplain
+	HeaderCandidates = "X-LLM-Router-Candidates"
+)
+
+// HeaderRequestID identifies a request in the router's logs, taken from the request when set and echoed in
+// the response
+const HeaderRequestID = "X-Request-ID"
+
+// maxRequestIDLength bounds the request IDs taken from requests
+const maxRequestIDLength = 128
+
+// identify attaches the ID of each request, the caller's X-Request-ID if valid or a random one, to its context
+// and response
+func identify(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(HeaderRequestID)
+		if id == "" || len(id) > maxRequestIDLength || strings.ContainsFunc(id, func(c rune) bool { return c < '!' || c > '~' }) {
+			random := make([]byte, 16)
+			rand.Read(random)
+			id = hex.EncodeToString(random)
+		}
+		w.Header().Set(HeaderRequestID, id)
+		next(w, r.WithContext(client.WithRequestID(r.Context(), id)))
+	}
+}
+
+// HeaderExplain is the request header asking for an explanation of the route, set to true
+const HeaderExplain = "X-LLM-Router-Explain"
+
+// Response headers reporting what is left of the budgets of the calling client key
+const (
+	HeaderBudgetRemaining       = "X-LLM-Router-Budget-Remaining"
+	HeaderBudgetRemainingTokens = "X-LLM-Router-Budget-Remaining-Tokens"
+	HeaderBudgetReset           = "X-LLM-Router-Budget-Reset"
+)
+
+// setRouteHeaders sets the headers describing the route of a request
+func setRouteHeaders(w http.ResponseWriter, route client.Route) {
+	if route.Provider == "" {
+		return
+	}
+	w.Header().Set(HeaderProvider, route.Provider)
+	w.Header().Set(HeaderModel, route.Model)
+	w.Header().Set(HeaderKeyAlias, route.KeyID)
+	w.Header().Set(HeaderAttempts, strconv.Itoa(route.Attempts))
+	if route.Candidates != nil {
+		candidates, _ := json.Marshal(route.Candidates)
+		w.Header().Set(HeaderCandidates, string(candidates))
+	}
+}
+
+// withRouteExplanation asks the router to explain the route of a request sent with HeaderExplain
+func withRouteExplanation(ctx context.Context, r *http.Request) context.Context {
+	if explain, _ := strconv.ParseBool(r.Header.Get(HeaderExplain)); explain {
+		return client.WithRouteExplanation(ctx)
+	}
+	return ctx
+}
+
+// setCostHeader sets the cost header of a response
+func setCostHeader(w http.ResponseWriter, cost float64) {
+	w.Header().Set(HeaderCost, formatCost(cost))
+}
+
+// setCostTrailer sets the cost trailer of a streamed response, after its body was written
+func setCostTrailer(w http.ResponseWriter, cost float64) {
+	w.Header().Set(http.TrailerPrefix+HeaderCost, formatCost(cost))
+}
+
+// setBudgetHeaders sets the headers reporting what is left of the budgets of the context's client key
+func (s *Server) setBudgetHeaders(w http.ResponseWriter, ctx context.Context) {
+	if s.handleClientBudget == nil {
+		return
+	}
+	remaining, ok := s.handleClientBudget(client.ClientKeyFromContext(ctx))
+	if !ok {
+		return
+	}
+	if remaining.Cost >= 0 {
+		w.Header().Set(HeaderBudgetRemaining, formatCost(remaining.Cost))
+	}
+	if remaining.Tokens >= 0 {
+		w.Header().Set(HeaderBudgetRemainingTokens, strconv.FormatInt(remaining.Tokens, 10))
+	}
+	w.Header().Set(HeaderBudgetReset, remaining.Reset.UTC().Format(time.RFC3339))
+}
+
+func formatCost(cost float64) string {
+	return strconv.FormatFloat(cost, 'f', -1, 64)
+}
@@ -2,46 +2,314 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"llm-router/client"
+	"llm-router/tracing"
+	"llm-router/usage"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"sync"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 type Server struct {
-	APIKey              string
+	APIKey string
+	// ClientKeys are named client API keys with quotas, accepted in addition to APIKey
+	ClientKeys []ClientKey
+	// AdminAPIKey authenticates the admin API, which is disabled when empty
+	AdminAPIKey string
+	// AdminListener serves the admin API and metrics instead of the main listener, when set, so that they are
+	// not exposed with the inference API
+	AdminListener net.Listener
+	// TLSCert and TLSKey are the PEM certificate and key files HTTPS is served with, loaded by LoadCertificate
+	// and reloaded when renewed; HTTP is served when they are not set
+	TLSCert string
+	TLSKey  string
+	// ACME obtains the certificates HTTPS is served with automatically instead, when its domains are set
+	ACME ACME
+	// ACMEListener answers the HTTP-01 challenge of ACME over HTTP, when set, redirecting other requests to
+	// HTTPS, for certificate authorities that cannot reach the router's HTTPS port for TLS-ALPN-01
+	ACMEListener net.Listener
+	// H2C serves HTTP/2 without TLS as well, to clients such as load balancers that use it with prior knowledge.
+	// HTTP/2 is always served over TLS.
+	H2C bool
+	// HTTP2MaxConcurrentStreams is the maximum number of concurrent requests, e.g. streams, on an HTTP/2
+	// connection, net/http's default of 250 when 0
+	HTTP2MaxConcurrentStreams int
+	// ReadHeaderTimeout, WriteTimeout, and IdleTimeout are the timeouts of clients' connections, as those of
+	// http.Server, not applied when 0. Streaming responses clear the write deadline, so that WriteTimeout bounds
+	// non-streaming responses only.
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// TrustedProxies are the networks of the reverse proxies and load balancers in front of the router, whose
+	// X-Forwarded-For and X-Real-IP headers name the client of requests; TrustUnixSocket trusts the peers of
+	// Unix sockets as well
+	TrustedProxies  []netip.Prefix
+	TrustUnixSocket bool
+	// ClientIPRPM limits the requests of each client IP per minute, before authentication, unlimited when 0
+	ClientIPRPM int64
+	// CORS lets browser-based apps of other origins call the API endpoints, disabled without allowed origins
+	CORS CORS
+	// EndUserHeader names a request header identifying the end user usage is attributed to,
+	// taking precedence over the user field of the request body
+	EndUserHeader string
+	// Profiling serves the runtime profiles of net/http/pprof under /debug/pprof/ with the admin API
+	Profiling bool
+	// Limits of /v1/chat/completions/batch, defaulting to DefaultChatBatchConcurrency and DefaultChatBatchMaxRequests
+	ChatBatchConcurrency int
+	ChatBatchMaxRequests int
+	// Maximum size in bytes of request bodies, unlimited when 0
+	MaxBodySize int64
+	// Maximum size in bytes of the files uploaded to the Files API, unlimited when 0
+	MaxUploadSize int64
+	// DisableCompression serves responses uncompressed whatever the encodings clients accept
+	DisableCompression bool
+	// Compression sets the levels responses are compressed at
+	Compression Compression
+	// Tracer records spans of the chat completion and messages requests, disabled when nil
+	Tracer *tracing.Tracer
+	// AccessLog is logged a line per request, apart from the application's logs, disabled when nil
+	AccessLog *slog.Logger
+	// PromptLogLength is the number of characters of the chat completion request and response bodies logged at
+	// debug, which hold the messages of the conversations; bodies are left out of the logs when 0
+	PromptLogLength int
+
 	Logger              *slog.Logger
 	handleRequest       func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionResponse, error)
 	handleStreamRequest func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionStream, error)
-	handleModels        func() []ModelInfo
+	handleModels        func(ctx context.Context) []ModelInfo
+	handleBatches       http.Handler
+	handleFiles         http.Handler
+	handleAssistants    map[string]AssistantsTarget
+	handleTokenize      func(req TokenizeRequest) (*TokenizeResponse, error)
+	handleDetokenize    func(req DetokenizeRequest) (*DetokenizeResponse, error)
+	handleRerank        func(ctx context.Context, req RerankRequest, body []byte) ([]byte, error)
+	handleAdmin         *AdminHandlers
+	handleDeepHealth    func(ctx context.Context) DeepHealth
+	handleUsage         func(start, end time.Time) []usage.Entry
+	handleClientBudget  func(name string) (usage.Remaining, bool)
+	handleVersion       func() VersionInfo
+	handleMetrics       http.Handler
+	handleDebugRouting  func() DebugRouting
+
+	quotas   clientQuotas
+	ipLimits clientIPLimits
+	// httpServers are the HTTP servers of the listeners, stopped by Shutdown
+	httpServers httpServers
+	// tlsConfig serves the certificates set up by LoadCertificate, nil to serve HTTP
+	tlsConfig *tls.Config
+	// certManager obtains the certificates of ACME, nil when ACME is disabled
+	certManager *autocert.Manager
+}
+
+// Handlers holds the application callbacks serving the router's endpoints.
+// Endpoints whose optional handler is nil are not registered.
+type Handlers struct {
+	Request       func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionResponse, error)
+	StreamRequest func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionStream, error)
+	// Models lists the models the caller of ctx may use
+	Models func(ctx context.Context) []ModelInfo
+	// Batches proxies the Batch API
+	Batches http.Handler
+	// Files proxies the Files API
+	Files http.Handler
+	// Assistants proxies the Assistants API per group
+	Assistants map[string]AssistantsTarget
+	// Tokenize and Detokenize serve local tokenization
+	Tokenize   func(req TokenizeRequest) (*TokenizeResponse, error)
+	Detokenize func(req DetokenizeRequest) (*DetokenizeResponse, error)
+	// Rerank routes rerank requests through the groups
+	Rerank func(ctx context.Context, req RerankRequest, body []byte) ([]byte, error)
+	// Admin serves the admin API
+	Admin *AdminHandlers
+	// DeepHealth checks the upstreams for /healthz?deep=1
+	DeepHealth func(ctx context.Context) DeepHealth
+	// Usage returns the recorded usage within a time range
+	Usage func(start, end time.Time) []usage.Entry
+	// ClientBudget returns what is left of the budgets of a client key, reported in response headers
+	ClientBudget func(name string) (usage.Remaining, bool)
+	// Version reports the build information
+	Version func() VersionInfo
+	// Metrics serves Prometheus metrics
+	Metrics http.Handler
+	// DebugRouting reports the routing state for /debug/routing
+	DebugRouting func() DebugRouting
 }
 
-func NewServer(apiKey string, logger *slog.Logger,
-	handleRequest func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionResponse, error),
-	handleStreamRequest func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionStream, error),
-	handleModels func() []ModelInfo,
-) *Server {
+func NewServer(apiKey string, logger *slog.Logger, handlers Handlers) *Server {
 	return &Server{
 		APIKey:              apiKey,
 		Logger:              logger,
-		handleRequest:       handleRequest,
-		handleStreamRequest: handleStreamRequest,
-		handleModels:        handleModels,
+		handleRequest:       handlers.Request,
+		handleStreamRequest: handlers.StreamRequest,
+		handleModels:        handlers.Models,
+		handleBatches:       handlers.Batches,
+		handleFiles:         handlers.Files,
+		handleAssistants:    handlers.Assistants,
+		handleTokenize:      handlers.Tokenize,
+		handleDetokenize:    handlers.Detokenize,
+		handleRerank:        handlers.Rerank,
+		handleAdmin:         handlers.Admin,
+		handleDeepHealth:    handlers.DeepHealth,
+		handleUsage:         handlers.Usage,
+		handleClientBudget:  handlers.ClientBudget,
+		handleVersion:       handlers.Version,
+		handleMetrics:       handlers.Metrics,
+		handleDebugRouting:  handlers.DebugRouting,
 	}
 }
 
-func (s *Server) ListenAndServe(addr string) {
-	s.Logger.Info("Server listening", slog.String("address", addr))
-	http.HandleFunc("/v1/chat/completions", compressionMiddleware(s.HandleCompletionsRequest))
-	// expose models list
+// Listener is a listener the router's endpoints are served on, a TCP address or a Unix socket
+type Listener struct {
+	net.Listener
+	// TLS serves HTTPS on the listener, with the certificates set up by LoadCertificate
+	TLS bool
+}
+
+// Serve serves the router's endpoints on listeners, all with the same handlers, until they all stop or
+// Shutdown stops them
+func (s *Server) Serve(listeners ...Listener) {
+	// a mux of its own rather than http.DefaultServeMux, which net/http/pprof registers unauthenticated profiles on
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", identify(s.trace("/v1/chat/completions", s.limitBody(s.compress(s.HandleCompletionsRequest)))))
+	mux.Handle("/v1/chat/completions/batch", s.authMiddleware(s.limitBody(s.compress(s.HandleChatBatchRequest))))
+	// Anthropic-compatible endpoint for clients hard-coded to the Anthropic SDK
+	mux.HandleFunc("/v1/messages", identify(s.trace("/v1/messages", s.limitBody(s.compress(s.HandleMessagesRequest)))))
+	// expose models list, filtered by the caller's tenant
 	if s.handleModels != nil {
-		http.HandleFunc("/v1/models", compressionMiddleware(s.HandleModelsRequest(s.handleModels)))
+		mux.Handle("/v1/models", s.authMiddleware(s.compress(s.HandleModelsRequest(s.handleModels))))
+		mux.Handle("/v1/models/{id...}", s.authMiddleware(s.compress(s.HandleModelRequest(s.handleModels))))
+	}
+	// proxy the Batch, Files, and Assistants APIs to their designated provider keys
+	if s.handleBatches != nil {
+		mux.Handle("/v1/batches", s.authMiddleware(s.sharedOnly(s.limitBody(s.handleBatches.ServeHTTP))))
+		mux.Handle("/v1/batches/", s.authMiddleware(s.sharedOnly(s.limitBody(s.handleBatches.ServeHTTP))))
+	}
+	if s.handleFiles != nil {
+		mux.Handle("/v1/files", s.authMiddleware(s.sharedOnly(s.limitUpload(s.handleFiles.ServeHTTP))))
+		mux.Handle("/v1/files/", s.authMiddleware(s.sharedOnly(s.limitUpload(s.handleFiles.ServeHTTP))))
+	}
+	if len(s.handleAssistants) > 0 {
+		assistants := s.authMiddleware(s.sharedOnly(s.limitBody(s.HandleAssistantsRequest(s.handleAssistants).ServeHTTP)))
+		mux.Handle("/v1/assistants", assistants)
+		mux.Handle("/v1/assistants/", assistants)
+		mux.Handle("/v1/threads", assistants)
+		mux.Handle("/v1/threads/", assistants)
+	}
+	// local tokenization against the router's models
+	if s.handleTokenize != nil {
+		mux.Handle("/v1/tokenize", s.authMiddleware(s.limitBody(s.HandleTokenizeRequest(s.handleTokenize))))
+	}
+	if s.handleDetokenize != nil {
+		mux.Handle("/v1/detokenize", s.authMiddleware(s.limitBody(s.HandleDetokenizeRequest(s.handleDetokenize))))
+	}
+	if s.handleRerank != nil {
+		mux.Handle("/v1/rerank", s.authMiddleware(s.limitBody(s.compress(s.HandleRerankRequest(s.handleRerank)))))
+	}
+	// usage reporting
+	if s.handleUsage != nil {
+		mux.Handle("/v1/usage", s.authMiddleware(s.HandleUsageRequest(s.handleUsage, []string{usage.GroupByModel, usage.GroupByKey})))
+		mux.Handle("/v1/organization/usage/completions", s.authMiddleware(s.HandleUsageRequest(s.handleUsage, nil)))
+	}
+	// runtime state inspection and key management, optionally on its own port kept off the public network
+	adminMux := mux
+	if s.AdminListener != nil {
+		adminMux = http.NewServeMux()
+	}
+	if s.handleAdmin != nil && s.AdminAPIKey != "" {
+		adminMux.Handle("/admin/", s.limitBody(s.AdminMux(*s.handleAdmin).ServeHTTP))
 	}
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	// Prometheus metrics, scraped with the admin API key as they reveal client keys and spend
+	if s.handleMetrics != nil && s.AdminAPIKey != "" {
+		adminMux.Handle("GET /metrics", s.adminMiddleware(s.handleMetrics))
+	}
+	// routing state for diagnosing the choice of keys, authenticated as it reveals usage and spend
+	if s.handleDebugRouting != nil && s.AdminAPIKey != "" {
+		adminMux.Handle("GET /debug/routing", s.adminMiddleware(s.HandleDebugRoutingRequest(s.handleDebugRouting)))
+	}
+	// CPU, heap, and goroutine profiles for performance investigations in production
+	if s.Profiling && s.AdminAPIKey != "" {
+		adminMux.Handle("/debug/pprof/", s.adminMiddleware(profiles()))
+	}
+	if s.AdminListener != nil {
+		s.Logger.Info("Admin server listening", slog.String("address", s.AdminListener.Addr().String()))
+		go func() {
+			err := s.serve(Listener{Listener: s.AdminListener, TLS: s.tlsConfig != nil}, s.clientIP(s.accessLog(adminMux)))
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.Logger.Error("Admin server stopped", slog.Any("error", err))
+			}
+		}()
+	}
+	if s.ACMEListener != nil && s.certManager != nil {
+		s.Logger.Info("ACME challenge server listening", slog.String("address", s.ACMEListener.Addr().String()))
+		go func() {
+			err := s.serve(Listener{Listener: s.ACMEListener}, s.certManager.HTTPHandler(nil))
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.Logger.Error("ACME challenge server stopped", slog.Any("error", err))
+			}
+		}()
+	}
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		s.Logger.Info("Health check endpoint hit", slog.String("addr", r.RemoteAddr))
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
-	http.ListenAndServe(addr, nil)
+	mux.HandleFunc("/healthz", s.HandleHealthzRequest(s.handleDeepHealth))
+	if s.handleVersion != nil {
+		mux.HandleFunc("/version", s.HandleVersionRequest(s.handleVersion))
+	}
+	handler := s.clientIP(s.accessLog(s.cors(s.limitClientIP(mux))))
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		s.Logger.Info("Server listening", slog.String("address", listener.Addr().String()), slog.Bool("tls", listener.TLS))
+		wg.Go(func() {
+			if err := s.serve(listener, handler); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.Logger.Error("Server stopped", slog.String("address", listener.Addr().String()), slog.Any("error", err))
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// serve serves a handler on a listener over HTTP/1.1 and HTTP/2, over TLS on TLS listeners, so that the many
+// concurrent streams of a client share a connection rather than exhausting connection pools
+func (s *Server) serve(listener Listener, handler http.Handler) error {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(s.H2C)
+	srv := &http.Server{
+		Handler:           handler,
+		Protocols:         &protocols,
+		HTTP2:             &http.HTTP2Config{MaxConcurrentStreams: s.HTTP2MaxConcurrentStreams},
+		TLSConfig:         s.tlsConfig,
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		WriteTimeout:      s.WriteTimeout,
+		IdleTimeout:       s.IdleTimeout,
+	}
+	if !s.httpServers.track(srv) {
+		listener.Close()
+		return http.ErrServerClosed
+	}
+	if listener.TLS {
+		if s.tlsConfig == nil {
+			return errors.New("no certificate is configured to serve TLS with")
+		}
+		// The certificates come from the TLS configuration, which HTTP/2 is added to the protocols of
+		return srv.ServeTLS(listener, "", "")
+	}
+	return srv.Serve(listener)
+}
+
+// clearWriteDeadline lifts the WriteTimeout of a streaming response, which lasts as long as the provider
+// generates tokens, leaving it to the stream idle timeout of provider requests to end stalled streams
+func clearWriteDeadline(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
 }
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"google.golang.org/grpc"
+)
+
+// httpServers are the HTTP and gRPC servers of the listeners being served, which Shutdown stops
+type httpServers struct {
+	mu          sync.Mutex
+	servers     []*http.Server
+	grpcServers []*grpc.Server
+	shutdown    bool
+}
+
+// track adds an HTTP server to those Shutdown stops, false when the server is shutting down already
+func (h *httpServers) track(srv *http.Server) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shutdown {
+		return false
+	}
+	h.servers = append(h.servers, srv)
+	return true
+}
+
+// trackGRPC adds a gRPC server to those Shutdown stops, false when the server is shutting down already
+func (h *httpServers) trackGRPC(srv *grpc.Server) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shutdown {
+		return false
+	}
+	h.grpcServers = append(h.grpcServers, srv)
+	return true
+}
+
+// Shutdown stops every listener from accepting connections and waits for the requests in flight to end,
+// streams included, closing the connections of those still in flight when ctx is done. Serve returns once it
+// has.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.httpServers.mu.Lock()
+	s.httpServers.shutdown = true
+	servers, grpcServers := s.httpServers.servers, s.httpServers.grpcServers
+	s.httpServers.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(servers)+len(grpcServers))
+	for i, srv := range servers {
+		wg.Go(func() {
+			if err := srv.Shutdown(ctx); err != nil {
+				srv.Close()
+				errs[i] = err
+			}
+		})
+	}
+	for i, srv := range grpcServers {
+		wg.Go(func() {
+			stopped := make(chan struct{})
+			go func() {
+				srv.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				srv.Stop()
+				<-stopped
+				errs[len(servers)+i] = ctx.Err()
+			}
+		})
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
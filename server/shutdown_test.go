@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-release
+		w.Write([]byte("data: [DONE]\n\n"))
+	})
+	s := &Server{}
+	served := make(chan error, 1)
+	go func() { served <- s.serve(Listener{Listener: listener}, handler) }()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Expected the listener to stop once shutting down, got %v", err)
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("Expected connections to be refused once shutting down")
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Expected the shutdown to wait for the stream in flight, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Expected the shutdown to complete, got %v", err)
+	}
+	if b := <-body; b != "data: first\n\ndata: [DONE]\n\n" {
+		t.Errorf("Expected the stream to be finished, got %q", b)
+	}
+
+	// Listeners served after the shutdown are closed at once
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.serve(Listener{Listener: listener}, handler); !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Expected a listener to be closed after the shutdown, got %v", err)
+	}
+
+	s = &Server{}
+	listener, _ = net.Listen("tcp", "127.0.0.1:0")
+	started, release = make(chan struct{}), make(chan struct{})
+	defer close(release)
+	go s.serve(Listener{Listener: listener}, handler)
+	go http.Get("http://" + listener.Addr().String())
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the shutdown to time out with the stream in flight, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"llm-router/client"
+	"llm-router/usage"
+	"log/slog"
+	"net/http"
+)
+
+// ErrGroupNotAllowed is returned for requests to a group the client key's tenant may not use
+var ErrGroupNotAllowed = errors.New("group not available to tenant")
+
+// sharedOnly rejects requests of tenant client keys to endpoints whose state is shared by all clients,
+// such as the files and batches of a provider account
+func (s *Server) sharedOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tenant := client.TenantFromContext(r.Context()); tenant != "" {
+			s.Logger.Warn("Tenant denied shared endpoint", slog.String("tenant", tenant), slog.String("path", r.URL.Path))
+			writeOpenAIError(w, http.StatusForbidden, "invalid_request_error", "permission_denied", "This endpoint is not available to tenant client keys")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tenantEntries returns the usage entries of the tenant of the context, or all entries for clients outside of tenants
+func tenantEntries(ctx context.Context, entries []usage.Entry) []usage.Entry {
+	tenant := client.TenantFromContext(ctx)
+	if tenant == "" {
+		return entries
+	}
+	filtered := make([]usage.Entry, 0, len(entries))
+	for _, e := range entries {
+		if e.Tenant == tenant {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
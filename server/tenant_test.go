@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"llm-router/client"
+	"llm-router/usage"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	hour := time.Now().Truncate(time.Hour).Unix()
+	s := &Server{
+		APIKey: "router-key",
+		ClientKeys: []ClientKey{
+			{Name: "acme-backend", Key: "acme-key", Tenant: "acme"},
+			{Name: "globex-web", Key: "globex-key", Tenant: "globex"},
+		},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		handleRequest: func(ctx context.Context, req openai.ChatCompletionRequest) (*client.ChatCompletionResponse, error) {
+			return nil, fmt.Errorf("%w: %s", ErrGroupNotAllowed, req.Model)
+		},
+	}
+	do := func(handler http.Handler, method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	var tenant string
+	handler := s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant = client.TenantFromContext(r.Context())
+	}))
+	if do(handler, "POST", "/v1/rerank", "acme-key", ""); tenant != "acme" {
+		t.Errorf("Expected the tenant of the client key to be attached, got %q", tenant)
+	}
+	if do(handler, "POST", "/v1/rerank", "router-key", ""); tenant != "" {
+		t.Errorf("Expected no tenant for keys outside of tenants, got %q", tenant)
+	}
+
+	files := s.authMiddleware(s.sharedOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	if w := do(files, "GET", "/v1/files", "acme-key", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected tenants to be denied shared endpoints, got %d", w.Code)
+	}
+	if w := do(files, "GET", "/v1/files", "router-key", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected keys outside of tenants to use shared endpoints, got %d", w.Code)
+	}
+
+	usageHandler := s.authMiddleware(s.HandleUsageRequest(func(start, end time.Time) []usage.Entry {
+		return []usage.Entry{
+			{Key: usage.Key{Hour: hour, ClientKey: "acme-backend", Tenant: "acme"}, Counts: usage.Counts{TotalTokens: 10}},
+			{Key: usage.Key{Hour: hour, ClientKey: "globex-web", Tenant: "globex"}, Counts: usage.Counts{TotalTokens: 20}},
+		}
+	}, nil))
+	total := func(key string) int64 {
+		var page UsagePage
+		json.Unmarshal(do(usageHandler, "GET", "/v1/organization/usage/completions?group_by=tenant", key, "").Body.Bytes(), &page)
+		var tokens int64
+		for _, b := range page.Data {
+			for _, r := range b.Results {
+				tokens += r.TotalTokens
+			}
+		}
+		return tokens
+	}
+	if tokens := total("acme-key"); tokens != 10 {
+		t.Errorf("Expected a tenant to only see its own usage, got %d tokens", tokens)
+	}
+	if tokens := total("router-key"); tokens != 30 {
+		t.Errorf("Expected keys outside of tenants to see all usage, got %d tokens", tokens)
+	}
+
+	w := do(http.HandlerFunc(s.HandleCompletionsRequest), "POST", "/v1/chat/completions", "acme-key", `{"model":"fast","messages":[]}`)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "model_not_found") {
+		t.Errorf("Expected status 404 for a group not available to the tenant, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME configures the certificates obtained and renewed automatically from an ACME certificate authority such
+// as Let's Encrypt, with the TLS-ALPN-01 challenge on the router's HTTPS port, or the HTTP-01 challenge on
+// ACMEListener
+type ACME struct {
+	// Domains are the names certificates are obtained for, ACME being disabled when empty
+	Domains []string
+	// CacheDir is the directory the certificates and account key are kept in across restarts
+	CacheDir string
+	// Email is the contact address the certificate authority notifies of problems with the certificates
+	Email string
+	// DirectoryURL is the ACME directory of the certificate authority, Let's Encrypt's when empty
+	DirectoryURL string
+}
+
+// certificateCheckInterval is how often the certificate files are checked for a renewal, at most, as they are
+// checked when clients connect
+var certificateCheckInterval = 10 * time.Second
+
+// certificate serves the certificate of a pair of PEM files, reloading it once the files change, e.g. when
+// certbot or cert-manager renews it, so that renewals apply without restarting the router
+type certificate struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+
+	mutex sync.Mutex
+	cert  *tls.Certificate
+	// version is the modification times of the files the certificate was loaded from
+	version [2]time.Time
+	checked time.Time
+}
+
+// LoadCertificate loads the certificate and key of TLSCert and TLSKey, or sets up obtaining certificates with
+// ACME, which the listeners then serve HTTPS with. It does nothing when neither is configured.
+func (s *Server) LoadCertificate() error {
+	if len(s.ACME.Domains) > 0 {
+		s.certManager = s.acmeManager()
+		s.tlsConfig = s.certManager.TLSConfig()
+		s.tlsConfig.MinVersion = tls.VersionTLS12
+		return nil
+	}
+	if s.TLSCert == "" && s.TLSKey == "" {
+		return nil
+	}
+	c := &certificate{certFile: s.TLSCert, keyFile: s.TLSKey, logger: s.Logger}
+	if err := c.load(); err != nil {
+		return err
+	}
+	s.tlsConfig = c.tlsConfig()
+	return nil
+}
+
+// acmeManager returns the manager obtaining the certificates of the ACME domains on the first connection
+// for each and renewing them ahead of their expiry, accepting the terms of service of the certificate authority
+func (s *Server) acmeManager() *autocert.Manager {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(s.ACME.Domains...),
+		Email:      s.ACME.Email,
+	}
+	if s.ACME.CacheDir != "" {
+		manager.Cache = autocert.DirCache(s.ACME.CacheDir)
+	}
+	if s.ACME.DirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: s.ACME.DirectoryURL}
+	}
+	return manager
+}
+
+// load loads the certificate from its files
+func (c *certificate) load() error {
+	version := c.fileVersion()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.version, c.checked = &cert, version, time.Now()
+	return nil
+}
+
+// fileVersion returns the modification times of the certificate files, zero for those that cannot be read
+func (c *certificate) fileVersion() [2]time.Time {
+	var version [2]time.Time
+	for i, path := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(path); err == nil {
+			version[i] = info.ModTime()
+		}
+	}
+	return version
+}
+
+// get returns the certificate, first reloading it if its files changed since it was loaded. A renewed
+// certificate that fails to load, e.g. as only one of its files was written yet, leaves the current one
+// served until the next check.
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if time.Since(c.checked) < certificateCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+	if c.fileVersion() == c.version {
+		return c.cert, nil
+	}
+	if err := c.load(); err != nil {
+		c.logger.Error("Failed to reload the TLS certificate, serving the previous one", slog.String("cert", c.certFile), slog.Any("error", err))
+		return c.cert, nil
+	}
+	c.logger.Info("Reloaded the renewed TLS certificate", slog.String("cert", c.certFile))
+	return c.cert, nil
+}
+
+// tlsConfig returns the TLS configuration of the listeners serving the certificate
+func (c *certificate) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.get,
+	}
+}
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// writeCertificate writes a self-signed certificate for localhost with a serial number and its key as PEM files
+func writeCertificate(t *testing.T, certFile string, keyFile string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	interval := certificateCheckInterval
+	certificateCheckInterval = 0
+	defer func() { certificateCheckInterval = interval }()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, 1)
+	s := &Server{TLSCert: certFile, TLSKey: keyFile, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	if err := s.LoadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(tls.NewListener(listener, s.tlsConfig), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serial := func() int64 {
+		t.Helper()
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	if n := serial(); n != 1 {
+		t.Fatalf("Expected the certificate of the files, got serial %d", n)
+	}
+
+	// A renewal half written keeps the previous certificate served
+	renewed := time.Now().Add(time.Minute)
+	os.WriteFile(keyFile, []byte("not a key"), 0o600)
+	os.Chtimes(keyFile, renewed, renewed)
+	if n := serial(); n != 1 {
+		t.Errorf("Expected the previous certificate until the renewal is complete, got serial %d", n)
+	}
+
+	writeCertificate(t, certFile, keyFile, 2)
+	renewed = renewed.Add(time.Minute)
+	os.Chtimes(certFile, renewed, renewed)
+	os.Chtimes(keyFile, renewed, renewed)
+	if n := serial(); n != 2 {
+		t.Errorf("Expected the renewed certificate, got serial %d", n)
+	}
+
+	if err := (&Server{TLSCert: certFile, TLSKey: filepath.Join(dir, "missing.pem")}).LoadCertificate(); err == nil {
+		t.Errorf("Expected a missing key to fail to load")
+	}
+}
+
+func TestACME(t *testing.T) {
+	s := &Server{ACME: ACME{Domains: []string{"llm.example.com"}, CacheDir: t.TempDir()}, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	if err := s.LoadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(s.tlsConfig.NextProtos, acme.ALPNProto) {
+		t.Errorf("Expected the TLS-ALPN-01 challenge to be answered, got protocols %v", s.tlsConfig.NextProtos)
+	}
+	// Certificates are only requested for the configured domains
+	if _, err := s.tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Errorf("Expected no certificate for another domain")
+	}
+
+	// The HTTP-01 challenge listener redirects requests other than the challenge to HTTPS
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ACMEListener = listener
+	s.Serve()
+	defer s.Shutdown(context.Background())
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	var resp *http.Response
+	for range 50 {
+		if resp, err = client.Get("http://" + listener.Addr().String() + "/v1/models"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if location := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || !strings.HasPrefix(location, "https://127.0.0.1") || !strings.HasSuffix(location, "/v1/models") {
+		t.Errorf("Expected a redirect to HTTPS, got %d to %q", resp.StatusCode, location)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/.well-known/acme-challenge/unknown", nil)
+	req.Host = "llm.example.com"
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected an unknown challenge token to be answered 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, 1)
+	proto := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	get := func(transport *http.Transport, url string) string {
+		t.Helper()
+		resp, err := (&http.Client{Transport: transport}).Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	serve := func(s *Server) string {
+		t.Helper()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go s.serve(Listener{Listener: listener, TLS: s.tlsConfig != nil}, proto)
+		return listener.Addr().String()
+	}
+
+	s := &Server{TLSCert: certFile, TLSKey: keyFile, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	if err := s.LoadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	address := serve(s)
+	if proto := get(&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}, "https://"+address); proto != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2 over TLS, got %s", proto)
+	}
+
+	var h2c http.Protocols
+	h2c.SetUnencryptedHTTP2(true)
+	address = serve(&Server{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if _, err := (&http.Client{Transport: &http.Transport{Protocols: &h2c}}).Get("http://" + address); err == nil {
+		t.Errorf("Expected no cleartext HTTP/2 without H2C")
+	}
+	if proto := get(&http.Transport{}, "http://"+address); proto != "HTTP/1.1" {
+		t.Errorf("Expected HTTP/1.1, got %s", proto)
+	}
+	address = serve(&Server{H2C: true, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if proto := get(&http.Transport{Protocols: &h2c}, "http://"+address); proto != "HTTP/2.0" {
+		t.Errorf("Expected cleartext HTTP/2 with H2C, got %s", proto)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	s := &Server{WriteTimeout: 100 * time.Millisecond, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(w, "slow")
+	})
+	mux.HandleFunc("/stream", Compression{}.middleware(func(w http.ResponseWriter, r *http.Request) {
+		// as compressed and recorded by the middlewares
+		w = &statusRecorder{ResponseWriter: w}
+		clearWriteDeadline(w)
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(w, "stream")
+	}))
+	go s.serve(Listener{Listener: listener}, mux)
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	if resp, err := client.Get("http://" + listener.Addr().String() + "/slow"); err == nil {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			t.Errorf("Expected the response to outlast WriteTimeout, got %q", body)
+		}
+	}
+	resp, err := client.Get("http://" + listener.Addr().String() + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, err := io.ReadAll(resp.Body); err != nil || string(body) != "stream" {
+		t.Errorf("Expected the stream to be exempt from WriteTimeout, got %q, %v", body, err)
+	}
+}
+
+func TestServeListeners(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, 1)
+	s := &Server{TLSCert: certFile, TLSKey: keyFile, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	if err := s.LoadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	var listeners []Listener
+	for _, network := range []string{"tcp", "tcp", "unix"} {
+		address := "127.0.0.1:0"
+		if network == "unix" {
+			address = filepath.Join(dir, "router.sock")
+		}
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		listeners = append(listeners, Listener{Listener: listener, TLS: len(listeners) == 1})
+	}
+	go s.Serve(listeners...)
+
+	get := func(transport *http.Transport, url string) {
+		t.Helper()
+		resp, err := (&http.Client{Transport: transport}).Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "OK" {
+			t.Errorf("Expected the health check of %s to pass, got %d %s", url, resp.StatusCode, body)
+		}
+	}
+	get(&http.Transport{}, "http://"+listeners[0].Addr().String()+"/health")
+	get(&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, "https://"+listeners[1].Addr().String()+"/health")
+	get(&http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", listeners[2].Addr().String())
+	}}, "http://router/health")
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// TokenizeRequest is the body of /v1/tokenize, with either a prompt or chat messages
+type TokenizeRequest struct {
+	Model    string                         `json:"model"`
+	Prompt   string                         `json:"prompt,omitempty"`
+	Messages []openai.ChatCompletionMessage `json:"messages,omitempty"`
+}
+
+// TokenizeResponse is returned by /v1/tokenize. Tokens are only returned for prompts
+// tokenized with the model's tokenizer; otherwise the count is an estimate.
+type TokenizeResponse struct {
+	Model       string `json:"model"`
+	Count       int    `json:"count"`
+	MaxModelLen int64  `json:"max_model_len,omitempty"`
+	Tokens      []int  `json:"tokens,omitempty"`
+	Estimated   bool   `json:"estimated,omitempty"`
+}
+
+// DetokenizeRequest is the body of /v1/detokenize
+type DetokenizeRequest struct {
+	Model  string `json:"model"`
+	Tokens []int  `json:"tokens"`
+}
+
+// DetokenizeResponse is returned by /v1/detokenize
+type DetokenizeResponse struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+}
+
+// HandleTokenizeRequest returns an http.HandlerFunc that tokenizes text locally without calling a provider
+func (s *Server) HandleTokenizeRequest(tokenize func(req TokenizeRequest) (*TokenizeResponse, error)) http.HandlerFunc {
+	return handleJSON(tokenize)
+}
+
+// HandleDetokenizeRequest returns an http.HandlerFunc that converts token IDs back into text
+func (s *Server) HandleDetokenizeRequest(detokenize func(req DetokenizeRequest) (*DetokenizeResponse, error)) http.HandlerFunc {
+	return handleJSON(detokenize)
+}
+
+// handleJSON serves a POST endpoint decoding a JSON request and encoding the JSON response of handle
+func handleJSON[Req, Resp any](handle func(req Req) (*Resp, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "", "method not allowed")
+			return
+		}
+
+		var req Req
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			if writeBodyError(w, err) {
+				return
+			}
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "invalid request body: "+err.Error())
+			return
+		}
+		resp, err := handle(req)
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"llm-router/tracing"
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// trace records a server span of the requests to a route, continuing the trace of the caller's traceparent
+// and tracestate headers. With tracing disabled, the caller's trace, or else a new one, is only passed on to
+// providers.
+func (s *Server) trace(route string, next http.HandlerFunc) http.HandlerFunc {
+	if s.Tracer == nil {
+		return func(w http.ResponseWriter, r *http.Request) {
+			next(w, r.WithContext(tracing.ContextWithTrace(tracing.Extract(r.Context(), r.Header))))
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := s.Tracer.Start(tracing.Extract(r.Context(), r.Header), r.Method+" "+route, trace.SpanKindServer,
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route))
+		defer span.End()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			tracing.RecordError(span, errStatus(recorder.status))
+		}
+	}
+}
+
+// errStatus is the error of a span whose response has a server error status
+type errStatus int
+
+func (e errStatus) Error() string {
+	return "status " + strconv.Itoa(int(e))
+}
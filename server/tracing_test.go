@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"llm-router/tracing"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTraceMiddleware(t *testing.T) {
+	exported := make(chan *coltracepb.ExportTraceServiceRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		proto.Unmarshal(body, req)
+		exported <- req
+	}))
+	defer collector.Close()
+
+	s := NewServer("", slog.New(slog.NewTextHandler(io.Discard, nil)), Handlers{})
+	tracer, err := tracing.NewTracer(tracing.Options{Endpoint: collector.URL, SampleRatio: 1, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Tracer = tracer
+	var recording bool
+	handler := s.trace("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		recording = trace.SpanFromContext(r.Context()).IsRecording()
+		w.WriteHeader(http.StatusBadGateway)
+		w.(http.Flusher).Flush()
+	})
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler(httptest.NewRecorder(), req)
+	if !recording {
+		t.Fatalf("Expected the handler to run within the request's span")
+	}
+	if err := s.Tracer.Flush(context.Background()); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	export := <-exported
+	if len(export.ResourceSpans) != 1 || len(export.ResourceSpans[0].ScopeSpans) != 1 || len(export.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("Expected a single span exported, got %v", export)
+	}
+	span := export.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	var status int64
+	for _, attribute := range span.Attributes {
+		if attribute.Key == "http.response.status_code" {
+			status = attribute.Value.GetIntValue()
+		}
+	}
+	if hex.EncodeToString(span.TraceId) != "4bf92f3577b34da6a3ce929d0e0e4736" || hex.EncodeToString(span.ParentSpanId) != "00f067aa0ba902b7" ||
+		span.Name != "POST /v1/chat/completions" || status != 502 || span.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR {
+		t.Errorf("Unexpected exported span %v", span)
+	}
+}
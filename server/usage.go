@@ -0,0 +1,236 @@
+package server
+
+import (
+	"fmt"
+	"llm-router/usage"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// UsageResult is a usage result in the shape of the OpenAI organization usage API.
+// Dimensions that are not grouped by are null.
+type UsageResult struct {
+	Object           string `json:"object"`
+	InputTokens      int64  `json:"input_tokens"`
+	OutputTokens     int64  `json:"output_tokens"`
+	ReasoningTokens  int64  `json:"output_reasoning_tokens"`
+	TotalTokens      int64  `json:"total_tokens"`
+	NumModelRequests int64  `json:"num_model_requests"`
+	// Cost is the cost in USD of models with a configured price
+	Cost      float64 `json:"cost"`
+	Model     *string `json:"model"`
+	Group     *string `json:"group,omitempty"`
+	ClientKey *string `json:"client_key,omitempty"`
+	Tenant    *string `json:"tenant,omitempty"`
+	User      *string `json:"user,omitempty"`
+	Provider  *string `json:"provider,omitempty"`
+	APIKeyID  *string `json:"api_key_id"`
+}
+
+// UsageBucket is a time bucket of usage results
+type UsageBucket struct {
+	Object    string        `json:"object"`
+	StartTime int64         `json:"start_time"`
+	EndTime   int64         `json:"end_time"`
+	Results   []UsageResult `json:"results"`
+}
+
+// UsagePage is the response of the usage endpoints
+type UsagePage struct {
+	Object   string        `json:"object"`
+	Data     []UsageBucket `json:"data"`
+	HasMore  bool          `json:"has_more"`
+	NextPage *string       `json:"next_page"`
+}
+
+// defaultUsageRange is the range reported when no start time is given
+const defaultUsageRange = 7 * 24 * time.Hour
+
+// HandleUsageRequest returns an http.HandlerFunc reporting token and request counts bucketed by time.
+// It accepts start_time and end_time as Unix seconds or start_date and end_date as YYYY-MM-DD (end inclusive),
+// bucket_width of 1h or 1d, and repeated group_by values (model, group, client_key, tenant, user, provider, api_key_id), defaulting to defaultGroupBy.
+// Clients of a tenant only see the usage of their tenant.
+func (s *Server) HandleUsageRequest(entries func(start, end time.Time) []usage.Entry, defaultGroupBy []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "", "method not allowed")
+			return
+		}
+
+		start, end, err := parseUsageRange(r)
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+			return
+		}
+		width := 24 * time.Hour
+		switch r.URL.Query().Get("bucket_width") {
+		case "", "1d":
+		case "1h":
+			width = time.Hour
+		default:
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "bucket_width must be 1h or 1d")
+			return
+		}
+		groupBy := r.URL.Query()["group_by"]
+		if len(groupBy) == 0 {
+			groupBy = defaultGroupBy
+		}
+
+		buckets, err := usage.Aggregate(tenantEntries(r.Context(), entries(start, end)), start, end, width, groupBy)
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+			return
+		}
+
+		page := UsagePage{Object: "page", Data: make([]UsageBucket, 0, len(buckets))}
+		for _, b := range buckets {
+			bucket := UsageBucket{
+				Object:    "bucket",
+				StartTime: b.Start.Unix(),
+				EndTime:   b.End.Unix(),
+				Results:   make([]UsageResult, 0, len(b.Results)),
+			}
+			for _, r := range b.Results {
+				bucket.Results = append(bucket.Results, UsageResult{
+					Object:           "organization.usage.completions.result",
+					InputTokens:      r.PromptTokens,
+					OutputTokens:     r.CompletionTokens,
+					ReasoningTokens:  r.ReasoningTokens,
+					TotalTokens:      r.TotalTokens,
+					NumModelRequests: r.Requests,
+					Cost:             r.Cost,
+					Model:            optionalString(r.Model),
+					Group:            optionalString(r.Group),
+					ClientKey:        optionalString(r.ClientKey),
+					Tenant:           optionalString(r.Tenant),
+					User:             optionalString(r.User),
+					Provider:         optionalString(r.Provider),
+					APIKeyID:         optionalString(r.KeyID),
+				})
+			}
+			page.Data = append(page.Data, bucket)
+		}
+		writeJSON(w, http.StatusOK, page)
+	}
+}
+
+// HandleUsageExportRequest returns an http.HandlerFunc exporting the usage and cost per day, group, client key,
+// end user, provider key, and model within the range of HandleUsageRequest, as CSV (default) or JSON with format=json
+func (s *Server) HandleUsageExportRequest(entries func(start, end time.Time) []usage.Entry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, end, err := parseUsageRange(r)
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+			return
+		}
+		rows := usage.Export(entries(start, end), start, end)
+
+		switch r.URL.Query().Get("format") {
+		case "", "csv":
+			filename := fmt.Sprintf("usage-%s-%s.csv", start.UTC().Format(time.DateOnly), end.Add(-time.Second).UTC().Format(time.DateOnly))
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+			if err := usage.WriteCSV(w, rows); err != nil {
+				s.Logger.Error("Failed to write usage export", slog.Any("error", err))
+			}
+		case "json":
+			writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": rows})
+		default:
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "format must be csv or json")
+		}
+	}
+}
+
+// HandleChargebackRequest returns an http.HandlerFunc reporting the usage and cost per tenant and model of the
+// calendar month given as month=YYYY-MM (UTC), defaulting to the current month, optionally limited to one tenant.
+// Reports are JSON by default or CSV with format=csv.
+func (s *Server) HandleChargebackRequest(entries func(start, end time.Time) []usage.Entry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		month := time.Now()
+		if v := query.Get("month"); v != "" {
+			parsed, err := time.Parse("2006-01", v)
+			if err != nil {
+				writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "invalid month: "+v)
+				return
+			}
+			month = parsed
+		}
+		start, end := usage.PeriodStart(usage.PeriodMonth, month), usage.PeriodEnd(usage.PeriodMonth, month)
+		reports := usage.Chargeback(entries(start, end), month)
+		if tenant := query.Get("tenant"); tenant != "" {
+			filtered := make([]usage.TenantReport, 0, 1)
+			for _, report := range reports {
+				if report.Tenant == tenant {
+					filtered = append(filtered, report)
+				}
+			}
+			reports = filtered
+		}
+
+		switch query.Get("format") {
+		case "", "json":
+			writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": reports})
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="chargeback-`+start.Format("2006-01")+`.csv"`)
+			if err := usage.WriteChargebackCSV(w, reports); err != nil {
+				s.Logger.Error("Failed to write chargeback report", slog.Any("error", err))
+			}
+		default:
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "format must be json or csv")
+		}
+	}
+}
+
+// parseUsageRange parses the requested time range, defaulting to the last 7 days
+func parseUsageRange(r *http.Request) (time.Time, time.Time, error) {
+	query := r.URL.Query()
+	end := time.Now()
+	start := end.Add(-defaultUsageRange)
+
+	if v := query.Get("start_time"); v != "" {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid start_time: %s", v)
+		}
+		start = time.Unix(seconds, 0)
+	} else if v := query.Get("start_date"); v != "" {
+		date, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid start_date: %s", v)
+		}
+		start = date
+	}
+
+	if v := query.Get("end_time"); v != "" {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid end_time: %s", v)
+		}
+		end = time.Unix(seconds, 0)
+	} else if v := query.Get("end_date"); v != "" {
+		date, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid end_date: %s", v)
+		}
+		end = date.Add(24 * time.Hour)
+	}
+
+	if !start.Before(end) {
+		return start, end, fmt.Errorf("start must be before end")
+	}
+	if end.Sub(start) > 366*24*time.Hour {
+		return start, end, fmt.Errorf("range must not exceed 366 days")
+	}
+	return start, end, nil
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
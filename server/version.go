@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// VersionInfo describes the deployed build of the router
+type VersionInfo struct {
+	Version    string    `json:"version"`
+	Commit     string    `json:"commit,omitempty"`
+	BuildDate  string    `json:"build_date,omitempty"`
+	GoVersion  string    `json:"go_version"`
+	ConfigHash string    `json:"config_hash"`
+	StartedAt  time.Time `json:"started_at"`
+	Uptime     string    `json:"uptime"`
+}
+
+// HandleVersionRequest returns an http.HandlerFunc serving the build information
+func (s *Server) HandleVersionRequest(versionFunc func() VersionInfo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "", "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, versionFunc())
+	}
+}
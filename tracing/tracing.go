@@ -0,0 +1,152 @@
+// Package tracing records spans of the router's requests with the OpenTelemetry SDK and exports them to a
+// collector over OTLP/HTTP. Trace context is propagated with the W3C traceparent and tracestate headers.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Options configures the tracer
+type Options struct {
+	// Endpoint is the OTLP/HTTP endpoint of the collector, e.g. "http://localhost:4318", to which
+	// "/v1/traces" is appended when it has no path
+	Endpoint string
+	// Headers are sent with every export, e.g. for authentication
+	Headers map[string]string
+	// ServiceName identifies the router in the traces, defaulting to "llm-router"
+	ServiceName string
+	// SampleRatio is the fraction of the traces started by the router that are recorded, from 0 to 1.
+	// Traces continued from a caller's traceparent follow the caller's sampling decision.
+	SampleRatio float64
+	// FlushInterval is the longest time a finished span waits to be exported, defaulting to 5 seconds
+	FlushInterval time.Duration
+	// OnError is called with the errors of failed exports, if set
+	OnError func(err error, spans int)
+}
+
+// Tracer starts spans and exports the finished ones in batches in the background, so that a slow or
+// unavailable collector never delays requests. A nil Tracer records no spans.
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+const (
+	// maxQueuedSpans bounds the finished spans waiting to be exported, newer ones being dropped
+	maxQueuedSpans = 4096
+	// exportBatchSize is the maximum number of spans exported at once
+	exportBatchSize = 512
+)
+
+// NewTracer creates a tracer exporting to the endpoint of the options
+func NewTracer(options Options) (*Tracer, error) {
+	if options.ServiceName == "" {
+		options.ServiceName = "llm-router"
+	}
+	if options.FlushInterval == 0 {
+		options.FlushInterval = 5 * time.Second
+	}
+	if !strings.Contains(strings.TrimPrefix(strings.TrimPrefix(options.Endpoint, "http://"), "https://"), "/") {
+		options.Endpoint = strings.TrimSuffix(options.Endpoint, "/") + "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(options.Endpoint),
+		otlptracehttp.WithHeaders(options.Headers))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(reportingExporter{SpanExporter: exporter, onError: options.OnError},
+			sdktrace.WithBatchTimeout(options.FlushInterval),
+			sdktrace.WithMaxQueueSize(maxQueuedSpans),
+			sdktrace.WithMaxExportBatchSize(exportBatchSize)),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", options.ServiceName))),
+		// New traces are sampled from their trace ID, so that the decision is the same for every instance
+		// seeing them
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(options.SampleRatio))))
+	return &Tracer{provider: provider, tracer: provider.Tracer("llm-router")}, nil
+}
+
+// reportingExporter reports the errors of the exports of an exporter
+type reportingExporter struct {
+	sdktrace.SpanExporter
+	onError func(err error, spans int)
+}
+
+func (e reportingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+	if err != nil && e.onError != nil {
+		e.onError(err, len(spans))
+	}
+	return err
+}
+
+// Start starts a span of the given kind, a child of the span of ctx or of a remote parent, if any, and
+// returns a context holding it. Spans of traces that are not sampled are not recorded, and neither are those
+// of a nil Tracer, whose spans do nothing.
+func (t *Tracer) Start(ctx context.Context, name string, kind trace.SpanKind, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	if t == nil {
+		return ctx, noop.Span{}
+	}
+	return t.tracer.Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attributes...))
+}
+
+// Flush exports the finished spans waiting to be exported
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.provider.ForceFlush(ctx)
+}
+
+// RecordError marks a span as failed with an error, if not nil
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// propagator propagates trace context with the W3C traceparent and tracestate headers
+var propagator = propagation.TraceContext{}
+
+// Extract returns a context whose spans continue the trace of a caller's traceparent and tracestate headers,
+// or ctx itself when the traceparent header is missing or invalid
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// ContextWithTrace returns a context whose requests to other services carry a new trace, which is not
+// sampled, unless ctx holds a span or remote parent already. It lets requests be followed across services
+// by their trace ID when the router records no spans of its own.
+func ContextWithTrace(ctx context.Context) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	var traceID trace.TraceID
+	var spanID trace.SpanID
+	rand.Read(traceID[:])
+	rand.Read(spanID[:])
+	return trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, Remote: true}))
+}
+
+// Inject sets the traceparent and tracestate headers of a request to another service to the trace context of
+// ctx, that of its span or else its remote parent, or a new trace, which is not sampled, when ctx has none
+func Inject(ctx context.Context, header http.Header) {
+	header.Del("tracestate")
+	propagator.Inject(ContextWithTrace(ctx), propagation.HeaderCarrier(header))
+}
@@ -0,0 +1,148 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// callerHeader returns the headers of a request of a caller whose trace is sampled
+func callerHeader() http.Header {
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	header.Set("tracestate", "congo=t61rcWkgMzE")
+	return header
+}
+
+func TestSpansExported(t *testing.T) {
+	received := make(chan *coltracepb.ExportTraceServiceRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Unexpected export to %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			t.Errorf("Unexpected export: %v", err)
+		}
+		received <- req
+	}))
+	defer collector.Close()
+
+	tracer, err := NewTracer(Options{Endpoint: collector.URL, Headers: map[string]string{"Authorization": "Bearer token"}, SampleRatio: 1, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Extract(context.Background(), callerHeader())
+	ctx, parent := tracer.Start(ctx, "POST /v1/chat/completions", trace.SpanKindServer)
+	_, child := tracer.Start(ctx, "upstream", trace.SpanKindClient, attribute.String("provider", "openai"), attribute.Int("attempt", 2))
+	RecordError(child, errors.New("rate limited"))
+	child.End()
+	parent.End()
+	parent.End()
+
+	if err := tracer.Flush(context.Background()); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	req := <-received
+	if len(req.ResourceSpans) != 1 || req.ResourceSpans[0].Resource.Attributes[0].Value.GetStringValue() != "llm-router" {
+		t.Fatalf("Unexpected resource: %+v", req.ResourceSpans)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Expected each span exported once, got %d", len(spans))
+	}
+	upstream, server := spans[0], spans[1]
+	if hex.EncodeToString(server.TraceId) != "4bf92f3577b34da6a3ce929d0e0e4736" || hex.EncodeToString(server.ParentSpanId) != "00f067aa0ba902b7" {
+		t.Errorf("Expected the caller's trace to be continued, got %+v", server)
+	}
+	if string(upstream.TraceId) != string(server.TraceId) || string(upstream.ParentSpanId) != string(server.SpanId) ||
+		upstream.Kind != tracepb.Span_SPAN_KIND_CLIENT || upstream.TraceState != "congo=t61rcWkgMzE" {
+		t.Errorf("Expected the upstream span to be a child of the server span, got %+v", upstream)
+	}
+	if upstream.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR || upstream.Status.GetMessage() != "rate limited" {
+		t.Errorf("Expected the error to be recorded, got %+v", upstream.Status)
+	}
+	if len(upstream.Attributes) != 2 || upstream.Attributes[1].Value.GetIntValue() != 2 {
+		t.Errorf("Unexpected attributes %+v", upstream.Attributes)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	tracer, err := NewTracer(Options{Endpoint: "http://localhost:4318", SampleRatio: 0, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := tracer.Start(context.Background(), "request", trace.SpanKindServer)
+	span.End()
+	if span.SpanContext().IsSampled() || span.IsRecording() {
+		t.Errorf("Expected traces not to be recorded with a sample ratio of 0")
+	}
+	// Callers' sampling decisions are followed
+	if _, span := tracer.Start(Extract(context.Background(), callerHeader()), "request", trace.SpanKindServer); !span.SpanContext().IsSampled() {
+		t.Errorf("Expected a sampled caller's trace to be recorded")
+	}
+
+	var nilTracer *Tracer
+	ctx, span := nilTracer.Start(context.Background(), "request", trace.SpanKindServer)
+	span.SetAttributes(attribute.String("group", "smart"))
+	RecordError(span, errors.New("failed"))
+	span.End()
+	if span.IsRecording() || trace.SpanContextFromContext(ctx).IsValid() {
+		t.Errorf("Expected a nil tracer to start no spans")
+	}
+
+	for _, traceparent := range []string{"", "00-xyz-00f067aa0ba902b7-01", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"} {
+		header := http.Header{}
+		header.Set("traceparent", traceparent)
+		if trace.SpanContextFromContext(Extract(context.Background(), header)).IsValid() {
+			t.Errorf("Expected traceparent %q to be invalid", traceparent)
+		}
+	}
+}
+
+func TestInject(t *testing.T) {
+	tracer, err := NewTracer(Options{Endpoint: "http://localhost:4318", SampleRatio: 1, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Extract(context.Background(), callerHeader())
+
+	// Without a span, the caller's trace context is passed on unchanged
+	header := http.Header{}
+	Inject(ctx, header)
+	if header.Get("traceparent") != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" || header.Get("tracestate") != "congo=t61rcWkgMzE" {
+		t.Errorf("Expected the caller's trace context, got %v", header)
+	}
+
+	// With one, the provider's request is a child of the span
+	spanCtx, span := tracer.Start(ctx, "upstream", trace.SpanKindClient)
+	Inject(spanCtx, header)
+	if header.Get("traceparent") != "00-4bf92f3577b34da6a3ce929d0e0e4736-"+span.SpanContext().SpanID().String()+"-01" || header.Get("tracestate") != "congo=t61rcWkgMzE" {
+		t.Errorf("Expected the trace context of the span, got %v", header)
+	}
+
+	// Without either, a new trace is started, the same one for every request of the context
+	ctx = ContextWithTrace(context.Background())
+	first, second := http.Header{}, http.Header{}
+	Inject(ctx, first)
+	Inject(ctx, second)
+	sc := trace.SpanContextFromContext(Extract(context.Background(), first))
+	if !sc.IsValid() || sc.IsSampled() || first.Get("traceparent") != second.Get("traceparent") || first.Get("tracestate") != "" {
+		t.Errorf("Expected the same new trace for every request, got %v and %v", first, second)
+	}
+	if ContextWithTrace(ctx) != ctx {
+		t.Errorf("Expected the trace of the context to be kept")
+	}
+}
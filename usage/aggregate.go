@@ -0,0 +1,146 @@
+package usage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Dimensions usage can be grouped by
+const (
+	GroupByModel    = "model"
+	GroupByProvider = "provider"
+	GroupByKey      = "api_key_id"
+	GroupByGroup    = "group"
+	GroupByClient   = "client_key"
+	GroupByUser     = "user"
+	GroupByTenant   = "tenant"
+)
+
+// Result is the usage of a group within a bucket. Fields not grouped by are empty.
+type Result struct {
+	Model     string
+	Group     string
+	ClientKey string
+	Tenant    string
+	User      string
+	Provider  string
+	// KeyID identifies a provider key as "provider/hash", see KeyID
+	KeyID string
+	Counts
+}
+
+// Bucket is the usage within [Start, End)
+type Bucket struct {
+	Start   time.Time
+	End     time.Time
+	Results []Result
+}
+
+// KeyHash returns the identifier of an API key within its provider, a prefix of its SHA-256 hash that
+// does not reveal the key and stays the same however the keys of the provider are added, removed, or reordered
+func KeyHash(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:6])
+}
+
+// KeyID returns the identifier of a provider key reported in grouped usage, e.g. "openai/3f2a9c1d0b7e"
+func KeyID(provider string, keyHash string) string {
+	return provider + "/" + keyHash
+}
+
+// Aggregate sums entries into buckets of the given width covering [start, end), grouped by the given dimensions.
+// Buckets are aligned to UTC and empty buckets are included.
+func Aggregate(entries []Entry, start, end time.Time, width time.Duration, groupBy []string) ([]Bucket, error) {
+	grouped := make(map[string]bool)
+	for _, g := range groupBy {
+		switch g {
+		case GroupByModel, GroupByProvider, GroupByKey, GroupByGroup, GroupByClient, GroupByUser, GroupByTenant:
+			grouped[g] = true
+		default:
+			return nil, fmt.Errorf("unsupported group_by value: %s", g)
+		}
+	}
+
+	buckets := make([]Bucket, 0)
+	for bucketStart := start.UTC().Truncate(width); bucketStart.Before(end); bucketStart = bucketStart.Add(width) {
+		buckets = append(buckets, Bucket{Start: bucketStart, End: bucketStart.Add(width)})
+	}
+
+	results := make([]map[Result]*Counts, len(buckets))
+	for _, e := range entries {
+		hour := time.Unix(e.Hour, 0).UTC()
+		if len(buckets) == 0 || hour.Before(buckets[0].Start) {
+			continue
+		}
+		i := int(hour.Sub(buckets[0].Start) / width)
+		if i >= len(buckets) {
+			continue
+		}
+
+		var group Result
+		if grouped[GroupByModel] {
+			group.Model = e.Model
+		}
+		if grouped[GroupByGroup] {
+			group.Group = e.Group
+		}
+		if grouped[GroupByClient] {
+			group.ClientKey = e.ClientKey
+		}
+		if grouped[GroupByTenant] {
+			group.Tenant = e.Tenant
+		}
+		if grouped[GroupByUser] {
+			group.User = e.User
+		}
+		if grouped[GroupByProvider] {
+			group.Provider = e.Provider
+		}
+		if grouped[GroupByKey] {
+			group.KeyID = KeyID(e.Provider, e.KeyHash)
+		}
+		if results[i] == nil {
+			results[i] = make(map[Result]*Counts)
+		}
+		counts, ok := results[i][group]
+		if !ok {
+			counts = &Counts{}
+			results[i][group] = counts
+		}
+		counts.Add(e.Counts)
+	}
+
+	for i := range buckets {
+		buckets[i].Results = make([]Result, 0, len(results[i]))
+		for group, counts := range results[i] {
+			group.Counts = *counts
+			buckets[i].Results = append(buckets[i].Results, group)
+		}
+		sort.Slice(buckets[i].Results, func(a, b int) bool {
+			ra, rb := buckets[i].Results[a], buckets[i].Results[b]
+			if ra.Tenant != rb.Tenant {
+				return ra.Tenant < rb.Tenant
+			}
+			if ra.Group != rb.Group {
+				return ra.Group < rb.Group
+			}
+			if ra.ClientKey != rb.ClientKey {
+				return ra.ClientKey < rb.ClientKey
+			}
+			if ra.User != rb.User {
+				return ra.User < rb.User
+			}
+			if ra.Provider != rb.Provider {
+				return ra.Provider < rb.Provider
+			}
+			if ra.KeyID != rb.KeyID {
+				return ra.KeyID < rb.KeyID
+			}
+			return ra.Model < rb.Model
+		})
+	}
+	return buckets, nil
+}
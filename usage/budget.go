@@ -0,0 +1,296 @@
+package usage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Periods a budget applies to, in calendar days and months (UTC)
+const (
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+)
+
+// ErrBudgetExceeded is returned when no candidate for a request is within its budgets
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// ErrSpendCapExceeded is returned when a client key or its tenant has used up one of its budgets.
+// It matches ErrBudgetExceeded as well.
+var ErrSpendCapExceeded error = spendCapError{}
+
+type spendCapError struct{}
+
+func (spendCapError) Error() string { return "spend cap exceeded" }
+
+func (spendCapError) Is(target error) bool { return target == ErrBudgetExceeded }
+
+// Scope selects the usage a budget applies to. Empty fields match any value.
+type Scope struct {
+	Group    string
+	Provider string
+	// KeyID identifies a provider key as "provider/hash", see KeyID
+	KeyID string
+	// ClientKey names a router client key
+	ClientKey string
+	// Model names a model of the provider
+	Model string
+	// Tenant names a tenant of client keys
+	Tenant string
+}
+
+// String describes the scope, e.g. "group fast" or "key openai/3f2a9c1d0b7e"
+func (s Scope) String() string {
+	switch {
+	case s.Tenant != "":
+		return "tenant " + s.Tenant
+	case s.ClientKey != "":
+		return "client key " + s.ClientKey
+	case s.Model != "":
+		return "model " + s.Provider + "/" + s.Model
+	case s.KeyID != "":
+		return "key " + s.KeyID
+	case s.Provider != "":
+		return "provider " + s.Provider
+	case s.Group != "":
+		return "group " + s.Group
+	}
+	return "all usage"
+}
+
+// matches reports whether usage of the key falls within the scope
+func (s Scope) matches(key Key) bool {
+	return (s.Group == "" || s.Group == key.Group) &&
+		(s.Provider == "" || s.Provider == key.Provider) &&
+		(s.KeyID == "" || s.KeyID == KeyID(key.Provider, key.KeyHash)) &&
+		(s.ClientKey == "" || s.ClientKey == key.ClientKey) &&
+		(s.Model == "" || s.Model == key.Model) &&
+		(s.Tenant == "" || s.Tenant == key.Tenant)
+}
+
+// Budget limits the tokens and/or cost in USD of a scope within a period. A zero limit is unlimited.
+type Budget struct {
+	Scope  Scope
+	Period string
+	Tokens int64
+	Cost   float64
+}
+
+// PeriodStart returns the start of the period containing t
+func PeriodStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	if period == PeriodMonth {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// PeriodEnd returns the end of the period containing t
+func PeriodEnd(period string, t time.Time) time.Time {
+	start := PeriodStart(period, t)
+	if period == PeriodMonth {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// exceeded reports whether the counts reach a limit of the budget
+func (b Budget) exceeded(spent Counts) bool {
+	return (b.Tokens > 0 && spent.TotalTokens >= b.Tokens) || (b.Cost > 0 && spent.Cost >= b.Cost)
+}
+
+// Alert reports that the usage of a budget crossed a percentage threshold of its limit
+type Alert struct {
+	Budget Budget
+	// Threshold is the crossed percentage, e.g. 80
+	Threshold float64
+	// Spent is the usage of the budget's current period
+	Spent Counts
+	// Key is the usage that crossed the threshold
+	Key Key
+}
+
+// percentUsed returns the usage of the highest limit of the budget in percent
+func (b Budget) percentUsed(spent Counts) float64 {
+	var percent float64
+	if b.Tokens > 0 {
+		percent = float64(spent.TotalTokens) / float64(b.Tokens) * 100
+	}
+	if b.Cost > 0 {
+		percent = max(percent, spent.Cost/b.Cost*100)
+	}
+	return percent
+}
+
+// Budgets tracks the usage of the current period of each budget. A nil Budgets has no limits.
+type Budgets struct {
+	// Thresholds are percentages of the budgets' limits that trigger OnThreshold when crossed
+	Thresholds []float64
+	// OnThreshold, if set, is called once per threshold and budget period
+	OnThreshold func(alert Alert)
+
+	mutex   sync.Mutex
+	budgets []Budget
+	spent   []Counts
+	starts  []time.Time
+	now     func() time.Time
+}
+
+// NewBudgets creates a tracker of the budgets. Past usage is counted by recording the entries since Earliest.
+func NewBudgets(budgets []Budget) *Budgets {
+	return &Budgets{
+		budgets: budgets,
+		spent:   make([]Counts, len(budgets)),
+		starts:  make([]time.Time, len(budgets)),
+		now:     time.Now,
+	}
+}
+
+// Earliest returns the start of the earliest current period, from which past usage counts
+func (b *Budgets) Earliest() time.Time {
+	earliest := PeriodStart(PeriodDay, b.now())
+	for _, budget := range b.budgets {
+		if start := PeriodStart(budget.Period, b.now()); start.Before(earliest) {
+			earliest = start
+		}
+	}
+	return earliest
+}
+
+// Record counts usage of the entry's hour towards the budgets whose scope and current period it falls in
+func (b *Budgets) Record(e Entry) {
+	if b == nil {
+		return
+	}
+	hour := time.Unix(e.Hour, 0)
+	var alerts []Alert
+	b.mutex.Lock()
+	for i, budget := range b.budgets {
+		b.rollover(i)
+		if !budget.Scope.matches(e.Key) || hour.Before(b.starts[i]) {
+			continue
+		}
+		before := budget.percentUsed(b.spent[i])
+		b.spent[i].Add(e.Counts)
+		after := budget.percentUsed(b.spent[i])
+		// Only the highest threshold crossed at once is reported
+		crossed := -1.0
+		for _, threshold := range b.Thresholds {
+			if before < threshold && after >= threshold && threshold > crossed {
+				crossed = threshold
+			}
+		}
+		if crossed >= 0 {
+			alerts = append(alerts, Alert{Budget: budget, Threshold: crossed, Spent: b.spent[i], Key: e.Key})
+		}
+	}
+	b.mutex.Unlock()
+
+	if b.OnThreshold != nil {
+		for _, alert := range alerts {
+			b.OnThreshold(alert)
+		}
+	}
+}
+
+// Exceeded returns an error wrapping ErrBudgetExceeded if usage of the key would fall in a scope
+// whose budget is used up. The key's hour is ignored.
+func (b *Budgets) Exceeded(key Key) error {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, budget := range b.budgets {
+		b.rollover(i)
+		if budget.Scope.matches(key) && budget.exceeded(b.spent[i]) {
+			if budget.Scope.ClientKey != "" || budget.Scope.Tenant != "" {
+				return fmt.Errorf("%w: %s budget of %s, resetting at %s", ErrSpendCapExceeded, budget.Period, budget.Scope,
+					PeriodEnd(budget.Period, b.now()).Format(time.RFC3339))
+			}
+			return fmt.Errorf("%w: %s budget of %s", ErrBudgetExceeded, budget.Period, budget.Scope)
+		}
+	}
+	return nil
+}
+
+// Remaining is the usage left within the budgets matching a key in their current periods.
+// Limits no budget sets are negative.
+type Remaining struct {
+	Tokens int64
+	Cost   float64
+	// Reset is the end of the period of the most used budget
+	Reset time.Time
+}
+
+// Remaining returns the least usage left within the budgets matching the key, and false if none matches
+func (b *Budgets) Remaining(key Key) (Remaining, bool) {
+	remaining := Remaining{Tokens: -1, Cost: -1}
+	if b == nil {
+		return remaining, false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	found := false
+	mostUsed := -1.0
+	for i, budget := range b.budgets {
+		b.rollover(i)
+		if !budget.Scope.matches(key) {
+			continue
+		}
+		found = true
+		spent := b.spent[i]
+		if budget.Tokens > 0 {
+			left := max(budget.Tokens-spent.TotalTokens, 0)
+			if remaining.Tokens < 0 || left < remaining.Tokens {
+				remaining.Tokens = left
+			}
+		}
+		if budget.Cost > 0 {
+			left := max(budget.Cost-spent.Cost, 0)
+			if remaining.Cost < 0 || left < remaining.Cost {
+				remaining.Cost = left
+			}
+		}
+		if used := budget.percentUsed(spent); used > mostUsed {
+			mostUsed = used
+			remaining.Reset = PeriodEnd(budget.Period, b.now())
+		}
+	}
+	return remaining, found
+}
+
+// BudgetUsage is the usage of a budget in its current period
+type BudgetUsage struct {
+	Budget Budget
+	Spent  Counts
+	// Reset is the end of the current period
+	Reset time.Time
+}
+
+// Usage returns the budgets matching the key with their usage in their current periods
+func (b *Budgets) Usage(key Key) []BudgetUsage {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var budgets []BudgetUsage
+	for i, budget := range b.budgets {
+		b.rollover(i)
+		if budget.Scope.matches(key) {
+			budgets = append(budgets, BudgetUsage{Budget: budget, Spent: b.spent[i], Reset: PeriodEnd(budget.Period, b.now())})
+		}
+	}
+	return budgets
+}
+
+// rollover resets the usage of a budget when its period changed
+func (b *Budgets) rollover(i int) {
+	start := PeriodStart(b.budgets[i].Period, b.now())
+	if !start.Equal(b.starts[i]) {
+		b.starts[i] = start
+		b.spent[i] = Counts{}
+	}
+}
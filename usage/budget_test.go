@@ -0,0 +1,129 @@
+package usage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBudgets(t *testing.T) {
+	clock := time.Date(2025, 3, 31, 22, 0, 0, 0, time.UTC)
+	budgets := NewBudgets([]Budget{
+		{Scope: Scope{Group: "fast"}, Period: PeriodDay, Tokens: 1000},
+		{Scope: Scope{KeyID: "openai/k0"}, Period: PeriodMonth, Cost: 1},
+	})
+	budgets.now = func() time.Time { return clock }
+	record := func(key Key, counts Counts) {
+		key.Hour = clock.Truncate(time.Hour).Unix()
+		budgets.Record(Entry{Key: key, Counts: counts})
+	}
+
+	record(Key{Group: "fast", Provider: "openai", KeyHash: "k0", Model: "gpt-4o-mini"}, Counts{TotalTokens: 600, Cost: 0.5})
+	if err := budgets.Exceeded(Key{Group: "fast"}); err != nil {
+		t.Errorf("Expected group to be within budget, got %v", err)
+	}
+	record(Key{Group: "fast", Provider: "openai", KeyHash: "k1", Model: "gpt-4o-mini"}, Counts{TotalTokens: 400})
+	if err := budgets.Exceeded(Key{Group: "fast"}); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("Expected group budget to be exceeded, got %v", err)
+	}
+	if err := budgets.Exceeded(Key{Group: "smart"}); err != nil {
+		t.Errorf("Expected other groups to be unaffected, got %v", err)
+	}
+
+	record(Key{Group: "smart", Provider: "openai", KeyHash: "k0", Model: "gpt-4o"}, Counts{TotalTokens: 100, Cost: 0.5})
+	if err := budgets.Exceeded(Key{Provider: "openai", KeyHash: "k0"}); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("Expected key budget to be exceeded across groups, got %v", err)
+	}
+	if err := budgets.Exceeded(Key{Provider: "openai", KeyHash: "k1"}); err != nil {
+		t.Errorf("Expected other keys to be unaffected, got %v", err)
+	}
+
+	spent := budgets.Usage(Key{Provider: "openai", KeyHash: "k0"})
+	if len(spent) != 1 || spent[0].Budget.Scope.KeyID != "openai/k0" || spent[0].Spent.Cost != 1 || !spent[0].Reset.Equal(time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the usage of the key budget, got %+v", spent)
+	}
+
+	// A new day resets the daily budget, and a new month the monthly one
+	clock = clock.Add(3 * time.Hour)
+	if err := budgets.Exceeded(Key{Group: "fast"}); err != nil {
+		t.Errorf("Expected daily budget to reset, got %v", err)
+	}
+	if err := budgets.Exceeded(Key{Provider: "openai", KeyHash: "k0"}); err != nil {
+		t.Errorf("Expected monthly budget to reset, got %v", err)
+	}
+
+	var unlimited *Budgets
+	if err := unlimited.Exceeded(Key{Group: "fast"}); err != nil {
+		t.Errorf("Expected nil budgets to be unlimited, got %v", err)
+	}
+}
+
+func TestBudgetThresholds(t *testing.T) {
+	clock := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	budgets := NewBudgets([]Budget{{Scope: Scope{Provider: "openai"}, Period: PeriodDay, Tokens: 1000, Cost: 10}})
+	budgets.now = func() time.Time { return clock }
+	budgets.Thresholds = []float64{50, 80, 100}
+	var alerts []Alert
+	budgets.OnThreshold = func(alert Alert) { alerts = append(alerts, alert) }
+	record := func(counts Counts) {
+		budgets.Record(Entry{Key: Key{Hour: clock.Unix(), Provider: "openai", KeyHash: "k1", Model: "gpt-4o"}, Counts: counts})
+	}
+
+	record(Counts{TotalTokens: 400, Cost: 1})
+	if len(alerts) != 0 {
+		t.Fatalf("Expected no alert below 50%%, got %+v", alerts)
+	}
+	// Cost stays low, but tokens cross 50%
+	record(Counts{TotalTokens: 200, Cost: 1})
+	if len(alerts) != 1 || alerts[0].Threshold != 50 || alerts[0].Key.KeyHash != "k1" || alerts[0].Spent.TotalTokens != 600 {
+		t.Fatalf("Expected one 50%% alert triggered by key 1, got %+v", alerts)
+	}
+	// Jumping past 80% and 100% at once reports the highest threshold
+	record(Counts{Cost: 9})
+	if len(alerts) != 2 || alerts[1].Threshold != 100 {
+		t.Fatalf("Expected one 100%% alert, got %+v", alerts)
+	}
+	record(Counts{TotalTokens: 100})
+	if len(alerts) != 2 {
+		t.Errorf("Expected crossed thresholds not to be reported again, got %+v", alerts)
+	}
+
+	// Thresholds are reported again in the next period
+	clock = clock.Add(24 * time.Hour)
+	record(Counts{TotalTokens: 500})
+	if len(alerts) != 3 || alerts[2].Threshold != 50 {
+		t.Errorf("Expected a 50%% alert in the next period, got %+v", alerts)
+	}
+}
+
+func TestClientSpendCaps(t *testing.T) {
+	clock := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	budgets := NewBudgets([]Budget{
+		{Scope: Scope{ClientKey: "ci"}, Period: PeriodMonth, Cost: 10},
+		{Scope: Scope{ClientKey: "ci"}, Period: PeriodDay, Tokens: 1000},
+		{Scope: Scope{Group: "fast"}, Period: PeriodDay, Tokens: 100},
+	})
+	budgets.now = func() time.Time { return clock }
+	budgets.Record(Entry{Key: Key{Hour: clock.Unix(), ClientKey: "ci", Provider: "openai"}, Counts: Counts{TotalTokens: 400, Cost: 7.5}})
+
+	remaining, ok := budgets.Remaining(Key{ClientKey: "ci"})
+	if !ok || remaining.Cost != 2.5 || remaining.Tokens != 600 {
+		t.Errorf("Expected the least remaining tokens and cost, got %+v", remaining)
+	}
+	// 75% of the monthly cap is used against 40% of the daily one
+	if !remaining.Reset.Equal(time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the reset of the most used budget, got %s", remaining.Reset)
+	}
+	if _, ok := budgets.Remaining(Key{ClientKey: "batch"}); ok {
+		t.Errorf("Expected no budget for other client keys")
+	}
+
+	budgets.Record(Entry{Key: Key{Hour: clock.Unix(), ClientKey: "ci", Provider: "openai"}, Counts: Counts{TotalTokens: 100, Cost: 2.5}})
+	err := budgets.Exceeded(Key{ClientKey: "ci"})
+	if !errors.Is(err, ErrSpendCapExceeded) || !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("Expected the spend cap to be exceeded, got %v", err)
+	}
+	if err := budgets.Exceeded(Key{Provider: "openai"}); err != nil {
+		t.Errorf("Expected client caps not to affect provider keys, got %v", err)
+	}
+}
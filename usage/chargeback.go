@@ -0,0 +1,97 @@
+package usage
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// TenantReport is the usage of a tenant within a calendar month (UTC), for charging back internal teams.
+// Usage of client keys outside of tenants is reported with an empty tenant.
+type TenantReport struct {
+	Tenant string `json:"tenant"`
+	Month  string `json:"month"` // YYYY-MM
+	Counts
+	Models []ModelReport `json:"models"`
+}
+
+// ModelReport is the usage of a model of a provider within a TenantReport
+type ModelReport struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Counts
+}
+
+// chargebackColumns are the CSV header of chargeback reports, one line per tenant and model
+var chargebackColumns = []string{
+	"month", "tenant", "provider", "model",
+	"requests", "input_tokens", "output_tokens", "output_reasoning_tokens", "total_tokens", "cost",
+}
+
+// Chargeback sums entries into a report per tenant of the month containing t, sorted by tenant,
+// with the usage per model sorted by provider and model
+func Chargeback(entries []Entry, t time.Time) []TenantReport {
+	start := PeriodStart(PeriodMonth, t)
+	end := PeriodEnd(PeriodMonth, t)
+	type model struct{ tenant, provider, name string }
+	tenants := make(map[string]*Counts)
+	models := make(map[model]*Counts)
+	for _, e := range entries {
+		hour := time.Unix(e.Hour, 0)
+		if hour.Before(start) || !hour.Before(end) {
+			continue
+		}
+		if tenants[e.Tenant] == nil {
+			tenants[e.Tenant] = &Counts{}
+		}
+		tenants[e.Tenant].Add(e.Counts)
+		m := model{tenant: e.Tenant, provider: e.Provider, name: e.Model}
+		if models[m] == nil {
+			models[m] = &Counts{}
+		}
+		models[m].Add(e.Counts)
+	}
+
+	reports := make([]TenantReport, 0, len(tenants))
+	for tenant, counts := range tenants {
+		report := TenantReport{Tenant: tenant, Month: start.Format("2006-01"), Counts: *counts, Models: make([]ModelReport, 0)}
+		for m, counts := range models {
+			if m.tenant == tenant {
+				report.Models = append(report.Models, ModelReport{Provider: m.provider, Model: m.name, Counts: *counts})
+			}
+		}
+		sort.Slice(report.Models, func(a, b int) bool {
+			ma, mb := report.Models[a], report.Models[b]
+			if ma.Provider != mb.Provider {
+				return ma.Provider < mb.Provider
+			}
+			return ma.Model < mb.Model
+		})
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(a, b int) bool { return reports[a].Tenant < reports[b].Tenant })
+	return reports
+}
+
+// WriteChargebackCSV writes reports as CSV with a header line and a line per tenant and model
+func WriteChargebackCSV(w io.Writer, reports []TenantReport) error {
+	writer := csv.NewWriter(w)
+	writer.Write(chargebackColumns)
+	for _, r := range reports {
+		for _, m := range r.Models {
+			writer.Write([]string{
+				r.Month, r.Tenant, m.Provider, m.Model,
+				strconv.FormatInt(m.Requests, 10),
+				strconv.FormatInt(m.PromptTokens, 10),
+				strconv.FormatInt(m.CompletionTokens, 10),
+				strconv.FormatInt(m.ReasoningTokens, 10),
+				strconv.FormatInt(m.TotalTokens, 10),
+				strconv.FormatFloat(m.Cost, 'f', -1, 64),
+			})
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,44 @@
+package usage
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChargeback(t *testing.T) {
+	march := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	at := func(t time.Time) int64 { return t.Unix() }
+	entries := []Entry{
+		{Key: Key{Hour: at(march.Add(time.Hour)), Tenant: "acme", ClientKey: "acme-backend", Provider: "openai", Model: "gpt-4o"}, Counts: Counts{Requests: 2, TotalTokens: 100, Cost: 1}},
+		{Key: Key{Hour: at(march.AddDate(0, 0, 30)), Tenant: "acme", ClientKey: "acme-batch", Provider: "openai", Model: "gpt-4o"}, Counts: Counts{Requests: 1, TotalTokens: 50, Cost: 0.5}},
+		{Key: Key{Hour: at(march.AddDate(0, 0, 2)), Tenant: "acme", Provider: "anthropic", Model: "claude-sonnet"}, Counts: Counts{Requests: 1, TotalTokens: 10, Cost: 0.25}},
+		{Key: Key{Hour: at(march.AddDate(0, 0, 3)), Tenant: "globex", Provider: "openai", Model: "gpt-4o-mini"}, Counts: Counts{Requests: 4, TotalTokens: 40}},
+		// Outside of the month
+		{Key: Key{Hour: at(march.AddDate(0, 1, 0)), Tenant: "acme", Provider: "openai", Model: "gpt-4o"}, Counts: Counts{Requests: 9, TotalTokens: 900}},
+	}
+
+	reports := Chargeback(entries, march.AddDate(0, 0, 15))
+	if len(reports) != 2 || reports[0].Tenant != "acme" || reports[1].Tenant != "globex" {
+		t.Fatalf("Expected a report per tenant, got %+v", reports)
+	}
+	acme := reports[0]
+	if acme.Month != "2025-03" || acme.Requests != 4 || acme.TotalTokens != 160 || acme.Cost != 1.75 {
+		t.Errorf("Expected the tenant's usage of the month summed across client keys, got %+v", acme)
+	}
+	if len(acme.Models) != 2 || acme.Models[0].Provider != "anthropic" || acme.Models[1].Requests != 3 || acme.Models[1].Cost != 1.5 {
+		t.Errorf("Expected the tenant's usage per model, got %+v", acme.Models)
+	}
+
+	var b strings.Builder
+	if err := WriteChargebackCSV(&b, reports); err != nil {
+		t.Fatalf("Failed to write CSV: %v", err)
+	}
+	expected := "month,tenant,provider,model,requests,input_tokens,output_tokens,output_reasoning_tokens,total_tokens,cost\n" +
+		"2025-03,acme,anthropic,claude-sonnet,1,0,0,0,10,0.25\n" +
+		"2025-03,acme,openai,gpt-4o,3,0,0,0,150,1.5\n" +
+		"2025-03,globex,openai,gpt-4o-mini,4,0,0,0,40,0\n"
+	if b.String() != expected {
+		t.Errorf("Unexpected CSV:\n%s", b.String())
+	}
+}
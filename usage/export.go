@@ -0,0 +1,77 @@
+package usage
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+// ExportRow is the daily usage of a model with a provider key by a client key and end user, for billing
+type ExportRow struct {
+	Date             string  `json:"date"` // YYYY-MM-DD (UTC)
+	Group            string  `json:"group"`
+	ClientKey        string  `json:"client_key"`
+	User             string  `json:"user"`
+	Provider         string  `json:"provider"`
+	KeyID            string  `json:"api_key_id"`
+	Model            string  `json:"model"`
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"input_tokens"`
+	CompletionTokens int64   `json:"output_tokens"`
+	ReasoningTokens  int64   `json:"output_reasoning_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// exportColumns are the CSV header, in the order of the ExportRow fields
+var exportColumns = []string{
+	"date", "group", "client_key", "user", "provider", "api_key_id", "model",
+	"requests", "input_tokens", "output_tokens", "output_reasoning_tokens", "total_tokens", "cost",
+}
+
+// Export sums entries into rows per UTC day within [start, end), group, client key, end user, provider key, and model
+func Export(entries []Entry, start, end time.Time) []ExportRow {
+	groupBy := []string{GroupByGroup, GroupByClient, GroupByUser, GroupByProvider, GroupByKey, GroupByModel}
+	buckets, _ := Aggregate(entries, start, end, 24*time.Hour, groupBy)
+	rows := make([]ExportRow, 0)
+	for _, b := range buckets {
+		for _, r := range b.Results {
+			rows = append(rows, ExportRow{
+				Date:             b.Start.Format(time.DateOnly),
+				Group:            r.Group,
+				ClientKey:        r.ClientKey,
+				User:             r.User,
+				Provider:         r.Provider,
+				KeyID:            r.KeyID,
+				Model:            r.Model,
+				Requests:         r.Requests,
+				PromptTokens:     r.PromptTokens,
+				CompletionTokens: r.CompletionTokens,
+				ReasoningTokens:  r.ReasoningTokens,
+				TotalTokens:      r.TotalTokens,
+				Cost:             r.Cost,
+			})
+		}
+	}
+	return rows
+}
+
+// WriteCSV writes rows as CSV with a header line
+func WriteCSV(w io.Writer, rows []ExportRow) error {
+	writer := csv.NewWriter(w)
+	writer.Write(exportColumns)
+	for _, r := range rows {
+		writer.Write([]string{
+			r.Date, r.Group, r.ClientKey, r.User, r.Provider, r.KeyID, r.Model,
+			strconv.FormatInt(r.Requests, 10),
+			strconv.FormatInt(r.PromptTokens, 10),
+			strconv.FormatInt(r.CompletionTokens, 10),
+			strconv.FormatInt(r.ReasoningTokens, 10),
+			strconv.FormatInt(r.TotalTokens, 10),
+			strconv.FormatFloat(r.Cost, 'f', -1, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,43 @@
+package usage
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	store, err := NewStore("")
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	clock := day.Add(9 * time.Hour)
+	store.now = func() time.Time { return clock }
+	key := Key{Group: "smart", ClientKey: "ci", User: "alice", Provider: "openai", KeyHash: "k1", Model: "gpt-4o"}
+	store.Record(key, Counts{Requests: 1, PromptTokens: 80, CompletionTokens: 20, TotalTokens: 100, Cost: 0.25})
+	clock = day.Add(15 * time.Hour)
+	store.Record(key, Counts{Requests: 1, PromptTokens: 40, CompletionTokens: 10, TotalTokens: 50, Cost: 0.125})
+	clock = day.Add(30 * time.Hour)
+	store.Record(Key{Provider: "openai", KeyHash: "k0", Model: "gpt-4o-mini"}, Counts{Requests: 2, TotalTokens: 10})
+
+	end := day.Add(48 * time.Hour)
+	rows := Export(store.Entries(day, end), day, end)
+	if len(rows) != 2 {
+		t.Fatalf("Expected a row per day and dimensions, got %+v", rows)
+	}
+	if r := rows[0]; r.Date != "2025-03-01" || r.ClientKey != "ci" || r.User != "alice" || r.KeyID != "openai/k1" || r.Requests != 2 || r.TotalTokens != 150 || r.Cost != 0.375 {
+		t.Errorf("Expected the usage of the first day summed, got %+v", r)
+	}
+
+	var b strings.Builder
+	if err := WriteCSV(&b, rows); err != nil {
+		t.Fatalf("Failed to write CSV: %v", err)
+	}
+	expected := "date,group,client_key,user,provider,api_key_id,model,requests,input_tokens,output_tokens,output_reasoning_tokens,total_tokens,cost\n" +
+		"2025-03-01,smart,ci,alice,openai,openai/k1,gpt-4o,2,120,30,0,150,0.375\n" +
+		"2025-03-02,,,,openai,openai/k0,gpt-4o-mini,2,0,0,0,10,0\n"
+	if b.String() != expected {
+		t.Errorf("Unexpected CSV:\n%s", b.String())
+	}
+}
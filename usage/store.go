@@ -0,0 +1,228 @@
+package usage
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"llm-router/utils"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Key identifies the usage of a model with a provider key within an hour
+type Key struct {
+	Hour int64 `json:"hour"` // Unix time of the start of the hour
+	// Group the requests were routed through, empty for passthrough endpoints
+	Group string `json:"group,omitempty"`
+	// ClientKey names the router client key the requests were made with
+	ClientKey string `json:"client_key,omitempty"`
+	// Tenant the client key belongs to
+	Tenant string `json:"tenant,omitempty"`
+	// User is the end user the requests were made for, from the request's user field or the end user header
+	User     string `json:"user,omitempty"`
+	Provider string `json:"provider"`
+	// KeyHash identifies the provider key, see KeyHash
+	KeyHash string `json:"key_hash"`
+	Model   string `json:"model"`
+}
+
+// Counts are the accumulated usage of a Key
+type Counts struct {
+	Requests         int64 `json:"requests"`
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	ReasoningTokens  int64 `json:"reasoning_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+	// Cost in USD, of models with a configured price
+	Cost float64 `json:"cost"`
+}
+
+// Add adds the counts of other
+func (c *Counts) Add(other Counts) {
+	c.Requests += other.Requests
+	c.PromptTokens += other.PromptTokens
+	c.CompletionTokens += other.CompletionTokens
+	c.ReasoningTokens += other.ReasoningTokens
+	c.TotalTokens += other.TotalTokens
+	c.Cost += other.Cost
+}
+
+// Entry is the usage of a Key
+type Entry struct {
+	Key
+	Counts
+}
+
+// Store accumulates usage in hourly buckets per provider key and model.
+// When created with a path, the usage is loaded from and saved to that file.
+type Store struct {
+	mutex   sync.Mutex
+	buckets map[Key]*Counts
+	path    string
+	dirty   bool
+	now     func() time.Time
+	// changes accumulates the usage recorded since HandOver, nil unless the usage was handed over
+	changes map[Key]*Counts
+}
+
+// NewStore creates a store persisted to path, loading the usage saved there if any.
+// An empty path creates an in-memory store.
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		buckets: make(map[Key]*Counts),
+		path:    path,
+		now:     time.Now,
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		counts := e.Counts
+		s.buckets[e.Key] = &counts
+	}
+	return s, nil
+}
+
+// Record adds usage of a key at the current time, ignoring the key's hour, and returns the recorded entry
+func (s *Store) Record(key Key, counts Counts) Entry {
+	key.Hour = s.now().Truncate(time.Hour).Unix()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	addCounts(s.buckets, key, counts)
+	if s.changes != nil {
+		addCounts(s.changes, key, counts)
+	}
+	s.dirty = true
+	return Entry{Key: key, Counts: counts}
+}
+
+// Add adds the usage of entries to their hours, e.g. the usage a previous process recorded after handing its
+// usage over
+func (s *Store) Add(entries []Entry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, e := range entries {
+		addCounts(s.buckets, e.Key, e.Counts)
+	}
+	if len(entries) > 0 {
+		s.dirty = true
+	}
+}
+
+func addCounts(buckets map[Key]*Counts, key Key, counts Counts) {
+	bucket, ok := buckets[key]
+	if !ok {
+		bucket = &Counts{}
+		buckets[key] = bucket
+	}
+	bucket.Add(counts)
+}
+
+// Entries returns the usage of the hours in [start, end), ordered by hour
+func (s *Store) Entries(start, end time.Time) []Entry {
+	s.mutex.Lock()
+	entries := make([]Entry, 0, len(s.buckets))
+	for key, counts := range s.buckets {
+		hour := time.Unix(key.Hour, 0)
+		if !hour.Before(start.Truncate(time.Hour)) && hour.Before(end) {
+			entries = append(entries, Entry{Key: key, Counts: *counts})
+		}
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Hour != b.Hour {
+			return a.Hour < b.Hour
+		}
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		if a.ClientKey != b.ClientKey {
+			return a.ClientKey < b.ClientKey
+		}
+		if a.Provider != b.Provider {
+			return a.Provider < b.Provider
+		}
+		if a.KeyHash != b.KeyHash {
+			return a.KeyHash < b.KeyHash
+		}
+		return a.Model < b.Model
+	})
+	return entries
+}
+
+// Save writes the usage to the store's file if it changed since the last save. It does nothing once the
+// usage was handed over, until the changes since are taken, as the file is then the new process's.
+func (s *Store) Save() error {
+	return s.save(false)
+}
+
+// HandOver saves the usage for a new process to load and tracks the usage recorded from then on, which
+// Changes returns for the new process to add, rather than saving it over the file the new process writes
+func (s *Store) HandOver() error {
+	return s.save(true)
+}
+
+// Changes returns the usage recorded since HandOver, and saves resume. It returns nil when the usage was not
+// handed over.
+func (s *Store) Changes() []Entry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.changes == nil {
+		return nil
+	}
+	entries := make([]Entry, 0, len(s.changes))
+	for key, counts := range s.changes {
+		entries = append(entries, Entry{Key: key, Counts: *counts})
+	}
+	s.changes = nil
+	return entries
+}
+
+func (s *Store) save(handOver bool) error {
+	s.mutex.Lock()
+	if s.changes != nil {
+		s.mutex.Unlock()
+		return nil
+	}
+	if handOver {
+		s.changes = make(map[Key]*Counts)
+	}
+	if s.path == "" || !s.dirty {
+		s.mutex.Unlock()
+		return nil
+	}
+	entries := make([]Entry, 0, len(s.buckets))
+	for key, counts := range s.buckets {
+		entries = append(entries, Entry{Key: key, Counts: *counts})
+	}
+	s.dirty = false
+	s.mutex.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err == nil {
+		err = utils.WriteFileAtomic(s.path, data)
+	}
+	if err != nil {
+		s.mutex.Lock()
+		s.dirty = true
+		s.mutex.Unlock()
+	}
+	return err
+}
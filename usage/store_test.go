@@ -0,0 +1,125 @@
+package usage
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStorePersistsAndAggregates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	clock := day.Add(9 * time.Hour)
+	store.now = func() time.Time { return clock }
+	store.Record(Key{Provider: "openai", KeyHash: "k0", Model: "gpt-4o"}, Counts{Requests: 1, TotalTokens: 100})
+	store.Record(Key{Provider: "openai", KeyHash: "k1", Model: "gpt-4o"}, Counts{Requests: 1, TotalTokens: 50})
+	clock = day.Add(30 * time.Hour)
+	store.Record(Key{Provider: "openai", KeyHash: "k0", Model: "gpt-4o-mini"}, Counts{Requests: 2, TotalTokens: 10})
+
+	if err := store.Save(); err != nil {
+		t.Fatalf("Failed to save store: %v", err)
+	}
+	loaded, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("Failed to load store: %v", err)
+	}
+
+	end := day.Add(48 * time.Hour)
+	entries := loaded.Entries(day, end)
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 persisted entries, got %d", len(entries))
+	}
+
+	buckets, err := Aggregate(entries, day, end, 24*time.Hour, []string{GroupByModel})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(buckets) != 2 {
+		t.Fatalf("Expected 2 daily buckets, got %d", len(buckets))
+	}
+	first := buckets[0].Results
+	if len(first) != 1 || first[0].Model != "gpt-4o" || first[0].Requests != 2 || first[0].TotalTokens != 150 {
+		t.Errorf("Expected both keys summed for gpt-4o on the first day, got %+v", first)
+	}
+	second := buckets[1].Results
+	if len(second) != 1 || second[0].Model != "gpt-4o-mini" || second[0].TotalTokens != 10 {
+		t.Errorf("Expected gpt-4o-mini on the second day, got %+v", second)
+	}
+
+	buckets, _ = Aggregate(entries, day, day.Add(24*time.Hour), 24*time.Hour, []string{GroupByKey})
+	if results := buckets[0].Results; len(results) != 2 || results[0].KeyID != "openai/k0" || results[1].TotalTokens != 50 {
+		t.Errorf("Expected usage per key, got %+v", results)
+	}
+
+	loaded.now = store.now
+	loaded.Record(Key{User: "alice", Provider: "openai", Model: "gpt-4o"}, Counts{Requests: 1, TotalTokens: 7})
+	buckets, _ = Aggregate(loaded.Entries(day, end), day, end, 48*time.Hour, []string{GroupByUser})
+	if results := buckets[0].Results; len(results) != 2 || results[0].User != "" || results[1].User != "alice" || results[1].TotalTokens != 7 {
+		t.Errorf("Expected usage per end user, got %+v", results)
+	}
+
+	if _, err := Aggregate(entries, day, end, time.Hour, []string{"project_id"}); err == nil {
+		t.Errorf("Expected an error for an unsupported group_by value")
+	}
+}
+
+func TestKeyHash(t *testing.T) {
+	hash := KeyHash("sk-secret")
+	if len(hash) != 12 || strings.Contains(hash, "secret") || hash != KeyHash("sk-secret") || hash == KeyHash("sk-other") {
+		t.Errorf("Expected a short stable hash per key, got %q", hash)
+	}
+	if id := KeyID("openai", hash); id != "openai/"+hash {
+		t.Errorf("Expected the provider and hash, got %q", id)
+	}
+}
+
+func TestStoreHandOver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	old, _ := NewStore(path)
+	key := Key{Provider: "openai", KeyHash: "k0", Model: "gpt-4o"}
+	old.Record(key, Counts{Requests: 1, TotalTokens: 100})
+	if err := old.HandOver(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new process loads the saved usage, and the old one no longer writes the file
+	taking, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Record(key, Counts{Requests: 1, TotalTokens: 20})
+	taking.Record(key, Counts{Requests: 1, TotalTokens: 5})
+	if err := taking.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := NewStore(path); saved.Entries(time.Unix(0, 0), time.Now().Add(time.Hour))[0].TotalTokens != 105 {
+		t.Errorf("Expected the file to be left to the new process")
+	}
+
+	// The usage the old process recorded since is added to the new one's
+	changes := old.Changes()
+	if len(changes) != 1 || changes[0].Requests != 1 || changes[0].TotalTokens != 20 {
+		t.Fatalf("Expected the usage recorded since the handover, got %+v", changes)
+	}
+	taking.Add(changes)
+	if err := taking.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ := NewStore(path)
+	entries := loaded.Entries(time.Unix(0, 0), time.Now().Add(time.Hour))
+	if len(entries) != 1 || entries[0].Requests != 3 || entries[0].TotalTokens != 125 {
+		t.Errorf("Expected the usage of both processes, got %+v", entries)
+	}
+	if old.Changes() != nil {
+		t.Errorf("Expected no changes once taken")
+	}
+}
@@ -0,0 +1,59 @@
+//go:build ignore
+
+// fetch_encodings downloads the tiktoken encoding files embedded in the router's binary into encodings/,
+// checking them against the hashes tiktoken publishes
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// encodings are the SHA-256 hashes of the encoding files by name
+var encodings = map[string]string{
+	"cl100k_base": "223921b76ee99bde995b7ff738513eef100fb51d18c93597a113bcffe865b2a7",
+	"o200k_base":  "446a9538cb6c348e3516120d7c08b09f57c36495e2acfffe59a5bf8b0cfb1a2d",
+}
+
+func main() {
+	for name, hash := range encodings {
+		if err := fetch(name, hash); err != nil {
+			fmt.Fprintf(os.Stderr, "fetch %s: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// fetch downloads an encoding file unless it is there already with the expected hash
+func fetch(name string, hash string) error {
+	path := filepath.Join("encodings", name+".tiktoken")
+	if data, err := os.ReadFile(path); err == nil && checksum(data) == hash {
+		return nil
+	}
+	resp, err := http.Get("https://openaipublic.blob.core.windows.net/encodings/" + name + ".tiktoken")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if sum := checksum(data); sum != hash {
+		return fmt.Errorf("hash %s, expected %s", sum, hash)
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
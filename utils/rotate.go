@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile appends to a file and rotates it once it would grow past a maximum size: the file is renamed
+// with the suffix .1, the previous .1 to .2, and so on, keeping a maximum number of rotated files
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+	// following is set once another process rotates the file, see Follow
+	following bool
+}
+
+// OpenRotatingFile opens the file at path for appending, never rotating it when maxSize is 0
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Follow stops rotating the file, for when another process appending to it rotates it instead. From then on,
+// p is appended to the file at the path, which is reopened when the other process replaced it.
+func (f *RotatingFile) Follow() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.following = true
+}
+
+// Write appends p to the file, rotating it first if p would make it larger than the maximum size
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.following {
+		if err := f.reopen(); err != nil {
+			return 0, err
+		}
+		return f.file.Write(p)
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file and its rotated files and opens a new file, dropping the oldest rotated file
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", f.path, i) }
+	if f.maxBackups > 0 {
+		os.Remove(backup(f.maxBackups))
+		for i := f.maxBackups - 1; i >= 1; i-- {
+			os.Rename(backup(i), backup(i+1))
+		}
+		if err := os.Rename(f.path, backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// reopen opens the file at the path again if it is no longer the file being appended to, e.g. once it was
+// rotated by another process
+func (f *RotatingFile) reopen() error {
+	current, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(f.path); err == nil && os.SameFile(info, current) {
+		return nil
+	}
+	f.file.Close()
+	return f.open()
+}
+
+// Close closes the file
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFileFollow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.log")
+	old, err := OpenRotatingFile(path, 20, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	old.Write([]byte("old 1\n"))
+
+	// The new process of a handover rotates the file, the old one follows it
+	old.Follow()
+	taking, err := OpenRotatingFile(path, 20, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taking.Close()
+	for _, line := range []string{"new 1\n", "new 2\n", "old 2\n", "new 3\n", "old 3\n"} {
+		file := taking
+		if strings.HasPrefix(line, "old") {
+			file = old
+		}
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatalf("Failed to write %q: %v", line, err)
+		}
+	}
+
+	read := func(name string) string {
+		data, _ := os.ReadFile(name)
+		return string(data)
+	}
+	if current := read(path); current != "new 3\nold 3\n" {
+		t.Errorf("Expected the old process to append to the file at the path once rotated, got %q", current)
+	}
+	if rotated := read(path + ".1"); rotated != "old 1\nnew 1\nnew 2\nold 2\n" {
+		t.Errorf("Expected the lines of both processes in the file rotated by the new process, got %q", rotated)
+	}
+	if _, err := os.Stat(path + ".2"); err == nil {
+		t.Error("Expected the file rotated by the new process only")
+	}
+}
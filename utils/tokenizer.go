@@ -0,0 +1,258 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+)
+
+// Tokenizer is a byte-pair encoding tokenizer of a tiktoken encoding such as cl100k_base or o200k_base,
+// counting tokens exactly as OpenAI's models do
+type Tokenizer struct {
+	encoding *tiktoken.Tiktoken
+}
+
+// LoadTokenizer loads a tokenizer of an encoding from a tiktoken encoding file, made of "<base64 token> <rank>"
+// lines
+func LoadTokenizer(encoding string, path string) (*Tokenizer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewTokenizer(encoding, data)
+}
+
+// loadingMutex serializes the creation of tokenizers, which hand their ranks to tiktoken through its global
+// loader
+var loadingMutex sync.Mutex
+
+// ranksLoader is a tiktoken loader serving the ranks already parsed from an encoding file
+type ranksLoader map[string]int
+
+func (r ranksLoader) LoadTiktokenBpe(string) (map[string]int, error) {
+	return r, nil
+}
+
+// NewTokenizer creates a tokenizer of an encoding from the contents of its tiktoken encoding file; the
+// pre-tokenization pattern and special tokens are those of the encoding
+func NewTokenizer(encoding string, data []byte) (*Tokenizer, error) {
+	ranks := make(ranksLoader)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := bytes.Fields(scanner.Bytes())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a token and a rank", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(string(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid token: %w", line, err)
+		}
+		rank, err := strconv.Atoi(string(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid rank: %w", line, err)
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("no tokens found")
+	}
+	loadingMutex.Lock()
+	defer loadingMutex.Unlock()
+	tiktoken.SetBpeLoader(ranks)
+	enc, err := tiktoken.GetEncoding(encoding)
+	if err != nil {
+		return nil, err
+	}
+	return &Tokenizer{encoding: enc}, nil
+}
+
+// encodingFiles are the tiktoken encoding files embedded in the binary, fetched into encodings/ by go generate
+//
+//go:generate go run fetch_encodings.go
+//go:embed encodings
+var encodingFiles embed.FS
+
+// embeddedTokenizers are the tokenizers of the embedded encodings by name, loaded on first use
+var embeddedTokenizers sync.Map
+
+// EmbeddedTokenizer returns the tokenizer of an encoding embedded in the binary, or nil when the encoding was
+// not embedded
+func EmbeddedTokenizer(encoding string) *Tokenizer {
+	load, _ := embeddedTokenizers.LoadOrStore(encoding, sync.OnceValue(func() *Tokenizer {
+		data, err := encodingFiles.ReadFile("encodings/" + encoding + ".tiktoken")
+		if err != nil {
+			return nil
+		}
+		tokenizer, err := NewTokenizer(encoding, data)
+		if err != nil {
+			return nil
+		}
+		return tokenizer
+	}))
+	return load.(func() *Tokenizer)()
+}
+
+// Encode converts a text into token IDs. Special tokens such as <|endoftext|> in the text are encoded as
+// ordinary text, as the providers do with the content of messages.
+func (t *Tokenizer) Encode(text string) []int {
+	return t.encoding.EncodeOrdinary(text)
+}
+
+// Count returns the number of tokens of a text
+func (t *Tokenizer) Count(text string) int {
+	return len(t.Encode(text))
+}
+
+// Decode converts token IDs back into text
+func (t *Tokenizer) Decode(tokens []int) (string, error) {
+	var buf strings.Builder
+	for _, token := range tokens {
+		// Tokens of the encoding all decode to at least a byte
+		piece := t.encoding.Decode([]int{token})
+		if piece == "" {
+			return "", fmt.Errorf("unknown token %d", token)
+		}
+		buf.WriteString(piece)
+	}
+	return buf.String(), nil
+}
+
+// EstimateTokens roughly estimates the number of tokens of a text without a tokenizer
+func EstimateTokens(text string) int {
+	count := 0
+	for _, piece := range splitText(text) {
+		count += (len(piece) + 3) / 4
+	}
+	return count
+}
+
+// splitText splits a text into the pieces encoded separately by byte-pair encoding,
+// following the pre-tokenization of the cl100k_base and o200k_base encodings:
+// contractions, words with an optional leading character, up to three digits,
+// punctuation runs, and whitespace.
+func splitText(text string) []string {
+	pieces := make([]string, 0, len(text)/4)
+	for i := 0; i < len(text); {
+		n := nextPiece(text[i:])
+		pieces = append(pieces, text[i:i+n])
+		i += n
+	}
+	return pieces
+}
+
+// nextPiece returns the length of the piece at the start of s
+func nextPiece(s string) int {
+	r, size := utf8.DecodeRuneInString(s)
+
+	// Contractions such as 's, 're, 'll
+	if r == '\'' {
+		for _, suffix := range []string{"s", "t", "re", "ve", "m", "ll", "d"} {
+			if len(s) > len(suffix) && equalFoldASCII(s[1:1+len(suffix)], suffix) {
+				return 1 + len(suffix)
+			}
+		}
+	}
+
+	// Words, optionally preceded by a single non-letter, non-digit character
+	if isLetter(r) {
+		return size + runLength(s[size:], isLetter)
+	}
+	if !isNumber(r) && r != '\r' && r != '\n' {
+		if next, nextSize := utf8.DecodeRuneInString(s[size:]); isLetter(next) {
+			return size + nextSize + runLength(s[size+nextSize:], isLetter)
+		}
+	}
+
+	// Numbers of up to three digits
+	if isNumber(r) {
+		n := size
+		for digits := 1; digits < 3 && n < len(s); digits++ {
+			next, nextSize := utf8.DecodeRuneInString(s[n:])
+			if !isNumber(next) {
+				break
+			}
+			n += nextSize
+		}
+		return n
+	}
+
+	// Punctuation, optionally preceded by a space and followed by newlines
+	start := 0
+	if r == ' ' {
+		start = size
+	}
+	if n := runLength(s[start:], isPunctuation); n > 0 {
+		n += start
+		return n + runLength(s[n:], func(r rune) bool { return r == '\r' || r == '\n' })
+	}
+
+	// Whitespace: up to the last newline of the run, or all but the last character before a word
+	n := runLength(s, unicode.IsSpace)
+	if n == 0 {
+		return size
+	}
+	if last := lastNewline(s[:n]); last >= 0 {
+		return last + 1
+	}
+	if n == len(s) {
+		return n
+	}
+	if _, lastSize := utf8.DecodeLastRuneInString(s[:n]); n > lastSize {
+		return n - lastSize
+	}
+	return n
+}
+
+func isLetter(r rune) bool {
+	return unicode.IsLetter(r) || unicode.Is(unicode.M, r)
+}
+
+func isNumber(r rune) bool {
+	return unicode.IsNumber(r)
+}
+
+func isPunctuation(r rune) bool {
+	return !unicode.IsSpace(r) && !isLetter(r) && !isNumber(r)
+}
+
+// runLength returns the length in bytes of the prefix of s whose runes satisfy f
+func runLength(s string, f func(rune) bool) int {
+	n := 0
+	for n < len(s) {
+		r, size := utf8.DecodeRuneInString(s[n:])
+		if !f(r) {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+func lastNewline(s string) int {
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] == '\n' || s[i] == '\r' {
+			return i
+		}
+	}
+	return -1
+}
+
+func equalFoldASCII(a, b string) bool {
+	return bytes.EqualFold([]byte(a), []byte(b))
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitText(t *testing.T) {
+	pieces := splitText("Hello world, it's 12345!\n\n  ok  ")
+	expected := []string{"Hello", " world", ",", " it", "'s", " ", "123", "45", "!\n\n", " ", " ok", "  "}
+	if !reflect.DeepEqual(pieces, expected) {
+		t.Errorf("Expected pieces %q, got %q", expected, pieces)
+	}
+}
+
+func TestTokenizerRoundTrip(t *testing.T) {
+	// Single bytes followed by a few merges, in tiktoken file format
+	var file strings.Builder
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&file, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), i)
+	}
+	for i, merge := range []string{"he", "ll", "hell", " w"} {
+		fmt.Fprintf(&file, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(merge)), 256+i)
+	}
+
+	tokenizer, err := NewTokenizer("cl100k_base", []byte(file.String()))
+	if err != nil {
+		t.Fatalf("Failed to load tokenizer: %v", err)
+	}
+
+	tokens := tokenizer.Encode("hello world")
+	expected := []int{258, 'o', 259, 'o', 'r', 'l', 'd'}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Expected tokens %v, got %v", expected, tokens)
+	}
+
+	text, err := tokenizer.Decode(tokens)
+	if err != nil || text != "hello world" {
+		t.Errorf("Expected decoded text 'hello world', got '%s' (%v)", text, err)
+	}
+	if _, err := tokenizer.Decode([]int{1000}); err == nil {
+		t.Errorf("Expected an error for an unknown token")
+	}
+}
+
+func TestEmbeddedTokenizer(t *testing.T) {
+	tokenizer := EmbeddedTokenizer("cl100k_base")
+	if tokenizer == nil {
+		t.Skip("cl100k_base is not embedded, see go generate")
+	}
+	if tokens := tokenizer.Encode("hello world"); !reflect.DeepEqual(tokens, []int{15339, 1917}) {
+		t.Errorf("Expected the tokens of cl100k_base, got %v", tokens)
+	}
+	if EmbeddedTokenizer("p50k_base") != nil {
+		t.Errorf("Expected no tokenizer of an encoding not embedded")
+	}
+}
@@ -19,23 +19,44 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
-	"unicode"
 )
 
-// RedactAuthorization redacts sensitive information from authorization keys.
+// RedactAuthorization redacts the credentials of an Authorization header, keeping its scheme, so that no
+// part of a key is logged.
 func RedactAuthorization(auth string) string {
-	if strings.HasPrefix(auth, "Bearer ") && len(auth) > 29 {
-		// Display the first 3 characters, ellipses, and the last 4 characters
-		return auth[:10] + "..." + auth[len(auth)-4:]
+	if auth == "" {
+		return ""
 	}
-	// Replace each non-whitespace character with '*'
-	return strings.Map(func(r rune) rune {
-		if unicode.IsSpace(r) {
-			return r
-		}
-		return '*'
-	}, auth)
+	if scheme, _, found := strings.Cut(auth, " "); found {
+		return scheme + " [REDACTED]"
+	}
+	return "[REDACTED]"
+}
+
+// sensitiveHeaders are the headers whose values are redacted from the logs, lowercase
+var sensitiveHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"x-api-key":           true,
+	"api-key":             true,
+	"cookie":              true,
+	"set-cookie":          true,
+}
+
+// Truncate shortens a text logged to at most limit characters, noting how many were left out. Texts are
+// left out entirely when limit is 0.
+func Truncate(text string, limit int) string {
+	if limit <= 0 {
+		return ""
+	}
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return fmt.Sprintf("%s... (%d more characters)", string(runes[:limit]), len(runes)-limit)
 }
 
 // DrainBody reads the body of an HTTP request and returns a new reader with the same content
@@ -65,26 +86,30 @@ func formatJSON(data []byte) string {
 	return string(data)
 }
 
-// LogRequestResponse logs the full request and response details when debug logging is enabled
+// LogRequestResponse logs the full request and response details when debug logging is enabled, without
+// credentials. Bodies are logged as given, when not empty, so callers truncate or leave them out.
 func LogRequestResponse(logger *slog.Logger, req *http.Request, resp *http.Response, reqBody, respBody string) {
 	if req != nil {
 		// Log request headers
 		headers := make(map[string]string)
 		for name, values := range req.Header {
-			// Don't log authorization header directly
-			if strings.ToLower(name) == "authorization" {
+			// Don't log credentials
+			if sensitiveHeaders[strings.ToLower(name)] {
 				headers[name] = RedactAuthorization(values[0])
 			} else {
 				headers[name] = strings.Join(values, ", ")
 			}
 		}
 
-		logger.Debug("Full request details",
+		attrs := []any{
 			slog.String("method", req.Method),
 			slog.String("url", req.URL.String()),
 			slog.Any("headers", headers),
-			slog.String("body", reqBody),
-		)
+		}
+		if reqBody != "" {
+			attrs = append(attrs, slog.String("body", reqBody))
+		}
+		logger.Debug("Full request details", attrs...)
 	}
 
 	if resp != nil {
@@ -94,11 +119,14 @@ func LogRequestResponse(logger *slog.Logger, req *http.Request, resp *http.Respo
 			headers[name] = strings.Join(values, ", ")
 		}
 
-		logger.Debug("Full response details",
+		attrs := []any{
 			slog.Int("status", resp.StatusCode),
 			slog.Any("headers", headers),
-			slog.String("body", respBody),
-		)
+		}
+		if respBody != "" {
+			attrs = append(attrs, slog.String("body", respBody))
+		}
+		logger.Debug("Full response details", attrs...)
 	}
 }
 
@@ -309,3 +337,20 @@ func GenerateStrongAPIKey() (string, error) {
 
 	return "rsk_" + string(result), nil
 }
+
+// WriteFileAtomic replaces the file at path with data, so readers never see a partial file
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"llm-router/app"
+	"llm-router/config"
+)
+
+// validateConfig runs the validate command, printing every problem found in the configuration without
+// starting the router, and fails if some of them are errors
+func validateConfig(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := flags.String("config", config.DefaultPath(), "configuration file: YAML, JSON, or TOML")
+	flags.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	problems := app.ValidateConfig(cfg)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	errors := 0
+	for _, p := range problems {
+		if !p.Warning {
+			errors++
+		}
+	}
+	if errors > 0 {
+		return fmt.Errorf("%s has %d errors", *configPath, errors)
+	}
+	fmt.Printf("%s is valid\n", *configPath)
+	return nil
+}